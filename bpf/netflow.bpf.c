@@ -0,0 +1,189 @@
+// SPDX-License-Identifier: (GPL-2.0-only OR BSD-2-Clause)
+/*
+ * Per-process TCP telemetry for the NetFlow collector: bytes sent and received,
+ * retransmits and connect latency, keyed by process ID.
+ *
+ * Built once by `make bpf` as a CO-RE object. Kernel struct accesses are relocated
+ * against the running kernel's BTF when the agent loads the object, so the same
+ * file runs across kernel versions. Needs Linux 5.5+ with CONFIG_DEBUG_INFO_BTF.
+ *
+ * The counters are cumulative; the agent turns them into per-interval deltas.
+ */
+#include "vmlinux.h"
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include <bpf/bpf_core_read.h>
+
+#define MAX_PROCESSES 16384
+#define MAX_SOCKETS 65536
+#define TASK_COMM_LEN 16
+
+/* flow_counters is read by bpfFlowCounters in the agent; keep the layouts in sync */
+struct flow_counters {
+	__u64 bytes_sent;
+	__u64 bytes_received;
+	__u64 retransmits;
+	__u64 connects;
+	__u64 connect_latency_ns;
+	char comm[TASK_COMM_LEN];
+};
+
+/* socket_owner is read by bpfSocketOwner in the agent */
+struct socket_owner {
+	__u32 pid;
+	__u32 pad;
+	/* connect_start_ns is set while an outgoing connection is in SYN_SENT */
+	__u64 connect_start_ns;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_LRU_HASH);
+	__uint(max_entries, MAX_PROCESSES);
+	__type(key, __u32);
+	__type(value, struct flow_counters);
+} flows SEC(".maps");
+
+/* sockets maps a socket address to the process using it, so events raised in softirq
+ * context, where the current task is unrelated, can be attributed */
+struct {
+	__uint(type, BPF_MAP_TYPE_LRU_HASH);
+	__uint(max_entries, MAX_SOCKETS);
+	__type(key, __u64);
+	__type(value, struct socket_owner);
+} sockets SEC(".maps");
+
+/* process_flow returns the counters of a process. They are only created in process
+ * context, where the current task's name belongs to pid. */
+static __always_inline struct flow_counters *process_flow(__u32 pid, bool create)
+{
+	struct flow_counters *flow = bpf_map_lookup_elem(&flows, &pid);
+	if (flow || !create)
+		return flow;
+
+	struct flow_counters zero = {};
+	bpf_get_current_comm(zero.comm, sizeof(zero.comm));
+	bpf_map_update_elem(&flows, &pid, &zero, BPF_NOEXIST);
+	return bpf_map_lookup_elem(&flows, &pid);
+}
+
+/* track_socket records the current process as the owner of sk, unless it already has
+ * one, and returns the current process's counters */
+static __always_inline struct flow_counters *track_socket(struct sock *sk)
+{
+	__u32 pid = bpf_get_current_pid_tgid() >> 32;
+	__u64 key = (__u64)sk;
+
+	/* Kernel threads */
+	if (pid == 0)
+		return NULL;
+	if (!bpf_map_lookup_elem(&sockets, &key)) {
+		struct socket_owner owner = { .pid = pid };
+		bpf_map_update_elem(&sockets, &key, &owner, BPF_NOEXIST);
+	}
+	return process_flow(pid, true);
+}
+
+/* socket_flow returns the counters of the process owning sk, from any context */
+static __always_inline struct flow_counters *socket_flow(const struct sock *sk)
+{
+	__u64 key = (__u64)sk;
+	struct socket_owner *owner = bpf_map_lookup_elem(&sockets, &key);
+	if (!owner)
+		return NULL;
+	return process_flow(owner->pid, false);
+}
+
+/* size is what the caller asked to send; a non-blocking send may queue less */
+SEC("kprobe/tcp_sendmsg")
+int BPF_KPROBE(tcp_sendmsg, struct sock *sk, struct msghdr *msg, size_t size)
+{
+	struct flow_counters *flow = track_socket(sk);
+	if (flow)
+		__sync_fetch_and_add(&flow->bytes_sent, size);
+	return 0;
+}
+
+/* tcp_cleanup_rbuf runs once data was copied to user space, with the bytes copied */
+SEC("kprobe/tcp_cleanup_rbuf")
+int BPF_KPROBE(tcp_cleanup_rbuf, struct sock *sk, int copied)
+{
+	struct flow_counters *flow;
+
+	if (copied <= 0)
+		return 0;
+	flow = track_socket(sk);
+	if (flow)
+		__sync_fetch_and_add(&flow->bytes_received, copied);
+	return 0;
+}
+
+static __always_inline int connect_start(struct sock *sk)
+{
+	__u32 pid = bpf_get_current_pid_tgid() >> 32;
+	__u64 key = (__u64)sk;
+	struct socket_owner owner = {
+		.pid = pid,
+		.connect_start_ns = bpf_ktime_get_ns(),
+	};
+
+	if (pid == 0)
+		return 0;
+	bpf_map_update_elem(&sockets, &key, &owner, BPF_ANY);
+	process_flow(pid, true);
+	return 0;
+}
+
+SEC("kprobe/tcp_v4_connect")
+int BPF_KPROBE(tcp_v4_connect, struct sock *sk)
+{
+	return connect_start(sk);
+}
+
+SEC("kprobe/tcp_v6_connect")
+int BPF_KPROBE(tcp_v6_connect, struct sock *sk)
+{
+	return connect_start(sk);
+}
+
+/* inet_sock_set_state completes a connect on SYN_SENT -> ESTABLISHED and forgets the
+ * socket once it is closed */
+SEC("tp_btf/inet_sock_set_state")
+int BPF_PROG(inet_sock_set_state, const struct sock *sk, int oldstate, int newstate)
+{
+	__u64 key = (__u64)sk;
+	struct socket_owner *owner;
+	struct flow_counters *flow;
+
+	/* sk_protocol is a bitfield before Linux 5.6 */
+	if (BPF_CORE_READ_BITFIELD_PROBED(sk, sk_protocol) != IPPROTO_TCP)
+		return 0;
+	if (newstate == TCP_CLOSE) {
+		bpf_map_delete_elem(&sockets, &key);
+		return 0;
+	}
+	if (oldstate != TCP_SYN_SENT || newstate != TCP_ESTABLISHED)
+		return 0;
+
+	owner = bpf_map_lookup_elem(&sockets, &key);
+	if (!owner || !owner->connect_start_ns)
+		return 0;
+	flow = process_flow(owner->pid, false);
+	if (flow) {
+		__sync_fetch_and_add(&flow->connects, 1);
+		__sync_fetch_and_add(&flow->connect_latency_ns, bpf_ktime_get_ns() - owner->connect_start_ns);
+	}
+	owner->connect_start_ns = 0;
+	return 0;
+}
+
+/* Retransmits fire from timers, so they are attributed through the socket owner */
+SEC("tp_btf/tcp_retransmit_skb")
+int BPF_PROG(tcp_retransmit_skb, const struct sock *sk)
+{
+	struct flow_counters *flow = socket_flow(sk);
+	if (flow)
+		__sync_fetch_and_add(&flow->retransmits, 1);
+	return 0;
+}
+
+char LICENSE[] SEC("license") = "Dual BSD/GPL";
@@ -0,0 +1,43 @@
+// Command sprinter-helper runs the privileged operations of the agent as root, so the
+// agent itself can run as an unprivileged account
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"sprinter-agent/internal/helper"
+)
+
+func main() {
+	socketPath := flag.String("socket", helper.DefaultSocketPath, "Path of the unix socket to listen on")
+	auditLog := flag.String("audit-log", "/var/log/audit/audit.log", "Audit log the agent may read through the helper")
+	allowUser := flag.String("allow-user", "sprinter-agent", "Account the agent runs as; only it and root may use the helper")
+	flag.Parse()
+
+	if os.Geteuid() != 0 {
+		log.Println("Warning: helper is not running as root - privileged operations will fail")
+	}
+
+	server := &helper.Server{
+		SocketPath:   *socketPath,
+		AuditLogPath: *auditLog,
+		AllowedUser:  *allowUser,
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigChan
+		log.Printf("Received %s, shutting down", sig)
+		server.Close()
+	}()
+
+	log.Printf("Privileged helper listening on %s for user %s", *socketPath, *allowUser)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatal("Helper failed: ", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/services"
+)
+
+// collect runs the collectors a single time and sends their reports, or prints them with
+// -print, then exits; for cron-driven installs and for debugging one collector
+func collect(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("collect", flag.ExitOnError)
+	once := fs.Bool("once", false, "Run each collector a single time and exit (required)")
+	only := fs.String("collector", "", "Run only this collector")
+	printOnly := fs.Bool("print", false, "Print the reports as JSON lines instead of sending them; nothing is sent to the server")
+	timeout := fs.Duration("timeout", 5*time.Minute, "Give up on collectors that have not finished after this long")
+	fs.Parse(args)
+	if !*once {
+		return errors.New("collect needs -once; run the agent to collect continuously")
+	}
+
+	// Collectors read the host through its mounts when the agent runs in a container
+	services.ConfigureHost(cfg)
+
+	hostRegService := services.NewHostRegistrationService(cfg)
+	var hostRid string
+	out := io.Writer(os.Stdout)
+	if *printOnly {
+		// Reports are addressed to the RID of an earlier registration, if there was one
+		if hostRid = hostRegService.StoredHostRid(); hostRid == "" {
+			hostRid = "unregistered"
+		}
+		services.SetReportSink(printReport(os.Stdout))
+		// Standard output carries the reports, so the summary goes to standard error
+		out = os.Stderr
+	} else {
+		rid, err := hostRegService.Register()
+		if err != nil {
+			return err
+		}
+		hostRid = rid
+	}
+
+	manager := services.NewCollectorManager(cfg, hostRid, hostRegService.GetClient())
+	statuses, err := manager.CollectOnce(*only, *timeout)
+
+	if !*printOnly {
+		// The heartbeat carries the collector states and keeps the host from looking offline
+		if err := hostRegService.SendHeartbeat(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to send heartbeat: %v\n", err)
+		}
+	}
+	if len(statuses) > 0 {
+		if printErr := printCollectors(out, statuses); printErr != nil {
+			return printErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, status := range statuses {
+		if status.State == services.CollectorError || status.LastError != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d collector(s) failed", failed)
+	}
+	return nil
+}
+
+// printReport returns a report sink writing each report as a JSON line
+func printReport(w io.Writer) services.ReportSink {
+	var mu sync.Mutex
+	encoder := json.NewEncoder(w)
+	return func(method, path string, body interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return encoder.Encode(struct {
+			Method string      `json:"method"`
+			Path   string      `json:"path"`
+			Body   interface{} `json:"body"`
+		}{method, path, body})
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/control"
+	"sprinter-agent/internal/services"
+)
+
+// controlCommand sends a command for a collector to the running agent and prints the
+// collector states
+func controlCommand(cfg *config.Config, command, collector string) error {
+	if collector == "" {
+		return errors.New("a collector name is required")
+	}
+
+	resp, err := control.Send(cfg.Control.SocketPath, control.Request{
+		Command:   command,
+		Collector: collector,
+	})
+	if err != nil {
+		return err
+	}
+
+	return printCollectors(os.Stdout, resp.Collectors)
+}
+
+// printCollectors prints the collector states as a table
+func printCollectors(out io.Writer, collectors []services.CollectorStatus) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COLLECTOR\tSTATE\tREASON")
+	for _, status := range collectors {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", status.Name, status.State, status.Reason)
+	}
+	return w.Flush()
+}
+
+// statusOutput is the status command's JSON output, a stable format for scripts
+type statusOutput struct {
+	HostRid            string                     `json:"host_rid"`
+	Healthy            bool                       `json:"healthy"`
+	Reason             string                     `json:"reason,omitempty"`
+	LastHeartbeat      *time.Time                 `json:"last_heartbeat"`
+	LastHeartbeatError string                     `json:"last_heartbeat_error,omitempty"`
+	QueueDepth         int                        `json:"queue_depth"`
+	Collectors         []services.CollectorStatus `json:"collectors"`
+}
+
+// showStatus prints the collector states of the running agent, or with -json the host,
+// heartbeat and queue state as well
+func showStatus(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print machine-readable JSON")
+	fs.Parse(args)
+
+	resp, err := control.Send(cfg.Control.SocketPath, control.Request{Command: control.CommandStatus})
+	if err != nil {
+		return err
+	}
+	if !*asJSON {
+		return printCollectors(os.Stdout, resp.Collectors)
+	}
+
+	out := statusOutput{QueueDepth: resp.QueueDepth, Collectors: resp.Collectors}
+	if out.Collectors == nil {
+		out.Collectors = []services.CollectorStatus{}
+	}
+	if health := resp.Health; health != nil {
+		out.HostRid = health.HostRid
+		out.Healthy = health.Healthy
+		out.Reason = health.Reason
+		out.LastHeartbeatError = health.LastHeartbeatError
+		if !health.LastHeartbeat.IsZero() {
+			out.LastHeartbeat = &health.LastHeartbeat
+		}
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(out)
+}
+
+// showLogs prints recent log lines kept in memory by the running agent
+func showLogs(cfg *config.Config, count string) error {
+	lines := 0
+	if count != "" {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid line count: %s", count)
+		}
+		lines = n
+	}
+
+	resp, err := control.Send(cfg.Control.SocketPath, control.Request{
+		Command: control.CommandLogs,
+		Lines:   lines,
+	})
+	if err != nil {
+		return err
+	}
+	for _, line := range resp.Logs {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// showActions prints the actions the running agent took at the server's request, the
+// most recent n when a count is given
+func showActions(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("actions", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print one JSON object per action")
+	fs.Parse(args)
+
+	lines := 0
+	if count := fs.Arg(0); count != "" {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid action count: %s", count)
+		}
+		lines = n
+	}
+
+	resp, err := control.Send(cfg.Control.SocketPath, control.Request{
+		Command: control.CommandActions,
+		Lines:   lines,
+	})
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, action := range resp.Actions {
+			if err := encoder.Encode(action); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tCOMMAND\tSERVER\tREQUESTER\tREQUEST\tRESULT\tERROR")
+	for _, action := range resp.Actions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", action.Time.Local().Format(time.RFC3339),
+			action.Command, action.Server, action.Requester, action.RequestID, action.Result, action.Error)
+	}
+	return w.Flush()
+}
+
+// dumpGoroutines asks the running agent to write a goroutine dump and prints its path
+func dumpGoroutines(cfg *config.Config) error {
+	resp, err := control.Send(cfg.Control.SocketPath, control.Request{Command: control.CommandDump})
+	if err != nil {
+		return err
+	}
+	fmt.Println(resp.File)
+	return nil
+}
+
+// traceroute asks the running agent to trace the path to target and prints the hops
+func traceroute(cfg *config.Config, target string) error {
+	resp, err := control.Send(cfg.Control.SocketPath, control.Request{
+		Command: control.CommandTraceroute,
+		Target:  target,
+	})
+	if resp == nil || resp.Path == nil {
+		return err
+	}
+
+	path := resp.Path
+	fmt.Printf("Path to %s (%s, %s)\n", path.Target, path.Tool, path.Duration.Round(time.Millisecond))
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "HOP\tADDRESS\tLOSS%\tSENT\tLAST\tAVG\tBEST\tWORST\t")
+	for _, hop := range path.Hops {
+		address := hop.Address
+		if address == "" {
+			address = "???"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%.1f\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t\n", hop.Hop, address, hop.LossPercent,
+			hop.Sent, hop.LastMillis, hop.AvgMillis, hop.BestMillis, hop.WorstMillis)
+	}
+	if flushErr := w.Flush(); flushErr != nil {
+		return flushErr
+	}
+	return err
+}
+
+// speedTest asks the running agent to measure throughput to the server and prints it
+func speedTest(cfg *config.Config) error {
+	resp, err := control.Send(cfg.Control.SocketPath, control.Request{Command: control.CommandSpeedTest})
+	if resp == nil || resp.Throughput == nil {
+		return err
+	}
+
+	result := resp.Throughput
+	fmt.Printf("Download: %.1f Mbit/s (%d bytes in %s)\n", result.DownloadMbps, result.DownloadBytes, result.DownloadDuration.Round(time.Millisecond))
+	fmt.Printf("Upload:   %.1f Mbit/s (%d bytes in %s)\n", result.UploadMbps, result.UploadBytes, result.UploadDuration.Round(time.Millisecond))
+	return err
+}
+
+// health asks the running agent for its registration and heartbeat state, prints it and
+// returns the exit code: 0 when healthy, 1 otherwise, including when the agent cannot be
+// reached. The agent opens its control socket only once registered, so an agent that is
+// still registering is unhealthy as well.
+func health(cfg *config.Config) int {
+	if !cfg.Control.Enabled {
+		fmt.Fprintln(os.Stderr, "unhealthy: the control socket is disabled, set control.enabled: true")
+		return 1
+	}
+	resp, err := control.Send(cfg.Control.SocketPath, control.Request{Command: control.CommandHealth})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unhealthy: %v\n", err)
+		return 1
+	}
+	status := resp.Health
+	if !status.Healthy {
+		fmt.Fprintf(os.Stderr, "unhealthy: %s\n", status.Reason)
+		return 1
+	}
+	last := "none yet"
+	if !status.LastHeartbeat.IsZero() {
+		last = time.Since(status.LastHeartbeat).Round(time.Second).String() + " ago"
+	}
+	fmt.Printf("healthy: host %s, last heartbeat %s\n", status.HostRid, last)
+	return 0
+}
+
+// retrieveFile asks the running agent to retrieve and upload a file, and prints the
+// redacted content it uploaded
+func retrieveFile(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("file", flag.ExitOnError)
+	output := fs.String("o", "", "write the content to this file instead of stdout")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: file [-o file] <path>")
+	}
+
+	resp, err := control.Send(cfg.Control.SocketPath, control.Request{Command: control.CommandFile, Path: fs.Arg(0)})
+	if err != nil {
+		return err
+	}
+	artifact := resp.Artifact
+	fmt.Fprintf(os.Stderr, "%s: %d bytes, sha256 %s, %d redactions\n", artifact.ResolvedPath, artifact.Size, artifact.SHA256, artifact.Redactions)
+	if *output != "" {
+		return os.WriteFile(*output, artifact.Content, 0600)
+	}
+	_, err = os.Stdout.Write(artifact.Content)
+	return err
+}
+
+// captureSnapshot asks the running agent to capture and upload a system snapshot, lists
+// its files and optionally keeps a copy of the bundle
+func captureSnapshot(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	output := fs.String("o", "", "also write the bundle to this file")
+	fs.Parse(args)
+
+	resp, err := control.Send(cfg.Control.SocketPath, control.Request{Command: control.CommandSnapshot})
+	if resp == nil || resp.Snapshot == nil {
+		return err
+	}
+
+	snapshot := resp.Snapshot
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSIZE\tSOURCE\tERROR")
+	for _, file := range snapshot.Files {
+		size := strconv.Itoa(file.Size)
+		if file.Truncated {
+			size += " (truncated)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", file.Name, size, file.Source, file.Error)
+	}
+	if flushErr := w.Flush(); flushErr != nil {
+		return flushErr
+	}
+	if *output != "" {
+		if writeErr := os.WriteFile(*output, snapshot.Bundle, 0600); writeErr != nil {
+			return writeErr
+		}
+		fmt.Printf("Wrote %s\n", *output)
+	}
+	return err
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/services"
+)
+
+// deregister decommissions the host recorded on disk and removes local agent state
+func deregister(cfg *config.Config) error {
+	hostRegService := services.NewHostRegistrationService(cfg)
+	return hostRegService.Deregister()
+}
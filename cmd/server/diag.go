@@ -0,0 +1,234 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/control"
+	"sprinter-agent/internal/services"
+)
+
+const (
+	// dataDir holds the agent's state files, crash reports and goroutine dumps
+	dataDir = "data"
+	// maxBundledStateFile keeps large state such as the FIM baseline out of the bundle; it is
+	// still listed in the state manifest
+	maxBundledStateFile = 1 << 20
+)
+
+// diag gathers the agent's logs, redacted configuration, state, recent report payloads,
+// environment and connectivity test results into a tarball to attach to support tickets.
+// Logs and payloads come from the running agent and are left out, with a note, when it
+// does not answer.
+func diag(cfg *config.Config, configPath string, args []string) error {
+	fs := flag.NewFlagSet("diag", flag.ExitOnError)
+	output := fs.String("output", "", "Write the bundle to this file (default: sprinter-diag-<host>-<time>.tar.gz in the current directory)")
+	fs.Parse(args)
+
+	hostname, _ := os.Hostname()
+	name := fmt.Sprintf("sprinter-diag-%s-%s", hostname, time.Now().UTC().Format("20060102T150405Z"))
+	if *output == "" {
+		*output = name + ".tar.gz"
+	}
+
+	b := &bundle{prefix: name}
+	if data, err := yaml.Marshal(cfg.Redacted()); err != nil {
+		b.fail("config.yaml", err)
+	} else {
+		b.add("config.yaml", data)
+	}
+	b.add("environment.txt", environmentReport(configPath))
+
+	fmt.Fprintf(os.Stderr, "Testing connectivity to %s...\n", cfg.HostRegistration.SprinterURL)
+	var report strings.Builder
+	printChecks(&report, connectivityChecks(cfg))
+	b.add("connectivity.txt", []byte(report.String()))
+
+	socket := cfg.Control.SocketPath
+	if resp, err := control.Send(socket, control.Request{Command: control.CommandStatus}); err != nil {
+		b.fail("status.json", err)
+	} else {
+		b.addJSON("status.json", resp)
+	}
+	if resp, err := control.Send(socket, control.Request{Command: control.CommandLogs}); err != nil {
+		b.fail("logs.txt", err)
+	} else {
+		b.add("logs.txt", []byte(strings.Join(resp.Logs, "\n")+"\n"))
+	}
+	if resp, err := control.Send(socket, control.Request{Command: control.CommandSamples}); err != nil {
+		b.fail("samples.json", err)
+	} else {
+		b.addJSON("samples.json", resp.Samples)
+	}
+
+	b.addState()
+	if len(b.problems) > 0 {
+		b.add("missing.txt", []byte(strings.Join(b.problems, "\n")+"\n"))
+	}
+
+	if err := b.write(*output); err != nil {
+		return err
+	}
+	for _, problem := range b.problems {
+		fmt.Fprintf(os.Stderr, "Not included: %s\n", problem)
+	}
+	fmt.Printf("Wrote %s\n", *output)
+	return nil
+}
+
+// bundleFile is one file in a diagnostic bundle
+type bundleFile struct {
+	name string
+	data []byte
+}
+
+// bundle collects the files of a diagnostic bundle in memory, along with the parts that
+// could not be gathered
+type bundle struct {
+	prefix   string
+	files    []bundleFile
+	problems []string
+}
+
+// add adds a file to the bundle
+func (b *bundle) add(name string, data []byte) {
+	b.files = append(b.files, bundleFile{name: name, data: data})
+}
+
+// addJSON adds a file holding v as indented JSON
+func (b *bundle) addJSON(name string, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		b.fail(name, err)
+		return
+	}
+	b.add(name, append(data, '\n'))
+}
+
+// fail records that a file could not be gathered
+func (b *bundle) fail(name string, err error) {
+	b.problems = append(b.problems, fmt.Sprintf("%s: %v", name, err))
+}
+
+// addState adds the state directory, listing every file in state/manifest.txt but leaving
+// out large ones
+func (b *bundle) addState() {
+	var manifest strings.Builder
+	err := filepath.WalkDir(dataDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&manifest, "%s\t%s\t%d\t%s\n", path, info.Mode(), info.Size(), info.ModTime().UTC().Format(time.RFC3339))
+		if info.Size() > maxBundledStateFile {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			b.fail(path, err)
+			return nil
+		}
+		b.add(filepath.ToSlash(filepath.Join("state", path)), data)
+		return nil
+	})
+	if err != nil {
+		b.fail(dataDir, err)
+	}
+	b.add("state/manifest.txt", []byte(manifest.String()))
+}
+
+// write writes the bundle as a gzipped tarball, only readable by its owner since logs and
+// state describe the host
+func (b *bundle) write(path string) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, file := range b.files {
+		header := &tar.Header{
+			Name:    b.prefix + "/" + file.name,
+			Mode:    0600,
+			Size:    int64(len(file.data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write bundle: %w", err)
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return fmt.Errorf("failed to write bundle: %w", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return nil
+}
+
+// environmentReport describes the agent build and the host it runs on. Only the names of
+// SOMANA_* variables are listed since their values may be secrets; the effective values
+// are in the redacted configuration.
+func environmentReport(configPath string) []byte {
+	var b strings.Builder
+	hostname, _ := os.Hostname()
+	wd, _ := os.Getwd()
+	fmt.Fprintf(&b, "agent version: %s\n", services.AgentVersion)
+	fmt.Fprintf(&b, "go version: %s\n", runtime.Version())
+	fmt.Fprintf(&b, "platform: %s/%s, %d CPUs\n", runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+	fmt.Fprintf(&b, "hostname: %s\n", hostname)
+	fmt.Fprintf(&b, "uid: %d, gid: %d\n", os.Getuid(), os.Getgid())
+	fmt.Fprintf(&b, "working directory: %s\n", wd)
+	fmt.Fprintf(&b, "config file: %s\n", configPath)
+	fmt.Fprintf(&b, "time: %s\n", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "container: %t\n", services.RunningInContainer())
+	fmt.Fprintf(&b, "kubernetes: %t\n", os.Getenv("KUBERNETES_SERVICE_HOST") != "")
+	if release, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		fmt.Fprintf(&b, "kernel: %s\n", strings.TrimSpace(string(release)))
+	}
+
+	somana := []string{}
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		switch strings.ToUpper(name) {
+		case "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY":
+			// Proxy URLs may carry credentials
+			if u, err := url.Parse(value); err == nil {
+				value = u.Redacted()
+			}
+			fmt.Fprintf(&b, "%s: %s\n", name, value)
+		}
+		if strings.HasPrefix(name, "SOMANA_") {
+			somana = append(somana, name)
+		}
+	}
+	sort.Strings(somana)
+	fmt.Fprintf(&b, "SOMANA_* variables set: %s\n", strings.Join(somana, ", "))
+
+	if release, err := os.ReadFile("/etc/os-release"); err == nil {
+		fmt.Fprintf(&b, "\n/etc/os-release:\n%s", release)
+	}
+	return []byte(b.String())
+}
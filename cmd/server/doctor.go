@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"sprinter-agent/internal/config"
+)
+
+// doctor checks each step of reaching the server and prints what to do about any that
+// fail; it returns the exit code, 1 when a check failed
+func doctor(cfg *config.Config) int {
+	fmt.Printf("Checking connectivity to %s\n", cfg.HostRegistration.SprinterURL)
+	results := connectivityChecks(cfg)
+	printChecks(os.Stdout, results)
+
+	failed := 0
+	for _, result := range results {
+		if !result.OK {
+			failed++
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d check(s) failed\n", failed)
+		return 1
+	}
+	fmt.Println("All checks passed")
+	return 0
+}
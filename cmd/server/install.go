@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"sprinter-agent/internal/execwrap"
+)
+
+const (
+	defaultUnitName = "sprinter-agent.service"
+	defaultUnitDir  = "/etc/systemd/system"
+	polkitRulesDir  = "/etc/polkit-1/rules.d"
+	// stateDirName is created under /var/lib by systemd and used as the working directory,
+	// so the relative data/ directory ends up in /var/lib/sprinter-agent/data
+	stateDirName = "sprinter-agent"
+	// helperRuntimeDir holds the helper socket, matching helper.DefaultSocketPath
+	helperRuntimeDir = "sprinter-agent-helper"
+	helperBinaryName = "sprinter-helper"
+)
+
+// unitTemplate is the hardened systemd unit written by the install command
+var unitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=Sprinter Agent
+Documentation=https://github.com/Somana-Engineering/somana-agent
+After=network-online.target{{if .HelperUnit}} {{.HelperUnit}}{{end}}
+Wants=network-online.target{{if .HelperUnit}} {{.HelperUnit}}{{end}}
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart={{.Binary}} -config {{.ConfigPath}}{{if .Instance}} -instance {{.Instance}}{{end}}
+Restart=on-failure
+RestartSec=5s
+{{- if .WatchdogSec}}
+WatchdogSec={{.WatchdogSec}}
+{{- end}}
+{{- if .DynamicUser}}
+DynamicUser=yes
+{{- else if .User}}
+User={{.User}}
+Group={{.User}}
+{{- end}}
+StateDirectory={{.StateDir}}
+WorkingDirectory=/var/lib/{{.StateDir}}
+LogsDirectory={{.StateDir}}
+RuntimeDirectory={{.StateDir}}
+{{- if .Capabilities}}
+AmbientCapabilities={{.Capabilities}}
+CapabilityBoundingSet={{.Capabilities}}
+{{- end}}
+
+# Hardening
+NoNewPrivileges=yes
+ProtectSystem=strict
+ProtectHome=read-only
+PrivateTmp=yes
+PrivateDevices={{if .PrivateDevices}}yes{{else}}no{{end}}
+ProtectKernelTunables=yes
+ProtectKernelModules=yes
+ProtectControlGroups=yes
+ProtectClock=yes
+ProtectHostname=yes
+RestrictSUIDSGID=yes
+RestrictRealtime=yes
+RestrictNamespaces=yes
+LockPersonality=yes
+MemoryDenyWriteExecute=yes
+SystemCallArchitectures=native
+RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6 AF_NETLINK
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// helperUnitTemplate runs the privileged helper as root with only the access it needs
+var helperUnitTemplate = template.Must(template.New("helper").Parse(`[Unit]
+Description=Sprinter Agent privileged helper
+Documentation=https://github.com/Somana-Engineering/somana-agent
+Before={{.AgentUnit}}
+
+[Service]
+Type=simple
+ExecStart={{.Binary}} -socket /run/{{.RuntimeDir}}/helper.sock -allow-user {{.User}}
+Restart=on-failure
+RestartSec=5s
+RuntimeDirectory={{.RuntimeDir}}
+RuntimeDirectoryMode=0755
+
+# Hardening
+NoNewPrivileges=yes
+ProtectSystem=strict
+ProtectHome=yes
+PrivateTmp=yes
+ProtectKernelTunables=yes
+ProtectKernelModules=yes
+ProtectControlGroups=yes
+RestrictAddressFamilies=AF_UNIX
+CapabilityBoundingSet=CAP_DAC_READ_SEARCH
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// polkitTemplate lets the agent account start and restart units over D-Bus without root
+var polkitTemplate = template.Must(template.New("polkit").Parse(`// Written by sprinter-agent install; removed by sprinter-agent uninstall
+polkit.addRule(function(action, subject) {
+    if (action.id == "org.freedesktop.systemd1.manage-units" &&
+        subject.user == "{{.User}}") {
+        var verb = action.lookup("verb");
+        if (verb == "start" || verb == "restart") {
+            return polkit.Result.YES;
+        }
+    }
+});
+`))
+
+// unitParams fills unitTemplate
+type unitParams struct {
+	Binary         string
+	ConfigPath     string
+	User           string
+	DynamicUser    bool
+	StateDir       string
+	PrivateDevices bool
+	// Capabilities is a space separated list granted to a non-root account
+	Capabilities string
+	// HelperUnit is the privileged helper unit the agent depends on, if installed
+	HelperUnit string
+	// WatchdogSec is how long the agent may go without a watchdog ping, empty to disable
+	WatchdogSec string
+	// Instance is the -instance the agent runs as, empty for the unnamed one
+	Instance string
+}
+
+// install writes and enables a systemd unit running this binary
+func install(configPath, instance string, args []string) error {
+	fs := flag.NewFlagSet("install", flag.ExitOnError)
+	runAs := fs.String("user", "dynamic", `Account to run as: "dynamic" for a systemd DynamicUser, "root", or a dedicated user name created if missing`)
+	unitName := fs.String("unit", instanceUnitName(instance), "Name of the systemd unit")
+	unitDir := fs.String("unit-dir", defaultUnitDir, "Directory the unit file is written to")
+	noStart := fs.Bool("no-start", false, "Write and enable the unit without starting it")
+	capabilities := fs.String("capabilities", "", "Comma separated capabilities granted to a non-root account, e.g. CAP_NET_ADMIN,CAP_DAC_READ_SEARCH")
+	polkit := fs.Bool("polkit", true, "Write a polkit rule letting a non-root account start and restart units")
+	withHelper := fs.Bool("helper", false, "Also install the privileged helper as a root unit so a non-root agent keeps root-only collectors")
+	watchdog := fs.Duration("watchdog", 60*time.Second, "Restart the agent when it stops responding for this long, 0 to disable")
+	fs.Parse(args)
+
+	binary, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate agent binary: %w", err)
+	}
+	if binary, err = filepath.EvalSymlinks(binary); err != nil {
+		return fmt.Errorf("failed to resolve agent binary: %w", err)
+	}
+	absConfig, err := filepath.Abs(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve config path: %w", err)
+	}
+
+	params := unitParams{
+		Binary:     binary,
+		ConfigPath: absConfig,
+		Instance:   instance,
+		StateDir:   instanceStateDir(instance),
+		// Hardware collectors such as IPMI need /dev access, which only root gets
+		PrivateDevices: *runAs != "root",
+	}
+	if *watchdog > 0 {
+		params.WatchdogSec = fmt.Sprintf("%ds", int(watchdog.Round(time.Second).Seconds()))
+	}
+	// A DynamicUser account is named after the unit
+	account := strings.TrimSuffix(*unitName, ".service")
+	switch *runAs {
+	case "dynamic":
+		params.DynamicUser = true
+	case "root":
+		account = ""
+	default:
+		if err := ensureSystemUser(*runAs); err != nil {
+			return err
+		}
+		params.User = *runAs
+		account = *runAs
+	}
+	if account != "" && *capabilities != "" {
+		caps, err := parseCapabilities(*capabilities)
+		if err != nil {
+			return err
+		}
+		params.Capabilities = strings.Join(caps, " ")
+	}
+	if *withHelper {
+		if account == "" {
+			return fmt.Errorf("the privileged helper is only needed when the agent does not run as root")
+		}
+		// The helper listens on a fixed socket and serves a single account
+		if instance != "" {
+			return fmt.Errorf("the privileged helper can only be installed with the unnamed instance")
+		}
+		params.HelperUnit = helperUnitName(*unitName)
+	}
+
+	var unit bytes.Buffer
+	if err := unitTemplate.Execute(&unit, params); err != nil {
+		return fmt.Errorf("failed to render unit: %w", err)
+	}
+
+	unitPath := filepath.Join(*unitDir, *unitName)
+	if err := os.WriteFile(unitPath, unit.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write unit file: %w", err)
+	}
+	log.Printf("Wrote unit file %s", unitPath)
+
+	if account != "" && *polkit {
+		if err := writePolkitRule(*unitName, account); err != nil {
+			return err
+		}
+	}
+
+	if params.HelperUnit != "" {
+		if err := writeHelperUnit(binary, *unitDir, *unitName, account); err != nil {
+			return err
+		}
+	}
+
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	if params.HelperUnit != "" {
+		helperArgs := []string{"enable", params.HelperUnit}
+		if !*noStart {
+			helperArgs = []string{"enable", "--now", params.HelperUnit}
+		}
+		if err := systemctl(helperArgs...); err != nil {
+			return err
+		}
+	}
+	enableArgs := []string{"enable", *unitName}
+	if !*noStart {
+		enableArgs = []string{"enable", "--now", *unitName}
+	}
+	if err := systemctl(enableArgs...); err != nil {
+		return err
+	}
+
+	if *noStart {
+		log.Printf("Enabled %s", *unitName)
+	} else {
+		log.Printf("Enabled and started %s", *unitName)
+	}
+	return nil
+}
+
+// uninstall stops, disables and removes the systemd unit
+func uninstall(instance string, args []string) error {
+	fs := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	unitName := fs.String("unit", instanceUnitName(instance), "Name of the systemd unit")
+	unitDir := fs.String("unit-dir", defaultUnitDir, "Directory the unit file was written to")
+	fs.Parse(args)
+
+	unitPath := filepath.Join(*unitDir, *unitName)
+	if _, err := os.Stat(unitPath); err != nil {
+		return fmt.Errorf("unit file not found: %w", err)
+	}
+
+	if err := systemctl("disable", "--now", *unitName); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if err := os.Remove(unitPath); err != nil {
+		return fmt.Errorf("failed to remove unit file: %w", err)
+	}
+	log.Printf("Removed unit file %s", unitPath)
+
+	helperPath := filepath.Join(*unitDir, helperUnitName(*unitName))
+	if _, err := os.Stat(helperPath); err == nil {
+		if err := systemctl("disable", "--now", helperUnitName(*unitName)); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		if err := os.Remove(helperPath); err != nil {
+			return fmt.Errorf("failed to remove helper unit file: %w", err)
+		}
+		log.Printf("Removed unit file %s", helperPath)
+	}
+
+	rulePath := polkitRulePath(*unitName)
+	if err := os.Remove(rulePath); err == nil {
+		log.Printf("Removed polkit rule %s", rulePath)
+	} else if !os.IsNotExist(err) {
+		log.Printf("Warning: failed to remove polkit rule: %v", err)
+	}
+
+	return systemctl("daemon-reload")
+}
+
+// instanceUnitName returns the default unit name of an instance
+func instanceUnitName(instance string) string {
+	if instance == "" {
+		return defaultUnitName
+	}
+	return "sprinter-agent-" + instance + ".service"
+}
+
+// instanceStateDir returns the state directory of an instance under /var/lib. Each
+// instance gets its own, so their runtime and log directories and DynamicUser accounts do
+// not collide.
+func instanceStateDir(instance string) string {
+	if instance == "" {
+		return stateDirName
+	}
+	return stateDirName + "-" + instance
+}
+
+// helperUnitName returns the name of the privileged helper unit for an agent unit
+func helperUnitName(unitName string) string {
+	return strings.TrimSuffix(unitName, ".service") + "-helper.service"
+}
+
+// writeHelperUnit writes the unit for the helper binary installed next to the agent
+func writeHelperUnit(agentBinary, unitDir, unitName, account string) error {
+	binary := filepath.Join(filepath.Dir(agentBinary), helperBinaryName)
+	if _, err := os.Stat(binary); err != nil {
+		return fmt.Errorf("helper binary not found next to the agent: %w", err)
+	}
+
+	var unit bytes.Buffer
+	params := struct {
+		Binary, AgentUnit, RuntimeDir, User string
+	}{binary, unitName, helperRuntimeDir, account}
+	if err := helperUnitTemplate.Execute(&unit, params); err != nil {
+		return fmt.Errorf("failed to render helper unit: %w", err)
+	}
+
+	unitPath := filepath.Join(unitDir, helperUnitName(unitName))
+	if err := os.WriteFile(unitPath, unit.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write helper unit file: %w", err)
+	}
+	log.Printf("Wrote unit file %s", unitPath)
+	return nil
+}
+
+// polkitRulePath returns where the polkit rule for a unit is written
+func polkitRulePath(unitName string) string {
+	return filepath.Join(polkitRulesDir, "50-"+strings.TrimSuffix(unitName, ".service")+".rules")
+}
+
+// writePolkitRule writes the polkit rule for the agent account
+func writePolkitRule(unitName, account string) error {
+	if _, err := os.Stat(polkitRulesDir); err != nil {
+		log.Printf("polkit not installed - skipping polkit rule")
+		return nil
+	}
+
+	var rule bytes.Buffer
+	if err := polkitTemplate.Execute(&rule, struct{ User string }{account}); err != nil {
+		return fmt.Errorf("failed to render polkit rule: %w", err)
+	}
+
+	rulePath := polkitRulePath(unitName)
+	if err := os.WriteFile(rulePath, rule.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write polkit rule: %w", err)
+	}
+	log.Printf("Wrote polkit rule %s", rulePath)
+	return nil
+}
+
+// parseCapabilities normalises a comma separated capability list, e.g. "net_admin" to "CAP_NET_ADMIN"
+func parseCapabilities(list string) ([]string, error) {
+	caps := []string{}
+	for _, capability := range strings.Split(list, ",") {
+		capability = strings.ToUpper(strings.TrimSpace(capability))
+		if capability == "" {
+			continue
+		}
+		if !strings.HasPrefix(capability, "CAP_") {
+			capability = "CAP_" + capability
+		}
+		for _, r := range capability {
+			if (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '_' {
+				return nil, fmt.Errorf("invalid capability: %s", capability)
+			}
+		}
+		caps = append(caps, capability)
+	}
+	return caps, nil
+}
+
+// ensureSystemUser creates a locked system account if it does not exist
+func ensureSystemUser(name string) error {
+	if _, err := user.Lookup(name); err == nil {
+		return nil
+	}
+
+	nologin := "/usr/sbin/nologin"
+	if _, err := os.Stat(nologin); err != nil {
+		nologin = "/sbin/nologin"
+	}
+	_, err := execwrap.Output(context.Background(), execwrap.Options{Writable: true}, "useradd", "--system", "--no-create-home", "--user-group", "--shell", nologin, name)
+	if err != nil {
+		return fmt.Errorf("failed to create user %s: %w", name, err)
+	}
+	log.Printf("Created system user %s", name)
+	return nil
+}
+
+// systemctl runs a systemctl command; its error includes what the command printed
+func systemctl(args ...string) error {
+	if _, err := execwrap.Output(context.Background(), execwrap.Options{Writable: true}, "systemctl", args...); err != nil {
+		return fmt.Errorf("systemctl %s: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
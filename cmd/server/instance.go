@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"sprinter-agent/internal/config"
+)
+
+// instancesDir holds the state of named instances below the working directory
+const instancesDir = "instances"
+
+// enterInstance makes instances/<name> the working directory, so the relative config,
+// data/ and log paths of a named instance are its own. A -config given on the command line
+// still refers to the directory the agent was started in.
+func enterInstance(name string, configPath *string) error {
+	if err := config.CheckInstanceName(name); err != nil {
+		return err
+	}
+	explicit := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			explicit = true
+		}
+	})
+	if explicit {
+		abs, err := filepath.Abs(*configPath)
+		if err != nil {
+			return fmt.Errorf("failed to resolve config path: %w", err)
+		}
+		*configPath = abs
+	}
+
+	dir := filepath.Join(instancesDir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create instance directory: %w", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		return fmt.Errorf("failed to enter instance directory: %w", err)
+	}
+	return nil
+}
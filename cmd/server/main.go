@@ -2,24 +2,260 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/control"
+	"sprinter-agent/internal/diagnostics"
+	"sprinter-agent/internal/logfile"
+	"sprinter-agent/internal/logring"
+	"sprinter-agent/internal/schedule"
+	"sprinter-agent/internal/sdnotify"
 	"sprinter-agent/internal/services"
 )
 
+// diagnosticsDir receives goroutine dumps when debugging is enabled
+const diagnosticsDir = "data/diagnostics"
+
+// service is a background component that can be stopped on shutdown
+type service interface {
+	Start() error
+	Stop()
+}
+
 func main() {
 	// Parse command-line flags
 	configPath := flag.String("config", "config/config.yaml", "Path to configuration file")
+	instance := flag.String("instance", "", "Run as a named instance with its own state in instances/<name> and its own control socket, for several agents on one host")
+	var sets setFlags
+	flag.Var(&sets, "set", "Override a configuration value as path=value, e.g. metrics.interval=30s (repeatable)")
+	flag.Usage = usage
 	flag.Parse()
 
+	if *instance != "" {
+		if err := enterInstance(*instance, configPath); err != nil {
+			log.Fatal("Failed to select instance: ", err)
+		}
+	}
+
+	// SOMANA_* environment variables override the file, and -set flags override both
+	overrides, unknown := config.EnvOverrides(os.Environ())
+	for _, name := range unknown {
+		log.Printf("Warning: Ignoring %s, which matches no configuration field", name)
+		services.ReportConfigProblem("environment", name+" matches no configuration field")
+	}
+	for _, arg := range sets {
+		override, err := config.ParseSetFlag(arg)
+		if err != nil {
+			log.Fatal("Failed to parse flags: ", err)
+		}
+		overrides = append(overrides, override)
+	}
+
+	if flag.Arg(0) == "validate-config" {
+		path := *configPath
+		if flag.NArg() > 1 {
+			path = flag.Arg(1)
+		}
+		os.Exit(validateConfig(path, overrides))
+	}
+	// Setup writes the configuration, so it runs before the file has to be valid
+	if flag.Arg(0) == "setup" {
+		if err := setup(*configPath, *instance, overrides, flag.Args()[1:]); err != nil {
+			log.Fatal("Setup failed: ", err)
+		}
+		return
+	}
+
 	// Load configuration
-	cfg, err := config.LoadConfig(*configPath)
+	checkConfig(*configPath, overrides)
+	cfg, err := config.LoadConfig(*configPath, overrides...)
 	if err != nil {
 		log.Fatal("Failed to load configuration:", err)
 	}
+	cfg.ApplyInstance(*instance)
+	// Every command reaches the server through the configured resolvers and TLS settings,
+	// doctor included
+	if err := services.ConfigureFIPS(cfg); err != nil {
+		log.Fatal("Failed to configure FIPS mode: ", err)
+	}
+	services.ConfigureResolver(cfg)
+	if err := services.ConfigureTLS(cfg); err != nil {
+		log.Fatal("Failed to configure TLS: ", err)
+	}
+	if err := services.ConfigureExec(cfg); err != nil {
+		log.Fatal("Failed to configure external commands: ", err)
+	}
+	if err := services.ResolveSecrets(cfg); err != nil {
+		log.Fatal("Failed to resolve secrets: ", err)
+	}
+	if err := services.ConfigurePayloadSigning(cfg); err != nil {
+		log.Fatal("Failed to configure payload signing: ", err)
+	}
+
+	switch flag.Arg(0) {
+	case "", "run":
+		run(cfg, *configPath)
+	case "deregister":
+		if err := deregister(cfg); err != nil {
+			log.Fatal("Failed to deregister host: ", err)
+		}
+	case "collect":
+		if err := collect(cfg, flag.Args()[1:]); err != nil {
+			log.Fatal("Collection failed: ", err)
+		}
+	case "doctor":
+		os.Exit(doctor(cfg))
+	case "diag":
+		if err := diag(cfg, *configPath, flag.Args()[1:]); err != nil {
+			log.Fatal("Failed to write diagnostic bundle: ", err)
+		}
+	case "install":
+		if err := install(*configPath, *instance, flag.Args()[1:]); err != nil {
+			log.Fatal("Failed to install service: ", err)
+		}
+	case "uninstall":
+		if err := uninstall(*instance, flag.Args()[1:]); err != nil {
+			log.Fatal("Failed to uninstall service: ", err)
+		}
+	case control.CommandStatus:
+		if err := showStatus(cfg, flag.Args()[1:]); err != nil {
+			log.Fatal("Control command failed: ", err)
+		}
+	case control.CommandPause, control.CommandResume:
+		if err := controlCommand(cfg, flag.Arg(0), flag.Arg(1)); err != nil {
+			log.Fatal("Control command failed: ", err)
+		}
+	case control.CommandHealth:
+		os.Exit(health(cfg))
+	case control.CommandLogs:
+		if err := showLogs(cfg, flag.Arg(1)); err != nil {
+			log.Fatal("Failed to fetch logs: ", err)
+		}
+	case control.CommandActions:
+		if err := showActions(cfg, flag.Args()[1:]); err != nil {
+			log.Fatal("Failed to fetch remote actions: ", err)
+		}
+	case control.CommandDump:
+		if err := dumpGoroutines(cfg); err != nil {
+			log.Fatal("Failed to dump goroutines: ", err)
+		}
+	case control.CommandTraceroute:
+		if err := traceroute(cfg, flag.Arg(1)); err != nil {
+			log.Fatal("Path diagnostic failed: ", err)
+		}
+	case control.CommandSpeedTest:
+		if err := speedTest(cfg); err != nil {
+			log.Fatal("Speed test failed: ", err)
+		}
+	case control.CommandSnapshot:
+		if err := captureSnapshot(cfg, flag.Args()[1:]); err != nil {
+			log.Fatal("Snapshot failed: ", err)
+		}
+	case control.CommandFile:
+		if err := retrieveFile(cfg, flag.Args()[1:]); err != nil {
+			log.Fatal("File retrieval failed: ", err)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+}
+
+// setFlags collects repeated -set flags
+type setFlags []string
+
+// String implements flag.Value
+func (s *setFlags) String() string {
+	return strings.Join(*s, ", ")
+}
+
+// Set implements flag.Value
+func (s *setFlags) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// usage prints the available commands and flags
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  run                Register the host and run all collectors (default)")
+	fmt.Fprintln(os.Stderr, "  setup              Ask for the server and enrollment token, test them by registering and save them")
+	fmt.Fprintln(os.Stderr, "  deregister         Decommission the host on the server and wipe local state")
+	fmt.Fprintln(os.Stderr, "  collect -once      Run the collectors once, send or -print their reports, and exit")
+	fmt.Fprintln(os.Stderr, "  doctor             Check DNS, proxy, TLS, certificate, clock and token against the server, with fixes")
+	fmt.Fprintln(os.Stderr, "  diag               Write a tarball of logs, redacted config, state and connectivity tests for support")
+	fmt.Fprintln(os.Stderr, "  install            Install, enable and start a hardened systemd unit")
+	fmt.Fprintln(os.Stderr, "  uninstall          Stop, disable and remove the systemd unit")
+	fmt.Fprintln(os.Stderr, "  validate-config    Check the configuration file, or the one given, and exit non-zero on problems")
+	fmt.Fprintln(os.Stderr, "  status [-json]     Show the state of every collector in the running agent")
+	fmt.Fprintln(os.Stderr, "  health             Exit 0 if the running agent is registered and its heartbeats succeed, else 1")
+	fmt.Fprintln(os.Stderr, "  pause <c>          Pause a collector in the running agent until resumed")
+	fmt.Fprintln(os.Stderr, "  resume <c>         Resume a paused collector")
+	fmt.Fprintln(os.Stderr, "  logs [n]           Print the last n log lines kept by the running agent")
+	fmt.Fprintln(os.Stderr, "  actions [n]        Print the last n actions the running agent took at the server's request (-json for JSON)")
+	fmt.Fprintln(os.Stderr, "  dump               Write a goroutine dump of the running agent (needs debug.enabled)")
+	fmt.Fprintln(os.Stderr, "  traceroute [host]  Trace and upload the network path to host (default: the server)")
+	fmt.Fprintln(os.Stderr, "  speedtest          Measure and upload throughput to the server (needs speed_test.enabled)")
+	fmt.Fprintln(os.Stderr, "  snapshot           Capture and upload processes, open files, sockets, dmesg and df (needs snapshot.enabled)")
+	fmt.Fprintln(os.Stderr, "  file <path>        Upload an allowed file, redacted, and print what was sent (needs file_retrieval.enabled)")
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// openLogFile opens the rotating log file when one is configured; a nil writer means
+// stderr
+func openLogFile(cfg *config.Config) (io.Writer, error) {
+	if cfg.Logging.File == "" {
+		return nil, nil
+	}
+	file, err := logfile.Open(logfile.Options{
+		Path:           cfg.Logging.File,
+		MaxSize:        int64(cfg.Logging.MaxSizeMB) << 20,
+		RotateInterval: cfg.Logging.RotateInterval,
+		MaxBackups:     cfg.Logging.MaxBackups,
+		MaxAge:         cfg.Logging.MaxAge,
+		Compress:       cfg.Logging.Compress,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// run registers the host, starts the collectors and blocks until a shutdown signal
+func run(cfg *config.Config, configPath string) {
+	// Recent log lines go into crash reports and are served by the logs command
+	logOutput, err := openLogFile(cfg)
+	logring.Install(cfg.Control.LogLines, logOutput)
+	if err != nil {
+		log.Printf("Warning: Failed to open log file, logging to stderr: %v", err)
+	}
+	services.ApplyMemoryLimit(cfg)
+	// The minimal profile shares one ticker between collectors, so it comes before any starts
+	services.ConfigureProfile(cfg)
+	// Collectors read the host through its mounts when the agent runs in a container
+	services.ConfigureHost(cfg)
+	// Events are tagged with the maintenance window they happen in from the start
+	services.ConfigureMaintenance(cfg)
+
+	// Restrict the process before any collector runs
+	applySandbox(cfg, configPath)
+
+	// Collectors reschedule themselves after a jump; the log explains gaps in reported data
+	schedule.OnClockJump(func(drift time.Duration) {
+		log.Printf("Wall clock jumped by %s (suspend/resume or time change)", drift)
+	})
 
 	// Create host registration service
 	hostRegService := services.NewHostRegistrationService(cfg)
@@ -35,20 +271,70 @@ func main() {
 	// Start systemd monitoring service (will start once host is registered)
 	// Check periodically if host is registered
 	var systemdStarted sync.Once
+	var servicesMu sync.Mutex
+	var started []service
+	var reporter *services.BulkReporter
+	var manager *services.CollectorManager
+	startService := func(name string, svc service) {
+		if err := svc.Start(); err != nil {
+			log.Printf("Warning: Failed to start %s: %v", name, err)
+			return
+		}
+		servicesMu.Lock()
+		started = append(started, svc)
+		servicesMu.Unlock()
+	}
+
+	// Started before registration so a hang there can be diagnosed too
+	if cfg.Debug.Enabled {
+		services.PublishExpvars()
+		startService("diagnostics server", diagnostics.NewServer(cfg.Debug.Listen, diagnosticsDir))
+	}
+	// Agents behind the gateway keep reporting while this host is still registering
+	startService("gateway", services.NewGatewayService(cfg))
 	go func() {
 		for {
 			hostRid := hostRegService.GetHostRid()
 			if hostRid != "" {
 				systemdStarted.Do(func() {
-					apiClient := hostRegService.GetClient()
-					if apiClient != nil {
-						systemdMonitor := services.NewSystemdMonitorService(cfg, apiClient, hostRid)
-						if err := systemdMonitor.Start(); err != nil {
-							log.Printf("Warning: Failed to start systemd monitoring: %v", err)
-						} else {
-							log.Printf("Systemd monitoring started for host RID: %s", hostRid)
+					// Started first so collectors hand their reports to it from the beginning
+					servicesMu.Lock()
+					reporter = services.NewBulkReporter(cfg, hostRid)
+					servicesMu.Unlock()
+					services.StartMQTT(cfg, hostRid)
+					reporter.Start()
+					startService("report buffer", services.NewReportBuffer(cfg))
+					go services.UploadCrashReports(cfg, hostRid)
+					startService("reboot detection", services.NewRebootService(cfg, hostRid))
+
+					// Collectors are restarted individually when remote configuration changes them
+					servicesMu.Lock()
+					manager = services.NewCollectorManager(cfg, hostRid, hostRegService.GetClient())
+					servicesMu.Unlock()
+					startService("collectors", manager)
+					startService("self limits", services.NewSelfLimitService(cfg, manager))
+					networkDiagnostics := services.NewNetworkDiagnosticsService(cfg, hostRid)
+					startService("network diagnostics", networkDiagnostics)
+					startService("runbooks", services.NewRunbookService(cfg, hostRid))
+					fileRetrieval := services.NewFileRetrievalService(cfg, hostRid)
+					startService("file retrieval", fileRetrieval)
+					snapshots := services.NewSnapshotService(cfg, hostRid)
+					startService("snapshots", snapshots)
+					startService("custom metrics", services.NewCustomMetricsService(cfg, hostRid))
+					startService("udp heartbeat", services.NewUDPHeartbeatService(cfg, hostRegService))
+					if cfg.Control.Enabled {
+						controlServer := control.NewServer(cfg.Control.SocketPath, manager)
+						if cfg.Debug.Enabled {
+							controlServer.DumpDir = diagnosticsDir
 						}
+						controlServer.Diagnostics = networkDiagnostics
+						controlServer.Files = fileRetrieval
+						controlServer.Snapshots = snapshots
+						controlServer.Registration = hostRegService
+						startService("control socket", controlServer)
 					}
+					startService("remote configuration sync", services.NewConfigSyncService(cfg, hostRid, manager))
+					sdnotify.Status("Reporting as host %s", hostRid)
 				})
 				return // Exit goroutine once monitoring is started
 			}
@@ -75,7 +361,60 @@ func main() {
 	}
 	*/
 
-	// Keep the process running for debugging
+	// Keep the process running until asked to stop
 	log.Println("Host registration service started. Press Ctrl+C to exit.")
-	select {}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	// Under a Type=notify unit, units ordered after the agent start only once it is up
+	if _, err := sdnotify.Notify(sdnotify.Ready); err != nil {
+		log.Printf("Warning: Failed to notify systemd of readiness: %v", err)
+	}
+	// Pings stop when the collectors are wedged, so systemd restarts a hung agent
+	stopWatchdog := sdnotify.StartWatchdog(func() bool {
+		servicesMu.Lock()
+		m := manager
+		servicesMu.Unlock()
+		return m == nil || m.Ping()
+	})
+
+	// Collectors report under the host RID, so a RID taken over by another machine needs
+	// a fresh start; the service manager restarts the agent, which then registers anew
+	conflict := false
+	select {
+	case sig := <-sigChan:
+		log.Printf("Received %s, shutting down", sig)
+	case <-hostRegService.IdentityConflict():
+		log.Printf("Host identity conflict, restarting to register as a new host")
+		conflict = true
+	}
+	sdnotify.Notify(sdnotify.Stopping)
+	stopWatchdog()
+
+	servicesMu.Lock()
+	// Stop in reverse start order so nothing restarts a service that was already stopped
+	for i := len(started) - 1; i >= 0; i-- {
+		started[i].Stop()
+	}
+	// Stopped last to flush the reports collectors queued before stopping
+	if reporter != nil {
+		reporter.Stop()
+	}
+	services.StopMQTT()
+	servicesMu.Unlock()
+
+	// The RID belongs to the other machine, which must not be deregistered
+	if conflict {
+		hostRegService.Stop()
+		os.Exit(1)
+	}
+
+	// Ephemeral hosts always say goodbye so they do not linger as zombies on the server
+	if cfg.HostRegistration.DeregisterOnShutdown || cfg.HostRegistration.Ephemeral {
+		if err := hostRegService.Deregister(); err != nil {
+			log.Printf("Warning: Failed to deregister host on shutdown: %v", err)
+		}
+		return
+	}
+	hostRegService.Stop()
 } 
\ No newline at end of file
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/sandbox"
+	"sprinter-agent/internal/services"
+)
+
+// applySandbox restricts the agent according to the sandbox configuration
+func applySandbox(cfg *config.Config, configPath string) {
+	if !cfg.Sandbox.Enabled {
+		return
+	}
+
+	applied, err := sandbox.Apply(sandboxOptions(cfg, configPath))
+	if err != nil {
+		log.Printf("Warning: Failed to apply %s sandbox: %v", cfg.Sandbox.Strictness, err)
+		return
+	}
+	log.Printf("Applied %s sandbox (%s)", cfg.Sandbox.Strictness, strings.Join(applied, ", "))
+	if cfg.Sandbox.Strictness == sandbox.Strict && len(applied) < 2 {
+		log.Println("Warning: landlock unavailable - it needs Linux 5.13+ and an agent built with CGO_ENABLED=0")
+	}
+}
+
+// sandboxOptions derives the paths the enabled collectors need
+func sandboxOptions(cfg *config.Config, configPath string) sandbox.Options {
+	opts := sandbox.Options{
+		Strictness: cfg.Sandbox.Strictness,
+		AllowBPF:   cfg.NetFlow.Enabled && cfg.NetFlow.EBPF,
+		// Collectors shell out to system tools and read kernel and process state
+		ExecPaths: []string{"/usr", "/bin", "/sbin", "/lib", "/lib64", "/etc"},
+		ReadPaths: []string{"/proc", "/sys", "/run", "/var/log", "/var/spool/cron", "/boot", filepath.Dir(configPath)},
+		// /dev covers /dev/null for child processes and device nodes such as /dev/ipmi0
+		WritePaths: []string{"data", "/dev", "/tmp"},
+	}
+
+	if cfg.Audit.Enabled {
+		opts.ReadPaths = append(opts.ReadPaths, filepath.Dir(cfg.Audit.LogPath))
+	}
+	if cfg.FIM.Enabled {
+		opts.ReadPaths = append(opts.ReadPaths, cfg.FIM.Paths...)
+	}
+	if cfg.Control.Enabled {
+		opts.WritePaths = append(opts.WritePaths, filepath.Dir(cfg.Control.SocketPath))
+	}
+	if cfg.Runbooks.Enabled {
+		for _, script := range cfg.Runbooks.Scripts {
+			opts.ExecPaths = append(opts.ExecPaths, filepath.Dir(script.Path))
+		}
+	}
+	if cfg.FileRetrieval.Enabled {
+		opts.ReadPaths = append(opts.ReadPaths, services.RetrievalReadPaths(cfg.FileRetrieval.AllowedPaths)...)
+		if hook := cfg.FileRetrieval.RedactHook.Command; len(hook) > 0 {
+			opts.ExecPaths = append(opts.ExecPaths, filepath.Dir(hook[0]))
+		}
+	}
+	if cfg.Buffer.Enabled && cfg.Buffer.Encrypt && cfg.Buffer.KeyFile != "" {
+		opts.ReadPaths = append(opts.ReadPaths, cfg.Buffer.KeyFile)
+	}
+	if cfg.Logging.File != "" {
+		opts.WritePaths = append(opts.WritePaths, filepath.Dir(cfg.Logging.File))
+	}
+	if cfg.NetFlow.Enabled && cfg.NetFlow.EBPF && cfg.NetFlow.ObjectPath != "" {
+		opts.ReadPaths = append(opts.ReadPaths, cfg.NetFlow.ObjectPath)
+	}
+	if cfg.Compliance.Enabled && cfg.Compliance.RulesDir != "" {
+		opts.ReadPaths = append(opts.ReadPaths, cfg.Compliance.RulesDir)
+	}
+	if cfg.Textfile.Enabled && cfg.Textfile.Directory != "" {
+		opts.ReadPaths = append(opts.ReadPaths, cfg.Textfile.Directory)
+	}
+	opts.ReadPaths = append(opts.ReadPaths, services.HostReadPaths()...)
+	opts.ReadPaths = append(opts.ReadPaths, cfg.Sandbox.ReadPaths...)
+	opts.WritePaths = append(opts.WritePaths, cfg.Sandbox.WritePaths...)
+	return opts
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/services"
+)
+
+// setup asks for the server URL and enrollment token, registers the host to test them, and
+// saves them to the config file, optionally installing the systemd unit afterwards. Flags
+// answer the questions up front for unattended provisioning, and arguments after "--" are
+// passed on to install.
+func setup(configPath, instance string, overrides []config.Override, args []string) error {
+	fs := flag.NewFlagSet("setup", flag.ExitOnError)
+	serverURL := fs.String("url", "", "Server URL; asked for when empty")
+	token := fs.String("token", "", "Enrollment token; asked for when empty")
+	withUnit := fs.Bool("install", false, "Install and start the systemd unit without asking")
+	yes := fs.Bool("yes", false, "Ask nothing, taking every answer from the flags or the current configuration")
+	fs.Parse(args)
+
+	absConfig, err := filepath.Abs(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve config path: %w", err)
+	}
+	cfg, err := config.LoadConfig(absConfig, overrides...)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	cfg.ApplyInstance(instance)
+	p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout, batch: *yes}
+
+	if *serverURL == "" {
+		*serverURL = cfg.HostRegistration.SprinterURL
+	}
+	if *token == "" {
+		*token = cfg.HostRegistration.EnrollmentToken
+	}
+
+	installUnit := *withUnit
+	if !installUnit && !*yes && runtime.GOOS == "linux" {
+		if installUnit, err = p.confirm("Install and start the systemd unit?", false); err != nil {
+			return err
+		}
+	}
+	if installUnit {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("the systemd unit can only be installed on Linux")
+		}
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("installing the systemd unit needs root, run setup with sudo")
+		}
+		// The unit runs the agent in its state directory, so the RID saved by the test
+		// registration must be written there to be found on start
+		stateDir := filepath.Join("/var/lib", instanceStateDir(instance))
+		if instance != "" {
+			stateDir = filepath.Join(stateDir, instancesDir, instance)
+		}
+		if err := os.MkdirAll(stateDir, 0755); err != nil {
+			return fmt.Errorf("failed to create state directory: %w", err)
+		}
+		if err := os.Chdir(stateDir); err != nil {
+			return fmt.Errorf("failed to enter state directory: %w", err)
+		}
+	}
+
+	for {
+		answer, err := p.ask("Server URL", *serverURL, false)
+		if err != nil {
+			return err
+		}
+		if err := config.CheckServerURL(answer); err != nil {
+			if *yes {
+				return err
+			}
+			fmt.Fprintf(p.out, "%v\n", err)
+			continue
+		}
+		*serverURL = answer
+		if *token, err = p.ask("Enrollment token", *token, true); err != nil {
+			return err
+		}
+
+		cfg.HostRegistration.SprinterURL = *serverURL
+		cfg.HostRegistration.EnrollmentToken = *token
+		// A token referencing a secret is saved as the reference, so only a copy is resolved
+		registration := *cfg
+		err = services.ResolveSecrets(&registration)
+		var rid string
+		if err == nil {
+			rid, err = services.NewHostRegistrationService(&registration).Register()
+		}
+		if err == nil {
+			fmt.Fprintf(p.out, "Registered with %s as host %s\n", *serverURL, rid)
+			break
+		}
+		fmt.Fprintf(p.out, "Test registration failed: %v\n", err)
+		if *yes {
+			return fmt.Errorf("test registration failed: %w", err)
+		}
+		retry, err := p.confirm("Try again?", true)
+		if err != nil {
+			return err
+		}
+		if !retry {
+			return fmt.Errorf("setup cancelled, %s was not changed", configPath)
+		}
+	}
+
+	values := map[string]string{"host_registration.sprinter_url": *serverURL}
+	if *token != "" {
+		values["host_registration.enrollment_token"] = *token
+	}
+	if err := config.SetValues(absConfig, values); err != nil {
+		return fmt.Errorf("failed to write configuration: %w", err)
+	}
+	fmt.Fprintf(p.out, "Saved configuration to %s\n", absConfig)
+
+	if installUnit {
+		return install(absConfig, instance, fs.Args())
+	}
+	return nil
+}
+
+// prompter asks setup questions on the terminal
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+	// batch answers every question with its default
+	batch bool
+}
+
+// ask prompts for a value, returning current when the answer is empty. A secret's current
+// value is not shown.
+func (p *prompter) ask(question, current string, secret bool) (string, error) {
+	if p.batch {
+		return current, nil
+	}
+	switch {
+	case current == "":
+		fmt.Fprintf(p.out, "%s: ", question)
+	case secret:
+		fmt.Fprintf(p.out, "%s [keep current]: ", question)
+	default:
+		fmt.Fprintf(p.out, "%s [%s]: ", question, current)
+	}
+	answer, err := p.readLine()
+	if err != nil {
+		return "", err
+	}
+	if answer == "" {
+		return current, nil
+	}
+	return answer, nil
+}
+
+// confirm asks a yes/no question, returning def when the answer is empty
+func (p *prompter) confirm(question string, def bool) (bool, error) {
+	if p.batch {
+		return def, nil
+	}
+	choices := "y/N"
+	if def {
+		choices = "Y/n"
+	}
+	for {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, choices)
+		answer, err := p.readLine()
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(answer) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
+}
+
+// readLine reads one trimmed line of input
+func (p *prompter) readLine() (string, error) {
+	line, err := p.in.ReadString('\n')
+	if errors.Is(err, io.EOF) && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read answer: %w", err)
+	}
+	return strings.TrimSpace(line), nil
+}
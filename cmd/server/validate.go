@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/services"
+)
+
+// validateConfig prints every problem in a configuration file and returns the exit code:
+// 0 when it is valid, 1 when it has errors and 2 when it cannot be read. Unknown keys only
+// warn when the agent loads a file, but fail here.
+func validateConfig(configPath string, overrides []config.Override) int {
+	if _, err := os.Stat(configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read %s: %v\n", configPath, err)
+		return 2
+	}
+	problems, err := config.Validate(configPath, overrides...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read %s: %v\n", configPath, err)
+		return 2
+	}
+	for _, problem := range problems {
+		if problem.Warning {
+			fmt.Fprintln(os.Stderr, "warning:", problem)
+		} else {
+			fmt.Fprintln(os.Stderr, "error:", problem)
+		}
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d problem(s)\n", configPath, len(problems))
+		return 1
+	}
+	fmt.Printf("%s: OK\n", configPath)
+	return 0
+}
+
+// checkConfig logs warnings in the configuration, which are also reported to the server as
+// agent health events, and stops the agent on errors
+func checkConfig(configPath string, overrides []config.Override) {
+	problems, err := config.Validate(configPath, overrides...)
+	if err != nil {
+		log.Fatal("Failed to load configuration: ", err)
+	}
+	for _, problem := range problems {
+		if problem.Warning {
+			log.Printf("Warning: %s", problem)
+			services.ReportConfigProblem(configPath, problem.String())
+		}
+	}
+	if config.HasErrors(problems) {
+		for _, problem := range problems {
+			if !problem.Warning {
+				log.Printf("Error: %s", problem)
+			}
+		}
+		log.Fatal("Invalid configuration, run validate-config for details")
+	}
+}
@@ -3,8 +3,11 @@ module sprinter-agent
 go 1.21
 
 require (
+	github.com/cilium/ebpf v0.12.3
 	github.com/gin-gonic/gin v1.9.1
+	github.com/klauspost/compress v1.17.11
 	github.com/oapi-codegen/runtime v1.1.2
+	golang.org/x/sys v0.15.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -31,8 +34,8 @@ require (
 	github.com/ugorji/go/codec v1.2.11 // indirect
 	golang.org/x/arch v0.4.0 // indirect
 	golang.org/x/crypto v0.17.0 // indirect
+	golang.org/x/exp v0.0.0-20230224173230-c95f2b4c22f2 // indirect
 	golang.org/x/net v0.19.0 // indirect
-	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	google.golang.org/protobuf v1.31.0 // indirect
 )
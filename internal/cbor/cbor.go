@@ -0,0 +1,160 @@
+// Package cbor encodes JSON documents as CBOR (RFC 8949), a binary form of the same data
+// model that is smaller on the wire and cheaper to parse. Converting from JSON keeps the
+// payload types' json tags as the single description of the wire format.
+package cbor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// ContentType is the media type of CBOR payloads
+const ContentType = "application/cbor"
+
+// Major types
+const (
+	majorUnsigned = 0 << 5
+	majorNegative = 1 << 5
+	majorText     = 3 << 5
+	majorArray    = 4 << 5
+	majorMap      = 5 << 5
+	majorSimple   = 7 << 5
+)
+
+// Simple values and the float64 marker
+const (
+	simpleFalse = majorSimple | 20
+	simpleTrue  = majorSimple | 21
+	simpleNull  = majorSimple | 22
+	float64Head = majorSimple | 27
+)
+
+// Marshal returns the CBOR encoding of v as it would be encoded to JSON
+func Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return FromJSON(data)
+}
+
+// FromJSON converts a JSON document to CBOR. Object keys are sorted so equal documents
+// encode identically.
+func FromJSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON: %w", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("trailing data after JSON document")
+	}
+
+	var buf bytes.Buffer
+	if err := encode(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encode writes a decoded JSON value
+func encode(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(simpleNull)
+	case bool:
+		if v {
+			buf.WriteByte(simpleTrue)
+		} else {
+			buf.WriteByte(simpleFalse)
+		}
+	case string:
+		writeHead(buf, majorText, uint64(len(v)))
+		buf.WriteString(v)
+	case json.Number:
+		return encodeNumber(buf, v)
+	case []interface{}:
+		writeHead(buf, majorArray, uint64(len(v)))
+		for _, item := range v {
+			if err := encode(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		writeHead(buf, majorMap, uint64(len(v)))
+		for _, key := range keys {
+			writeHead(buf, majorText, uint64(len(key)))
+			buf.WriteString(key)
+			if err := encode(buf, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported JSON value of type %T", value)
+	}
+	return nil
+}
+
+// encodeNumber writes integers as CBOR integers and everything else as float64
+func encodeNumber(buf *bytes.Buffer, n json.Number) error {
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		writeHead(buf, majorUnsigned, u)
+		return nil
+	}
+	// "-0", which json.Marshal writes for a negative zero float, parses as the integer 0
+	// and falls through to keep its sign
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil && i < 0 {
+		// Negative integers encode -1-n
+		writeHead(buf, majorNegative, uint64(-1-i))
+		return nil
+	}
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s: %w", n, err)
+	}
+	buf.WriteByte(float64Head)
+	var bits [8]byte
+	binary.BigEndian.PutUint64(bits[:], math.Float64bits(f))
+	buf.Write(bits[:])
+	return nil
+}
+
+// writeHead writes a major type with its argument in the shortest form
+func writeHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		var b [2]byte
+		binary.BigEndian.PutUint16(b[:], uint16(n))
+		buf.Write(b[:])
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(n))
+		buf.Write(b[:])
+	default:
+		buf.WriteByte(major | 27)
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], n)
+		buf.Write(b[:])
+	}
+}
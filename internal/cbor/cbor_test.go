@@ -0,0 +1,152 @@
+package cbor
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// decode reads one value written by encode, with integers as int64 or uint64 and floats as
+// float64, and returns the rest of data
+func decode(data []byte) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("unexpected end of data")
+	}
+	head := data[0]
+	data = data[1:]
+	switch head {
+	case simpleFalse:
+		return false, data, nil
+	case simpleTrue:
+		return true, data, nil
+	case simpleNull:
+		return nil, data, nil
+	case float64Head:
+		if len(data) < 8 {
+			return nil, nil, fmt.Errorf("short float64")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+	}
+
+	var n uint64
+	switch info := head & 0x1f; {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, fmt.Errorf("short argument")
+		}
+		for _, b := range data[:size] {
+			n = n<<8 | uint64(b)
+		}
+		data = data[size:]
+	default:
+		return nil, nil, fmt.Errorf("unsupported additional info %d", info)
+	}
+
+	switch head &^ 0x1f {
+	case majorUnsigned:
+		return n, data, nil
+	case majorNegative:
+		if n > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("negative integer -1-%d overflows int64", n)
+		}
+		return -1 - int64(n), data, nil
+	case majorText:
+		if uint64(len(data)) < n {
+			return nil, nil, fmt.Errorf("short text")
+		}
+		return string(data[:n]), data[n:], nil
+	case majorArray:
+		items := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var item interface{}
+			var err error
+			if item, data, err = decode(data); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case majorMap:
+		object := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			key, rest, err := decode(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			value, rest, err := decode(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			object[key.(string)], data = value, rest
+		}
+		return object, data, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported major type %d", head>>5)
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	negativeZero := math.Copysign(0, -1)
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{name: "zero", value: 0, want: uint64(0)},
+		{name: "small unsigned", value: 23, want: uint64(23)},
+		{name: "max uint64", value: uint64(math.MaxUint64), want: uint64(math.MaxUint64)},
+		{name: "minus one", value: -1, want: int64(-1)},
+		{name: "min int64", value: int64(math.MinInt64), want: int64(math.MinInt64)},
+		{name: "float", value: 1.5, want: 1.5},
+		{name: "negative zero", value: negativeZero, want: negativeZero},
+		{name: "string", value: "host", want: "host"},
+		{name: "null", value: nil, want: nil},
+		{
+			name:  "object",
+			value: map[string]interface{}{"b": []interface{}{true, -0.25}, "a": "x"},
+			want:  map[string]interface{}{"a": "x", "b": []interface{}{true, -0.25}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := Marshal(tt.value)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			got, rest, err := decode(data)
+			if err != nil {
+				t.Fatalf("decode %x: %v", data, err)
+			}
+			if len(rest) != 0 {
+				t.Fatalf("decode %x left %d bytes", data, len(rest))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("round trip of %v = %#v, want %#v", tt.value, got, tt.want)
+			}
+			if f, ok := tt.want.(float64); ok && math.Signbit(got.(float64)) != math.Signbit(f) {
+				t.Fatalf("round trip of %v lost the sign", tt.value)
+			}
+		})
+	}
+}
+
+func TestFromJSONNegativeZero(t *testing.T) {
+	// json.Marshal writes a negative zero float as -0
+	data, err := json.Marshal(math.Copysign(0, -1))
+	if err != nil || string(data) != "-0" {
+		t.Fatalf("json.Marshal(-0.0) = %s, %v", data, err)
+	}
+	encoded, err := FromJSON(data)
+	if err != nil {
+		t.Fatalf("FromJSON: %v", err)
+	}
+	want := []byte{float64Head, 0x80, 0, 0, 0, 0, 0, 0, 0}
+	if !reflect.DeepEqual(encoded, want) {
+		t.Fatalf("FromJSON(-0) = %x, want %x", encoded, want)
+	}
+}
@@ -0,0 +1,236 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FragmentDir is the directory next to the config file whose *.yaml fragments are merged
+// into it, in name order
+const FragmentDir = "conf.d"
+
+// source is one YAML document making up the configuration, with variables substituted
+type source struct {
+	path string
+	// node is the document's root mapping, or nil for an empty document
+	node *yaml.Node
+}
+
+// VariableError is an undefined variable referenced in a configuration file
+type VariableError struct {
+	Path string
+	Line int
+	Name string
+}
+
+// Error implements error
+func (e *VariableError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.detail())
+}
+
+// detail describes the error without its position
+func (e *VariableError) detail() string {
+	return fmt.Sprintf("undefined variable %s, set it or give a default with ${%s:-value}", e.Name, e.Name)
+}
+
+// SyntaxError is a YAML syntax error in a configuration file
+type SyntaxError struct {
+	Path string
+	Err  error
+}
+
+// Error implements error
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+// Unwrap returns the YAML error
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// readSources reads the configuration in merge order: the config file, the fragments in
+// conf.d, then the overlay for the selected environment, such as config.production.yaml.
+// Missing files are skipped.
+func readSources(configPath string, overrides []Override) ([]source, error) {
+	paths := []string{configPath}
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(filepath.Dir(configPath), FragmentDir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+
+	sources := []source{}
+	environment := ""
+	for _, path := range paths {
+		src, err := readSource(path)
+		if err != nil {
+			return nil, err
+		}
+		if src.node != nil {
+			sources = append(sources, src)
+			if value := mappingValue(src.node, "environment"); value != nil {
+				environment = value.Value
+			}
+		}
+	}
+
+	// The environment selects the overlay, so an override of it applies here too
+	for _, override := range overrides {
+		if override.Path == "environment" {
+			environment = override.Value
+		}
+	}
+	if environment != "" && !strings.ContainsAny(environment, `/\`) {
+		ext := filepath.Ext(configPath)
+		overlay, err := readSource(strings.TrimSuffix(configPath, ext) + "." + environment + ext)
+		if err != nil {
+			return nil, err
+		}
+		if overlay.node != nil {
+			sources = append(sources, overlay)
+		}
+	}
+	return sources, nil
+}
+
+// readSource reads and parses one file and substitutes its variables
+func readSource(path string) (source, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return source{path: path}, nil
+	}
+	if err != nil {
+		return source{}, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return source{}, &SyntaxError{Path: path, Err: err}
+	}
+	if len(doc.Content) == 0 {
+		return source{path: path}, nil
+	}
+	root := doc.Content[0]
+	if err := expandVariables(root, path); err != nil {
+		return source{}, err
+	}
+	return source{path: path, node: root}, nil
+}
+
+// mappingValue returns the value of a key in a mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// variablePattern matches $$ and ${NAME} or ${NAME:-default}
+var variablePattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// expandVariables substitutes environment variables in every scalar value. ${HOSTNAME}
+// falls back to the machine's hostname, since services often run without it in their
+// environment, and $$ is a literal $. Keys and comments are left alone.
+func expandVariables(node *yaml.Node, path string) error {
+	if node.Kind != yaml.ScalarNode {
+		for i, child := range node.Content {
+			// Mapping keys sit at even positions
+			if node.Kind == yaml.MappingNode && i%2 == 0 {
+				continue
+			}
+			if err := expandVariables(child, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !strings.Contains(node.Value, "$") {
+		return nil
+	}
+
+	var undefined string
+	expanded := variablePattern.ReplaceAllStringFunc(node.Value, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+		parts := variablePattern.FindStringSubmatch(match)
+		if value, ok := lookupVariable(parts[1]); ok {
+			return value
+		}
+		if strings.Contains(match, ":-") {
+			return parts[2]
+		}
+		if undefined == "" {
+			undefined = parts[1]
+		}
+		return ""
+	})
+	if undefined != "" {
+		return &VariableError{Path: path, Line: node.Line, Name: undefined}
+	}
+	node.Value = expanded
+	// Plain scalars are resolved again, so "${PORT}" can fill an integer field
+	if node.Style == 0 {
+		node.Tag = ""
+	}
+	return nil
+}
+
+// lookupVariable returns the value of a variable used in a configuration file
+func lookupVariable(name string) (string, bool) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true
+	}
+	if name == "HOSTNAME" {
+		if hostname, err := os.Hostname(); err == nil {
+			return hostname, true
+		}
+	}
+	return "", false
+}
+
+// mergeSources merges the sources into one YAML document: mappings merge key by key and
+// any other value replaces the earlier one, as with remote configuration
+func mergeSources(sources []source) ([]byte, error) {
+	var merged interface{}
+	for _, src := range sources {
+		var tree interface{}
+		if err := src.node.Decode(&tree); err != nil {
+			return nil, &SyntaxError{Path: src.path, Err: err}
+		}
+		merged = mergeTrees(merged, tree)
+	}
+	if merged == nil {
+		return nil, nil
+	}
+	return yaml.Marshal(merged)
+}
+
+// mergeTrees merges an overlay into a base decoded YAML value
+func mergeTrees(base, overlay interface{}) interface{} {
+	baseMap, baseIsMap := base.(map[string]interface{})
+	overlayMap, overlayIsMap := overlay.(map[string]interface{})
+	if !baseIsMap || !overlayIsMap {
+		return overlay
+	}
+	for key, value := range overlayMap {
+		baseMap[key] = mergeTrees(baseMap[key], value)
+	}
+	return baseMap
+}
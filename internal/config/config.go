@@ -3,44 +3,1337 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Config holds the application configuration
 type Config struct {
+	// Instance names the agent instance when several run on one host, set from -instance
+	// rather than the file; empty for the only instance
+	Instance string `yaml:"-"`
+
+	// Profile is "standard" or "minimal"; minimal lowers defaults for memory-constrained
+	// hosts such as ARM gateways, and values set in the file still take precedence
+	Profile string `yaml:"profile"`
+
 	// Simplified host registration configuration
-	HostRegistration struct {
-		SprinterURL string `yaml:"sprinter_url"`
-	} `yaml:"host_registration"`
+	HostRegistration HostRegistrationConfig `yaml:"host_registration"`
+
+	// Labels are arbitrary key/value pairs sent with registration and heartbeats
+	Labels map[string]string `yaml:"labels"`
+	// Environment, Team and Tags let the server group hosts without manual tagging
+	Environment string   `yaml:"environment"`
+	Team        string   `yaml:"team"`
+	Tags        []string `yaml:"tags"`
+
+	// Systemd configures the systemd services collector
+	Systemd SystemdConfig `yaml:"systemd"`
+
+	// IPMI configures the BMC sensor and SEL collector
+	IPMI IPMIConfig `yaml:"ipmi"`
+
+	// Connections configures the TCP connection to process mapping collector
+	Connections ConnectionsConfig `yaml:"connections"`
+
+	// NetFlow configures per-process TCP flow and latency telemetry
+	NetFlow NetFlowConfig `yaml:"netflow"`
+
+	// Audit configures forwarding of security-relevant auditd events
+	Audit AuditConfig `yaml:"audit"`
+
+	// FIM configures file integrity monitoring
+	FIM FIMConfig `yaml:"fim"`
+
+	// ScheduledJobs configures cron and systemd timer tracking
+	ScheduledJobs ScheduledJobsConfig `yaml:"scheduled_jobs"`
+
+	// Firewall configures firewall ruleset inventory
+	Firewall FirewallConfig `yaml:"firewall"`
+
+	// Kernel configures kernel version, module and sysctl snapshots
+	Kernel KernelConfig `yaml:"kernel"`
+
+	// KernelLog configures hardware error, OOM kill and segfault events from the kernel log
+	KernelLog KernelLogConfig `yaml:"kernel_log"`
+
+	// Crashes configures OOM kill and core dump events attributed to systemd units
+	Crashes CrashesConfig `yaml:"crashes"`
+
+	// Textfile configures forwarding metrics that scripts write to .prom files
+	Textfile TextfileConfig `yaml:"textfile"`
+
+	// Compliance configures the baseline compliance check engine
+	Compliance ComplianceConfig `yaml:"compliance"`
+
+	// RemoteHosts configures agentless collection from devices over SSH
+	RemoteHosts RemoteHostsConfig `yaml:"remote_hosts"`
+
+	// Containers configures reporting LXC and systemd-nspawn containers as children of the host
+	Containers ContainersConfig `yaml:"containers"`
+
+	// Libvirt configures reporting the virtual machines of a libvirt hypervisor
+	Libvirt LibvirtConfig `yaml:"libvirt"`
+
+	// Storage configures ZFS pool, LVM volume and software RAID health collection
+	Storage StorageConfig `yaml:"storage"`
+
+	// NetworkMounts configures probing NFS, CIFS and other network mounts for hung or stale servers
+	NetworkMounts NetworkMountsConfig `yaml:"network_mounts"`
+
+	// Saturation configures file descriptor, conntrack, PID and entropy limit monitoring
+	Saturation SaturationConfig `yaml:"saturation"`
+
+	// Metrics configures host CPU, memory, disk and process metrics
+	Metrics MetricsConfig `yaml:"metrics"`
+
+	// Inventory configures installed software, update, domain and hardware inventory
+	Inventory InventoryConfig `yaml:"inventory"`
+
+	// EventLog configures forwarding of Windows event log entries
+	EventLog EventLogConfig `yaml:"eventlog"`
+
+	// Helper configures the privileged helper used for root-only operations
+	Helper HelperConfig `yaml:"helper"`
+
+	// Sandbox configures seccomp and landlock self-restriction at startup
+	Sandbox SandboxConfig `yaml:"sandbox"`
+
+	// Reporting configures how collector reports are sent to the server
+	Reporting ReportingConfig `yaml:"reporting"`
+	// Bandwidth budgets the data reports may use, for hosts on metered links
+	Bandwidth BandwidthConfig `yaml:"bandwidth"`
+
+	// Buffer keeps reports on disk while the server cannot be reached
+	Buffer BufferConfig `yaml:"buffer"`
+
+	// RemoteConfig configures pulling collector configuration from the server
+	RemoteConfig RemoteConfigConfig `yaml:"remote_config"`
+
+	// CommandSigning configures verifying the signatures of server-issued commands
+	CommandSigning CommandSigningConfig `yaml:"command_signing"`
+
+	// Control configures the local control socket used by the CLI
+	Control ControlConfig `yaml:"control"`
+
+	// EventDedup configures coalescing of repeated identical events
+	EventDedup EventDedupConfig `yaml:"event_dedup"`
+
+	// ErrorBudget configures backing off collectors that keep failing
+	ErrorBudget ErrorBudgetConfig `yaml:"error_budget"`
+
+	// Commands bounds the external commands collectors run at once and how long they may run
+	Commands CommandsConfig `yaml:"commands"`
+	// Exec configures how every external command the agent runs is started
+	Exec ExecConfig `yaml:"exec"`
+	// QueryCache reuses the results of slow system queries across collectors
+	QueryCache QueryCacheConfig `yaml:"query_cache"`
+
+	// Logging configures writing the agent's own log to a rotating file
+	Logging LoggingConfig `yaml:"logging"`
+
+	// Debug configures runtime diagnostics endpoints
+	Debug DebugConfig `yaml:"debug"`
+
+	// SelfLimits configures the agent's own memory and CPU budget
+	SelfLimits SelfLimitsConfig `yaml:"self_limits"`
+
+	// Host configures reading the host's filesystems when the agent runs in a container
+	Host HostConfig `yaml:"host"`
+
+	// Kubernetes configures registering the node when the agent runs as a DaemonSet
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+	// PathDiagnostics configures on-demand traceroutes requested by the server or the CLI
+	PathDiagnostics PathDiagnosticsConfig `yaml:"path_diagnostics"`
+	// SpeedTest configures on-demand throughput tests against the server
+	SpeedTest SpeedTestConfig `yaml:"speed_test"`
+	// Runbooks configures running locally registered scripts at the server's request
+	Runbooks RunbooksConfig `yaml:"runbooks"`
+	// FileRetrieval configures uploading allowlisted files requested by the server or the CLI
+	FileRetrieval FileRetrievalConfig `yaml:"file_retrieval"`
+	// Snapshot configures point-in-time system snapshots requested by the server or the CLI
+	Snapshot SnapshotConfig `yaml:"snapshot"`
+	// Reboots configures detecting reboots and telling planned ones from crashes
+	Reboots RebootsConfig `yaml:"reboots"`
+	// Maintenance configures the windows in which work on the host is planned
+	Maintenance MaintenanceConfig `yaml:"maintenance"`
+	// Remediation configures restarting failed systemd units
+	Remediation RemediationConfig `yaml:"remediation"`
+	// MQTT publishes heartbeats and reports to a broker instead of the Somana server
+	MQTT MQTTConfig `yaml:"mqtt"`
+	// Gateway relays the API for agents on an isolated subnet
+	Gateway GatewayConfig `yaml:"gateway"`
+	// CustomMetrics configures the localhost API applications push their own metrics to
+	CustomMetrics CustomMetricsConfig `yaml:"custom_metrics"`
+	// UDPHeartbeat configures the signed datagram that keeps liveness visible without HTTPS
+	UDPHeartbeat UDPHeartbeatConfig `yaml:"udp_heartbeat"`
+	// DNS configures the resolvers the agent looks up the server and broker with
+	DNS DNSConfig `yaml:"dns"`
+	// TLS configures how the server's certificate is verified
+	TLS TLSConfig `yaml:"tls"`
+	// Secrets configures the providers credentials are fetched from instead of the file
+	Secrets SecretsConfig `yaml:"secrets"`
+	// FIPS restricts the agent's TLS to FIPS-approved algorithms
+	FIPS FIPSConfig `yaml:"fips"`
+	// PayloadSigning signs requests and MQTT messages with the agent's key
+	PayloadSigning PayloadSigningConfig `yaml:"payload_signing"`
+}
+
+// HostRegistrationConfig holds the host registration configuration
+type HostRegistrationConfig struct {
+	SprinterURL string `yaml:"sprinter_url"`
+	// EnrollmentToken authorizes the agent to register a new host; it is sent as a bearer
+	// token with the registration request and may be empty when the server does not ask for one
+	EnrollmentToken string `yaml:"enrollment_token"`
+	// IdentityProvider registers with a token the cloud issues to the instance instead of
+	// EnrollmentToken: "aws", "gcp", "azure", or "auto" for whichever metadata service answers
+	IdentityProvider string `yaml:"identity_provider"`
+	// IdentityAudience is the audience of GCP ID tokens and the resource of Azure managed
+	// identity tokens, SprinterURL when empty
+	IdentityAudience string `yaml:"identity_audience"`
+	// DeregisterOnShutdown decommissions the host and wipes local state when the agent is stopped
+	DeregisterOnShutdown bool `yaml:"deregister_on_shutdown"`
+	// HeartbeatInterval is how often a heartbeat is sent once registered
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	// Ephemeral registers a short-lived host: the RID is never persisted, heartbeats use
+	// EphemeralHeartbeatInterval and the host deregisters itself on shutdown
+	Ephemeral                  bool          `yaml:"ephemeral"`
+	EphemeralHeartbeatInterval time.Duration `yaml:"ephemeral_heartbeat_interval"`
+	// AddressCheckInterval is how often heartbeats look for a changed hostname or IP address
+	// and update the host on the server
+	AddressCheckInterval time.Duration `yaml:"address_check_interval"`
+}
+
+// SystemdConfig holds the systemd services collector configuration
+type SystemdConfig struct {
+	// ResourceUsage includes per-unit cgroup v2 CPU, memory and IO usage in the services report
+	ResourceUsage bool `yaml:"resource_usage"`
+	// Availability reports how long each unit was up over rolling windows
+	Availability AvailabilityConfig `yaml:"availability"`
+}
+
+// AvailabilityConfig holds the per-unit availability configuration
+type AvailabilityConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Interval is how often availability is reported
+	Interval time.Duration `yaml:"interval"`
+	// Windows are the rolling windows reported, in whole hours; the longest sets how long
+	// history is kept
+	Windows []time.Duration `yaml:"windows"`
+	// Units limits tracking to units matching these glob patterns; empty tracks every
+	// service
+	Units []string `yaml:"units"`
 }
 
-// LoadConfig loads configuration from file
-func LoadConfig(configPath string) (*Config, error) {
+// IPMIConfig holds the IPMI/BMC collector configuration
+type IPMIConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// Backend selects the tool used to talk to the BMC: "auto", "ipmitool" or "freeipmi"
+	Backend string `yaml:"backend"`
+}
+
+// ConnectionsConfig holds the connection mapping collector configuration
+type ConnectionsConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// MaxEdges caps the number of dependency edges sent per report
+	MaxEdges int `yaml:"max_edges"`
+}
+
+// NetFlowConfig holds the network flow telemetry configuration
+type NetFlowConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// EBPF prefers the eBPF probes; polling ss is used when they cannot be loaded
+	EBPF bool `yaml:"ebpf"`
+	// ObjectPath is the CO-RE object built by `make bpf`
+	ObjectPath string `yaml:"object_path"`
+}
+
+// AuditConfig holds the auditd event forwarding configuration
+type AuditConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	LogPath  string        `yaml:"log_path"`
+	Interval time.Duration `yaml:"interval"`
+	// SensitiveBinaries are executables whose execution is always forwarded
+	SensitiveBinaries []string `yaml:"sensitive_binaries"`
+	// RateLimit is the maximum number of events forwarded per minute
+	RateLimit int `yaml:"rate_limit"`
+}
+
+// FIMConfig holds the file integrity monitoring configuration
+type FIMConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Paths are files or directories (watched recursively) to monitor
+	Paths []string `yaml:"paths"`
+	// Exclude are glob patterns matched against full paths that are never hashed
+	Exclude []string `yaml:"exclude"`
+	// ScanInterval is how often a full rescan runs to catch changes the watcher missed
+	ScanInterval time.Duration `yaml:"scan_interval"`
+	// MaxFileSize skips hashing files larger than this many bytes
+	MaxFileSize int64 `yaml:"max_file_size"`
+}
+
+// ScheduledJobsConfig holds the cron and timer tracking configuration
+type ScheduledJobsConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// MissedGrace is how long after its expected time a job may start before it counts as missed
+	MissedGrace time.Duration `yaml:"missed_grace"`
+	// Lookback bounds how far back cron logs are searched for executions
+	Lookback time.Duration `yaml:"lookback"`
+}
+
+// FirewallConfig holds the firewall inventory configuration
+type FirewallConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// KernelConfig holds the kernel snapshot configuration
+type KernelConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// Sysctls are the keys (dotted form, e.g. net.ipv4.ip_forward) included in each snapshot
+	Sysctls []string `yaml:"sysctls"`
+}
+
+// KernelLogConfig holds the kernel log monitoring configuration
+type KernelLogConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// Source is "kmsg" for the kernel ring buffer, "journald" for the journal's kernel
+	// messages, or "auto" to use the ring buffer when it is readable
+	Source string `yaml:"source"`
+	// RateLimit is the maximum number of events forwarded per minute
+	RateLimit int `yaml:"rate_limit"`
+}
+
+// CrashesConfig holds the OOM kill and core dump detection configuration
+type CrashesConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// TextfileConfig holds the textfile collector configuration
+type TextfileConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// Directory holds the *.prom files, in the Prometheus text format
+	Directory string `yaml:"directory"`
+	// MaxFileKB leaves out larger files
+	MaxFileKB int `yaml:"max_file_kb"`
+	// MaxSamples bounds the samples forwarded per interval across every file
+	MaxSamples int `yaml:"max_samples"`
+}
+
+// ComplianceConfig holds the compliance check configuration
+type ComplianceConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// RulesDir holds additional *.yaml rule files; rules with a bundled ID override it
+	RulesDir string `yaml:"rules_dir"`
+	// DisableBundled runs only the rules from RulesDir
+	DisableBundled bool `yaml:"disable_bundled"`
+	// Skip lists rule IDs that are not evaluated
+	Skip []string `yaml:"skip"`
+}
+
+// RemoteHostsConfig holds the agentless SSH collection configuration
+type RemoteHostsConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// Timeout bounds connecting to a remote host
+	Timeout time.Duration `yaml:"timeout"`
+	// User and IdentityFile are the SSH credentials used for targets that set none
+	User         string `yaml:"user"`
+	IdentityFile string `yaml:"identity_file"`
+	// KnownHostsFile holds the host keys of the targets; unknown keys are refused
+	KnownHostsFile string             `yaml:"known_hosts_file"`
+	Targets        []RemoteHostTarget `yaml:"targets"`
+}
+
+// ContainersConfig holds the system container collector configuration
+type ContainersConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// Services also lists the systemd services inside each running container
+	Services bool `yaml:"services"`
+	// Exclude lists glob patterns of container names that are not reported
+	Exclude []string `yaml:"exclude"`
+}
+
+// LibvirtConfig holds the libvirt virtual machine collector configuration
+type LibvirtConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// URI is the libvirt connection virsh reads, such as qemu:///system
+	URI string `yaml:"uri"`
+	// Exclude lists glob patterns of domain names that are not reported
+	Exclude []string `yaml:"exclude"`
+}
+
+// StorageConfig holds the ZFS, LVM and software RAID storage collector configuration
+type StorageConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// MDStatInterval is how often /proc/mdstat is checked for a changed RAID array, which
+	// triggers a poll right away
+	MDStatInterval time.Duration `yaml:"mdstat_interval"`
+	// CapacityWarning is the percentage of a zpool, or of a thin pool's data or metadata,
+	// above which an event is raised; 0 disables
+	CapacityWarning int `yaml:"capacity_warning"`
+	// ThinOvercommit raises an event when the thin volumes of a pool may grow to more than
+	// this multiple of its size; 0 disables
+	ThinOvercommit float64 `yaml:"thin_overcommit"`
+}
+
+// NetworkMountsConfig holds the network mount probe configuration
+type NetworkMountsConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// Timeout is how long a mount may take to answer statfs before it is reported hung
+	Timeout time.Duration `yaml:"timeout"`
+	// Types lists the filesystem types that are probed
+	Types []string `yaml:"types"`
+	// Exclude lists glob patterns of mount points that are not probed
+	Exclude []string `yaml:"exclude"`
+}
+
+// SaturationConfig holds the kernel limit saturation collector configuration
+type SaturationConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// Warning is the percentage of a limit in use above which an event is raised
+	Warning int `yaml:"warning"`
+	// EntropyWarning raises an event when the kernel's entropy estimate drops below it;
+	// 0 disables
+	EntropyWarning int `yaml:"entropy_warning"`
+	// TopProcesses is the number of processes closest to their open file limit reported
+	TopProcesses int `yaml:"top_processes"`
+}
+
+// MetricsConfig holds the host metrics collector configuration
+type MetricsConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// TopProcesses is the number of busiest processes reported
+	TopProcesses int `yaml:"top_processes"`
+}
+
+// InventoryConfig holds the inventory collector configuration
+type InventoryConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// EventLogConfig holds the Windows event log collector configuration
+type EventLogConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// MaxEvents caps the entries read per channel and interval
+	MaxEvents int               `yaml:"max_events"`
+	Channels  []EventLogChannel `yaml:"channels"`
+}
+
+// EventLogChannel is an event log channel and the XPath query selecting its entries
+type EventLogChannel struct {
+	Name  string `yaml:"name"`
+	Query string `yaml:"query"`
+}
+
+// RemoteHostTarget is a device monitored over SSH and reported as a host of its own
+type RemoteHostTarget struct {
+	// Name is the hostname the device is registered with, defaulting to its address
+	Name         string            `yaml:"name"`
+	Address      string            `yaml:"address"`
+	Port         int               `yaml:"port"`
+	User         string            `yaml:"user"`
+	IdentityFile string            `yaml:"identity_file"`
+	Labels       map[string]string `yaml:"labels"`
+}
+
+// HelperConfig holds the privileged helper configuration
+type HelperConfig struct {
+	// Enabled routes root-only operations through the helper when the agent lacks privileges
+	Enabled    bool   `yaml:"enabled"`
+	SocketPath string `yaml:"socket_path"`
+}
+
+// SandboxConfig holds the process sandbox configuration
+type SandboxConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Strictness is "basic" (block system-altering syscalls) or "strict" (also block process
+	// introspection and confine the filesystem with landlock)
+	Strictness string `yaml:"strictness"`
+	// ReadPaths and WritePaths extend the paths allowed in strict mode
+	ReadPaths  []string `yaml:"read_paths"`
+	WritePaths []string `yaml:"write_paths"`
+}
+
+// ReportingConfig holds the outbound reporting configuration
+type ReportingConfig struct {
+	// Bulk combines all collector reports into one request per FlushInterval
+	Bulk          bool          `yaml:"bulk"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// Encoding is the report payload format: "json", "cbor", or "auto" to use CBOR once
+	// the server advertises it
+	Encoding string `yaml:"encoding"`
+	// MaxFlushKB bounds the reports in one bulk request; the highest-priority ones go first
+	// and the rest wait for the next flush. 0 is unlimited.
+	MaxFlushKB int `yaml:"max_flush_kb"`
+}
+
+// BandwidthConfig holds the budgets for collector reports on metered links. When a budget
+// runs low, inventory, logs and then metrics are shed before events.
+type BandwidthConfig struct {
+	// HourlyMB and DailyMB bound the report payloads sent per clock hour and per day; 0 is
+	// unlimited
+	HourlyMB int `yaml:"hourly_mb"`
+	DailyMB  int `yaml:"daily_mb"`
+	// DownsampleInterval is how often each metrics report is sent while metrics are downsampled
+	DownsampleInterval time.Duration `yaml:"downsample_interval"`
+}
+
+// BufferConfig holds the settings of the disk buffer that keeps reports the server could
+// not be reached for and sends them once it can
+type BufferConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	Directory string `yaml:"directory"`
+	// MaxSizeMB is the quota of the buffer on disk
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// HighWatermark and LowWatermark are percentages of the quota. Once the buffer passes the
+	// high one, the oldest reports of the lowest classes are dropped until it is below the low one.
+	HighWatermark int `yaml:"high_watermark"`
+	LowWatermark  int `yaml:"low_watermark"`
+	// MinFreeMB stops buffering while the filesystem holding the buffer has less space free
+	MinFreeMB int `yaml:"min_free_mb"`
+	// Compress stores reports zstd-compressed
+	Compress bool `yaml:"compress"`
+	// Encrypt stores reports sealed with AES-256-GCM under a key provisioned outside the
+	// buffer: Key references it in a secrets provider, or KeyFile names the file holding it
+	Encrypt bool   `yaml:"encrypt"`
+	Key     string `yaml:"key"`
+	KeyFile string `yaml:"key_file"`
+	// Retention is how long reports of each class are kept; 0 keeps them until the quota
+	// needs their space
+	Retention BufferRetention `yaml:"retention"`
+	// ReplayInterval is how often buffered reports are sent again
+	ReplayInterval time.Duration `yaml:"replay_interval"`
+}
+
+// BufferRetention holds how long the disk buffer keeps reports of each data class
+type BufferRetention struct {
+	Events    time.Duration `yaml:"events"`
+	Metrics   time.Duration `yaml:"metrics"`
+	Logs      time.Duration `yaml:"logs"`
+	Inventory time.Duration `yaml:"inventory"`
+}
+
+// RemoteConfigConfig holds the server-pushed configuration settings
+type RemoteConfigConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// Locked lists dotted keys, e.g. "fim.paths", the server may not override
+	Locked []string `yaml:"locked"`
+}
+
+// CommandSigningConfig holds the keys server-issued commands must be signed with
+type CommandSigningConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// PublicKeys are base64-encoded Ed25519 public keys; a command signed by any of them
+	// is accepted, so a new key can be pinned before the server switches to it
+	PublicKeys []string `yaml:"public_keys"`
+	// ClockSkew is how far the server's clock may be off when checking issue and expiry times
+	ClockSkew time.Duration `yaml:"clock_skew"`
+	// MaxLifetime rejects commands valid for longer than this after they were issued
+	MaxLifetime time.Duration `yaml:"max_lifetime"`
+}
+
+// ControlConfig holds the local control socket configuration
+type ControlConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	SocketPath string `yaml:"socket_path"`
+	// LogLines is how many recent log lines are kept in memory for the logs command
+	LogLines int `yaml:"log_lines"`
+}
+
+// EventDedupConfig holds the event deduplication configuration
+type EventDedupConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Window is how long repeats of an event are counted before a summary is sent
+	Window time.Duration `yaml:"window"`
+}
+
+// ErrorBudgetConfig holds the per-collector error budget configuration
+type ErrorBudgetConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxFailures is how many iterations in a row a collector may fail before it backs off
+	MaxFailures int `yaml:"max_failures"`
+	// BackoffInterval is how often a backed-off collector retries until it succeeds again
+	BackoffInterval time.Duration `yaml:"backoff_interval"`
+}
+
+// CommandsConfig holds the limits of the external commands collectors run, such as zpool,
+// ipmitool or virsh, so a hung command cannot pile up behind itself
+type CommandsConfig struct {
+	// MaxConcurrent is how many commands run at once across all collectors
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// PerCollector is how many commands one collector runs at once
+	PerCollector int `yaml:"per_collector"`
+	// Timeout kills a command that has not finished
+	Timeout time.Duration `yaml:"timeout"`
+	// Collectors overrides the limits of single collectors, by collector name
+	Collectors map[string]CommandLimits `yaml:"collectors"`
+}
+
+// CommandLimits overrides the command limits of one collector; zero keeps the default
+type CommandLimits struct {
+	Concurrency int           `yaml:"concurrency"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// ExecConfig holds the defaults of every external command the agent runs, from collector
+// tools to checks and hooks
+type ExecConfig struct {
+	// Timeout kills a command that sets no timeout of its own
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxOutputKB fails a command printing more than this many kilobytes
+	MaxOutputKB int `yaml:"max_output_kb"`
+	// KeepEnv names the agent's environment variables commands see besides PATH, HOME,
+	// the locale and the time zone; a trailing * matches a prefix
+	KeepEnv []string `yaml:"keep_env"`
+	// Wrapper is "bwrap" or "nsjail" to run commands that only read the system in a
+	// read-only sandbox, or empty to run them directly
+	Wrapper string `yaml:"wrapper"`
+}
+
+// QueryCacheConfig holds how long the results of slow system queries, such as the
+// installed packages, are reused before they are queried again
+type QueryCacheConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// PackagesTTL bounds reusing the installed packages; a change of the package database
+	// refreshes them sooner
+	PackagesTTL time.Duration `yaml:"packages_ttl"`
+	// HardwareTTL bounds reusing the DMI and CPU description of the machine
+	HardwareTTL time.Duration `yaml:"hardware_ttl"`
+}
+
+// LoggingConfig holds the agent log file configuration
+type LoggingConfig struct {
+	// File is the log file; when empty the agent logs to stderr, which systemd hands to
+	// the journal
+	File string `yaml:"file"`
+	// MaxSizeMB rotates the file when it would grow past this many megabytes, 0 for no limit
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// RotateInterval rotates the file once it is this old, 0 to rotate only by size
+	RotateInterval time.Duration `yaml:"rotate_interval"`
+	// MaxBackups is how many rotated files are kept, 0 for no limit
+	MaxBackups int `yaml:"max_backups"`
+	// MaxAge removes rotated files older than this, 0 for no limit
+	MaxAge time.Duration `yaml:"max_age"`
+	// Compress gzips rotated files
+	Compress bool `yaml:"compress"`
+}
+
+// DebugConfig holds the runtime diagnostics configuration
+type DebugConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Listen is the loopback address serving pprof and expvar
+	Listen string `yaml:"listen"`
+}
+
+// SelfLimitsConfig holds the agent's own resource budget
+type SelfLimitsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MemoryMB is the memory budget; zero derives it from the agent's cgroup memory limit
+	MemoryMB int `yaml:"memory_mb"`
+	// CPUPercent is the CPU budget in percent of one core; zero derives it from the cgroup CPU quota
+	CPUPercent    float64       `yaml:"cpu_percent"`
+	CheckInterval time.Duration `yaml:"check_interval"`
+	// Essential collectors keep running while load is shed
+	Essential []string `yaml:"essential"`
+}
+
+// HostConfig locates the host's filesystems and D-Bus socket when the agent runs in a
+// container; empty paths default to /host/proc, /host/sys, /host/var/log, /host and the
+// D-Bus socket under the host root
+type HostConfig struct {
+	// Mode is "auto" to detect containers, "host" or "container"
+	Mode       string `yaml:"mode"`
+	ProcRoot   string `yaml:"proc_root"`
+	SysRoot    string `yaml:"sys_root"`
+	LogRoot    string `yaml:"log_root"`
+	RootFS     string `yaml:"root_fs"`
+	DBusSocket string `yaml:"dbus_socket"`
+}
+
+// KubernetesConfig holds the DaemonSet identity configuration, read from the downward API
+type KubernetesConfig struct {
+	// Enabled registers the node instead of the pod when running in a Kubernetes pod
+	Enabled bool `yaml:"enabled"`
+	// Cluster distinguishes nodes with the same name in different clusters
+	Cluster string `yaml:"cluster"`
+	// NodeNameEnv is the environment variable set from spec.nodeName
+	NodeNameEnv string `yaml:"node_name_env"`
+	// LabelsFile is a downward API volume file of labels sent with the host
+	LabelsFile string `yaml:"labels_file"`
+}
+
+// PathDiagnosticsConfig holds the on-demand path diagnostics configuration
+type PathDiagnosticsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// PollInterval is how often the server is asked for requested diagnostics
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Probes is the number of probes sent to each hop
+	Probes  int `yaml:"probes"`
+	MaxHops int `yaml:"max_hops"`
+}
+
+// SpeedTestConfig holds the on-demand throughput test configuration
+type SpeedTestConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// SizeMB is the amount of data downloaded and then uploaded
+	SizeMB int `yaml:"size_mb"`
+}
+
+// RunbooksConfig holds the scripts the server may run on the host. Scripts are only ever
+// registered in the local file; the server triggers them by name.
+type RunbooksConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// PollInterval is how often the server is asked for requested runs
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Timeout applies to scripts that do not set their own
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxConcurrent is how many runbooks may run at once; requests beyond it are refused
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// MaxOutputKB bounds the stdout and stderr captured and uploaded for each run
+	MaxOutputKB int `yaml:"max_output_kb"`
+	// Scripts maps runbook names to the scripts they run
+	Scripts map[string]RunbookScript `yaml:"scripts"`
+}
+
+// RunbookScript is a locally stored script the server may run by name
+type RunbookScript struct {
+	// Path is the absolute path of the script; it must not be writable by group or others
+	Path string   `yaml:"path"`
+	Args []string `yaml:"args"`
+	// Timeout kills the script, and everything it started, after this long
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxMemoryMB limits the script's address space, 0 for no limit
+	MaxMemoryMB int `yaml:"max_memory_mb"`
+	// MaxCPUSeconds limits the script's CPU time, 0 for no limit
+	MaxCPUSeconds int `yaml:"max_cpu_seconds"`
+}
+
+// FileRetrievalConfig holds the files the server may fetch from the host. A file is
+// retrieved only when its path, with symlinks resolved, matches allowed_paths and none of
+// denied_paths.
+type FileRetrievalConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// PollInterval is how often the server is asked for requested files
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// AllowedPaths are absolute files, directories whose whole tree is allowed, or
+	// filepath.Match patterns such as /etc/nginx/*.conf
+	AllowedPaths []string `yaml:"allowed_paths"`
+	// DeniedPaths take the same forms and win over AllowedPaths
+	DeniedPaths []string `yaml:"denied_paths"`
+	// MaxSizeKB refuses larger files rather than uploading part of them
+	MaxSizeKB int `yaml:"max_size_kb"`
+	// Redact are regular expressions whose matches are replaced before upload: each
+	// capture group when the expression has any, otherwise the whole match
+	Redact []string `yaml:"redact"`
+	// RedactHook optionally runs a command over every file after Redact
+	RedactHook FileRedactHook `yaml:"redact_hook"`
+}
+
+// FileRedactHook is a local command that redacts a retrieved file. It gets the content on
+// stdin and the file's path as its last argument, and prints the content to upload; a
+// non-zero exit refuses the retrieval.
+type FileRedactHook struct {
+	// Command is the absolute path of the program and its arguments, empty for no hook
+	Command []string      `yaml:"command"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// SnapshotConfig holds the on-demand system snapshot configuration. Snapshots include
+// process command lines and open files, so they are off unless enabled locally.
+type SnapshotConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// PollInterval is how often the server is asked for requested snapshots
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Timeout bounds each command run for a snapshot
+	Timeout time.Duration `yaml:"timeout"`
+	// DmesgLines is how many of the most recent kernel log lines are kept
+	DmesgLines int `yaml:"dmesg_lines"`
+	// MaxFileKB bounds each file of the snapshot; longer output is cut short
+	MaxFileKB int `yaml:"max_file_kb"`
+}
+
+// RebootsConfig holds the reboot detection configuration
+type RebootsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Interval is how often the agent records that the host is up, which bounds how
+	// precisely the end of a crashed boot is known
+	Interval time.Duration `yaml:"interval"`
+	// Remote lets the server reboot the host
+	Remote RemoteRebootConfig `yaml:"remote"`
+}
+
+// RemoteRebootConfig holds the configuration of reboots requested by the server
+type RemoteRebootConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// PollInterval is how often the server is asked for requested reboots
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Command reboots the host; empty uses systemctl reboot, shutdown -r now, or
+	// shutdown /r on Windows
+	Command []string `yaml:"command"`
+	// OnlyInWindow refuses requests outside a maintenance window that allows reboots
+	OnlyInWindow bool `yaml:"only_in_window"`
+	// FlushTimeout bounds sending queued reports before rebooting
+	FlushTimeout time.Duration `yaml:"flush_timeout"`
+}
+
+// MaintenanceConfig holds the maintenance windows
+type MaintenanceConfig struct {
+	// Windows are periods of planned work; events raised during one are tagged with its
+	// name
+	Windows []MaintenanceWindow `yaml:"windows"`
+}
+
+// MaintenanceWindow is a recurring or one-off period of planned work
+type MaintenanceWindow struct {
+	Name string `yaml:"name"`
+	// Schedule is a cron expression, in local time, for when a recurring window opens
+	Schedule string        `yaml:"schedule"`
+	Duration time.Duration `yaml:"duration"`
+	// Start and End bound a one-off window, instead of Schedule and Duration
+	Start time.Time `yaml:"start"`
+	End   time.Time `yaml:"end"`
+	// Reboot marks the window as one in which the host is expected to reboot
+	Reboot bool `yaml:"reboot"`
+}
+
+// RemediationConfig holds the rules for restarting failed systemd units. Rules are only
+// ever set in the local file.
+type RemediationConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxRestarts is how many restarts are attempted before escalating, for rules that do
+	// not set their own
+	MaxRestarts int `yaml:"max_restarts"`
+	// Backoff is the wait before the first restart, doubled before each one after
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// ResetAfter is how long a unit has to stay out of the failed state before its
+	// restarts are forgotten
+	ResetAfter time.Duration `yaml:"reset_after"`
+	// RestartTimeout bounds waiting for systemctl restart
+	RestartTimeout time.Duration     `yaml:"restart_timeout"`
+	Rules          []RemediationRule `yaml:"rules"`
+}
+
+// RemediationRule restarts the units it matches when they fail
+type RemediationRule struct {
+	// Unit is a unit name or a glob pattern such as "worker@*.service"
+	Unit string `yaml:"unit"`
+	// MaxRestarts, Backoff and MaxBackoff override the section's when set
+	MaxRestarts int           `yaml:"max_restarts"`
+	Backoff     time.Duration `yaml:"backoff"`
+	MaxBackoff  time.Duration `yaml:"max_backoff"`
+}
+
+// MQTTConfig holds the MQTT transport configuration for edge deployments
+type MQTTConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// BrokerURL is a tcp://, mqtt://, ssl:// or mqtts:// URL, optionally with credentials
+	BrokerURL string `yaml:"broker_url"`
+	// TopicTemplate expands {host_rid} and {kind}, e.g. "heartbeat" or "fim-events"
+	TopicTemplate string `yaml:"topic_template"`
+	// QoS is 0 (at most once) or 1 (at least once)
+	QoS       byte          `yaml:"qos"`
+	ClientID  string        `yaml:"client_id"`
+	Username  string        `yaml:"username"`
+	Password  string        `yaml:"password"`
+	KeepAlive time.Duration `yaml:"keep_alive"`
+}
+
+// GatewayConfig holds the gateway mode configuration
+type GatewayConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Listen  string `yaml:"listen"`
+	// AllowedNetworks lists the CIDRs of agents allowed to relay through the gateway
+	AllowedNetworks []string `yaml:"allowed_networks"`
+	// TLSCert and TLSKey serve the gateway over HTTPS when set
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+}
+
+// CustomMetricsConfig holds the configuration of the localhost API through which
+// applications on the host send their own metrics and events
+type CustomMetricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Listen must be a loopback address; the API is only for applications on the host
+	Listen string `yaml:"listen"`
+	// Token, when set, must be sent by applications as a bearer token
+	Token string `yaml:"token"`
+	// Interval is how often accepted metrics and events are forwarded
+	Interval time.Duration `yaml:"interval"`
+	// RateLimit is how many metrics and events are accepted per minute, across applications
+	RateLimit int `yaml:"rate_limit"`
+	// MaxQueued bounds the metrics and events kept while the server is unreachable
+	MaxQueued int `yaml:"max_queued"`
+}
+
+// UDPHeartbeatConfig holds the configuration of the signed UDP heartbeat, which tells the
+// server the host is up while HTTPS to it is broken, such as by a failing proxy
+type UDPHeartbeatConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Address is the host:port datagrams are sent to; an empty host is the host of sprinter_url
+	Address  string        `yaml:"address"`
+	Interval time.Duration `yaml:"interval"`
+	// OnlyOnFailure sends datagrams only while HTTPS heartbeats are failing
+	OnlyOnFailure bool `yaml:"only_on_failure"`
+}
+
+// DNSConfig holds the resolvers the agent uses for its own connections instead of the
+// ones in /etc/resolv.conf. Collectors and the host itself are not affected.
+type DNSConfig struct {
+	// Servers are DNS servers as IP or IP:port, queried in turn
+	Servers []string `yaml:"servers"`
+	// DoHURL is a DNS-over-HTTPS endpoint, such as https://1.1.1.1/dns-query; when set,
+	// servers only resolve its host name
+	DoHURL string `yaml:"doh_url"`
+	// Timeout bounds each lookup through the configured resolvers
+	Timeout time.Duration `yaml:"timeout"`
+	// Fallback retries a failed lookup with the system resolver
+	Fallback bool `yaml:"fallback"`
+}
+
+// TLSConfig holds how the agent verifies the Somana server's certificate
+type TLSConfig struct {
+	// CAFile is a PEM bundle of the authorities trusted to sign the server's certificate,
+	// instead of the system's
+	CAFile string `yaml:"ca_file"`
+	// PinnedKeys are base64 SHA-256 hashes of public keys (SPKI); when set, a server whose
+	// verified chain holds none of them is refused
+	PinnedKeys []string `yaml:"pinned_keys"`
+}
+
+// FIPSConfig holds the restricted crypto mode required in regulated environments
+type FIPSConfig struct {
+	// Enabled limits every TLS connection to FIPS-approved versions, cipher suites and curves
+	Enabled bool `yaml:"enabled"`
+	// RequireModule refuses to start a binary not built with a FIPS-validated crypto module
+	RequireModule bool `yaml:"require_module"`
+}
+
+// PayloadSigningConfig holds the signing of what the agent sends, so the server can verify
+// it came from the agent unaltered when TLS ends at a gateway or MQTT broker
+type PayloadSigningConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// SecretsConfig holds the providers that credentials written as references, such as
+// "vault:secret/data/sprinter#mqtt_password", are fetched from when the agent starts
+type SecretsConfig struct {
+	// Timeout bounds fetching each secret
+	Timeout time.Duration `yaml:"timeout"`
+	Vault   VaultConfig   `yaml:"vault"`
+	// AWSRegion is the region of "aws-sm:" secrets, read with the aws CLI; empty uses the
+	// CLI's default
+	AWSRegion string `yaml:"aws_region"`
+	// Command prints the secret of an "exec:" reference, which it is given as its last
+	// argument
+	Command []string `yaml:"command"`
+}
+
+// VaultConfig holds how "vault:" secrets are read from HashiCorp Vault's KV engine
+type VaultConfig struct {
+	// Address is Vault's URL, such as https://vault.example.com:8200
+	Address string `yaml:"address"`
+	// Token authenticates to Vault; TokenFile is read instead when set, such as the sink
+	// of a Vault agent
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	Namespace string `yaml:"namespace"`
+}
+
+// LoadConfig loads configuration from file, merged with its conf.d fragments and
+// environment overlay. Precedence is defaults < profile < files < overrides, and a profile
+// selected by an override applies its defaults too.
+func LoadConfig(configPath string, overrides ...Override) (*Config, error) {
 	// Create default config
 	config := &Config{
-		HostRegistration: struct {
-			SprinterURL string `yaml:"sprinter_url"`
-		}{
-			SprinterURL: "http://localhost:8081",
+		Profile: ProfileStandard,
+		HostRegistration: HostRegistrationConfig{
+			SprinterURL:                "http://localhost:8081",
+			HeartbeatInterval:          5 * time.Second,
+			EphemeralHeartbeatInterval: 2 * time.Second,
+			AddressCheckInterval:       time.Minute,
+		},
+		Systemd: SystemdConfig{
+			ResourceUsage: true,
+			Availability: AvailabilityConfig{
+				Enabled:  true,
+				Interval: 5 * time.Minute,
+				Windows:  []time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour, 30 * 24 * time.Hour},
+			},
+		},
+		IPMI: IPMIConfig{
+			Enabled:  false,
+			Interval: 60 * time.Second,
+			Backend:  "auto",
+		},
+		Connections: ConnectionsConfig{
+			Enabled:  false,
+			Interval: 60 * time.Second,
+			MaxEdges: 500,
+		},
+		NetFlow: NetFlowConfig{
+			Enabled:    false,
+			Interval:   30 * time.Second,
+			EBPF:       true,
+			ObjectPath: "/usr/lib/sprinter/netflow.bpf.o",
+		},
+		Audit: AuditConfig{
+			Enabled:  false,
+			LogPath:  "/var/log/audit/audit.log",
+			Interval: 10 * time.Second,
+			SensitiveBinaries: []string{
+				"/usr/bin/sudo", "/usr/bin/su", "/usr/bin/passwd", "/usr/sbin/useradd",
+				"/usr/sbin/usermod", "/usr/sbin/visudo", "/usr/bin/chsh", "/usr/bin/crontab",
+			},
+			RateLimit: 120,
+		},
+		FIM: FIMConfig{
+			Enabled:      false,
+			Paths:        []string{"/etc", "/usr/bin", "/usr/sbin"},
+			Exclude:      []string{"/etc/mtab", "/etc/*.cache", "/etc/ld.so.cache"},
+			ScanInterval: 1 * time.Hour,
+			MaxFileSize:  64 * 1024 * 1024,
+		},
+		ScheduledJobs: ScheduledJobsConfig{
+			Enabled:     false,
+			Interval:    5 * time.Minute,
+			MissedGrace: 10 * time.Minute,
+			Lookback:    48 * time.Hour,
+		},
+		Firewall: FirewallConfig{
+			Enabled:  false,
+			Interval: 5 * time.Minute,
+		},
+		KernelLog: KernelLogConfig{
+			Enabled:   true,
+			Interval:  10 * time.Second,
+			Source:    "auto",
+			RateLimit: 60,
+		},
+		Crashes: CrashesConfig{
+			Enabled:  true,
+			Interval: 15 * time.Second,
+		},
+		Textfile: TextfileConfig{
+			Enabled:    false,
+			Interval:   time.Minute,
+			Directory:  "textfile",
+			MaxFileKB:  1024,
+			MaxSamples: 10000,
+		},
+		Kernel: KernelConfig{
+			Enabled:  true,
+			Interval: 10 * time.Minute,
+			Sysctls: []string{
+				"kernel.randomize_va_space",
+				"kernel.kptr_restrict",
+				"kernel.dmesg_restrict",
+				"kernel.yama.ptrace_scope",
+				"fs.protected_hardlinks",
+				"fs.protected_symlinks",
+				"fs.suid_dumpable",
+				"net.ipv4.ip_forward",
+				"net.ipv4.tcp_syncookies",
+				"net.ipv4.conf.all.accept_redirects",
+				"net.ipv4.conf.all.send_redirects",
+				"net.ipv4.conf.all.accept_source_route",
+				"net.ipv4.conf.all.rp_filter",
+				"net.ipv4.conf.all.log_martians",
+				"net.ipv6.conf.all.accept_redirects",
+			},
+		},
+		Compliance: ComplianceConfig{
+			Enabled:  false,
+			Interval: 6 * time.Hour,
+			RulesDir: "config/compliance.d",
+		},
+		RemoteHosts: RemoteHostsConfig{
+			Enabled:        false,
+			Interval:       60 * time.Second,
+			Timeout:        10 * time.Second,
+			KnownHostsFile: "config/remote_hosts_known_hosts",
+		},
+		Containers: ContainersConfig{
+			Enabled:  false,
+			Interval: 60 * time.Second,
+		},
+		Libvirt: LibvirtConfig{
+			Enabled:  false,
+			Interval: 60 * time.Second,
+			URI:      "qemu:///system",
+		},
+		Storage: StorageConfig{
+			Enabled:         false,
+			Interval:        5 * time.Minute,
+			MDStatInterval:  10 * time.Second,
+			CapacityWarning: 85,
+			ThinOvercommit:  2,
+		},
+		NetworkMounts: NetworkMountsConfig{
+			Enabled:  false,
+			Interval: 60 * time.Second,
+			Timeout:  5 * time.Second,
+			Types:    []string{"nfs", "nfs4", "cifs", "smb3", "smbfs", "ceph", "glusterfs", "fuse.glusterfs", "fuse.sshfs", "lustre", "afs"},
+		},
+		Saturation: SaturationConfig{
+			Enabled:        false,
+			Interval:       60 * time.Second,
+			Warning:        80,
+			EntropyWarning: 200,
+			TopProcesses:   5,
+		},
+		Metrics: MetricsConfig{
+			Enabled:      false,
+			Interval:     60 * time.Second,
+			TopProcesses: 10,
+		},
+		Inventory: InventoryConfig{
+			Enabled:  false,
+			Interval: time.Hour,
+		},
+		EventLog: EventLogConfig{
+			Enabled:   false,
+			Interval:  30 * time.Second,
+			MaxEvents: 500,
+			Channels: []EventLogChannel{
+				{Name: "System", Query: "*[System[(Level=1 or Level=2 or Level=3)]]"},
+				{Name: "Application", Query: "*[System[(Level=1 or Level=2 or Level=3)]]"},
+				// Failed logons, lockouts, account creation and group membership changes
+				{Name: "Security", Query: "*[System[(EventID=4625 or EventID=4740 or EventID=4720 or EventID=4732)]]"},
+			},
+		},
+		Helper: HelperConfig{
+			Enabled:    false,
+			SocketPath: "/run/sprinter-agent-helper/helper.sock",
+		},
+		Sandbox: SandboxConfig{
+			Enabled:    false,
+			Strictness: "basic",
+		},
+		Reporting: ReportingConfig{
+			Bulk:          true,
+			FlushInterval: 5 * time.Second,
+			Encoding:      "json",
+			MaxFlushKB:    512,
+		},
+		Bandwidth: BandwidthConfig{
+			DownsampleInterval: 5 * time.Minute,
+		},
+		Buffer: BufferConfig{
+			Enabled:       false,
+			Directory:     "data/buffer",
+			MaxSizeMB:     100,
+			HighWatermark: 90,
+			LowWatermark:  70,
+			MinFreeMB:     256,
+			Compress:      true,
+			Encrypt:       false,
+			Retention: BufferRetention{
+				Events:    7 * 24 * time.Hour,
+				Metrics:   24 * time.Hour,
+				Logs:      3 * 24 * time.Hour,
+				Inventory: 24 * time.Hour,
+			},
+			ReplayInterval: 30 * time.Second,
+		},
+		RemoteConfig: RemoteConfigConfig{
+			Enabled:  false,
+			Interval: 60 * time.Second,
+		},
+		CommandSigning: CommandSigningConfig{
+			Enabled:     false,
+			ClockSkew:   time.Minute,
+			MaxLifetime: 24 * time.Hour,
+		},
+		Control: ControlConfig{
+			Enabled:    true,
+			SocketPath: defaultControlSocket,
+			LogLines:   500,
+		},
+		EventDedup: EventDedupConfig{
+			Enabled: true,
+			Window:  5 * time.Minute,
+		},
+		ErrorBudget: ErrorBudgetConfig{
+			Enabled:         true,
+			MaxFailures:     10,
+			BackoffInterval: time.Hour,
+		},
+		Commands: CommandsConfig{
+			MaxConcurrent: 8,
+			PerCollector:  2,
+			Timeout:       time.Minute,
+		},
+		Exec: ExecConfig{
+			Timeout:     time.Minute,
+			MaxOutputKB: 16 << 10,
+		},
+		QueryCache: QueryCacheConfig{
+			Enabled:     true,
+			PackagesTTL: 24 * time.Hour,
+			HardwareTTL: 24 * time.Hour,
+		},
+		Logging: LoggingConfig{
+			MaxSizeMB:      50,
+			RotateInterval: 24 * time.Hour,
+			MaxBackups:     7,
+			MaxAge:         7 * 24 * time.Hour,
+			Compress:       true,
+		},
+		Debug: DebugConfig{
+			Enabled: false,
+			Listen:  "127.0.0.1:6060",
+		},
+		SelfLimits: SelfLimitsConfig{
+			Enabled:       true,
+			CheckInterval: 30 * time.Second,
+			Essential:     []string{"systemd"},
+		},
+		Host: HostConfig{
+			Mode: "auto",
+		},
+		Kubernetes: KubernetesConfig{
+			Enabled:     true,
+			NodeNameEnv: "NODE_NAME",
+			LabelsFile:  "/etc/podinfo/labels",
+		},
+		PathDiagnostics: PathDiagnosticsConfig{
+			Enabled:      true,
+			PollInterval: time.Minute,
+			Probes:       5,
+			MaxHops:      30,
+		},
+		SpeedTest: SpeedTestConfig{
+			Enabled: false,
+			SizeMB:  4,
+		},
+		Runbooks: RunbooksConfig{
+			Enabled:       false,
+			PollInterval:  time.Minute,
+			Timeout:       5 * time.Minute,
+			MaxConcurrent: 1,
+			MaxOutputKB:   256,
+		},
+		FileRetrieval: FileRetrievalConfig{
+			Enabled:      false,
+			PollInterval: time.Minute,
+			AllowedPaths: []string{"/etc/systemd/system", "/lib/systemd/system", "/usr/lib/systemd/system"},
+			DeniedPaths:  []string{"/etc/shadow", "/etc/shadow-", "/etc/gshadow", "/etc/gshadow-", "/etc/ssh/ssh_host_*_key"},
+			MaxSizeKB:    1024,
+			Redact: []string{
+				`(?i)[\w.-]*(?:password|passwd|secret|token|api_?key)[\w.-]*["']?\s*[:=]\s*["']?([^\s"']+)`,
+				`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----(.*?)-----END [A-Z ]*PRIVATE KEY-----`,
+			},
+			RedactHook: FileRedactHook{
+				Timeout: 10 * time.Second,
+			},
+		},
+		Snapshot: SnapshotConfig{
+			Enabled:      false,
+			PollInterval: time.Minute,
+			Timeout:      30 * time.Second,
+			DmesgLines:   500,
+			MaxFileKB:    4096,
+		},
+		Reboots: RebootsConfig{
+			Enabled:  true,
+			Interval: time.Minute,
+			Remote: RemoteRebootConfig{
+				Enabled:      false,
+				PollInterval: time.Minute,
+				OnlyInWindow: true,
+				FlushTimeout: 30 * time.Second,
+			},
+		},
+		Remediation: RemediationConfig{
+			Enabled:        false,
+			MaxRestarts:    3,
+			Backoff:        10 * time.Second,
+			MaxBackoff:     5 * time.Minute,
+			ResetAfter:     10 * time.Minute,
+			RestartTimeout: 90 * time.Second,
+		},
+		MQTT: MQTTConfig{
+			Enabled:       false,
+			TopicTemplate: "somana/{host_rid}/{kind}",
+			QoS:           1,
+			KeepAlive:     60 * time.Second,
+		},
+		Gateway: GatewayConfig{
+			Enabled: false,
+			Listen:  ":8090",
+		},
+		CustomMetrics: CustomMetricsConfig{
+			Enabled:   false,
+			Listen:    "127.0.0.1:9102",
+			Interval:  30 * time.Second,
+			RateLimit: 6000,
+			MaxQueued: 10000,
+		},
+		UDPHeartbeat: UDPHeartbeatConfig{
+			Enabled:  false,
+			Address:  ":4515",
+			Interval: 30 * time.Second,
+		},
+		DNS: DNSConfig{
+			Timeout:  5 * time.Second,
+			Fallback: true,
+		},
+		Secrets: SecretsConfig{
+			Timeout: 10 * time.Second,
 		},
 	}
 
-	// Load from file if it exists
-	if _, err := os.Stat(configPath); err == nil {
-		file, err := os.Open(configPath)
-		if err != nil {
-			return nil, err
-		}
-		defer file.Close()
+	// Load from the files that exist
+	sources, err := readSources(configPath, overrides)
+	if err != nil {
+		return nil, err
+	}
+	data, err := mergeSources(sources)
+	if err != nil {
+		return nil, err
+	}
 
-		decoder := yaml.NewDecoder(file)
-		if err := decoder.Decode(config); err != nil {
-			return nil, err
+	// The profile's defaults apply first so the rest of the file overrides them
+	var selected struct {
+		Profile string `yaml:"profile"`
+	}
+	if err := yaml.Unmarshal(data, &selected); err != nil {
+		return nil, err
+	}
+	for _, override := range overrides {
+		if override.Path == "profile" {
+			selected.Profile = override.Value
 		}
 	}
+	if err := applyProfile(config, selected.Profile); err != nil {
+		return nil, err
+	}
 
-	return config, nil
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return applyOverrides(config, overrides)
 }
 
 // SaveConfig saves configuration to file
@@ -61,4 +1354,4 @@ func SaveConfig(config *Config, configPath string) error {
 	defer encoder.Close()
 	
 	return encoder.Encode(config)
-} 
\ No newline at end of file
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SetValues sets configuration values, keyed by their dotted YAML path, in the file at
+// configPath and leaves the rest of the file, including its comments, as it was. The file
+// is created when missing; since it may hold secrets, a new file is only readable by its
+// owner.
+func SetValues(configPath string, values map[string]string) error {
+	var doc yaml.Node
+	mode := os.FileMode(0600)
+	data, err := os.ReadFile(configPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return &SyntaxError{Path: configPath, Err: err}
+		}
+		if info, err := os.Stat(configPath); err == nil {
+			mode = info.Mode().Perm()
+		}
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: expected a mapping at the top level", configPath)
+	}
+
+	fields := configFields()
+	paths := make([]string, 0, len(values))
+	for path := range values {
+		if _, ok := lookupField(fields, path); !ok {
+			return fmt.Errorf("no configuration field %s", path)
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		value := &yaml.Node{Kind: yaml.ScalarNode, Value: values[path]}
+		// Strings stay strings, so a token such as "no" or "0123" is written quoted
+		if field, _ := lookupField(fields, path); field.typ.Kind() == reflect.String {
+			value.Tag = "!!str"
+		}
+		if err := setNodeValue(root, strings.Split(path, "."), value); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return err
+	}
+	// Written next to the file and renamed over it, so a failed write leaves the old one
+	tmp := configPath + ".tmp"
+	if err := os.WriteFile(tmp, out, mode); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, configPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// setNodeValue sets a scalar in a mapping node, adding the mappings along the path
+func setNodeValue(node *yaml.Node, parts []string, value *yaml.Node) error {
+	for i, part := range parts {
+		child := mappingValue(node, part)
+		if child == nil {
+			child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: part}, child)
+		}
+		if i == len(parts)-1 {
+			value.LineComment = child.LineComment
+			*child = *value
+			return nil
+		}
+		if child.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s is not a section", part)
+		}
+		node = child
+	}
+	return nil
+}
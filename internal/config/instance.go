@@ -0,0 +1,30 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// defaultControlSocket is where the control socket of the unnamed instance listens
+const defaultControlSocket = "/run/sprinter-agent/control.sock"
+
+// instanceNamePattern keeps instance names usable in directory, socket and unit names
+var instanceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// CheckInstanceName checks a name given with -instance
+func CheckInstanceName(name string) error {
+	if !instanceNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid instance name %q: expected up to 32 lowercase letters, digits, '-' or '_'", name)
+	}
+	return nil
+}
+
+// ApplyInstance marks the configuration as belonging to a named instance. A control socket
+// left at its default moves to a directory of the instance's own, so the CLI of one
+// instance does not talk to another.
+func (c *Config) ApplyInstance(name string) {
+	c.Instance = name
+	if name != "" && c.Control.SocketPath == defaultControlSocket {
+		c.Control.SocketPath = fmt.Sprintf("/run/sprinter-agent-%s/control.sock", name)
+	}
+}
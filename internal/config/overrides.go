@@ -0,0 +1,200 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the names of environment variables that override configuration values
+const EnvPrefix = "SOMANA_"
+
+// Override sets one configuration value, addressed by its dotted YAML path such as
+// "host_registration.sprinter_url", from the environment or a -set flag
+type Override struct {
+	Path  string
+	Value string
+	// Source names where the override came from, for error messages
+	Source string
+}
+
+// configField is a settable path in the configuration and the type of its value
+type configField struct {
+	path string
+	typ  reflect.Type
+}
+
+// configFields lists every path in Config, including sections and map fields, keyed by path
+func configFields() map[string]configField {
+	fields := make(map[string]configField)
+	var walk func(t reflect.Type, prefix string)
+	walk = func(t reflect.Type, prefix string) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if name == "" || name == "-" || !field.IsExported() {
+				continue
+			}
+			path := prefix + name
+			fields[path] = configField{path: path, typ: field.Type}
+			if field.Type.Kind() == reflect.Struct {
+				walk(field.Type, path+".")
+			}
+		}
+	}
+	walk(reflect.TypeOf(Config{}), "")
+	return fields
+}
+
+// lookupField resolves a path, which may address a key inside a map field such as
+// "labels.site"
+func lookupField(fields map[string]configField, path string) (configField, bool) {
+	if field, ok := fields[path]; ok {
+		return field, true
+	}
+	parent, _, ok := cutLast(path)
+	if !ok {
+		return configField{}, false
+	}
+	if field, ok := fields[parent]; ok && field.typ.Kind() == reflect.Map {
+		return configField{path: path, typ: field.typ.Elem()}, true
+	}
+	return configField{}, false
+}
+
+// cutLast splits a dotted path before its last element
+func cutLast(path string) (string, string, bool) {
+	i := strings.LastIndex(path, ".")
+	if i < 0 {
+		return "", "", false
+	}
+	return path[:i], path[i+1:], true
+}
+
+// envName returns the environment variable overriding a path
+func envName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// EnvOverrides returns the overrides set by SOMANA_* variables in environ, in KEY=value
+// form, and the names of SOMANA_* variables that match no configuration field. Each
+// variable is the upper-cased path with dots replaced by underscores, such as
+// SOMANA_HOST_REGISTRATION_SPRINTER_URL; keys of map fields are lower-cased, so
+// SOMANA_LABELS_SITE sets labels.site.
+func EnvOverrides(environ []string) ([]Override, []string) {
+	fields := configFields()
+	byEnv := make(map[string]string, len(fields))
+	var mapPrefixes []string
+	for path, field := range fields {
+		byEnv[envName(path)] = path
+		if field.typ.Kind() == reflect.Map {
+			mapPrefixes = append(mapPrefixes, path)
+		}
+	}
+
+	overrides := []Override{}
+	unknown := []string{}
+	for _, entry := range environ {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		path, found := byEnv[name]
+		if !found {
+			for _, prefix := range mapPrefixes {
+				if key := strings.TrimPrefix(name, envName(prefix)+"_"); key != name && key != "" {
+					path, found = prefix+"."+strings.ToLower(key), true
+					break
+				}
+			}
+		}
+		if !found {
+			unknown = append(unknown, name)
+			continue
+		}
+		overrides = append(overrides, Override{Path: path, Value: value, Source: name})
+	}
+	// os.Environ has no defined order, so overrides are applied in a stable one
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].Path < overrides[j].Path })
+	sort.Strings(unknown)
+	return overrides, unknown
+}
+
+// ParseSetFlag parses the path=value argument of a -set flag
+func ParseSetFlag(arg string) (Override, error) {
+	path, value, ok := strings.Cut(arg, "=")
+	if !ok || path == "" {
+		return Override{}, fmt.Errorf("invalid -set %q, expected path=value", arg)
+	}
+	if _, ok := lookupField(configFields(), path); !ok {
+		return Override{}, fmt.Errorf("invalid -set %q: no configuration field %s", arg, path)
+	}
+	return Override{Path: path, Value: value, Source: "-set " + path}, nil
+}
+
+// applyOverrides sets the overridden values in cfg, later overrides winning. String fields
+// take the value verbatim; anything else is parsed as YAML, so durations read "30s" and
+// lists "[/etc, /opt]". Overridden paths are locked against remote configuration.
+func applyOverrides(cfg *Config, overrides []Override) (*Config, error) {
+	if len(overrides) == 0 {
+		return cfg, nil
+	}
+
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	var tree map[string]interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+
+	fields := configFields()
+	overridden := make([]string, 0, len(overrides))
+	for _, override := range overrides {
+		field, ok := lookupField(fields, override.Path)
+		if !ok {
+			return nil, fmt.Errorf("%s: no configuration field %s", override.Source, override.Path)
+		}
+		// Decoding into the field's own type reports a bad value against its source
+		value := reflect.New(field.typ)
+		if field.typ.Kind() == reflect.String {
+			value.Elem().SetString(override.Value)
+		} else if err := yaml.Unmarshal([]byte(override.Value), value.Interface()); err != nil {
+			return nil, fmt.Errorf("%s: invalid value %q: %w", override.Source, override.Value, err)
+		}
+		setPath(tree, strings.Split(override.Path, "."), value.Elem().Interface())
+		overridden = append(overridden, override.Path)
+	}
+
+	merged, err := yaml.Marshal(tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode overridden config: %w", err)
+	}
+	result := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(merged))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(result); err != nil {
+		return nil, fmt.Errorf("invalid override: %w", err)
+	}
+	// Added after decoding, since remote_config.locked may itself be overridden
+	result.RemoteConfig.Locked = append(result.RemoteConfig.Locked, overridden...)
+	return result, nil
+}
+
+// setPath sets a value in a decoded YAML tree, creating the maps along the path
+func setPath(tree map[string]interface{}, parts []string, value interface{}) {
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := tree[part].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			tree[part] = next
+		}
+		tree = next
+	}
+	tree[parts[len(parts)-1]] = value
+}
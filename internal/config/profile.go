@@ -0,0 +1,36 @@
+package config
+
+import "fmt"
+
+const (
+	// ProfileStandard keeps the regular defaults
+	ProfileStandard = "standard"
+	// ProfileMinimal trades report detail for memory on small ARM and embedded hosts
+	ProfileMinimal = "minimal"
+)
+
+// applyProfile overrides the defaults in cfg with those of the named profile; an empty
+// name selects the standard profile
+func applyProfile(cfg *Config, profile string) error {
+	switch profile {
+	case "", ProfileStandard:
+		return nil
+	case ProfileMinimal:
+		cfg.Profile = ProfileMinimal
+	default:
+		return fmt.Errorf("unknown profile %q, expected %q or %q", profile, ProfileStandard, ProfileMinimal)
+	}
+
+	// Smaller in-memory buffers and reports
+	cfg.Control.LogLines = 100
+	cfg.Connections.MaxEdges = 100
+	cfg.EventLog.MaxEvents = 100
+	cfg.Metrics.TopProcesses = 5
+	cfg.FIM.MaxFileSize = 8 * 1024 * 1024
+	// Loading the eBPF object costs more memory than the ss fallback
+	cfg.NetFlow.EBPF = false
+	// A fixed budget, since gateways rarely run the agent in a memory-limited cgroup
+	cfg.SelfLimits.MemoryMB = 48
+	cfg.SelfLimits.CPUPercent = 25
+	return nil
+}
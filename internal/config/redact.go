@@ -0,0 +1,40 @@
+package config
+
+import "net/url"
+
+// redactedValue replaces secrets in a redacted configuration
+const redactedValue = "REDACTED"
+
+// Redacted returns a copy of the configuration with its secrets, the enrollment token, the
+// MQTT password, the custom metrics token, the Vault token and credentials embedded in URLs, replaced, so it can be shared in support
+// tickets. Paths to key files are kept since they are not secret themselves.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	redacted.HostRegistration.EnrollmentToken = redactSecret(c.HostRegistration.EnrollmentToken)
+	redacted.HostRegistration.SprinterURL = redactURL(c.HostRegistration.SprinterURL)
+	redacted.MQTT.Password = redactSecret(c.MQTT.Password)
+	redacted.MQTT.BrokerURL = redactURL(c.MQTT.BrokerURL)
+	redacted.CustomMetrics.Token = redactSecret(c.CustomMetrics.Token)
+	redacted.Secrets.Vault.Token = redactSecret(c.Secrets.Vault.Token)
+	return &redacted
+}
+
+// redactSecret hides a secret, keeping an unset one empty so it still reads as unset
+func redactSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// redactURL hides the password of a URL with credentials
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redactedValue)
+	}
+	return u.String()
+}
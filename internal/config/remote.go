@@ -0,0 +1,142 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RemoteSections are the top-level sections a server-pushed configuration may set;
+// registration, helper, sandbox, command signing and remote config settings always come
+// from the local file
+var RemoteSections = map[string]bool{
+	"systemd":        true,
+	"ipmi":           true,
+	"connections":    true,
+	"netflow":        true,
+	"audit":          true,
+	"fim":            true,
+	"scheduled_jobs": true,
+	"firewall":       true,
+	"kernel":         true,
+	"kernel_log":     true,
+	"crashes":        true,
+	"textfile":       true,
+	"compliance":     true,
+	"containers":     true,
+	"libvirt":        true,
+	"storage":        true,
+	"network_mounts": true,
+	"saturation":     true,
+	"metrics":        true,
+	"inventory":      true,
+	"eventlog":       true,
+	"maintenance":    true,
+	"bandwidth":      true,
+	"commands":       true,
+	"query_cache":    true,
+}
+
+// ApplyRemote merges a server-pushed configuration document over the local configuration.
+// Precedence is defaults < local file < remote, except for sections outside RemoteSections
+// and for dotted keys listed in remote_config.locked (e.g. "fim" or "fim.paths"), which keep
+// their local value. Remote objects are merged key by key; any other value replaces the
+// local one. The ignored keys are returned so they can be reported.
+func ApplyRemote(local *Config, remote map[string]interface{}) (*Config, []string, error) {
+	data, err := yaml.Marshal(local)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode local config: %w", err)
+	}
+	var tree map[string]interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode local config: %w", err)
+	}
+
+	locked := make(map[string]bool, len(local.RemoteConfig.Locked))
+	for _, key := range local.RemoteConfig.Locked {
+		locked[key] = true
+	}
+
+	ignored := []string{}
+	for key, value := range remote {
+		if !RemoteSections[key] {
+			ignored = append(ignored, key)
+			continue
+		}
+		tree[key] = mergeRemote(tree[key], normalizeJSON(value), key, locked, &ignored)
+	}
+	sort.Strings(ignored)
+
+	merged, err := yaml.Marshal(tree)
+	if err != nil {
+		return nil, ignored, fmt.Errorf("failed to encode merged config: %w", err)
+	}
+	result := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(merged))
+	// Unknown keys mean the document was written for a different agent version
+	decoder.KnownFields(true)
+	if err := decoder.Decode(result); err != nil {
+		return nil, ignored, fmt.Errorf("invalid remote config: %w", err)
+	}
+	if problems := result.check(); len(problems) > 0 {
+		return nil, ignored, fmt.Errorf("invalid remote config: %s", problems[0])
+	}
+	return result, ignored, nil
+}
+
+// mergeRemote merges a remote value into a local one at a dotted key path
+func mergeRemote(local, remote interface{}, path string, locked map[string]bool, ignored *[]string) interface{} {
+	if locked[path] {
+		*ignored = append(*ignored, path)
+		return local
+	}
+
+	remoteMap, remoteIsMap := remote.(map[string]interface{})
+	localMap, localIsMap := local.(map[string]interface{})
+	if !remoteIsMap || !localIsMap {
+		if remoteIsMap && hasLockedBelow(path, locked) {
+			*ignored = append(*ignored, path)
+			return local
+		}
+		return remote
+	}
+
+	for key, value := range remoteMap {
+		localMap[key] = mergeRemote(localMap[key], value, path+"."+key, locked, ignored)
+	}
+	return localMap
+}
+
+// normalizeJSON turns integral JSON numbers into integers so they decode into integer
+// and duration fields
+func normalizeJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+			return int64(v)
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeJSON(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeJSON(item)
+		}
+	}
+	return value
+}
+
+// hasLockedBelow reports whether any locked key lies under path
+func hasLockedBelow(path string, locked map[string]bool) bool {
+	for key := range locked {
+		if strings.HasPrefix(key, path+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SecretRef is a credential to fetch from a secrets provider instead of a value in the
+// file, written as "<provider>:<path>#<key>"
+type SecretRef struct {
+	// Provider is "vault", "aws-sm" or "exec"
+	Provider string
+	// Path is the Vault path, the Secrets Manager secret ID or name, or the argument
+	// given to the exec command
+	Path string
+	// Key selects a field of a Vault secret or of a JSON Secrets Manager secret
+	Key string
+}
+
+// String returns the reference as written in the file
+func (r SecretRef) String() string {
+	if r.Key == "" {
+		return r.Provider + ":" + r.Path
+	}
+	return r.Provider + ":" + r.Path + "#" + r.Key
+}
+
+// secretProviders are the prefixes of values that reference a secret
+var secretProviders = []string{"vault", "aws-sm", "exec"}
+
+// ParseSecretRef parses a value referencing a secret; ok is false for a plain value
+func ParseSecretRef(value string) (SecretRef, bool) {
+	for _, provider := range secretProviders {
+		rest, found := strings.CutPrefix(value, provider+":")
+		if !found {
+			continue
+		}
+		path, key, _ := strings.Cut(rest, "#")
+		return SecretRef{Provider: provider, Path: path, Key: key}, true
+	}
+	return SecretRef{}, false
+}
+
+// SecretField is a credential of the configuration that may reference a secret
+type SecretField struct {
+	Path  string
+	Value *string
+}
+
+// SecretFields returns the credentials that may reference a secret
+func (c *Config) SecretFields() []SecretField {
+	return []SecretField{
+		{"host_registration.enrollment_token", &c.HostRegistration.EnrollmentToken},
+		{"mqtt.password", &c.MQTT.Password},
+		{"custom_metrics.token", &c.CustomMetrics.Token},
+	}
+}
+
+// checkSecretRef validates a secret reference against the configured providers
+func (c *Config) checkSecretRef(ref SecretRef) error {
+	if ref.Path == "" {
+		return fmt.Errorf("%q names no secret", ref.String())
+	}
+	switch ref.Provider {
+	case "vault":
+		if c.Secrets.Vault.Address == "" {
+			return fmt.Errorf("%q needs secrets.vault.address", ref.String())
+		}
+		if c.Secrets.Vault.Token == "" && c.Secrets.Vault.TokenFile == "" {
+			return fmt.Errorf("%q needs secrets.vault.token or secrets.vault.token_file", ref.String())
+		}
+		if ref.Key == "" {
+			return fmt.Errorf("%q needs the key of the secret's field after #", ref.String())
+		}
+	case "exec":
+		if len(c.Secrets.Command) == 0 {
+			return fmt.Errorf("%q needs secrets.command", ref.String())
+		}
+	}
+	return nil
+}
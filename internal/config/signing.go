@@ -0,0 +1,24 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// ParsePublicKeys decodes the pinned signing keys
+func (c CommandSigningConfig) ParsePublicKeys() ([]ed25519.PublicKey, error) {
+	keys := make([]ed25519.PublicKey, 0, len(c.PublicKeys))
+	for i, encoded := range c.PublicKeys {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("public key %d is not valid base64: %w", i, err)
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("public key %d is %d bytes, expected a %d-byte Ed25519 key", i, len(key), ed25519.PublicKeySize)
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	return keys, nil
+}
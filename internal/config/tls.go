@@ -0,0 +1,25 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// ParsePinnedKeys decodes the pinned SPKI hashes, written as base64 with an optional
+// "sha256//" prefix as curl's --pinnedpubkey takes them
+func (c TLSConfig) ParsePinnedKeys() ([][sha256.Size]byte, error) {
+	pins := make([][sha256.Size]byte, 0, len(c.PinnedKeys))
+	for i, encoded := range c.PinnedKeys {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(encoded), "sha256//"))
+		if err != nil {
+			return nil, fmt.Errorf("pinned key %d is not valid base64: %w", i, err)
+		}
+		if len(raw) != sha256.Size {
+			return nil, fmt.Errorf("pinned key %d is %d bytes, expected a %d-byte SHA-256 hash", i, len(raw), sha256.Size)
+		}
+		pins = append(pins, [sha256.Size]byte(raw))
+	}
+	return pins, nil
+}
@@ -0,0 +1,806 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is a configuration error, or a warning such as an unknown key
+type Problem struct {
+	File string
+	// Line and Column locate the problem in File; zero when the value is not in the file
+	Line    int
+	Column  int
+	Path    string
+	Message string
+	Warning bool
+}
+
+// String formats the problem as file:line:column: path: message
+func (p Problem) String() string {
+	var b strings.Builder
+	if p.File != "" {
+		b.WriteString(p.File)
+		if p.Line > 0 {
+			fmt.Fprintf(&b, ":%d", p.Line)
+		}
+		if p.Column > 0 {
+			fmt.Fprintf(&b, ":%d", p.Column)
+		}
+		b.WriteString(": ")
+	}
+	if p.Path != "" {
+		b.WriteString(p.Path + ": ")
+	}
+	b.WriteString(p.Message)
+	return b.String()
+}
+
+// HasErrors reports whether any of the problems is an error rather than a warning
+func HasErrors(problems []Problem) bool {
+	for _, problem := range problems {
+		if !problem.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+// yamlErrorLine matches the line number in yaml.v3 syntax errors
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// position is where a path was last set among the configuration files
+type position struct {
+	file string
+	node *yaml.Node
+}
+
+// Validate checks a configuration file, its fragments and overlay, and the overrides
+// applied to them. Unknown keys are warnings, so a file written for a newer agent still
+// loads; values of the wrong type, malformed URLs and durations, unknown enum values and
+// undefined variables are errors. The returned error is only set when a file cannot be read.
+func Validate(configPath string, overrides ...Override) ([]Problem, error) {
+	problems := []Problem{}
+	sources, err := readSources(configPath, overrides)
+	var syntaxErr *SyntaxError
+	var variableErr *VariableError
+	switch {
+	case errors.As(err, &syntaxErr):
+		problem := Problem{File: syntaxErr.Path, Message: syntaxErr.Err.Error()}
+		if match := yamlErrorLine.FindStringSubmatch(problem.Message); match != nil {
+			problem.Line, _ = strconv.Atoi(match[1])
+			problem.Message = match[2]
+		}
+		return append(problems, problem), nil
+	case errors.As(err, &variableErr):
+		return append(problems, Problem{
+			File:    variableErr.Path,
+			Line:    variableErr.Line,
+			Message: variableErr.detail(),
+		}), nil
+	case err != nil:
+		return nil, err
+	}
+
+	// Later files set a path last, so their positions replace earlier ones
+	positions := make(map[string]position)
+	for _, src := range sources {
+		nodes := make(map[string]*yaml.Node)
+		first := len(problems)
+		checkNode(src.node, reflect.TypeOf(Config{}), "", nodes, &problems)
+		for i := first; i < len(problems); i++ {
+			problems[i].File = src.path
+		}
+		for path, node := range nodes {
+			positions[path] = position{file: src.path, node: node}
+		}
+	}
+	if HasErrors(problems) {
+		return locate(configPath, problems, positions), nil
+	}
+
+	cfg, err := LoadConfig(configPath, overrides...)
+	if err != nil {
+		return append(locate(configPath, problems, positions), Problem{File: configPath, Message: err.Error()}), nil
+	}
+	problems = append(problems, cfg.check()...)
+	return locate(configPath, problems, positions), nil
+}
+
+// locate fills in the file position of each problem from the nearest node on its path,
+// and sorts the problems by file and position
+func locate(configPath string, problems []Problem, positions map[string]position) []Problem {
+	for i := range problems {
+		if problems[i].File != "" {
+			continue
+		}
+		problems[i].File = configPath
+		for path := problems[i].Path; path != ""; {
+			if pos, ok := positions[path]; ok {
+				problems[i].File, problems[i].Line, problems[i].Column = pos.file, pos.node.Line, pos.node.Column
+				break
+			}
+			path, _, _ = cutLast(path)
+		}
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		a, b := problems[i], problems[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return problems
+}
+
+// durationType is checked before the generic integer kinds it shares a kind with
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// checkNode checks a YAML node against the Go type it decodes into, recording the position
+// of every path it visits
+func checkNode(node *yaml.Node, typ reflect.Type, path string, positions map[string]*yaml.Node, problems *[]Problem) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return
+	}
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	report := func(n *yaml.Node, message string) {
+		*problems = append(*problems, Problem{Line: n.Line, Column: n.Column, Path: path, Message: message})
+	}
+
+	switch typ.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			report(node, "expected a mapping of settings")
+			return
+		}
+		fields := make(map[string]reflect.Type, typ.NumField())
+		for i := 0; i < typ.NumField(); i++ {
+			name, _, _ := strings.Cut(typ.Field(i).Tag.Get("yaml"), ",")
+			if name != "" && name != "-" {
+				fields[name] = typ.Field(i).Type
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			childPath := joinPath(path, key.Value)
+			positions[childPath] = key
+			fieldType, ok := fields[key.Value]
+			if !ok {
+				// Merge keys bring in fields checked where the anchor was defined
+				if key.Value == "<<" {
+					continue
+				}
+				message := fmt.Sprintf("unknown key %q", key.Value)
+				if suggestion := closestKey(key.Value, fields); suggestion != "" {
+					message += fmt.Sprintf(", did you mean %q?", suggestion)
+				}
+				*problems = append(*problems, Problem{Line: key.Line, Column: key.Column, Path: childPath, Message: message, Warning: true})
+				continue
+			}
+			checkNode(value, fieldType, childPath, positions, problems)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			report(node, "expected a mapping")
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			childPath := joinPath(path, node.Content[i].Value)
+			positions[childPath] = node.Content[i]
+			checkNode(node.Content[i+1], typ.Elem(), childPath, positions, problems)
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			report(node, "expected a list")
+			return
+		}
+		for i, item := range node.Content {
+			childPath := fmt.Sprintf("%s[%d]", path, i)
+			positions[childPath] = item
+			checkNode(item, typ.Elem(), childPath, positions, problems)
+		}
+	default:
+		if node.Kind != yaml.ScalarNode {
+			report(node, "expected "+describeType(typ))
+			return
+		}
+		if err := node.Decode(reflect.New(typ).Interface()); err != nil {
+			report(node, fmt.Sprintf("expected %s, got %q", describeType(typ), node.Value))
+		}
+	}
+}
+
+// joinPath appends a key to a dotted path
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// describeType names the kind of value a type expects
+func describeType(typ reflect.Type) string {
+	if typ == durationType {
+		return "a duration such as 30s or 5m"
+	}
+	switch typ.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "an integer"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a non-negative integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	default:
+		return "a string"
+	}
+}
+
+// closestKey suggests the known key nearest to a misspelled one, if any is close
+func closestKey(key string, fields map[string]reflect.Type) string {
+	best, bestDistance := "", len(key)/2+1
+	for name := range fields {
+		if distance := editDistance(key, name); distance < bestDistance || (distance == bestDistance && name < best) {
+			best, bestDistance = name, distance
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// check validates the values of a decoded configuration
+func (c *Config) check() []Problem {
+	problems := []Problem{}
+	add := func(path, format string, args ...interface{}) {
+		problems = append(problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	oneOf := func(path, value string, allowed ...string) {
+		for _, option := range allowed {
+			if value == option {
+				return
+			}
+		}
+		add(path, "unknown value %q, expected one of %s", value, strings.Join(allowed, ", "))
+	}
+
+	if err := CheckServerURL(c.HostRegistration.SprinterURL); err != nil {
+		add("host_registration.sprinter_url", "%v", err)
+	}
+	oneOf("profile", c.Profile, ProfileStandard, ProfileMinimal)
+	if c.HostRegistration.IdentityProvider != "" {
+		oneOf("host_registration.identity_provider", c.HostRegistration.IdentityProvider, "aws", "gcp", "azure", "auto")
+	}
+	oneOf("ipmi.backend", c.IPMI.Backend, "auto", "ipmitool", "freeipmi")
+	oneOf("sandbox.strictness", c.Sandbox.Strictness, "basic", "strict")
+	oneOf("reporting.encoding", c.Reporting.Encoding, "json", "cbor", "auto")
+	oneOf("host.mode", c.Host.Mode, "auto", "host", "container")
+	oneOf("kernel_log.source", c.KernelLog.Source, "auto", "kmsg", "journald")
+
+	if c.Reporting.MaxFlushKB < 0 {
+		add("reporting.max_flush_kb", "must not be negative")
+	}
+	if c.Bandwidth.HourlyMB < 0 {
+		add("bandwidth.hourly_mb", "must not be negative")
+	}
+	if c.Bandwidth.DailyMB < 0 {
+		add("bandwidth.daily_mb", "must not be negative")
+	}
+	if c.Buffer.Enabled {
+		if c.Buffer.Directory == "" {
+			add("buffer.directory", "required when the buffer is enabled")
+		}
+		if c.Buffer.MaxSizeMB < 1 {
+			add("buffer.max_size_mb", "must be at least 1")
+		}
+		if c.Buffer.HighWatermark < 1 || c.Buffer.HighWatermark > 100 {
+			add("buffer.high_watermark", "must be a percentage between 1 and 100")
+		}
+		if c.Buffer.LowWatermark < 0 || c.Buffer.LowWatermark >= c.Buffer.HighWatermark {
+			add("buffer.low_watermark", "must be a percentage below high_watermark")
+		}
+		if c.Buffer.MinFreeMB < 0 {
+			add("buffer.min_free_mb", "must not be negative")
+		}
+		if c.Buffer.Encrypt {
+			ref, isRef := ParseSecretRef(c.Buffer.Key)
+			switch {
+			case c.Buffer.Key == "" && c.Buffer.KeyFile == "":
+				add("buffer.key_file", "required when buffer encryption is enabled, unless buffer.key references a secret; the key is never generated")
+			case c.Buffer.Key != "" && c.Buffer.KeyFile != "":
+				add("buffer.key", "cannot be combined with buffer.key_file")
+			case c.Buffer.Key != "" && !isRef:
+				add("buffer.key", "must reference a secret, such as vault:secret/data/sprinter#buffer_key")
+			case isRef:
+				if err := c.checkSecretRef(ref); err != nil {
+					add("buffer.key", "%v", err)
+				}
+			case withinPath(c.Buffer.KeyFile, "data") || withinPath(c.Buffer.KeyFile, c.Buffer.Directory):
+				add("buffer.key_file", "must not be in the data directory or buffer.directory, next to the reports it protects")
+			}
+		}
+	}
+	if c.ErrorBudget.Enabled && c.ErrorBudget.MaxFailures < 1 {
+		add("error_budget.max_failures", "must be at least 1")
+	}
+	if c.Commands.MaxConcurrent < 1 {
+		add("commands.max_concurrent", "must be at least 1")
+	}
+	if c.Commands.PerCollector < 1 {
+		add("commands.per_collector", "must be at least 1")
+	}
+	commandCollectors := make([]string, 0, len(c.Commands.Collectors))
+	for name := range c.Commands.Collectors {
+		commandCollectors = append(commandCollectors, name)
+	}
+	sort.Strings(commandCollectors)
+	for _, name := range commandCollectors {
+		limits := c.Commands.Collectors[name]
+		if limits.Concurrency < 0 {
+			add("commands.collectors."+name+".concurrency", "must not be negative")
+		}
+		if limits.Timeout < 0 {
+			add("commands.collectors."+name+".timeout", "must not be negative")
+		}
+	}
+	if c.QueryCache.Enabled {
+		if c.QueryCache.PackagesTTL <= 0 {
+			add("query_cache.packages_ttl", "must be positive")
+		}
+		if c.QueryCache.HardwareTTL <= 0 {
+			add("query_cache.hardware_ttl", "must be positive")
+		}
+	}
+	if c.Exec.MaxOutputKB < 1 {
+		add("exec.max_output_kb", "must be at least 1")
+	}
+	if c.Exec.Wrapper != "" {
+		oneOf("exec.wrapper", c.Exec.Wrapper, "bwrap", "nsjail")
+		if c.Sandbox.Enabled {
+			add("exec.wrapper", "cannot be used with sandbox.enabled, whose seccomp filter blocks the namespaces and mounts %s needs", c.Exec.Wrapper)
+		}
+	}
+	if c.CommandSigning.Enabled {
+		if len(c.CommandSigning.PublicKeys) == 0 {
+			add("command_signing.public_keys", "at least one key is required when command signing is enabled")
+		}
+		if _, err := c.CommandSigning.ParsePublicKeys(); err != nil {
+			add("command_signing.public_keys", "%v", err)
+		}
+		if c.CommandSigning.MaxLifetime == 0 {
+			add("command_signing.max_lifetime", "must be positive")
+		}
+	}
+	if c.Runbooks.Enabled {
+		if c.Runbooks.MaxConcurrent < 1 {
+			add("runbooks.max_concurrent", "must be at least 1")
+		}
+		if c.Runbooks.MaxOutputKB < 1 {
+			add("runbooks.max_output_kb", "must be at least 1")
+		}
+	}
+	runbooks := make([]string, 0, len(c.Runbooks.Scripts))
+	for name := range c.Runbooks.Scripts {
+		runbooks = append(runbooks, name)
+	}
+	sort.Strings(runbooks)
+	for _, name := range runbooks {
+		script := c.Runbooks.Scripts[name]
+		path := "runbooks.scripts." + name
+		if !filepath.IsAbs(script.Path) {
+			add(path+".path", "must be an absolute path, got %q", script.Path)
+		}
+		if script.Timeout < 0 {
+			add(path+".timeout", "must not be negative, got %s", script.Timeout)
+		}
+		if script.MaxMemoryMB < 0 || script.MaxCPUSeconds < 0 {
+			add(path, "max_memory_mb and max_cpu_seconds must not be negative")
+		}
+	}
+	if c.FileRetrieval.Enabled && c.FileRetrieval.MaxSizeKB < 1 {
+		add("file_retrieval.max_size_kb", "must be at least 1")
+	}
+	checkPathPatterns("file_retrieval.allowed_paths", c.FileRetrieval.AllowedPaths, add)
+	checkPathPatterns("file_retrieval.denied_paths", c.FileRetrieval.DeniedPaths, add)
+	for i, pattern := range c.FileRetrieval.Redact {
+		if _, err := regexp.Compile(pattern); err != nil {
+			add(fmt.Sprintf("file_retrieval.redact[%d]", i), "%v", err)
+		}
+	}
+	if hook := c.FileRetrieval.RedactHook.Command; len(hook) > 0 && !filepath.IsAbs(hook[0]) {
+		add("file_retrieval.redact_hook.command", "must start with an absolute path, got %q", hook[0])
+	}
+	if c.Snapshot.Enabled {
+		if c.Snapshot.DmesgLines < 1 {
+			add("snapshot.dmesg_lines", "must be at least 1")
+		}
+		if c.Snapshot.MaxFileKB < 1 {
+			add("snapshot.max_file_kb", "must be at least 1")
+		}
+	}
+	if c.Reboots.Remote.Enabled && !c.Reboots.Enabled {
+		add("reboots.remote.enabled", "requires reboots.enabled, which confirms the reboot after boot")
+	}
+	windows := make(map[string]bool, len(c.Maintenance.Windows))
+	for i, window := range c.Maintenance.Windows {
+		path := fmt.Sprintf("maintenance.windows[%d]", i)
+		if window.Name == "" {
+			add(path+".name", "is required")
+		} else if windows[window.Name] {
+			add(path+".name", "duplicate window %q", window.Name)
+		}
+		windows[window.Name] = true
+		switch {
+		case window.Schedule != "" && !window.Start.IsZero():
+			add(path, "set either schedule and duration, or start and end")
+		case window.Schedule != "":
+			if fields := strings.Fields(window.Schedule); len(fields) != 5 && !strings.HasPrefix(window.Schedule, "@") {
+				add(path+".schedule", "expected a cron expression with 5 fields, got %q", window.Schedule)
+			}
+			if window.Duration <= 0 {
+				add(path+".duration", "must be positive")
+			}
+		case !window.Start.IsZero():
+			if !window.End.After(window.Start) {
+				add(path+".end", "must be after start")
+			}
+		default:
+			add(path, "set either schedule and duration, or start and end")
+		}
+	}
+	if c.Systemd.Availability.Enabled && len(c.Systemd.Availability.Windows) == 0 {
+		add("systemd.availability.windows", "must list at least one window")
+	}
+	for i, window := range c.Systemd.Availability.Windows {
+		path := fmt.Sprintf("systemd.availability.windows[%d]", i)
+		if window <= 0 || window%time.Hour != 0 {
+			add(path, "must be a positive number of whole hours, got %s", window)
+		} else if window > maxAvailabilityWindow {
+			add(path, "must be at most %s, got %s", maxAvailabilityWindow, window)
+		}
+	}
+	for i, pattern := range c.Systemd.Availability.Units {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			add(fmt.Sprintf("systemd.availability.units[%d]", i), "invalid pattern %q: %v", pattern, err)
+		}
+	}
+	if c.Textfile.Enabled {
+		if c.Textfile.Directory == "" {
+			add("textfile.directory", "is required")
+		}
+		if c.Textfile.MaxFileKB < 1 {
+			add("textfile.max_file_kb", "must be at least 1")
+		}
+		if c.Textfile.MaxSamples < 1 {
+			add("textfile.max_samples", "must be at least 1")
+		}
+	}
+	for i, pattern := range c.Containers.Exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			add(fmt.Sprintf("containers.exclude[%d]", i), "invalid pattern %q: %v", pattern, err)
+		}
+	}
+	if c.Libvirt.Enabled && c.Libvirt.URI == "" {
+		add("libvirt.uri", "is required")
+	} else if err := checkLibvirtURI(c.Libvirt.URI); c.Libvirt.URI != "" && err != nil {
+		add("libvirt.uri", "%v", err)
+	}
+	for i, pattern := range c.Libvirt.Exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			add(fmt.Sprintf("libvirt.exclude[%d]", i), "invalid pattern %q: %v", pattern, err)
+		}
+	}
+	if c.Storage.CapacityWarning < 0 || c.Storage.CapacityWarning > 100 {
+		add("storage.capacity_warning", "must be between 0 and 100, got %d", c.Storage.CapacityWarning)
+	}
+	if c.Storage.ThinOvercommit < 0 {
+		add("storage.thin_overcommit", "must not be negative, got %g", c.Storage.ThinOvercommit)
+	}
+	if c.NetworkMounts.Enabled && c.NetworkMounts.Timeout >= c.NetworkMounts.Interval {
+		add("network_mounts.timeout", "must be shorter than network_mounts.interval (%s), got %s", c.NetworkMounts.Interval, c.NetworkMounts.Timeout)
+	}
+	if c.Saturation.Warning < 1 || c.Saturation.Warning > 100 {
+		add("saturation.warning", "must be between 1 and 100, got %d", c.Saturation.Warning)
+	}
+	if c.Saturation.EntropyWarning < 0 {
+		add("saturation.entropy_warning", "must not be negative, got %d", c.Saturation.EntropyWarning)
+	}
+	if c.Saturation.TopProcesses < 0 {
+		add("saturation.top_processes", "must not be negative, got %d", c.Saturation.TopProcesses)
+	}
+	for i, pattern := range c.NetworkMounts.Exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			add(fmt.Sprintf("network_mounts.exclude[%d]", i), "invalid pattern %q: %v", pattern, err)
+		}
+	}
+	if c.Remediation.Enabled {
+		if c.Remediation.MaxRestarts < 1 {
+			add("remediation.max_restarts", "must be at least 1")
+		}
+		for _, field := range []struct {
+			path  string
+			value time.Duration
+		}{
+			{"remediation.backoff", c.Remediation.Backoff},
+			{"remediation.max_backoff", c.Remediation.MaxBackoff},
+			{"remediation.reset_after", c.Remediation.ResetAfter},
+			{"remediation.restart_timeout", c.Remediation.RestartTimeout},
+		} {
+			if field.value <= 0 {
+				add(field.path, "must be positive")
+			}
+		}
+	}
+	for i, rule := range c.Remediation.Rules {
+		path := fmt.Sprintf("remediation.rules[%d]", i)
+		if rule.Unit == "" {
+			add(path+".unit", "is required")
+		} else if _, err := filepath.Match(rule.Unit, ""); err != nil {
+			add(path+".unit", "invalid pattern %q: %v", rule.Unit, err)
+		}
+		if rule.MaxRestarts < 0 || rule.Backoff < 0 || rule.MaxBackoff < 0 {
+			add(path, "max_restarts, backoff and max_backoff must not be negative")
+		}
+	}
+	if c.Logging.MaxSizeMB < 0 {
+		add("logging.max_size_mb", "must not be negative")
+	}
+	if c.Logging.MaxBackups < 0 {
+		add("logging.max_backups", "must not be negative")
+	}
+
+	if c.MQTT.Enabled {
+		if err := checkURL(c.MQTT.BrokerURL, "tcp", "mqtt", "ssl", "tls", "mqtts"); err != nil {
+			add("mqtt.broker_url", "%v", err)
+		}
+		if c.MQTT.QoS > 1 {
+			add("mqtt.qos", "must be 0 or 1")
+		}
+	}
+
+	if c.Gateway.Enabled {
+		if _, _, err := net.SplitHostPort(c.Gateway.Listen); err != nil {
+			add("gateway.listen", "expected host:port or :port: %v", err)
+		}
+		if (c.Gateway.TLSCert == "") != (c.Gateway.TLSKey == "") {
+			add("gateway", "tls_cert and tls_key must be set together")
+		}
+	}
+	for i, network := range c.Gateway.AllowedNetworks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			add(fmt.Sprintf("gateway.allowed_networks[%d]", i), "expected a CIDR such as 10.0.0.0/8, got %q", network)
+		}
+	}
+	if c.CustomMetrics.Enabled {
+		if host, _, err := net.SplitHostPort(c.CustomMetrics.Listen); err != nil {
+			add("custom_metrics.listen", "expected host:port: %v", err)
+		} else if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			add("custom_metrics.listen", "must be a loopback address such as 127.0.0.1:9102, got %q", c.CustomMetrics.Listen)
+		}
+		if c.CustomMetrics.RateLimit < 1 {
+			add("custom_metrics.rate_limit", "must be at least 1")
+		}
+		if c.CustomMetrics.MaxQueued < 1 {
+			add("custom_metrics.max_queued", "must be at least 1")
+		}
+	}
+	if c.UDPHeartbeat.Enabled {
+		if _, port, err := net.SplitHostPort(c.UDPHeartbeat.Address); err != nil {
+			add("udp_heartbeat.address", "expected host:port: %v", err)
+		} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			add("udp_heartbeat.address", "invalid port %q", port)
+		}
+	}
+	for i, server := range c.DNS.Servers {
+		host := server
+		if h, port, err := net.SplitHostPort(server); err == nil {
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				add(fmt.Sprintf("dns.servers[%d]", i), "invalid port %q", port)
+			}
+			host = h
+		}
+		if net.ParseIP(host) == nil {
+			add(fmt.Sprintf("dns.servers[%d]", i), "expected an IP address or IP:port, got %q", server)
+		}
+	}
+	if c.DNS.DoHURL != "" {
+		if u, err := url.Parse(c.DNS.DoHURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			add("dns.doh_url", "expected an https:// URL such as https://1.1.1.1/dns-query, got %q", c.DNS.DoHURL)
+		}
+	}
+	if _, err := c.TLS.ParsePinnedKeys(); err != nil {
+		add("tls.pinned_keys", "%v", err)
+	}
+	if len(c.TLS.PinnedKeys) > 0 && !strings.HasPrefix(c.HostRegistration.SprinterURL, "https://") {
+		add("tls.pinned_keys", "only apply to an https:// host_registration.sprinter_url, got %q", c.HostRegistration.SprinterURL)
+	}
+	if c.FIPS.RequireModule && !c.FIPS.Enabled {
+		add("fips.require_module", "needs fips.enabled")
+	}
+	if c.Secrets.Vault.Address != "" {
+		if u, err := url.Parse(c.Secrets.Vault.Address); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			add("secrets.vault.address", "expected a URL such as https://vault.example.com:8200, got %q", c.Secrets.Vault.Address)
+		}
+	}
+	for _, field := range c.SecretFields() {
+		if ref, ok := ParseSecretRef(*field.Value); ok {
+			if err := c.checkSecretRef(ref); err != nil {
+				add(field.Path, "%v", err)
+			}
+		}
+	}
+	for i, target := range c.RemoteHosts.Targets {
+		if target.Address == "" {
+			add(fmt.Sprintf("remote_hosts.targets[%d].address", i), "is required")
+		}
+	}
+	for i, channel := range c.EventLog.Channels {
+		if channel.Name == "" {
+			add(fmt.Sprintf("eventlog.channels[%d].name", i), "is required")
+		}
+	}
+	fields := configFields()
+	for i, key := range c.RemoteConfig.Locked {
+		if _, ok := lookupField(fields, key); !ok {
+			add(fmt.Sprintf("remote_config.locked[%d]", i), "no configuration field %s", key)
+		}
+	}
+
+	checkDurations(reflect.ValueOf(*c), "", add)
+	return problems
+}
+
+// CheckServerURL checks a Somana server URL, as given for host_registration.sprinter_url
+func CheckServerURL(value string) error {
+	return checkURL(value, "http", "https")
+}
+
+// checkURL checks that a URL is absolute with one of the allowed schemes
+func checkURL(value string, schemes ...string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %w", value, err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid URL %q: expected %s://host[:port]", value, schemes[0])
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported scheme %q in %q, expected %s", u.Scheme, value, strings.Join(schemes, ", "))
+}
+
+// checkPathPatterns requires absolute, well-formed paths or patterns
+func checkPathPatterns(path string, patterns []string, add func(path, format string, args ...interface{})) {
+	for i, pattern := range patterns {
+		entry := fmt.Sprintf("%s[%d]", path, i)
+		if !filepath.IsAbs(pattern) {
+			add(entry, "must be an absolute path, got %q", pattern)
+		} else if _, err := filepath.Match(pattern, pattern); err != nil {
+			add(entry, "invalid pattern %q: %v", pattern, err)
+		}
+	}
+}
+
+// maxAvailabilityWindow bounds the history kept for unit availability
+const maxAvailabilityWindow = 90 * 24 * time.Hour
+
+// zeroDisables lists the intervals where zero turns the check off rather than being invalid
+var zeroDisables = map[string]bool{
+	"host_registration.address_check_interval": true,
+	"logging.rotate_interval":                  true,
+}
+
+// checkDurations rejects negative durations, and zero intervals and timeouts in sections
+// that are enabled or cannot be disabled, since tickers need a positive period
+func checkDurations(v reflect.Value, path string, add func(path, format string, args ...interface{})) {
+	typ := v.Type()
+	enabled := true
+	if field := v.FieldByName("Enabled"); field.IsValid() && field.Kind() == reflect.Bool {
+		enabled = field.Bool()
+	}
+	for i := 0; i < typ.NumField(); i++ {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		field := v.Field(i)
+		fieldPath := joinPath(path, name)
+		switch {
+		case field.Type() == durationType:
+			d := time.Duration(field.Int())
+			goName := typ.Field(i).Name
+			periodic := (strings.HasSuffix(goName, "Interval") || goName == "Timeout") && !zeroDisables[fieldPath]
+			if d < 0 {
+				add(fieldPath, "must not be negative, got %s", d)
+			} else if d == 0 && periodic && enabled {
+				add(fieldPath, "must be positive")
+			}
+		case field.Kind() == reflect.Struct:
+			checkDurations(field, fieldPath, add)
+		}
+	}
+}
+
+// withinPath reports whether path is dir or lies below it
+func withinPath(path, dir string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// libvirtCommandParams are libvirt URI parameters that make virsh run a program or use
+// credentials and sockets of the caller's choosing
+var libvirtCommandParams = []string{"command", "netcat", "socket", "keyfile"}
+
+// checkLibvirtURI accepts only connections to the local libvirt socket. libvirt.uri may
+// come from remote configuration, and the ssh, ext and libssh transports run programs the
+// URI names, as root.
+func checkLibvirtURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" {
+		return fmt.Errorf("expected a libvirt URI such as qemu:///system, got %q", uri)
+	}
+	if _, transport, ok := strings.Cut(u.Scheme, "+"); ok && transport != "unix" {
+		return fmt.Errorf("%q uses the %s transport; only the local socket is allowed", uri, transport)
+	}
+	if u.Host != "" || u.User != nil {
+		return fmt.Errorf("%q names a remote host; only the local socket is allowed", uri)
+	}
+	for name := range u.Query() {
+		for _, param := range libvirtCommandParams {
+			if strings.EqualFold(name, param) {
+				return fmt.Errorf("%q sets %s, which is not allowed", uri, name)
+			}
+		}
+	}
+	return nil
+}
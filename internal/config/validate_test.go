@@ -0,0 +1,108 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateBufferKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		buffer string
+		// secrets is the secrets section, for references
+		secrets string
+		// want is the path of the expected problem, empty when the buffer is valid
+		want string
+	}{
+		{name: "key file", buffer: "key_file: /etc/sprinter/buffer.key"},
+		{name: "secret reference", buffer: "key: exec:buffer-key", secrets: `command: ["/usr/local/bin/get-secret"]`},
+		{name: "secret reference without provider", buffer: "key: vault:secret/data/sprinter#buffer_key", want: "buffer.key"},
+		{name: "no key", want: "buffer.key_file"},
+		{name: "key file in data", buffer: "key_file: data/buffer.key", want: "buffer.key_file"},
+		{name: "key file in buffer directory", buffer: "directory: /var/lib/sprinter/buffer\n  key_file: /var/lib/sprinter/buffer/key", want: "buffer.key_file"},
+		{name: "plain key", buffer: "key: 000102030405060708090a0b0c0d0e0f", want: "buffer.key"},
+		{name: "key and key file", buffer: "key: exec:buffer-key\n  key_file: /etc/sprinter/buffer.key", want: "buffer.key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			content := "buffer:\n  enabled: true\n  encrypt: true\n"
+			if tt.buffer != "" {
+				content += "  " + tt.buffer + "\n"
+			}
+			if tt.secrets != "" {
+				content += "secrets:\n  " + tt.secrets + "\n"
+			}
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			problems, err := Validate(path)
+			if err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+
+			var found []string
+			for _, problem := range problems {
+				if strings.HasPrefix(problem.Path, "buffer.") {
+					found = append(found, problem.String())
+				}
+			}
+			if tt.want == "" {
+				if len(found) > 0 {
+					t.Fatalf("problems = %v, want none", found)
+				}
+				return
+			}
+			if len(found) != 1 || !strings.Contains(found[0], tt.want) {
+				t.Fatalf("problems = %v, want one for %s", found, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckLibvirtURI(t *testing.T) {
+	tests := []struct {
+		uri string
+		ok  bool
+	}{
+		{"qemu:///system", true},
+		{"qemu:///session", true},
+		{"qemu+unix:///system", true},
+		{"lxc:///", true},
+		{"qemu+ssh://root@host/system", false},
+		{"qemu+ext:///system?command=/tmp/run", false},
+		{"qemu+unix:///system?socket=/tmp/sock", false},
+		{"qemu:///system?NetCat=/bin/sh", false},
+		{"qemu:///system?keyfile=/root/.ssh/id_rsa", false},
+		{"qemu+tls://host/system", false},
+		{"qemu://host/system", false},
+		{"qemu+libssh2:///system", false},
+		{"not a uri", false},
+	}
+	for _, tt := range tests {
+		if err := checkLibvirtURI(tt.uri); (err == nil) != tt.ok {
+			t.Errorf("checkLibvirtURI(%q) = %v, want ok %v", tt.uri, err, tt.ok)
+		}
+	}
+}
+
+func TestApplyRemoteRejectsLibvirtCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("libvirt:\n  enabled: true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	local, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ApplyRemote(local, map[string]interface{}{"libvirt": map[string]interface{}{"interval": "2m"}}); err != nil {
+		t.Fatalf("ApplyRemote of a valid document: %v", err)
+	}
+
+	remote := map[string]interface{}{"libvirt": map[string]interface{}{"uri": "qemu+ext:///system?command=/tmp/payload"}}
+	if _, _, err := ApplyRemote(local, remote); err == nil || !strings.Contains(err.Error(), "libvirt.uri") {
+		t.Fatalf("ApplyRemote = %v, want the libvirt URI refused", err)
+	}
+}
@@ -0,0 +1,309 @@
+// Package control implements the agent's local control socket, used by the CLI to inspect
+// and steer a running agent
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"sprinter-agent/internal/diagnostics"
+	"sprinter-agent/internal/logring"
+	"sprinter-agent/internal/services"
+)
+
+// Commands accepted on the control socket
+const (
+	CommandStatus = "status"
+	CommandPause  = "pause"
+	CommandResume = "resume"
+	CommandLogs   = "logs"
+	CommandDump   = "dump"
+	// CommandTraceroute traces the network path to a target and uploads the result
+	CommandTraceroute = "traceroute"
+	// CommandSpeedTest measures throughput to the server and uploads the result
+	CommandSpeedTest = "speedtest"
+	// CommandHealth reports registration and heartbeat state
+	CommandHealth = "health"
+	// CommandSamples returns the most recent report sent to each path
+	CommandSamples = "samples"
+	// CommandActions returns the log of actions taken at the server's request
+	CommandActions = "actions"
+	// CommandFile retrieves and uploads an allowed file
+	CommandFile = "file"
+	// CommandSnapshot captures and uploads a system snapshot
+	CommandSnapshot = "snapshot"
+)
+
+// diagnosticTimeout covers a traceroute with slow hops, a speed test on a slow link, a
+// file passed through a redaction hook, or a snapshot's commands, each uploaded
+const diagnosticTimeout = 3 * time.Minute
+
+// Request is a single command sent to the agent
+type Request struct {
+	Command   string `json:"command"`
+	Collector string `json:"collector,omitempty"`
+	// Lines limits the logs and actions commands to the most recent entries, zero for all
+	Lines int `json:"lines,omitempty"`
+	// Target is the traceroute destination, the Somana server when empty
+	Target string `json:"target,omitempty"`
+	// Path is the file to retrieve
+	Path string `json:"path,omitempty"`
+}
+
+// Response is the agent's reply: recent log lines for the logs command, otherwise the
+// collector states
+type Response struct {
+	Error      string                     `json:"error,omitempty"`
+	Collectors []services.CollectorStatus `json:"collectors,omitempty"`
+	Logs       []string                   `json:"logs,omitempty"`
+	// File is the goroutine dump written by the dump command
+	File string `json:"file,omitempty"`
+	// Path is the result of the traceroute command
+	Path *services.PathDiagnostic `json:"path,omitempty"`
+	// Throughput is the result of the speedtest command
+	Throughput *services.ThroughputResult `json:"throughput,omitempty"`
+	// Health is the result of the health command, and part of the status command's result
+	Health *services.RegistrationHealth `json:"health,omitempty"`
+	// QueueDepth is the number of reports waiting for the next bulk flush, for the status command
+	QueueDepth int `json:"queue_depth,omitempty"`
+	// Samples is the result of the samples command
+	Samples []services.PayloadSample `json:"samples,omitempty"`
+	// Actions is the result of the actions command
+	Actions []services.RemoteAction `json:"actions,omitempty"`
+	// Artifact is the result of the file command
+	Artifact *services.FileArtifact `json:"artifact,omitempty"`
+	// Snapshot is the result of the snapshot command
+	Snapshot *services.Snapshot `json:"snapshot,omitempty"`
+}
+
+// Server serves the control socket for a running agent
+type Server struct {
+	socketPath string
+	manager    *services.CollectorManager
+	listener   net.Listener
+
+	// DumpDir receives goroutine dumps; the dump command is refused when it is empty
+	DumpDir string
+	// Diagnostics runs traceroutes and speed tests; those commands are refused when it is nil
+	Diagnostics *services.NetworkDiagnosticsService
+	// Registration reports the health command's state; the command is refused when it is nil
+	Registration *services.HostRegistrationService
+	// Files retrieves files; the file command is refused when it is nil
+	Files *services.FileRetrievalService
+	// Snapshots captures system snapshots; the snapshot command is refused when it is nil
+	Snapshots *services.SnapshotService
+}
+
+// NewServer creates a control server for the collector manager
+func NewServer(socketPath string, manager *services.CollectorManager) *Server {
+	return &Server{
+		socketPath: socketPath,
+		manager:    manager,
+	}
+}
+
+// Start listens on the control socket
+func (s *Server) Start() error {
+	if err := os.MkdirAll(filepath.Dir(s.socketPath), 0755); err != nil {
+		return fmt.Errorf("failed to create control socket directory: %w", err)
+	}
+	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale control socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.socketPath, err)
+	}
+	// Only the agent's account and its group may steer it
+	if err := os.Chmod(s.socketPath, 0660); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to set control socket permissions: %w", err)
+	}
+	s.listener = listener
+
+	go s.serve()
+
+	log.Printf("Control socket listening on %s", s.socketPath)
+	return nil
+}
+
+// Stop closes the control socket
+func (s *Server) Stop() {
+	if s.listener != nil {
+		s.listener.Close()
+		os.Remove(s.socketPath)
+	}
+}
+
+// serve accepts connections until the listener is closed
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Control socket accept failed: %v", err)
+			}
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle serves a single request
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	var req Request
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		resp.Error = "invalid request"
+	} else {
+		conn.SetDeadline(time.Now().Add(requestTimeout(req)))
+		resp = s.dispatch(req)
+	}
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Printf("Failed to send control response: %v", err)
+	}
+}
+
+// dispatch runs a command and builds its response
+func (s *Server) dispatch(req Request) Response {
+	var resp Response
+	var err error
+	switch req.Command {
+	case CommandLogs:
+		resp.Logs = recentLogs(req.Lines)
+		return resp
+	case CommandSamples:
+		resp.Samples = services.PayloadSamples()
+		return resp
+	case CommandActions:
+		if resp.Actions, err = services.RemoteActions(req.Lines); err != nil {
+			resp.Error = err.Error()
+		}
+		return resp
+	case CommandDump:
+		if resp.File, err = s.dump(); err != nil {
+			resp.Error = err.Error()
+		}
+		return resp
+	case CommandTraceroute, CommandSpeedTest:
+		if s.Diagnostics == nil {
+			resp.Error = "network diagnostics are not available"
+			return resp
+		}
+		// A failed diagnostic still carries the partial result
+		if req.Command == CommandTraceroute {
+			resp.Path, err = s.Diagnostics.Traceroute(req.Target)
+		} else {
+			resp.Throughput, err = s.Diagnostics.SpeedTest()
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		return resp
+	case CommandFile:
+		if s.Files == nil {
+			resp.Error = "file retrieval is not available"
+			return resp
+		}
+		// A refused file still carries the artifact that was uploaded
+		if resp.Artifact, err = s.Files.Retrieve(req.Path); err != nil {
+			resp.Error = err.Error()
+		}
+		return resp
+	case CommandSnapshot:
+		if s.Snapshots == nil {
+			resp.Error = "snapshots are not available"
+			return resp
+		}
+		// A snapshot that failed to upload is still returned
+		if resp.Snapshot, err = s.Snapshots.Capture(); err != nil {
+			resp.Error = err.Error()
+		}
+		return resp
+	case CommandHealth:
+		if s.Registration == nil {
+			resp.Error = "registration state is not available"
+			return resp
+		}
+		health := s.Registration.Health()
+		resp.Health = &health
+		return resp
+	case CommandStatus:
+		if s.Registration != nil {
+			health := s.Registration.Health()
+			resp.Health = &health
+		}
+		resp.QueueDepth = services.QueuedReports()
+	case CommandPause:
+		err = s.manager.Pause(req.Collector)
+	case CommandResume:
+		err = s.manager.Resume(req.Collector)
+	default:
+		err = fmt.Errorf("unknown command: %s", req.Command)
+	}
+
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	resp.Collectors = services.CollectorStatuses()
+	return resp
+}
+
+// dump writes a goroutine dump when diagnostics are enabled
+func (s *Server) dump() (string, error) {
+	if s.DumpDir == "" {
+		return "", errors.New("diagnostics are disabled, set debug.enabled: true")
+	}
+	return diagnostics.WriteGoroutineDump(s.DumpDir)
+}
+
+// recentLogs returns up to n of the most recent log lines, or all kept lines when n is zero
+func recentLogs(n int) []string {
+	lines := logring.Recent()
+	if n > 0 && n < len(lines) {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// requestTimeout returns how long a command may take
+func requestTimeout(req Request) time.Duration {
+	switch req.Command {
+	case CommandTraceroute, CommandSpeedTest, CommandFile, CommandSnapshot:
+		return diagnosticTimeout
+	}
+	return 30 * time.Second
+}
+
+// Send sends a command to a running agent and returns its response
+func Send(socketPath string, req Request) (*Response, error) {
+	conn, err := net.DialTimeout("unix", socketPath, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("agent not reachable on %s: %w", socketPath, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout(req)))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send command: %w", err)
+	}
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.Error != "" {
+		return &resp, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
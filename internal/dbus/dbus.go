@@ -0,0 +1,619 @@
+// Package dbus is a minimal client for the D-Bus system bus, sufficient for the
+// read-only method calls the agent makes to systemd without requiring root.
+package dbus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message types
+const (
+	typeMethodCall   = 1
+	typeMethodReturn = 2
+	typeError        = 3
+)
+
+// Header field codes
+const (
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSignature   = 8
+)
+
+const defaultSystemBusAddress = "unix:path=/run/dbus/system_bus_socket"
+
+// ObjectPath is a D-Bus object path
+type ObjectPath string
+
+// Variant is a D-Bus variant value with its signature
+type Variant struct {
+	Signature string
+	Value     interface{}
+}
+
+// Error is a D-Bus error reply
+type Error struct {
+	Name    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return e.Name + ": " + e.Message
+	}
+	return e.Name
+}
+
+// Conn is a connection to a message bus
+type Conn struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	serial uint32
+}
+
+// SystemBus connects and authenticates to the system bus
+func SystemBus() (*Conn, error) {
+	address := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")
+	if address == "" {
+		address = defaultSystemBusAddress
+	}
+
+	path, err := parseUnixAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to system bus: %w", err)
+	}
+
+	c := &Conn{conn: conn, reader: bufio.NewReader(conn)}
+	if err := c.authenticate(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := c.Call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", ""); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("hello failed: %w", err)
+	}
+	return c, nil
+}
+
+// parseUnixAddress extracts the socket path from a "unix:path=..." bus address
+func parseUnixAddress(address string) (string, error) {
+	for _, candidate := range strings.Split(address, ";") {
+		transport, params, ok := strings.Cut(candidate, ":")
+		if !ok || transport != "unix" {
+			continue
+		}
+		for _, param := range strings.Split(params, ",") {
+			if key, value, ok := strings.Cut(param, "="); ok && key == "path" {
+				return value, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unsupported bus address: %s", address)
+}
+
+// authenticate performs the SASL EXTERNAL handshake using our UID
+func (c *Conn) authenticate() error {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := c.conn.Write([]byte("\x00AUTH EXTERNAL " + uid + "\r\n")); err != nil {
+		return fmt.Errorf("auth failed: %w", err)
+	}
+
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("auth failed: %w", err)
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("auth rejected: %s", strings.TrimSpace(line))
+	}
+
+	if _, err := c.conn.Write([]byte("BEGIN\r\n")); err != nil {
+		return fmt.Errorf("auth failed: %w", err)
+	}
+	return nil
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Call invokes a method and returns the decoded reply body. signature describes args.
+func (c *Conn) Call(destination string, path ObjectPath, iface, member, signature string, args ...interface{}) ([]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.serial++
+	serial := c.serial
+
+	body := &encoder{order: binary.LittleEndian}
+	if signature != "" {
+		if err := body.encodeSignature(signature, args); err != nil {
+			return nil, err
+		}
+	}
+
+	fields := []headerField{
+		{fieldPath, Variant{"o", path}},
+		{fieldMember, Variant{"s", member}},
+		{fieldDestination, Variant{"s", destination}},
+	}
+	if iface != "" {
+		fields = append(fields, headerField{fieldInterface, Variant{"s", iface}})
+	}
+	if signature != "" {
+		fields = append(fields, headerField{fieldSignature, Variant{"g", signature}})
+	}
+
+	msg := &encoder{order: binary.LittleEndian}
+	msg.buf.Write([]byte{'l', typeMethodCall, 0, 1})
+	msg.writeUint32(uint32(body.buf.Len()))
+	msg.writeUint32(serial)
+	if err := msg.encodeValue("a(yv)", fields); err != nil {
+		return nil, err
+	}
+	msg.align(8)
+	msg.buf.Write(body.buf.Bytes())
+
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer c.conn.SetDeadline(time.Time{})
+
+	if _, err := c.conn.Write(msg.buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("failed to send %s: %w", member, err)
+	}
+
+	for {
+		reply, err := c.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if reply.replySerial != serial {
+			// Signals and unrelated replies are ignored
+			continue
+		}
+		if reply.msgType == typeError {
+			dbusErr := &Error{Name: reply.errorName}
+			if len(reply.body) > 0 {
+				if text, ok := reply.body[0].(string); ok {
+					dbusErr.Message = text
+				}
+			}
+			return nil, dbusErr
+		}
+		if reply.msgType == typeMethodReturn {
+			return reply.body, nil
+		}
+	}
+}
+
+// GetProperty reads a single property through org.freedesktop.DBus.Properties
+func (c *Conn) GetProperty(destination string, path ObjectPath, iface, property string) (interface{}, error) {
+	reply, err := c.Call(destination, path, "org.freedesktop.DBus.Properties", "Get", "ss", iface, property)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) != 1 {
+		return nil, errors.New("unexpected reply to Properties.Get")
+	}
+	variant, ok := reply[0].(Variant)
+	if !ok {
+		return nil, errors.New("unexpected reply to Properties.Get")
+	}
+	return variant.Value, nil
+}
+
+type headerField struct {
+	Code  byte
+	Value Variant
+}
+
+type message struct {
+	msgType     byte
+	replySerial uint32
+	errorName   string
+	body        []interface{}
+}
+
+// readMessage reads and decodes one message from the bus
+func (c *Conn) readMessage() (*message, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(c.reader, fixed); err != nil {
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid endianness marker %q", fixed[0])
+	}
+
+	bodyLen := order.Uint32(fixed[4:8])
+	fieldsLen := order.Uint32(fixed[12:16])
+	headerLen := 16 + int(fieldsLen)
+	padded := (headerLen + 7) &^ 7
+	const maxMessage = 128 * 1024 * 1024
+	if padded+int(bodyLen) > maxMessage {
+		return nil, errors.New("message too large")
+	}
+
+	rest := make([]byte, padded-16+int(bodyLen))
+	if _, err := io.ReadFull(c.reader, rest); err != nil {
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+	data := append(fixed, rest...)
+
+	dec := &decoder{data: data, order: order, pos: 12}
+	rawFields, err := dec.decodeValue("a(yv)")
+	if err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+
+	msg := &message{msgType: fixed[1]}
+	var signature string
+	for _, raw := range rawFields.([]interface{}) {
+		field := raw.([]interface{})
+		code := field[0].(byte)
+		value := field[1].(Variant).Value
+		switch code {
+		case fieldReplySerial:
+			msg.replySerial, _ = value.(uint32)
+		case fieldErrorName:
+			msg.errorName, _ = value.(string)
+		case fieldSignature:
+			signature, _ = value.(string)
+		}
+	}
+
+	if signature != "" {
+		body := &decoder{data: data[padded:], order: order}
+		for _, sig := range splitSignature(signature) {
+			value, err := body.decodeValue(sig)
+			if err != nil {
+				return nil, fmt.Errorf("invalid body: %w", err)
+			}
+			msg.body = append(msg.body, value)
+		}
+	}
+	return msg, nil
+}
+
+// splitSignature splits a signature into its complete types
+func splitSignature(signature string) []string {
+	var types []string
+	for len(signature) > 0 {
+		n := completeTypeLen(signature)
+		types = append(types, signature[:n])
+		signature = signature[n:]
+	}
+	return types
+}
+
+// completeTypeLen returns the length of the first complete type in sig
+func completeTypeLen(sig string) int {
+	switch sig[0] {
+	case 'a':
+		return 1 + completeTypeLen(sig[1:])
+	case '(', '{':
+		opening, closing := sig[0], byte(')')
+		if opening == '{' {
+			closing = '}'
+		}
+		depth := 0
+		for i := 0; i < len(sig); i++ {
+			switch sig[i] {
+			case opening:
+				depth++
+			case closing:
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+		}
+		return len(sig)
+	default:
+		return 1
+	}
+}
+
+// alignment returns the alignment of the first type in sig
+func alignment(sig byte) int {
+	switch sig {
+	case 'y', 'g', 'v':
+		return 1
+	case 'n', 'q':
+		return 2
+	case 'b', 'i', 'u', 's', 'o', 'a', 'h':
+		return 4
+	default:
+		// x, t, d, structs and dict entries
+		return 8
+	}
+}
+
+type encoder struct {
+	buf   bytes.Buffer
+	order binary.ByteOrder
+}
+
+func (e *encoder) align(n int) {
+	for e.buf.Len()%n != 0 {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *encoder) writeUint32(v uint32) {
+	e.align(4)
+	var b [4]byte
+	e.order.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) encodeSignature(signature string, args []interface{}) error {
+	types := splitSignature(signature)
+	if len(types) != len(args) {
+		return fmt.Errorf("signature %q expects %d arguments, got %d", signature, len(types), len(args))
+	}
+	for i, sig := range types {
+		if err := e.encodeValue(sig, args[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeValue supports the subset of types the agent sends: y, b, u, s, o, g, v, a(yv) and a<basic>
+func (e *encoder) encodeValue(sig string, value interface{}) error {
+	switch sig[0] {
+	case 'y':
+		e.buf.WriteByte(value.(byte))
+	case 'b':
+		v := uint32(0)
+		if value.(bool) {
+			v = 1
+		}
+		e.writeUint32(v)
+	case 'u':
+		e.writeUint32(value.(uint32))
+	case 's':
+		e.writeString(value.(string))
+	case 'o':
+		e.writeString(string(value.(ObjectPath)))
+	case 'g':
+		s := value.(string)
+		e.buf.WriteByte(byte(len(s)))
+		e.buf.WriteString(s)
+		e.buf.WriteByte(0)
+	case 'v':
+		variant := value.(Variant)
+		if err := e.encodeValue("g", variant.Signature); err != nil {
+			return err
+		}
+		return e.encodeValue(variant.Signature, variant.Value)
+	case 'a':
+		elem := sig[1:]
+		e.writeUint32(0)
+		lenPos := e.buf.Len() - 4
+		e.align(alignment(elem[0]))
+		start := e.buf.Len()
+		switch items := value.(type) {
+		case []headerField:
+			for _, item := range items {
+				e.align(8)
+				e.buf.WriteByte(item.Code)
+				if err := e.encodeValue("v", item.Value); err != nil {
+					return err
+				}
+			}
+		case []string:
+			for _, item := range items {
+				if err := e.encodeValue(elem, item); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unsupported array value %T", value)
+		}
+		e.order.PutUint32(e.buf.Bytes()[lenPos:], uint32(e.buf.Len()-start))
+	default:
+		return fmt.Errorf("unsupported signature %q", sig)
+	}
+	return nil
+}
+
+func (e *encoder) writeString(s string) {
+	e.writeUint32(uint32(len(s)))
+	e.buf.WriteString(s)
+	e.buf.WriteByte(0)
+}
+
+type decoder struct {
+	data  []byte
+	order binary.ByteOrder
+	pos   int
+}
+
+func (d *decoder) align(n int) {
+	d.pos = (d.pos + n - 1) &^ (n - 1)
+}
+
+func (d *decoder) need(n int) error {
+	if d.pos+n > len(d.data) {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	d.align(4)
+	if err := d.need(4); err != nil {
+		return 0, err
+	}
+	v := d.order.Uint32(d.data[d.pos:])
+	d.pos += 4
+	return v, nil
+}
+
+func (d *decoder) string() (string, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return "", err
+	}
+	if err := d.need(int(n) + 1); err != nil {
+		return "", err
+	}
+	s := string(d.data[d.pos : d.pos+int(n)])
+	d.pos += int(n) + 1
+	return s, nil
+}
+
+// decodeValue decodes one complete type; structs decode to []interface{} and dicts to map[interface{}]interface{}
+func (d *decoder) decodeValue(sig string) (interface{}, error) {
+	switch sig[0] {
+	case 'y':
+		if err := d.need(1); err != nil {
+			return nil, err
+		}
+		v := d.data[d.pos]
+		d.pos++
+		return v, nil
+	case 'b':
+		v, err := d.uint32()
+		return v != 0, err
+	case 'n', 'q':
+		d.align(2)
+		if err := d.need(2); err != nil {
+			return nil, err
+		}
+		v := d.order.Uint16(d.data[d.pos:])
+		d.pos += 2
+		if sig[0] == 'n' {
+			return int16(v), nil
+		}
+		return v, nil
+	case 'i':
+		v, err := d.uint32()
+		return int32(v), err
+	case 'u', 'h':
+		return d.uint32()
+	case 'x', 't', 'd':
+		d.align(8)
+		if err := d.need(8); err != nil {
+			return nil, err
+		}
+		v := d.order.Uint64(d.data[d.pos:])
+		d.pos += 8
+		switch sig[0] {
+		case 'x':
+			return int64(v), nil
+		case 'd':
+			return math.Float64frombits(v), nil
+		}
+		return v, nil
+	case 's':
+		return d.string()
+	case 'o':
+		s, err := d.string()
+		return ObjectPath(s), err
+	case 'g':
+		if err := d.need(1); err != nil {
+			return nil, err
+		}
+		n := int(d.data[d.pos])
+		d.pos++
+		if err := d.need(n + 1); err != nil {
+			return nil, err
+		}
+		s := string(d.data[d.pos : d.pos+n])
+		d.pos += n + 1
+		return s, nil
+	case 'v':
+		inner, err := d.decodeValue("g")
+		if err != nil {
+			return nil, err
+		}
+		innerSig := inner.(string)
+		if innerSig == "" {
+			return nil, errors.New("empty variant signature")
+		}
+		value, err := d.decodeValue(innerSig)
+		return Variant{Signature: innerSig, Value: value}, err
+	case '(':
+		d.align(8)
+		inner := sig[1 : len(sig)-1]
+		fields := []interface{}{}
+		for _, fieldSig := range splitSignature(inner) {
+			value, err := d.decodeValue(fieldSig)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, value)
+		}
+		return fields, nil
+	case 'a':
+		n, err := d.uint32()
+		if err != nil {
+			return nil, err
+		}
+		elem := sig[1:]
+		d.align(alignment(elem[0]))
+		end := d.pos + int(n)
+		if end > len(d.data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if elem[0] == '{' {
+			kv := splitSignature(elem[1 : len(elem)-1])
+			dict := make(map[interface{}]interface{})
+			for d.pos < end {
+				d.align(8)
+				key, err := d.decodeValue(kv[0])
+				if err != nil {
+					return nil, err
+				}
+				value, err := d.decodeValue(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				dict[key] = value
+			}
+			return dict, nil
+		}
+		items := []interface{}{}
+		for d.pos < end {
+			value, err := d.decodeValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unsupported signature %q", sig)
+	}
+}
@@ -0,0 +1,58 @@
+package dbus
+
+import "fmt"
+
+const (
+	systemdDestination = "org.freedesktop.systemd1"
+	systemdPath        = ObjectPath("/org/freedesktop/systemd1")
+	systemdManager     = "org.freedesktop.systemd1.Manager"
+)
+
+// Unit is an entry returned by systemd's ListUnits
+type Unit struct {
+	Name        string
+	Description string
+	LoadState   string
+	ActiveState string
+	SubState    string
+	Path        ObjectPath
+}
+
+// ListUnits returns the units currently loaded by systemd; reading them needs no privileges
+func (c *Conn) ListUnits() ([]Unit, error) {
+	reply, err := c.Call(systemdDestination, systemdPath, systemdManager, "ListUnits", "")
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) != 1 {
+		return nil, fmt.Errorf("unexpected ListUnits reply")
+	}
+
+	raw, ok := reply[0].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected ListUnits reply")
+	}
+
+	// a(ssssssouso): name, description, load, active, sub, following, path, job id, job type, job path
+	units := make([]Unit, 0, len(raw))
+	for _, entry := range raw {
+		fields, ok := entry.([]interface{})
+		if !ok || len(fields) < 7 {
+			continue
+		}
+		unit := Unit{}
+		unit.Name, _ = fields[0].(string)
+		unit.Description, _ = fields[1].(string)
+		unit.LoadState, _ = fields[2].(string)
+		unit.ActiveState, _ = fields[3].(string)
+		unit.SubState, _ = fields[4].(string)
+		unit.Path, _ = fields[6].(ObjectPath)
+		units = append(units, unit)
+	}
+	return units, nil
+}
+
+// UnitProperty reads a property of a unit object, e.g. ("org.freedesktop.systemd1.Service", "ControlGroup")
+func (c *Conn) UnitProperty(path ObjectPath, iface, property string) (interface{}, error) {
+	return c.GetProperty(systemdDestination, path, iface, property)
+}
@@ -0,0 +1,143 @@
+// Package diagnostics serves runtime profiling endpoints (pprof, expvar) on a loopback
+// listener and writes goroutine dumps, for diagnosing long-running agents.
+package diagnostics
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	rpprof "runtime/pprof"
+	"time"
+)
+
+// Server serves pprof, expvar and goroutine dumps
+type Server struct {
+	addr    string
+	dumpDir string
+	server  *http.Server
+}
+
+// NewServer creates a diagnostics server listening on addr and writing dumps to dumpDir
+func NewServer(addr, dumpDir string) *Server {
+	return &Server{
+		addr:    addr,
+		dumpDir: dumpDir,
+	}
+}
+
+// Start listens on the configured address, which must be a loopback address since the
+// endpoints expose memory contents and need no authentication
+func (s *Server) Start() error {
+	host, _, err := net.SplitHostPort(s.addr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %s: %w", s.addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("refusing to serve diagnostics on non-loopback address %s", s.addr)
+	}
+
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/dump", s.handleDump)
+
+	s.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Diagnostics server failed: %v", err)
+		}
+	}()
+
+	log.Printf("Diagnostics listening on http://%s/debug/pprof/", listener.Addr())
+	return nil
+}
+
+// Stop shuts the diagnostics server down
+func (s *Server) Stop() {
+	if s.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.server.Shutdown(ctx)
+}
+
+// handleDump writes a goroutine dump to disk and replies with its path
+func (s *Server) handleDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	path, err := WriteGoroutineDump(s.dumpDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, path)
+}
+
+// WriteGoroutineDump writes the stacks of all goroutines, followed by memory statistics
+// and a heap profile summary, to a new file in dir and returns its path
+func WriteGoroutineDump(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create dump directory: %w", err)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("goroutines-%s.txt", time.Now().UTC().Format("20060102T150405")))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create dump file: %w", err)
+	}
+	defer f.Close()
+
+	if err := WriteGoroutines(f); err != nil {
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("failed to write dump file: %w", err)
+	}
+	// Reported to a CLI running in another working directory
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path, nil
+}
+
+// WriteGoroutines writes the stacks of all goroutines, memory statistics and a heap
+// profile summary to w
+func WriteGoroutines(w io.Writer) error {
+	if err := rpprof.Lookup("goroutine").WriteTo(w, 2); err != nil {
+		return fmt.Errorf("failed to write goroutine dump: %w", err)
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fmt.Fprintf(w, "\n# goroutines=%d heap_alloc=%d heap_inuse=%d heap_objects=%d sys=%d num_gc=%d\n\n",
+		runtime.NumGoroutine(), mem.HeapAlloc, mem.HeapInuse, mem.HeapObjects, mem.Sys, mem.NumGC)
+	if err := rpprof.Lookup("heap").WriteTo(w, 1); err != nil {
+		return fmt.Errorf("failed to write heap profile: %w", err)
+	}
+	return nil
+}
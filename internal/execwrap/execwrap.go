@@ -0,0 +1,253 @@
+// Package execwrap starts the external commands of the agent. Every command gets a
+// timeout, a cap on the output kept, an environment reduced to what tools need and,
+// when configured, a read-only bwrap or nsjail sandbox, so no caller has to remember
+// any of them.
+package execwrap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// WaitDelay is how long a killed command's output pipes stay open for children that
+// inherited them
+const WaitDelay = 5 * time.Second
+
+// stderrLimit is how much error output is kept for the error of a failed command
+const stderrLimit = 4096
+
+// ErrTimeout is wrapped by the error of a command killed at its timeout
+var ErrTimeout = errors.New("timed out")
+
+// baseEnv are the variables every command sees: what tools need to be found, to find
+// their files and to print in a known format, plus what Windows needs to start any
+// program. Anything else the agent was started with, such as the service manager's
+// NOTIFY_SOCKET or credentials given to the agent, stays with the agent.
+var baseEnv = []string{
+	"PATH", "HOME", "USER", "LOGNAME", "LANG", "LANGUAGE", "LC_*", "TZ", "TMPDIR",
+	"SYSTEMROOT", "WINDIR", "SYSTEMDRIVE", "COMSPEC", "PATHEXT", "TEMP", "TMP", "USERPROFILE",
+	"PROGRAMDATA", "PROGRAMFILES", "PROGRAMFILES(X86)", "APPDATA", "LOCALAPPDATA", "PSMODULEPATH",
+	"NUMBER_OF_PROCESSORS", "PROCESSOR_ARCHITECTURE",
+}
+
+// Config holds the defaults of all commands
+type Config struct {
+	// Timeout applies to commands whose caller sets none
+	Timeout time.Duration
+	// MaxOutput is how many bytes of output Output keeps before failing the command
+	MaxOutput int
+	// KeepEnv names variables passed on besides the base ones; a trailing * matches a prefix
+	KeepEnv []string
+	// Wrapper is "bwrap" or "nsjail", or empty to start commands directly
+	Wrapper string
+}
+
+var current atomic.Pointer[Config]
+
+func init() {
+	current.Store(&Config{Timeout: time.Minute, MaxOutput: 16 << 20})
+}
+
+// Configure sets the defaults of the commands started from now on. It fails when the
+// wrapper is not installed or not supported here.
+func Configure(cfg Config) error {
+	if cfg.Wrapper != "" {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("the %s wrapper is only supported on Linux", cfg.Wrapper)
+		}
+		if _, err := exec.LookPath(cfg.Wrapper); err != nil {
+			return fmt.Errorf("the %s wrapper is not installed: %w", cfg.Wrapper, err)
+		}
+	}
+	current.Store(&cfg)
+	return nil
+}
+
+// Options adjust one command
+type Options struct {
+	// Timeout overrides the default timeout; a deadline of the context is kept instead
+	// when it is zero
+	Timeout time.Duration
+	// MaxOutput overrides the default output cap of Output
+	MaxOutput int
+	// Env is added to the command's environment
+	Env []string
+	// KeepEnv names more of the agent's variables this command sees, like KeepEnv of Config
+	KeepEnv []string
+	// Writable commands change the host, such as restarting a unit or running a runbook,
+	// so they are never wrapped in the read-only sandbox
+	Writable bool
+}
+
+// Command returns a command ready to start, with its environment and wrapper set up. It
+// is killed when the returned cancel function is called or its timeout passes; callers
+// set its output and should call cancel once it finished. Output suits commands whose
+// output is read whole.
+func Command(ctx context.Context, opts Options, name string, args ...string) (*exec.Cmd, context.CancelFunc) {
+	cfg := current.Load()
+	ctx, cancel, _ := withTimeout(ctx, cfg, opts)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(environment(os.Environ(), cfg.KeepEnv, opts.KeepEnv), opts.Env...)
+	cmd.WaitDelay = WaitDelay
+	// A command that was not found is left for Start to report
+	if cfg.Wrapper != "" && !opts.Writable && cmd.Err == nil {
+		wrapper, err := exec.LookPath(cfg.Wrapper)
+		if err != nil {
+			cmd.Err = fmt.Errorf("the %s wrapper is not installed: %w", cfg.Wrapper, err)
+			return cmd, cancel
+		}
+		cmd.Args = append(wrapperArgs(cfg.Wrapper, cmd.Env), append([]string{cmd.Path}, args...)...)
+		cmd.Path = wrapper
+	}
+	return cmd, cancel
+}
+
+// Output runs a command and returns its standard output. The error names the command and
+// includes the end of its error output; output is returned with it, for tools that report
+// findings through their exit status. A command printing more than the output cap fails.
+func Output(ctx context.Context, opts Options, name string, args ...string) ([]byte, error) {
+	cfg := current.Load()
+	limit := cfg.MaxOutput
+	if opts.MaxOutput > 0 {
+		limit = opts.MaxOutput
+	}
+	ctx, cancel, timeout := withTimeout(ctx, cfg, opts)
+	defer cancel()
+	cmd, cancelCmd := Command(ctx, Options{Env: opts.Env, KeepEnv: opts.KeepEnv, Writable: opts.Writable}, name, args...)
+	defer cancelCmd()
+
+	stdout, stderr := &cappedWriter{limit: limit}, &cappedWriter{limit: stderrLimit, tail: true}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	err := cmd.Run()
+	output := stdout.buf.Bytes()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		if timeout == 0 {
+			return output, fmt.Errorf("%s %w", name, ErrTimeout)
+		}
+		return output, fmt.Errorf("%s %w after %s", name, ErrTimeout, timeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.buf.String()); msg != "" {
+			return output, fmt.Errorf("%s failed: %s: %w", name, msg, err)
+		}
+		return output, fmt.Errorf("%s failed: %w", name, err)
+	}
+	if stdout.truncated {
+		return output, fmt.Errorf("%s printed more than %d bytes", name, limit)
+	}
+	return output, nil
+}
+
+// withTimeout bounds ctx by the command's timeout: the one of the options, else a deadline
+// ctx already has, else the default. It returns the timeout it set, zero when it kept the
+// deadline of ctx.
+func withTimeout(ctx context.Context, cfg *Config, opts Options) (context.Context, context.CancelFunc, time.Duration) {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		if _, ok := ctx.Deadline(); ok {
+			ctx, cancel := context.WithCancel(ctx)
+			return ctx, cancel, 0
+		}
+		timeout = cfg.Timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, cancel, timeout
+}
+
+// environment keeps the variables of environ named by baseEnv or one of the keep lists
+func environment(environ []string, keep ...[]string) []string {
+	names := baseEnv
+	for _, list := range keep {
+		names = append(names[:len(names):len(names)], list...)
+	}
+	kept := []string{}
+	for _, variable := range environ {
+		name, _, _ := strings.Cut(variable, "=")
+		for _, pattern := range names {
+			if matchName(pattern, name) {
+				kept = append(kept, variable)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// matchName matches a variable name against a name or prefix pattern. Names are case
+// insensitive on Windows, where Path and PATH are the same variable.
+func matchName(pattern, name string) bool {
+	if runtime.GOOS == "windows" {
+		pattern, name = strings.ToUpper(pattern), strings.ToUpper(name)
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(name, prefix)
+	}
+	return pattern == name
+}
+
+// wrapperArgs returns the wrapper's arguments up to the command. The command sees the host
+// read-only, with the devices, a private /tmp, and the host's network and processes so
+// tools report on the host. env is passed explicitly to nsjail, which otherwise clears it.
+func wrapperArgs(wrapper string, env []string) []string {
+	switch wrapper {
+	case "bwrap":
+		return []string{"bwrap",
+			"--ro-bind", "/", "/",
+			"--dev-bind", "/dev", "/dev",
+			"--tmpfs", "/tmp",
+			"--unshare-ipc", "--unshare-uts", "--unshare-cgroup-try",
+			"--die-with-parent", "--new-session",
+			"--"}
+	case "nsjail":
+		dir, err := os.Getwd()
+		if err != nil {
+			dir = "/"
+		}
+		args := []string{"nsjail", "--mode", "o", "--quiet",
+			"--chroot", "/", "--cwd", dir,
+			"--bindmount", "/dev", "--tmpfsmount", "/tmp",
+			"--disable_clone_newnet", "--disable_clone_newpid", "--disable_clone_newuser",
+			"--keep_caps", "--time_limit", "0",
+			"--rlimit_as", "max", "--rlimit_cpu", "max", "--rlimit_fsize", "max", "--rlimit_nofile", "max"}
+		for _, variable := range env {
+			args = append(args, "--env", variable)
+		}
+		return append(args, "--")
+	}
+	return nil
+}
+
+// cappedWriter keeps the first limit bytes written to it, or the last with tail, and
+// swallows the rest so the command is not blocked on a full pipe
+type cappedWriter struct {
+	buf       bytes.Buffer
+	limit     int
+	tail      bool
+	truncated bool
+}
+
+func (w *cappedWriter) Write(p []byte) (int, error) {
+	if w.tail {
+		w.buf.Write(p)
+		if excess := w.buf.Len() - w.limit; excess > 0 {
+			w.buf.Next(excess)
+			w.truncated = true
+		}
+		return len(p), nil
+	}
+	if room := w.limit - w.buf.Len(); room < len(p) {
+		w.buf.Write(p[:max(room, 0)])
+		w.truncated = true
+		return len(p), nil
+	}
+	w.buf.Write(p)
+	return len(p), nil
+}
@@ -0,0 +1,92 @@
+// Package helper implements the privileged helper: a small root process that runs the
+// operations needing root, currently reading the audit log, on behalf of an unprivileged
+// agent over a local unix socket.
+package helper
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultSocketPath is where the helper listens unless configured otherwise
+const DefaultSocketPath = "/run/sprinter-agent-helper/helper.sock"
+
+// Operations supported by the helper
+const (
+	OpHealth    = "health"
+	OpAuditRead = "audit_read"
+)
+
+// Request is a single operation sent to the helper, one JSON object per connection
+type Request struct {
+	Op string `json:"op"`
+	// Inode and Offset are the audit log cursor for OpAuditRead
+	Inode  uint64 `json:"inode,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+}
+
+// Response is the helper's reply to a Request
+type Response struct {
+	Error  string   `json:"error,omitempty"`
+	Lines  []string `json:"lines,omitempty"`
+	Inode  uint64   `json:"inode,omitempty"`
+	Offset int64    `json:"offset,omitempty"`
+}
+
+// Client talks to the helper over its unix socket
+type Client struct {
+	socketPath string
+	timeout    time.Duration
+}
+
+// NewClient creates a client for the helper listening on socketPath
+func NewClient(socketPath string) *Client {
+	if socketPath == "" {
+		socketPath = DefaultSocketPath
+	}
+	return &Client{
+		socketPath: socketPath,
+		timeout:    30 * time.Second,
+	}
+}
+
+// call sends a request and waits for the response
+func (c *Client) call(req Request) (*Response, error) {
+	conn, err := net.DialTimeout("unix", c.socketPath, c.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to privileged helper: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send helper request: %w", err)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read helper response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("helper %s: %s", req.Op, resp.Error)
+	}
+	return &resp, nil
+}
+
+// Available reports whether the helper is running and accepts this process
+func (c *Client) Available() bool {
+	_, err := c.call(Request{Op: OpHealth})
+	return err == nil
+}
+
+// ReadAuditLog returns complete audit log lines after the given cursor and the new cursor;
+// a zero cursor starts at the current end of the log
+func (c *Client) ReadAuditLog(inode uint64, offset int64) ([]string, uint64, int64, error) {
+	resp, err := c.call(Request{Op: OpAuditRead, Inode: inode, Offset: offset})
+	if err != nil {
+		return nil, inode, offset, err
+	}
+	return resp.Lines, resp.Inode, resp.Offset, nil
+}
@@ -0,0 +1,9 @@
+package helper
+
+import "os"
+
+// fileInode is 0 on Windows, which has no inode numbers. The helper only runs on Linux;
+// this keeps the package building for Windows agents.
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
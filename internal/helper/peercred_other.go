@@ -0,0 +1,13 @@
+//go:build !linux
+
+package helper
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerUID is only supported on Linux, so every caller is rejected elsewhere
+func peerUID(conn net.Conn) (uint32, error) {
+	return 0, fmt.Errorf("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,181 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAuditRead bounds how much of the audit log a single request returns
+const maxAuditRead = 1 << 20
+
+// Server runs privileged operations for the agent
+type Server struct {
+	SocketPath   string
+	AuditLogPath string
+	// AllowedUser is the account allowed to use the helper besides root
+	AllowedUser string
+
+	listener net.Listener
+}
+
+// ListenAndServe listens on the unix socket and serves requests until Close is called
+func (s *Server) ListenAndServe() error {
+	if s.SocketPath == "" {
+		s.SocketPath = DefaultSocketPath
+	}
+	if err := os.MkdirAll(filepath.Dir(s.SocketPath), 0755); err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	// Remove a socket left behind by a previous run
+	if err := os.Remove(s.SocketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", s.SocketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.SocketPath, err)
+	}
+	// Anyone may connect; callers are authorized by their peer credentials
+	if err := os.Chmod(s.SocketPath, 0666); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	s.listener = listener
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting requests
+func (s *Server) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// handle serves a single request
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	uid, err := peerUID(conn)
+	if err != nil {
+		log.Printf("Rejected helper connection: %v", err)
+		return
+	}
+	if !s.authorized(uid) {
+		log.Printf("Rejected helper connection from UID %d", uid)
+		json.NewEncoder(conn).Encode(Response{Error: "not authorized"})
+		return
+	}
+
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(Response{Error: "invalid request"})
+		return
+	}
+
+	resp, err := s.dispatch(req)
+	if err != nil {
+		resp = &Response{Error: err.Error()}
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Printf("Failed to send helper response: %v", err)
+	}
+}
+
+// authorized reports whether a peer UID may use the helper
+func (s *Server) authorized(uid uint32) bool {
+	if uid == 0 {
+		return true
+	}
+	if s.AllowedUser == "" {
+		return false
+	}
+	// Looked up on every request since DynamicUser accounts only exist while the agent runs
+	u, err := user.Lookup(s.AllowedUser)
+	if err != nil {
+		return false
+	}
+	return u.Uid == strconv.FormatUint(uint64(uid), 10)
+}
+
+// dispatch runs the requested operation
+func (s *Server) dispatch(req Request) (*Response, error) {
+	switch req.Op {
+	case OpHealth:
+		return &Response{}, nil
+	case OpAuditRead:
+		if s.AuditLogPath == "" {
+			return nil, fmt.Errorf("audit log not configured")
+		}
+		lines, inode, offset, err := readLogLines(s.AuditLogPath, req.Inode, req.Offset)
+		if err != nil {
+			return nil, err
+		}
+		return &Response{Lines: lines, Inode: inode, Offset: offset}, nil
+	default:
+		return nil, fmt.Errorf("unknown operation: %s", req.Op)
+	}
+}
+
+// readLogLines returns complete lines after the cursor and the new cursor, starting over
+// when the file was rotated or truncated and at the end of the file for a zero cursor
+func readLogLines(path string, inode uint64, offset int64) ([]string, uint64, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, inode, offset, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, inode, offset, err
+	}
+	current := fileInode(info)
+
+	if inode == 0 {
+		return nil, current, info.Size(), nil
+	}
+	if current != inode || info.Size() < offset {
+		offset = 0
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, inode, offset, err
+	}
+	buf := make([]byte, maxAuditRead)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, inode, offset, err
+	}
+
+	// Leave a trailing partial line for the next read
+	data := buf[:n]
+	end := bytes.LastIndexByte(data, '\n')
+	if end < 0 {
+		return nil, current, offset, nil
+	}
+	lines := strings.Split(string(data[:end]), "\n")
+	return lines, current, offset + int64(end) + 1, nil
+}
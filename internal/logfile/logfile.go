@@ -0,0 +1,274 @@
+// Package logfile writes the agent's log to a file that rotates itself by size and age,
+// compressing and pruning rotated files so a long-running agent cannot fill /var/log.
+package logfile
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat stamps rotated files; it sorts in time order and has millisecond
+// precision so rotations in quick succession get distinct names
+const backupTimeFormat = "20060102T150405.000"
+
+// Options configures a rotating log file
+type Options struct {
+	Path string
+	// MaxSize rotates the file before a write would grow it past this many bytes, zero
+	// for no limit
+	MaxSize int64
+	// RotateInterval rotates the file once it has been written to for this long, zero
+	// for never
+	RotateInterval time.Duration
+	// MaxBackups is how many rotated files are kept, zero for no limit
+	MaxBackups int
+	// MaxAge removes rotated files older than this, zero for no limit
+	MaxAge time.Duration
+	// Compress gzips rotated files
+	Compress bool
+}
+
+// File is an io.Writer appending to a log file that rotates itself. Rotated files are
+// renamed with the time of rotation, as in agent-20261016T120939.123.log, then compressed
+// and pruned in the background.
+type File struct {
+	opts Options
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+
+	// cleanupMu serializes compressing and pruning rotated files
+	cleanupMu sync.Mutex
+	cleanups  sync.WaitGroup
+}
+
+// Open opens the log file for appending, creating it and its directory when missing, and
+// tidies up rotated files left by earlier runs
+func Open(opts Options) (*File, error) {
+	f := &File{opts: opts}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	f.cleanups.Add(1)
+	go f.cleanup()
+	return f, nil
+}
+
+// open opens the log file, whose age counts from now
+func (f *File) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.opts.Path), 0755); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	file, err := os.OpenFile(f.opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	f.file, f.size, f.openedAt = file, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends p to the log file, rotating it first when it is due
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.due(int64(len(p))) {
+		// The log cannot report its own failure, and losing rotation is better than
+		// losing the line
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file: %v\n", err)
+		}
+		if f.file == nil {
+			return 0, fmt.Errorf("log file %s is not open", f.opts.Path)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// due reports whether the file should rotate before a write of n bytes; an empty file
+// never rotates, so a single oversized line still gets written
+func (f *File) due(n int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.opts.MaxSize > 0 && f.size+n > f.opts.MaxSize {
+		return true
+	}
+	return f.opts.RotateInterval > 0 && time.Since(f.openedAt) >= f.opts.RotateInterval
+}
+
+// rotate renames the log file aside and opens a new one. If the rename fails the current
+// file is reopened and writing continues there.
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	backup := backupName(f.opts.Path, time.Now())
+	renameErr := os.Rename(f.opts.Path, backup)
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	f.cleanups.Add(1)
+	go f.cleanup()
+	return nil
+}
+
+// Close closes the log file and waits for background compression and pruning
+func (f *File) Close() error {
+	f.mu.Lock()
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	f.mu.Unlock()
+
+	f.cleanups.Wait()
+	return err
+}
+
+// backupName returns the name of a file rotated at t, keeping the log's extension so
+// tools still recognize it
+func backupName(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + t.Format(backupTimeFormat) + ext
+}
+
+// cleanup compresses rotated files, including any whose compression was cut short by
+// the agent stopping, then prunes those beyond the retention limits
+func (f *File) cleanup() {
+	defer f.cleanups.Done()
+	f.cleanupMu.Lock()
+	defer f.cleanupMu.Unlock()
+
+	if f.opts.Compress {
+		backups, err := f.backups()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list rotated log files: %v\n", err)
+		}
+		for _, b := range backups {
+			if strings.HasSuffix(b.path, ".gz") {
+				continue
+			}
+			if err := compress(b.path); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to compress rotated log file: %v\n", err)
+			}
+		}
+	}
+	if err := f.prune(time.Now()); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to remove old log files: %v\n", err)
+	}
+}
+
+// compress gzips a rotated file and removes the original once the copy is complete
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	src.Close()
+	return os.Remove(path)
+}
+
+// backup is a rotated log file and when it was rotated
+type backup struct {
+	path      string
+	rotatedAt time.Time
+}
+
+// backups lists the rotated files of the log, newest first
+func (f *File) backups() ([]backup, error) {
+	dir := filepath.Dir(f.opts.Path)
+	ext := filepath.Ext(f.opts.Path)
+	prefix := strings.TrimSuffix(filepath.Base(f.opts.Path), ext) + "-"
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	found := []backup{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimPrefix(strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ext), prefix)
+		rotatedAt, err := time.ParseInLocation(backupTimeFormat, stamp, time.Local)
+		if err != nil {
+			continue
+		}
+		found = append(found, backup{path: filepath.Join(dir, name), rotatedAt: rotatedAt})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].rotatedAt.After(found[j].rotatedAt) })
+	return found, nil
+}
+
+// prune removes rotated files beyond MaxBackups or older than MaxAge
+func (f *File) prune(now time.Time) error {
+	if f.opts.MaxBackups <= 0 && f.opts.MaxAge <= 0 {
+		return nil
+	}
+	backups, err := f.backups()
+	if err != nil {
+		return err
+	}
+	for i, b := range backups {
+		tooMany := f.opts.MaxBackups > 0 && i >= f.opts.MaxBackups
+		tooOld := f.opts.MaxAge > 0 && now.Sub(b.rotatedAt) > f.opts.MaxAge
+		if tooMany || tooOld {
+			if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
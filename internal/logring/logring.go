@@ -0,0 +1,97 @@
+// Package logring keeps the most recent agent log lines in memory, so crash reports and
+// operators can see what the agent logged without access to the journal.
+package logring
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DefaultSize is the number of lines kept by Install when no size is given
+const DefaultSize = 500
+
+// Ring is an io.Writer keeping the last lines written to it
+type Ring struct {
+	mu      sync.Mutex
+	lines   []string
+	next    int
+	full    bool
+	partial string
+}
+
+// New creates a ring keeping the last size lines
+func New(size int) *Ring {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	return &Ring{lines: make([]string, size)}
+}
+
+// Write splits p into lines and stores them; a trailing partial line waits for the rest
+func (r *Ring) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	text := r.partial + string(p)
+	for {
+		line, rest, ok := strings.Cut(text, "\n")
+		if !ok {
+			break
+		}
+		r.lines[r.next] = line
+		r.next = (r.next + 1) % len(r.lines)
+		if r.next == 0 {
+			r.full = true
+		}
+		text = rest
+	}
+	r.partial = text
+	return len(p), nil
+}
+
+// Lines returns the kept lines, oldest first
+func (r *Ring) Lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]string(nil), r.lines[:r.next]...)
+	}
+	lines := make([]string, 0, len(r.lines))
+	lines = append(lines, r.lines[r.next:]...)
+	return append(lines, r.lines[:r.next]...)
+}
+
+var (
+	installedMu sync.Mutex
+	installed   *Ring
+)
+
+// Install sends the standard logger's output to out, stderr when nil, and copies it into
+// a new ring of size lines
+func Install(size int, out io.Writer) *Ring {
+	installedMu.Lock()
+	defer installedMu.Unlock()
+
+	if out == nil {
+		out = os.Stderr
+	}
+	installed = New(size)
+	log.SetOutput(io.MultiWriter(out, installed))
+	return installed
+}
+
+// Recent returns the lines kept by the installed ring, or nil before Install
+func Recent() []string {
+	installedMu.Lock()
+	ring := installed
+	installedMu.Unlock()
+
+	if ring == nil {
+		return nil
+	}
+	return ring.Lines()
+}
@@ -0,0 +1,369 @@
+// Package mqtt is a minimal MQTT 3.1.1 publisher, enough for the agent to send heartbeats
+// and reports through an existing broker. It supports QoS 0 and 1 over TCP or TLS and
+// does not subscribe.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Packet types
+const (
+	packetConnect    = 1
+	packetConnack    = 2
+	packetPublish    = 3
+	packetPuback     = 4
+	packetPingreq    = 12
+	packetPingresp   = 13
+	packetDisconnect = 14
+)
+
+// ackTimeout bounds the wait for a broker acknowledgement
+const ackTimeout = 10 * time.Second
+
+// dialTimeout bounds connecting to the broker, including the TLS handshake
+const dialTimeout = 10 * time.Second
+
+// ErrClosed is returned when publishing on a closed or broken connection
+var ErrClosed = errors.New("mqtt connection closed")
+
+// Options configure a connection to a broker
+type Options struct {
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	TLSConfig *tls.Config
+	// DialContext opens the connection to the broker, a plain net.Dialer when nil
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Client is a connection to an MQTT broker
+type Client struct {
+	conn      net.Conn
+	keepAlive time.Duration
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  uint16
+	acks    map[uint16]chan struct{}
+	err     error
+	closed  chan struct{}
+}
+
+// Dial connects to the broker at brokerURL, a tcp://, mqtt://, ssl://, tls:// or mqtts:// URL
+func Dial(brokerURL string, opts Options) (*Client, error) {
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker URL: %w", err)
+	}
+
+	dial := opts.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		conn, err = dial(ctx, "tcp", hostPort(u, "1883"))
+	case "ssl", "tls", "mqtts":
+		config := &tls.Config{MinVersion: tls.VersionTLS12}
+		if opts.TLSConfig != nil {
+			config = opts.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		if conn, err = dial(ctx, "tcp", hostPort(u, "8883")); err == nil {
+			tlsConn := tls.Client(conn, config)
+			if err = tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+			}
+			conn = tlsConn
+		}
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme: %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to broker: %w", err)
+	}
+
+	if u.User != nil && opts.Username == "" {
+		opts.Username = u.User.Username()
+		opts.Password, _ = u.User.Password()
+	}
+
+	c := &Client{
+		conn:      conn,
+		keepAlive: opts.KeepAlive,
+		acks:      make(map[uint16]chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	if err := c.connect(opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go c.readLoop()
+	if c.keepAlive > 0 {
+		go c.pingLoop()
+	}
+	return c, nil
+}
+
+// hostPort returns the URL's host with the default port when none is given
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+// connect sends CONNECT and waits for the broker to accept it
+func (c *Client) connect(opts Options) error {
+	var body []byte
+	body = appendString(body, "MQTT")
+	body = append(body, 4) // protocol level 3.1.1
+
+	flags := byte(0x02) // clean session
+	if opts.Username != "" {
+		flags |= 0x80
+		if opts.Password != "" {
+			flags |= 0x40
+		}
+	}
+	body = append(body, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(opts.KeepAlive/time.Second))
+
+	body = appendString(body, opts.ClientID)
+	if opts.Username != "" {
+		body = appendString(body, opts.Username)
+		if opts.Password != "" {
+			body = appendString(body, opts.Password)
+		}
+	}
+
+	c.conn.SetDeadline(time.Now().Add(ackTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+	if err := c.writePacket(packetConnect<<4, body); err != nil {
+		return fmt.Errorf("failed to send CONNECT: %w", err)
+	}
+
+	packetType, payload, err := readPacket(bufio.NewReader(io.LimitReader(c.conn, 4)))
+	if err != nil {
+		return fmt.Errorf("failed to read CONNACK: %w", err)
+	}
+	if packetType>>4 != packetConnack || len(payload) != 2 {
+		return fmt.Errorf("unexpected packet %d instead of CONNACK", packetType>>4)
+	}
+	if code := payload[1]; code != 0 {
+		return fmt.Errorf("broker refused connection: %s", connackReason(code))
+	}
+	return nil
+}
+
+// connackReason describes a CONNACK return code
+func connackReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	default:
+		return fmt.Sprintf("return code %d", code)
+	}
+}
+
+// Publish sends payload to topic. With QoS 1 it waits until the broker acknowledged the
+// message.
+func (c *Client) Publish(topic string, payload []byte, qos byte) error {
+	if qos > 1 {
+		return fmt.Errorf("unsupported QoS %d", qos)
+	}
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	body := appendString(nil, topic)
+	var ack chan struct{}
+	var id uint16
+	if qos == 1 {
+		c.mu.Lock()
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		id = c.nextID
+		ack = make(chan struct{})
+		c.acks[id] = ack
+		c.mu.Unlock()
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	body = append(body, payload...)
+
+	if err := c.writePacket(packetPublish<<4|qos<<1, body); err != nil {
+		c.fail(err)
+		return fmt.Errorf("failed to publish: %w", err)
+	}
+	if ack == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(ackTimeout)
+	defer timer.Stop()
+	select {
+	case <-ack:
+		return nil
+	case <-c.closed:
+		return c.Err()
+	case <-timer.C:
+		c.mu.Lock()
+		delete(c.acks, id)
+		c.mu.Unlock()
+		return errors.New("broker did not acknowledge the message")
+	}
+}
+
+// Close disconnects from the broker
+func (c *Client) Close() error {
+	c.writePacket(packetDisconnect<<4, nil)
+	c.fail(ErrClosed)
+	return nil
+}
+
+// Err returns why the connection broke, or nil while it is usable
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// fail marks the connection broken and releases everything waiting on it
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.closed)
+	c.conn.Close()
+}
+
+// readLoop handles acknowledgements until the connection breaks
+func (c *Client) readLoop() {
+	reader := bufio.NewReader(c.conn)
+	for {
+		packetType, payload, err := readPacket(reader)
+		if err != nil {
+			c.fail(fmt.Errorf("mqtt connection lost: %w", err))
+			return
+		}
+		if packetType>>4 != packetPuback || len(payload) < 2 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(payload)
+		c.mu.Lock()
+		if ack, ok := c.acks[id]; ok {
+			delete(c.acks, id)
+			close(ack)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// pingLoop keeps the connection alive while nothing is published
+func (c *Client) pingLoop() {
+	ticker := time.NewTicker(c.keepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.writePacket(packetPingreq<<4, nil); err != nil {
+				c.fail(err)
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// writePacket writes a packet with the given first header byte
+func (c *Client) writePacket(header byte, body []byte) error {
+	packet := []byte{header}
+	packet = appendLength(packet, len(body))
+	packet = append(packet, body...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+// readPacket reads one packet, returning its first header byte and its body
+func readPacket(reader *bufio.Reader) (byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// appendLength appends the variable length encoding of n
+func appendLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// appendString appends a length-prefixed UTF-8 string
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,24 @@
+// Package sandbox restricts the agent process with seccomp and landlock, limiting what a
+// compromised agent can do to the syscalls and paths it actually needs
+package sandbox
+
+// Strictness levels
+const (
+	// Basic blocks syscalls that alter the system: module loading, mounts, reboot, clock changes
+	Basic = "basic"
+	// Strict additionally blocks process introspection and namespace syscalls and confines
+	// the filesystem to the configured paths with landlock
+	Strict = "strict"
+)
+
+// Options describes the restrictions to apply
+type Options struct {
+	Strictness string
+	// AllowBPF keeps the bpf and perf_event_open syscalls available in strict mode, for the
+	// eBPF flow probes
+	AllowBPF bool
+	// ReadPaths may be read, ExecPaths read and executed, WritePaths read and modified
+	ReadPaths  []string
+	ExecPaths  []string
+	WritePaths []string
+}
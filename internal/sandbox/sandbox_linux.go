@@ -0,0 +1,206 @@
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000
+
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+
+	// Landlock syscall numbers are shared by all architectures
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+)
+
+// Landlock ABI v1 filesystem access rights
+const (
+	accessExecute = 1 << iota
+	accessWriteFile
+	accessReadFile
+	accessReadDir
+	accessRemoveDir
+	accessRemoveFile
+	accessMakeChar
+	accessMakeDir
+	accessMakeReg
+	accessMakeSock
+	accessMakeFifo
+	accessMakeBlock
+	accessMakeSym
+
+	accessAll    = 1<<13 - 1
+	accessRead   = accessReadFile | accessReadDir
+	accessExec   = accessRead | accessExecute
+	accessWrite  = accessRead | accessWriteFile | accessRemoveDir | accessRemoveFile | accessMakeDir | accessMakeReg | accessMakeSock | accessMakeFifo | accessMakeSym
+	accessOnFile = accessExecute | accessWriteFile | accessReadFile
+)
+
+// Apply restricts the process and every thread it later starts, including child
+// processes; it returns the mechanisms that were applied
+func Apply(opts Options) ([]string, error) {
+	if opts.Strictness != Basic && opts.Strictness != Strict {
+		return nil, fmt.Errorf("unknown sandbox strictness: %s", opts.Strictness)
+	}
+
+	// Both mechanisms require no_new_privs; seccomp's TSYNC propagates it, landlock needs it per thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return nil, fmt.Errorf("failed to set no_new_privs: %w", errno)
+	}
+
+	applied := []string{}
+	if opts.Strictness == Strict {
+		if err := applyLandlock(opts); err != nil {
+			if !errors.Is(err, errLandlockUnavailable) {
+				return applied, err
+			}
+		} else {
+			applied = append(applied, "landlock")
+		}
+	}
+
+	if err := applySeccomp(deniedSyscalls(opts)); err != nil {
+		return applied, err
+	}
+	applied = append(applied, "seccomp")
+	return applied, nil
+}
+
+// deniedSyscalls returns the syscalls blocked at the requested strictness
+func deniedSyscalls(opts Options) []uint32 {
+	denied := append([]uint32{}, basicDenied...)
+	if opts.Strictness == Strict {
+		denied = append(denied, strictDenied...)
+		if !opts.AllowBPF {
+			denied = append(denied, sysBPF, sysPerfEventOpen)
+		}
+	}
+	return denied
+}
+
+// applySeccomp installs a filter failing the denied syscalls with EPERM on all threads
+func applySeccomp(denied []uint32) error {
+	if auditArch == 0 {
+		return fmt.Errorf("seccomp filtering is not supported on %s", runtime.GOARCH)
+	}
+
+	filter := []syscall.SockFilter{
+		// Reject syscalls made with a foreign calling convention
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: 4},
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 1, K: auditArch},
+		{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetErrno | uint32(syscall.EPERM)},
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: 0},
+	}
+	if syscallLimit != 0 {
+		filter = append(filter, syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K, Jt: uint8(len(denied) + 1), K: syscallLimit})
+	}
+	for i, nr := range denied {
+		// Jump to the final EPERM return on a match
+		filter = append(filter, syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: uint8(len(denied) - i), K: nr})
+	}
+	filter = append(filter,
+		syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetAllow},
+		syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetErrno | uint32(syscall.EPERM)},
+	)
+
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog)))
+	runtime.KeepAlive(filter)
+	if errno != 0 {
+		return fmt.Errorf("failed to install seccomp filter: %w", errno)
+	}
+	return nil
+}
+
+// errLandlockUnavailable is returned when the kernel lacks landlock or the binary uses cgo
+var errLandlockUnavailable = errors.New("landlock is not available")
+
+// applyLandlock confines filesystem access to the configured paths
+func applyLandlock(opts Options) error {
+	abi, _, errno := syscall.RawSyscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 || abi < 1 {
+		return errLandlockUnavailable
+	}
+
+	handled := uint64(accessAll)
+	fd, _, errno := syscall.RawSyscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&handled)), unsafe.Sizeof(handled), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create landlock ruleset: %w", errno)
+	}
+	ruleset := int(fd)
+	defer syscall.Close(ruleset)
+
+	rules := []struct {
+		paths  []string
+		access uint64
+	}{
+		{opts.ReadPaths, accessRead},
+		{opts.ExecPaths, accessExec},
+		{opts.WritePaths, accessWrite},
+	}
+	for _, rule := range rules {
+		for _, path := range rule.paths {
+			if err := addLandlockRule(ruleset, path, rule.access); err != nil {
+				return err
+			}
+		}
+	}
+
+	// landlock_restrict_self only affects the calling thread, so it has to run on all of them
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		// Not supported in binaries linked with cgo
+		if errno == syscall.ENOTSUP {
+			return errLandlockUnavailable
+		}
+		return fmt.Errorf("failed to set no_new_privs on all threads: %w", errno)
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, uintptr(ruleset), 0, 0); errno != 0 {
+		return fmt.Errorf("failed to apply landlock ruleset: %w", errno)
+	}
+	return nil
+}
+
+// addLandlockRule grants access beneath path; missing paths are ignored
+func addLandlockRule(ruleset int, path string, access uint64) error {
+	fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open %s for landlock: %w", path, err)
+	}
+	defer syscall.Close(fd)
+
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(fd, &stat); err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= accessOnFile
+	}
+
+	// struct landlock_path_beneath_attr is packed: __u64 allowed_access, __s32 parent_fd
+	var attr [12]byte
+	*(*uint64)(unsafe.Pointer(&attr[0])) = access
+	*(*int32)(unsafe.Pointer(&attr[8])) = int32(fd)
+	if _, _, errno := syscall.RawSyscall6(sysLandlockAddRule, uintptr(ruleset), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr[0])), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to add landlock rule for %s: %w", path, errno)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package sandbox
+
+import "fmt"
+
+// Apply is only supported on Linux
+func Apply(opts Options) ([]string, error) {
+	return nil, fmt.Errorf("sandboxing is only supported on Linux")
+}
@@ -0,0 +1,37 @@
+package sandbox
+
+const (
+	// auditArch is AUDIT_ARCH_X86_64
+	auditArch = 0xc000003e
+	// syscallLimit rejects x32 ABI syscalls, which share the architecture value
+	syscallLimit = 0x40000000
+	sysSeccomp   = 317
+	sysBPF       = 321
+	// sysPerfEventOpen attaches kprobes
+	sysPerfEventOpen = 298
+)
+
+// basicDenied alter the system: kexec, modules, reboot, swap, mounts, clocks, hostname, raw IO
+var basicDenied = []uint32{
+	246, 320, // kexec_load, kexec_file_load
+	175, 313, 176, // init_module, finit_module, delete_module
+	169,      // reboot
+	167, 168, // swapon, swapoff
+	165, 166, 155, 161, // mount, umount2, pivot_root, chroot
+	428, 429, 430, 431, 432, 442, // open_tree, move_mount, fsopen, fsconfig, fsmount, mount_setattr
+	163,                // acct
+	164, 227, 305, 159, // settimeofday, clock_settime, clock_adjtime, adjtimex
+	170, 171, // sethostname, setdomainname
+	172, 173, // iopl, ioperm
+	303, 304, // name_to_handle_at, open_by_handle_at
+	179, 212, 153, // quotactl, lookup_dcookie, vhangup
+}
+
+// strictDenied inspect or enter other processes and namespaces
+var strictDenied = []uint32{
+	101, 310, 311, 312, // ptrace, process_vm_readv, process_vm_writev, kcmp
+	248, 249, 250, // add_key, request_key, keyctl
+	323,      // userfaultfd
+	308, 272, // setns, unshare
+	135, 103, // personality, syslog
+}
@@ -0,0 +1,35 @@
+package sandbox
+
+const (
+	// auditArch is AUDIT_ARCH_AARCH64
+	auditArch    = 0xc00000b7
+	syscallLimit = 0
+	sysSeccomp   = 277
+	sysBPF       = 280
+	// sysPerfEventOpen attaches kprobes
+	sysPerfEventOpen = 241
+)
+
+// basicDenied alter the system: kexec, modules, reboot, swap, mounts, clocks, hostname
+var basicDenied = []uint32{
+	104, 294, // kexec_load, kexec_file_load
+	105, 273, 106, // init_module, finit_module, delete_module
+	142,      // reboot
+	224, 225, // swapon, swapoff
+	40, 39, 41, 51, // mount, umount2, pivot_root, chroot
+	428, 429, 430, 431, 432, 442, // open_tree, move_mount, fsopen, fsconfig, fsmount, mount_setattr
+	89,                 // acct
+	170, 112, 266, 171, // settimeofday, clock_settime, clock_adjtime, adjtimex
+	161, 162, // sethostname, setdomainname
+	264, 265, // name_to_handle_at, open_by_handle_at
+	60, 18, 58, // quotactl, lookup_dcookie, vhangup
+}
+
+// strictDenied inspect or enter other processes and namespaces
+var strictDenied = []uint32{
+	117, 270, 271, 272, // ptrace, process_vm_readv, process_vm_writev, kcmp
+	217, 218, 219, // add_key, request_key, keyctl
+	282,     // userfaultfd
+	268, 97, // setns, unshare
+	92, 116, // personality, syslog
+}
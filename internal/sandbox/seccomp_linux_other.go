@@ -0,0 +1,15 @@
+//go:build linux && !amd64 && !arm64
+
+package sandbox
+
+// Seccomp filtering is only implemented for amd64 and arm64
+const (
+	auditArch    = 0
+	syscallLimit = 0
+	sysSeccomp   = 0
+	sysBPF       = 0
+	// sysPerfEventOpen attaches kprobes
+	sysPerfEventOpen = 0
+)
+
+var basicDenied, strictDenied []uint32
@@ -0,0 +1,193 @@
+// Package schedule provides tickers that cope with suspend/resume and wall-clock jumps.
+//
+// Go timers run on the monotonic clock, which stops while a machine is suspended, so after
+// a resume a plain time.Ticker waits out the rest of its interval while wall-clock based
+// state (cursors, queue ages) has jumped ahead. A single watcher compares the wall and
+// monotonic clocks, notifies subscribers of jumps and lets tickers fire promptly after a
+// resume, once and with jitter, instead of stalling or replaying missed ticks.
+package schedule
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// watchPeriod is how often the wall and monotonic clocks are compared
+	watchPeriod = 2 * time.Second
+	// jumpThreshold is the drift between the clocks reported as a jump
+	jumpThreshold = 2 * time.Second
+	// maxResumeJitter bounds the delay before a ticker fires after a resume
+	maxResumeJitter = 5 * time.Second
+)
+
+var watcher = struct {
+	once   sync.Once
+	mu     sync.Mutex
+	nextID int
+	subs   map[int]chan time.Duration
+}{subs: make(map[int]chan time.Duration)}
+
+// watchClock reports the drift between wall and monotonic time to subscribers; a positive
+// drift means the wall clock moved ahead (resume or clock set forward)
+func watchClock() {
+	last := time.Now()
+	for {
+		time.Sleep(watchPeriod)
+		now := time.Now()
+		// Round(0) strips the monotonic reading, leaving wall time
+		drift := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+		last = now
+		if drift < jumpThreshold && drift > -jumpThreshold {
+			continue
+		}
+
+		watcher.mu.Lock()
+		for _, ch := range watcher.subs {
+			select {
+			case ch <- drift:
+			default:
+			}
+		}
+		watcher.mu.Unlock()
+	}
+}
+
+// subscribe registers for clock jump notifications
+func subscribe() (int, <-chan time.Duration) {
+	watcher.once.Do(func() { go watchClock() })
+
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	watcher.nextID++
+	ch := make(chan time.Duration, 1)
+	watcher.subs[watcher.nextID] = ch
+	return watcher.nextID, ch
+}
+
+// unsubscribe stops notifications for a subscription
+func unsubscribe(id int) {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	delete(watcher.subs, id)
+}
+
+// OnClockJump calls fn with the drift whenever the wall clock jumps relative to the
+// monotonic clock; the returned function cancels the subscription
+func OnClockJump(fn func(drift time.Duration)) func() {
+	id, jumps := subscribe()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case drift := <-jumps:
+				fn(drift)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			unsubscribe(id)
+			close(done)
+		})
+	}
+}
+
+// Ticker delivers ticks every interval like time.Ticker, firing once shortly after a
+// resume or forward clock jump; ticks are dropped rather than queued for slow receivers
+type Ticker struct {
+	C <-chan time.Time
+
+	c     chan time.Time
+	reset chan time.Duration
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// NewTicker returns a ticker firing every interval, which must be positive
+func NewTicker(interval time.Duration) *Ticker {
+	if interval <= 0 {
+		panic("schedule: non-positive interval for NewTicker")
+	}
+	c := make(chan time.Time, 1)
+	t := &Ticker{
+		C:     c,
+		c:     c,
+		reset: make(chan time.Duration),
+		stop:  make(chan struct{}),
+	}
+	go t.run(interval)
+	return t
+}
+
+// Reset changes the interval; the next tick comes one new interval from now
+func (t *Ticker) Reset(interval time.Duration) {
+	if interval <= 0 {
+		panic("schedule: non-positive interval for Ticker.Reset")
+	}
+	select {
+	case t.reset <- interval:
+	case <-t.stop:
+	}
+}
+
+// Stop turns off the ticker; no more ticks are sent after it returns
+func (t *Ticker) Stop() {
+	t.once.Do(func() { close(t.stop) })
+}
+
+// run drives the ticker on the monotonic clock
+func (t *Ticker) run(interval time.Duration) {
+	id, jumps := subscribe()
+	defer unsubscribe(id)
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case interval = <-t.reset:
+			resetTimer(timer, interval)
+		case drift := <-jumps:
+			if drift > 0 {
+				resetTimer(timer, resumeJitter(interval))
+			}
+		case now := <-timer.C:
+			select {
+			case t.c <- now:
+			default:
+			}
+			timer.Reset(interval)
+		}
+	}
+}
+
+// resetTimer stops a timer, drains a pending fire and rearms it
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+// resumeJitter spreads post-resume ticks so a fleet resuming together does not fire at once
+func resumeJitter(interval time.Duration) time.Duration {
+	limit := interval / 10
+	if limit > maxResumeJitter {
+		limit = maxResumeJitter
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
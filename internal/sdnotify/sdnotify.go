@@ -0,0 +1,87 @@
+// Package sdnotify implements the systemd service notification protocol (sd_notify), so a
+// Type=notify unit reports readiness and shutdown and is restarted when its watchdog lapses.
+// All functions are no-ops when the agent is not started by systemd.
+package sdnotify
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notification states understood by systemd
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Notify sends a state to the service manager and reports whether it was sent;
+// it returns false without error when NOTIFY_SOCKET is not set
+func Notify(state string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false, nil
+	}
+	// A leading @ denotes an abstract socket
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("failed to send notification: %w", err)
+	}
+	return true, nil
+}
+
+// Status sends a free-form status line shown by systemctl status
+func Status(format string, args ...interface{}) (bool, error) {
+	return Notify("STATUS=" + fmt.Sprintf(format, args...))
+}
+
+// WatchdogInterval returns the watchdog timeout configured with WatchdogSec, or zero when
+// the watchdog is disabled or meant for another process
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// StartWatchdog pings the watchdog at half its timeout for as long as healthy returns true,
+// so a hung agent stops pinging and is restarted; it returns a function that stops pinging
+func StartWatchdog(healthy func() bool) (stop func()) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if healthy() {
+					Notify(Watchdog)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
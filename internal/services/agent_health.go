@@ -0,0 +1,139 @@
+package services
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// AgentHealthEvent is an incident in the agent itself, such as a collector that fails or
+// lacks permissions, a queue that dropped data or a configuration error, so operators
+// see broken agents without reading each host's logs
+type AgentHealthEvent struct {
+	EventID  string `json:"event_id"`
+	Type     string `json:"type"`
+	Severity string `json:"severity"`
+	// Component is the collector, queue or configuration source the event is about
+	Component string `json:"component"`
+	Reason    string `json:"reason"`
+	// Details holds type-specific fields, such as the number of dropped events
+	Details     map[string]interface{} `json:"details,omitempty"`
+	Timestamp   string                 `json:"timestamp"`
+	Maintenance string                 `json:"maintenance,omitempty"`
+	EventOccurrences
+}
+
+// AgentHealthReport is the payload sent to the agent health endpoint
+type AgentHealthReport struct {
+	Events []AgentHealthEvent `json:"events"`
+}
+
+// Agent health event types
+const (
+	healthCollectorRestarted = "collector_restarted"
+	healthCollectorBackedOff = "collector_backed_off"
+	// healthCollectorFailed is raised when a collector enters the error state
+	healthCollectorFailed = "collector_failed"
+	// healthPermissionDenied is raised when a collector is skipped or degraded for lack of
+	// privileges
+	healthPermissionDenied = "permission_denied"
+	// healthQueueOverflow is raised when unsent events are dropped from a full queue
+	healthQueueOverflow = "queue_overflow"
+	// healthConfigError is raised for configuration problems, such as a remote
+	// configuration that cannot be applied
+	healthConfigError = "config_error"
+	// healthCommandRejected is raised when a server-issued command fails signature checks
+	healthCommandRejected = "command_rejected"
+)
+
+// Event severities. Storage and network mount events use info for a return to normal.
+const (
+	severityInfo    = "info"
+	severityWarning = "warning"
+	severityError   = "error"
+)
+
+// agentHealth queues agent health events until the supervisor reports them. Repeats of an
+// event type for the same component are coalesced with the event deduplication window.
+var agentHealth = struct {
+	sync.Mutex
+	events []AgentHealthEvent
+	dedup  *eventDeduper[AgentHealthEvent]
+}{dedup: newEventDeduper[AgentHealthEvent](0)}
+
+// configureAgentHealth applies the event deduplication window to agent health events
+func configureAgentHealth(cfg *config.Config) {
+	agentHealth.Lock()
+	defer agentHealth.Unlock()
+	if window := dedupWindow(cfg); window != agentHealth.dedup.window {
+		agentHealth.dedup = newEventDeduper[AgentHealthEvent](window)
+	}
+}
+
+// raiseHealthEvent queues an agent health event for the supervisor to report
+func raiseHealthEvent(eventType, severity, component, reason string, details map[string]interface{}) {
+	now := time.Now()
+	event := AgentHealthEvent{
+		Type:        eventType,
+		Severity:    severity,
+		Component:   component,
+		Reason:      reason,
+		Details:     details,
+		Timestamp:   now.UTC().Format(time.RFC3339Nano),
+		Maintenance: maintenanceTag(now),
+	}
+	event.EventID = eventID("agent_health", event.Type, event.Component, event.Timestamp)
+
+	agentHealth.Lock()
+	defer agentHealth.Unlock()
+	if !agentHealth.dedup.Observe(eventType+"\x00"+component, event, now) {
+		return
+	}
+	agentHealth.events = append(agentHealth.events, event)
+	// retainEvents would raise an overflow event of its own, so the oldest are dropped here
+	if len(agentHealth.events) > maxRetainedEvents {
+		agentHealth.events = agentHealth.events[len(agentHealth.events)-maxRetainedEvents:]
+	}
+}
+
+// ReportConfigProblem raises a configuration problem found outside the collectors, such as
+// a warning about the configuration file, as an agent health event
+func ReportConfigProblem(source, problem string) {
+	raiseHealthEvent(healthConfigError, severityWarning, source, problem, nil)
+}
+
+// takeHealthEvents returns and clears the queued agent health events, along with
+// summaries of coalesced repeats whose window ended
+func takeHealthEvents() []AgentHealthEvent {
+	agentHealth.Lock()
+	defer agentHealth.Unlock()
+	events := agentHealth.events
+	agentHealth.events = nil
+	for _, summary := range agentHealth.dedup.Flush(time.Now()) {
+		event := summary.Event
+		event.EventOccurrences = summary.occurrences()
+		events = append(events, event)
+	}
+	return events
+}
+
+// reportHealthEvents sends agent health incidents to the API along with those that failed
+// to send earlier
+func (m *CollectorManager) reportHealthEvents(events []AgentHealthEvent) {
+	events = append(m.pendingHealth, events...)
+	if len(events) == 0 {
+		return
+	}
+
+	reqBody := AgentHealthReport{Events: events}
+	if err := submitReport(context.Background(), m.config, http.MethodPost, hostPath(m.hostRid, "/agent-health"), reqBody); err != nil {
+		log.Printf("Failed to report agent health events (%d queued): %v", len(events), err)
+		m.pendingHealth = retainEvents("agent health", events)
+		return
+	}
+	m.pendingHealth = nil
+}
@@ -0,0 +1,142 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"sprinter-agent/internal/cbor"
+	"sprinter-agent/internal/config"
+)
+
+// reportHTTPClient is used for endpoints that are not yet part of the generated client
+var reportHTTPClient = newAPIClient()
+
+// apiStatusError is returned when the server answers with a non-2xx status
+type apiStatusError struct {
+	Path       string
+	StatusCode int
+}
+
+func (e *apiStatusError) Error() string {
+	return fmt.Sprintf("request to %s failed with status: %d", e.Path, e.StatusCode)
+}
+
+// sendJSON sends body as JSON to the given API path on the Somana server and
+// decodes the response into out when out is non-nil. Bodies are sent as CBOR instead
+// when the payload encoding negotiated with the server allows it.
+func sendJSON(ctx context.Context, cfg *config.Config, method, path string, body, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = encodeBody(body); err != nil {
+			return fmt.Errorf("failed to encode request body: %w", err)
+		}
+	}
+
+	if data != nil && useCBOR(cfg) {
+		encoded, err := cbor.FromJSON(data)
+		if err != nil {
+			return fmt.Errorf("failed to encode request body: %w", err)
+		}
+		err = sendBody(ctx, cfg, method, path, encoded, cbor.ContentType, idempotencyKey(method, path, data), out)
+		var statusErr *apiStatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnsupportedMediaType {
+			return err
+		}
+		rejectCBOR()
+	}
+	return sendBody(ctx, cfg, method, path, data, "application/json", idempotencyKey(method, path, data), out)
+}
+
+// sendBody sends an encoded body, nil for none, and decodes the JSON response into out
+// when out is non-nil
+func sendBody(ctx context.Context, cfg *config.Config, method, path string, data []byte, contentType, key string, out interface{}) error {
+	var reader io.Reader
+	if data != nil {
+		reader = bytes.NewReader(data)
+	}
+
+	url := strings.TrimRight(cfg.HostRegistration.SprinterURL, "/") + path
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := reportHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %w", path, err)
+	}
+	defer func() {
+		// Drain the body so HTTP/1.1 connections return to the pool for reuse
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+	}()
+	observeAcceptPost(resp.Header.Get("Accept-Post"))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &apiStatusError{Path: path, StatusCode: resp.StatusCode}
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil && err != io.EOF {
+			return fmt.Errorf("failed to decode response from %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// hostPath builds an API path scoped to the given host RID
+func hostPath(hostRid, suffix string) string {
+	return "/api/v1/hosts/" + hostRid + suffix
+}
+
+// mergeJSONBody returns a request editor that adds fields to a request's JSON object body,
+// letting generated client calls carry attributes the OpenAPI schema does not declare yet
+func mergeJSONBody(fields map[string]interface{}) func(ctx context.Context, req *http.Request) error {
+	return func(ctx context.Context, req *http.Request) error {
+		if len(fields) == 0 || req.Body == nil {
+			return nil
+		}
+
+		data, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read request body: %w", err)
+		}
+
+		body := make(map[string]interface{})
+		if len(bytes.TrimSpace(data)) > 0 {
+			if err := json.Unmarshal(data, &body); err != nil {
+				return fmt.Errorf("failed to decode request body: %w", err)
+			}
+		}
+		for key, value := range fields {
+			body[key] = value
+		}
+
+		merged, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request body: %w", err)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(merged))
+		req.ContentLength = int64(len(merged))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(merged)), nil
+		}
+		return nil
+	}
+}
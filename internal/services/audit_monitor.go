@@ -0,0 +1,346 @@
+//go:build !minimal && !no_audit
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// SecurityEvent is a security-relevant audit record
+type SecurityEvent struct {
+	EventID     string `json:"event_id"`
+	Category    string `json:"category"`
+	Type        string `json:"type"`
+	Timestamp   string `json:"timestamp"`
+	Serial      string `json:"serial"`
+	User        string `json:"user,omitempty"`
+	Exe         string `json:"exe,omitempty"`
+	Command     string `json:"command,omitempty"`
+	Address     string `json:"address,omitempty"`
+	Result      string `json:"result,omitempty"`
+	Maintenance string `json:"maintenance,omitempty"`
+	EventOccurrences
+}
+
+// SecurityEventsReport is the payload sent to the security events endpoint
+type SecurityEventsReport struct {
+	Source  string          `json:"source"`
+	Events  []SecurityEvent `json:"events"`
+	Dropped int             `json:"dropped"`
+}
+
+// Security event categories
+const (
+	securityCategoryExec      = "sensitive_exec"
+	securityCategoryAuth      = "auth_failure"
+	securityCategoryPrivilege = "privilege_escalation"
+	securityCategoryAnomaly   = "anomaly"
+)
+
+// execveSyscalls are the execve and execveat numbers per audit architecture, since the same
+// number is a different syscall elsewhere: 59 is execve on x86_64 but pipe2 on arm64
+var execveSyscalls = map[string]map[string]bool{
+	"c000003e": {"59": true, "322": true},  // x86_64
+	"c00000b7": {"221": true, "281": true}, // aarch64
+	"40000003": {"11": true, "358": true},  // i386, including 32-bit processes on x86_64
+	"40000028": {"11": true, "387": true},  // arm
+}
+
+// isExecve reports whether a SYSCALL record is an execve or execveat on its architecture
+func isExecve(fields map[string]string) bool {
+	return execveSyscalls[strings.ToLower(fields["arch"])][fields["syscall"]]
+}
+
+// AuditMonitorService forwards security-relevant auditd events to the API
+type AuditMonitorService struct {
+	config    *config.Config
+	hostRid   string
+	tailer    lineReader
+	limiter   *tokenBucket
+	dedup     *eventDeduper[SecurityEvent]
+	sensitive map[string]bool
+	dropped   int
+	// pending events failed to send and are resent with the next batch
+	pending  []SecurityEvent
+	stopChan chan bool
+}
+
+// NewAuditMonitorService creates a new audit monitor service
+func NewAuditMonitorService(cfg *config.Config, hostRid string) *AuditMonitorService {
+	sensitive := make(map[string]bool, len(cfg.Audit.SensitiveBinaries))
+	for _, path := range cfg.Audit.SensitiveBinaries {
+		sensitive[path] = true
+	}
+
+	return &AuditMonitorService{
+		config:    cfg,
+		hostRid:   hostRid,
+		sensitive: sensitive,
+		dedup:     newEventDeduper[SecurityEvent](dedupWindow(cfg)),
+		stopChan:  make(chan bool),
+	}
+}
+
+// init registers the collector, unless built with no_audit
+func init() {
+	registerCollector("audit", func(m *CollectorManager, c *config.Config) Collector {
+		return NewAuditMonitorService(c, m.hostRid)
+	})
+}
+
+// Start begins tailing the audit log
+func (s *AuditMonitorService) Start() error {
+	if !s.config.Audit.Enabled {
+		log.Println("Audit event forwarding not enabled - skipping")
+		setCollectorStatus("audit", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping audit event forwarding")
+		return nil
+	}
+
+	logPath := hostFile(s.config.Audit.LogPath)
+	source := logPath
+	if f, err := os.Open(logPath); err != nil {
+		if isPermissionError(err) {
+			client := privilegedHelper(s.config)
+			if client == nil {
+				setPermissionProblem("audit", CollectorSkipped, fmt.Sprintf("no read access to %s", s.config.Audit.LogPath))
+				log.Printf("Audit event forwarding skipped due to permissions: %v", err)
+				return nil
+			}
+			s.tailer = &helperTailer{client: client}
+			source = "privileged helper"
+		}
+	} else {
+		f.Close()
+	}
+
+	if s.tailer == nil {
+		s.tailer = newFileTailer(logPath)
+	}
+	s.limiter = newTokenBucket(s.config.Audit.RateLimit)
+
+	go s.monitorLoop()
+
+	setCollectorStatus("audit", CollectorRunning, "")
+	log.Printf("Audit event forwarding started from %s", source)
+	return nil
+}
+
+// Stop stops the monitoring process
+func (s *AuditMonitorService) Stop() {
+	if s.tailer != nil {
+		close(s.stopChan)
+		log.Println("Audit event forwarding stopped")
+	}
+}
+
+// monitorLoop polls the audit log for new records
+func (s *AuditMonitorService) monitorLoop() {
+	defer recoverPanic("audit")
+	ticker := newCollectorTicker("audit", s.config.Audit.Interval)
+	defer ticker.Stop()
+	defer s.tailer.Close()
+
+	markProgress("audit", s.config.Audit.Interval)
+	for {
+		select {
+		case <-ticker.C:
+			s.forwardEvents()
+			markProgress("audit", s.config.Audit.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// forwardEvents reads new audit records and forwards the security-relevant ones
+func (s *AuditMonitorService) forwardEvents() {
+	lines, err := s.tailer.ReadLines()
+	if err != nil {
+		if isPermissionError(err) {
+			if setPermissionProblem("audit", CollectorSkipped, fmt.Sprintf("no read access to %s", s.config.Audit.LogPath)) {
+				log.Printf("Audit event forwarding skipped due to permissions: %v", err)
+			}
+			return
+		}
+		log.Printf("Failed to read audit log: %v", err)
+	} else {
+		setCollectorStatus("audit", CollectorRunning, "")
+	}
+
+	now := time.Now()
+	events := s.pending
+	for _, line := range lines {
+		event, ok := s.classifyRecord(line)
+		if !ok {
+			continue
+		}
+		// Repeats are counted before rate limiting so they do not use up the budget
+		if !s.dedup.Observe(securityEventKey(event), event, now) {
+			continue
+		}
+		if !s.limiter.Allow() {
+			s.dropped++
+			continue
+		}
+		events = append(events, event)
+	}
+	for _, summary := range s.dedup.Flush(now) {
+		event := summary.Event
+		event.EventOccurrences = summary.occurrences()
+		events = append(events, event)
+	}
+
+	if len(events) == 0 && s.dropped == 0 {
+		return
+	}
+
+	reqBody := SecurityEventsReport{
+		Source:  "auditd",
+		Events:  events,
+		Dropped: s.dropped,
+	}
+
+	ctx := context.Background()
+	if err := submitReport(ctx, s.config, http.MethodPost, hostPath(s.hostRid, "/security-events"), reqBody); err != nil {
+		log.Printf("Failed to forward security events (%d queued): %v", len(events), err)
+		recordCollectorError("audit", err)
+		s.pending = retainEvents("audit", events)
+		return
+	}
+	s.pending = nil
+
+	if s.dropped > 0 {
+		log.Printf("Forwarded %d security events (%d dropped by rate limit)", len(events), s.dropped)
+	} else {
+		log.Printf("Forwarded %d security events successfully", len(events))
+	}
+	s.dropped = 0
+}
+
+// classifyRecord parses an audit record and decides whether it is security relevant
+func (s *AuditMonitorService) classifyRecord(line string) (SecurityEvent, bool) {
+	recordType, timestamp, serial, fields, ok := parseAuditRecord(line)
+	if !ok {
+		return SecurityEvent{}, false
+	}
+
+	event := SecurityEvent{
+		Type:      recordType,
+		Timestamp: timestamp,
+		Serial:    serial,
+		User:      firstNonEmpty(fields["acct"], fields["auid"], fields["uid"]),
+		Exe:       fields["exe"],
+		Command:   firstNonEmpty(fields["cmd"], fields["comm"]),
+		Address:   firstNonEmpty(fields["addr"], fields["hostname"]),
+		Result:    firstNonEmpty(fields["res"], fields["success"]),
+		// Records are classified as they are written
+		Maintenance: maintenanceTag(time.Now()),
+	}
+	// Audit serials are unique per boot, the timestamp tells boots apart
+	event.EventID = eventID("audit", timestamp, serial, recordType)
+
+	switch {
+	case recordType == "SYSCALL" && isExecve(fields) && s.sensitive[fields["exe"]]:
+		event.Category = securityCategoryExec
+	case recordType == "SYSCALL" && fields["euid"] == "0" && fields["uid"] != "0" && isExecve(fields):
+		event.Category = securityCategoryPrivilege
+	case (recordType == "USER_AUTH" || recordType == "USER_LOGIN" || recordType == "USER_ACCT" || recordType == "USER_ERR") &&
+		(fields["res"] == "failed" || fields["res"] == "0"):
+		event.Category = securityCategoryAuth
+	case recordType == "USER_CMD" || recordType == "USER_ROLE_CHANGE":
+		event.Category = securityCategoryPrivilege
+	case strings.HasPrefix(recordType, "ANOM_"):
+		event.Category = securityCategoryAnomaly
+	default:
+		return SecurityEvent{}, false
+	}
+
+	return event, true
+}
+
+// securityEventKey identifies identical events, ignoring when they happened
+func securityEventKey(event SecurityEvent) string {
+	return strings.Join([]string{event.Category, event.Type, event.User, event.Exe, event.Command, event.Address, event.Result}, "\x00")
+}
+
+// parseAuditRecord splits a raw audit line into its type, timestamp, serial and fields
+// Format: type=TYPE msg=audit(SECONDS.MILLIS:SERIAL): key=value ... msg='key=value ...'
+func parseAuditRecord(line string) (string, string, string, map[string]string, bool) {
+	if !strings.HasPrefix(line, "type=") {
+		return "", "", "", nil, false
+	}
+
+	header, body, ok := strings.Cut(line, "): ")
+	if !ok {
+		return "", "", "", nil, false
+	}
+
+	recordType, stamp, ok := strings.Cut(strings.TrimPrefix(header, "type="), " msg=audit(")
+	if !ok {
+		return "", "", "", nil, false
+	}
+	timestamp, serial, _ := strings.Cut(stamp, ":")
+
+	// User-space records nest their payload inside msg='...'
+	body = strings.Replace(body, "msg='", "", 1)
+	body = strings.TrimSuffix(strings.TrimSpace(body), "'")
+
+	return recordType, timestamp, serial, parseKeyValues(body), true
+}
+
+// parseKeyValues parses space separated key=value pairs, honouring double-quoted values
+func parseKeyValues(input string) map[string]string {
+	fields := make(map[string]string)
+	for len(input) > 0 {
+		input = strings.TrimLeft(input, " ")
+		key, rest, ok := strings.Cut(input, "=")
+		if !ok || strings.Contains(key, " ") {
+			// Skip tokens without a value
+			if i := strings.IndexByte(input, ' '); i >= 0 {
+				input = input[i+1:]
+				continue
+			}
+			break
+		}
+
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if i := strings.IndexByte(rest, ' '); i >= 0 {
+			value, rest = rest[:i], rest[i+1:]
+		} else {
+			value, rest = rest, ""
+		}
+
+		fields[key] = value
+		input = rest
+	}
+	return fields
+}
+
+// firstNonEmpty returns the first non-empty, non-placeholder value
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" && value != "?" && value != "(null)" && value != "unset" && value != "4294967295" {
+			return value
+		}
+	}
+	return ""
+}
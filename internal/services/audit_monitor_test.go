@@ -0,0 +1,58 @@
+//go:build !minimal && !no_audit
+
+package services
+
+import "testing"
+
+func TestClassifyRecordExecveByArch(t *testing.T) {
+	s := &AuditMonitorService{sensitive: map[string]bool{"/usr/bin/nc": true}}
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{
+			name: "execve on x86_64",
+			line: `type=SYSCALL msg=audit(1700000000.123:42): arch=c000003e syscall=59 success=yes exit=0 uid=1000 euid=1000 comm="nc" exe="/usr/bin/nc"`,
+			want: securityCategoryExec,
+		},
+		{
+			name: "execveat on aarch64",
+			line: `type=SYSCALL msg=audit(1700000000.123:43): arch=c00000b7 syscall=281 success=yes exit=0 uid=1000 euid=1000 comm="nc" exe="/usr/bin/nc"`,
+			want: securityCategoryExec,
+		},
+		{
+			name: "32-bit execve on x86_64",
+			line: `type=SYSCALL msg=audit(1700000000.123:44): arch=40000003 syscall=11 success=yes exit=0 uid=1000 euid=0 comm="su" exe="/usr/bin/su"`,
+			want: securityCategoryPrivilege,
+		},
+		{
+			// 59 is pipe2 on arm64
+			name: "x86_64 execve number on aarch64",
+			line: `type=SYSCALL msg=audit(1700000000.123:45): arch=c00000b7 syscall=59 success=yes exit=0 uid=1000 euid=1000 comm="nc" exe="/usr/bin/nc"`,
+		},
+		{
+			// 221 is fadvise64 on x86_64
+			name: "aarch64 execve number on x86_64",
+			line: `type=SYSCALL msg=audit(1700000000.123:46): arch=c000003e syscall=221 success=yes exit=0 uid=1000 euid=0 comm="nc" exe="/usr/bin/nc"`,
+		},
+		{
+			name: "no arch",
+			line: `type=SYSCALL msg=audit(1700000000.123:47): syscall=59 success=yes exit=0 uid=1000 euid=1000 comm="nc" exe="/usr/bin/nc"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, ok := s.classifyRecord(tt.line)
+			if tt.want == "" {
+				if ok {
+					t.Fatalf("classifyRecord = %+v, want the record skipped", event)
+				}
+				return
+			}
+			if !ok || event.Category != tt.want {
+				t.Fatalf("classifyRecord = %+v, %v; want category %s", event, ok, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/generated"
+)
+
+// availabilityStatePath keeps the per-unit time accounting across restarts
+const availabilityStatePath = "data/unit_availability.json"
+
+// availabilityBucket is the granularity time is accounted in. Windows are whole buckets,
+// so a 30 day window of every unit stays small enough to save on each report.
+const availabilityBucket = time.Hour
+
+// maxObservationGap is the longest time between two polls that is attributed to the state
+// a unit was in. Longer gaps, such as while the agent was stopped, are left unobserved.
+const maxObservationGap = time.Minute
+
+// unitTime is the time a unit spent in each kind of state during one bucket
+type unitTime struct {
+	// Start is the Unix time the bucket starts at
+	Start int64 `json:"t"`
+	// Up is time active or reloading
+	Up time.Duration `json:"u,omitempty"`
+	// Down is time failed, starting or stopping
+	Down time.Duration `json:"d,omitempty"`
+	// Inactive is time the unit was stopped or not loaded, which does not count against it
+	Inactive time.Duration `json:"i,omitempty"`
+	// Maintenance is time down during a maintenance window, which does not count either
+	Maintenance time.Duration `json:"m,omitempty"`
+}
+
+// AvailabilityWindow is a unit's availability over one rolling window
+type AvailabilityWindow struct {
+	// Window is the length of the window, such as "1h" or "7d"
+	Window string `json:"window"`
+	// Availability is the percentage of up and down time the unit was up, nil when it was
+	// neither during the window
+	Availability       *float64 `json:"availability"`
+	UpSeconds          float64  `json:"up_seconds"`
+	DownSeconds        float64  `json:"down_seconds"`
+	InactiveSeconds    float64  `json:"inactive_seconds"`
+	MaintenanceSeconds float64  `json:"maintenance_seconds"`
+}
+
+// UnitAvailability is the availability of one unit over every configured window
+type UnitAvailability struct {
+	Unit    string               `json:"unit"`
+	Windows []AvailabilityWindow `json:"windows"`
+}
+
+// AvailabilityReport is the payload sent to the service availability endpoint
+type AvailabilityReport struct {
+	GeneratedAt time.Time          `json:"generated_at"`
+	Units       []UnitAvailability `json:"units"`
+}
+
+// availabilityTracker accounts the time each unit spends up and down, in hourly buckets
+type availabilityTracker struct {
+	mu sync.Mutex
+	// units holds each unit's buckets, oldest first
+	units map[string][]unitTime
+	// last holds each unit's active state at the previous poll
+	last     map[string]string
+	lastPoll time.Time
+}
+
+// unitAvailability is the tracker shared by every run of the systemd collector, so a
+// restart of the collector neither loses nor reloads the accounting
+var unitAvailability = sync.OnceValue(newAvailabilityTracker)
+
+// newAvailabilityTracker returns a tracker resuming from the saved accounting
+func newAvailabilityTracker() *availabilityTracker {
+	t := &availabilityTracker{units: make(map[string][]unitTime)}
+	data, err := os.ReadFile(availabilityStatePath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: failed to read unit availability: %v", err)
+		}
+		return t
+	}
+	if err := json.Unmarshal(data, &t.units); err != nil {
+		log.Printf("Warning: failed to parse unit availability, starting afresh: %v", err)
+		t.units = make(map[string][]unitTime)
+	}
+	return t
+}
+
+// observe attributes the time since the previous poll to the state each unit was in then
+func (t *availabilityTracker) observe(cfg *config.AvailabilityConfig, services []generated.SystemdUnit, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(cfg, now)
+
+	current := make(map[string]string, len(services))
+	for _, service := range services {
+		if trackedUnit(cfg.Units, service.Unit) {
+			current[service.Unit] = service.Active
+		}
+	}
+	previous, elapsed := t.last, now.Sub(t.lastPoll)
+	t.last, t.lastPoll = current, now
+	if previous == nil || elapsed <= 0 || elapsed > maxObservationGap {
+		return
+	}
+
+	start := now.Truncate(availabilityBucket).Unix()
+	inMaintenance := maintenanceTag(now) != ""
+	// Units that were not listed were inactive, including tracked ones that disappeared
+	units := make(map[string]bool, len(previous))
+	for unit := range previous {
+		units[unit] = true
+	}
+	for unit := range t.units {
+		if trackedUnit(cfg.Units, unit) {
+			units[unit] = true
+		}
+	}
+	for unit := range units {
+		buckets := t.units[unit]
+		if len(buckets) == 0 || buckets[len(buckets)-1].Start != start {
+			buckets = append(buckets, unitTime{Start: start})
+		}
+		bucket := &buckets[len(buckets)-1]
+		switch previous[unit] {
+		case "active", "reloading":
+			bucket.Up += elapsed
+		case "failed", "activating", "deactivating":
+			if inMaintenance {
+				bucket.Maintenance += elapsed
+			} else {
+				bucket.Down += elapsed
+			}
+		default:
+			bucket.Inactive += elapsed
+		}
+		t.units[unit] = buckets
+	}
+}
+
+// prune drops buckets older than the longest window, and units left without any
+func (t *availabilityTracker) prune(cfg *config.AvailabilityConfig, now time.Time) {
+	longest := time.Duration(0)
+	for _, window := range cfg.Windows {
+		longest = max(longest, window)
+	}
+	cutoff := now.Add(-longest).Truncate(availabilityBucket).Unix()
+	for unit, buckets := range t.units {
+		i := sort.Search(len(buckets), func(i int) bool { return buckets[i].Start >= cutoff })
+		if i == len(buckets) {
+			delete(t.units, unit)
+			continue
+		}
+		if i > 0 {
+			t.units[unit] = append([]unitTime(nil), buckets[i:]...)
+		}
+	}
+}
+
+// report returns every tracked unit's availability over each window ending now. A window
+// covers the buckets starting within it, so it is up to an hour longer than its length.
+func (t *availabilityTracker) report(cfg *config.AvailabilityConfig, now time.Time) AvailabilityReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	report := AvailabilityReport{GeneratedAt: now.UTC(), Units: []UnitAvailability{}}
+	for unit, buckets := range t.units {
+		if !trackedUnit(cfg.Units, unit) {
+			continue
+		}
+		entry := UnitAvailability{Unit: unit}
+		for _, window := range cfg.Windows {
+			cutoff := now.Add(-window).Truncate(availabilityBucket).Unix()
+			var total unitTime
+			for _, bucket := range buckets {
+				if bucket.Start < cutoff {
+					continue
+				}
+				total.Up += bucket.Up
+				total.Down += bucket.Down
+				total.Inactive += bucket.Inactive
+				total.Maintenance += bucket.Maintenance
+			}
+			result := AvailabilityWindow{
+				Window:             formatWindow(window),
+				UpSeconds:          total.Up.Seconds(),
+				DownSeconds:        total.Down.Seconds(),
+				InactiveSeconds:    total.Inactive.Seconds(),
+				MaintenanceSeconds: total.Maintenance.Seconds(),
+			}
+			if counted := total.Up + total.Down; counted > 0 {
+				percent := 100 * total.Up.Seconds() / counted.Seconds()
+				result.Availability = &percent
+			}
+			entry.Windows = append(entry.Windows, result)
+		}
+		report.Units = append(report.Units, entry)
+	}
+	sort.Slice(report.Units, func(i, j int) bool {
+		return report.Units[i].Unit < report.Units[j].Unit
+	})
+	return report
+}
+
+// save writes the accounting atomically, so a crash mid-write does not lose the history
+func (t *availabilityTracker) save() error {
+	t.mu.Lock()
+	data, err := json.Marshal(t.units)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(availabilityStatePath), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	tmp := availabilityStatePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write unit availability file: %w", err)
+	}
+	if err := os.Rename(tmp, availabilityStatePath); err != nil {
+		return fmt.Errorf("failed to write unit availability file: %w", err)
+	}
+	return nil
+}
+
+// trackedUnit reports whether a unit matches the configured patterns; no patterns match
+// every unit
+func trackedUnit(patterns []string, unit string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, unit); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// formatWindow names a window in days when it is whole days, otherwise in hours
+func formatWindow(window time.Duration) string {
+	if window%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", window/(24*time.Hour))
+	}
+	return fmt.Sprintf("%dh", window/time.Hour)
+}
+
+// reportAvailability sends unit availability once the interval has passed since the last
+// report, and saves the accounting
+func (s *SystemdMonitorService) reportAvailability(now time.Time) {
+	cfg := &s.config.Systemd.Availability
+	if now.Sub(s.lastAvailabilityReport) < cfg.Interval {
+		return
+	}
+	s.lastAvailabilityReport = now
+	if err := unitAvailability().save(); err != nil {
+		log.Printf("Warning: failed to save unit availability: %v", err)
+	}
+
+	report := unitAvailability().report(cfg, now)
+	if len(report.Units) == 0 {
+		return
+	}
+	if err := submitReport(context.Background(), s.config, http.MethodPut, hostPath(s.hostRid, "/service-availability"), report); err != nil {
+		log.Printf("Failed to report service availability: %v", err)
+		recordCollectorError("systemd", err)
+		return
+	}
+	log.Printf("Reported availability of %d units successfully", len(report.Units))
+}
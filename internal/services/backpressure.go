@@ -0,0 +1,208 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/schedule"
+)
+
+const (
+	// maxBackoffFactor caps how much reporting intervals are stretched under backpressure
+	maxBackoffFactor = 16
+	// defaultRetryAfter is used when an overloaded server sends no Retry-After header
+	defaultRetryAfter = 30 * time.Second
+	// maxRetryAfter bounds the pause a server can request
+	maxRetryAfter = 10 * time.Minute
+)
+
+// errBackpressure is returned for requests held back while the server asked agents to back off
+var errBackpressure = errors.New("server requested backoff")
+
+// backpressure tracks overload signals from the server shared by all collectors: requests
+// pause until Retry-After has passed and reporting intervals are stretched, then ramp back
+// to normal as requests succeed again
+type backpressure struct {
+	mu     sync.Mutex
+	until  time.Time
+	factor int
+	nextID int
+	// tickers are rescaled when the factor changes
+	tickers map[int]*reportTicker
+}
+
+var serverBackpressure = &backpressure{factor: 1, tickers: make(map[int]*reportTicker)}
+
+// remaining returns how long requests are still held back
+func (b *backpressure) remaining() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Until(b.until)
+}
+
+// currentFactor returns how much reporting intervals are currently stretched
+func (b *backpressure) currentFactor() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.factor
+}
+
+// observe updates the backpressure state from a server response
+func (b *backpressure) observe(statusCode int, retryAfter string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	factor := b.factor
+	switch {
+	case statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable:
+		wait := parseRetryAfter(retryAfter)
+		// Jitter keeps agents told to wait the same time from returning together
+		wait += time.Duration(rand.Int63n(int64(wait)/2 + 1))
+		b.until = time.Now().Add(wait)
+		if factor < maxBackoffFactor {
+			factor *= 2
+		}
+		log.Printf("Server requested backoff (status %d), pausing reports for %s at %dx intervals", statusCode, wait.Round(time.Second), factor)
+	case statusCode >= 200 && statusCode < 300 && factor > 1:
+		factor /= 2
+		if factor == 1 {
+			log.Println("Server backpressure cleared, reporting at normal intervals")
+		}
+	}
+
+	if factor != b.factor {
+		b.factor = factor
+		for _, ticker := range b.tickers {
+			ticker.Reset(ticker.period(factor))
+		}
+	}
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	wait := defaultRetryAfter
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		wait = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil {
+		wait = time.Until(at)
+	}
+
+	if wait <= 0 {
+		wait = time.Second
+	}
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	return wait
+}
+
+// backpressureTransport holds requests back while the server asked for backoff and
+// records overload responses
+type backpressureTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *backpressureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Heartbeats are few and keep the host from looking offline, so they are not held back;
+	// they still slow down with the stretched intervals
+	if wait := serverBackpressure.remaining(); wait > 0 && routeOf(req.URL.Path).class != classHeartbeat {
+		return nil, fmt.Errorf("%w, next attempt in %s", errBackpressure, wait.Round(time.Second))
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	serverBackpressure.observe(resp.StatusCode, resp.Header.Get("Retry-After"))
+	return resp, nil
+}
+
+// tickSource drives a report ticker: its own schedule.Ticker, or the shared clock of the
+// minimal profile
+type tickSource interface {
+	Reset(interval time.Duration)
+	Stop()
+}
+
+// reportTicker is a collector ticker whose interval stretches under server backpressure
+type reportTicker struct {
+	C      <-chan time.Time
+	source tickSource
+	base   time.Duration
+	id     int
+	// collector is the loop the ticker drives, if it is a collector's, so the ticker also
+	// stretches while the collector is over its error budget
+	collector string
+}
+
+// newReportTicker returns a ticker firing every interval, scaled by the current backpressure
+func newReportTicker(interval time.Duration) *reportTicker {
+	return newCollectorTicker("", interval)
+}
+
+// newCollectorTicker returns a report ticker for the named collector's loop, which also
+// slows to the error budget's backoff interval while the collector keeps failing
+func newCollectorTicker(name string, interval time.Duration) *reportTicker {
+	if name != "" {
+		startErrorBudgetLoop(name)
+	}
+
+	b := serverBackpressure
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	t := &reportTicker{base: interval, id: b.nextID, collector: name}
+	scaled := t.period(b.factor)
+	if clock := currentSharedClock(); clock != nil {
+		tick := clock.subscribe(scaled)
+		t.C, t.source = tick.C, tick
+	} else {
+		ticker := schedule.NewTicker(scaled)
+		t.C, t.source = ticker.C, ticker
+	}
+	b.tickers[t.id] = t
+	return t
+}
+
+// period returns the ticker's interval at a backpressure factor
+func (t *reportTicker) period(factor int) time.Duration {
+	period := t.base * time.Duration(factor)
+	if t.collector != "" {
+		if backoff, ok := collectorBackoff(t.collector); ok {
+			period = max(period, backoff)
+		}
+	}
+	return period
+}
+
+// rescaleCollector resets the tickers of a collector whose error budget state changed
+func (b *backpressure) rescaleCollector(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ticker := range b.tickers {
+		if ticker.collector == name {
+			ticker.Reset(ticker.period(b.factor))
+		}
+	}
+}
+
+// Reset changes the interval; the next tick comes one new interval from now
+func (t *reportTicker) Reset(interval time.Duration) {
+	t.source.Reset(interval)
+}
+
+// Stop turns off the ticker and stops rescaling it
+func (t *reportTicker) Stop() {
+	serverBackpressure.mu.Lock()
+	delete(serverBackpressure.tickers, t.id)
+	serverBackpressure.mu.Unlock()
+	t.source.Stop()
+}
@@ -0,0 +1,264 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// bandwidthStatePath keeps the bytes sent in the current hour and day across restarts, so a
+// restart does not renew the budgets
+const bandwidthStatePath = "data/bandwidth.json"
+
+// bandwidthSaveInterval bounds how often the usage is saved
+const bandwidthSaveInterval = time.Minute
+
+// shedShare is the share of a budget each class may fill; a report that would take usage
+// past its class's share is dropped. Events may use the whole budget.
+var shedShare = map[dataClass]float64{
+	classInventory: 0.6,
+	classLogs:      0.75,
+	classMetrics:   0.9,
+	classEvents:    1,
+}
+
+// downsampleShare is the share of a budget past which each metrics report is only sent once
+// per downsample interval
+const downsampleShare = 0.75
+
+// CollectorBandwidth is what one collector's reports used of the budgets
+type CollectorBandwidth struct {
+	HourBytes int64 `json:"hour_bytes"`
+	DayBytes  int64 `json:"day_bytes"`
+	// ShedReports and ShedBytes count the reports dropped today to stay within the budgets
+	ShedReports int64 `json:"shed_reports,omitempty"`
+	ShedBytes   int64 `json:"shed_bytes,omitempty"`
+	// Downsampled counts the metrics reports skipped today while metrics were downsampled
+	Downsampled int64 `json:"downsampled_reports,omitempty"`
+}
+
+// BandwidthStats are the report bytes sent in the current hour and day, reported in
+// self-metrics
+type BandwidthStats struct {
+	HourlyBudgetBytes int64 `json:"hourly_budget_bytes,omitempty"`
+	DailyBudgetBytes  int64 `json:"daily_budget_bytes,omitempty"`
+	HourBytes         int64 `json:"hour_bytes"`
+	DayBytes          int64 `json:"day_bytes"`
+	// Shedding lists the classes of data dropped or downsampled this hour
+	Shedding   []string                      `json:"shedding,omitempty"`
+	Collectors map[string]CollectorBandwidth `json:"collectors"`
+}
+
+// bandwidthUsage is the saved accounting of the current hour and day
+type bandwidthUsage struct {
+	HourStart  time.Time                      `json:"hour_start"`
+	DayStart   time.Time                      `json:"day_start"`
+	HourBytes  int64                          `json:"hour_bytes"`
+	DayBytes   int64                          `json:"day_bytes"`
+	Collectors map[string]*CollectorBandwidth `json:"collectors"`
+}
+
+// bandwidthTracker accounts report bytes per collector and decides which reports fit the
+// budgets
+type bandwidthTracker struct {
+	mu    sync.Mutex
+	usage bandwidthUsage
+	// hourlyBudget and dailyBudget are the budgets in bytes at the last report, 0 for none
+	hourlyBudget, dailyBudget int64
+	// lastSent holds when each metrics path was last sent, for downsampling
+	lastSent map[string]time.Time
+	// shedding holds the classes shed this hour, so each is logged once
+	shedding map[dataClass]bool
+	lastSave time.Time
+}
+
+// bandwidthActive is set once a report was accounted, so self-metrics leave the bandwidth
+// out of agents that send none, such as during collect -print
+var bandwidthActive atomic.Bool
+
+// reportBandwidth is the tracker every report is accounted with
+var reportBandwidth = sync.OnceValue(newBandwidthTracker)
+
+// newBandwidthTracker returns a tracker resuming from the saved usage
+func newBandwidthTracker() *bandwidthTracker {
+	t := &bandwidthTracker{
+		usage:    bandwidthUsage{Collectors: make(map[string]*CollectorBandwidth)},
+		lastSent: make(map[string]time.Time),
+		shedding: make(map[dataClass]bool),
+	}
+	data, err := os.ReadFile(bandwidthStatePath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: failed to read bandwidth usage: %v", err)
+		}
+		return t
+	}
+	if err := json.Unmarshal(data, &t.usage); err != nil {
+		log.Printf("Warning: failed to parse bandwidth usage, starting afresh: %v", err)
+		t.usage = bandwidthUsage{}
+	}
+	if t.usage.Collectors == nil {
+		t.usage.Collectors = make(map[string]*CollectorBandwidth)
+	}
+	return t
+}
+
+// admit accounts a report of size bytes to path and reports whether it fits the budgets.
+// Reports that do not fit are counted as shed and must not be sent.
+func (t *bandwidthTracker) admit(cfg *config.BandwidthConfig, path string, size int64, now time.Time) bool {
+	bandwidthActive.Store(true)
+	t.mu.Lock()
+	t.hourlyBudget = int64(cfg.HourlyMB) * 1024 * 1024
+	t.dailyBudget = int64(cfg.DailyMB) * 1024 * 1024
+	t.roll(now)
+
+	route := routeOf(path)
+	usage := t.usage.Collectors[route.collector]
+	if usage == nil {
+		usage = &CollectorBandwidth{}
+		t.usage.Collectors[route.collector] = usage
+	}
+	share := t.share(size)
+	admitted := false
+	switch {
+	case share > shedShare[route.class]:
+		usage.ShedReports++
+		usage.ShedBytes += size
+		t.startShedding(route.class, share)
+	case route.class == classMetrics && share > downsampleShare && now.Sub(t.lastSent[path]) < cfg.DownsampleInterval:
+		usage.Downsampled++
+		t.startShedding(route.class, share)
+	default:
+		admitted = true
+		usage.HourBytes += size
+		usage.DayBytes += size
+		t.usage.HourBytes += size
+		t.usage.DayBytes += size
+		if route.class == classMetrics {
+			t.lastSent[path] = now
+		}
+	}
+	t.mu.Unlock()
+
+	t.saveEvery(now)
+	return admitted
+}
+
+// roll starts a new hour or day when now is past the current one
+func (t *bandwidthTracker) roll(now time.Time) {
+	year, month, day := now.Date()
+	dayStart := time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+	if !t.usage.DayStart.Equal(dayStart) {
+		t.usage.DayStart = dayStart
+		t.usage.DayBytes = 0
+		t.usage.Collectors = make(map[string]*CollectorBandwidth)
+	}
+	hourStart := now.Truncate(time.Hour)
+	if !t.usage.HourStart.Equal(hourStart) {
+		t.usage.HourStart = hourStart
+		t.usage.HourBytes = 0
+		for _, usage := range t.usage.Collectors {
+			usage.HourBytes = 0
+		}
+		if len(t.shedding) > 0 {
+			log.Println("Bandwidth budget renewed, sending all reports again")
+		}
+		t.shedding = make(map[dataClass]bool)
+	}
+}
+
+// share returns the largest share of a budget that would be used with size more bytes,
+// 0 when there is no budget
+func (t *bandwidthTracker) share(size int64) float64 {
+	share := 0.0
+	if t.hourlyBudget > 0 {
+		share = max(share, float64(t.usage.HourBytes+size)/float64(t.hourlyBudget))
+	}
+	if t.dailyBudget > 0 {
+		share = max(share, float64(t.usage.DayBytes+size)/float64(t.dailyBudget))
+	}
+	return share
+}
+
+// startShedding logs the first report of a class shed this hour
+func (t *bandwidthTracker) startShedding(class dataClass, share float64) {
+	if t.shedding[class] {
+		return
+	}
+	t.shedding[class] = true
+	if class == classMetrics && share <= shedShare[classMetrics] {
+		log.Printf("Bandwidth budget %.0f%% used, downsampling metrics reports", 100*share)
+		return
+	}
+	log.Printf("Bandwidth budget %.0f%% used, dropping %s reports", 100*share, class)
+}
+
+// saveEvery saves the usage when it was last saved at least bandwidthSaveInterval ago
+func (t *bandwidthTracker) saveEvery(now time.Time) {
+	t.mu.Lock()
+	if now.Sub(t.lastSave) < bandwidthSaveInterval {
+		t.mu.Unlock()
+		return
+	}
+	t.lastSave = now
+	data, err := json.Marshal(t.usage)
+	t.mu.Unlock()
+	if err == nil {
+		err = writeBandwidthUsage(data)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to save bandwidth usage: %v", err)
+	}
+}
+
+// writeBandwidthUsage writes the usage atomically
+func writeBandwidthUsage(data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(bandwidthStatePath), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	tmp := bandwidthStatePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write bandwidth usage file: %w", err)
+	}
+	if err := os.Rename(tmp, bandwidthStatePath); err != nil {
+		return fmt.Errorf("failed to write bandwidth usage file: %w", err)
+	}
+	return nil
+}
+
+// currentBandwidthStats returns the usage of the current hour and day, or nil when no
+// report was sent yet
+func currentBandwidthStats() *BandwidthStats {
+	if !bandwidthActive.Load() {
+		return nil
+	}
+	t := reportBandwidth()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.roll(time.Now())
+
+	stats := &BandwidthStats{
+		HourlyBudgetBytes: t.hourlyBudget,
+		DailyBudgetBytes:  t.dailyBudget,
+		HourBytes:         t.usage.HourBytes,
+		DayBytes:          t.usage.DayBytes,
+		Collectors:        make(map[string]CollectorBandwidth, len(t.usage.Collectors)),
+	}
+	for class := range t.shedding {
+		stats.Shedding = append(stats.Shedding, class.String())
+	}
+	sort.Strings(stats.Shedding)
+	for name, usage := range t.usage.Collectors {
+		stats.Collectors[name] = *usage
+	}
+	return stats
+}
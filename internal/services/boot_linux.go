@@ -0,0 +1,49 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/execwrap"
+)
+
+// currentBoot reads the kernel's boot ID and the boot time from /proc/stat
+func currentBoot() (bootInfo, error) {
+	boot := bootInfo{ID: readTrimmedFile("/proc/sys/kernel/random/boot_id")}
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return boot, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+			seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return boot, err
+			}
+			boot.Time = time.Unix(seconds, 0)
+			return boot, nil
+		}
+	}
+	return boot, errors.New("no boot time in /proc/stat")
+}
+
+// systemShuttingDown reports whether systemd is stopping the system, or on other init
+// systems whether the runlevel is halt or reboot
+func systemShuttingDown() bool {
+	if output, err := execwrap.Output(context.Background(), execwrap.Options{}, "systemctl", "is-system-running"); len(output) > 0 || err == nil {
+		return strings.TrimSpace(string(output)) == "stopping"
+	}
+	output, err := execwrap.Output(context.Background(), execwrap.Options{}, "runlevel")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(output))
+	return len(fields) == 2 && (fields[1] == "0" || fields[1] == "6")
+}
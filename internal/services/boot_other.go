@@ -0,0 +1,41 @@
+//go:build !linux && !windows
+
+package services
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+
+	"sprinter-agent/internal/execwrap"
+)
+
+// kernBootTimePattern matches the seconds of sysctl kern.boottime, e.g.
+// "{ sec = 1700000000, usec = 12345 } Tue Nov 14 22:13:20 2023"
+var kernBootTimePattern = regexp.MustCompile(`sec = (\d+)`)
+
+// currentBoot reads the boot time from sysctl kern.boottime; the BSDs and macOS have no
+// boot ID the agent can read without privileges
+func currentBoot() (bootInfo, error) {
+	output, err := execwrap.Output(context.Background(), execwrap.Options{}, "sysctl", "-n", "kern.boottime")
+	if err != nil {
+		return bootInfo{}, err
+	}
+	match := kernBootTimePattern.FindSubmatch(output)
+	if match == nil {
+		return bootInfo{}, errors.New("unexpected kern.boottime format")
+	}
+	seconds, err := strconv.ParseInt(string(match[1]), 10, 64)
+	if err != nil {
+		return bootInfo{}, err
+	}
+	return bootInfo{Time: time.Unix(seconds, 0)}, nil
+}
+
+// systemShuttingDown cannot tell a shutdown from the agent being stopped here, so reboots
+// after a clean stop are reported with kind "unknown"
+func systemShuttingDown() bool {
+	return false
+}
@@ -0,0 +1,44 @@
+package services
+
+import (
+	"errors"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	procGetTickCount64   = kernel32.NewProc("GetTickCount64")
+	user32               = syscall.NewLazyDLL("user32.dll")
+	procGetSystemMetrics = user32.NewProc("GetSystemMetrics")
+)
+
+// smShuttingDown is the GetSystemMetrics index that is nonzero while Windows shuts down
+const smShuttingDown = 0x2000
+
+// currentBoot derives the boot time from the milliseconds since boot; Windows has no boot ID
+func currentBoot() (bootInfo, error) {
+	if err := procGetTickCount64.Find(); err != nil {
+		return bootInfo{}, err
+	}
+	r1, r2, _ := procGetTickCount64.Call()
+	ticks := uint64(r1)
+	// On 32-bit Windows the high half comes back in EDX
+	if unsafe.Sizeof(uintptr(0)) == 4 {
+		ticks |= uint64(r2) << 32
+	}
+	if ticks == 0 {
+		return bootInfo{}, errors.New("GetTickCount64 returned no uptime")
+	}
+	now := time.Now()
+	return bootInfo{Time: now.Add(-time.Duration(ticks) * time.Millisecond).Truncate(time.Second)}, nil
+}
+
+// systemShuttingDown reports whether Windows is shutting down
+func systemShuttingDown() bool {
+	if err := procGetSystemMetrics.Find(); err != nil {
+		return false
+	}
+	r1, _, _ := procGetSystemMetrics.Call(smShuttingDown)
+	return r1 != 0
+}
@@ -0,0 +1,518 @@
+package services
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// bufferFileSuffix ends the name of every buffered report
+const bufferFileSuffix = ".report"
+
+// bufferedReport is a report kept on disk until the server can be reached
+type bufferedReport struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// bufferEntry is a buffered report as described by its file name, so the buffer is indexed
+// without reading every report. Names are <queued Unix nanoseconds>.<class>.<method>.<path
+// hash>.report.
+type bufferEntry struct {
+	name     string
+	queuedAt time.Time
+	class    dataClass
+	method   string
+	pathKey  string
+	size     int64
+}
+
+// BufferStats describe the disk buffer, reported in self-metrics
+type BufferStats struct {
+	QuotaBytes int64 `json:"quota_bytes"`
+	Bytes      int64 `json:"bytes"`
+	Reports    int   `json:"reports"`
+	// Classes counts the buffered reports of each data class
+	Classes map[string]int `json:"classes,omitempty"`
+	// Oldest is when the oldest buffered report was queued
+	Oldest *time.Time `json:"oldest,omitempty"`
+	// Buffered and Replayed count the reports stored and later sent since the agent started
+	Buffered uint64 `json:"buffered"`
+	Replayed uint64 `json:"replayed"`
+	// Dropped counts the reports dropped since the agent started, by reason: quota,
+	// retention, superseded, rejected, unreadable or disk_full
+	Dropped map[string]uint64 `json:"dropped,omitempty"`
+}
+
+// activeBuffer is the running disk buffer failed reports are kept in, if any
+var activeBuffer struct {
+	sync.Mutex
+	buffer *ReportBuffer
+}
+
+// currentBuffer returns the running disk buffer, or nil
+func currentBuffer() *ReportBuffer {
+	activeBuffer.Lock()
+	defer activeBuffer.Unlock()
+	return activeBuffer.buffer
+}
+
+// ReportBuffer keeps the reports that failed because the server or the path to it was down
+// on disk, within a quota, and sends them once the server can be reached again
+type ReportBuffer struct {
+	config   *config.Config
+	stopChan chan bool
+	started  bool
+	// aead encrypts reports when buffer.encrypt is set
+	aead cipher.AEAD
+
+	mu sync.Mutex
+	// entries are the buffered reports in the order they were queued
+	entries    []*bufferEntry
+	size       int64
+	lastQueued int64
+	buffered   uint64
+	replayed   uint64
+	dropped    map[string]uint64
+	// failing is set while replays fail, so a lasting outage is logged once
+	failing bool
+}
+
+// NewReportBuffer creates a new disk buffer
+func NewReportBuffer(cfg *config.Config) *ReportBuffer {
+	return &ReportBuffer{
+		config:   cfg,
+		stopChan: make(chan bool),
+		dropped:  make(map[string]uint64),
+	}
+}
+
+// Start loads the reports buffered by earlier runs and begins replaying them
+func (b *ReportBuffer) Start() error {
+	if !b.config.Buffer.Enabled {
+		log.Println("Report buffer not enabled - skipping")
+		return nil
+	}
+	if err := os.MkdirAll(b.config.Buffer.Directory, 0700); err != nil {
+		return fmt.Errorf("failed to create buffer directory: %w", err)
+	}
+	if b.config.Buffer.Encrypt {
+		aead, err := loadBufferCipher(b.config)
+		if err != nil {
+			return err
+		}
+		b.aead = aead
+	}
+	if err := b.load(); err != nil {
+		return err
+	}
+
+	activeBuffer.Lock()
+	activeBuffer.buffer = b
+	activeBuffer.Unlock()
+
+	b.started = true
+	go b.replayLoop()
+
+	log.Printf("Report buffer started in %s with %d reports buffered, quota %d MB%s", b.config.Buffer.Directory, len(b.entries), b.config.Buffer.MaxSizeMB, b.storageDescription())
+	return nil
+}
+
+// Stop stops buffering and replaying; buffered reports are kept for the next run
+func (b *ReportBuffer) Stop() {
+	if b.started {
+		activeBuffer.Lock()
+		activeBuffer.buffer = nil
+		activeBuffer.Unlock()
+		close(b.stopChan)
+		log.Println("Report buffer stopped")
+	}
+}
+
+// load indexes the reports in the buffer directory
+func (b *ReportBuffer) load() error {
+	dir := b.config.Buffer.Directory
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read buffer directory: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, file := range files {
+		name := file.Name()
+		// Left behind when the agent stopped while writing a report
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		entry, ok := parseBufferName(name)
+		if !ok {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		entry.size = info.Size()
+		b.entries = append(b.entries, entry)
+		b.size += entry.size
+		b.lastQueued = max(b.lastQueued, entry.queuedAt.UnixNano())
+	}
+	sort.Slice(b.entries, func(i, j int) bool { return b.entries[i].queuedAt.Before(b.entries[j].queuedAt) })
+	b.compact(time.Now())
+	return nil
+}
+
+// settle handles the outcome of sending a report: a report that failed because the server
+// could not be reached is buffered and counts as delivered, and a snapshot that was sent
+// replaces the ones still buffered for its path
+func (b *ReportBuffer) settle(method, path string, body interface{}, err error) error {
+	if err == nil {
+		if method == http.MethodPut {
+			b.mu.Lock()
+			b.supersede(method, bufferPathKey(path))
+			b.mu.Unlock()
+		}
+		return nil
+	}
+	if !serverUnreachable(err) {
+		return err
+	}
+	data, _ := body.(json.RawMessage)
+	if storeErr := b.store(method, path, data); storeErr != nil {
+		return fmt.Errorf("%w, and it could not be buffered: %v", err, storeErr)
+	}
+	return nil
+}
+
+// store writes a report to the buffer, then drops expired reports and, past the high
+// watermark, the lowest-priority ones
+func (b *ReportBuffer) store(method, path string, data []byte) error {
+	cfg := &b.config.Buffer
+	record, err := json.Marshal(bufferedReport{Method: method, Path: path, Body: data})
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.lastQueued = max(now.UnixNano(), b.lastQueued+1)
+	entry := &bufferEntry{
+		queuedAt: time.Unix(0, b.lastQueued),
+		class:    routeOf(path).class,
+		method:   method,
+		pathKey:  bufferPathKey(path),
+	}
+	entry.name = fmt.Sprintf("%d.%s.%s.%s%s", b.lastQueued, entry.class, strings.ToLower(method), entry.pathKey, bufferFileSuffix)
+	encoded, err := b.encode(entry.name, record)
+	if err != nil {
+		return err
+	}
+	entry.size = int64(len(encoded))
+	if entry.size > b.highWatermarkBytes() {
+		b.dropped["quota"]++
+		return fmt.Errorf("report of %d bytes is larger than the buffer may hold", entry.size)
+	}
+	if free, err := diskFreeBytes(cfg.Directory); err == nil && free < uint64(cfg.MinFreeMB)*1024*1024+uint64(entry.size) {
+		b.dropped["disk_full"]++
+		return fmt.Errorf("less than min_free_mb (%d MB) free for the buffer", cfg.MinFreeMB)
+	}
+	if err := writeBufferFile(filepath.Join(cfg.Directory, entry.name), encoded); err != nil {
+		return err
+	}
+	// Only the latest snapshot of a path is worth sending
+	if method == http.MethodPut {
+		b.supersede(method, entry.pathKey)
+	}
+	b.entries = append(b.entries, entry)
+	b.size += entry.size
+	b.buffered++
+	b.compact(now)
+	return nil
+}
+
+// supersede drops the buffered reports sent with method to the path with key
+func (b *ReportBuffer) supersede(method, key string) {
+	for _, entry := range append([]*bufferEntry(nil), b.entries...) {
+		if entry.method == method && entry.pathKey == key {
+			b.remove(entry, "superseded")
+		}
+	}
+}
+
+// compact drops the reports past their class's retention and, once the buffer passes the
+// high watermark, the oldest reports of the lowest classes until it is below the low one
+func (b *ReportBuffer) compact(now time.Time) {
+	for _, entry := range append([]*bufferEntry(nil), b.entries...) {
+		if retention := bufferRetention(&b.config.Buffer.Retention, entry.class); retention > 0 && now.Sub(entry.queuedAt) > retention {
+			b.remove(entry, "retention")
+		}
+	}
+
+	if b.size <= b.highWatermarkBytes() {
+		return
+	}
+	victims := append([]*bufferEntry(nil), b.entries...)
+	sort.SliceStable(victims, func(i, j int) bool { return victims[i].class < victims[j].class })
+	dropped := 0
+	for _, entry := range victims {
+		if b.size <= b.lowWatermarkBytes() {
+			break
+		}
+		b.remove(entry, "quota")
+		dropped++
+	}
+	if dropped > 0 {
+		log.Printf("Report buffer passed %d%% of its %d MB quota, dropped the %d oldest lowest-priority reports", b.config.Buffer.HighWatermark, b.config.Buffer.MaxSizeMB, dropped)
+	}
+}
+
+// highWatermarkBytes returns the size past which the buffer is compacted
+func (b *ReportBuffer) highWatermarkBytes() int64 {
+	return int64(b.config.Buffer.MaxSizeMB) * 1024 * 1024 * int64(b.config.Buffer.HighWatermark) / 100
+}
+
+// lowWatermarkBytes returns the size compaction brings the buffer down to
+func (b *ReportBuffer) lowWatermarkBytes() int64 {
+	return int64(b.config.Buffer.MaxSizeMB) * 1024 * 1024 * int64(b.config.Buffer.LowWatermark) / 100
+}
+
+// remove deletes a buffered report, counting it as dropped for reason unless that is empty
+func (b *ReportBuffer) remove(entry *bufferEntry, reason string) {
+	i := b.index(entry)
+	if i < 0 {
+		return
+	}
+	if err := os.Remove(filepath.Join(b.config.Buffer.Directory, entry.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Warning: failed to remove buffered report %s: %v", entry.name, err)
+	}
+	b.entries = append(b.entries[:i], b.entries[i+1:]...)
+	b.size -= entry.size
+	if reason != "" {
+		b.dropped[reason]++
+	}
+}
+
+// index returns the position of entry in the buffer, or -1 once it was removed
+func (b *ReportBuffer) index(entry *bufferEntry) int {
+	for i, e := range b.entries {
+		if e == entry {
+			return i
+		}
+	}
+	return -1
+}
+
+// replayLoop sends the buffered reports at the replay interval
+func (b *ReportBuffer) replayLoop() {
+	defer recoverPanic("buffer")
+	ticker := newReportTicker(b.config.Buffer.ReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.replay()
+		case <-b.stopChan:
+			return
+		}
+	}
+}
+
+// replay sends the buffered reports, highest priority first and oldest first within a
+// class, until the server cannot be reached
+func (b *ReportBuffer) replay() {
+	b.mu.Lock()
+	b.compact(time.Now())
+	queue := append([]*bufferEntry(nil), b.entries...)
+	b.mu.Unlock()
+	sort.SliceStable(queue, func(i, j int) bool { return queue[i].class > queue[j].class })
+
+	sent := 0
+	for _, entry := range queue {
+		select {
+		case <-b.stopChan:
+			return
+		default:
+		}
+		b.mu.Lock()
+		queued := b.index(entry) >= 0
+		b.mu.Unlock()
+		if !queued {
+			continue
+		}
+
+		record, err := b.read(entry)
+		if err != nil {
+			log.Printf("Warning: dropping unreadable buffered report %s: %v", entry.name, err)
+			b.drop(entry, "unreadable")
+			continue
+		}
+		err = sendJSON(context.Background(), b.config, record.Method, record.Path, record.Body, nil)
+		if err != nil && serverUnreachable(err) {
+			if !b.failing {
+				log.Printf("Buffered reports not sent yet: %v", err)
+			}
+			b.failing = true
+			break
+		}
+		b.failing = false
+		if err != nil {
+			log.Printf("Server rejected buffered report to %s, dropping it: %v", record.Path, err)
+			b.drop(entry, "rejected")
+			continue
+		}
+		b.drop(entry, "")
+		b.mu.Lock()
+		b.replayed++
+		b.mu.Unlock()
+		sent++
+	}
+	if sent > 0 {
+		b.mu.Lock()
+		left := len(b.entries)
+		b.mu.Unlock()
+		log.Printf("Sent %d buffered reports, %d left", sent, left)
+	}
+}
+
+// drop removes a buffered report under the lock
+func (b *ReportBuffer) drop(entry *bufferEntry, reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(entry, reason)
+}
+
+// read loads a buffered report
+func (b *ReportBuffer) read(entry *bufferEntry) (*bufferedReport, error) {
+	data, err := os.ReadFile(filepath.Join(b.config.Buffer.Directory, entry.name))
+	if err != nil {
+		return nil, err
+	}
+	if data, err = b.decode(entry.name, data); err != nil {
+		return nil, err
+	}
+	var record bufferedReport
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// serverUnreachable reports whether a request failed because of the server or the path to
+// it rather than the request itself, so sending it again later may succeed
+func serverUnreachable(err error) bool {
+	var statusErr *apiStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode == http.StatusRequestTimeout
+	}
+	return true
+}
+
+// bufferPathKey shortens a report path for buffer file names
+func bufferPathKey(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:8])
+}
+
+// parseBufferName describes a buffered report from its file name
+func parseBufferName(name string) (*bufferEntry, bool) {
+	base, ok := strings.CutSuffix(name, bufferFileSuffix)
+	if !ok {
+		return nil, false
+	}
+	parts := strings.Split(base, ".")
+	if len(parts) != 4 {
+		return nil, false
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	class, ok := parseDataClass(parts[1])
+	if !ok {
+		return nil, false
+	}
+	return &bufferEntry{
+		name:     name,
+		queuedAt: time.Unix(0, nanos),
+		class:    class,
+		method:   strings.ToUpper(parts[2]),
+		pathKey:  parts[3],
+	}, true
+}
+
+// bufferRetention returns how long reports of a class are kept
+func bufferRetention(retention *config.BufferRetention, class dataClass) time.Duration {
+	switch class {
+	case classInventory:
+		return retention.Inventory
+	case classLogs:
+		return retention.Logs
+	case classMetrics:
+		return retention.Metrics
+	}
+	return retention.Events
+}
+
+// writeBufferFile writes a buffered report atomically, readable by the agent only
+func writeBufferFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write buffered report: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write buffered report: %w", err)
+	}
+	return nil
+}
+
+// currentBufferStats returns the state of the disk buffer, or nil when it is not running
+func currentBufferStats() *BufferStats {
+	b := currentBuffer()
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := &BufferStats{
+		QuotaBytes: int64(b.config.Buffer.MaxSizeMB) * 1024 * 1024,
+		Bytes:      b.size,
+		Reports:    len(b.entries),
+		Classes:    make(map[string]int),
+		Buffered:   b.buffered,
+		Replayed:   b.replayed,
+		Dropped:    make(map[string]uint64, len(b.dropped)),
+	}
+	for _, entry := range b.entries {
+		stats.Classes[entry.class.String()]++
+	}
+	if len(b.entries) > 0 {
+		oldest := b.entries[0].queuedAt.UTC()
+		stats.Oldest = &oldest
+	}
+	for reason, n := range b.dropped {
+		stats.Dropped[reason] = n
+	}
+	return stats
+}
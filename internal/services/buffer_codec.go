@@ -0,0 +1,154 @@
+package services
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"sprinter-agent/internal/config"
+)
+
+// encryptedBufferMagic starts encrypted buffered reports, followed by the nonce and the
+// AES-256-GCM sealed report
+const encryptedBufferMagic = "SMB1"
+
+// zstdMagic starts compressed buffered reports; reports stored before compression was
+// enabled are plain JSON
+var zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+
+// maxBufferedReportSize bounds a report decompressed from the buffer
+const maxBufferedReportSize = 64 << 20
+
+// bufferZstd is the encoder and decoder shared by every report; EncodeAll and DecodeAll
+// are safe for concurrent use
+var bufferZstd struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+// zstdCodec returns the shared encoder and decoder, creating them on first use
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	bufferZstd.once.Do(func() {
+		// Reports are compressed one at a time as they are buffered, so a single
+		// goroutine each keeps the codec's memory small
+		bufferZstd.encoder, bufferZstd.err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if bufferZstd.err != nil {
+			return
+		}
+		bufferZstd.decoder, bufferZstd.err = zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(maxBufferedReportSize))
+	})
+	return bufferZstd.encoder, bufferZstd.decoder, bufferZstd.err
+}
+
+// encode compresses and encrypts a report as configured. The file name is authenticated
+// with an encrypted report, so its class and path cannot be swapped with another's.
+func (b *ReportBuffer) encode(name string, record []byte) ([]byte, error) {
+	if b.config.Buffer.Compress {
+		encoder, _, err := zstdCodec()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		record = encoder.EncodeAll(record, nil)
+	}
+	if b.aead == nil {
+		return record, nil
+	}
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := append([]byte(encryptedBufferMagic), nonce...)
+	return b.aead.Seal(sealed, nonce, record, []byte(name)), nil
+}
+
+// decode returns the JSON of a buffered report, whichever of the settings it was stored with
+func (b *ReportBuffer) decode(name string, data []byte) ([]byte, error) {
+	if sealed, ok := bytes.CutPrefix(data, []byte(encryptedBufferMagic)); ok {
+		if b.aead == nil {
+			return nil, errors.New("report is encrypted but buffer.encrypt is off")
+		}
+		if len(sealed) < b.aead.NonceSize() {
+			return nil, errors.New("encrypted report is truncated")
+		}
+		nonce, sealed := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+		opened, err := b.aead.Open(nil, nonce, sealed, []byte(name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt report, was the key changed? %w", err)
+		}
+		data = opened
+	}
+	if bytes.HasPrefix(data, zstdMagic) {
+		_, decoder, err := zstdCodec()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+		}
+		return decoder.DecodeAll(data, nil)
+	}
+	return data, nil
+}
+
+// storageDescription lists how reports are stored, for the start-up log
+func (b *ReportBuffer) storageDescription() string {
+	switch {
+	case b.config.Buffer.Compress && b.aead != nil:
+		return ", compressed and encrypted"
+	case b.config.Buffer.Compress:
+		return ", compressed"
+	case b.aead != nil:
+		return ", encrypted"
+	}
+	return ""
+}
+
+// loadBufferCipher returns the AES-256-GCM cipher of the buffer key, fetched by
+// ResolveSecrets from the provider buffer.key references or read from buffer.key_file.
+// The key is never generated: one kept next to the buffer would not protect it on a
+// copied disk.
+func loadBufferCipher(cfg *config.Config) (cipher.AEAD, error) {
+	if ref, ok := config.ParseSecretRef(cfg.Buffer.Key); ok {
+		bufferKeySecret.Lock()
+		fetched, secret := bufferKeySecret.ref, bufferKeySecret.secret
+		bufferKeySecret.Unlock()
+		if fetched != ref.String() {
+			return nil, fmt.Errorf("buffer key %s was not fetched at startup", ref)
+		}
+		return newBufferCipher([]byte(secret), ref.String())
+	}
+
+	key, err := os.ReadFile(cfg.Buffer.KeyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("buffer key file %s does not exist, provision one with openssl rand -hex 32", cfg.Buffer.KeyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read buffer key: %w", err)
+	}
+	return newBufferCipher(key, cfg.Buffer.KeyFile)
+}
+
+// newBufferCipher returns the AES-256-GCM cipher of a 32-byte key, raw or hex-encoded so a
+// key from openssl rand -hex 32 can be provisioned. source names where the key came from.
+func newBufferCipher(key []byte, source string) (cipher.AEAD, error) {
+	if decoded, err := hex.DecodeString(string(bytes.TrimSpace(key))); err == nil {
+		key = decoded
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s holds a %d-byte key, expected 32 bytes raw or hex-encoded", source, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
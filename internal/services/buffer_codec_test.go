@@ -0,0 +1,223 @@
+package services
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+const testBufferKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+// testBuffer returns a buffer storing reports with the given settings
+func testBuffer(t *testing.T, compress, encrypt bool) *ReportBuffer {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Buffer.Compress = compress
+	b := &ReportBuffer{config: cfg}
+	if encrypt {
+		aead, err := newBufferCipher([]byte(testBufferKey+"\n"), "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.aead = aead
+	}
+	return b
+}
+
+func TestBufferCodecRoundTrip(t *testing.T) {
+	report := []byte(strings.Repeat(`{"metric":"cpu","value":12.5}`, 100))
+	for _, tt := range []struct {
+		name              string
+		compress, encrypt bool
+	}{
+		{"plain", false, false},
+		{"compressed", true, false},
+		{"encrypted", false, true},
+		{"compressed and encrypted", true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBuffer(t, tt.compress, tt.encrypt)
+			stored, err := b.encode("metrics-1.json", report)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if tt.encrypt && bytes.Contains(stored, []byte("cpu")) {
+				t.Error("encrypted report holds the report in clear")
+			}
+			decoded, err := b.decode("metrics-1.json", stored)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !bytes.Equal(decoded, report) {
+				t.Fatalf("decode returned %d bytes, want the %d-byte report", len(decoded), len(report))
+			}
+		})
+	}
+}
+
+func TestBufferCodecRejectsTampering(t *testing.T) {
+	b := testBuffer(t, true, true)
+	report := []byte(`{"event":"login"}`)
+	stored, err := b.encode("events-1.json", report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := len(encryptedBufferMagic) + b.aead.NonceSize()
+
+	tests := []struct {
+		name string
+		file string
+		data []byte
+		want string
+	}{
+		{name: "other file name", file: "events-2.json", data: stored, want: "failed to decrypt"},
+		{name: "flipped ciphertext", file: "events-1.json", data: flipByte(stored, prefix+1), want: "failed to decrypt"},
+		{name: "flipped nonce", file: "events-1.json", data: flipByte(stored, len(encryptedBufferMagic)), want: "failed to decrypt"},
+		{name: "flipped tag", file: "events-1.json", data: flipByte(stored, len(stored)-1), want: "failed to decrypt"},
+		{name: "truncated nonce", file: "events-1.json", data: stored[:prefix-1], want: "truncated"},
+		{name: "truncated tag", file: "events-1.json", data: stored[:len(stored)-4], want: "failed to decrypt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := b.decode(tt.file, tt.data); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("decode error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	other, err := newBufferCipher(bytes.Repeat([]byte{7}, 32), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&ReportBuffer{config: b.config, aead: other}).decode("events-1.json", stored); err == nil {
+		t.Error("report decrypted under another key")
+	}
+	if _, err := testBuffer(t, true, false).decode("events-1.json", stored); err == nil || !strings.Contains(err.Error(), "buffer.encrypt is off") {
+		t.Errorf("decode without a key = %v, want it refused", err)
+	}
+}
+
+func TestBufferCodecReadsOlderReports(t *testing.T) {
+	// Reports stored before compression or encryption was enabled are read as they are
+	report := []byte(`{"log":"line"}`)
+	decoded, err := testBuffer(t, true, true).decode("logs-1.json", report)
+	if err != nil || !bytes.Equal(decoded, report) {
+		t.Fatalf("decode = %q, %v; want the report unchanged", decoded, err)
+	}
+}
+
+func TestBufferCodecReadsOtherZstdEncoders(t *testing.T) {
+	report := []byte(strings.Repeat(`{"metric":"cpu","value":12.5}`, 20))
+	// Written by the agent's earlier built-in encoder, which used the predefined tables
+	// and no Huffman literals
+	earlier, _ := hex.DecodeString("28b52ffd6444012d0100e87b226d6574726963223a22637075222c2276616c7565223a31322e357d01009100957202869011c8")
+	frames := map[string][]byte{"earlier agent": earlier}
+	if _, err := exec.LookPath("zstd"); err == nil {
+		cmd := exec.Command("zstd", "-19", "-c")
+		cmd.Stdin = bytes.NewReader(report)
+		frame, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("zstd: %v", err)
+		}
+		frames["zstd command"] = frame
+	}
+
+	b := testBuffer(t, true, false)
+	for name, frame := range frames {
+		decoded, err := b.decode("metrics-1.json", frame)
+		if err != nil || !bytes.Equal(decoded, report) {
+			t.Errorf("%s: decode = %d bytes, %v; want the report", name, len(decoded), err)
+		}
+	}
+}
+
+func TestBufferCodecBoundsDecompressedSize(t *testing.T) {
+	b := testBuffer(t, true, false)
+	stored, err := b.encode("metrics-1.json", make([]byte, maxBufferedReportSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.decode("metrics-1.json", stored); err == nil {
+		t.Fatal("decode returned a report over maxBufferedReportSize")
+	}
+}
+
+func TestNewBufferCipher(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		key  []byte
+		ok   bool
+	}{
+		{"hex", []byte(testBufferKey), true},
+		{"hex with newline", []byte(testBufferKey + "\n"), true},
+		{"raw", bytes.Repeat([]byte{0xfe}, 32), true},
+		{"short", []byte(testBufferKey[:62]), false},
+		{"empty", nil, false},
+	} {
+		if _, err := newBufferCipher(tt.key, "test"); (err == nil) != tt.ok {
+			t.Errorf("%s: newBufferCipher error = %v", tt.name, err)
+		}
+	}
+}
+
+func TestLoadBufferCipherNeverGeneratesKey(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.Secrets.Timeout = time.Second
+	cfg.Buffer.KeyFile = filepath.Join(dir, "buffer.key")
+
+	if _, err := loadBufferCipher(cfg); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("loadBufferCipher without a key file = %v, want it refused", err)
+	}
+	if _, err := os.Stat(cfg.Buffer.KeyFile); !os.IsNotExist(err) {
+		t.Fatalf("a key file was created: %v", err)
+	}
+
+	os.WriteFile(cfg.Buffer.KeyFile, []byte(testBufferKey), 0600)
+	if _, err := loadBufferCipher(cfg); err != nil {
+		t.Fatalf("loadBufferCipher: %v", err)
+	}
+}
+
+func TestLoadBufferCipherUsesKeyFetchedAtStartup(t *testing.T) {
+	t.Cleanup(func() {
+		bufferKeySecret.Lock()
+		bufferKeySecret.ref, bufferKeySecret.secret = "", ""
+		bufferKeySecret.Unlock()
+	})
+	cfg := &config.Config{}
+	cfg.Secrets.Timeout = 5 * time.Second
+	cfg.Secrets.Command = []string{"/bin/sh", "-c", "echo " + testBufferKey, "sh"}
+	cfg.Buffer.Enabled, cfg.Buffer.Encrypt = true, true
+	cfg.Buffer.Key = "exec:buffer_key"
+
+	if _, err := loadBufferCipher(cfg); err == nil || !strings.Contains(err.Error(), "not fetched at startup") {
+		t.Fatalf("loadBufferCipher before ResolveSecrets = %v, want it refused", err)
+	}
+	if err := ResolveSecrets(cfg); err != nil {
+		t.Fatalf("ResolveSecrets: %v", err)
+	}
+	if cfg.Buffer.Key != "exec:buffer_key" {
+		t.Fatalf("buffer.key = %q, want the reference kept for validation", cfg.Buffer.Key)
+	}
+
+	// Once sandboxed, the provider may be out of reach
+	cfg.Secrets.Command = []string{"/bin/false"}
+	if _, err := loadBufferCipher(cfg); err != nil {
+		t.Fatalf("loadBufferCipher after ResolveSecrets: %v", err)
+	}
+}
+
+// flipByte returns a copy of data with the byte at i inverted
+func flipByte(data []byte, i int) []byte {
+	flipped := bytes.Clone(data)
+	flipped[i] ^= 0xff
+	return flipped
+}
@@ -0,0 +1,225 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cgroupRoot is the mount point of the unified cgroup v2 hierarchy
+const cgroupRoot = "/sys/fs/cgroup"
+
+// CgroupUsage is a snapshot of resource consumption for a single cgroup
+type CgroupUsage struct {
+	CPUUsageUsec  uint64   `json:"cpu_usage_usec"`
+	CPUPercent    *float64 `json:"cpu_percent,omitempty"`
+	MemoryCurrent uint64   `json:"memory_current_bytes"`
+	IOReadBytes   uint64   `json:"io_read_bytes"`
+	IOWriteBytes  uint64   `json:"io_write_bytes"`
+	IOReadOps     uint64   `json:"io_read_ops"`
+	IOWriteOps    uint64   `json:"io_write_ops"`
+	// NetReceivedBytes and NetSentBytes come from systemd's IP accounting, for units that
+	// have it on; cgroups themselves do not count network traffic
+	NetReceivedBytes *uint64 `json:"net_received_bytes,omitempty"`
+	NetSentBytes     *uint64 `json:"net_sent_bytes,omitempty"`
+	// The rates cover the time since the previous poll and are absent on the first
+	IOReadBytesPerSec      *float64 `json:"io_read_bytes_per_sec,omitempty"`
+	IOWriteBytesPerSec     *float64 `json:"io_write_bytes_per_sec,omitempty"`
+	IOReadOpsPerSec        *float64 `json:"io_read_ops_per_sec,omitempty"`
+	IOWriteOpsPerSec       *float64 `json:"io_write_ops_per_sec,omitempty"`
+	NetReceivedBytesPerSec *float64 `json:"net_received_bytes_per_sec,omitempty"`
+	NetSentBytesPerSec     *float64 `json:"net_sent_bytes_per_sec,omitempty"`
+}
+
+// cgroupSample is a cgroup usage reading taken at a point in time
+type cgroupSample struct {
+	usage   CgroupUsage
+	takenAt time.Time
+}
+
+// applyRates sets the CPU percentage and the I/O and network rates from an earlier sample
+// of the same cgroup. A counter that went backwards, as when a unit restarted into a new
+// cgroup, gives no rate.
+func (u *CgroupUsage) applyRates(prev cgroupSample, now time.Time) {
+	seconds := now.Sub(prev.takenAt).Seconds()
+	if seconds <= 0 {
+		return
+	}
+	rate := func(current, previous uint64) *float64 {
+		if current < previous {
+			return nil
+		}
+		perSec := float64(current-previous) / seconds
+		return &perSec
+	}
+	if u.CPUUsageUsec >= prev.usage.CPUUsageUsec {
+		percent := float64(u.CPUUsageUsec-prev.usage.CPUUsageUsec) / (seconds * 1e6) * 100
+		u.CPUPercent = &percent
+	}
+	u.IOReadBytesPerSec = rate(u.IOReadBytes, prev.usage.IOReadBytes)
+	u.IOWriteBytesPerSec = rate(u.IOWriteBytes, prev.usage.IOWriteBytes)
+	u.IOReadOpsPerSec = rate(u.IOReadOps, prev.usage.IOReadOps)
+	u.IOWriteOpsPerSec = rate(u.IOWriteOps, prev.usage.IOWriteOps)
+	if u.NetReceivedBytes != nil && prev.usage.NetReceivedBytes != nil {
+		u.NetReceivedBytesPerSec = rate(*u.NetReceivedBytes, *prev.usage.NetReceivedBytes)
+	}
+	if u.NetSentBytes != nil && prev.usage.NetSentBytes != nil {
+		u.NetSentBytesPerSec = rate(*u.NetSentBytes, *prev.usage.NetSentBytes)
+	}
+}
+
+// cgroupV2Available reports whether the unified cgroup v2 hierarchy is mounted
+func cgroupV2Available() bool {
+	_, err := os.Stat(filepath.Join(hostFile(cgroupRoot), "cgroup.controllers"))
+	return err == nil
+}
+
+// readCgroupUsage reads CPU, memory and IO counters for a cgroup path relative to the cgroup root
+func readCgroupUsage(cgroupPath string) (*CgroupUsage, error) {
+	dir := filepath.Join(hostFile(cgroupRoot), cgroupPath)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("cgroup %s not found: %w", cgroupPath, err)
+	}
+
+	usage := &CgroupUsage{}
+
+	cpuStat, err := readKeyValueFile(filepath.Join(dir, "cpu.stat"))
+	if err == nil {
+		usage.CPUUsageUsec = cpuStat["usage_usec"]
+	}
+
+	if value, err := readUintFile(filepath.Join(dir, "memory.current")); err == nil {
+		usage.MemoryCurrent = value
+	}
+
+	if err := readIOStat(filepath.Join(dir, "io.stat"), usage); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// readKeyValueFile parses files made of "key value" lines, such as cpu.stat
+func readKeyValueFile(path string) (map[string]uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = value
+		}
+	}
+	return values, scanner.Err()
+}
+
+// readUintFile reads a file containing a single unsigned integer
+func readUintFile(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readIOStat sums io.stat counters across all devices
+// Format: MAJ:MIN rbytes=N wbytes=N rios=N wios=N dbytes=N dios=N
+func readIOStat(path string, usage *CgroupUsage) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			key, raw, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			value, err := strconv.ParseUint(raw, 10, 64)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "rbytes":
+				usage.IOReadBytes += value
+			case "wbytes":
+				usage.IOWriteBytes += value
+			case "rios":
+				usage.IOReadOps += value
+			case "wios":
+				usage.IOWriteOps += value
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// cgroupLimits are the resource limits of a cgroup; zero means unlimited
+type cgroupLimits struct {
+	MemoryMax uint64
+	CPUCores  float64
+}
+
+// ownCgroupLimits reads the memory and CPU limits of the agent's own cgroup, such as
+// those set by a container runtime or systemd MemoryMax=/CPUQuota=
+func ownCgroupLimits() (cgroupLimits, error) {
+	var limits cgroupLimits
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return limits, err
+	}
+
+	// The unified hierarchy is the "0::/path" line
+	var cgroupPath string
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			cgroupPath = path
+			break
+		}
+	}
+	if cgroupPath == "" {
+		return limits, fmt.Errorf("agent is not in a cgroup v2 hierarchy")
+	}
+
+	// Limits of parent cgroups apply too, so the tightest one along the path wins
+	for dir := filepath.Join(cgroupRoot, cgroupPath); strings.HasPrefix(dir, cgroupRoot+"/"); dir = filepath.Dir(dir) {
+		if value, err := readUintFile(filepath.Join(dir, "memory.max")); err == nil {
+			if limits.MemoryMax == 0 || value < limits.MemoryMax {
+				limits.MemoryMax = value
+			}
+		}
+		// cpu.max is "QUOTA PERIOD", with a quota of "max" for no limit
+		if data, err := os.ReadFile(filepath.Join(dir, "cpu.max")); err == nil {
+			fields := strings.Fields(string(data))
+			if len(fields) == 2 && fields[0] != "max" {
+				quota, qerr := strconv.ParseFloat(fields[0], 64)
+				period, perr := strconv.ParseFloat(fields[1], 64)
+				if qerr == nil && perr == nil && period > 0 {
+					if cores := quota / period; limits.CPUCores == 0 || cores < limits.CPUCores {
+						limits.CPUCores = cores
+					}
+				}
+			}
+		}
+	}
+	return limits, nil
+}
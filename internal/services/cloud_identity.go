@@ -0,0 +1,207 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// identityProviderHeader names the cloud that issued the bearer token of a registration,
+// so the server knows how to verify it
+const identityProviderHeader = "X-Somana-Identity-Provider"
+
+const (
+	awsMetadataURL   = "http://169.254.169.254/latest"
+	gcpMetadataURL   = "http://metadata.google.internal/computeMetadata/v1"
+	azureMetadataURL = "http://169.254.169.254/metadata"
+)
+
+// metadataClient talks to the instance metadata service, which only answers on the
+// link-local network: proxies are bypassed and a host outside the cloud fails fast
+var metadataClient = &http.Client{
+	Timeout: 5 * time.Second,
+	Transport: &http.Transport{
+		Proxy:       nil,
+		DialContext: (&net.Dialer{Timeout: 2 * time.Second}).DialContext,
+	},
+}
+
+// identityFetcher gets a token proving the identity of the instance from its cloud
+type identityFetcher func(ctx context.Context, audience string) (string, error)
+
+// identityProviders are tried in this order when identity_provider is "auto"
+var identityProviders = []struct {
+	name  string
+	fetch identityFetcher
+}{
+	{"aws", awsIdentity},
+	{"gcp", gcpIdentity},
+	{"azure", azureIdentity},
+}
+
+// detectedIdentity remembers which cloud answered with identity_provider "auto"
+var detectedIdentity struct {
+	sync.Mutex
+	provider string
+}
+
+// AuthorizeEnrollment authorizes a host registration. With an identity provider configured
+// it sends the token the cloud issues to the instance; the enrollment token, if any, is
+// used instead when the metadata service cannot provide one. It returns the provider whose
+// token was sent, empty when none was.
+func AuthorizeEnrollment(ctx context.Context, cfg *config.Config, req *http.Request) (string, error) {
+	reg := cfg.HostRegistration
+	if reg.IdentityProvider != "" {
+		provider, token, err := cloudIdentityToken(ctx, reg.IdentityProvider, identityAudience(cfg))
+		if err == nil {
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set(identityProviderHeader, provider)
+			return provider, nil
+		}
+		if reg.EnrollmentToken == "" {
+			return "", err
+		}
+		log.Printf("Cannot get a cloud identity token, using the enrollment token: %v", err)
+	}
+	if reg.EnrollmentToken != "" {
+		req.Header.Set("Authorization", "Bearer "+reg.EnrollmentToken)
+	}
+	return "", nil
+}
+
+// identityAudience is the audience the identity token is issued for
+func identityAudience(cfg *config.Config) string {
+	if cfg.HostRegistration.IdentityAudience != "" {
+		return cfg.HostRegistration.IdentityAudience
+	}
+	return strings.TrimRight(cfg.HostRegistration.SprinterURL, "/")
+}
+
+// cloudIdentityToken gets an identity token from the named provider, or with "auto" from
+// the first whose metadata service answers
+func cloudIdentityToken(ctx context.Context, provider, audience string) (string, string, error) {
+	if provider == "auto" {
+		detectedIdentity.Lock()
+		defer detectedIdentity.Unlock()
+		if detectedIdentity.provider != "" {
+			provider = detectedIdentity.provider
+		} else {
+			var failures []string
+			for _, candidate := range identityProviders {
+				token, err := candidate.fetch(ctx, audience)
+				if err == nil {
+					detectedIdentity.provider = candidate.name
+					return candidate.name, token, nil
+				}
+				failures = append(failures, fmt.Sprintf("%s: %v", candidate.name, err))
+			}
+			return "", "", fmt.Errorf("no cloud metadata service provided an identity token (%s)", strings.Join(failures, "; "))
+		}
+	}
+	for _, candidate := range identityProviders {
+		if candidate.name == provider {
+			token, err := candidate.fetch(ctx, audience)
+			if err != nil {
+				return "", "", fmt.Errorf("failed to get an identity token from %s: %w", provider, err)
+			}
+			return provider, token, nil
+		}
+	}
+	return "", "", fmt.Errorf("unknown identity provider %q", provider)
+}
+
+// awsIdentity returns the signed PKCS#7 instance identity document of an EC2 instance,
+// using an IMDSv2 session token
+func awsIdentity(ctx context.Context, _ string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, awsMetadataURL+"/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	session, err := metadataRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, awsMetadataURL+"/dynamic/instance-identity/pkcs7", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", session)
+	document, err := metadataRequest(req)
+	if err != nil {
+		return "", err
+	}
+	// The document is base64 wrapped over several lines
+	return strings.Join(strings.Fields(document), ""), nil
+}
+
+// gcpIdentity returns a Google-signed ID token of the instance's default service account,
+// with the instance details included
+func gcpIdentity(ctx context.Context, audience string) (string, error) {
+	query := url.Values{"audience": {audience}, "format": {"full"}}
+	endpoint := gcpMetadataURL + "/instance/service-accounts/default/identity?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return metadataRequest(req)
+}
+
+// azureIdentity returns an access token of the VM's managed identity for the audience
+func azureIdentity(ctx context.Context, audience string) (string, error) {
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {audience}}
+	endpoint := azureMetadataURL + "/identity/oauth2/token?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+	body, err := metadataRequest(req)
+	if err != nil {
+		return "", err
+	}
+	var response struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		return "", fmt.Errorf("failed to decode managed identity token: %w", err)
+	}
+	if response.AccessToken == "" {
+		return "", errors.New("managed identity response has no access token")
+	}
+	return response.AccessToken, nil
+}
+
+// metadataRequest sends a request to the metadata service and returns the trimmed body
+func metadataRequest(req *http.Request) (string, error) {
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	token := strings.TrimSpace(string(body))
+	if token == "" {
+		return "", fmt.Errorf("%s answered with an empty body", req.URL.Host)
+	}
+	return token, nil
+}
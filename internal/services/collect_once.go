@@ -0,0 +1,142 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oneShotWindow is how long rate-based collectors such as metrics sample in one-shot mode,
+// instead of waiting a full interval between their baseline and first report
+const oneShotWindow = 5 * time.Second
+
+// streamingCollectors only forward events as they arrive, so a single iteration has
+// nothing to report
+var streamingCollectors = map[string]string{
+	"audit":      "forwards audit events as they are written",
+	"kernel_log": "forwards kernel log events as they are written",
+	"crashes":    "forwards crashes as they are logged",
+}
+
+// oneShot coordinates the collect command: in one-shot mode collector loops return after
+// their first iteration and signal it here
+var oneShot struct {
+	sync.Mutex
+	active bool
+	done   map[string]chan struct{}
+}
+
+// oneShotMode reports whether the collect command is running the collectors
+func oneShotMode() bool {
+	oneShot.Lock()
+	defer oneShot.Unlock()
+	return oneShot.active
+}
+
+// finishedOnce is called by a collector loop after an iteration; in one-shot mode it
+// records that the collector finished and returns true so the loop returns
+func finishedOnce(name string) bool {
+	oneShot.Lock()
+	defer oneShot.Unlock()
+	if !oneShot.active {
+		return false
+	}
+	if done, ok := oneShot.done[name]; ok {
+		close(done)
+		delete(oneShot.done, name)
+	}
+	return true
+}
+
+// CollectOnce runs every collector, or only the named one, for a single iteration instead
+// of starting their loops, and returns the states of the collectors it ran once they all
+// finished or the timeout passed. Reports go wherever they would when running, or to the
+// sink set with SetReportSink.
+func (m *CollectorManager) CollectOnce(only string, timeout time.Duration) ([]CollectorStatus, error) {
+	if only != "" {
+		if _, ok := findCollectorSpec(only); !ok {
+			return nil, fmt.Errorf("unknown collector: %s", only)
+		}
+	}
+
+	m.mu.Lock()
+	cfg := *m.config
+	cfg.Metrics.Interval = min(cfg.Metrics.Interval, oneShotWindow)
+	cfg.NetFlow.Interval = min(cfg.NetFlow.Interval, oneShotWindow)
+
+	oneShot.Lock()
+	oneShot.active = true
+	oneShot.done = make(map[string]chan struct{})
+	oneShot.Unlock()
+
+	selected := []string{}
+	waiting := make(map[string]chan struct{})
+	for _, spec := range collectorSpecs {
+		if only != "" && spec.name != only {
+			continue
+		}
+		selected = append(selected, spec.name)
+		if reason, ok := streamingCollectors[spec.name]; ok {
+			setCollectorStatus(spec.name, CollectorSkipped, reason+", so it cannot run once")
+			continue
+		}
+
+		done := make(chan struct{})
+		oneShot.Lock()
+		oneShot.done[spec.name] = done
+		oneShot.Unlock()
+		m.startLocked(spec, &cfg)
+
+		// Disabled and skipped collectors return from Start without running
+		if _, running := m.running[spec.name]; running {
+			switch collectorState(spec.name) {
+			case CollectorDisabled, CollectorSkipped:
+			default:
+				waiting[spec.name] = done
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	unfinished := []string{}
+	expired := false
+	for name, done := range waiting {
+		if !expired {
+			select {
+			case <-done:
+				continue
+			case <-deadline.C:
+				expired = true
+			}
+		}
+		select {
+		case <-done:
+		default:
+			unfinished = append(unfinished, name)
+		}
+	}
+	m.Stop()
+
+	names := make(map[string]bool, len(selected))
+	for _, name := range selected {
+		names[name] = true
+	}
+	statuses := []CollectorStatus{}
+	for _, status := range CollectorStatuses() {
+		if names[status.Name] {
+			statuses = append(statuses, status)
+		}
+	}
+
+	if len(unfinished) > 0 {
+		sort.Strings(unfinished)
+		log.Printf("Collectors did not finish within %s: %s", timeout, strings.Join(unfinished, ", "))
+		return statuses, fmt.Errorf("%s did not finish within %s", strings.Join(unfinished, ", "), timeout)
+	}
+	return statuses, nil
+}
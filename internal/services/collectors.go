@@ -0,0 +1,299 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/generated"
+)
+
+// Collector is a background collector that can be started and stopped
+type Collector interface {
+	Start() error
+	Stop()
+}
+
+// collectorSpec describes how to build a collector and which config section drives it
+type collectorSpec struct {
+	name    string
+	section func(cfg *config.Config) interface{}
+	create  func(m *CollectorManager, cfg *config.Config) Collector
+}
+
+// collectorSpecs lists every collector in start order. Optional collectors have no create
+// function here: their files register one with registerCollector, and are left out of
+// builds with the minimal tag or their own no_<name> tag.
+var collectorSpecs = []collectorSpec{
+	{"systemd", func(c *config.Config) interface{} { return c.Systemd }, func(m *CollectorManager, c *config.Config) Collector {
+		if m.client == nil {
+			return nil
+		}
+		return NewSystemdMonitorService(c, m.client, m.hostRid)
+	}},
+	{"ipmi", func(c *config.Config) interface{} { return c.IPMI }, nil},
+	{"connections", func(c *config.Config) interface{} { return c.Connections }, nil},
+	{"netflow", func(c *config.Config) interface{} { return c.NetFlow }, nil},
+	{"audit", func(c *config.Config) interface{} { return c.Audit }, nil},
+	{"fim", func(c *config.Config) interface{} { return c.FIM }, func(m *CollectorManager, c *config.Config) Collector {
+		return NewFIMService(c, m.hostRid)
+	}},
+	{"scheduled_jobs", func(c *config.Config) interface{} { return c.ScheduledJobs }, func(m *CollectorManager, c *config.Config) Collector {
+		return NewScheduledJobsMonitorService(c, m.hostRid)
+	}},
+	{"firewall", func(c *config.Config) interface{} { return c.Firewall }, func(m *CollectorManager, c *config.Config) Collector {
+		return NewFirewallMonitorService(c, m.hostRid)
+	}},
+	{"kernel", func(c *config.Config) interface{} { return c.Kernel }, func(m *CollectorManager, c *config.Config) Collector {
+		return NewKernelMonitorService(c, m.hostRid)
+	}},
+	{"kernel_log", func(c *config.Config) interface{} { return c.KernelLog }, nil},
+	{"crashes", func(c *config.Config) interface{} { return c.Crashes }, nil},
+	{"textfile", func(c *config.Config) interface{} { return c.Textfile }, nil},
+	{"compliance", func(c *config.Config) interface{} { return c.Compliance }, nil},
+	{"remote_hosts", func(c *config.Config) interface{} { return c.RemoteHosts }, nil},
+	{"containers", func(c *config.Config) interface{} { return c.Containers }, nil},
+	{"libvirt", func(c *config.Config) interface{} { return c.Libvirt }, nil},
+	{"storage", func(c *config.Config) interface{} { return c.Storage }, nil},
+	{"network_mounts", func(c *config.Config) interface{} { return c.NetworkMounts }, nil},
+	{"saturation", func(c *config.Config) interface{} { return c.Saturation }, nil},
+	{"metrics", func(c *config.Config) interface{} { return c.Metrics }, func(m *CollectorManager, c *config.Config) Collector {
+		return NewMetricsMonitorService(c, m.hostRid)
+	}},
+	{"inventory", func(c *config.Config) interface{} { return c.Inventory }, func(m *CollectorManager, c *config.Config) Collector {
+		return NewInventoryMonitorService(c, m.hostRid)
+	}},
+	{"eventlog", func(c *config.Config) interface{} { return c.EventLog }, nil},
+}
+
+// registerCollector supplies the create function of an optional collector built into this
+// binary; it is called from init functions
+func registerCollector(name string, create func(m *CollectorManager, cfg *config.Config) Collector) {
+	for i := range collectorSpecs {
+		if collectorSpecs[i].name == name {
+			collectorSpecs[i].create = create
+			return
+		}
+	}
+	panic("services: registering unknown collector " + name)
+}
+
+// CollectorManager runs the collectors and restarts those whose configuration changed
+type CollectorManager struct {
+	mu      sync.Mutex
+	config  *config.Config
+	hostRid string
+	client  *generated.ClientWithResponses
+	running map[string]Collector
+	// paused collectors stay stopped across configuration changes until resumed
+	paused map[string]bool
+	// shed collectors were stopped while the agent is over its resource budget
+	shed    map[string]bool
+	stopped bool
+	// superviseStop ends the supervisor restarting stalled collectors
+	superviseStop chan bool
+	// pendingHealth holds health events the supervisor failed to report, resent with the next
+	pendingHealth []AgentHealthEvent
+}
+
+// NewCollectorManager creates a new collector manager
+func NewCollectorManager(cfg *config.Config, hostRid string, apiClient *generated.ClientWithResponses) *CollectorManager {
+	return &CollectorManager{
+		config:  cfg,
+		hostRid: hostRid,
+		client:  apiClient,
+		running: make(map[string]Collector),
+		paused:  make(map[string]bool),
+		shed:    make(map[string]bool),
+	}
+}
+
+// Start starts every collector
+func (m *CollectorManager) Start() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	configureErrorBudget(m.config)
+	configureAgentHealth(m.config)
+	configureCommandPool(m.config)
+	configureQueryCache(m.config)
+	for _, spec := range collectorSpecs {
+		m.startLocked(spec, m.config)
+	}
+
+	m.superviseStop = make(chan bool)
+	go m.supervise(m.superviseStop)
+	return nil
+}
+
+// Stop stops every running collector
+func (m *CollectorManager) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stopped = true
+	if m.superviseStop != nil {
+		close(m.superviseStop)
+	}
+	for _, spec := range collectorSpecs {
+		m.stopLocked(spec.name)
+	}
+}
+
+// Apply switches to a new configuration, restarting only collectors whose section changed
+func (m *CollectorManager) Apply(cfg *config.Config) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopped {
+		return
+	}
+	configureErrorBudget(cfg)
+	configureAgentHealth(cfg)
+	configureCommandPool(cfg)
+	configureQueryCache(cfg)
+	ConfigureMaintenance(cfg)
+	for _, spec := range collectorSpecs {
+		if reflect.DeepEqual(spec.section(m.config), spec.section(cfg)) {
+			continue
+		}
+		if m.paused[spec.name] || m.shed[spec.name] {
+			continue
+		}
+		log.Printf("Configuration of %s changed, restarting it", spec.name)
+		// The new configuration may have fixed what made it fail
+		resetErrorBudget(spec.name)
+		m.stopLocked(spec.name)
+		m.startLocked(spec, cfg)
+	}
+	m.config = cfg
+}
+
+// Ping reports whether the manager is responsive; it blocks while the manager is stuck
+func (m *CollectorManager) Ping() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return !m.stopped
+}
+
+// Pause stops a collector until Resume is called, without changing its configuration
+func (m *CollectorManager) Pause(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := findCollectorSpec(name); !ok {
+		return fmt.Errorf("unknown collector: %s", name)
+	}
+	if m.paused[name] {
+		return nil
+	}
+	m.stopLocked(name)
+	m.paused[name] = true
+	setCollectorStatus(name, CollectorPaused, "paused by operator")
+	log.Printf("Paused %s", name)
+	return nil
+}
+
+// Resume restarts a paused collector with the current configuration
+func (m *CollectorManager) Resume(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	spec, ok := findCollectorSpec(name)
+	if !ok {
+		return fmt.Errorf("unknown collector: %s", name)
+	}
+	if !m.paused[name] {
+		return fmt.Errorf("collector %s is not paused", name)
+	}
+	delete(m.paused, name)
+	if m.stopped || m.shed[name] {
+		return nil
+	}
+	m.startLocked(spec, m.config)
+	log.Printf("Resumed %s", name)
+	return nil
+}
+
+// Shed stops every running collector not listed as essential and returns their names
+func (m *CollectorManager) Shed(essential []string, reason string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keep := make(map[string]bool, len(essential))
+	for _, name := range essential {
+		keep[name] = true
+	}
+
+	var shed []string
+	for _, spec := range collectorSpecs {
+		if _, ok := m.running[spec.name]; !ok || keep[spec.name] {
+			continue
+		}
+		// Disabled and skipped collectors use no resources
+		if state := collectorState(spec.name); state != CollectorRunning && state != CollectorDegraded {
+			continue
+		}
+		m.stopLocked(spec.name)
+		m.shed[spec.name] = true
+		setCollectorStatus(spec.name, CollectorPaused, "load shedding: "+reason)
+		shed = append(shed, spec.name)
+	}
+	return shed
+}
+
+// Restore restarts the collectors stopped by Shed, except those paused meanwhile
+func (m *CollectorManager) Restore() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, spec := range collectorSpecs {
+		if !m.shed[spec.name] {
+			continue
+		}
+		delete(m.shed, spec.name)
+		if m.stopped || m.paused[spec.name] {
+			continue
+		}
+		m.startLocked(spec, m.config)
+	}
+}
+
+// findCollectorSpec looks up a collector by name
+func findCollectorSpec(name string) (collectorSpec, bool) {
+	for _, spec := range collectorSpecs {
+		if spec.name == name {
+			return spec, true
+		}
+	}
+	return collectorSpec{}, false
+}
+
+// stopLocked stops one collector if it is running; m.mu must be held
+func (m *CollectorManager) stopLocked(name string) {
+	if collector, ok := m.running[name]; ok {
+		collector.Stop()
+		delete(m.running, name)
+	}
+	forgetProgress(name)
+}
+
+// startLocked creates and starts one collector; m.mu must be held
+func (m *CollectorManager) startLocked(spec collectorSpec, cfg *config.Config) {
+	if spec.create == nil {
+		setCollectorStatus(spec.name, CollectorSkipped, "not included in this build")
+		return
+	}
+	collector := spec.create(m, cfg)
+	if collector == nil {
+		return
+	}
+	if err := collector.Start(); err != nil {
+		setCollectorStatus(spec.name, CollectorError, err.Error())
+		log.Printf("Warning: Failed to start %s: %v", spec.name, err)
+		return
+	}
+	m.running[spec.name] = collector
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/execwrap"
+)
+
+// ConfigureExec applies the defaults of every external command the agent runs
+func ConfigureExec(cfg *config.Config) error {
+	return execwrap.Configure(execwrap.Config{
+		Timeout:   cfg.Exec.Timeout,
+		MaxOutput: cfg.Exec.MaxOutputKB << 10,
+		KeepEnv:   cfg.Exec.KeepEnv,
+		Wrapper:   cfg.Exec.Wrapper,
+	})
+}
+
+// CommandStats count the external commands collectors ran, reported in self-metrics
+type CommandStats struct {
+	Running  int64  `json:"running"`
+	Started  uint64 `json:"started"`
+	TimedOut uint64 `json:"timed_out"`
+	// Rejected commands found no free slot before their timeout, since earlier ones are
+	// still running
+	Rejected uint64 `json:"rejected"`
+}
+
+var commandStats struct {
+	running                     atomic.Int64
+	started, timedOut, rejected atomic.Uint64
+}
+
+// currentCommandStats returns the command counters, or nil before any command ran
+func currentCommandStats() *CommandStats {
+	if commandStats.started.Load() == 0 && commandStats.rejected.Load() == 0 {
+		return nil
+	}
+	return &CommandStats{
+		Running:  commandStats.running.Load(),
+		Started:  commandStats.started.Load(),
+		TimedOut: commandStats.timedOut.Load(),
+		Rejected: commandStats.rejected.Load(),
+	}
+}
+
+// commandPool holds the slots commands take while they run: one of the shared slots and
+// one of their collector's. A command stuck in the kernel keeps its slots, so a hung tool
+// costs its collector a slot instead of a new goroutine every interval.
+var commandPool = struct {
+	sync.Mutex
+	config     config.CommandsConfig
+	shared     chan struct{}
+	collectors map[string]chan struct{}
+}{
+	config:     config.CommandsConfig{MaxConcurrent: 8, PerCollector: 2, Timeout: time.Minute},
+	collectors: make(map[string]chan struct{}),
+}
+
+// configureCommandPool applies the command limits. Commands running keep the slots they
+// took; new ones take slots sized by the new limits.
+func configureCommandPool(cfg *config.Config) {
+	commandPool.Lock()
+	defer commandPool.Unlock()
+	commandPool.config = cfg.Commands
+	commandPool.shared = nil
+	commandPool.collectors = make(map[string]chan struct{})
+}
+
+// commandSlots returns the shared slots and the collector's, and its command timeout
+func commandSlots(collector string) (shared, own chan struct{}, timeout time.Duration) {
+	commandPool.Lock()
+	defer commandPool.Unlock()
+	cfg := commandPool.config
+	if commandPool.shared == nil {
+		commandPool.shared = make(chan struct{}, cfg.MaxConcurrent)
+	}
+	limits := cfg.Collectors[collector]
+	own, ok := commandPool.collectors[collector]
+	if !ok {
+		size := cfg.PerCollector
+		if limits.Concurrency > 0 {
+			size = limits.Concurrency
+		}
+		own = make(chan struct{}, size)
+		commandPool.collectors[collector] = own
+	}
+	timeout = cfg.Timeout
+	if limits.Timeout > 0 {
+		timeout = limits.Timeout
+	}
+	return commandPool.shared, own, timeout
+}
+
+// acquireCommand waits for a slot of the collector and a shared one, until ctx is done
+func acquireCommand(ctx context.Context, collector string, shared, own chan struct{}) (func(), error) {
+	select {
+	case own <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%d commands of the %s collector are still running", cap(own), collector)
+	}
+	select {
+	case shared <- struct{}{}:
+	case <-ctx.Done():
+		<-own
+		return nil, fmt.Errorf("%d commands of all collectors are still running", cap(shared))
+	}
+	return func() {
+		<-shared
+		<-own
+	}, nil
+}
+
+// runCollectorCommand runs an external command for a collector within its concurrency
+// limits and timeout, and returns its output. env is added to the command's environment.
+// Its error output is included in any error.
+func runCollectorCommand(collector string, env []string, name string, args ...string) (string, error) {
+	shared, own, timeout := commandSlots(collector)
+	// Waiting for a slot and running each get the full timeout
+	wait, cancelWait := context.WithTimeout(context.Background(), timeout)
+	release, err := acquireCommand(wait, collector, shared, own)
+	cancelWait()
+	if err != nil {
+		commandStats.rejected.Add(1)
+		return "", fmt.Errorf("%s not run: %w", name, err)
+	}
+	defer release()
+
+	commandStats.started.Add(1)
+	commandStats.running.Add(1)
+	defer commandStats.running.Add(-1)
+
+	output, err := execwrap.Output(context.Background(), execwrap.Options{Timeout: timeout, Env: env}, name, args...)
+	if errors.Is(err, execwrap.ErrTimeout) {
+		commandStats.timedOut.Add(1)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
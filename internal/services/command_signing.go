@@ -0,0 +1,281 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// commandNoncePath keeps the nonces of accepted commands until they expire, so a command
+// cannot be replayed across agent restarts either
+const commandNoncePath = "data/command_nonces.json"
+
+// signedEnvelope wraps a server-issued command or document: Payload is the base64-encoded
+// JSON the server signed and Signature its base64-encoded Ed25519 signature over those
+// bytes
+type signedEnvelope struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// commandClaims are the fields of a signed payload that bind it to a host and a time
+type commandClaims struct {
+	HostRid   string     `json:"host_rid"`
+	Nonce     string     `json:"nonce"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// claimKeys are removed from signed documents before they are applied
+var claimKeys = []string{"host_rid", "nonce", "issued_at", "expires_at"}
+
+// commandVerifier checks server-issued commands against the keys pinned in the local
+// configuration, so an attacker holding only an API token cannot make the agent act
+type commandVerifier struct {
+	keys        []ed25519.PublicKey
+	hostRid     string
+	clockSkew   time.Duration
+	maxLifetime time.Duration
+}
+
+// newCommandVerifier returns a verifier for the host, or nil when command signing is off
+func newCommandVerifier(cfg *config.Config, hostRid string) (*commandVerifier, error) {
+	if !cfg.CommandSigning.Enabled {
+		return nil, nil
+	}
+	keys, err := cfg.CommandSigning.ParsePublicKeys()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("command signing is enabled but no public keys are pinned")
+	}
+	return &commandVerifier{
+		keys:        keys,
+		hostRid:     hostRid,
+		clockSkew:   cfg.CommandSigning.ClockSkew,
+		maxLifetime: cfg.CommandSigning.MaxLifetime,
+	}, nil
+}
+
+// open checks an envelope's signature and returns the signed payload and its claims
+func (v *commandVerifier) open(raw []byte) ([]byte, commandClaims, error) {
+	var claims commandClaims
+	var envelope signedEnvelope
+	if err := json.Unmarshal(raw, &envelope); err != nil || envelope.Payload == "" || envelope.Signature == "" {
+		return nil, claims, errors.New("command is not signed")
+	}
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, claims, fmt.Errorf("invalid payload encoding: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return nil, claims, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	verified := false
+	for _, key := range v.keys {
+		if ed25519.Verify(key, payload, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, claims, errors.New("signature does not match any pinned key")
+	}
+
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, claims, fmt.Errorf("invalid signed payload: %w", err)
+	}
+	if claims.HostRid != "" && claims.HostRid != v.hostRid {
+		return nil, claims, fmt.Errorf("command was issued for host %s", claims.HostRid)
+	}
+	if claims.IssuedAt.IsZero() {
+		return nil, claims, errors.New("command has no issued_at time")
+	}
+	if claims.IssuedAt.After(time.Now().Add(v.clockSkew)) {
+		return nil, claims, fmt.Errorf("command was issued in the future, at %s", claims.IssuedAt.Format(time.RFC3339))
+	}
+	return payload, claims, nil
+}
+
+// openCommand verifies a signed one-off command and decodes its payload into out. Commands
+// must name this host and expire; their nonce is only used once the caller knows the
+// command is new, with claim.
+func (v *commandVerifier) openCommand(raw []byte, out interface{}) (commandClaims, error) {
+	payload, claims, err := v.open(raw)
+	if err != nil {
+		return claims, err
+	}
+	if claims.HostRid == "" {
+		return claims, errors.New("command does not name a host")
+	}
+	if claims.Nonce == "" {
+		return claims, errors.New("command has no nonce")
+	}
+	if claims.ExpiresAt == nil {
+		return claims, errors.New("command has no expires_at time")
+	}
+	if claims.ExpiresAt.Sub(claims.IssuedAt) > v.maxLifetime {
+		return claims, fmt.Errorf("command is valid for %s, longer than the allowed %s", claims.ExpiresAt.Sub(claims.IssuedAt), v.maxLifetime)
+	}
+	if time.Now().After(claims.ExpiresAt.Add(v.clockSkew)) {
+		return claims, fmt.Errorf("command expired at %s", claims.ExpiresAt.Format(time.RFC3339))
+	}
+	if err := json.Unmarshal(payload, out); err != nil {
+		return claims, fmt.Errorf("invalid signed payload: %w", err)
+	}
+	return claims, nil
+}
+
+// claim uses the nonce of a command opened with openCommand, so it is never accepted again
+func (v *commandVerifier) claim(claims commandClaims) error {
+	return useNonce(claims.Nonce, claims.ExpiresAt.Add(v.clockSkew))
+}
+
+// commandInbox remembers the requests of one poll endpoint between polls, since the server
+// keeps offering a request until its result is in
+type commandInbox struct {
+	// handled holds the request IDs accepted at the last poll, so each is acted on once
+	handled map[string]bool
+	// rejected holds the requests refused at the last poll, so each is reported once
+	rejected map[string]bool
+}
+
+// receiveCommands decodes the requests of one poll, verifying them when command signing is
+// enabled, and passes those not handled at the last poll to handle, until it returns false.
+// A request's nonce is only used once it is known to be new, so one the server offers
+// again is skipped rather than refused as a replay. Requests that cannot be decoded or
+// verified go to reject, once while the server keeps offering them.
+func receiveCommands[T any](inbox *commandInbox, verifier *commandVerifier, items []json.RawMessage, id func(T) string, reject func(json.RawMessage, error), handle func(T) bool) {
+	handled := make(map[string]bool)
+	rejected := make(map[string]bool)
+	defer func() { inbox.handled, inbox.rejected = handled, rejected }()
+
+	for _, item := range items {
+		var request T
+		var err error
+		if verifier == nil {
+			err = json.Unmarshal(item, &request)
+		} else {
+			var claims commandClaims
+			if claims, err = verifier.openCommand(item, &request); err == nil && !inbox.handled[id(request)] {
+				err = verifier.claim(claims)
+			}
+		}
+		if err != nil {
+			rejected[string(item)] = true
+			if !inbox.rejected[string(item)] {
+				reject(item, err)
+			}
+			continue
+		}
+		handled[id(request)] = true
+		if inbox.handled[id(request)] {
+			continue
+		}
+		if !handle(request) {
+			return
+		}
+	}
+}
+
+// openDocument verifies a signed document such as the remote configuration. Documents are
+// fetched again on every poll, so instead of a nonce their issue time guards against
+// replay: callers reject one issued before the document they applied last.
+func (v *commandVerifier) openDocument(raw []byte) (map[string]interface{}, time.Time, error) {
+	payload, claims, err := v.open(raw)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if claims.ExpiresAt != nil && time.Now().After(claims.ExpiresAt.Add(v.clockSkew)) {
+		return nil, time.Time{}, fmt.Errorf("document expired at %s", claims.ExpiresAt.Format(time.RFC3339))
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(payload, &document); err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid signed payload: %w", err)
+	}
+	for _, key := range claimKeys {
+		delete(document, key)
+	}
+	return document, claims.IssuedAt, nil
+}
+
+// unverifiedPayload returns what a command claims to be, signed or not, to describe a
+// rejected command in logs; none of it may be trusted
+func unverifiedPayload(raw []byte) []byte {
+	var envelope signedEnvelope
+	if err := json.Unmarshal(raw, &envelope); err == nil && envelope.Payload != "" {
+		if payload, err := base64.StdEncoding.DecodeString(envelope.Payload); err == nil {
+			return payload
+		}
+	}
+	return raw
+}
+
+// commandNonces are the nonces of accepted commands, with when each may be forgotten
+var commandNonces = struct {
+	sync.Mutex
+	loaded bool
+	m      map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+// useNonce accepts a nonce once until it expires. The nonce is saved before the command
+// runs; a nonce that cannot be saved rejects the command, since it could be replayed
+// after a restart.
+func useNonce(nonce string, until time.Time) error {
+	commandNonces.Lock()
+	defer commandNonces.Unlock()
+
+	if !commandNonces.loaded {
+		// A missing or corrupt file only loses nonces whose commands expire within
+		// max_lifetime
+		if data, err := os.ReadFile(commandNoncePath); err == nil {
+			json.Unmarshal(data, &commandNonces.m)
+		}
+		commandNonces.loaded = true
+	}
+	now := time.Now()
+	for seen, expires := range commandNonces.m {
+		if now.After(expires) {
+			delete(commandNonces.m, seen)
+		}
+	}
+	if _, ok := commandNonces.m[nonce]; ok {
+		return fmt.Errorf("nonce %s was already used", nonce)
+	}
+
+	commandNonces.m[nonce] = until
+	if err := saveNonces(); err != nil {
+		delete(commandNonces.m, nonce)
+		return err
+	}
+	return nil
+}
+
+// saveNonces writes the nonce store atomically; the caller holds commandNonces
+func saveNonces() error {
+	data, err := json.Marshal(commandNonces.m)
+	if err != nil {
+		return fmt.Errorf("failed to encode command nonces: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(commandNoncePath), 0755); err != nil {
+		return fmt.Errorf("failed to create nonce directory: %w", err)
+	}
+	tmp := commandNoncePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to save command nonces: %w", err)
+	}
+	if err := os.Rename(tmp, commandNoncePath); err != nil {
+		return fmt.Errorf("failed to save command nonces: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTempDir runs the test in a fresh directory, so the nonce store is written under it,
+// and starts with no nonces loaded
+func useTempDir(t *testing.T) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	resetNonces := func() {
+		commandNonces.Lock()
+		commandNonces.loaded, commandNonces.m = false, make(map[string]time.Time)
+		commandNonces.Unlock()
+	}
+	resetNonces()
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		resetNonces()
+	})
+	return dir
+}
+
+// signCommand wraps the claims and fields in an envelope signed with key
+func signCommand(t *testing.T, key ed25519.PrivateKey, fields map[string]interface{}) []byte {
+	t.Helper()
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(signedEnvelope{
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestOpenCommand(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+	verifier := &commandVerifier{
+		keys:        []ed25519.PublicKey{public},
+		hostRid:     "host-1",
+		clockSkew:   time.Minute,
+		maxLifetime: time.Hour,
+	}
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name string
+		key  ed25519.PrivateKey
+		// edit changes the claims of an otherwise valid command
+		edit func(fields map[string]interface{})
+		// raw replaces the signed command
+		raw  []byte
+		want string
+	}{
+		{name: "valid"},
+		{name: "unsigned", raw: []byte(`{"id":"r1"}`), want: "command is not signed"},
+		{name: "bad signature", key: other, want: "signature does not match any pinned key"},
+		{
+			name: "tampered payload",
+			raw: func() []byte {
+				var envelope signedEnvelope
+				json.Unmarshal(signCommand(t, private, map[string]interface{}{"id": "r1"}), &envelope)
+				envelope.Payload = base64.StdEncoding.EncodeToString([]byte(`{"id":"r2"}`))
+				raw, _ := json.Marshal(envelope)
+				return raw
+			}(),
+			want: "signature does not match any pinned key",
+		},
+		{name: "wrong host", edit: func(f map[string]interface{}) { f["host_rid"] = "host-2" }, want: "issued for host host-2"},
+		{name: "no host", edit: func(f map[string]interface{}) { delete(f, "host_rid") }, want: "does not name a host"},
+		{name: "no nonce", edit: func(f map[string]interface{}) { delete(f, "nonce") }, want: "has no nonce"},
+		{name: "no issued_at", edit: func(f map[string]interface{}) { delete(f, "issued_at") }, want: "has no issued_at"},
+		{name: "no expires_at", edit: func(f map[string]interface{}) { delete(f, "expires_at") }, want: "has no expires_at"},
+		{
+			name: "expired",
+			edit: func(f map[string]interface{}) {
+				f["issued_at"], f["expires_at"] = now.Add(-time.Hour), now.Add(-10*time.Minute)
+			},
+			want: "command expired",
+		},
+		{
+			name: "expired within clock skew",
+			edit: func(f map[string]interface{}) {
+				f["issued_at"], f["expires_at"] = now.Add(-time.Hour), now.Add(-30*time.Second)
+			},
+		},
+		{
+			name: "issued in the future",
+			edit: func(f map[string]interface{}) {
+				f["issued_at"], f["expires_at"] = now.Add(10*time.Minute), now.Add(20*time.Minute)
+			},
+			want: "issued in the future",
+		},
+		{
+			name: "issued ahead within clock skew",
+			edit: func(f map[string]interface{}) {
+				f["issued_at"], f["expires_at"] = now.Add(30*time.Second), now.Add(10*time.Minute)
+			},
+		},
+		{
+			name: "lifetime too long",
+			edit: func(f map[string]interface{}) { f["expires_at"] = now.Add(2 * time.Hour) },
+			want: "longer than the allowed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := tt.raw
+			if raw == nil {
+				fields := map[string]interface{}{
+					"id":         "r1",
+					"host_rid":   "host-1",
+					"nonce":      "nonce-" + tt.name,
+					"issued_at":  now,
+					"expires_at": now.Add(10 * time.Minute),
+				}
+				if tt.edit != nil {
+					tt.edit(fields)
+				}
+				key := private
+				if tt.key != nil {
+					key = tt.key
+				}
+				raw = signCommand(t, key, fields)
+			}
+
+			var request runbookRequest
+			_, err := verifier.openCommand(raw, &request)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("openCommand: %v", err)
+				}
+				if request.ID != "r1" {
+					t.Errorf("request ID = %q, want r1", request.ID)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("openCommand error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUseNonce(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup prepares the working directory and the nonces used before
+		setup func(t *testing.T)
+		want  string
+	}{
+		{name: "new nonce"},
+		{
+			name:  "reused nonce",
+			setup: func(t *testing.T) { useNonce("n1", time.Now().Add(time.Hour)) },
+			want:  "nonce n1 was already used",
+		},
+		{
+			name: "reused nonce after a restart",
+			setup: func(t *testing.T) {
+				data, _ := json.Marshal(map[string]time.Time{"n1": time.Now().Add(time.Hour)})
+				os.MkdirAll("data", 0755)
+				os.WriteFile(commandNoncePath, data, 0600)
+			},
+			want: "nonce n1 was already used",
+		},
+		{
+			name: "expired nonce is forgotten",
+			setup: func(t *testing.T) {
+				data, _ := json.Marshal(map[string]time.Time{"n1": time.Now().Add(-time.Minute)})
+				os.MkdirAll("data", 0755)
+				os.WriteFile(commandNoncePath, data, 0600)
+			},
+		},
+		{
+			name: "nonce store cannot be saved",
+			setup: func(t *testing.T) {
+				// A file where the data directory should be
+				os.WriteFile("data", nil, 0600)
+			},
+			want: "failed to create nonce directory",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempDir(t)
+			if tt.setup != nil {
+				tt.setup(t)
+			}
+
+			err := useNonce("n1", time.Now().Add(time.Hour))
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("useNonce: %v", err)
+				}
+				data, err := os.ReadFile(commandNoncePath)
+				if err != nil || !strings.Contains(string(data), `"n1"`) {
+					t.Fatalf("nonce store = %s, %v; want n1 saved", data, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("useNonce error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUseNonceNotSaved(t *testing.T) {
+	useTempDir(t)
+	os.WriteFile("data", nil, 0600)
+	if err := useNonce("n1", time.Now().Add(time.Hour)); err == nil {
+		t.Fatal("useNonce succeeded without a nonce store")
+	}
+
+	// A nonce that could not be saved was not used, so the command can run once the store
+	// is back
+	os.Remove("data")
+	if err := useNonce("n1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("useNonce after the store recovered: %v", err)
+	}
+}
+
+func TestReceiveCommands(t *testing.T) {
+	useTempDir(t)
+	public, private, _ := ed25519.GenerateKey(nil)
+	verifier := &commandVerifier{
+		keys:        []ed25519.PublicKey{public},
+		hostRid:     "host-1",
+		clockSkew:   time.Minute,
+		maxLifetime: time.Hour,
+	}
+	now := time.Now().UTC()
+	command := func(id, nonce string) json.RawMessage {
+		return signCommand(t, private, map[string]interface{}{
+			"id":         id,
+			"host_rid":   "host-1",
+			"nonce":      nonce,
+			"issued_at":  now,
+			"expires_at": now.Add(10 * time.Minute),
+		})
+	}
+
+	var inbox commandInbox
+	var handled, rejected []string
+	poll := func(items ...json.RawMessage) {
+		handled, rejected = nil, nil
+		receiveCommands(&inbox, verifier, items, runbookRequest.id, func(item json.RawMessage, err error) {
+			rejected = append(rejected, err.Error())
+		}, func(request runbookRequest) bool {
+			handled = append(handled, request.ID)
+			return true
+		})
+	}
+
+	poll(command("r1", "n1"))
+	if len(handled) != 1 || len(rejected) != 0 {
+		t.Fatalf("first poll handled %v, rejected %v; want r1 handled", handled, rejected)
+	}
+	// The server offers r1 until its result is in; it is neither run again nor refused as
+	// a replay
+	poll(command("r1", "n1"), command("r2", "n2"))
+	if len(handled) != 1 || handled[0] != "r2" || len(rejected) != 0 {
+		t.Fatalf("second poll handled %v, rejected %v; want only r2 handled", handled, rejected)
+	}
+	// A new request replaying a used nonce is refused, once while it is offered
+	poll(command("r3", "n1"))
+	if len(handled) != 0 || len(rejected) != 1 || !strings.Contains(rejected[0], "already used") {
+		t.Fatalf("replay handled %v, rejected %v; want it refused", handled, rejected)
+	}
+	poll(command("r3", "n1"))
+	if len(handled) != 0 || len(rejected) != 0 {
+		t.Fatalf("replay offered again handled %v, rejected %v; want it reported only once", handled, rejected)
+	}
+}
@@ -0,0 +1,346 @@
+//go:build !minimal && !no_compliance
+
+package services
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"sprinter-agent/internal/execwrap"
+)
+
+// Compliance check types
+const (
+	complianceCheckSSHD        = "sshd_option"
+	complianceCheckFileSetting = "file_setting"
+	complianceCheckMountOption = "mount_option"
+	complianceCheckSysctl      = "sysctl"
+	complianceCheckFileMode    = "file_mode"
+)
+
+// Compliance result statuses
+const (
+	complianceStatusPass          = "pass"
+	complianceStatusFail          = "fail"
+	complianceStatusError         = "error"
+	complianceStatusNotApplicable = "not_applicable"
+)
+
+// ComplianceRule is a single baseline check; bundled rules and rule files share this format
+type ComplianceRule struct {
+	ID       string `yaml:"id" json:"id"`
+	Title    string `yaml:"title" json:"title"`
+	Severity string `yaml:"severity" json:"severity"`
+	Check    string `yaml:"check" json:"check"`
+	Path     string `yaml:"path" json:"path,omitempty"`
+	Key      string `yaml:"key" json:"key,omitempty"`
+	// Operator compares the actual value to Expected: eq (default), ne, le, ge or in
+	Operator string `yaml:"operator" json:"operator,omitempty"`
+	Expected string `yaml:"expected" json:"expected"`
+	// Default is the value assumed when a setting is absent from its file
+	Default string `yaml:"default" json:"default,omitempty"`
+}
+
+// ComplianceResult is the outcome of one rule
+type ComplianceResult struct {
+	RuleID   string `json:"rule_id"`
+	Title    string `json:"title"`
+	Severity string `json:"severity"`
+	Status   string `json:"status"`
+	Actual   string `json:"actual,omitempty"`
+	Expected string `json:"expected"`
+	Message  string `json:"message,omitempty"`
+}
+
+// bundledComplianceRules is the built-in baseline, loosely following the CIS benchmarks
+var bundledComplianceRules = []ComplianceRule{
+	{ID: "ssh-root-login", Title: "SSH root login is disabled", Severity: "high", Check: complianceCheckSSHD, Path: "/etc/ssh/sshd_config", Key: "PermitRootLogin", Expected: "no", Default: "prohibit-password"},
+	{ID: "ssh-password-auth", Title: "SSH password authentication is disabled", Severity: "medium", Check: complianceCheckSSHD, Path: "/etc/ssh/sshd_config", Key: "PasswordAuthentication", Expected: "no", Default: "yes"},
+	{ID: "ssh-empty-passwords", Title: "SSH empty passwords are not permitted", Severity: "high", Check: complianceCheckSSHD, Path: "/etc/ssh/sshd_config", Key: "PermitEmptyPasswords", Expected: "no", Default: "no"},
+	{ID: "ssh-x11-forwarding", Title: "SSH X11 forwarding is disabled", Severity: "low", Check: complianceCheckSSHD, Path: "/etc/ssh/sshd_config", Key: "X11Forwarding", Expected: "no", Default: "no"},
+	{ID: "ssh-max-auth-tries", Title: "SSH MaxAuthTries is 4 or less", Severity: "medium", Check: complianceCheckSSHD, Path: "/etc/ssh/sshd_config", Key: "MaxAuthTries", Operator: "le", Expected: "4", Default: "6"},
+	{ID: "password-max-days", Title: "Password expiration is 365 days or less", Severity: "medium", Check: complianceCheckFileSetting, Path: "/etc/login.defs", Key: "PASS_MAX_DAYS", Operator: "le", Expected: "365", Default: "99999"},
+	{ID: "password-min-days", Title: "Minimum days between password changes is 1 or more", Severity: "low", Check: complianceCheckFileSetting, Path: "/etc/login.defs", Key: "PASS_MIN_DAYS", Operator: "ge", Expected: "1", Default: "0"},
+	{ID: "password-warn-age", Title: "Password expiration warning is 7 days or more", Severity: "low", Check: complianceCheckFileSetting, Path: "/etc/login.defs", Key: "PASS_WARN_AGE", Operator: "ge", Expected: "7", Default: "7"},
+	{ID: "mount-tmp-nodev", Title: "/tmp is mounted with nodev", Severity: "medium", Check: complianceCheckMountOption, Path: "/tmp", Expected: "nodev"},
+	{ID: "mount-tmp-nosuid", Title: "/tmp is mounted with nosuid", Severity: "medium", Check: complianceCheckMountOption, Path: "/tmp", Expected: "nosuid"},
+	{ID: "mount-tmp-noexec", Title: "/tmp is mounted with noexec", Severity: "medium", Check: complianceCheckMountOption, Path: "/tmp", Expected: "noexec"},
+	{ID: "mount-devshm-nodev", Title: "/dev/shm is mounted with nodev", Severity: "medium", Check: complianceCheckMountOption, Path: "/dev/shm", Expected: "nodev"},
+	{ID: "mount-devshm-nosuid", Title: "/dev/shm is mounted with nosuid", Severity: "medium", Check: complianceCheckMountOption, Path: "/dev/shm", Expected: "nosuid"},
+	{ID: "mount-devshm-noexec", Title: "/dev/shm is mounted with noexec", Severity: "medium", Check: complianceCheckMountOption, Path: "/dev/shm", Expected: "noexec"},
+	{ID: "sysctl-aslr", Title: "Address space layout randomisation is enabled", Severity: "high", Check: complianceCheckSysctl, Key: "kernel.randomize_va_space", Expected: "2"},
+	{ID: "sysctl-ip-forward", Title: "IP forwarding is disabled", Severity: "medium", Check: complianceCheckSysctl, Key: "net.ipv4.ip_forward", Expected: "0"},
+	{ID: "sysctl-syncookies", Title: "TCP SYN cookies are enabled", Severity: "medium", Check: complianceCheckSysctl, Key: "net.ipv4.tcp_syncookies", Expected: "1"},
+	{ID: "sysctl-accept-redirects", Title: "ICMP redirects are not accepted", Severity: "medium", Check: complianceCheckSysctl, Key: "net.ipv4.conf.all.accept_redirects", Expected: "0"},
+	{ID: "file-shadow-mode", Title: "/etc/shadow permissions are 0640 or stricter", Severity: "high", Check: complianceCheckFileMode, Path: "/etc/shadow", Expected: "0640"},
+	{ID: "file-passwd-mode", Title: "/etc/passwd permissions are 0644 or stricter", Severity: "medium", Check: complianceCheckFileMode, Path: "/etc/passwd", Expected: "0644"},
+	{ID: "file-sshd-config-mode", Title: "/etc/ssh/sshd_config permissions are 0600 or stricter", Severity: "medium", Check: complianceCheckFileMode, Path: "/etc/ssh/sshd_config", Expected: "0600"},
+}
+
+// loadComplianceRules returns the bundled rules merged with *.yaml rule files from dir;
+// a rule file entry with the ID of a bundled rule replaces it
+func loadComplianceRules(dir string, includeBundled bool) ([]ComplianceRule, error) {
+	rules := []ComplianceRule{}
+	index := make(map[string]int)
+	add := func(rule ComplianceRule) {
+		if i, ok := index[rule.ID]; ok {
+			rules[i] = rule
+			return
+		}
+		index[rule.ID] = len(rules)
+		rules = append(rules, rule)
+	}
+
+	if includeBundled {
+		for _, rule := range bundledComplianceRules {
+			add(rule)
+		}
+	}
+
+	if dir == "" {
+		return rules, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rule file %s: %w", path, err)
+		}
+		var fileRules []ComplianceRule
+		if err := yaml.Unmarshal(data, &fileRules); err != nil {
+			return nil, fmt.Errorf("failed to parse rule file %s: %w", path, err)
+		}
+		for _, rule := range fileRules {
+			if rule.ID == "" || rule.Check == "" {
+				return nil, fmt.Errorf("rule file %s: every rule needs an id and a check", path)
+			}
+			add(rule)
+		}
+	}
+
+	return rules, nil
+}
+
+// complianceEvaluator runs rules, caching inputs shared between rules
+type complianceEvaluator struct {
+	sshdConfig map[string]string
+	sshdLoaded bool
+	mounts     map[string][]string
+	mountsErr  error
+}
+
+// newComplianceEvaluator creates an evaluator for one compliance run
+func newComplianceEvaluator() *complianceEvaluator {
+	e := &complianceEvaluator{}
+	e.mounts, e.mountsErr = readMountOptions()
+	return e
+}
+
+// Evaluate runs a single rule
+func (e *complianceEvaluator) Evaluate(rule ComplianceRule) ComplianceResult {
+	result := ComplianceResult{
+		RuleID:   rule.ID,
+		Title:    rule.Title,
+		Severity: rule.Severity,
+		Expected: rule.Expected,
+	}
+
+	var actual string
+	var err error
+	switch rule.Check {
+	case complianceCheckSSHD:
+		actual, err = e.sshdOption(rule)
+	case complianceCheckFileSetting:
+		actual, err = readConfigSetting(rule.Path, rule.Key, rule.Default)
+	case complianceCheckSysctl:
+		actual, err = readSysctl(rule.Key)
+	case complianceCheckMountOption:
+		e.evaluateMount(rule, &result)
+		return result
+	case complianceCheckFileMode:
+		e.evaluateFileMode(rule, &result)
+		return result
+	default:
+		result.Status = complianceStatusError
+		result.Message = "unknown check type " + rule.Check
+		return result
+	}
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			result.Status = complianceStatusNotApplicable
+		} else {
+			result.Status = complianceStatusError
+		}
+		result.Message = err.Error()
+		return result
+	}
+
+	result.Actual = actual
+	if compareComplianceValue(actual, rule.Operator, rule.Expected) {
+		result.Status = complianceStatusPass
+	} else {
+		result.Status = complianceStatusFail
+	}
+	return result
+}
+
+// sshdOption reads an effective sshd setting, preferring `sshd -T` over parsing the file
+func (e *complianceEvaluator) sshdOption(rule ComplianceRule) (string, error) {
+	if !e.sshdLoaded {
+		e.sshdLoaded = true
+		// sshd -T needs root; without it the config file is parsed instead
+		if output, err := execwrap.Output(context.Background(), execwrap.Options{}, "sshd", "-T"); err == nil {
+			e.sshdConfig = parseSettings(string(output))
+		}
+	}
+	if e.sshdConfig != nil {
+		if value, ok := e.sshdConfig[strings.ToLower(rule.Key)]; ok {
+			return value, nil
+		}
+	}
+	return readConfigSetting(rule.Path, rule.Key, rule.Default)
+}
+
+// evaluateMount checks that a mount point is separately mounted with an option
+func (e *complianceEvaluator) evaluateMount(rule ComplianceRule, result *ComplianceResult) {
+	if e.mountsErr != nil {
+		result.Status = complianceStatusError
+		result.Message = e.mountsErr.Error()
+		return
+	}
+	options, ok := e.mounts[rule.Path]
+	if !ok {
+		result.Status = complianceStatusFail
+		result.Message = rule.Path + " is not a separate mount"
+		return
+	}
+	result.Actual = strings.Join(options, ",")
+	result.Status = complianceStatusFail
+	for _, option := range options {
+		if option == rule.Expected {
+			result.Status = complianceStatusPass
+			return
+		}
+	}
+}
+
+// evaluateFileMode checks that a file grants no permission bits beyond the expected mode
+func (e *complianceEvaluator) evaluateFileMode(rule ComplianceRule, result *ComplianceResult) {
+	info, err := os.Stat(hostFile(rule.Path))
+	if err != nil {
+		result.Status = complianceStatusNotApplicable
+		if !os.IsNotExist(err) {
+			result.Status = complianceStatusError
+		}
+		result.Message = err.Error()
+		return
+	}
+	allowed, err := strconv.ParseUint(rule.Expected, 8, 32)
+	if err != nil {
+		result.Status = complianceStatusError
+		result.Message = "invalid expected mode " + rule.Expected
+		return
+	}
+
+	mode := uint64(info.Mode().Perm())
+	result.Actual = fmt.Sprintf("%04o", mode)
+	if mode&^allowed == 0 {
+		result.Status = complianceStatusPass
+	} else {
+		result.Status = complianceStatusFail
+	}
+}
+
+// compareComplianceValue applies a rule operator to an actual value
+func compareComplianceValue(actual, operator, expected string) bool {
+	switch operator {
+	case "", "eq":
+		return strings.EqualFold(actual, expected)
+	case "ne":
+		return !strings.EqualFold(actual, expected)
+	case "in":
+		for _, option := range strings.Split(expected, ",") {
+			if strings.EqualFold(actual, strings.TrimSpace(option)) {
+				return true
+			}
+		}
+		return false
+	case "le", "ge":
+		a, errA := strconv.ParseFloat(actual, 64)
+		b, errB := strconv.ParseFloat(expected, 64)
+		if errA != nil || errB != nil {
+			return false
+		}
+		if operator == "le" {
+			return a <= b
+		}
+		return a >= b
+	default:
+		return false
+	}
+}
+
+// readConfigSetting reads a "Key value" setting from a file, falling back to def when absent
+func readConfigSetting(path, key, def string) (string, error) {
+	data, err := os.ReadFile(hostFile(path))
+	if err != nil {
+		return "", err
+	}
+	if value, ok := parseSettings(string(data))[strings.ToLower(key)]; ok {
+		return value, nil
+	}
+	if def != "" {
+		return def, nil
+	}
+	return "", fmt.Errorf("%s not set in %s", key, path)
+}
+
+// parseSettings parses whitespace separated "key value" lines; the first occurrence wins, as in sshd
+func parseSettings(content string) map[string]string {
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		key := strings.ToLower(fields[0])
+		if _, seen := settings[key]; !seen {
+			settings[key] = strings.Join(fields[1:], " ")
+		}
+	}
+	return settings
+}
+
+// readMountOptions maps mount points to their options from /proc/mounts
+func readMountOptions() (map[string][]string, error) {
+	data, err := os.ReadFile(hostProcSelf("mounts"))
+	if err != nil {
+		return nil, err
+	}
+	mounts := make(map[string][]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		mounts[fields[1]] = strings.Split(fields[3], ",")
+	}
+	return mounts, nil
+}
@@ -0,0 +1,156 @@
+//go:build !minimal && !no_compliance
+
+package services
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// ComplianceSummary counts results by status
+type ComplianceSummary struct {
+	Pass          int `json:"pass"`
+	Fail          int `json:"fail"`
+	Error         int `json:"error"`
+	NotApplicable int `json:"not_applicable"`
+}
+
+// ComplianceReport is the payload sent to the compliance endpoint
+type ComplianceReport struct {
+	CheckedAt time.Time          `json:"checked_at"`
+	Summary   ComplianceSummary  `json:"summary"`
+	Results   []ComplianceResult `json:"results"`
+}
+
+// ComplianceMonitorService runs baseline compliance checks and reports the results
+type ComplianceMonitorService struct {
+	config   *config.Config
+	hostRid  string
+	started  bool
+	stopChan chan bool
+}
+
+// NewComplianceMonitorService creates a new compliance monitor service
+func NewComplianceMonitorService(cfg *config.Config, hostRid string) *ComplianceMonitorService {
+	return &ComplianceMonitorService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+	}
+}
+
+// init registers the collector along with its bundled rules, unless built with no_compliance
+func init() {
+	registerCollector("compliance", func(m *CollectorManager, c *config.Config) Collector {
+		return NewComplianceMonitorService(c, m.hostRid)
+	})
+}
+
+// Start begins running compliance checks periodically
+func (s *ComplianceMonitorService) Start() error {
+	if !s.config.Compliance.Enabled {
+		log.Println("Compliance checks not enabled - skipping")
+		setCollectorStatus("compliance", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping compliance checks")
+		return nil
+	}
+
+	// Validate rule files up front so mistakes surface at startup
+	if _, err := loadComplianceRules(s.config.Compliance.RulesDir, !s.config.Compliance.DisableBundled); err != nil {
+		return err
+	}
+
+	s.started = true
+	go s.monitorLoop()
+
+	setCollectorStatus("compliance", CollectorRunning, "")
+	log.Printf("Compliance check service started for host RID: %s", s.hostRid)
+	return nil
+}
+
+// Stop stops the monitoring process
+func (s *ComplianceMonitorService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("Compliance check service stopped")
+	}
+}
+
+// monitorLoop runs the periodic check loop
+func (s *ComplianceMonitorService) monitorLoop() {
+	defer recoverPanic("compliance")
+	ticker := newCollectorTicker("compliance", s.config.Compliance.Interval)
+	defer ticker.Stop()
+
+	markProgress("compliance", s.config.Compliance.Interval)
+	// Run immediately on start
+	s.reportCompliance()
+	if finishedOnce("compliance") {
+		return
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reportCompliance()
+			markProgress("compliance", s.config.Compliance.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// reportCompliance evaluates all rules and reports the results to the API
+func (s *ComplianceMonitorService) reportCompliance() {
+	// Rules are reloaded every run so rule file edits apply without a restart
+	rules, err := loadComplianceRules(s.config.Compliance.RulesDir, !s.config.Compliance.DisableBundled)
+	if err != nil {
+		log.Printf("Failed to load compliance rules: %v", err)
+		return
+	}
+
+	skip := make(map[string]bool, len(s.config.Compliance.Skip))
+	for _, id := range s.config.Compliance.Skip {
+		skip[id] = true
+	}
+
+	evaluator := newComplianceEvaluator()
+	report := ComplianceReport{
+		CheckedAt: time.Now().UTC(),
+		Results:   make([]ComplianceResult, 0, len(rules)),
+	}
+	for _, rule := range rules {
+		if skip[rule.ID] {
+			continue
+		}
+		result := evaluator.Evaluate(rule)
+		switch result.Status {
+		case complianceStatusPass:
+			report.Summary.Pass++
+		case complianceStatusFail:
+			report.Summary.Fail++
+		case complianceStatusNotApplicable:
+			report.Summary.NotApplicable++
+		default:
+			report.Summary.Error++
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	ctx := context.Background()
+	if err := submitReport(ctx, s.config, http.MethodPut, hostPath(s.hostRid, "/compliance"), report); err != nil {
+		log.Printf("Failed to report compliance results: %v", err)
+		recordCollectorError("compliance", err)
+		return
+	}
+
+	log.Printf("Reported compliance results: %d pass, %d fail, %d error, %d not applicable",
+		report.Summary.Pass, report.Summary.Fail, report.Summary.Error, report.Summary.NotApplicable)
+}
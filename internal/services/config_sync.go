@@ -0,0 +1,230 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// ConfigSyncService pulls the host's configuration document from the server and applies
+// it to the running collectors
+type ConfigSyncService struct {
+	// local is the configuration loaded from disk; remote documents are always merged
+	// over it so removing a remote setting restores the local value
+	local    *config.Config
+	hostRid  string
+	manager  *CollectorManager
+	document *remoteDocument
+	// applied is the last document rolled out to this host, kept while a newer one is staged
+	applied *remoteDocument
+	// waiting is the rollout this host has not been reached by yet
+	waiting  string
+	stopChan chan bool
+	started  bool
+}
+
+// NewConfigSyncService creates a new config sync service
+func NewConfigSyncService(cfg *config.Config, hostRid string, manager *CollectorManager) *ConfigSyncService {
+	return &ConfigSyncService{
+		local:    cfg,
+		hostRid:  hostRid,
+		manager:  manager,
+		document: newRemoteDocument(hostPath(hostRid, "/config"), "remote_config"),
+		applied:  newRemoteDocument("", "remote_config_applied"),
+		stopChan: make(chan bool),
+	}
+}
+
+// Start applies the cached document, if any, and begins polling for changes
+func (s *ConfigSyncService) Start() error {
+	if !s.local.RemoteConfig.Enabled {
+		log.Println("Remote configuration not enabled - skipping")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping remote configuration")
+		return nil
+	}
+
+	// The last known remote config applies right away, even if the server is unreachable
+	s.apply(true)
+
+	s.started = true
+	go s.syncLoop()
+
+	log.Printf("Remote configuration sync started for host RID: %s", s.hostRid)
+	return nil
+}
+
+// Stop stops polling
+func (s *ConfigSyncService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("Remote configuration sync stopped")
+	}
+}
+
+// syncLoop polls the configuration document
+func (s *ConfigSyncService) syncLoop() {
+	defer recoverPanic("remote_config")
+	ticker := newReportTicker(s.local.RemoteConfig.Interval)
+	defer ticker.Stop()
+
+	// Run immediately on start
+	s.sync()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sync()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// sync fetches the document and applies it when it changed
+func (s *ConfigSyncService) sync() {
+	changed, err := s.document.Fetch(context.Background(), s.local)
+	if err != nil {
+		log.Printf("Failed to fetch remote configuration: %v", err)
+		return
+	}
+	// A staged rollout is re-evaluated on every poll since its deadline may have passed
+	if changed || s.waiting != "" {
+		s.apply(false)
+	}
+}
+
+// apply merges the fetched document over the local configuration and applies the result
+// when its rollout has reached this host; at startup a staged document falls back to the
+// last applied one. Documents fetched from the server are recorded in the remote action
+// log when applied or rejected; the cached one applied at startup was recorded already.
+func (s *ConfigSyncService) apply(startup bool) {
+	action := startRemoteAction(s.local, ActionApplyConfig)
+	action.RequestID = strings.Trim(s.document.ETag, `"`)
+	applied, err := s.applyFetched(startup, action)
+	if err != nil {
+		rejectRemoteConfig(err)
+	}
+	if startup || (!applied && err == nil) {
+		return
+	}
+	if err != nil {
+		action.reject(err)
+	} else {
+		action.finish(nil)
+	}
+}
+
+// applyFetched applies the fetched document, filling in the action's details, and reports
+// whether it was applied
+func (s *ConfigSyncService) applyFetched(startup bool, action *RemoteAction) (bool, error) {
+	remote, issuedAt, err := s.decode(s.document)
+	if err != nil || remote == nil {
+		return false, err
+	}
+	// A signed document older than the applied one is a replay of a superseded configuration
+	if _, appliedAt, err := s.decode(s.applied); err == nil && issuedAt.Before(appliedAt) {
+		return false, fmt.Errorf("document issued at %s is older than the applied one, issued at %s",
+			issuedAt.Format(time.RFC3339), appliedAt.Format(time.RFC3339))
+	}
+	action.Requester = extractRequester(remote)
+
+	rollout, err := extractRollout(remote)
+	if err != nil {
+		return false, err
+	}
+	if rollout != nil && !rollout.Eligible(s.hostRid, time.Now()) {
+		if s.waiting != rollout.ID {
+			log.Printf("Remote configuration rollout %s has not reached this host yet", rollout.ID)
+			s.waiting = rollout.ID
+		}
+		if startup {
+			s.applyPrevious()
+		}
+		return false, nil
+	}
+	s.waiting = ""
+
+	if rollout != nil {
+		action.RequestID = rollout.ID
+	}
+	action.Args = map[string]string{"keys": documentKeys(remote)}
+	if err := s.applyDocument(remote); err != nil {
+		return false, err
+	}
+	s.applied.Body = s.document.Body
+	if err := s.applied.save(); err != nil {
+		log.Printf("Warning: failed to save applied remote configuration: %v", err)
+	}
+	if rollout != nil {
+		log.Printf("Applied remote configuration rollout %s", rollout.ID)
+	} else {
+		log.Println("Applied remote configuration")
+	}
+	return true, nil
+}
+
+// applyPrevious applies the last document that was rolled out to this host
+func (s *ConfigSyncService) applyPrevious() {
+	remote, _, err := s.decode(s.applied)
+	if err != nil {
+		rejectRemoteConfig(err)
+		return
+	}
+	if remote == nil {
+		return
+	}
+	delete(remote, "rollout")
+	extractRequester(remote)
+	if err := s.applyDocument(remote); err != nil {
+		rejectRemoteConfig(err)
+		return
+	}
+	log.Println("Applied previously rolled out remote configuration")
+}
+
+// decode returns a cached document, or nil when nothing was fetched yet. With command
+// signing enabled the document must be signed by a pinned key, and the time it was issued
+// is returned as well.
+func (s *ConfigSyncService) decode(document *remoteDocument) (map[string]interface{}, time.Time, error) {
+	if document.Body == nil {
+		return nil, time.Time{}, nil
+	}
+	verifier, err := newCommandVerifier(s.local, s.hostRid)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if verifier == nil {
+		var remote map[string]interface{}
+		_, err := document.Decode(&remote)
+		return remote, time.Time{}, err
+	}
+	return verifier.openDocument(document.Body)
+}
+
+// applyDocument merges a document over the local configuration and restarts changed collectors
+func (s *ConfigSyncService) applyDocument(remote map[string]interface{}) error {
+	merged, ignored, err := config.ApplyRemote(s.local, remote)
+	if err != nil {
+		return err
+	}
+	if len(ignored) > 0 {
+		log.Printf("Remote configuration keys kept local: %s", strings.Join(ignored, ", "))
+	}
+
+	s.manager.Apply(merged)
+	return nil
+}
+
+// rejectRemoteConfig logs a remote configuration that cannot be applied and raises it as an
+// agent health event, since the host keeps running its previous configuration
+func rejectRemoteConfig(err error) {
+	log.Printf("Failed to apply remote configuration: %v", err)
+	raiseHealthEvent(healthConfigError, severityError, "remote_config", err.Error(), nil)
+}
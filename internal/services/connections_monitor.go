@@ -0,0 +1,210 @@
+//go:build !minimal && !no_connections
+
+package services
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// ConnectionEdge is an aggregated dependency between a local service and a remote endpoint
+type ConnectionEdge struct {
+	Process    string `json:"process"`
+	Unit       string `json:"unit,omitempty"`
+	Direction  string `json:"direction"`
+	LocalPort  int    `json:"local_port,omitempty"`
+	RemoteIP   string `json:"remote_ip"`
+	RemotePort int    `json:"remote_port,omitempty"`
+	Count      int    `json:"count"`
+}
+
+// ConnectionsReport is the payload sent to the connections endpoint
+type ConnectionsReport struct {
+	SampledAt  time.Time        `json:"sampled_at"`
+	TotalEdges int              `json:"total_edges"`
+	Edges      []ConnectionEdge `json:"edges"`
+}
+
+// ConnectionsMonitorService maps established TCP connections to their owning processes
+type ConnectionsMonitorService struct {
+	config   *config.Config
+	hostRid  string
+	stopChan chan bool
+}
+
+// NewConnectionsMonitorService creates a new connections monitor service
+func NewConnectionsMonitorService(cfg *config.Config, hostRid string) *ConnectionsMonitorService {
+	return &ConnectionsMonitorService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+	}
+}
+
+// init registers the collector, unless built with no_connections
+func init() {
+	registerCollector("connections", func(m *CollectorManager, c *config.Config) Collector {
+		return NewConnectionsMonitorService(c, m.hostRid)
+	})
+}
+
+// Start begins sampling connections and reporting them periodically
+func (s *ConnectionsMonitorService) Start() error {
+	if !s.config.Connections.Enabled {
+		log.Println("Connection mapping not enabled - skipping")
+		setCollectorStatus("connections", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping connection mapping")
+		return nil
+	}
+
+	go s.monitorLoop()
+
+	if isPrivileged() {
+		setCollectorStatus("connections", CollectorRunning, "")
+	} else {
+		setPermissionProblem("connections", CollectorDegraded, "not running as root: sockets of other users' processes are not attributed")
+	}
+	log.Printf("Connection mapping service started for host RID: %s", s.hostRid)
+	return nil
+}
+
+// Stop stops the monitoring process
+func (s *ConnectionsMonitorService) Stop() {
+	if s.config.Connections.Enabled && s.hostRid != "" {
+		close(s.stopChan)
+		log.Println("Connection mapping service stopped")
+	}
+}
+
+// monitorLoop runs the periodic sampling loop
+func (s *ConnectionsMonitorService) monitorLoop() {
+	defer recoverPanic("connections")
+	ticker := newCollectorTicker("connections", s.config.Connections.Interval)
+	defer ticker.Stop()
+
+	markProgress("connections", s.config.Connections.Interval)
+	// Run immediately on start
+	s.reportConnections()
+	if finishedOnce("connections") {
+		return
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reportConnections()
+			markProgress("connections", s.config.Connections.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// reportConnections samples connections and reports the dependency edges to the API
+func (s *ConnectionsMonitorService) reportConnections() {
+	edges, err := s.getConnectionEdges()
+	if err != nil {
+		log.Printf("Failed to read TCP connections: %v", err)
+		return
+	}
+
+	total := len(edges)
+	if limit := s.config.Connections.MaxEdges; limit > 0 && len(edges) > limit {
+		edges = edges[:limit]
+	}
+
+	reqBody := ConnectionsReport{
+		SampledAt:  time.Now().UTC(),
+		TotalEdges: total,
+		Edges:      edges,
+	}
+
+	ctx := context.Background()
+	if err := submitReport(ctx, s.config, http.MethodPut, hostPath(s.hostRid, "/connections"), reqBody); err != nil {
+		log.Printf("Failed to report connections: %v", err)
+		recordCollectorError("connections", err)
+		return
+	}
+
+	log.Printf("Reported %d of %d connection edges successfully", len(edges), total)
+}
+
+// getConnectionEdges aggregates established connections into edges, busiest first
+func (s *ConnectionsMonitorService) getConnectionEdges() ([]ConnectionEdge, error) {
+	sockets, err := readTCPSockets()
+	if err != nil {
+		return nil, err
+	}
+
+	// Connections whose local port is listening were accepted by this host
+	listening := make(map[int]bool)
+	for _, sock := range sockets {
+		if sock.State == tcpStateListen {
+			listening[sock.LocalPort] = true
+		}
+	}
+
+	owners := mapSocketInodes()
+
+	type edgeKey struct {
+		process, unit, direction, remoteIP string
+		localPort, remotePort              int
+	}
+	counts := make(map[edgeKey]int)
+
+	for _, sock := range sockets {
+		if sock.State != tcpStateEstablished || sock.RemoteIP.IsLoopback() {
+			continue
+		}
+
+		owner, ok := owners[sock.Inode]
+		if !ok {
+			owner = processInfo{Comm: "unknown"}
+		}
+
+		key := edgeKey{
+			process:  owner.Comm,
+			unit:     owner.Unit,
+			remoteIP: sock.RemoteIP.String(),
+		}
+		if listening[sock.LocalPort] {
+			// Inbound: the client's ephemeral port is noise, keep our service port
+			key.direction = "inbound"
+			key.localPort = sock.LocalPort
+		} else {
+			key.direction = "outbound"
+			key.remotePort = sock.RemotePort
+		}
+		counts[key]++
+	}
+
+	edges := make([]ConnectionEdge, 0, len(counts))
+	for key, count := range counts {
+		edges = append(edges, ConnectionEdge{
+			Process:    key.process,
+			Unit:       key.unit,
+			Direction:  key.direction,
+			LocalPort:  key.localPort,
+			RemoteIP:   key.remoteIP,
+			RemotePort: key.remotePort,
+			Count:      count,
+		})
+	}
+
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].Count != edges[j].Count {
+			return edges[i].Count > edges[j].Count
+		}
+		return edges[i].Process < edges[j].Process
+	})
+
+	return edges, nil
+}
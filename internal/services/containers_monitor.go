@@ -0,0 +1,447 @@
+//go:build !minimal && !no_containers
+
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/generated"
+)
+
+// Container is a system container on the host, reported as a child of it
+type Container struct {
+	Name string `json:"name"`
+	// Runtime is the service that registered the container with systemd-machined, such as
+	// "systemd-nspawn", or "lxc" for containers found by lxc-ls
+	Runtime   string   `json:"runtime"`
+	State     string   `json:"state"`
+	OS        string   `json:"os,omitempty"`
+	Version   string   `json:"version,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+	LeaderPID int      `json:"leader_pid,omitempty"`
+	Unit      string   `json:"unit,omitempty"`
+	// Resources and Tasks are read from the container's cgroup while it runs
+	Resources *CgroupUsage `json:"resources,omitempty"`
+	Tasks     uint64       `json:"tasks,omitempty"`
+	// Services are the systemd services inside the container, with containers.services
+	Services []generated.SystemdUnit `json:"services,omitempty"`
+	// ServicesError is why the services could not be listed
+	ServicesError string `json:"services_error,omitempty"`
+
+	// cgroup is the container's cgroup relative to the cgroup root
+	cgroup string
+}
+
+// ContainersReport is the payload sent to the containers endpoint. It replaces the previous
+// one, so a container that was removed disappears.
+type ContainersReport struct {
+	Containers []Container `json:"containers"`
+}
+
+// ContainersMonitorService reports the LXC and systemd-nspawn containers on the host, with
+// their resource usage and optionally their services, so a container host is not opaque
+type ContainersMonitorService struct {
+	config   *config.Config
+	hostRid  string
+	stopChan chan bool
+	started  bool
+	// lastUsage holds the previous cgroup sample of each container for the CPU percentage
+	// and I/O rates
+	lastUsage map[string]cgroupSample
+}
+
+// NewContainersMonitorService creates a new container monitor service
+func NewContainersMonitorService(cfg *config.Config, hostRid string) *ContainersMonitorService {
+	return &ContainersMonitorService{
+		config:    cfg,
+		hostRid:   hostRid,
+		stopChan:  make(chan bool),
+		lastUsage: make(map[string]cgroupSample),
+	}
+}
+
+// init registers the collector, unless built with no_containers
+func init() {
+	registerCollector("containers", func(m *CollectorManager, c *config.Config) Collector {
+		return NewContainersMonitorService(c, m.hostRid)
+	})
+}
+
+// Start begins reporting containers periodically
+func (s *ContainersMonitorService) Start() error {
+	if !s.config.Containers.Enabled {
+		log.Println("Container collector not enabled - skipping")
+		setCollectorStatus("containers", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping container collector")
+		return nil
+	}
+	if !commandAvailable("machinectl") && !commandAvailable("lxc-ls") {
+		log.Println("Neither machinectl nor lxc-ls found - skipping container collector")
+		setCollectorStatus("containers", CollectorSkipped, "neither machinectl nor lxc-ls found")
+		return nil
+	}
+
+	s.started = true
+	go s.monitorLoop()
+
+	setCollectorStatus("containers", CollectorRunning, "")
+	log.Println("Container collector started")
+	return nil
+}
+
+// Stop stops the collector
+func (s *ContainersMonitorService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("Container collector stopped")
+	}
+}
+
+// monitorLoop reports the containers at the configured interval
+func (s *ContainersMonitorService) monitorLoop() {
+	defer recoverPanic("containers")
+	ticker := newCollectorTicker("containers", s.config.Containers.Interval)
+	defer ticker.Stop()
+
+	markProgress("containers", s.config.Containers.Interval)
+	s.reportContainers()
+	if finishedOnce("containers") {
+		return
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reportContainers()
+			markProgress("containers", s.config.Containers.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// reportContainers lists the containers, reads their usage and reports them
+func (s *ContainersMonitorService) reportContainers() {
+	containers, err := s.listContainers()
+	if err != nil {
+		log.Printf("Failed to list containers: %v", err)
+		setCollectorStatus("containers", CollectorError, err.Error())
+		recordCollectorError("containers", err)
+		return
+	}
+
+	s.attachUsage(containers)
+	degraded := ""
+	if s.config.Containers.Services {
+		for i := range containers {
+			if containers[i].State != "running" {
+				continue
+			}
+			services, err := listContainerServices(containers[i])
+			if err != nil {
+				containers[i].ServicesError = err.Error()
+				if isPermissionError(err) {
+					degraded = "listing services inside containers needs root"
+				}
+				continue
+			}
+			containers[i].Services = services
+		}
+	}
+	if degraded != "" {
+		setPermissionProblem("containers", CollectorDegraded, degraded)
+	} else {
+		setCollectorStatus("containers", CollectorRunning, "")
+	}
+
+	report := ContainersReport{Containers: containers}
+	if err := submitReport(context.Background(), s.config, http.MethodPut, hostPath(s.hostRid, "/containers"), report); err != nil {
+		log.Printf("Failed to report containers: %v", err)
+		recordCollectorError("containers", err)
+	}
+}
+
+// listContainers merges the containers registered with systemd-machined and those lxc-ls
+// knows, skipping virtual machines and excluded names. A container registered with both is
+// reported once, as machined describes it.
+func (s *ContainersMonitorService) listContainers() ([]Container, error) {
+	containers := []Container{}
+	seen := make(map[string]bool)
+	var errs []error
+
+	if commandAvailable("machinectl") {
+		machines, err := listMachines()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, machine := range machines {
+			seen[machine.Name] = true
+			containers = append(containers, machine)
+		}
+	}
+	if commandAvailable("lxc-ls") {
+		lxc, err := listLXCContainers()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, container := range lxc {
+			if !seen[container.Name] {
+				containers = append(containers, container)
+			}
+		}
+	}
+	// One runtime failing still leaves the other's containers worth reporting
+	if len(containers) == 0 && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	kept := containers[:0]
+	for _, container := range containers {
+		if !s.excluded(container.Name) {
+			kept = append(kept, container)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].Name < kept[j].Name
+	})
+	return kept, nil
+}
+
+// excluded reports whether a container name matches containers.exclude
+func (s *ContainersMonitorService) excluded(name string) bool {
+	for _, pattern := range s.config.Containers.Exclude {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// attachUsage reads the cgroup of every running container
+func (s *ContainersMonitorService) attachUsage(containers []Container) {
+	// machined containers run in a unit, whose cgroup systemd knows
+	var units []string
+	for _, container := range containers {
+		if container.Unit != "" {
+			units = append(units, container.Unit)
+		}
+	}
+	if len(units) > 0 {
+		cgroups, err := getUnitCgroups(units)
+		if err != nil {
+			log.Printf("Failed to look up container cgroups: %v", err)
+		}
+		for i := range containers {
+			if path := cgroups[containers[i].Unit]; path != "" {
+				containers[i].cgroup = path
+			}
+		}
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool, len(containers))
+	for i := range containers {
+		container := &containers[i]
+		if container.cgroup == "" {
+			continue
+		}
+		usage, err := readCgroupUsage(container.cgroup)
+		if err != nil {
+			continue
+		}
+		if prev, ok := s.lastUsage[container.Name]; ok {
+			usage.applyRates(prev, now)
+		}
+		s.lastUsage[container.Name] = cgroupSample{usage: *usage, takenAt: now}
+		seen[container.Name] = true
+		container.Resources = usage
+		container.Tasks, _ = readUintFile(filepath.Join(hostFile(cgroupRoot), container.cgroup, "pids.current"))
+	}
+
+	for name := range s.lastUsage {
+		if !seen[name] {
+			delete(s.lastUsage, name)
+		}
+	}
+}
+
+// listMachines returns the containers registered with systemd-machined
+func listMachines() ([]Container, error) {
+	output, err := runContainerCommand("machinectl", "list", "--no-legend", "--no-pager")
+	if err != nil {
+		return nil, err
+	}
+	listed := parseMachineList(output)
+	if len(listed) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(listed))
+	for _, machine := range listed {
+		names = append(names, machine.Name)
+	}
+	args := append([]string{"show", "--property=Name,Class,Service,Unit,Leader,State", "--"}, names...)
+	output, err = runContainerCommand("machinectl", args...)
+	if err != nil {
+		return nil, err
+	}
+	shown := parsePropertyBlocks(output, "Name")
+
+	var containers []Container
+	for _, machine := range listed {
+		props := shown[machine.Name]
+		// Virtual machines registered by libvirt or qemu are not containers
+		if props["Class"] != "" && props["Class"] != "container" {
+			continue
+		}
+		if machine.Runtime = props["Service"]; machine.Runtime == "" {
+			machine.Runtime = "machined"
+		}
+		machine.Unit = props["Unit"]
+		machine.State = props["State"]
+		if machine.State == "" {
+			machine.State = "running"
+		}
+		machine.LeaderPID, _ = strconv.Atoi(props["Leader"])
+		containers = append(containers, machine)
+	}
+	return containers, nil
+}
+
+// parseMachineList parses machinectl list --no-legend, whose columns are MACHINE CLASS
+// SERVICE and, since systemd 246, OS VERSION ADDRESSES. Empty columns are shown as "-".
+func parseMachineList(output string) []Container {
+	var machines []Container
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		machine := Container{Name: fields[0]}
+		if len(fields) >= 5 {
+			machine.OS = dashEmpty(fields[3])
+			machine.Version = dashEmpty(fields[4])
+		}
+		// Further addresses are elided with an ellipsis
+		for _, address := range fields[min(len(fields), 5):] {
+			if address = strings.TrimRight(address, "…"); dashEmpty(address) != "" {
+				machine.Addresses = append(machine.Addresses, address)
+			}
+		}
+		machines = append(machines, machine)
+	}
+	return machines
+}
+
+// dashEmpty returns "" for the "-" that machinectl shows in empty columns
+func dashEmpty(value string) string {
+	if value == "-" {
+		return ""
+	}
+	return value
+}
+
+// parsePropertyBlocks parses the blank-line separated KEY=VALUE blocks of a show command,
+// keyed by the value of key
+func parsePropertyBlocks(output, key string) map[string]map[string]string {
+	result := make(map[string]map[string]string)
+	block := make(map[string]string)
+	flush := func() {
+		if id := block[key]; id != "" {
+			result[id] = block
+		}
+		block = make(map[string]string)
+	}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			flush()
+			continue
+		}
+		if name, value, ok := strings.Cut(line, "="); ok {
+			block[name] = value
+		}
+	}
+	flush()
+	return result
+}
+
+// listLXCContainers returns the containers lxc-ls knows, running or not
+func listLXCContainers() ([]Container, error) {
+	all, err := runContainerCommand("lxc-ls", "-1")
+	if err != nil {
+		return nil, err
+	}
+	active, err := runContainerCommand("lxc-ls", "-1", "--running")
+	if err != nil {
+		return nil, err
+	}
+	running := make(map[string]bool)
+	for _, name := range strings.Fields(active) {
+		running[name] = true
+	}
+
+	var containers []Container
+	for _, name := range strings.Fields(all) {
+		container := Container{Name: name, Runtime: "lxc", State: "stopped"}
+		if running[name] {
+			container.State = "running"
+			container.cgroup = lxcCgroup(name)
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+// lxcCgroup returns the cgroup of a running LXC container: lxc.payload.<name> since LXC 4,
+// lxc/<name> before. It is empty when neither exists.
+func lxcCgroup(name string) string {
+	for _, path := range []string{"lxc.payload." + name, filepath.Join("lxc", name)} {
+		if _, err := os.Stat(filepath.Join(hostFile(cgroupRoot), path)); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// listContainerServices lists the systemd services inside a running container. systemctl
+// reaches an nspawn container through machined, and an LXC container through lxc-attach.
+func listContainerServices(container Container) ([]generated.SystemdUnit, error) {
+	listArgs := []string{"list-units", "--type=service", "--no-pager", "--no-legend", "--plain"}
+	var output string
+	var err error
+	if container.Runtime == "lxc" {
+		output, err = runContainerCommand("lxc-attach", append([]string{"-n", container.Name, "--", "systemctl"}, listArgs...)...)
+	} else {
+		output, err = runContainerCommand("systemctl", append([]string{"-M", container.Name}, listArgs...)...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseSystemctlUnits(output), nil
+}
+
+// runContainerCommand runs a machinectl, lxc-ls or in-container systemctl command
+func runContainerCommand(name string, args ...string) (string, error) {
+	return runCollectorCommand("containers", nil, name, args...)
+}
+
+// commandAvailable reports whether a command is found in PATH
+func commandAvailable(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
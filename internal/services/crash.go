@@ -0,0 +1,139 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/logring"
+)
+
+// AgentVersion is the agent build version, set at build time with
+// -ldflags "-X sprinter-agent/internal/services.AgentVersion=..."
+var AgentVersion = "dev"
+
+const (
+	// crashDir holds crash reports until they are uploaded
+	crashDir = "data/crashes"
+	// maxCrashReports bounds how many reports are kept while the server is unreachable
+	maxCrashReports = 20
+)
+
+// CrashReport describes a panic in one of the agent's goroutines
+type CrashReport struct {
+	Component  string    `json:"component"`
+	Panic      string    `json:"panic"`
+	Stack      string    `json:"stack"`
+	Version    string    `json:"version"`
+	GoVersion  string    `json:"go_version"`
+	Platform   string    `json:"platform"`
+	OccurredAt time.Time `json:"occurred_at"`
+	// RecentLogs are the log lines leading up to the panic
+	RecentLogs []string `json:"recent_logs,omitempty"`
+}
+
+// recoverPanic is deferred at the top of every service goroutine and turns a panic into a
+// crash report. A collector that died this way is marked as errored and restarted by the
+// supervisor once it misses its iterations. Other components, which collectors depend on,
+// panic again after the report is saved, so systemd restarts the whole agent.
+func recoverPanic(component string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	report := CrashReport{
+		Component:  component,
+		Panic:      fmt.Sprint(r),
+		Stack:      string(debug.Stack()),
+		Version:    AgentVersion,
+		GoVersion:  runtime.Version(),
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+		OccurredAt: time.Now().UTC(),
+		RecentLogs: logring.Recent(),
+	}
+	log.Printf("Panic in %s: %v", component, r)
+	if err := saveCrashReport(report); err != nil {
+		log.Printf("Failed to save crash report: %v", err)
+	}
+
+	if _, ok := findCollectorSpec(component); !ok {
+		panic(r)
+	}
+	setCollectorStatus(component, CollectorError, "panic: "+report.Panic)
+}
+
+// saveCrashReport writes a crash report to disk, dropping the oldest beyond maxCrashReports
+func saveCrashReport(report CrashReport) error {
+	if err := os.MkdirAll(crashDir, 0700); err != nil {
+		return fmt.Errorf("failed to create crash directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode crash report: %w", err)
+	}
+	name := fmt.Sprintf("%s-%s.json", report.OccurredAt.Format("20060102T150405.000000000"), report.Component)
+	if err := os.WriteFile(filepath.Join(crashDir, name), data, 0600); err != nil {
+		return fmt.Errorf("failed to write crash report: %w", err)
+	}
+
+	paths := crashReportPaths()
+	for len(paths) > maxCrashReports {
+		os.Remove(paths[0])
+		paths = paths[1:]
+	}
+	return nil
+}
+
+// crashReportPaths lists the stored crash reports, oldest first
+func crashReportPaths() []string {
+	paths, _ := filepath.Glob(filepath.Join(crashDir, "*.json"))
+	sort.Strings(paths)
+	return paths
+}
+
+// UploadCrashReports sends crash reports left by earlier runs to the diagnostics endpoint
+// and removes those the server accepted
+func UploadCrashReports(cfg *config.Config, hostRid string) {
+	defer recoverPanic("crash_upload")
+
+	uploaded := 0
+	for _, path := range crashReportPaths() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Failed to read crash report %s: %v", path, err)
+			continue
+		}
+		var report CrashReport
+		if err := json.Unmarshal(data, &report); err != nil {
+			log.Printf("Discarding unreadable crash report %s: %v", path, err)
+			os.Remove(path)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err = sendJSON(ctx, cfg, http.MethodPost, hostPath(hostRid, "/diagnostics/crashes"), report, nil)
+		cancel()
+		if err != nil {
+			// Kept for the next start
+			log.Printf("Failed to upload crash report %s: %v", filepath.Base(path), err)
+			return
+		}
+		os.Remove(path)
+		uploaded++
+	}
+
+	if uploaded > 0 {
+		log.Printf("Uploaded %d crash reports from earlier runs", uploaded)
+	}
+}
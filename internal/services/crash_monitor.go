@@ -0,0 +1,392 @@
+//go:build !minimal && !no_crashes
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// crashCursorPath keeps the journal cursor of the last entry reported
+const crashCursorPath = "data/crash_cursor.json"
+
+// coredumpMessageID is the journal MESSAGE_ID of systemd-coredump's entries
+const coredumpMessageID = "fc2e22bc6ee647b6b90729ab34a250b1"
+
+// maxCrashJournalEntries bounds the journal entries read per interval
+const maxCrashJournalEntries = 5000
+
+// Crash kinds
+const (
+	crashKindOOM      = "oom_kill"
+	crashKindCoreDump = "core_dump"
+)
+
+// coreSignals names the signals that dump core
+var coreSignals = map[string]string{
+	"3": "SIGQUIT", "4": "SIGILL", "5": "SIGTRAP", "6": "SIGABRT", "7": "SIGBUS",
+	"8": "SIGFPE", "11": "SIGSEGV", "24": "SIGXCPU", "25": "SIGXFSZ", "31": "SIGSYS",
+}
+
+// CrashEvent is a process killed by the OOM killer or dumping core, attributed to the
+// systemd unit it ran in
+type CrashEvent struct {
+	EventID   string `json:"event_id"`
+	Kind      string `json:"kind"`
+	Unit      string `json:"unit,omitempty"`
+	Process   string `json:"process"`
+	PID       int    `json:"pid"`
+	Exe       string `json:"exe,omitempty"`
+	Signal    string `json:"signal,omitempty"`
+	Timestamp string `json:"timestamp"`
+	// Message says what happened in one line, e.g. "nginx.service was OOM killed"
+	Message     string       `json:"message"`
+	Memory      *CrashMemory `json:"memory,omitempty"`
+	Maintenance string       `json:"maintenance,omitempty"`
+	EventOccurrences
+}
+
+// CrashMemory is how much memory a crashed process used, and the limits of its unit
+type CrashMemory struct {
+	TotalVMKB  int64 `json:"total_vm_kb,omitempty"`
+	RSSKB      int64 `json:"rss_kb,omitempty"`
+	AnonRSSKB  int64 `json:"anon_rss_kb,omitempty"`
+	FileRSSKB  int64 `json:"file_rss_kb,omitempty"`
+	ShmemRSSKB int64 `json:"shmem_rss_kb,omitempty"`
+	// Constraint is CONSTRAINT_MEMCG when the process's cgroup hit its limit and
+	// CONSTRAINT_NONE when the whole system ran out of memory
+	Constraint string `json:"constraint,omitempty"`
+	// UnitMemoryMax and UnitMemoryHigh are the unit's MemoryMax and MemoryHigh in bytes,
+	// omitted when unlimited
+	UnitMemoryMax  int64 `json:"unit_memory_max_bytes,omitempty"`
+	UnitMemoryHigh int64 `json:"unit_memory_high_bytes,omitempty"`
+}
+
+// CrashEventsReport is the payload sent to the crash events endpoint
+type CrashEventsReport struct {
+	Events []CrashEvent `json:"events"`
+}
+
+// crashCursor is the position after the last journal entry reported
+type crashCursor struct {
+	Journal string `json:"journal"`
+}
+
+// CrashMonitorService reports OOM kills and core dumps from the journal, naming the unit
+// that lost a process
+type CrashMonitorService struct {
+	config  *config.Config
+	hostRid string
+	dedup   *eventDeduper[CrashEvent]
+	// cursor is the journal position after the last entry read, saved once its events
+	// are sent
+	cursor string
+	saved  string
+	// pending events failed to send and are resent with the next batch
+	pending []CrashEvent
+	// oomContexts holds the oom-kill lines waiting for their kill message, by PID
+	oomContexts map[int]oomContext
+	stopChan    chan bool
+	started     bool
+}
+
+// NewCrashMonitorService creates a new crash monitor service
+func NewCrashMonitorService(cfg *config.Config, hostRid string) *CrashMonitorService {
+	return &CrashMonitorService{
+		config:      cfg,
+		hostRid:     hostRid,
+		dedup:       newEventDeduper[CrashEvent](dedupWindow(cfg)),
+		oomContexts: make(map[int]oomContext),
+		stopChan:    make(chan bool),
+	}
+}
+
+// init registers the collector, unless built with no_crashes
+func init() {
+	registerCollector("crashes", func(m *CollectorManager, c *config.Config) Collector {
+		return NewCrashMonitorService(c, m.hostRid)
+	})
+}
+
+// Start begins watching the journal for crashes
+func (s *CrashMonitorService) Start() error {
+	if !s.config.Crashes.Enabled {
+		log.Println("Crash monitoring not enabled - skipping")
+		setCollectorStatus("crashes", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping crash monitoring")
+		return nil
+	}
+	if _, err := exec.LookPath("journalctl"); err != nil {
+		log.Println("journalctl not found - skipping crash monitoring")
+		setCollectorStatus("crashes", CollectorSkipped, "journalctl is not installed")
+		return nil
+	}
+
+	cursor, err := loadCrashCursor()
+	if err != nil {
+		log.Printf("Warning: failed to load crash cursor: %v", err)
+	}
+	s.cursor, s.saved = cursor, cursor
+
+	s.started = true
+	go s.monitorLoop()
+
+	setCollectorStatus("crashes", CollectorRunning, "")
+	log.Println("Crash monitoring started")
+	return nil
+}
+
+// Stop stops the monitoring process
+func (s *CrashMonitorService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("Crash monitoring stopped")
+	}
+}
+
+// monitorLoop reads the journal at the configured interval
+func (s *CrashMonitorService) monitorLoop() {
+	defer recoverPanic("crashes")
+	ticker := newCollectorTicker("crashes", s.config.Crashes.Interval)
+	defer ticker.Stop()
+
+	markProgress("crashes", s.config.Crashes.Interval)
+	for {
+		select {
+		case <-ticker.C:
+			s.forwardCrashes()
+			markProgress("crashes", s.config.Crashes.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// forwardCrashes reports the crashes logged since the last run
+func (s *CrashMonitorService) forwardCrashes() {
+	// Kernel messages carry OOM kills; systemd-coredump logs each core dump
+	entries, err := readJournal(s.cursor, maxCrashJournalEntries, "_TRANSPORT=kernel", "+", "MESSAGE_ID="+coredumpMessageID)
+	if err != nil {
+		log.Printf("Failed to read the journal: %v", err)
+		recordCollectorError("crashes", err)
+		return
+	}
+	setCollectorStatus("crashes", CollectorRunning, "")
+
+	now := time.Now()
+	events := s.pending
+	for _, entry := range entries {
+		s.cursor = entry.Field("__CURSOR")
+		event, ok := s.parseEntry(entry)
+		if !ok {
+			continue
+		}
+		if s.dedup.Observe(crashEventKey(event), event, now) {
+			events = append(events, event)
+		}
+	}
+	for _, summary := range s.dedup.Flush(now) {
+		event := summary.Event
+		event.EventOccurrences = summary.occurrences()
+		events = append(events, event)
+	}
+
+	if len(events) > 0 {
+		reqBody := CrashEventsReport{Events: events}
+		if err := submitReport(context.Background(), s.config, http.MethodPost, hostPath(s.hostRid, "/crash-events"), reqBody); err != nil {
+			log.Printf("Failed to report crashes (%d queued): %v", len(events), err)
+			recordCollectorError("crashes", err)
+			s.pending = retainEvents("crashes", events)
+			return
+		}
+		log.Printf("Reported %d crashes successfully", len(events))
+		s.pending = nil
+	}
+
+	if s.cursor != s.saved {
+		if err := saveCrashCursor(s.cursor); err != nil {
+			log.Printf("Warning: failed to save crash cursor: %v", err)
+			return
+		}
+		s.saved = s.cursor
+	}
+}
+
+// parseEntry turns a journal entry into a crash event when it reports one
+func (s *CrashMonitorService) parseEntry(entry journalEntry) (CrashEvent, bool) {
+	if entry.Field("MESSAGE_ID") == coredumpMessageID {
+		return s.coreDumpEvent(entry), true
+	}
+
+	message := entry.Field("MESSAGE")
+	// The oom-kill line comes first and names the victim's cgroup
+	if oom, ok := parseOOMContext(message); ok {
+		if len(s.oomContexts) >= 100 {
+			s.oomContexts = make(map[int]oomContext)
+		}
+		s.oomContexts[oom.PID] = oom
+		return CrashEvent{}, false
+	}
+	kill, ok := parseOOMKill(message)
+	if !ok {
+		return CrashEvent{}, false
+	}
+	oom := s.oomContexts[kill.PID]
+	delete(s.oomContexts, kill.PID)
+
+	event := CrashEvent{
+		Kind:    crashKindOOM,
+		Unit:    unitFromCgroup(oom.Cgroup),
+		Process: kill.Process,
+		PID:     kill.PID,
+		Signal:  "SIGKILL",
+		Memory: &CrashMemory{
+			TotalVMKB:  kill.Memory["total_vm"],
+			RSSKB:      kill.Memory["anon_rss"] + kill.Memory["file_rss"] + kill.Memory["shmem_rss"],
+			AnonRSSKB:  kill.Memory["anon_rss"],
+			FileRSSKB:  kill.Memory["file_rss"],
+			ShmemRSSKB: kill.Memory["shmem_rss"],
+			Constraint: oom.Constraint,
+		},
+	}
+	event.Message = fmt.Sprintf("%s was OOM killed", crashSubject(event))
+	s.finish(&event, entry, entry.Time())
+	return event, true
+}
+
+// coreDumpEvent describes a systemd-coredump entry
+func (s *CrashMonitorService) coreDumpEvent(entry journalEntry) CrashEvent {
+	event := CrashEvent{
+		Kind:    crashKindCoreDump,
+		Unit:    entry.Field("COREDUMP_UNIT"),
+		Process: entry.Field("COREDUMP_COMM"),
+		Exe:     entry.Field("COREDUMP_EXE"),
+		Signal:  entry.Field("COREDUMP_SIGNAL_NAME"),
+	}
+	event.PID, _ = strconv.Atoi(entry.Field("COREDUMP_PID"))
+	// The user manager's own unit is user@UID.service; the user unit is more telling
+	if userUnit := entry.Field("COREDUMP_USER_UNIT"); userUnit != "" {
+		event.Unit = userUnit
+	}
+	if event.Unit == "" {
+		event.Unit = unitFromCgroup(entry.Field("COREDUMP_CGROUP"))
+	}
+	if event.Signal == "" {
+		number := entry.Field("COREDUMP_SIGNAL")
+		if event.Signal = coreSignals[number]; event.Signal == "" && number != "" {
+			event.Signal = "signal " + number
+		}
+	}
+	if status := entry.Field("COREDUMP_PROC_STATUS"); status != "" {
+		event.Memory = &CrashMemory{
+			TotalVMKB: procStatusKB(status, "VmSize"),
+			RSSKB:     procStatusKB(status, "VmRSS"),
+			AnonRSSKB: procStatusKB(status, "RssAnon"),
+			FileRSSKB: procStatusKB(status, "RssFile"),
+		}
+	}
+	event.Message = fmt.Sprintf("%s dumped core", crashSubject(event))
+	if event.Signal != "" {
+		event.Message += " on " + event.Signal
+	}
+
+	at := entry.Time()
+	if usec, err := strconv.ParseInt(entry.Field("COREDUMP_TIMESTAMP"), 10, 64); err == nil {
+		at = time.UnixMicro(usec)
+	}
+	s.finish(&event, entry, at)
+	return event
+}
+
+// finish sets what every crash event has: its ID, time, maintenance window and the limits
+// of its unit
+func (s *CrashMonitorService) finish(event *CrashEvent, entry journalEntry, at time.Time) {
+	event.EventID = eventID("crash", entry.Field("__CURSOR"))
+	event.Timestamp = at.UTC().Format(time.RFC3339Nano)
+	event.Maintenance = maintenanceTag(at)
+	if event.Unit == "" {
+		return
+	}
+	limits, err := systemctlShow([]string{event.Unit}, []string{"Id", "MemoryMax", "MemoryHigh"})
+	if err != nil || limits[event.Unit] == nil {
+		return
+	}
+	if event.Memory == nil {
+		event.Memory = &CrashMemory{}
+	}
+	// Unlimited is "infinity", which leaves the fields out
+	event.Memory.UnitMemoryMax, _ = strconv.ParseInt(limits[event.Unit]["MemoryMax"], 10, 64)
+	event.Memory.UnitMemoryHigh, _ = strconv.ParseInt(limits[event.Unit]["MemoryHigh"], 10, 64)
+}
+
+// crashSubject names what crashed: the unit when known, else the process
+func crashSubject(event CrashEvent) string {
+	if event.Unit != "" {
+		return event.Unit
+	}
+	return fmt.Sprintf("%s (pid %d)", event.Process, event.PID)
+}
+
+// crashEventKey identifies repeated crashes of the same program in the same unit
+func crashEventKey(event CrashEvent) string {
+	return strings.Join([]string{event.Kind, event.Unit, event.Process, event.Signal}, "\x00")
+}
+
+// procStatusKB returns a "Name:  1234 kB" value from the contents of /proc/PID/status
+func procStatusKB(status, name string) int64 {
+	for _, line := range strings.Split(status, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || key != name {
+			continue
+		}
+		kb, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+		return kb
+	}
+	return 0
+}
+
+// loadCrashCursor loads the journal cursor of the last entry reported
+func loadCrashCursor() (string, error) {
+	data, err := os.ReadFile(crashCursorPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read crash cursor file: %w", err)
+	}
+	var cursor crashCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return "", fmt.Errorf("failed to parse crash cursor file: %w", err)
+	}
+	return cursor.Journal, nil
+}
+
+// saveCrashCursor saves the journal cursor of the last entry reported
+func saveCrashCursor(journal string) error {
+	data, err := json.Marshal(crashCursor{Journal: journal})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(crashCursorPath), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	if err := os.WriteFile(crashCursorPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write crash cursor file: %w", err)
+	}
+	return nil
+}
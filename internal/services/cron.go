@@ -0,0 +1,157 @@
+package services
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five-field cron expression
+type cronSchedule struct {
+	minutes  [60]bool
+	hours    [24]bool
+	days     [32]bool
+	months   [13]bool
+	weekdays [7]bool
+	// domStar and dowStar track unrestricted fields for the cron day-matching rule
+	domStar bool
+	dowStar bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronDayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// parseCronSchedule parses a cron expression or macro such as @daily
+func parseCronSchedule(expr string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	s := &cronSchedule{
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+	if err := parseCronField(fields[0], 0, 59, nil, s.minutes[:]); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if err := parseCronField(fields[1], 0, 23, nil, s.hours[:]); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if err := parseCronField(fields[2], 1, 31, nil, s.days[:]); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if err := parseCronField(fields[3], 1, 12, cronMonthNames, s.months[:]); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+
+	// Day of week allows 7 as an alias for Sunday
+	var weekdays [8]bool
+	if err := parseCronField(fields[4], 0, 7, cronDayNames, weekdays[:]); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	copy(s.weekdays[:], weekdays[:7])
+	s.weekdays[0] = s.weekdays[0] || weekdays[7]
+
+	return s, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps into set
+func parseCronField(field string, lowest, highest int, names map[string]int, set []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		low, high := lowest, highest
+		if rangePart != "*" {
+			lowStr, highStr, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = parseCronValue(lowStr, names); err != nil {
+				return err
+			}
+			high = low
+			if isRange {
+				if high, err = parseCronValue(highStr, names); err != nil {
+					return err
+				}
+			} else if hasStep {
+				// "5/15" means starting at 5 through the maximum
+				high = highest
+			}
+		}
+
+		if low < lowest || high > highest || low > high {
+			return fmt.Errorf("value out of range in %q", part)
+		}
+		for v := low; v <= high; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+// parseCronValue parses a number or a month/day name
+func parseCronValue(value string, names map[string]int) (int, error) {
+	if n, ok := names[strings.ToLower(value)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	return n, nil
+}
+
+// matches reports whether the schedule fires at the given minute
+func (s *cronSchedule) matches(t time.Time) bool {
+	if !s.minutes[t.Minute()] || !s.hours[t.Hour()] || !s.months[int(t.Month())] {
+		return false
+	}
+
+	dom := s.days[t.Day()]
+	dow := s.weekdays[int(t.Weekday())]
+	// When both day fields are restricted, cron runs if either matches
+	if !s.domStar && !s.dowStar {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// previous returns the latest fire time at or before t, searching back at most lookback
+func (s *cronSchedule) previous(t time.Time, lookback time.Duration) (time.Time, bool) {
+	t = t.Truncate(time.Minute)
+	limit := t.Add(-lookback)
+	for ; !t.Before(limit); t = t.Add(-time.Minute) {
+		if s.matches(t) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,470 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// customMetricsRoute is where applications on the host post their metrics and events
+const customMetricsRoute = "/api/v1/custom-metrics"
+
+// Limits on what an application may push
+const (
+	maxCustomPushBytes     = 1 << 20
+	maxCustomNameLength    = 200
+	maxCustomLabels        = 20
+	maxCustomLabelLength   = 256
+	maxCustomMessageLength = 4096
+	// customMaxAge and customMaxSkew bound the timestamps applications may give, so a
+	// stale or wrong clock cannot file samples far from when they were pushed
+	customMaxAge  = time.Hour
+	customMaxSkew = 5 * time.Minute
+)
+
+var (
+	customNamePattern  = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:.]*$`)
+	customLabelPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// CustomMetric is a metric pushed by an application on the host
+type CustomMetric struct {
+	Name string `json:"name"`
+	// Type is "gauge" or "counter"
+	Type      string            `json:"type"`
+	Value     float64           `json:"value"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+	// Source is the application that pushed the metric, as it named itself
+	Source string `json:"source,omitempty"`
+}
+
+// CustomEvent is an event pushed by an application on the host
+type CustomEvent struct {
+	EventID string `json:"event_id"`
+	Name    string `json:"name"`
+	// Severity is "info", "warning", "error" or "critical"
+	Severity    string            `json:"severity"`
+	Message     string            `json:"message,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Source      string            `json:"source,omitempty"`
+	Maintenance string            `json:"maintenance,omitempty"`
+}
+
+// customPush is the body applications post. Value is a pointer so a missing value is
+// told apart from zero.
+type customPush struct {
+	Source  string `json:"source"`
+	Metrics []struct {
+		Name      string            `json:"name"`
+		Type      string            `json:"type"`
+		Value     *float64          `json:"value"`
+		Labels    map[string]string `json:"labels"`
+		Timestamp time.Time         `json:"timestamp"`
+	} `json:"metrics"`
+	Events []struct {
+		Name      string            `json:"name"`
+		Severity  string            `json:"severity"`
+		Message   string            `json:"message"`
+		Labels    map[string]string `json:"labels"`
+		Timestamp time.Time         `json:"timestamp"`
+	} `json:"events"`
+}
+
+// CustomMetricsReport is what the agent forwards, tagged with the host it runs on
+type CustomMetricsReport struct {
+	HostRID string         `json:"host_rid"`
+	Metrics []CustomMetric `json:"metrics"`
+	Events  []CustomEvent  `json:"events"`
+}
+
+// CustomMetricsStats are counters of pushed metrics and events, reported in self-metrics
+type CustomMetricsStats struct {
+	Accepted uint64 `json:"accepted"`
+	// Rejected counts pushes refused as invalid or unauthorized
+	Rejected    uint64 `json:"rejected"`
+	RateLimited uint64 `json:"rate_limited"`
+	// Dropped counts metrics and events lost because the queue was full
+	Dropped uint64 `json:"dropped"`
+}
+
+var customMetricsStats struct {
+	active                                   atomic.Bool
+	accepted, rejected, rateLimited, dropped atomic.Uint64
+}
+
+// currentCustomMetricsStats returns the push counters, or nil when the API is not running
+func currentCustomMetricsStats() *CustomMetricsStats {
+	if !customMetricsStats.active.Load() {
+		return nil
+	}
+	return &CustomMetricsStats{
+		Accepted:    customMetricsStats.accepted.Load(),
+		Rejected:    customMetricsStats.rejected.Load(),
+		RateLimited: customMetricsStats.rateLimited.Load(),
+		Dropped:     customMetricsStats.dropped.Load(),
+	}
+}
+
+// CustomMetricsService accepts metrics and events from applications on the host over a
+// loopback HTTP API and forwards them with the agent's own reports, so the agent is the
+// host's single way out to the server
+type CustomMetricsService struct {
+	config   *config.Config
+	hostRid  string
+	server   *http.Server
+	limiter  *tokenBucket
+	stopChan chan bool
+	done     chan struct{}
+
+	mu      sync.Mutex
+	metrics []CustomMetric
+	events  []CustomEvent
+}
+
+// NewCustomMetricsService creates a new custom metrics service
+func NewCustomMetricsService(cfg *config.Config, hostRid string) *CustomMetricsService {
+	return &CustomMetricsService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start listens for pushes and forwards what is accepted every interval
+func (s *CustomMetricsService) Start() error {
+	if !s.config.CustomMetrics.Enabled {
+		log.Println("Custom metrics API not enabled - skipping")
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", s.config.CustomMetrics.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.config.CustomMetrics.Listen, err)
+	}
+	s.limiter = newTokenBucket(s.config.CustomMetrics.RateLimit)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(customMetricsRoute, s.handlePush)
+	s.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+	}
+	go s.serve(listener)
+	go s.forwardLoop()
+	customMetricsStats.active.Store(true)
+
+	log.Printf("Custom metrics API listening on http://%s%s", listener.Addr(), customMetricsRoute)
+	return nil
+}
+
+// serve runs the server until it is shut down
+func (s *CustomMetricsService) serve(listener net.Listener) {
+	defer recoverPanic("custom metrics")
+	if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Custom metrics server failed: %v", err)
+	}
+}
+
+// Stop stops accepting pushes and forwards what is still queued
+func (s *CustomMetricsService) Stop() {
+	if s.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s.server.Shutdown(ctx)
+	close(s.stopChan)
+	<-s.done
+	customMetricsStats.active.Store(false)
+	log.Println("Custom metrics API stopped")
+}
+
+// forwardLoop forwards the queued metrics and events every interval
+func (s *CustomMetricsService) forwardLoop() {
+	defer close(s.done)
+	defer recoverPanic("custom metrics")
+	ticker := newReportTicker(s.config.CustomMetrics.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.forward()
+		case <-s.stopChan:
+			s.forward()
+			return
+		}
+	}
+}
+
+// forward sends the queued metrics and events, keeping them for the next attempt when the
+// server cannot be reached
+func (s *CustomMetricsService) forward() {
+	s.mu.Lock()
+	report := CustomMetricsReport{HostRID: s.hostRid, Metrics: s.metrics, Events: s.events}
+	s.metrics, s.events = nil, nil
+	s.mu.Unlock()
+	if len(report.Metrics) == 0 && len(report.Events) == 0 {
+		return
+	}
+	if report.Metrics == nil {
+		report.Metrics = []CustomMetric{}
+	}
+	if report.Events == nil {
+		report.Events = []CustomEvent{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiRequestTimeout)
+	err := submitReport(ctx, s.config, http.MethodPost, hostPath(s.hostRid, "/custom-metrics"), report)
+	cancel()
+
+	var statusErr *apiStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		// Servers without custom metrics would only fill the queue
+		log.Printf("Server does not accept custom metrics, dropped %d metrics and %d events", len(report.Metrics), len(report.Events))
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to forward custom metrics (%d metrics and %d events queued): %v", len(report.Metrics), len(report.Events), err)
+		s.mu.Lock()
+		s.metrics = append(report.Metrics, s.metrics...)
+		s.events = append(report.Events, s.events...)
+		s.trimQueueLocked()
+		s.mu.Unlock()
+		return
+	}
+	log.Printf("Forwarded %d custom metrics and %d events successfully", len(report.Metrics), len(report.Events))
+}
+
+// trimQueueLocked drops the oldest queued metrics and events beyond max_queued. The caller
+// holds s.mu.
+func (s *CustomMetricsService) trimQueueLocked() {
+	capacity := s.config.CustomMetrics.MaxQueued
+	dropped := 0
+	if excess := len(s.metrics) + len(s.events) - capacity; excess > 0 {
+		// Metrics are superseded by later samples, so they go before events
+		n := min(excess, len(s.metrics))
+		s.metrics = s.metrics[n:]
+		s.events = s.events[excess-n:]
+		dropped = excess
+	}
+	if dropped > 0 {
+		customMetricsStats.dropped.Add(uint64(dropped))
+		log.Printf("Warning: custom metrics queue is full, dropped the %d oldest", dropped)
+		raiseHealthEvent(healthQueueOverflow, severityError, "custom metrics", "custom metrics and events dropped while the server was unreachable", map[string]interface{}{
+			"dropped":  dropped,
+			"capacity": capacity,
+		})
+	}
+}
+
+// handlePush validates a push, rate-limits it and queues it whole, or refuses it whole
+func (s *CustomMetricsService) handlePush(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err != nil || !net.ParseIP(host).IsLoopback() {
+		customMetricsStats.rejected.Add(1)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if token := s.config.CustomMetrics.Token; token != "" {
+		given := []byte(req.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(given, []byte("Bearer "+token)) != 1 {
+			customMetricsStats.rejected.Add(1)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	// Browsers cannot send JSON cross-origin without a preflight, which is never answered,
+	// so a web page cannot push through the user's browser
+	if mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		customMetricsStats.rejected.Add(1)
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var push customPush
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxCustomPushBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&push); err != nil {
+		customMetricsStats.rejected.Add(1)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writePushError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("body exceeds %d bytes", maxCustomPushBytes), nil)
+			return
+		}
+		writePushError(w, http.StatusBadRequest, "invalid JSON: "+err.Error(), nil)
+		return
+	}
+
+	metrics, events, problems := validatePush(push, time.Now())
+	if len(problems) > 0 {
+		customMetricsStats.rejected.Add(1)
+		writePushError(w, http.StatusBadRequest, "invalid push", problems)
+		return
+	}
+	count := len(metrics) + len(events)
+	if count > s.config.CustomMetrics.RateLimit {
+		customMetricsStats.rejected.Add(1)
+		writePushError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("a push may hold at most %d metrics and events", s.config.CustomMetrics.RateLimit), nil)
+		return
+	}
+	if !s.limiter.AllowN(count) {
+		customMetricsStats.rateLimited.Add(1)
+		// Long enough for the bucket to refill by the size of the push
+		retry := math.Ceil(float64(count) * 60 / float64(s.config.CustomMetrics.RateLimit))
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry)))
+		writePushError(w, http.StatusTooManyRequests, "rate limit exceeded", nil)
+		return
+	}
+
+	s.mu.Lock()
+	s.metrics = append(s.metrics, metrics...)
+	s.events = append(s.events, events...)
+	s.trimQueueLocked()
+	s.mu.Unlock()
+	customMetricsStats.accepted.Add(uint64(count))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"accepted": count})
+}
+
+// writePushError answers a refused push with the reason and what was wrong with it
+func writePushError(w http.ResponseWriter, status int, message string, problems []string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error    string   `json:"error"`
+		Problems []string `json:"problems,omitempty"`
+	}{message, problems})
+}
+
+// validatePush checks every metric and event of a push and fills in their defaults. A
+// push with any problem is refused whole, so an application never has to work out which
+// part was taken.
+func validatePush(push customPush, now time.Time) ([]CustomMetric, []CustomEvent, []string) {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if len(push.Metrics) == 0 && len(push.Events) == 0 {
+		add("push holds no metrics or events")
+	}
+	if len(push.Source) > maxCustomLabelLength {
+		add("source: longer than %d characters", maxCustomLabelLength)
+	}
+	checkTimestamp := func(path string, timestamp time.Time) time.Time {
+		if timestamp.IsZero() {
+			return now.UTC()
+		}
+		if timestamp.Before(now.Add(-customMaxAge)) || timestamp.After(now.Add(customMaxSkew)) {
+			add("%s.timestamp: must be within %s before and %s after the host's clock", path, customMaxAge, customMaxSkew)
+		}
+		return timestamp.UTC()
+	}
+
+	metrics := make([]CustomMetric, 0, len(push.Metrics))
+	for i, pushed := range push.Metrics {
+		path := fmt.Sprintf("metrics[%d]", i)
+		checkCustomName(path, pushed.Name, add)
+		checkCustomLabels(path, pushed.Labels, add)
+		metric := CustomMetric{Name: pushed.Name, Type: pushed.Type, Labels: pushed.Labels, Source: push.Source}
+		switch pushed.Type {
+		case "":
+			metric.Type = "gauge"
+		case "gauge", "counter":
+		default:
+			add("%s.type: expected gauge or counter, got %q", path, pushed.Type)
+		}
+		if pushed.Value == nil {
+			add("%s.value: is required", path)
+		} else {
+			metric.Value = *pushed.Value
+			if metric.Type == "counter" && metric.Value < 0 {
+				add("%s.value: a counter must not be negative", path)
+			}
+		}
+		metric.Timestamp = checkTimestamp(path, pushed.Timestamp)
+		metrics = append(metrics, metric)
+	}
+
+	events := make([]CustomEvent, 0, len(push.Events))
+	for i, pushed := range push.Events {
+		path := fmt.Sprintf("events[%d]", i)
+		checkCustomName(path, pushed.Name, add)
+		checkCustomLabels(path, pushed.Labels, add)
+		event := CustomEvent{Name: pushed.Name, Severity: pushed.Severity, Message: pushed.Message, Labels: pushed.Labels, Source: push.Source}
+		switch pushed.Severity {
+		case "":
+			event.Severity = "info"
+		case "info", "warning", "error", "critical":
+		default:
+			add("%s.severity: expected info, warning, error or critical, got %q", path, pushed.Severity)
+		}
+		if len(pushed.Message) > maxCustomMessageLength {
+			add("%s.message: longer than %d characters", path, maxCustomMessageLength)
+		}
+		event.Timestamp = checkTimestamp(path, pushed.Timestamp)
+		event.Maintenance = maintenanceTag(event.Timestamp)
+		event.EventID = eventID("custom", push.Source, event.Name, event.Message, event.Timestamp.Format(time.RFC3339Nano))
+		events = append(events, event)
+	}
+	return metrics, events, problems
+}
+
+// checkCustomName checks the name of a pushed metric or event
+func checkCustomName(path, name string, add func(format string, args ...interface{})) {
+	switch {
+	case name == "":
+		add("%s.name: is required", path)
+	case len(name) > maxCustomNameLength:
+		add("%s.name: longer than %d characters", path, maxCustomNameLength)
+	case !customNamePattern.MatchString(name):
+		add("%s.name: %q must start with a letter, '_' or ':' and hold only letters, digits, '_', ':' and '.'", path, name)
+	}
+}
+
+// checkCustomLabels checks the labels of a pushed metric or event
+func checkCustomLabels(path string, labels map[string]string, add func(format string, args ...interface{})) {
+	if len(labels) > maxCustomLabels {
+		add("%s.labels: more than %d labels", path, maxCustomLabels)
+		return
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := labels[key]
+		if !customLabelPattern.MatchString(key) || len(key) > maxCustomNameLength {
+			add("%s.labels: invalid label name %q", path, key)
+		}
+		if len(value) > maxCustomLabelLength {
+			add("%s.labels.%s: longer than %d characters", path, key, maxCustomLabelLength)
+		}
+	}
+}
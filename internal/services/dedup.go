@@ -0,0 +1,115 @@
+package services
+
+import (
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// EventOccurrences summarizes identical events that were coalesced into one
+type EventOccurrences struct {
+	Occurrences int    `json:"occurrences,omitempty"`
+	FirstSeen   string `json:"first_seen,omitempty"`
+	LastSeen    string `json:"last_seen,omitempty"`
+}
+
+// eventDeduper coalesces identical events. The first event for a key is sent
+// immediately; repeats within the window are only counted and sent as one
+// summary when the window ends, so a flapping source costs two events per window.
+type eventDeduper[T any] struct {
+	window  time.Duration
+	entries map[string]*dedupEntry[T]
+	ready   []dedupSummary[T]
+}
+
+// dedupEntry tracks one key's current window
+type dedupEntry[T any] struct {
+	event   T
+	sentAt  time.Time
+	repeats int
+	first   time.Time
+	last    time.Time
+}
+
+// dedupSummary is the latest of a run of suppressed repeats with their count and time range
+type dedupSummary[T any] struct {
+	Event T
+	Count int
+	First time.Time
+	Last  time.Time
+}
+
+// dedupWindow returns the configured deduplication window, or zero when disabled
+func dedupWindow(cfg *config.Config) time.Duration {
+	if !cfg.EventDedup.Enabled {
+		return 0
+	}
+	return cfg.EventDedup.Window
+}
+
+// newEventDeduper creates a deduper; a zero window disables deduplication
+func newEventDeduper[T any](window time.Duration) *eventDeduper[T] {
+	return &eventDeduper[T]{
+		window:  window,
+		entries: make(map[string]*dedupEntry[T]),
+	}
+}
+
+// Observe records an event and reports whether it should be sent now
+func (d *eventDeduper[T]) Observe(key string, event T, at time.Time) bool {
+	if d.window <= 0 {
+		return true
+	}
+
+	if entry, ok := d.entries[key]; ok {
+		if at.Sub(entry.sentAt) < d.window {
+			if entry.repeats == 0 {
+				entry.first = at
+			}
+			entry.repeats++
+			entry.last = at
+			entry.event = event
+			return false
+		}
+		d.expire(key, entry)
+	}
+
+	d.entries[key] = &dedupEntry[T]{event: event, sentAt: at}
+	return true
+}
+
+// Flush returns a summary for every window that has ended with suppressed repeats
+func (d *eventDeduper[T]) Flush(now time.Time) []dedupSummary[T] {
+	for key, entry := range d.entries {
+		if now.Sub(entry.sentAt) >= d.window {
+			d.expire(key, entry)
+		}
+	}
+
+	summaries := d.ready
+	d.ready = nil
+	return summaries
+}
+
+// expire ends a key's window, queueing a summary of its repeats
+func (d *eventDeduper[T]) expire(key string, entry *dedupEntry[T]) {
+	delete(d.entries, key)
+	if entry.repeats == 0 {
+		return
+	}
+	d.ready = append(d.ready, dedupSummary[T]{
+		Event: entry.event,
+		Count: entry.repeats,
+		First: entry.first,
+		Last:  entry.last,
+	})
+}
+
+// occurrences describes the summarized repeats for an event payload
+func (s dedupSummary[T]) occurrences() EventOccurrences {
+	return EventOccurrences{
+		Occurrences: s.Count,
+		FirstSeen:   s.First.UTC().Format(time.RFC3339),
+		LastSeen:    s.Last.UTC().Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !windows
+
+package services
+
+import "fmt"
+
+// diskFreeBytes is only implemented on Linux, Windows and macOS
+func diskFreeBytes(path string) (uint64, error) {
+	return 0, fmt.Errorf("free space not supported on this platform")
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"sprinter-agent/internal/cbor"
+	"sprinter-agent/internal/config"
+)
+
+// Payload encodings for reports
+const (
+	encodingJSON = "json"
+	encodingCBOR = "cbor"
+	// encodingAuto switches to CBOR once the server advertises it in Accept-Post
+	encodingAuto = "auto"
+)
+
+// serverEncoding is what the server told the agent about the payload encodings it accepts
+var serverEncoding = struct {
+	sync.Mutex
+	cborAdvertised bool
+	cborRejected   bool
+}{}
+
+// useCBOR reports whether request bodies are sent as CBOR. JSON stays in use after the
+// server rejected CBOR with 415 Unsupported Media Type.
+func useCBOR(cfg *config.Config) bool {
+	serverEncoding.Lock()
+	defer serverEncoding.Unlock()
+	if serverEncoding.cborRejected {
+		return false
+	}
+	switch cfg.Reporting.Encoding {
+	case encodingCBOR:
+		return true
+	case encodingAuto:
+		return serverEncoding.cborAdvertised
+	default:
+		return false
+	}
+}
+
+// observeAcceptPost records whether the media types a response's Accept-Post header lists
+// include CBOR
+func observeAcceptPost(header string) {
+	if header == "" {
+		return
+	}
+	advertised := false
+	for _, mediaType := range strings.Split(header, ",") {
+		mediaType, _, _ = strings.Cut(mediaType, ";")
+		if strings.EqualFold(strings.TrimSpace(mediaType), cbor.ContentType) {
+			advertised = true
+		}
+	}
+
+	serverEncoding.Lock()
+	defer serverEncoding.Unlock()
+	if advertised && !serverEncoding.cborAdvertised && !serverEncoding.cborRejected {
+		log.Println("Server accepts CBOR payloads")
+	}
+	serverEncoding.cborAdvertised = advertised
+}
+
+// rejectCBOR falls back to JSON for the rest of the run after the server refused CBOR
+func rejectCBOR() {
+	serverEncoding.Lock()
+	defer serverEncoding.Unlock()
+	if !serverEncoding.cborRejected {
+		log.Println("Warning: server does not accept CBOR payloads, sending JSON")
+	}
+	serverEncoding.cborRejected = true
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// budgetExempt lists collectors whose failures do not count against the error budget:
+// remote_hosts fails an iteration whenever one of its devices is unreachable, and backing
+// off would delay polling the others
+var budgetExempt = map[string]bool{
+	"remote_hosts": true,
+}
+
+// errorBudget tracks consecutive failed iterations per collector. A collector that fails
+// max_failures iterations in a row retries only every backoff interval, with a single
+// agent health event instead of an error every iteration, until an iteration succeeds.
+var errorBudget = struct {
+	sync.Mutex
+	// maxFailures is zero while the error budget is disabled
+	maxFailures int
+	backoff     time.Duration
+	collectors  map[string]*budgetState
+}{collectors: make(map[string]*budgetState)}
+
+// budgetState is a collector's standing against its error budget
+type budgetState struct {
+	// starting is set until the loop's first markProgress, which opens the first
+	// iteration rather than completing one
+	starting      bool
+	failed        bool
+	failuresInRow int
+	backedOff     bool
+}
+
+// configureErrorBudget applies the error budget configuration
+func configureErrorBudget(cfg *config.Config) {
+	errorBudget.Lock()
+	defer errorBudget.Unlock()
+	errorBudget.maxFailures = 0
+	if cfg.ErrorBudget.Enabled {
+		errorBudget.maxFailures = cfg.ErrorBudget.MaxFailures
+	}
+	errorBudget.backoff = cfg.ErrorBudget.BackoffInterval
+}
+
+// budgetFor returns a collector's error budget state, creating it on first use
+func budgetFor(name string) *budgetState {
+	state, ok := errorBudget.collectors[name]
+	if !ok {
+		state = &budgetState{}
+		errorBudget.collectors[name] = state
+	}
+	return state
+}
+
+// startErrorBudgetLoop notes that a collector loop is starting
+func startErrorBudgetLoop(name string) {
+	errorBudget.Lock()
+	defer errorBudget.Unlock()
+	budgetFor(name).starting = true
+}
+
+// chargeErrorBudget records a failure in a collector's current iteration, backing the
+// collector off when it has failed too many iterations in a row
+func chargeErrorBudget(name string, err error) {
+	if budgetExempt[name] {
+		return
+	}
+	errorBudget.Lock()
+	state := budgetFor(name)
+	if state.failed {
+		errorBudget.Unlock()
+		return
+	}
+	state.failed = true
+	state.failuresInRow++
+	if errorBudget.maxFailures == 0 || state.backedOff || state.failuresInRow < errorBudget.maxFailures {
+		errorBudget.Unlock()
+		return
+	}
+
+	state.backedOff = true
+	failures, backoff := state.failuresInRow, errorBudget.backoff
+	errorBudget.Unlock()
+
+	log.Printf("Warning: %s failed %d iterations in a row, retrying every %s until it succeeds", name, failures, backoff)
+	serverBackpressure.rescaleCollector(name)
+	raiseHealthEvent(healthCollectorBackedOff, severityError, name, fmt.Sprintf("%d consecutive failures: %v", failures, err), map[string]interface{}{
+		"consecutive_failures": failures,
+		"retry_interval":       backoff.String(),
+	})
+}
+
+// settleErrorBudget completes a collector iteration; one without failures restores a
+// backed-off collector's interval
+func settleErrorBudget(name string) {
+	errorBudget.Lock()
+	state := budgetFor(name)
+	if state.starting {
+		state.starting = false
+		errorBudget.Unlock()
+		return
+	}
+	failed := state.failed
+	state.failed = false
+	if failed {
+		errorBudget.Unlock()
+		return
+	}
+	state.failuresInRow = 0
+	recovered := state.backedOff
+	state.backedOff = false
+	errorBudget.Unlock()
+
+	if recovered {
+		log.Printf("%s succeeded again, back to its normal interval", name)
+		serverBackpressure.rescaleCollector(name)
+	}
+}
+
+// resetErrorBudget gives a collector a fresh error budget, for instance after its
+// configuration changed
+func resetErrorBudget(name string) {
+	errorBudget.Lock()
+	defer errorBudget.Unlock()
+	delete(errorBudget.collectors, name)
+}
+
+// collectorBackoff returns the interval a backed-off collector retries at
+func collectorBackoff(name string) (time.Duration, bool) {
+	errorBudget.Lock()
+	defer errorBudget.Unlock()
+	state, ok := errorBudget.collectors[name]
+	if !ok || !state.backedOff {
+		return 0, false
+	}
+	return errorBudget.backoff, true
+}
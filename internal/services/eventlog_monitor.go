@@ -0,0 +1,330 @@
+//go:build !minimal && !no_eventlog
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// errEventLogUnsupported is returned where there is no Windows event log
+var errEventLogUnsupported = errors.New("the Windows event log is only available on Windows")
+
+// LogEntry is a log line or event shipped to the logs endpoint
+type LogEntry struct {
+	EventID   string            `json:"event_id"`
+	Timestamp time.Time         `json:"timestamp"`
+	Source    string            `json:"source"`
+	Channel   string            `json:"channel"`
+	Provider  string            `json:"provider"`
+	Code      int               `json:"code"`
+	Level     string            `json:"level"`
+	RecordID  int64             `json:"record_id"`
+	Computer  string            `json:"computer,omitempty"`
+	Keywords  []string          `json:"keywords,omitempty"`
+	Message   string            `json:"message"`
+	Data      map[string]string `json:"data,omitempty"`
+}
+
+// LogsRequest is the payload sent to the logs endpoint
+type LogsRequest struct {
+	Entries []LogEntry `json:"entries"`
+}
+
+// EventLogMonitorService forwards Windows event log entries to the logs endpoint. Each
+// channel is read with its XPath filter; the last record ID sent per channel is kept on
+// disk, so entries are neither lost nor sent twice across restarts.
+type EventLogMonitorService struct {
+	config   *config.Config
+	hostRid  string
+	cursors  map[string]int64
+	stopChan chan bool
+	started  bool
+}
+
+// NewEventLogMonitorService creates a new event log monitor service
+func NewEventLogMonitorService(cfg *config.Config, hostRid string) *EventLogMonitorService {
+	return &EventLogMonitorService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+	}
+}
+
+// init registers the collector; it only collects on Windows but reports its status everywhere
+func init() {
+	registerCollector("eventlog", func(m *CollectorManager, c *config.Config) Collector {
+		return NewEventLogMonitorService(c, m.hostRid)
+	})
+}
+
+// Start begins forwarding event log entries
+func (s *EventLogMonitorService) Start() error {
+	if !s.config.EventLog.Enabled {
+		log.Println("Event log monitoring not enabled - skipping")
+		setCollectorStatus("eventlog", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping event log monitoring")
+		return nil
+	}
+	if err := checkEventLogAccess(); err != nil {
+		setCollectorStatus("eventlog", CollectorSkipped, err.Error())
+		log.Printf("Event log monitoring skipped: %v", err)
+		return nil
+	}
+
+	cursors, err := s.loadCursors()
+	if err != nil {
+		log.Printf("Warning: failed to load event log cursors: %v", err)
+	}
+	s.cursors = cursors
+
+	go s.monitorLoop()
+	s.started = true
+
+	setCollectorStatus("eventlog", CollectorRunning, "")
+	log.Printf("Event log monitoring started for %d channels", len(s.config.EventLog.Channels))
+	return nil
+}
+
+// Stop stops the monitoring process
+func (s *EventLogMonitorService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		s.started = false
+		log.Println("Event log monitoring stopped")
+	}
+}
+
+// monitorLoop runs the periodic collection loop
+func (s *EventLogMonitorService) monitorLoop() {
+	defer recoverPanic("eventlog")
+	ticker := newCollectorTicker("eventlog", s.config.EventLog.Interval)
+	defer ticker.Stop()
+
+	markProgress("eventlog", s.config.EventLog.Interval)
+	s.reportEvents()
+	if finishedOnce("eventlog") {
+		return
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reportEvents()
+			markProgress("eventlog", s.config.EventLog.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// reportEvents sends the entries written to every channel since the previous report
+func (s *EventLogMonitorService) reportEvents() {
+	entries := []LogEntry{}
+	cursors := make(map[string]int64, len(s.cursors))
+	for channel, id := range s.cursors {
+		cursors[channel] = id
+	}
+
+	for _, channel := range s.config.EventLog.Channels {
+		events, err := queryEventLog(channel.Name, channel.Query, s.config.EventLog.MaxEvents)
+		if err != nil {
+			log.Printf("Failed to read event log channel %s: %v", channel.Name, err)
+			continue
+		}
+
+		last, seen := cursors[channel.Name]
+		maxID := last
+		for _, event := range events {
+			if event.RecordID > maxID {
+				maxID = event.RecordID
+			}
+			// A channel read for the first time starts at its newest entry, like a tailed file
+			if seen && event.RecordID > last {
+				entries = append(entries, event)
+			}
+		}
+		// Cleared logs restart their record IDs
+		if seen && len(events) > 0 && events[len(events)-1].RecordID < last {
+			log.Printf("Event log channel %s was cleared, starting over", channel.Name)
+			entries = append(entries, events...)
+			maxID = events[len(events)-1].RecordID
+		}
+		if seen && len(events) > 0 && len(events) == s.config.EventLog.MaxEvents && events[0].RecordID > last+1 {
+			log.Printf("Warning: more than %d entries written to %s since the last report, some were skipped", s.config.EventLog.MaxEvents, channel.Name)
+		}
+		cursors[channel.Name] = maxID
+	}
+
+	if len(entries) > 0 {
+		ctx := context.Background()
+		if err := submitReport(ctx, s.config, http.MethodPost, hostPath(s.hostRid, "/logs"), LogsRequest{Entries: entries}); err != nil {
+			// The cursors stay put, so the entries are read and sent again next time
+			log.Printf("Failed to report event log entries: %v", err)
+			recordCollectorError("eventlog", err)
+			return
+		}
+		log.Printf("Reported %d event log entries successfully", len(entries))
+	}
+
+	// Only advance the cursors once the server has accepted the entries
+	s.cursors = cursors
+	if err := s.saveCursors(cursors); err != nil {
+		log.Printf("Warning: failed to save event log cursors: %v", err)
+	}
+}
+
+// getCursorPath returns the path of the file holding the last record ID per channel
+func (s *EventLogMonitorService) getCursorPath() string {
+	return filepath.Join("data", "eventlog_cursors.json")
+}
+
+// loadCursors loads the last reported record ID per channel from disk
+func (s *EventLogMonitorService) loadCursors() (map[string]int64, error) {
+	cursors := make(map[string]int64)
+	data, err := os.ReadFile(s.getCursorPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cursors, nil
+		}
+		return cursors, fmt.Errorf("failed to read event log cursor file: %w", err)
+	}
+	if err := json.Unmarshal(data, &cursors); err != nil {
+		return make(map[string]int64), fmt.Errorf("failed to parse event log cursor file: %w", err)
+	}
+	return cursors, nil
+}
+
+// saveCursors saves the last reported record ID per channel to disk
+func (s *EventLogMonitorService) saveCursors(cursors map[string]int64) error {
+	data, err := json.Marshal(cursors)
+	if err != nil {
+		return err
+	}
+	cursorPath := s.getCursorPath()
+	if err := os.MkdirAll(filepath.Dir(cursorPath), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	if err := os.WriteFile(cursorPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write event log cursor file: %w", err)
+	}
+	return nil
+}
+
+// eventXML is an event rendered as XML by the event log
+type eventXML struct {
+	System struct {
+		Provider struct {
+			Name string `xml:"Name,attr"`
+		} `xml:"Provider"`
+		EventID     int `xml:"EventID"`
+		Level       int `xml:"Level"`
+		TimeCreated struct {
+			SystemTime string `xml:"SystemTime,attr"`
+		} `xml:"TimeCreated"`
+		EventRecordID int64  `xml:"EventRecordID"`
+		Channel       string `xml:"Channel"`
+		Computer      string `xml:"Computer"`
+	} `xml:"System"`
+	EventData struct {
+		Data []struct {
+			Name  string `xml:"Name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"Data"`
+	} `xml:"EventData"`
+	RenderingInfo struct {
+		Message  string   `xml:"Message"`
+		Keywords []string `xml:"Keywords>Keyword"`
+	} `xml:"RenderingInfo"`
+}
+
+// parseEventXML parses a stream of rendered events into log entries ordered by record ID
+func parseEventXML(r io.Reader) ([]LogEntry, error) {
+	decoder := xml.NewDecoder(r)
+	entries := []LogEntry{}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entries, fmt.Errorf("failed to parse event XML: %w", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "Event" {
+			continue
+		}
+
+		var event eventXML
+		if err := decoder.DecodeElement(&event, &start); err != nil {
+			return entries, fmt.Errorf("failed to parse event XML: %w", err)
+		}
+		entries = append(entries, event.logEntry())
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].RecordID < entries[j].RecordID })
+	return entries, nil
+}
+
+// logEntry converts a rendered event to a log entry
+func (e *eventXML) logEntry() LogEntry {
+	system := e.System
+	timestamp, _ := time.Parse(time.RFC3339Nano, system.TimeCreated.SystemTime)
+	entry := LogEntry{
+		EventID:   eventID("eventlog", system.Channel, strconv.FormatInt(system.EventRecordID, 10)),
+		Timestamp: timestamp.UTC(),
+		Source:    "eventlog",
+		Channel:   system.Channel,
+		Provider:  system.Provider.Name,
+		Code:      system.EventID,
+		Level:     eventLevel(system.Level),
+		RecordID:  system.EventRecordID,
+		Computer:  system.Computer,
+		Keywords:  e.RenderingInfo.Keywords,
+		Message:   strings.TrimSpace(e.RenderingInfo.Message),
+	}
+	for i, data := range e.EventData.Data {
+		if entry.Data == nil {
+			entry.Data = make(map[string]string)
+		}
+		name := data.Name
+		if name == "" {
+			name = "param" + strconv.Itoa(i+1)
+		}
+		entry.Data[name] = data.Value
+	}
+	return entry
+}
+
+// eventLevel names an event level the way journald priorities are named
+func eventLevel(level int) string {
+	switch level {
+	case 1:
+		return "critical"
+	case 2:
+		return "error"
+	case 3:
+		return "warning"
+	case 5:
+		return "debug"
+	default:
+		// 0 (log always) is used by the Security channel for audit events
+		return "info"
+	}
+}
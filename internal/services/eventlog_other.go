@@ -0,0 +1,13 @@
+//go:build !windows && !minimal && !no_eventlog
+
+package services
+
+// checkEventLogAccess fails outside Windows, which has no event log
+func checkEventLogAccess() error {
+	return errEventLogUnsupported
+}
+
+// queryEventLog is only supported on Windows
+func queryEventLog(channel, query string, maxEvents int) ([]LogEntry, error) {
+	return nil, errEventLogUnsupported
+}
@@ -0,0 +1,36 @@
+//go:build !minimal && !no_eventlog
+
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+
+	"sprinter-agent/internal/execwrap"
+)
+
+// checkEventLogAccess verifies wevtutil is available to query the event log
+func checkEventLogAccess() error {
+	if _, err := exec.LookPath("wevtutil"); err != nil {
+		return fmt.Errorf("wevtutil not found in PATH: %w", err)
+	}
+	return nil
+}
+
+// queryEventLog returns the newest entries of a channel matching the XPath query, at most
+// maxEvents, ordered by record ID. Reading the Security channel needs an administrator
+// or membership in Event Log Readers.
+func queryEventLog(channel, query string, maxEvents int) ([]LogEntry, error) {
+	args := []string{"qe", channel, "/f:RenderedXml", "/rd:true", "/c:" + strconv.Itoa(maxEvents)}
+	if query != "" {
+		args = append(args, "/q:"+query)
+	}
+	output, err := execwrap.Output(context.Background(), execwrap.Options{}, "wevtutil", args...)
+	if err != nil {
+		return nil, err
+	}
+	return parseEventXML(bytes.NewReader(output))
+}
@@ -0,0 +1,392 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/execwrap"
+)
+
+// ActionRetrieveFile is the remote action of uploading a file
+const ActionRetrieveFile = "retrieve_file"
+
+// localRequester stands in for the server in the action log when the CLI asked for a file
+// over the control socket
+const localRequester = "local"
+
+// redactedFileValue replaces what the redaction rules match
+const redactedFileValue = "REDACTED"
+
+// fileRequest is a file the server asks for
+type fileRequest struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	// RequestedBy is the user or automation that asked for the file
+	RequestedBy string `json:"requested_by,omitempty"`
+}
+
+// FileArtifact is a retrieved file, uploaded to the server as a diagnostic artifact. A
+// refused or failed retrieval is uploaded too, with Error set and no content.
+type FileArtifact struct {
+	RequestID string `json:"request_id,omitempty"`
+	// Path is the path asked for and ResolvedPath the file read, after symlinks
+	Path         string    `json:"path"`
+	ResolvedPath string    `json:"resolved_path,omitempty"`
+	RetrievedAt  time.Time `json:"retrieved_at"`
+	Size         int64     `json:"size"`
+	Mode         string    `json:"mode,omitempty"`
+	ModTime      time.Time `json:"mod_time,omitempty"`
+	// SHA256 is the digest of the file on disk, before redaction
+	SHA256 string `json:"sha256,omitempty"`
+	// Content is the file after redaction, base64-encoded in JSON
+	Content []byte `json:"content,omitempty"`
+	// Redactions counts the replacements made by the redaction rules
+	Redactions int    `json:"redactions,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// FileRetrievalService uploads allowlisted files requested by the server or the CLI
+type FileRetrievalService struct {
+	config   *config.Config
+	hostRid  string
+	stopChan chan bool
+	started  bool
+	redact   []*regexp.Regexp
+
+	// requests remembers the file requests between polls
+	requests commandInbox
+}
+
+// NewFileRetrievalService creates a new file retrieval service
+func NewFileRetrievalService(cfg *config.Config, hostRid string) *FileRetrievalService {
+	s := &FileRetrievalService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+	}
+	// The patterns were checked when the configuration was loaded
+	for _, pattern := range cfg.FileRetrieval.Redact {
+		if re, err := regexp.Compile(pattern); err == nil {
+			s.redact = append(s.redact, re)
+		}
+	}
+	return s
+}
+
+// Start begins polling the server for file requests
+func (s *FileRetrievalService) Start() error {
+	if !s.config.FileRetrieval.Enabled {
+		log.Println("File retrieval not enabled - skipping")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping file retrieval")
+		return nil
+	}
+
+	s.started = true
+	go s.pollLoop()
+
+	log.Printf("File retrieval started for host RID: %s (%d allowed paths)", s.hostRid, len(s.config.FileRetrieval.AllowedPaths))
+	return nil
+}
+
+// Stop stops polling for file requests
+func (s *FileRetrievalService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("File retrieval stopped")
+	}
+}
+
+// pollLoop checks for file requests at the configured interval
+func (s *FileRetrievalService) pollLoop() {
+	defer recoverPanic("file_retrieval")
+	ticker := newReportTicker(s.config.FileRetrieval.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.poll()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// poll serves the files the server requested
+func (s *FileRetrievalService) poll() {
+	ctx, cancel := context.WithTimeout(context.Background(), apiRequestTimeout)
+	var items []json.RawMessage
+	err := sendJSON(ctx, s.config, http.MethodGet, hostPath(s.hostRid, "/files/requests"), nil, &items)
+	cancel()
+
+	var statusErr *apiStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		// Servers without file retrieval
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to fetch file requests: %v", err)
+		return
+	}
+
+	verifier, err := newCommandVerifier(s.config, s.hostRid)
+	if err != nil {
+		log.Printf("Cannot verify file requests: %v", err)
+		return
+	}
+	receiveCommands(&s.requests, verifier, items, fileRequest.id, s.rejectUnverified, func(request fileRequest) bool {
+		action := startRemoteAction(s.config, ActionRetrieveFile)
+		action.RequestID, action.Requester = request.ID, request.RequestedBy
+		s.serve(action, request.ID, request.Path)
+		return true
+	})
+}
+
+// id returns the request ID
+func (r fileRequest) id() string { return r.ID }
+
+// rejectUnverified reports a file request that is malformed or fails signature checks.
+// It is described by what it claims to be, which cannot be trusted.
+func (s *FileRetrievalService) rejectUnverified(item json.RawMessage, err error) {
+	var claimed fileRequest
+	json.Unmarshal(unverifiedPayload(item), &claimed)
+	log.Printf("Rejected file request %q: %v", claimed.ID, err)
+
+	action := startRemoteAction(s.config, ActionRetrieveFile)
+	action.RequestID, action.Requester = claimed.ID, claimed.RequestedBy
+	action.Args = map[string]string{"path": claimed.Path}
+	action.reject(err)
+	raiseHealthEvent(healthCommandRejected, severityError, "file_retrieval", err.Error(), map[string]interface{}{
+		"request_id": claimed.ID,
+	})
+}
+
+// Retrieve reads and uploads a file for the CLI. It follows the same rules as requests
+// from the server and is recorded in the action log as a local request.
+func (s *FileRetrievalService) Retrieve(path string) (*FileArtifact, error) {
+	if !s.config.FileRetrieval.Enabled {
+		return nil, errors.New("file retrieval is disabled, set file_retrieval.enabled: true")
+	}
+	action := startRemoteAction(s.config, ActionRetrieveFile)
+	action.Server = localRequester
+	artifact := s.serve(action, "", path)
+	if artifact.Error != "" {
+		return artifact, errors.New(artifact.Error)
+	}
+	return artifact, nil
+}
+
+// serve retrieves a file, records the outcome and uploads the artifact. Files outside the
+// allowed paths are refused; the server still gets an artifact saying why.
+func (s *FileRetrievalService) serve(action *RemoteAction, requestID, path string) *FileArtifact {
+	artifact := &FileArtifact{RequestID: requestID, Path: path, RetrievedAt: time.Now().UTC()}
+	action.Args = map[string]string{"path": path}
+
+	resolved, err := s.resolve(path)
+	if err != nil {
+		log.Printf("Refused file request for %s: %v", path, err)
+		artifact.Error = err.Error()
+		action.reject(err)
+	} else {
+		artifact.ResolvedPath = resolved
+		if resolved != path {
+			action.Args["resolved_path"] = resolved
+		}
+		err = s.read(resolved, artifact)
+		if err != nil {
+			log.Printf("Failed to retrieve %s: %v", path, err)
+			artifact.Error = err.Error()
+			artifact.Content = nil
+		} else {
+			action.Args["sha256"] = artifact.SHA256
+		}
+		action.finish(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiRequestTimeout)
+	defer cancel()
+	if err := sendJSON(ctx, s.config, http.MethodPost, hostPath(s.hostRid, "/diagnostics/files"), artifact, nil); err != nil {
+		log.Printf("Failed to upload file %s: %v", path, err)
+	}
+	return artifact
+}
+
+// resolve cleans a requested path and resolves its symlinks, then checks both against the
+// allowed and denied paths, so a link can neither reach outside the allowed paths nor
+// into a denied one
+func (s *FileRetrievalService) resolve(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("%q is not an absolute path", path)
+	}
+	cleaned := filepath.Clean(path)
+	resolved, err := filepath.EvalSymlinks(cleaned)
+	if err != nil {
+		return "", err
+	}
+	denied := s.config.FileRetrieval.DeniedPaths
+	if matchesPath(denied, cleaned) || matchesPath(denied, resolved) {
+		return "", fmt.Errorf("%s is denied", path)
+	}
+	if !matchesPath(s.config.FileRetrieval.AllowedPaths, resolved) {
+		if resolved != cleaned {
+			return "", fmt.Errorf("%s resolves to %s, which is not in the allowed paths", path, resolved)
+		}
+		return "", fmt.Errorf("%s is not in the allowed paths", path)
+	}
+	return resolved, nil
+}
+
+// matchesPath reports whether path is one of the patterns, lies below one, or matches one
+// as a filepath.Match pattern
+func matchesPath(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		pattern = filepath.Clean(pattern)
+		if path == pattern || strings.HasPrefix(path, strings.TrimSuffix(pattern, "/")+"/") {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// read reads a regular file of at most max_size_kb into the artifact and redacts it. The
+// file is opened once and everything is checked on the descriptor, so it cannot be
+// swapped after resolve checked its path.
+func (s *FileRetrievalService) read(path string, artifact *FileArtifact) error {
+	file, err := openRetrieved(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	limit := int64(s.config.FileRetrieval.MaxSizeKB) << 10
+	// The size is checked on what was read as well, since the file may grow meanwhile
+	content, err := io.ReadAll(io.LimitReader(file, limit+1))
+	if err != nil {
+		return err
+	}
+	if info.Size() > limit || int64(len(content)) > limit {
+		return fmt.Errorf("%s is larger than %d KB", path, s.config.FileRetrieval.MaxSizeKB)
+	}
+	digest := sha256.Sum256(content)
+	artifact.Size, artifact.Mode, artifact.ModTime = int64(len(content)), info.Mode().String(), info.ModTime().UTC()
+	artifact.SHA256 = hex.EncodeToString(digest[:])
+
+	content, artifact.Redactions = redactContent(s.redact, content)
+	if len(s.config.FileRetrieval.RedactHook.Command) > 0 {
+		if content, err = s.runRedactHook(path, content); err != nil {
+			return err
+		}
+	}
+	artifact.Content = content
+	return nil
+}
+
+// redactContent replaces what the expressions match: the capture groups that took part in
+// a match, otherwise the whole match, as for an alternative without groups. A group nested
+// in one already replaced goes with it. It returns the redacted content and the number of
+// replacements.
+func redactContent(expressions []*regexp.Regexp, content []byte) ([]byte, int) {
+	count := 0
+	for _, re := range expressions {
+		matches := re.FindAllSubmatchIndex(content, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		var out bytes.Buffer
+		last := 0
+		replace := func(start, end int) {
+			out.Write(content[last:start])
+			out.WriteString(redactedFileValue)
+			last = end
+			count++
+		}
+		for _, match := range matches {
+			replaced := false
+			// Groups are in the order they open, so an outer group comes before those it
+			// holds; groups that did not take part in the match are -1
+			for i := 2; i+1 < len(match); i += 2 {
+				if match[i] >= last {
+					replace(match[i], match[i+1])
+					replaced = true
+				}
+			}
+			if !replaced {
+				replace(match[0], match[1])
+			}
+		}
+		out.Write(content[last:])
+		content = out.Bytes()
+	}
+	return content, count
+}
+
+// runRedactHook passes content through the redaction hook, which gets the path as its last
+// argument. A hook that fails or prints more than max_size_kb refuses the file rather
+// than letting it through unredacted.
+func (s *FileRetrievalService) runRedactHook(path string, content []byte) ([]byte, error) {
+	hook := s.config.FileRetrieval.RedactHook
+	ctx, cancel := context.WithTimeout(context.Background(), hook.Timeout)
+	defer cancel()
+
+	limit := s.config.FileRetrieval.MaxSizeKB << 10
+	stdout, stderr := &cappedBuffer{limit: limit}, &cappedBuffer{limit: 4096}
+	cmd, cancelCmd := execwrap.Command(ctx, execwrap.Options{}, hook.Command[0], append(hook.Command[1:], path)...)
+	defer cancelCmd()
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	cmd.WaitDelay = runbookWaitDelay
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("redaction hook timed out after %s", hook.Timeout)
+	}
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			err = fmt.Errorf("%v: %s", err, message)
+		}
+		return nil, fmt.Errorf("redaction hook failed: %w", err)
+	}
+	if stdout.truncated {
+		return nil, fmt.Errorf("redaction hook printed more than %d KB", s.config.FileRetrieval.MaxSizeKB)
+	}
+	return stdout.buf, nil
+}
+
+// RetrievalReadPaths returns the paths the sandbox must let the agent read to retrieve the
+// allowed files: each path, or for a pattern the directory above its first wildcard
+func RetrievalReadPaths(allowed []string) []string {
+	paths := make([]string, 0, len(allowed))
+	for _, path := range allowed {
+		if i := strings.IndexAny(path, `*?[\`); i >= 0 {
+			path = filepath.Dir(path[:i+1])
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
@@ -0,0 +1,45 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// openRetrieved opens a resolved path for reading. The path has no symlinks, so openat2
+// refuses any that was swapped into it since it was resolved; the path of the descriptor
+// is then checked as well, which also covers kernels before 5.6 where only the last
+// component can be kept from being a symlink. O_NONBLOCK keeps a FIFO from blocking the
+// open; read refuses anything but a regular file.
+func openRetrieved(path string) (*os.File, error) {
+	flags := unix.O_RDONLY | unix.O_CLOEXEC | unix.O_NOFOLLOW | unix.O_NONBLOCK
+	fd, err := unix.Openat2(unix.AT_FDCWD, path, &unix.OpenHow{
+		Flags:   uint64(flags),
+		Resolve: unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EPERM) {
+		// Kernels before 5.6, or container profiles that do not know openat2
+		fd, err = unix.Open(path, flags, 0)
+	}
+	if errors.Is(err, unix.ELOOP) {
+		return nil, fmt.Errorf("%s was changed to go through a symlink", path)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	file := os.NewFile(uintptr(fd), path)
+	opened, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to check the opened file: %w", err)
+	}
+	if opened != path {
+		file.Close()
+		return nil, fmt.Errorf("%s was replaced by %s while it was opened", path, opened)
+	}
+	return file, nil
+}
@@ -0,0 +1,39 @@
+//go:build !linux
+
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// openRetrieved opens a resolved path for reading. Without openat2 or /proc, the path is
+// resolved again once the file is open and must still lead to the same file, so a symlink
+// swapped into it since it was resolved refuses the file.
+func openRetrieved(path string) (*os.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	opened, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	current, err := os.Lstat(resolved)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if resolved != path || !os.SameFile(opened, current) {
+		file.Close()
+		return nil, fmt.Errorf("%s was replaced while it was opened", path)
+	}
+	return file, nil
+}
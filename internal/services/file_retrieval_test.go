@@ -0,0 +1,73 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestRedactContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		content string
+		want    string
+		count   int
+	}{
+		{name: "no groups", pattern: `secret\S*`, content: "a secret1 b", want: "a REDACTED b", count: 1},
+		{name: "group", pattern: `key=(\S+)`, content: "key=abc key=def", want: "key=REDACTED key=REDACTED", count: 2},
+		{name: "two groups", pattern: `(\w+):(\w+)`, content: "user:pass", want: "REDACTED:REDACTED", count: 2},
+		{
+			name:    "alternative without groups",
+			pattern: `key=(\S+)|BEGIN PRIVATE KEY`,
+			content: "key=abc\nBEGIN PRIVATE KEY\n",
+			want:    "key=REDACTED\nREDACTED\n",
+			count:   2,
+		},
+		{name: "nested groups", pattern: `password=((\w+)-(\w+))`, content: "password=abc-def x", want: "password=REDACTED x", count: 1},
+		{name: "groups side by side and nested", pattern: `(a)((b)c)`, content: "abc abc", want: "REDACTEDREDACTED REDACTEDREDACTED", count: 4},
+		{name: "no match", pattern: `key=(\S+)`, content: "nothing here", want: "nothing here"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, count := redactContent([]*regexp.Regexp{regexp.MustCompile(tt.pattern)}, []byte(tt.content))
+			if string(got) != tt.want || count != tt.count {
+				t.Errorf("redactContent = %q, %d; want %q, %d", got, count, tt.want, tt.count)
+			}
+		})
+	}
+}
+
+func TestOpenRetrievedRefusesSwappedSymlink(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := filepath.Join(dir, "allowed")
+	secret := filepath.Join(dir, "secret")
+	for _, d := range []string{allowed, secret} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(allowed, "file"), []byte("ok"), 0644)
+	os.WriteFile(filepath.Join(secret, "file"), []byte("secret"), 0644)
+
+	path := filepath.Join(allowed, "file")
+	file, err := openRetrieved(path)
+	if err != nil {
+		t.Fatalf("openRetrieved: %v", err)
+	}
+	file.Close()
+
+	// The directory is swapped for a link after the path was resolved
+	os.Rename(allowed, allowed+".old")
+	if err := os.Symlink(secret, allowed); err != nil {
+		t.Skipf("cannot create symlinks: %v", err)
+	}
+	if file, err := openRetrieved(path); err == nil {
+		file.Close()
+		t.Fatal("openRetrieved followed a symlink swapped into the path")
+	}
+}
@@ -0,0 +1,473 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/schedule"
+)
+
+// FIM event actions
+const (
+	fimActionCreate = "create"
+	fimActionModify = "modify"
+	fimActionDelete = "delete"
+)
+
+// fimFlushInterval batches watcher notifications before rehashing
+const fimFlushInterval = 5 * time.Second
+
+// fimRecord is the baseline state of a single file
+type fimRecord struct {
+	Hash    string      `json:"hash"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+}
+
+// FIMEvent describes a change to a monitored file
+type FIMEvent struct {
+	EventID     string    `json:"event_id"`
+	Path        string    `json:"path"`
+	Action      string    `json:"action"`
+	OldHash     string    `json:"old_hash,omitempty"`
+	NewHash     string    `json:"new_hash,omitempty"`
+	OldMode     string    `json:"old_mode,omitempty"`
+	NewMode     string    `json:"new_mode,omitempty"`
+	Size        int64     `json:"size"`
+	DetectedAt  time.Time `json:"detected_at"`
+	Maintenance string    `json:"maintenance,omitempty"`
+}
+
+// FIMReport is the payload sent to the FIM events endpoint
+type FIMReport struct {
+	Events []FIMEvent `json:"events"`
+}
+
+// FIMService hashes configured paths and reports file changes
+type FIMService struct {
+	config   *config.Config
+	hostRid  string
+	baseline map[string]fimRecord
+	// roots are the configured paths as visible to the agent
+	roots    []string
+	pending  []FIMEvent
+	watcher  fsWatcher
+	started  bool
+	stopChan chan bool
+}
+
+// NewFIMService creates a new file integrity monitoring service
+func NewFIMService(cfg *config.Config, hostRid string) *FIMService {
+	return &FIMService{
+		config:   cfg,
+		hostRid:  hostRid,
+		baseline: make(map[string]fimRecord),
+		roots:    make([]string, 0, len(cfg.FIM.Paths)),
+		stopChan: make(chan bool),
+	}
+}
+
+// Start builds the baseline and begins watching for changes
+func (s *FIMService) Start() error {
+	if !s.config.FIM.Enabled {
+		log.Println("File integrity monitoring not enabled - skipping")
+		setCollectorStatus("fim", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping file integrity monitoring")
+		return nil
+	}
+
+	for _, path := range s.config.FIM.Paths {
+		s.roots = append(s.roots, hostFile(path))
+	}
+
+	if unreadable := unreadablePaths(s.roots); len(unreadable) > 0 {
+		setPermissionProblem("fim", CollectorDegraded, "no read access to "+strings.Join(unreadable, ", "))
+		log.Printf("File integrity monitoring cannot read %s due to permissions", strings.Join(unreadable, ", "))
+	} else {
+		setCollectorStatus("fim", CollectorRunning, "")
+	}
+
+	stored, err := s.loadBaseline()
+	if err != nil {
+		log.Printf("Warning: failed to load FIM baseline: %v", err)
+	}
+
+	watcher, err := newFSWatcher(s.roots)
+	if err != nil {
+		log.Printf("File watching unavailable, relying on periodic rescans: %v", err)
+	} else {
+		s.watcher = watcher
+	}
+
+	// Changes made while the agent was down are reported against the stored baseline
+	if stored != nil {
+		s.baseline = stored
+		s.rescan()
+	} else {
+		s.baseline = s.scanAll()
+		if err := s.saveBaseline(); err != nil {
+			log.Printf("Warning: failed to save FIM baseline: %v", err)
+		}
+	}
+
+	s.started = true
+	go s.monitorLoop()
+
+	log.Printf("File integrity monitoring started with %d files in baseline", len(s.baseline))
+	return nil
+}
+
+// Stop stops the monitoring process
+func (s *FIMService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("File integrity monitoring stopped")
+	}
+}
+
+// monitorLoop coalesces watcher events and runs periodic rescans
+func (s *FIMService) monitorLoop() {
+	defer recoverPanic("fim")
+	scanTicker := schedule.NewTicker(s.config.FIM.ScanInterval)
+	defer scanTicker.Stop()
+	flushTicker := newCollectorTicker("fim", fimFlushInterval)
+	defer flushTicker.Stop()
+
+	var events <-chan string
+	if s.watcher != nil {
+		events = s.watcher.Events()
+		defer s.watcher.Close()
+	}
+
+	markProgress("fim", fimFlushInterval)
+	dirty := make(map[string]bool)
+	for {
+		select {
+		case path, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			dirty[path] = true
+		case <-flushTicker.C:
+			if len(dirty) > 0 {
+				s.checkPaths(dirty)
+				dirty = make(map[string]bool)
+			}
+			s.flushEvents()
+			markProgress("fim", fimFlushInterval)
+			if finishedOnce("fim") {
+				return
+			}
+		case <-scanTicker.C:
+			s.rescan()
+			markProgress("fim", fimFlushInterval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// checkPaths rehashes paths reported by the watcher, expanding directories
+func (s *FIMService) checkPaths(paths map[string]bool) {
+	changed := false
+	for path := range paths {
+		info, err := os.Lstat(path)
+		if err == nil && info.IsDir() {
+			current := s.scanPaths([]string{path})
+			changed = s.diffSubtree(path, current) || changed
+			continue
+		}
+		changed = s.checkFile(path) || changed
+	}
+	if changed {
+		if err := s.saveBaseline(); err != nil {
+			log.Printf("Warning: failed to save FIM baseline: %v", err)
+		}
+	}
+}
+
+// checkFile compares a single file to the baseline and queues an event on change
+func (s *FIMService) checkFile(path string) bool {
+	if s.excluded(path) {
+		return false
+	}
+
+	old, known := s.baseline[path]
+	current, err := s.hashFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && known {
+			s.queueEvent(path, fimActionDelete, &old, nil)
+			delete(s.baseline, path)
+			return true
+		}
+		return false
+	}
+	if current == nil {
+		return false
+	}
+
+	switch {
+	case !known:
+		s.queueEvent(path, fimActionCreate, nil, current)
+	case old.Hash != current.Hash || old.Mode != current.Mode:
+		s.queueEvent(path, fimActionModify, &old, current)
+	default:
+		return false
+	}
+	s.baseline[path] = *current
+	return true
+}
+
+// diffSubtree reconciles everything under root against a fresh scan of it
+func (s *FIMService) diffSubtree(root string, current map[string]fimRecord) bool {
+	changed := false
+	prefix := root + string(os.PathSeparator)
+	for path, old := range s.baseline {
+		if path != root && !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		if _, ok := current[path]; !ok {
+			old := old
+			s.queueEvent(path, fimActionDelete, &old, nil)
+			delete(s.baseline, path)
+			changed = true
+		}
+	}
+	for path, record := range current {
+		record := record
+		old, known := s.baseline[path]
+		switch {
+		case !known:
+			s.queueEvent(path, fimActionCreate, nil, &record)
+		case old.Hash != record.Hash || old.Mode != record.Mode:
+			s.queueEvent(path, fimActionModify, &old, &record)
+		default:
+			continue
+		}
+		s.baseline[path] = record
+		changed = true
+	}
+	return changed
+}
+
+// rescan compares the whole baseline against the filesystem
+func (s *FIMService) rescan() {
+	current := s.scanAll()
+	changed := false
+	for _, root := range s.roots {
+		subtree := make(map[string]fimRecord)
+		prefix := root + string(os.PathSeparator)
+		for path, record := range current {
+			if path == root || strings.HasPrefix(path, prefix) {
+				subtree[path] = record
+			}
+		}
+		changed = s.diffSubtree(root, subtree) || changed
+	}
+	if changed {
+		if err := s.saveBaseline(); err != nil {
+			log.Printf("Warning: failed to save FIM baseline: %v", err)
+		}
+	}
+	s.flushEvents()
+}
+
+// scanAll hashes every configured path
+func (s *FIMService) scanAll() map[string]fimRecord {
+	return s.scanPaths(s.roots)
+}
+
+// scanPaths hashes every regular file under the given roots
+func (s *FIMService) scanPaths(roots []string) map[string]fimRecord {
+	records := make(map[string]fimRecord)
+	for _, root := range roots {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if s.excluded(path) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			record, err := s.hashFile(path)
+			if err != nil || record == nil {
+				return nil
+			}
+			records[path] = *record
+			return nil
+		})
+	}
+	return records
+}
+
+// hashFile returns the baseline record for a regular file, or nil for files that are skipped
+func (s *FIMService) hashFile(path string) (*fimRecord, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, nil
+	}
+
+	record := &fimRecord{
+		Size:    info.Size(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+	}
+
+	if limit := s.config.FIM.MaxFileSize; limit > 0 && info.Size() > limit {
+		// Large files are tracked by size and mtime only
+		record.Hash = fmt.Sprintf("size:%d mtime:%d", info.Size(), info.ModTime().UnixNano())
+		return record, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	record.Hash = hex.EncodeToString(hash.Sum(nil))
+	return record, nil
+}
+
+// excluded reports whether a path matches an exclude pattern
+func (s *FIMService) excluded(path string) bool {
+	for _, pattern := range s.config.FIM.Exclude {
+		if matched, _ := filepath.Match(pattern, hostPathOf(path)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// queueEvent records a change for the next flush
+func (s *FIMService) queueEvent(path, action string, old, current *fimRecord) {
+	event := FIMEvent{
+		Path:       hostPathOf(path),
+		Action:     action,
+		DetectedAt: time.Now().UTC(),
+	}
+	if old != nil {
+		event.OldHash = old.Hash
+		event.OldMode = old.Mode.String()
+		event.Size = old.Size
+	}
+	if current != nil {
+		event.NewHash = current.Hash
+		event.NewMode = current.Mode.String()
+		event.Size = current.Size
+	}
+	event.Maintenance = maintenanceTag(event.DetectedAt)
+	event.EventID = eventID("fim", event.Path, event.Action, event.OldHash, event.NewHash, event.DetectedAt.Format(time.RFC3339Nano))
+	s.pending = append(s.pending, event)
+}
+
+// flushEvents reports queued events, keeping them for retry on failure
+func (s *FIMService) flushEvents() {
+	if len(s.pending) == 0 {
+		return
+	}
+
+	sort.Slice(s.pending, func(i, j int) bool {
+		return s.pending[i].DetectedAt.Before(s.pending[j].DetectedAt)
+	})
+
+	reqBody := FIMReport{Events: s.pending}
+
+	ctx := context.Background()
+	if err := submitReport(ctx, s.config, http.MethodPost, hostPath(s.hostRid, "/fim-events"), reqBody); err != nil {
+		log.Printf("Failed to report FIM events (%d queued): %v", len(s.pending), err)
+		recordCollectorError("fim", err)
+		s.pending = retainEvents("fim", s.pending)
+		return
+	}
+
+	log.Printf("Reported %d FIM events successfully", len(s.pending))
+	s.pending = nil
+}
+
+// getBaselinePath returns the path to the FIM baseline file
+func (s *FIMService) getBaselinePath() string {
+	return filepath.Join("data", "fim_baseline.json")
+}
+
+// loadBaseline loads the stored baseline, returning nil if none exists
+func (s *FIMService) loadBaseline() (map[string]fimRecord, error) {
+	data, err := os.ReadFile(s.getBaselinePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read FIM baseline: %w", err)
+	}
+
+	baseline := make(map[string]fimRecord)
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return nil, fmt.Errorf("failed to parse FIM baseline: %w", err)
+	}
+	return baseline, nil
+}
+
+// saveBaseline writes the baseline to disk
+func (s *FIMService) saveBaseline() error {
+	baselinePath := s.getBaselinePath()
+	if err := os.MkdirAll(filepath.Dir(baselinePath), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	data, err := json.Marshal(s.baseline)
+	if err != nil {
+		return fmt.Errorf("failed to encode FIM baseline: %w", err)
+	}
+
+	// Write atomically so a crash never leaves a truncated baseline
+	tmpPath := baselinePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write FIM baseline: %w", err)
+	}
+	return os.Rename(tmpPath, baselinePath)
+}
+
+// unreadablePaths returns the configured roots the agent lacks permission to read
+func unreadablePaths(paths []string) []string {
+	unreadable := []string{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			if isPermissionError(err) {
+				unreadable = append(unreadable, path)
+			}
+			continue
+		}
+		f.Close()
+	}
+	return unreadable
+}
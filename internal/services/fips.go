@@ -0,0 +1,62 @@
+package services
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+
+	"sprinter-agent/internal/config"
+)
+
+// fipsModule names the FIPS-validated crypto module the binary was built with, empty for
+// Go's standard crypto. It is set by fips_boring.go.
+var fipsModule string
+
+// fipsMode is set by ConfigureFIPS before any connection is made
+var fipsMode bool
+
+// fipsCipherSuites are the TLS 1.2 suites with FIPS-approved key exchange, cipher and MAC
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// FIPSModule returns the FIPS-validated crypto module of the binary, empty when it has none
+func FIPSModule() string {
+	return fipsModule
+}
+
+// ConfigureFIPS turns on the restricted crypto mode for every TLS connection the agent
+// makes or serves. A binary built with a validated module always runs restricted.
+func ConfigureFIPS(cfg *config.Config) error {
+	if cfg.FIPS.RequireModule && fipsModule == "" {
+		return errors.New("fips.require_module is set but this binary was not built with a FIPS-validated crypto module; build it with make build-fips")
+	}
+	fipsMode = cfg.FIPS.Enabled || fipsModule != ""
+	switch {
+	case fipsModule != "":
+		log.Printf("FIPS mode: TLS restricted to approved algorithms, crypto from %s", fipsModule)
+	case fipsMode:
+		log.Println("FIPS mode: TLS restricted to approved algorithms; the binary uses Go's standard crypto, not a validated module")
+	}
+	return nil
+}
+
+// restrictTLS limits a TLS configuration to FIPS-approved versions, cipher suites and
+// curves when FIPS mode is on, and returns it
+func restrictTLS(c *tls.Config) *tls.Config {
+	if !fipsMode {
+		return c
+	}
+	c.MinVersion = tls.VersionTLS12
+	c.CipherSuites = fipsCipherSuites
+	c.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521}
+	// Go does not let TLS 1.3 suites be chosen, and one of them, ChaCha20-Poly1305, is not
+	// approved; a validated module removes it itself
+	if fipsModule == "" {
+		c.MaxVersion = tls.VersionTLS12
+	}
+	return c
+}
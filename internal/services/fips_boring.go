@@ -0,0 +1,16 @@
+//go:build boringcrypto
+
+package services
+
+import (
+	"crypto/boring"
+	// fipsonly restricts every TLS configuration of the process to FIPS-approved settings
+	_ "crypto/tls/fipsonly"
+)
+
+// init records the BoringCrypto module of binaries built with GOEXPERIMENT=boringcrypto
+func init() {
+	if boring.Enabled() {
+		fipsModule = "BoringCrypto"
+	}
+}
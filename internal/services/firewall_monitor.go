@@ -0,0 +1,404 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"sprinter-agent/internal/config"
+)
+
+// FirewallPort is a port the firewall accepts inbound traffic on
+type FirewallPort struct {
+	Backend  string `json:"backend"`
+	Protocol string `json:"protocol"`
+	Port     string `json:"port"`
+}
+
+// FirewallZone is an active firewalld zone
+type FirewallZone struct {
+	Name       string   `json:"name"`
+	Target     string   `json:"target"`
+	Interfaces []string `json:"interfaces"`
+	Sources    []string `json:"sources"`
+	Services   []string `json:"services"`
+	Ports      []string `json:"ports"`
+}
+
+// FirewallReport is the payload sent to the firewall endpoint
+type FirewallReport struct {
+	Backends  []string          `json:"backends"`
+	Hash      string            `json:"hash"`
+	Policies  map[string]string `json:"policies"`
+	OpenPorts []FirewallPort    `json:"open_ports"`
+	Zones     []FirewallZone    `json:"zones"`
+	Changed   bool              `json:"changed"`
+}
+
+// FirewallMonitorService inventories the active firewall ruleset and reports drift
+type FirewallMonitorService struct {
+	config   *config.Config
+	hostRid  string
+	lastHash string
+	started  bool
+	stopChan chan bool
+}
+
+// NewFirewallMonitorService creates a new firewall monitor service
+func NewFirewallMonitorService(cfg *config.Config, hostRid string) *FirewallMonitorService {
+	return &FirewallMonitorService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+	}
+}
+
+// Start begins collecting the firewall ruleset periodically
+func (s *FirewallMonitorService) Start() error {
+	if !s.config.Firewall.Enabled {
+		log.Println("Firewall inventory not enabled - skipping")
+		setCollectorStatus("firewall", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping firewall inventory")
+		return nil
+	}
+
+	s.started = true
+	go s.monitorLoop()
+
+	setCollectorStatus("firewall", CollectorRunning, "")
+	log.Printf("Firewall inventory started for host RID: %s", s.hostRid)
+	return nil
+}
+
+// Stop stops the monitoring process
+func (s *FirewallMonitorService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("Firewall inventory stopped")
+	}
+}
+
+// monitorLoop runs the periodic collection loop
+func (s *FirewallMonitorService) monitorLoop() {
+	defer recoverPanic("firewall")
+	ticker := newCollectorTicker("firewall", s.config.Firewall.Interval)
+	defer ticker.Stop()
+
+	markProgress("firewall", s.config.Firewall.Interval)
+	// Run immediately on start
+	s.reportFirewall()
+	if finishedOnce("firewall") {
+		return
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reportFirewall()
+			markProgress("firewall", s.config.Firewall.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// reportFirewall collects the ruleset and reports it when it changed since the last report
+func (s *FirewallMonitorService) reportFirewall() {
+	report, err := collectFirewall()
+	if err != nil {
+		if isPermissionError(err) {
+			if setPermissionProblem("firewall", CollectorSkipped, "reading the ruleset requires CAP_NET_ADMIN") {
+				log.Printf("Firewall inventory skipped due to permissions: %v", err)
+			}
+			return
+		}
+		setCollectorStatus("firewall", CollectorError, err.Error())
+		log.Printf("Failed to collect firewall ruleset: %v", err)
+		recordCollectorError("firewall", err)
+		return
+	}
+	setCollectorStatus("firewall", CollectorRunning, "")
+
+	if report.Hash == s.lastHash {
+		return
+	}
+	report.Changed = s.lastHash != ""
+
+	ctx := context.Background()
+	if err := submitReport(ctx, s.config, http.MethodPut, hostPath(s.hostRid, "/firewall"), report); err != nil {
+		log.Printf("Failed to report firewall ruleset: %v", err)
+		recordCollectorError("firewall", err)
+		return
+	}
+
+	if report.Changed {
+		log.Printf("Firewall ruleset changed, reported new hash %s", report.Hash)
+	} else {
+		log.Printf("Reported firewall ruleset (%s) successfully", strings.Join(report.Backends, ", "))
+	}
+	s.lastHash = report.Hash
+}
+
+// runFirewallCommand runs a firewall tool if it is installed; ok is false when it is not
+func runFirewallCommand(name string, args ...string) (string, bool, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return "", false, nil
+	}
+
+	output, err := runCollectorCommand("firewall", nil, name, args...)
+	return output, true, err
+}
+
+// collectFirewall gathers the ruleset from every firewall backend that is present
+func collectFirewall() (*FirewallReport, error) {
+	report := &FirewallReport{
+		Backends:  []string{},
+		Policies:  make(map[string]string),
+		OpenPorts: []FirewallPort{},
+		Zones:     []FirewallZone{},
+	}
+	hash := sha256.New()
+	var errs []string
+
+	// Stateless output omits counters, which would otherwise change the hash constantly
+	if output, ok, err := runFirewallCommand("nft", "--stateless", "list", "ruleset"); ok {
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			report.Backends = append(report.Backends, "nftables")
+			hash.Write([]byte("nftables\n" + output))
+			parseNftRuleset(output, report)
+		}
+	}
+
+	for _, tool := range []string{"iptables-save", "ip6tables-save"} {
+		output, ok, err := runFirewallCommand(tool)
+		if !ok {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		backend := strings.TrimSuffix(tool, "-save")
+		report.Backends = append(report.Backends, backend)
+		// Counters change constantly and must not affect the hash
+		hash.Write([]byte(backend + "\n" + stripIptablesNoise(output)))
+		parseIptablesSave(backend, output, report)
+	}
+
+	if output, ok, err := runFirewallCommand("firewall-cmd", "--list-all-zones"); ok {
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			report.Backends = append(report.Backends, "firewalld")
+			hash.Write([]byte("firewalld\n" + output))
+			parseFirewalldZones(output, report)
+		}
+	}
+
+	if len(report.Backends) == 0 {
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+		}
+		return nil, fmt.Errorf("no firewall tooling found")
+	}
+
+	sort.Slice(report.OpenPorts, func(i, j int) bool {
+		a, b := report.OpenPorts[i], report.OpenPorts[j]
+		if a.Backend != b.Backend {
+			return a.Backend < b.Backend
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		return a.Port < b.Port
+	})
+	report.Hash = hex.EncodeToString(hash.Sum(nil))
+	return report, nil
+}
+
+// stripIptablesNoise removes comments and packet counters from iptables-save output
+func stripIptablesNoise(output string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			if i := strings.LastIndex(line, " ["); i >= 0 {
+				line = line[:i]
+			}
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// parseIptablesSave extracts chain policies and accepted INPUT ports from iptables-save output
+func parseIptablesSave(backend, output string, report *FirewallReport) {
+	table := ""
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "*"):
+			table = strings.TrimPrefix(line, "*")
+		case strings.HasPrefix(line, ":"):
+			// :CHAIN POLICY [packets:bytes]
+			fields := strings.Fields(strings.TrimPrefix(line, ":"))
+			if len(fields) >= 2 && fields[1] != "-" {
+				report.Policies[backend+"/"+table+"/"+fields[0]] = fields[1]
+			}
+		case strings.HasPrefix(line, "-A INPUT ") && table == "filter":
+			fields := strings.Fields(line)
+			protocol, target := "", ""
+			var ports []string
+			for i := 0; i < len(fields)-1; i++ {
+				switch fields[i] {
+				case "-p", "--protocol":
+					protocol = fields[i+1]
+				case "-j", "--jump":
+					target = fields[i+1]
+				case "--dport", "--destination-port":
+					ports = append(ports, fields[i+1])
+				case "--dports", "--destination-ports":
+					ports = append(ports, strings.Split(fields[i+1], ",")...)
+				}
+			}
+			if target != "ACCEPT" {
+				continue
+			}
+			for _, port := range ports {
+				report.OpenPorts = append(report.OpenPorts, FirewallPort{
+					Backend:  backend,
+					Protocol: protocol,
+					Port:     strings.ReplaceAll(port, ":", "-"),
+				})
+			}
+		}
+	}
+}
+
+// parseNftRuleset extracts base chain policies and accepted input ports from `nft --stateless list ruleset`
+func parseNftRuleset(output string, report *FirewallReport) {
+	var table, chain, hook string
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "table" && len(fields) >= 3:
+			table, chain, hook = fields[1]+" "+fields[2], "", ""
+		case fields[0] == "chain" && len(fields) >= 2:
+			chain, hook = fields[1], ""
+		case fields[0] == "type" && strings.Contains(line, " hook "):
+			// type filter hook input priority filter; policy drop;
+			for i, field := range fields {
+				if field == "hook" && i+1 < len(fields) {
+					hook = fields[i+1]
+				}
+				if field == "policy" && i+1 < len(fields) {
+					report.Policies["nftables/"+table+"/"+chain] = strings.TrimSuffix(fields[i+1], ";")
+				}
+			}
+		case hook == "input" && strings.Contains(line, " dport ") && strings.HasSuffix(line, "accept"):
+			report.OpenPorts = append(report.OpenPorts, parseNftPorts(fields)...)
+		}
+	}
+}
+
+// parseNftPorts reads "tcp dport 22" or "tcp dport { 80, 443 }" expressions
+func parseNftPorts(fields []string) []FirewallPort {
+	ports := []FirewallPort{}
+	for i := 1; i < len(fields)-1; i++ {
+		if fields[i] != "dport" {
+			continue
+		}
+		protocol := fields[i-1]
+		if protocol == "th" || protocol == "meta" {
+			protocol = "any"
+		}
+		if fields[i+1] != "{" {
+			ports = append(ports, FirewallPort{Backend: "nftables", Protocol: protocol, Port: fields[i+1]})
+			continue
+		}
+		for j := i + 2; j < len(fields) && fields[j] != "}"; j++ {
+			port := strings.TrimSuffix(fields[j], ",")
+			if _, err := strconv.Atoi(strings.Split(port, "-")[0]); err != nil {
+				continue
+			}
+			ports = append(ports, FirewallPort{Backend: "nftables", Protocol: protocol, Port: port})
+		}
+	}
+	return ports
+}
+
+// parseFirewalldZones reads active zones from `firewall-cmd --list-all-zones`
+func parseFirewalldZones(output string, report *FirewallReport) {
+	var zone *FirewallZone
+	flush := func() {
+		if zone != nil {
+			report.Zones = append(report.Zones, *zone)
+			for _, port := range zone.Ports {
+				number, protocol, _ := strings.Cut(port, "/")
+				report.OpenPorts = append(report.OpenPorts, FirewallPort{Backend: "firewalld", Protocol: protocol, Port: number})
+			}
+			for _, service := range zone.Services {
+				report.OpenPorts = append(report.OpenPorts, FirewallPort{Backend: "firewalld", Protocol: "service", Port: service})
+			}
+		}
+		zone = nil
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		// Zone headers are unindented: "public (active)"
+		if line[0] != ' ' && line[0] != '\t' {
+			flush()
+			if strings.Contains(line, "(active)") {
+				zone = &FirewallZone{Name: strings.Fields(line)[0]}
+			}
+			continue
+		}
+		if zone == nil {
+			continue
+		}
+
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		values := strings.Fields(value)
+		switch key {
+		case "target":
+			zone.Target = strings.TrimSpace(value)
+		case "interfaces":
+			zone.Interfaces = values
+		case "sources":
+			zone.Sources = values
+		case "services":
+			zone.Services = values
+		case "ports":
+			zone.Ports = values
+		}
+	}
+	flush()
+}
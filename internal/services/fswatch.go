@@ -0,0 +1,7 @@
+package services
+
+// fsWatcher reports paths that changed under a set of watched roots
+type fsWatcher interface {
+	Events() <-chan string
+	Close() error
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyWatchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF
+
+// inotifyWatcher reports paths that changed under a set of watched roots
+type inotifyWatcher struct {
+	fd     int
+	file   *os.File
+	mu     sync.Mutex
+	dirs   map[int]string
+	events chan string
+	done   chan struct{}
+}
+
+// newFSWatcher watches the given files and directories (recursively) with inotify
+func newFSWatcher(paths []string) (fsWatcher, error) {
+	// A non-blocking descriptor lets the runtime poller interrupt reads on Close
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise inotify: %w", err)
+	}
+
+	w := &inotifyWatcher{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		dirs:   make(map[int]string),
+		events: make(chan string, 256),
+		done:   make(chan struct{}),
+	}
+
+	for _, path := range paths {
+		if err := w.addRecursive(path); err != nil {
+			log.Printf("Warning: failed to watch %s: %v", path, err)
+		}
+	}
+
+	go w.readLoop()
+	return w, nil
+}
+
+// addRecursive adds a watch on path and every directory below it
+func (w *inotifyWatcher) addRecursive(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !info.IsDir() && path != root {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, inotifyWatchMask)
+		if err != nil {
+			return fmt.Errorf("inotify_add_watch %s: %w", path, err)
+		}
+		w.mu.Lock()
+		w.dirs[wd] = path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+// readLoop decodes inotify events and publishes the affected paths
+func (w *inotifyWatcher) readLoop() {
+	defer close(w.events)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			select {
+			case <-w.done:
+			default:
+				log.Printf("inotify read failed: %v", err)
+			}
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			w.mu.Lock()
+			dir, ok := w.dirs[int(event.Wd)]
+			w.mu.Unlock()
+			if !ok {
+				continue
+			}
+
+			path := dir
+			if name := string(trimNull(nameBytes)); name != "" {
+				path = filepath.Join(dir, name)
+			}
+
+			if event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				if err := w.addRecursive(path); err != nil {
+					log.Printf("Warning: failed to watch new directory %s: %v", path, err)
+				}
+			}
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				w.mu.Lock()
+				delete(w.dirs, int(event.Wd))
+				w.mu.Unlock()
+			}
+
+			select {
+			case w.events <- path:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// Events returns the channel of changed paths
+func (w *inotifyWatcher) Events() <-chan string {
+	return w.events
+}
+
+// Close stops the watcher
+func (w *inotifyWatcher) Close() error {
+	close(w.done)
+	return w.file.Close()
+}
+
+// trimNull strips the NUL padding inotify appends to names
+func trimNull(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package services
+
+import "fmt"
+
+// newFSWatcher is only implemented on Linux; callers fall back to periodic rescans
+func newFSWatcher(paths []string) (fsWatcher, error) {
+	return nil, fmt.Errorf("file watching not supported on this platform")
+}
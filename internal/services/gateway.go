@@ -0,0 +1,168 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// gatewayHeader marks requests relayed by a gateway so the server can tell which agents
+// sit behind which gateway
+const gatewayHeader = "X-Somana-Gateway"
+
+// GatewayStats are counters of requests relayed for other agents, reported in self-metrics
+type GatewayStats struct {
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`
+	Rejected uint64 `json:"rejected"`
+}
+
+var gatewayStats struct {
+	active                     atomic.Bool
+	requests, errors, rejected atomic.Uint64
+}
+
+// currentGatewayStats returns the relay counters, or nil when the agent is not a gateway
+func currentGatewayStats() *GatewayStats {
+	if !gatewayStats.active.Load() {
+		return nil
+	}
+	return &GatewayStats{
+		Requests: gatewayStats.requests.Load(),
+		Errors:   gatewayStats.errors.Load(),
+		Rejected: gatewayStats.rejected.Load(),
+	}
+}
+
+// GatewayService relays the Somana API for agents on an isolated subnet, so only the
+// gateway needs outbound connectivity. Agents behind it use the gateway's address as
+// their sprinter_url; requests are forwarded unchanged over the shared connection pool.
+type GatewayService struct {
+	config   *config.Config
+	allowed  []*net.IPNet
+	server   *http.Server
+	hostname string
+}
+
+// NewGatewayService creates a new gateway service
+func NewGatewayService(cfg *config.Config) *GatewayService {
+	hostname, _ := hostHostname()
+	return &GatewayService{config: cfg, hostname: hostname}
+}
+
+// Start listens for agents and relays their requests upstream
+func (s *GatewayService) Start() error {
+	if !s.config.Gateway.Enabled {
+		log.Println("Gateway mode not enabled - skipping")
+		return nil
+	}
+
+	for _, cidr := range s.config.Gateway.AllowedNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid gateway allowed network %s: %w", cidr, err)
+		}
+		s.allowed = append(s.allowed, network)
+	}
+	if len(s.allowed) == 0 {
+		return errors.New("gateway.allowed_networks must list the subnets allowed to relay")
+	}
+
+	upstream, err := url.Parse(s.config.HostRegistration.SprinterURL)
+	if err != nil {
+		return fmt.Errorf("invalid upstream URL: %w", err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	proxy.Transport = apiTransport
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Host = upstream.Host
+		req.Header.Set(gatewayHeader, s.hostname)
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		gatewayStats.errors.Add(1)
+		log.Printf("Failed to relay %s %s: %v", req.Method, req.URL.Path, err)
+		// Agents treat 502 like an unreachable server and retry later
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	listener, err := net.Listen("tcp", s.config.Gateway.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.config.Gateway.Listen, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", s.authorize(proxy))
+	s.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if s.config.Gateway.TLSCert != "" {
+		s.server.TLSConfig = restrictTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+		go s.serve(func() error {
+			return s.server.ServeTLS(listener, s.config.Gateway.TLSCert, s.config.Gateway.TLSKey)
+		})
+	} else {
+		go s.serve(func() error { return s.server.Serve(listener) })
+	}
+	gatewayStats.active.Store(true)
+
+	log.Printf("Gateway relaying agents on %s to %s", listener.Addr(), upstream.Redacted())
+	return nil
+}
+
+// serve runs the server until it is shut down
+func (s *GatewayService) serve(run func() error) {
+	defer recoverPanic("gateway")
+	if err := run(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Gateway server failed: %v", err)
+	}
+}
+
+// Stop shuts the gateway down, letting relayed requests in flight finish
+func (s *GatewayService) Stop() {
+	if s.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s.server.Shutdown(ctx)
+	gatewayStats.active.Store(false)
+	log.Println("Gateway stopped")
+}
+
+// authorize only relays requests from the allowed networks
+func (s *GatewayService) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || !s.allows(ip) {
+			gatewayStats.rejected.Add(1)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		gatewayStats.requests.Add(1)
+		next.ServeHTTP(w, req)
+	})
+}
+
+// allows reports whether ip is in one of the allowed networks
+func (s *GatewayService) allows(ip net.IP) bool {
+	for _, network := range s.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
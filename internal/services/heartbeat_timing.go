@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HeartbeatTiming is the network timing of a heartbeat, a per-agent signal of the network
+// quality between the host and the server. Phase timings are only set when the heartbeat
+// opened a new connection; a reused connection skips DNS, connect and TLS.
+type HeartbeatTiming struct {
+	At                  time.Time `json:"at"`
+	Reachable           bool      `json:"reachable"`
+	Error               string    `json:"error,omitempty"`
+	RTTMillis           float64   `json:"rtt_ms"`
+	DNSMillis           *float64  `json:"dns_ms,omitempty"`
+	ConnectMillis       *float64  `json:"connect_ms,omitempty"`
+	TLSMillis           *float64  `json:"tls_ms,omitempty"`
+	FirstByteMillis     float64   `json:"first_byte_ms,omitempty"`
+	ReusedConn          bool      `json:"reused_conn"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+}
+
+var heartbeatTiming = struct {
+	sync.Mutex
+	last *HeartbeatTiming
+}{}
+
+// currentHeartbeatTiming returns the timing of the last heartbeat, or nil before the first.
+// Each heartbeat carries the timing of the one before it.
+func currentHeartbeatTiming() *HeartbeatTiming {
+	heartbeatTiming.Lock()
+	defer heartbeatTiming.Unlock()
+	if heartbeatTiming.last == nil {
+		return nil
+	}
+	timing := *heartbeatTiming.last
+	return &timing
+}
+
+// traceHeartbeat returns a context timing the request sent with it, and a function
+// recording the timing once the request completed with err
+func traceHeartbeat(ctx context.Context) (context.Context, func(err error)) {
+	var (
+		mu                                 sync.Mutex
+		start                              = time.Now()
+		dnsStart, connectStart, tlsStart   time.Time
+		dns, connect, handshake, firstByte time.Duration
+		reused                             bool
+	)
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart = time.Now()
+			mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			dns = time.Since(dnsStart)
+			mu.Unlock()
+		},
+		ConnectStart: func(string, string) {
+			mu.Lock()
+			connectStart = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(string, string, error) {
+			mu.Lock()
+			connect = time.Since(connectStart)
+			mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			mu.Lock()
+			handshake = time.Since(tlsStart)
+			mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			reused = info.Reused
+			mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			firstByte = time.Since(start)
+			mu.Unlock()
+		},
+	}
+
+	done := func(err error) {
+		mu.Lock()
+		// Error statuses still prove the server is reachable
+		var urlErr *url.Error
+		timing := HeartbeatTiming{
+			At:              start,
+			Reachable:       !errors.As(err, &urlErr),
+			RTTMillis:       millis(time.Since(start)),
+			FirstByteMillis: millis(firstByte),
+			ReusedConn:      reused,
+		}
+		if !dnsStart.IsZero() {
+			timing.DNSMillis = millisPtr(dns)
+		}
+		if !connectStart.IsZero() {
+			timing.ConnectMillis = millisPtr(connect)
+		}
+		if !tlsStart.IsZero() {
+			timing.TLSMillis = millisPtr(handshake)
+		}
+		mu.Unlock()
+		if err != nil {
+			timing.Error = err.Error()
+		}
+
+		heartbeatTiming.Lock()
+		defer heartbeatTiming.Unlock()
+		if !timing.Reachable {
+			timing.ConsecutiveFailures = 1
+			if heartbeatTiming.last != nil {
+				timing.ConsecutiveFailures += heartbeatTiming.last.ConsecutiveFailures
+			}
+		}
+		heartbeatTiming.last = &timing
+	}
+	return httptrace.WithClientTrace(ctx, trace), done
+}
+
+// millis converts a duration to milliseconds with microsecond precision
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// millisPtr is millis for optional timings
+func millisPtr(d time.Duration) *float64 {
+	ms := millis(d)
+	return &ms
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"sprinter-agent/internal/generated"
+)
+
+// hostAPI wraps the generated client's host calls so the agent keeps working against
+// newer or older servers. The generated client only accepts the exact status codes and
+// response shapes in the schema; the wrapper degrades gracefully instead:
+//   - any 2xx status is success, so a create answered with 200 instead of 201 registers
+//   - a success response whose body does not decode is still a success, since the
+//     server did what was asked; only the returned details are lost
+//
+// Unknown response fields are ignored by the JSON decoding already.
+type hostAPI struct {
+	client *generated.ClientWithResponses
+}
+
+// isSuccess reports whether a status code means the request was accepted
+func isSuccess(statusCode int) bool {
+	return statusCode >= 200 && statusCode < 300
+}
+
+// isDecodeError reports whether a generated client error came from parsing a response
+// rather than from sending the request. The generated client only parses responses with
+// the status codes it expects, so the server accepted the request.
+func isDecodeError(err error) bool {
+	var urlErr *url.Error
+	return err != nil && !errors.As(err, &urlErr) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// exists reports whether the server knows the host RID
+func (a *hostAPI) exists(ctx context.Context, hostRid string) (bool, error) {
+	resp, err := a.client.GetApiV1HostsHostRidWithResponse(ctx, generated.HostRid(hostRid))
+	if isDecodeError(err) {
+		log.Printf("Warning: unexpected host response from server, assuming host %s exists: %v", hostRid, err)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case resp.StatusCode() == http.StatusNotFound:
+		return false, nil
+	case isSuccess(resp.StatusCode()):
+		return true, nil
+	default:
+		return false, fmt.Errorf("host lookup failed with status: %d", resp.StatusCode())
+	}
+}
+
+// create registers a host and returns the RID the server assigned, which is the requested
+// RID when the server does not say otherwise
+func (a *hostAPI) create(ctx context.Context, body generated.HostCreateRequest, reqEditors ...generated.RequestEditorFn) (string, error) {
+	resp, err := a.client.PostApiV1HostsWithResponse(ctx, body, reqEditors...)
+	if isDecodeError(err) {
+		log.Printf("Warning: unexpected registration response from server, keeping RID %s: %v", body.HostRid, err)
+		return string(body.HostRid), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !isSuccess(resp.StatusCode()) {
+		return "", fmt.Errorf("registration failed with status: %d", resp.StatusCode())
+	}
+	if resp.JSON201 == nil || resp.JSON201.HostRid == "" {
+		if resp.StatusCode() == http.StatusCreated {
+			log.Printf("Warning: server returned no host data, keeping RID %s", body.HostRid)
+		}
+		return string(body.HostRid), nil
+	}
+	return string(resp.JSON201.HostRid), nil
+}
+
+// update changes a host's details; a 409 means the RID belongs to another machine
+func (a *hostAPI) update(ctx context.Context, hostRid string, body generated.HostUpdateRequest, reqEditors ...generated.RequestEditorFn) error {
+	resp, err := a.client.PutApiV1HostsHostRidWithResponse(ctx, generated.HostRid(hostRid), body, reqEditors...)
+	if isDecodeError(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update host: %w", err)
+	}
+	if resp.StatusCode() == http.StatusConflict {
+		return errIdentityConflict
+	}
+	if !isSuccess(resp.StatusCode()) {
+		return fmt.Errorf("update failed with status: %d", resp.StatusCode())
+	}
+	return nil
+}
+
+// heartbeat sends a heartbeat; a 409 means the RID belongs to another machine
+func (a *hostAPI) heartbeat(ctx context.Context, hostRid string, body generated.HostHeartbeatRequest, reqEditors ...generated.RequestEditorFn) error {
+	resp, err := a.client.PostApiV1HostsHostRidHeartbeatWithResponse(ctx, generated.HostRid(hostRid), body, reqEditors...)
+	if isDecodeError(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send heartbeat: %w", err)
+	}
+	if resp.StatusCode() == http.StatusConflict {
+		return errIdentityConflict
+	}
+	if !isSuccess(resp.StatusCode()) {
+		return &apiStatusError{Path: hostPath(hostRid, "/heartbeat"), StatusCode: resp.StatusCode()}
+	}
+	return nil
+}
@@ -12,11 +12,13 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 
 	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/execwrap"
 	"sprinter-agent/internal/generated"
 )
 
@@ -24,15 +26,36 @@ import (
 type HostRegistrationService struct {
 	config   *config.Config
 	client   *generated.ClientWithResponses
+	api      *hostAPI
 	hostRid  string
 	stopChan chan bool
+	stopOnce sync.Once
+
+	// k8s is the node identity when running as a Kubernetes DaemonSet
+	k8s *kubernetesIdentity
+
+	// identity fingerprints this machine so clones sharing a RID can be told apart
+	identity     string
+	conflict     chan struct{}
+	conflictOnce sync.Once
+
+	// hostname and ipAddress are what the server last accepted for this host
+	hostname         string
+	ipAddress        string
+	lastAddressCheck time.Time
+
+	healthMu sync.Mutex
+	health   heartbeatHealth
 }
 
+// errIdentityConflict is returned when the server holds the RID for a different machine
+var errIdentityConflict = errors.New("host RID is registered to a different machine")
+
 // NewHostRegistrationService creates a new host registration service
 func NewHostRegistrationService(cfg *config.Config) *HostRegistrationService {
 	log.Printf("Creating host registration service with URL: %s", cfg.HostRegistration.SprinterURL)
 	
-	httpClient := &http.Client{Timeout: 10 * time.Second}
+	httpClient := newAPIClient()
 	apiClient, err := generated.NewClientWithResponses(cfg.HostRegistration.SprinterURL, generated.WithHTTPClient(httpClient))
 	if err != nil {
 		log.Printf("Warning: failed to create client: %v", err)
@@ -43,7 +66,11 @@ func NewHostRegistrationService(cfg *config.Config) *HostRegistrationService {
 	return &HostRegistrationService{
 		config:   cfg,
 		client:   apiClient,
+		api:      &hostAPI{client: apiClient},
 		stopChan: make(chan bool),
+		k8s:      detectKubernetes(cfg),
+		identity: machineIdentity(cfg.Instance),
+		conflict: make(chan struct{}),
 	}
 }
 
@@ -54,15 +81,14 @@ func (s *HostRegistrationService) Start() error {
 		return nil
 	}
 
-	// Get system information
-	hostname, err := os.Hostname()
-	if err != nil {
-		return fmt.Errorf("failed to get hostname: %w", err)
+	if s.k8s != nil {
+		log.Printf("Running as a Kubernetes DaemonSet pod on node %s", s.k8s.Node)
 	}
 
-	ipAddress, err := s.getIP()
+	// Get system information
+	hostname, ipAddress, err := s.currentAddress()
 	if err != nil {
-		return fmt.Errorf("failed to get IP address: %w", err)
+		return err
 	}
 
 	osVersion, err := s.getOSVersion()
@@ -78,8 +104,43 @@ func (s *HostRegistrationService) Start() error {
 	return nil
 }
 
+// Register registers the host once, without retrying or starting heartbeats, and returns
+// its RID; the RID is saved to disk as when the agent registers on start
+func (s *HostRegistrationService) Register() (string, error) {
+	hostname, ipAddress, err := s.currentAddress()
+	if err != nil {
+		return "", err
+	}
+	osVersion, err := s.getOSVersion()
+	if err != nil {
+		osVersion = "Unknown"
+	}
+	if err := s.registerHost(hostname, ipAddress, osVersion); err != nil {
+		return "", err
+	}
+	return s.hostRid, nil
+}
+
+// StoredHostRid returns the host RID an earlier registration saved on disk, or an empty
+// string when there is none
+func (s *HostRegistrationService) StoredHostRid() string {
+	rid, err := s.loadHostRid()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return rid
+}
+
+// SendHeartbeat sends a single heartbeat, for runs that do not start the heartbeat loop
+func (s *HostRegistrationService) SendHeartbeat() error {
+	err := s.sendHeartbeat()
+	s.recordHeartbeat(err)
+	return err
+}
+
 // registrationLoop continuously retries host registration until successful
 func (s *HostRegistrationService) registrationLoop(hostname, ipAddress, osVersion string) {
+	defer recoverPanic("host_registration")
 	retryDelay := 5 * time.Second
 	maxRetryDelay := 5 * time.Minute
 
@@ -93,6 +154,9 @@ func (s *HostRegistrationService) registrationLoop(hostname, ipAddress, osVersio
 			if err == nil {
 				// Registration successful
 				log.Printf("Host registration successful - Host RID: %s", s.hostRid)
+				s.markRegistered()
+				s.hostname, s.ipAddress = hostname, ipAddress
+				s.lastAddressCheck = time.Now()
 				
 				// Start heartbeat goroutine
 				go s.startHeartbeat()
@@ -125,9 +189,55 @@ func (s *HostRegistrationService) GetClient() *generated.ClientWithResponses {
 // Stop stops the heartbeat process
 func (s *HostRegistrationService) Stop() {
 	if s.config.HostRegistration.SprinterURL != "" {
-		close(s.stopChan)
-		log.Println("Host registration stopped")
+		s.stopOnce.Do(func() {
+			close(s.stopChan)
+			log.Println("Host registration stopped")
+		})
+	}
+}
+
+// Deregister decommissions this host on the server and wipes local agent state
+func (s *HostRegistrationService) Deregister() error {
+	s.Stop()
+
+	hostRid := s.hostRid
+	if hostRid == "" {
+		var err error
+		if hostRid, err = s.loadHostRid(); err != nil {
+			return err
+		}
+	}
+
+	if hostRid == "" {
+		log.Println("No host RID found - nothing to deregister on the server")
+	} else {
+		ctx := context.Background()
+		err := sendJSON(ctx, s.config, http.MethodDelete, hostPath(hostRid, ""), nil, nil)
+		var statusErr *apiStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			log.Printf("Host %s was already removed from the server", hostRid)
+		} else if err != nil {
+			return fmt.Errorf("failed to deregister host: %w", err)
+		} else {
+			log.Printf("Deregistered host with RID: %s", hostRid)
+		}
 	}
+
+	if err := s.wipeLocalState(); err != nil {
+		return err
+	}
+	s.hostRid = ""
+	return nil
+}
+
+// wipeLocalState removes the data directory holding the host RID and collector state
+func (s *HostRegistrationService) wipeLocalState() error {
+	dir := filepath.Dir(s.getRidFilePath())
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove local state in %s: %w", dir, err)
+	}
+	log.Printf("Removed local agent state in %s", dir)
+	return nil
 }
 
 // registerHost registers this host with the main Somana instance
@@ -136,10 +246,21 @@ func (s *HostRegistrationService) registerHost(hostname, ipAddress, osVersion st
 
 	log.Printf("Attempting to register host: %s (%s) - %s", hostname, ipAddress, osVersion)
 
-	// Check if we have a host RID stored on disk
-	hostRid, err := s.loadHostRid()
-	if err != nil {
-		log.Printf("Failed to load host RID from disk: %v", err)
+	// Check if we have a host RID stored on disk; ephemeral hosts only reuse the RID
+	// generated by an earlier attempt of this process
+	hostRid := s.hostRid
+	if !s.config.HostRegistration.Ephemeral {
+		var err error
+		hostRid, err = s.loadHostRid()
+		if err != nil {
+			log.Printf("Failed to load host RID from disk: %v", err)
+		}
+		// A RID baked into a cloned image was recorded by the machine the image came from
+		dir := filepath.Dir(s.getRidFilePath())
+		if hostRid != "" && identityConflict(loadMachineIdentity(dir), s.identity) {
+			log.Printf("Warning: host RID %s on disk belongs to a different machine (cloned image?), registering as a new host", hostRid)
+			hostRid = ""
+		}
 	}
 
 	// If RID exists on disk, verify it exists on the server
@@ -147,23 +268,32 @@ func (s *HostRegistrationService) registerHost(hostname, ipAddress, osVersion st
 		log.Printf("Found host RID on disk: %s, verifying with server", hostRid)
 		
 		// Check if host exists with this RID
-		resp, err := s.client.GetApiV1HostsHostRidWithResponse(ctx, generated.HostRid(hostRid))
+		exists, err := s.api.exists(ctx, hostRid)
 		if err != nil {
 			log.Printf("Failed to check host existence: %v", err)
 			return fmt.Errorf("failed to check host existence: %w", err)
 		}
 
-		if resp.StatusCode() == http.StatusOK && resp.JSON200 != nil {
+		if exists && s.ownsHostRid(ctx, hostRid) {
 			// Host exists with this RID, use it
 			s.hostRid = hostRid
 			log.Printf("Verified existing host with RID: %s", s.hostRid)
 			
 			// Update host information in case it changed
-			if err := s.updateHost(hostname, ipAddress); err != nil {
-				log.Printf("Warning: failed to update host information: %v", err)
+			err := s.updateHost(hostname, ipAddress)
+			if errors.Is(err, errIdentityConflict) {
+				log.Printf("Warning: server rejected host RID %s as %v, registering as a new host", hostRid, err)
+				hostRid = ""
+			} else {
+				if err != nil {
+					log.Printf("Warning: failed to update host information: %v", err)
+				}
+				s.saveIdentity()
+				return nil
 			}
-			
-			return nil
+		} else if exists {
+			log.Printf("Warning: host RID %s is registered to a different machine, registering as a new host", hostRid)
+			hostRid = ""
 		} else {
 			log.Printf("Host with RID %s does not exist on server, will create new host", hostRid)
 			// RID exists on disk but not on server - create new host with this RID
@@ -171,6 +301,21 @@ func (s *HostRegistrationService) registerHost(hostname, ipAddress, osVersion st
 	}
 
 	// Generate new RID if we don't have one
+	if hostRid == "" && s.k8s != nil {
+		hostRid = s.k8s.hostRid()
+		log.Printf("Derived host RID %s from node %s", hostRid, s.k8s.Node)
+		if s.hostExists(ctx, hostRid) {
+			s.hostRid = hostRid
+			log.Printf("Node already registered, reusing host RID: %s", hostRid)
+			if err := s.updateHost(hostname, ipAddress); err != nil {
+				log.Printf("Warning: failed to update host information: %v", err)
+			}
+			if err := s.saveHostRid(hostRid); err != nil {
+				log.Printf("Warning: failed to save host RID to disk: %v", err)
+			}
+			return nil
+		}
+	}
 	if hostRid == "" {
 		hostRid = s.generateHostRid()
 		log.Printf("Generated new host RID: %s", hostRid)
@@ -202,35 +347,25 @@ func (s *HostRegistrationService) registerHost(hostname, ipAddress, osVersion st
 	}
 
 	log.Printf("Sending registration request to: %s/api/v1/hosts", s.config.HostRegistration.SprinterURL)
-	resp, err := s.client.PostApiV1HostsWithResponse(ctx, reqBody)
+	serverRid, err := s.api.create(ctx, reqBody, s.hostMetadata(), enrollmentToken(s.config))
 	if err != nil {
 		log.Printf("Registration request failed: %v", err)
 		return fmt.Errorf("failed to register host: %w", err)
 	}
 
-	log.Printf("Registration response status: %d", resp.StatusCode())
-	if resp.StatusCode() != http.StatusCreated {
-		log.Printf("Registration failed with status: %d", resp.StatusCode())
-		return fmt.Errorf("registration failed with status: %d", resp.StatusCode())
-	}
-
-	if resp.JSON201 == nil {
-		log.Printf("No host data in response")
-		return fmt.Errorf("no host data in response")
-	}
-
 	// Use the RID from the server response (server may have validated/modified it)
-	serverRid := string(resp.JSON201.HostRid)
-	if serverRid == "" {
-		log.Printf("Warning: Server returned empty RID, using locally generated RID: %s", s.hostRid)
-	} else if serverRid != s.hostRid {
+	if serverRid != s.hostRid {
 		log.Printf("Server returned different RID (%s) than we sent (%s), using server RID", serverRid, s.hostRid)
 		s.hostRid = serverRid
 	}
 
 	// Save the RID to disk
-	if err := s.saveHostRid(s.hostRid); err != nil {
+	if s.config.HostRegistration.Ephemeral {
+		log.Printf("Ephemeral mode - not persisting host RID")
+	} else if err := s.saveHostRid(s.hostRid); err != nil {
 		log.Printf("Warning: failed to save host RID to disk: %v", err)
+	} else {
+		s.saveIdentity()
 	}
 
 	log.Printf("Successfully registered host with RID: %s", s.hostRid)
@@ -246,16 +381,109 @@ func (s *HostRegistrationService) updateHost(hostname, ipAddress string) error {
 		IpAddress: &ipAddress,
 	}
 
-	resp, err := s.client.PutApiV1HostsHostRidWithResponse(ctx, generated.HostRid(s.hostRid), reqBody)
+	return s.api.update(ctx, s.hostRid, reqBody, s.hostMetadata())
+}
+
+// ownsHostRid reports whether the server's recorded identity for the RID is this machine's.
+// Lookup failures give the RID the benefit of the doubt.
+func (s *HostRegistrationService) ownsHostRid(ctx context.Context, hostRid string) bool {
+	recorded, err := recordedIdentity(ctx, s.config, hostRid)
 	if err != nil {
-		return fmt.Errorf("failed to update host: %w", err)
+		log.Printf("Warning: failed to look up machine identity of host %s: %v", hostRid, err)
+		return true
 	}
+	return !identityConflict(recorded, s.identity)
+}
 
-	if resp.StatusCode() != http.StatusOK {
-		return fmt.Errorf("update failed with status: %d", resp.StatusCode())
+// saveIdentity records this machine as the owner of the persisted host RID
+func (s *HostRegistrationService) saveIdentity() {
+	if s.config.HostRegistration.Ephemeral {
+		return
 	}
+	if err := saveMachineIdentity(filepath.Dir(s.getRidFilePath()), s.identity); err != nil {
+		log.Printf("Warning: failed to save machine identity: %v", err)
+	}
+}
 
-	return nil
+// IdentityConflict is closed when the server reports that the host RID in use belongs to
+// another machine. The persisted RID is discarded by then, so a restart registers afresh.
+func (s *HostRegistrationService) IdentityConflict() <-chan struct{} {
+	return s.conflict
+}
+
+// resolveConflict forgets the host RID claimed by another machine and signals the conflict
+func (s *HostRegistrationService) resolveConflict() {
+	s.conflictOnce.Do(func() {
+		log.Printf("Warning: host RID %s is registered to a different machine, discarding it", s.hostRid)
+		if !s.config.HostRegistration.Ephemeral {
+			dir := filepath.Dir(s.getRidFilePath())
+			for _, name := range []string{filepath.Base(s.getRidFilePath()), machineIdentityFile} {
+				if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+					log.Printf("Warning: failed to remove %s: %v", name, err)
+				}
+			}
+		}
+		close(s.conflict)
+	})
+}
+
+// enrollmentToken returns a request editor authorizing a host registration with the
+// cloud identity token or the configured enrollment token, if any
+func enrollmentToken(cfg *config.Config) generated.RequestEditorFn {
+	return func(ctx context.Context, req *http.Request) error {
+		_, err := AuthorizeEnrollment(ctx, cfg, req)
+		return err
+	}
+}
+
+// hostMetadata returns a request editor adding the configured labels, environment, team and tags
+func (s *HostRegistrationService) hostMetadata() generated.RequestEditorFn {
+	return mergeJSONBody(s.metadataFields())
+}
+
+// metadataFields returns the labels, environment, team, tags, instance and identity sent with
+// the host
+func (s *HostRegistrationService) metadataFields() map[string]interface{} {
+	fields := make(map[string]interface{})
+	labels := make(map[string]string)
+	if s.k8s != nil {
+		for key, value := range s.k8s.Labels {
+			labels[key] = value
+		}
+		fields["kubernetes"] = s.k8s
+	}
+	// Configured labels win over those from the downward API
+	for key, value := range s.config.Labels {
+		labels[key] = value
+	}
+	if len(labels) > 0 {
+		fields["labels"] = labels
+	}
+	if s.config.Environment != "" {
+		fields["environment"] = s.config.Environment
+	}
+	if s.config.Team != "" {
+		fields["team"] = s.config.Team
+	}
+	if len(s.config.Tags) > 0 {
+		fields["tags"] = s.config.Tags
+	}
+	if s.config.HostRegistration.Ephemeral {
+		fields["ephemeral"] = true
+	}
+	if s.config.Instance != "" {
+		fields["instance"] = s.config.Instance
+	}
+	if s.identity != "" {
+		fields["machine_identity"] = s.identity
+	}
+	return fields
+}
+
+// hostExists reports whether a host with the RID is registered on the server
+func (s *HostRegistrationService) hostExists(ctx context.Context, hostRid string) bool {
+	exists, err := s.api.exists(ctx, hostRid)
+	return err == nil && exists
 }
 
 // generateHostRid generates a new UUID-based RID
@@ -308,11 +536,14 @@ func (s *HostRegistrationService) saveHostRid(rid string) error {
 
 // startHeartbeat starts the heartbeat process
 func (s *HostRegistrationService) startHeartbeat() {
-	ticker := time.NewTicker(5 * time.Second)
+	defer recoverPanic("heartbeat")
+	ticker := newReportTicker(s.heartbeatInterval())
 	defer ticker.Stop()
 
 	// Send initial heartbeat immediately
-	if err := s.sendHeartbeat(); err != nil {
+	err := s.sendHeartbeat()
+	s.recordHeartbeat(err)
+	if err != nil {
 		log.Printf("Failed to send initial heartbeat: %v", err)
 	} else {
 		log.Printf("Heartbeat sent successfully")
@@ -321,17 +552,84 @@ func (s *HostRegistrationService) startHeartbeat() {
 	for {
 		select {
 		case <-ticker.C:
-			if err := s.sendHeartbeat(); err != nil {
+			s.checkAddressChange()
+			err := s.sendHeartbeat()
+			s.recordHeartbeat(err)
+			if err != nil {
 				log.Printf("Failed to send heartbeat: %v (will retry on next interval)", err)
 			} else {
 				log.Printf("Heartbeat sent successfully")
 			}
+		case <-s.conflict:
+			return
 		case <-s.stopChan:
 			return
 		}
 	}
 }
 
+// currentAddress returns the hostname and IP address the host registers with
+func (s *HostRegistrationService) currentAddress() (string, string, error) {
+	hostname, err := hostHostname()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get hostname: %w", err)
+	}
+	if s.k8s != nil {
+		// The pod's hostname changes on every restart; the node's name does not
+		hostname = s.k8s.Node
+	}
+
+	var ipAddress string
+	if s.k8s != nil && s.k8s.HostIP != "" {
+		ipAddress = s.k8s.HostIP
+	} else if ipAddress, err = s.getIP(); err != nil {
+		return "", "", fmt.Errorf("failed to get IP address: %w", err)
+	}
+	return hostname, ipAddress, nil
+}
+
+// checkAddressChange updates the host on the server when its hostname or IP address
+// changed since registration, such as after a DHCP lease renewal. A failed update is
+// retried on the next check.
+func (s *HostRegistrationService) checkAddressChange() {
+	interval := s.config.HostRegistration.AddressCheckInterval
+	if interval <= 0 || time.Since(s.lastAddressCheck) < interval {
+		return
+	}
+	s.lastAddressCheck = time.Now()
+
+	hostname, ipAddress, err := s.currentAddress()
+	if err != nil {
+		log.Printf("Failed to check host address: %v", err)
+		return
+	}
+	if hostname == s.hostname && ipAddress == s.ipAddress {
+		return
+	}
+
+	log.Printf("Host address changed from %s (%s) to %s (%s), updating server", s.hostname, s.ipAddress, hostname, ipAddress)
+	if err := s.updateHost(hostname, ipAddress); err != nil {
+		if errors.Is(err, errIdentityConflict) {
+			s.resolveConflict()
+			return
+		}
+		log.Printf("Failed to update host address: %v", err)
+		return
+	}
+	s.hostname, s.ipAddress = hostname, ipAddress
+}
+
+// heartbeatInterval returns the heartbeat period, which is shorter for ephemeral hosts
+func (s *HostRegistrationService) heartbeatInterval() time.Duration {
+	if s.config.HostRegistration.Ephemeral && s.config.HostRegistration.EphemeralHeartbeatInterval > 0 {
+		return s.config.HostRegistration.EphemeralHeartbeatInterval
+	}
+	if s.config.HostRegistration.HeartbeatInterval > 0 {
+		return s.config.HostRegistration.HeartbeatInterval
+	}
+	return 5 * time.Second
+}
+
 // sendHeartbeat sends a heartbeat to the main Somana instance
 func (s *HostRegistrationService) sendHeartbeat() error {
 	if s.hostRid == "" {
@@ -343,36 +641,53 @@ func (s *HostRegistrationService) sendHeartbeat() error {
 	// API changed: status field removed, server tracks last_heartbeat automatically
 	reqBody := generated.HostHeartbeatRequest{}
 
-	resp, err := s.client.PostApiV1HostsHostRidHeartbeatWithResponse(ctx, generated.HostRid(s.hostRid), reqBody)
-	if err != nil {
-		return fmt.Errorf("failed to send heartbeat: %w", err)
+	// Collector states let the server show which collectors were skipped due to permissions
+	state := map[string]interface{}{
+		"collectors":    CollectorStatuses(),
+		"agent_metrics": currentAgentMetrics(),
+	}
+	if window, ok := CurrentMaintenance(); ok {
+		state["maintenance"] = window
+	}
+	// The server pins the key over HTTPS, so datagrams signed with it can be trusted later
+	if key := udpHeartbeatPublicKey(s.config); key != "" {
+		state["udp_heartbeat_key"] = key
+	}
+	if key := signingPublicKey(); key != "" {
+		state["signing_key"] = key
 	}
 
-	if resp.StatusCode() != http.StatusOK {
-		return fmt.Errorf("heartbeat failed with status: %d", resp.StatusCode())
+	// Over MQTT the heartbeat carries the metadata itself; the broker cannot report conflicts
+	if publisher := currentMQTT(); publisher != nil {
+		for key, value := range s.metadataFields() {
+			state[key] = value
+		}
+		path := hostPath(s.hostRid, "/heartbeat")
+		return publisher.publish("heartbeat", http.MethodPost, path, state)
 	}
 
-	return nil
+	agentState := mergeJSONBody(state)
+	ctx, recordTiming := traceHeartbeat(ctx)
+	err := s.api.heartbeat(ctx, s.hostRid, reqBody, s.hostMetadata(), agentState)
+	recordTiming(err)
+
+	// The server answers 409 when another machine with a different identity owns the RID
+	if errors.Is(err, errIdentityConflict) {
+		s.resolveConflict()
+	}
+	return err
 }
 
 // getIP gets the IP address, preferring Tailscale IP if available
 func (s *HostRegistrationService) getIP() (string, error) {
 	// Try to get IP from tailscale first
-	cmd := exec.Command("tailscale", "ip")
-	output, err := cmd.Output()
+	output, err := execwrap.Output(context.Background(), execwrap.Options{}, "tailscale", "ip")
 	if err != nil {
 		// Check if tailscale command exists
 		if _, lookErr := exec.LookPath("tailscale"); lookErr != nil {
 			log.Printf("tailscale command not found in PATH, falling back to hostname lookup")
 		} else {
-			// Command exists but failed - get stderr for details
-			var exitError *exec.ExitError
-			if errors.As(err, &exitError) {
-				stderr := string(exitError.Stderr)
-				log.Printf("tailscale ip command failed (exit code %d): %s, falling back to hostname lookup", exitError.ExitCode(), stderr)
-			} else {
-				log.Printf("tailscale ip command failed: %v, falling back to hostname lookup", err)
-			}
+			log.Printf("%v, falling back to hostname lookup", err)
 		}
 	} else {
 		// Command succeeded, parse output
@@ -417,7 +732,7 @@ func (s *HostRegistrationService) getOSVersion() (string, error) {
 	switch runtime.GOOS {
 	case "linux":
 		// Try to read /etc/os-release
-		if data, err := os.ReadFile("/etc/os-release"); err == nil {
+		if data, err := os.ReadFile(hostFile("/etc/os-release")); err == nil {
 			lines := strings.Split(string(data), "\n")
 			for _, line := range lines {
 				if strings.HasPrefix(line, "PRETTY_NAME=") {
@@ -428,13 +743,13 @@ func (s *HostRegistrationService) getOSVersion() (string, error) {
 		}
 
 		// Fallback to uname
-		if output, err := exec.Command("uname", "-r").Output(); err == nil {
+		if output, err := execwrap.Output(context.Background(), execwrap.Options{}, "uname", "-r"); err == nil {
 			return "Linux " + strings.TrimSpace(string(output)), nil
 		}
 
 		return "Linux", nil
 	case "darwin":
-		if output, err := exec.Command("sw_vers", "-productVersion").Output(); err == nil {
+		if output, err := execwrap.Output(context.Background(), execwrap.Options{}, "sw_vers", "-productVersion"); err == nil {
 			return "macOS " + strings.TrimSpace(string(output)), nil
 		}
 		return "macOS", nil
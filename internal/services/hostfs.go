@@ -0,0 +1,186 @@
+package services
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"sprinter-agent/internal/config"
+)
+
+// Host modes
+const (
+	HostModeAuto      = "auto"
+	HostModeHost      = "host"
+	HostModeContainer = "container"
+)
+
+// hostFS maps host paths to where the host's filesystems are visible to the agent. Outside
+// a container every path maps to itself.
+var hostFS = struct {
+	sync.RWMutex
+	container bool
+	// mounts are ordered longest host path first
+	mounts []hostMount
+}{}
+
+// hostMount is a host directory visible to the agent at another path
+type hostMount struct {
+	hostPath  string
+	localPath string
+}
+
+// ConfigureHost sets up reading the host through mounts when the agent runs in a
+// container, so collectors report on the host rather than the container
+func ConfigureHost(cfg *config.Config) {
+	container := cfg.Host.Mode == HostModeContainer || (cfg.Host.Mode == HostModeAuto && RunningInContainer())
+	if !container {
+		return
+	}
+
+	var mounts []hostMount
+	add := func(hostPath, configured, fallback string) {
+		if configured != "" {
+			mounts = append(mounts, hostMount{hostPath, configured})
+			return
+		}
+		// Defaults are only used when the host directory is actually mounted
+		if info, err := os.Stat(fallback); err == nil && info.IsDir() {
+			mounts = append(mounts, hostMount{hostPath, fallback})
+		}
+	}
+	add("/var/log", cfg.Host.LogRoot, "/host/var/log")
+	add("/proc", cfg.Host.ProcRoot, "/host/proc")
+	add("/sys", cfg.Host.SysRoot, "/host/sys")
+	add("/", cfg.Host.RootFS, "/host")
+
+	if len(mounts) == 0 {
+		log.Println("Warning: Running in a container without host mounts - collectors report on the container itself")
+	}
+
+	hostFS.Lock()
+	hostFS.container = true
+	hostFS.mounts = mounts
+	hostFS.Unlock()
+
+	// Collectors read systemd over the host's D-Bus socket
+	socket := cfg.Host.DBusSocket
+	if socket == "" {
+		socket = hostFile("/run/dbus/system_bus_socket")
+	}
+	if os.Getenv("DBUS_SYSTEM_BUS_ADDRESS") == "" {
+		if _, err := os.Stat(socket); err == nil {
+			os.Setenv("DBUS_SYSTEM_BUS_ADDRESS", "unix:path="+socket)
+		}
+	}
+
+	for _, mount := range mounts {
+		log.Printf("Container mode: reading host %s from %s", mount.hostPath, mount.localPath)
+	}
+}
+
+// RunningInContainer detects common container runtimes
+func RunningInContainer() bool {
+	if os.Getenv("container") != "" {
+		return true
+	}
+	for _, marker := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(marker); err == nil {
+			return true
+		}
+	}
+	data, err := os.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		return false
+	}
+	for _, runtime := range []string{"docker", "kubepods", "containerd", "libpod"} {
+		if strings.Contains(string(data), runtime) {
+			return true
+		}
+	}
+	return false
+}
+
+// inContainer reports whether the agent reads the host through mounts
+func inContainer() bool {
+	hostFS.RLock()
+	defer hostFS.RUnlock()
+	return hostFS.container
+}
+
+// HostReadPaths returns the mounted host directories the agent reads
+func HostReadPaths() []string {
+	hostFS.RLock()
+	defer hostFS.RUnlock()
+
+	paths := make([]string, len(hostFS.mounts))
+	for i, mount := range hostFS.mounts {
+		paths[i] = mount.localPath
+	}
+	return paths
+}
+
+// hostFile returns where an absolute host path is visible to the agent
+func hostFile(path string) string {
+	hostFS.RLock()
+	defer hostFS.RUnlock()
+
+	for _, mount := range hostFS.mounts {
+		if rest, ok := cutPathPrefix(path, mount.hostPath); ok {
+			return filepath.Join(mount.localPath, rest)
+		}
+	}
+	return path
+}
+
+// hostPathOf maps a path returned by hostFile back to the host path it shows
+func hostPathOf(local string) string {
+	hostFS.RLock()
+	defer hostFS.RUnlock()
+
+	for _, mount := range hostFS.mounts {
+		if rest, ok := cutPathPrefix(local, mount.localPath); ok {
+			return filepath.Join(mount.hostPath, rest)
+		}
+	}
+	return local
+}
+
+// hostProcSelf returns a /proc/self file of the host. Files such as /proc/net/tcp and
+// /proc/mounts follow the namespaces of the reading process, which in a container is the
+// agent, so the host's init process is read instead.
+func hostProcSelf(name string) string {
+	if inContainer() {
+		return hostFile(filepath.Join("/proc/1", name))
+	}
+	return filepath.Join("/proc/self", name)
+}
+
+// hostHostname returns the host's name. A container has its own UTS namespace, so the
+// host's /etc/hostname is preferred there.
+func hostHostname() (string, error) {
+	if inContainer() {
+		if data, err := os.ReadFile(hostFile("/etc/hostname")); err == nil {
+			if name := strings.TrimSpace(string(data)); name != "" {
+				return name, nil
+			}
+		}
+	}
+	return os.Hostname()
+}
+
+// cutPathPrefix strips a directory prefix from a path on a path element boundary
+func cutPathPrefix(path, prefix string) (string, bool) {
+	if prefix == "/" {
+		return path, strings.HasPrefix(path, "/")
+	}
+	if path == prefix {
+		return "", true
+	}
+	if rest, ok := strings.CutPrefix(path, prefix+"/"); ok {
+		return rest, true
+	}
+	return "", false
+}
@@ -0,0 +1,49 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// maxRetainedEvents bounds the events a collector keeps for resending while the server is
+// unreachable; the oldest are dropped first
+const maxRetainedEvents = 1000
+
+// idempotencyKeyHeader carries a request's idempotency key, letting the server recognise a
+// resent request it already processed
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// eventID derives a stable identifier for an event from the fields that make it unique, so
+// the same event keeps its ID when it is resent after a failed submission
+func eventID(kind string, parts ...string) string {
+	sum := sha256.Sum256([]byte(kind + "\x00" + strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// idempotencyKey derives the key of a request from its content. Resending a request with
+// the same body yields the same key. Only POST needs one; PUT replaces state and repeats
+// harmlessly.
+func idempotencyKey(method, path string, body []byte) string {
+	if method != http.MethodPost || body == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(method + " " + path + "\n" + string(body)))
+	return hex.EncodeToString(sum[:])
+}
+
+// retainEvents keeps events that failed to send for the next attempt, dropping the oldest
+// beyond maxRetainedEvents and raising a queue overflow when it does
+func retainEvents[T any](queue string, events []T) []T {
+	if dropped := len(events) - maxRetainedEvents; dropped > 0 {
+		log.Printf("Warning: %s queue is full, dropped the %d oldest unsent events", queue, dropped)
+		raiseHealthEvent(healthQueueOverflow, severityError, queue, "unsent events dropped while the server was unreachable", map[string]interface{}{
+			"dropped":  dropped,
+			"capacity": maxRetainedEvents,
+		})
+		events = events[dropped:]
+	}
+	return events
+}
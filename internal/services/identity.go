@@ -0,0 +1,113 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"sprinter-agent/internal/config"
+)
+
+// machineIdentityFile records the identity of the machine that owns data/host.rid, so a
+// cloned image carrying the file is recognised as a different host
+const machineIdentityFile = "machine.id"
+
+// machineIdentity returns a stable fingerprint of the machine: a hash of /etc/machine-id
+// and the MAC addresses of its physical network interfaces. It is empty when neither can
+// be read. Cloned VMs usually regenerate at least one of the two. A named instance adds its
+// name, so instances sharing a host are told apart.
+func machineIdentity(instance string) string {
+	var parts []string
+	if data, err := os.ReadFile(hostFile("/etc/machine-id")); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			parts = append(parts, "machine-id="+id)
+		}
+	}
+	for _, mac := range physicalMACs() {
+		parts = append(parts, "mac="+mac)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	if instance != "" {
+		parts = append(parts, "instance="+instance)
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// physicalMACs returns the sorted MAC addresses of the host's interfaces backed by a device.
+// Bridges, veths and other virtual interfaces come and go, so they are left out.
+func physicalMACs() []string {
+	netDir := hostFile("/sys/class/net")
+	entries, err := os.ReadDir(netDir)
+	if err != nil {
+		return nil
+	}
+
+	var macs []string
+	for _, entry := range entries {
+		if _, err := os.Stat(filepath.Join(netDir, entry.Name(), "device")); err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(netDir, entry.Name(), "address"))
+		if err != nil {
+			continue
+		}
+		mac := strings.ToLower(strings.TrimSpace(string(data)))
+		if mac == "" || mac == "00:00:00:00:00:00" {
+			continue
+		}
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+	return macs
+}
+
+// loadMachineIdentity returns the identity recorded next to the host RID, if any
+func loadMachineIdentity(dir string) string {
+	data, err := os.ReadFile(filepath.Join(dir, machineIdentityFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// saveMachineIdentity records the identity of the machine owning the host RID
+func saveMachineIdentity(dir, identity string) error {
+	if identity == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, machineIdentityFile), []byte(identity), 0644); err != nil {
+		return fmt.Errorf("failed to write machine identity file: %w", err)
+	}
+	return nil
+}
+
+// recordedIdentity returns the machine identity the server stored for the host RID.
+// Servers that do not track identities return an empty string.
+func recordedIdentity(ctx context.Context, cfg *config.Config, hostRid string) (string, error) {
+	var host struct {
+		MachineIdentity string `json:"machine_identity"`
+	}
+	if err := sendJSON(ctx, cfg, http.MethodGet, hostPath(hostRid, ""), nil, &host); err != nil {
+		return "", err
+	}
+	return host.MachineIdentity, nil
+}
+
+// identityConflict reports whether a recorded identity belongs to a different machine.
+// Unknown identities on either side never conflict.
+func identityConflict(recorded, current string) bool {
+	return recorded != "" && current != "" && recorded != current
+}
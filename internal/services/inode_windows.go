@@ -0,0 +1,9 @@
+package services
+
+import "os"
+
+// fileInode is 0 on Windows, which has no inode numbers; rotation is then only detected
+// by the file shrinking
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
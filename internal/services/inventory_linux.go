@@ -0,0 +1,188 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// packageList is the result of readInstalledPackages
+type packageList struct {
+	software []InstalledSoftware
+	backend  string
+}
+
+// installedPackages caches the installed packages; installing or removing one rewrites the
+// package database, which refreshes them
+var installedPackages = newCachedQuery("packages",
+	func(c *config.QueryCacheConfig) time.Duration { return c.PackagesTTL },
+	packageDatabaseStamp,
+	func() (packageList, error) {
+		software, backend, err := readInstalledPackages()
+		return packageList{software: software, backend: backend}, err
+	})
+
+// machineHardware caches the description of the machine, which only changes across reboots
+var machineHardware = newCachedQuery("hardware",
+	func(c *config.QueryCacheConfig) time.Duration { return c.HardwareTTL },
+	nil,
+	func() (HardwareInfo, error) { return readHardwareInfo(), nil })
+
+// packageDatabases are the files dpkg and rpm rewrite when packages change
+var packageDatabases = []string{
+	"/var/lib/dpkg/status",
+	"/var/lib/rpm/rpmdb.sqlite",
+	"/var/lib/rpm/Packages",
+	"/usr/lib/sysimage/rpm/rpmdb.sqlite",
+}
+
+// packageDatabaseStamp returns the size and modification time of the package databases
+func packageDatabaseStamp() string {
+	var stamp strings.Builder
+	for _, path := range packageDatabases {
+		if info, err := os.Stat(hostFile(path)); err == nil {
+			fmt.Fprintf(&stamp, "%s:%d:%d;", path, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return stamp.String()
+}
+
+// collectInventory reads installed packages from dpkg or rpm and hardware from DMI
+func collectInventory() (*InventorySnapshot, error) {
+	packages, err := installedPackages.get()
+	if err != nil {
+		return nil, err
+	}
+	hardware, _ := machineHardware.get()
+
+	snapshot := &InventorySnapshot{
+		Backend: packages.backend,
+		// inventoryHash sorts the list in place, and the cached one is shared
+		Software: append([]InstalledSoftware{}, packages.software...),
+		Updates:  UpdateStatus{Installed: []InstalledUpdate{}},
+		Hardware: hardware,
+	}
+	// Debian and Ubuntu flag updates that need a reboot
+	if _, err := os.Stat(hostFile("/var/run/reboot-required")); err == nil {
+		snapshot.Updates.RebootRequired = true
+	}
+	return snapshot, nil
+}
+
+// readInstalledPackages lists packages with dpkg-query or rpm, reading the host's
+// package database in container mode
+func readInstalledPackages() ([]InstalledSoftware, string, error) {
+	if _, err := exec.LookPath("dpkg-query"); err == nil {
+		args := []string{"-W", "-f", "${db:Status-Abbrev}\t${Package}\t${Version}\t${Maintainer}\n"}
+		if inContainer() {
+			args = append([]string{"--admindir=" + hostFile("/var/lib/dpkg")}, args...)
+		}
+		output, err := runInventoryCommand("dpkg-query", args...)
+		if err != nil {
+			return nil, "", err
+		}
+		return parseDpkgPackages(output), "dpkg", nil
+	}
+
+	if _, err := exec.LookPath("rpm"); err == nil {
+		args := []string{"-qa", "--qf", "%{NAME}\t%{VERSION}-%{RELEASE}\t%{VENDOR}\t%{INSTALLTIME}\n"}
+		if inContainer() {
+			args = append([]string{"--dbpath", hostFile("/var/lib/rpm")}, args...)
+		}
+		output, err := runInventoryCommand("rpm", args...)
+		if err != nil {
+			return nil, "", err
+		}
+		return parseRPMPackages(output), "rpm", nil
+	}
+
+	return []InstalledSoftware{}, "none", nil
+}
+
+// runInventoryCommand runs a package manager query and returns its stdout
+func runInventoryCommand(name string, args ...string) (string, error) {
+	return runCollectorCommand("inventory", nil, name, args...)
+}
+
+// parseDpkgPackages parses dpkg-query output, keeping installed packages only
+func parseDpkgPackages(output string) []InstalledSoftware {
+	software := []InstalledSoftware{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, "\t")
+		// "ii " is desired install, currently installed
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "ii") {
+			continue
+		}
+		software = append(software, InstalledSoftware{
+			Name:      fields[1],
+			Version:   fields[2],
+			Publisher: fields[3],
+			Source:    "dpkg",
+		})
+	}
+	return software
+}
+
+// parseRPMPackages parses rpm query output
+func parseRPMPackages(output string) []InstalledSoftware {
+	software := []InstalledSoftware{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 4 || fields[0] == "" {
+			continue
+		}
+		entry := InstalledSoftware{
+			Name:    fields[0],
+			Version: fields[1],
+			Source:  "rpm",
+		}
+		if fields[2] != "(none)" {
+			entry.Publisher = fields[2]
+		}
+		var installed int64
+		if _, err := fmt.Sscan(fields[3], &installed); err == nil && installed > 0 {
+			entry.InstalledOn = time.Unix(installed, 0).UTC().Format("2006-01-02")
+		}
+		software = append(software, entry)
+	}
+	return software
+}
+
+// readHardwareInfo reads the machine description from DMI and /proc. The serial number
+// is only readable by root.
+func readHardwareInfo() HardwareInfo {
+	dmi := func(name string) string {
+		return readTrimmedFile(hostFile("/sys/class/dmi/id/" + name))
+	}
+	info := HardwareInfo{
+		Manufacturer: dmi("sys_vendor"),
+		Model:        dmi("product_name"),
+		SerialNumber: dmi("product_serial"),
+		BIOSVersion:  dmi("bios_version"),
+	}
+
+	if data, err := os.ReadFile(hostFile("/proc/cpuinfo")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			key, value, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+			switch strings.TrimSpace(key) {
+			case "processor":
+				info.CPUCores++
+			case "model name":
+				if info.CPUModel == "" {
+					info.CPUModel = strings.TrimSpace(value)
+				}
+			}
+		}
+	}
+	if memory, err := readMemInfo(); err == nil {
+		info.MemoryBytes = memory.TotalBytes
+	}
+	return info
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+
+	"sprinter-agent/internal/config"
+)
+
+// InstalledSoftware is a package or program installed on the host
+type InstalledSoftware struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Publisher   string `json:"publisher,omitempty"`
+	InstalledOn string `json:"installed_on,omitempty"`
+	// Source is where the entry was found: dpkg, rpm or registry
+	Source string `json:"source"`
+}
+
+// InstalledUpdate is an operating system update, such as a Windows hotfix
+type InstalledUpdate struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	InstalledOn string `json:"installed_on,omitempty"`
+}
+
+// UpdateStatus is the state of operating system updates
+type UpdateStatus struct {
+	RebootRequired bool              `json:"reboot_required"`
+	LastInstalled  string            `json:"last_installed,omitempty"`
+	Installed      []InstalledUpdate `json:"installed"`
+}
+
+// DomainMembership is the directory domain the host belongs to
+type DomainMembership struct {
+	Joined bool `json:"joined"`
+	// Name is the domain, or the workgroup of a host that is not joined
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// HardwareInfo describes the machine
+type HardwareInfo struct {
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Model        string `json:"model,omitempty"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	BIOSVersion  string `json:"bios_version,omitempty"`
+	CPUModel     string `json:"cpu_model,omitempty"`
+	// CPUCores counts logical processors, like the cores of the host metrics
+	CPUCores    int    `json:"cpu_cores,omitempty"`
+	MemoryBytes uint64 `json:"memory_bytes,omitempty"`
+}
+
+// InventorySnapshot is the payload sent to the inventory endpoint
+type InventorySnapshot struct {
+	Backend  string              `json:"backend"`
+	Software []InstalledSoftware `json:"software"`
+	Updates  UpdateStatus        `json:"updates"`
+	Domain   *DomainMembership   `json:"domain,omitempty"`
+	Hardware HardwareInfo        `json:"hardware"`
+	Hash     string              `json:"hash"`
+}
+
+// InventoryMonitorService reports installed software, updates, domain membership and
+// hardware at startup and whenever they change
+type InventoryMonitorService struct {
+	config   *config.Config
+	hostRid  string
+	lastHash string
+	started  bool
+	stopChan chan bool
+}
+
+// NewInventoryMonitorService creates a new inventory monitor service
+func NewInventoryMonitorService(cfg *config.Config, hostRid string) *InventoryMonitorService {
+	return &InventoryMonitorService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+	}
+}
+
+// Start reports the current inventory and begins checking for changes
+func (s *InventoryMonitorService) Start() error {
+	if !s.config.Inventory.Enabled {
+		log.Println("Inventory not enabled - skipping")
+		setCollectorStatus("inventory", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping inventory")
+		return nil
+	}
+
+	s.started = true
+	go s.monitorLoop()
+
+	setCollectorStatus("inventory", CollectorRunning, "")
+	log.Printf("Inventory service started for host RID: %s", s.hostRid)
+	return nil
+}
+
+// Stop stops the monitoring process
+func (s *InventoryMonitorService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("Inventory service stopped")
+	}
+}
+
+// monitorLoop runs the periodic change check
+func (s *InventoryMonitorService) monitorLoop() {
+	defer recoverPanic("inventory")
+	ticker := newCollectorTicker("inventory", s.config.Inventory.Interval)
+	defer ticker.Stop()
+
+	markProgress("inventory", s.config.Inventory.Interval)
+	// Run immediately on start
+	s.reportInventory()
+	if finishedOnce("inventory") {
+		return
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reportInventory()
+			markProgress("inventory", s.config.Inventory.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// reportInventory reports the inventory if it differs from the last one sent
+func (s *InventoryMonitorService) reportInventory() {
+	snapshot, err := collectInventory()
+	if err != nil {
+		log.Printf("Failed to collect inventory: %v", err)
+		return
+	}
+	snapshot.Hash = inventoryHash(snapshot)
+	if snapshot.Hash == s.lastHash {
+		return
+	}
+
+	ctx := context.Background()
+	if err := submitReport(ctx, s.config, http.MethodPut, hostPath(s.hostRid, "/inventory"), snapshot); err != nil {
+		log.Printf("Failed to report inventory: %v", err)
+		recordCollectorError("inventory", err)
+		return
+	}
+
+	if s.lastHash != "" {
+		log.Printf("Inventory changed, reported new snapshot")
+	} else {
+		log.Printf("Reported inventory (%d software entries) successfully", len(snapshot.Software))
+	}
+	s.lastHash = snapshot.Hash
+}
+
+// inventoryHash sorts the snapshot's lists and hashes it, so the same inventory always
+// hashes the same
+func inventoryHash(snapshot *InventorySnapshot) string {
+	sort.Slice(snapshot.Software, func(i, j int) bool {
+		a, b := snapshot.Software[i], snapshot.Software[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Version < b.Version
+	})
+	sort.Slice(snapshot.Updates.Installed, func(i, j int) bool {
+		return snapshot.Updates.Installed[i].ID < snapshot.Updates.Installed[j].ID
+	})
+
+	data, _ := json.Marshal(snapshot)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+
+package services
+
+import "fmt"
+
+// collectInventory is only implemented on Linux and Windows
+func collectInventory() (*InventorySnapshot, error) {
+	return nil, fmt.Errorf("inventory not supported on this platform")
+}
@@ -0,0 +1,289 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"sprinter-agent/internal/execwrap"
+)
+
+// errNoMoreItems is ERROR_NO_MORE_ITEMS, which ends a registry key enumeration
+const errNoMoreItems = syscall.Errno(259)
+
+// uninstallKeys hold an entry per installed program; 32-bit programs on 64-bit Windows
+// register under WOW6432Node
+var uninstallKeys = []string{
+	`SOFTWARE\Microsoft\Windows\CurrentVersion\Uninstall`,
+	`SOFTWARE\WOW6432Node\Microsoft\Windows\CurrentVersion\Uninstall`,
+}
+
+// rebootPendingKeys exist while installed updates wait for a reboot
+var rebootPendingKeys = []string{
+	`SOFTWARE\Microsoft\Windows\CurrentVersion\WindowsUpdate\Auto Update\RebootRequired`,
+	`SOFTWARE\Microsoft\Windows\CurrentVersion\Component Based Servicing\RebootPending`,
+}
+
+// wmiScript reads the hardware, domain and hotfixes through WMI and prints them as JSON
+const wmiScript = `$ErrorActionPreference = 'Stop'
+$cs = Get-CimInstance Win32_ComputerSystem
+$bios = Get-CimInstance Win32_BIOS
+$cpu = @(Get-CimInstance Win32_Processor)
+$qfe = @(Get-CimInstance Win32_QuickFixEngineering | ForEach-Object {
+  $on = ''
+  try { if ($_.InstalledOn) { $on = ([datetime]$_.InstalledOn).ToString('yyyy-MM-dd') } } catch {}
+  @{ id = $_.HotFixID; description = $_.Description; installed_on = $on }
+})
+@{
+  manufacturer = $cs.Manufacturer
+  model = $cs.Model
+  memory_bytes = [uint64]$cs.TotalPhysicalMemory
+  part_of_domain = [bool]$cs.PartOfDomain
+  domain = $cs.Domain
+  domain_role = [int]$cs.DomainRole
+  serial_number = $bios.SerialNumber
+  bios_version = $bios.SMBIOSBIOSVersion
+  cpu_model = $cpu[0].Name
+  cpu_cores = [int]($cpu | Measure-Object NumberOfLogicalProcessors -Sum).Sum
+  hotfixes = $qfe
+} | ConvertTo-Json -Depth 4 -Compress`
+
+// wmiInventory is the output of wmiScript
+type wmiInventory struct {
+	Manufacturer string            `json:"manufacturer"`
+	Model        string            `json:"model"`
+	MemoryBytes  uint64            `json:"memory_bytes"`
+	PartOfDomain bool              `json:"part_of_domain"`
+	Domain       string            `json:"domain"`
+	DomainRole   int               `json:"domain_role"`
+	SerialNumber string            `json:"serial_number"`
+	BIOSVersion  string            `json:"bios_version"`
+	CPUModel     string            `json:"cpu_model"`
+	CPUCores     int               `json:"cpu_cores"`
+	Hotfixes     []InstalledUpdate `json:"hotfixes"`
+}
+
+// collectInventory reads installed programs from the registry and hardware, domain and
+// hotfixes through WMI
+func collectInventory() (*InventorySnapshot, error) {
+	software, err := readUninstallEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	wmi, err := queryWMIInventory()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &InventorySnapshot{
+		Backend:  "registry+wmi",
+		Software: software,
+		Updates: UpdateStatus{
+			RebootRequired: rebootPending(),
+			Installed:      wmi.Hotfixes,
+		},
+		Domain: &DomainMembership{
+			Joined: wmi.PartOfDomain,
+			Name:   wmi.Domain,
+			Role:   domainRole(wmi.DomainRole),
+		},
+		Hardware: HardwareInfo{
+			Manufacturer: wmi.Manufacturer,
+			Model:        wmi.Model,
+			SerialNumber: strings.TrimSpace(wmi.SerialNumber),
+			BIOSVersion:  wmi.BIOSVersion,
+			CPUModel:     strings.TrimSpace(wmi.CPUModel),
+			CPUCores:     wmi.CPUCores,
+			MemoryBytes:  wmi.MemoryBytes,
+		},
+	}
+	if snapshot.Updates.Installed == nil {
+		snapshot.Updates.Installed = []InstalledUpdate{}
+	}
+	for _, update := range snapshot.Updates.Installed {
+		// Dates are formatted yyyy-MM-dd, so they compare as strings
+		if update.InstalledOn > snapshot.Updates.LastInstalled {
+			snapshot.Updates.LastInstalled = update.InstalledOn
+		}
+	}
+	return snapshot, nil
+}
+
+// queryWMIInventory runs wmiScript with PowerShell
+func queryWMIInventory() (*wmiInventory, error) {
+	output, err := execwrap.Output(context.Background(), execwrap.Options{}, "powershell.exe", "-NoProfile", "-NonInteractive", "-Command", wmiScript)
+	if err != nil {
+		return nil, fmt.Errorf("WMI query failed: %w", err)
+	}
+
+	var inventory wmiInventory
+	if err := json.Unmarshal(bytes.TrimSpace(output), &inventory); err != nil {
+		return nil, fmt.Errorf("failed to parse WMI output: %w", err)
+	}
+	return &inventory, nil
+}
+
+// domainRole names Win32_ComputerSystem.DomainRole
+func domainRole(role int) string {
+	switch role {
+	case 0:
+		return "standalone_workstation"
+	case 1:
+		return "member_workstation"
+	case 2:
+		return "standalone_server"
+	case 3:
+		return "member_server"
+	case 4, 5:
+		return "domain_controller"
+	default:
+		return "unknown"
+	}
+}
+
+// readUninstallEntries lists the programs registered for uninstall, skipping system
+// components and updates registered under a parent program
+func readUninstallEntries() ([]InstalledSoftware, error) {
+	// Registry enumeration must stay on one OS thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	seen := make(map[string]bool)
+	software := []InstalledSoftware{}
+	for _, path := range uninstallKeys {
+		key, err := openLocalMachineKey(path)
+		if err != nil {
+			// WOW6432Node only exists on 64-bit Windows
+			continue
+		}
+		names, err := enumSubkeys(key)
+		if err != nil {
+			syscall.RegCloseKey(key)
+			return nil, fmt.Errorf("failed to list %s: %w", path, err)
+		}
+		for _, name := range names {
+			entry, ok := readUninstallEntry(key, name)
+			if !ok || seen[entry.Name+"\x00"+entry.Version] {
+				continue
+			}
+			seen[entry.Name+"\x00"+entry.Version] = true
+			software = append(software, entry)
+		}
+		syscall.RegCloseKey(key)
+	}
+	sort.Slice(software, func(i, j int) bool { return software[i].Name < software[j].Name })
+	return software, nil
+}
+
+// readUninstallEntry reads one program's uninstall entry
+func readUninstallEntry(parent syscall.Handle, name string) (InstalledSoftware, bool) {
+	namePtr, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return InstalledSoftware{}, false
+	}
+	var key syscall.Handle
+	if err := syscall.RegOpenKeyEx(parent, namePtr, 0, syscall.KEY_READ, &key); err != nil {
+		return InstalledSoftware{}, false
+	}
+	defer syscall.RegCloseKey(key)
+
+	displayName := registryString(key, "DisplayName")
+	if displayName == "" || registryDWORD(key, "SystemComponent") == 1 || registryString(key, "ParentKeyName") != "" {
+		return InstalledSoftware{}, false
+	}
+	entry := InstalledSoftware{
+		Name:      displayName,
+		Version:   registryString(key, "DisplayVersion"),
+		Publisher: registryString(key, "Publisher"),
+		Source:    "registry",
+	}
+	// InstallDate is yyyyMMdd
+	if date := registryString(key, "InstallDate"); len(date) == 8 {
+		entry.InstalledOn = date[:4] + "-" + date[4:6] + "-" + date[6:]
+	}
+	return entry, true
+}
+
+// rebootPending reports whether installed updates wait for a reboot
+func rebootPending() bool {
+	for _, path := range rebootPendingKeys {
+		if key, err := openLocalMachineKey(path); err == nil {
+			syscall.RegCloseKey(key)
+			return true
+		}
+	}
+	return false
+}
+
+// openLocalMachineKey opens a key under HKEY_LOCAL_MACHINE for reading, in the 64-bit
+// view even from a 32-bit agent
+func openLocalMachineKey(path string) (syscall.Handle, error) {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var key syscall.Handle
+	err = syscall.RegOpenKeyEx(syscall.HKEY_LOCAL_MACHINE, pathPtr, 0, syscall.KEY_READ|syscall.KEY_WOW64_64KEY, &key)
+	return key, err
+}
+
+// enumSubkeys returns the names of a key's subkeys
+func enumSubkeys(key syscall.Handle) ([]string, error) {
+	var names []string
+	// Key names are at most 255 characters
+	buf := make([]uint16, 256)
+	for index := uint32(0); ; index++ {
+		length := uint32(len(buf))
+		err := syscall.RegEnumKeyEx(key, index, &buf[0], &length, nil, nil, nil, nil)
+		if err == errNoMoreItems {
+			return names, nil
+		}
+		if err != nil {
+			return names, err
+		}
+		names = append(names, syscall.UTF16ToString(buf[:length]))
+	}
+}
+
+// registryString reads a REG_SZ or REG_EXPAND_SZ value, or "" when it is missing
+func registryString(key syscall.Handle, name string) string {
+	data, valueType, ok := registryValue(key, name)
+	if !ok || (valueType != syscall.REG_SZ && valueType != syscall.REG_EXPAND_SZ) || len(data) < 2 {
+		return ""
+	}
+	chars := unsafe.Slice((*uint16)(unsafe.Pointer(&data[0])), len(data)/2)
+	return strings.TrimSpace(syscall.UTF16ToString(chars))
+}
+
+// registryDWORD reads a REG_DWORD value, or 0 when it is missing
+func registryDWORD(key syscall.Handle, name string) uint32 {
+	data, valueType, ok := registryValue(key, name)
+	if !ok || valueType != syscall.REG_DWORD || len(data) < 4 {
+		return 0
+	}
+	return uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24
+}
+
+// registryValue reads a value's raw data and type
+func registryValue(key syscall.Handle, name string) ([]byte, uint32, bool) {
+	namePtr, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, 0, false
+	}
+	var valueType, size uint32
+	if err := syscall.RegQueryValueEx(key, namePtr, nil, &valueType, nil, &size); err != nil || size == 0 {
+		return nil, 0, false
+	}
+	data := make([]byte, size)
+	if err := syscall.RegQueryValueEx(key, namePtr, nil, &valueType, &data[0], &size); err != nil {
+		return nil, 0, false
+	}
+	return data[:size], valueType, true
+}
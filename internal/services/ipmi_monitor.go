@@ -0,0 +1,441 @@
+//go:build !minimal && !no_ipmi
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"sprinter-agent/internal/config"
+)
+
+// IPMISensor is a single BMC sensor reading
+type IPMISensor struct {
+	Name   string   `json:"name"`
+	Kind   string   `json:"kind"`
+	Value  *float64 `json:"value,omitempty"`
+	Unit   string   `json:"unit"`
+	Status string   `json:"status"`
+}
+
+// IPMIEvent is a single System Event Log entry
+type IPMIEvent struct {
+	RecordID  int64  `json:"record_id"`
+	Timestamp string `json:"timestamp"`
+	Sensor    string `json:"sensor"`
+	Event     string `json:"event"`
+	Direction string `json:"direction,omitempty"`
+}
+
+// IPMIReport is the payload sent to the hardware endpoint
+type IPMIReport struct {
+	Backend string       `json:"backend"`
+	Sensors []IPMISensor `json:"sensors"`
+	Events  []IPMIEvent  `json:"events"`
+}
+
+// IPMIMonitorService collects BMC sensor readings and SEL events
+type IPMIMonitorService struct {
+	config      *config.Config
+	hostRid     string
+	backend     string
+	lastEventID int64
+	stopChan    chan bool
+}
+
+// NewIPMIMonitorService creates a new IPMI monitor service
+func NewIPMIMonitorService(cfg *config.Config, hostRid string) *IPMIMonitorService {
+	return &IPMIMonitorService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+	}
+}
+
+// init registers the collector, unless built with no_ipmi
+func init() {
+	registerCollector("ipmi", func(m *CollectorManager, c *config.Config) Collector {
+		return NewIPMIMonitorService(c, m.hostRid)
+	})
+}
+
+// Start begins collecting IPMI data and reporting it periodically
+func (s *IPMIMonitorService) Start() error {
+	if !s.config.IPMI.Enabled {
+		log.Println("IPMI monitoring not enabled - skipping")
+		setCollectorStatus("ipmi", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping IPMI monitoring")
+		return nil
+	}
+
+	backend, err := s.detectBackend()
+	if err != nil {
+		return err
+	}
+	if err := checkIPMIDeviceAccess(); err != nil {
+		setPermissionProblem("ipmi", CollectorSkipped, err.Error())
+		log.Printf("IPMI monitoring skipped due to permissions: %v", err)
+		return nil
+	}
+	s.backend = backend
+
+	lastEventID, err := s.loadEventCursor()
+	if err != nil {
+		log.Printf("Warning: failed to load IPMI SEL cursor: %v", err)
+	}
+	s.lastEventID = lastEventID
+
+	go s.monitorLoop()
+
+	setCollectorStatus("ipmi", CollectorRunning, "")
+	log.Printf("IPMI monitoring service started using %s", s.backend)
+	return nil
+}
+
+// Stop stops the monitoring process
+func (s *IPMIMonitorService) Stop() {
+	if s.config.IPMI.Enabled && s.backend != "" {
+		close(s.stopChan)
+		log.Println("IPMI monitoring service stopped")
+	}
+}
+
+// detectBackend picks the configured tool, or the first one available on PATH
+func (s *IPMIMonitorService) detectBackend() (string, error) {
+	switch s.config.IPMI.Backend {
+	case "ipmitool":
+		if _, err := exec.LookPath("ipmitool"); err != nil {
+			return "", fmt.Errorf("ipmitool not found in PATH: %w", err)
+		}
+		return "ipmitool", nil
+	case "freeipmi":
+		if _, err := exec.LookPath("ipmi-sensors"); err != nil {
+			return "", fmt.Errorf("ipmi-sensors not found in PATH: %w", err)
+		}
+		return "freeipmi", nil
+	case "", "auto":
+		if _, err := exec.LookPath("ipmitool"); err == nil {
+			return "ipmitool", nil
+		}
+		if _, err := exec.LookPath("ipmi-sensors"); err == nil {
+			return "freeipmi", nil
+		}
+		return "", fmt.Errorf("neither ipmitool nor freeipmi found in PATH")
+	default:
+		return "", fmt.Errorf("unknown IPMI backend: %s", s.config.IPMI.Backend)
+	}
+}
+
+// checkIPMIDeviceAccess verifies the local IPMI device node can be opened, if one exists
+func checkIPMIDeviceAccess() error {
+	for _, device := range []string{"/dev/ipmi0", "/dev/ipmi/0", "/dev/ipmidev/0"} {
+		if _, err := os.Stat(device); err != nil {
+			continue
+		}
+		f, err := os.OpenFile(device, os.O_RDWR, 0)
+		if err != nil {
+			if isPermissionError(err) {
+				return fmt.Errorf("no read/write access to %s", device)
+			}
+			return nil
+		}
+		f.Close()
+		return nil
+	}
+	return nil
+}
+
+// monitorLoop runs the periodic collection loop
+func (s *IPMIMonitorService) monitorLoop() {
+	defer recoverPanic("ipmi")
+	ticker := newCollectorTicker("ipmi", s.config.IPMI.Interval)
+	defer ticker.Stop()
+
+	markProgress("ipmi", s.config.IPMI.Interval)
+	// Run immediately on start
+	s.reportIPMI()
+	if finishedOnce("ipmi") {
+		return
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reportIPMI()
+			markProgress("ipmi", s.config.IPMI.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// reportIPMI collects sensors and new SEL events and reports them to the API
+func (s *IPMIMonitorService) reportIPMI() {
+	sensors, err := s.getSensors()
+	if err != nil {
+		log.Printf("Failed to read IPMI sensors: %v", err)
+		sensors = []IPMISensor{}
+	}
+
+	events, err := s.getEvents()
+	if err != nil {
+		log.Printf("Failed to read IPMI SEL: %v", err)
+	}
+
+	// Clearing the SEL restarts record IDs at 1, so a log whose newest record is older than
+	// the cursor was cleared since and everything in it is new
+	cursor := s.lastEventID
+	if err == nil {
+		var latest int64
+		for _, event := range events {
+			latest = max(latest, event.RecordID)
+		}
+		if latest < cursor {
+			log.Printf("IPMI SEL was cleared, reporting its events from the start")
+			cursor = 0
+		}
+	}
+
+	newEvents := make([]IPMIEvent, 0, len(events))
+	maxID := cursor
+	for _, event := range events {
+		if event.RecordID > cursor {
+			newEvents = append(newEvents, event)
+		}
+		if event.RecordID > maxID {
+			maxID = event.RecordID
+		}
+	}
+
+	reqBody := IPMIReport{
+		Backend: s.backend,
+		Sensors: sensors,
+		Events:  newEvents,
+	}
+
+	ctx := context.Background()
+	if err := submitReport(ctx, s.config, http.MethodPut, hostPath(s.hostRid, "/hardware/ipmi"), reqBody); err != nil {
+		log.Printf("Failed to report IPMI data: %v", err)
+		recordCollectorError("ipmi", err)
+		return
+	}
+
+	// Only advance the cursor once the server has accepted the events
+	if maxID != s.lastEventID {
+		s.lastEventID = maxID
+		if err := s.saveEventCursor(maxID); err != nil {
+			log.Printf("Warning: failed to save IPMI SEL cursor: %v", err)
+		}
+	}
+
+	log.Printf("Reported %d IPMI sensors and %d SEL events successfully", len(sensors), len(newEvents))
+}
+
+// runIPMICommand runs an IPMI tool and returns its stdout
+func runIPMICommand(name string, args ...string) (string, error) {
+	return runCollectorCommand("ipmi", nil, name, args...)
+}
+
+// getSensors reads all sensors from the BMC
+func (s *IPMIMonitorService) getSensors() ([]IPMISensor, error) {
+	if s.backend == "freeipmi" {
+		output, err := runIPMICommand("ipmi-sensors", "--comma-separated-output", "--no-header-output", "--output-sensor-state")
+		if err != nil {
+			return nil, err
+		}
+		return parseFreeIPMISensors(output), nil
+	}
+
+	output, err := runIPMICommand("ipmitool", "sensor")
+	if err != nil {
+		return nil, err
+	}
+	return parseIPMIToolSensors(output), nil
+}
+
+// getEvents reads the System Event Log from the BMC
+func (s *IPMIMonitorService) getEvents() ([]IPMIEvent, error) {
+	if s.backend == "freeipmi" {
+		output, err := runIPMICommand("ipmi-sel", "--comma-separated-output", "--no-header-output")
+		if err != nil {
+			return nil, err
+		}
+		return parseFreeIPMISEL(output), nil
+	}
+
+	output, err := runIPMICommand("ipmitool", "sel", "elist")
+	if err != nil {
+		return nil, err
+	}
+	return parseIPMIToolSEL(output), nil
+}
+
+// parseIPMIToolSensors parses `ipmitool sensor` output
+// Format: NAME | VALUE | UNIT | STATUS | thresholds...
+func parseIPMIToolSensors(output string) []IPMISensor {
+	sensors := []IPMISensor{}
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) < 4 {
+			continue
+		}
+		name := strings.TrimSpace(parts[0])
+		if name == "" {
+			continue
+		}
+		unit := strings.TrimSpace(parts[2])
+		sensors = append(sensors, IPMISensor{
+			Name:   name,
+			Kind:   sensorKind(name, unit),
+			Value:  parseSensorValue(parts[1]),
+			Unit:   unit,
+			Status: strings.TrimSpace(parts[3]),
+		})
+	}
+	return sensors
+}
+
+// parseFreeIPMISensors parses `ipmi-sensors --comma-separated-output` output
+// Format: ID,NAME,TYPE,STATE,READING,UNITS,EVENT
+func parseFreeIPMISensors(output string) []IPMISensor {
+	sensors := []IPMISensor{}
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.Split(line, ",")
+		if len(parts) < 6 {
+			continue
+		}
+		name := strings.TrimSpace(parts[1])
+		unit := strings.TrimSpace(parts[5])
+		sensors = append(sensors, IPMISensor{
+			Name:   name,
+			Kind:   sensorKind(strings.TrimSpace(parts[2]), unit),
+			Value:  parseSensorValue(parts[4]),
+			Unit:   unit,
+			Status: strings.TrimSpace(parts[3]),
+		})
+	}
+	return sensors
+}
+
+// parseIPMIToolSEL parses `ipmitool sel elist` output
+// Format: ID | DATE | TIME | SENSOR | EVENT | DIRECTION
+func parseIPMIToolSEL(output string) []IPMIEvent {
+	events := []IPMIEvent{}
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) < 5 {
+			continue
+		}
+		// ipmitool prints record IDs in hex
+		id, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 16, 64)
+		if err != nil {
+			continue
+		}
+		event := IPMIEvent{
+			RecordID:  id,
+			Timestamp: strings.TrimSpace(parts[1]) + " " + strings.TrimSpace(parts[2]),
+			Sensor:    strings.TrimSpace(parts[3]),
+			Event:     strings.TrimSpace(parts[4]),
+		}
+		if len(parts) > 5 {
+			event.Direction = strings.TrimSpace(parts[5])
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// parseFreeIPMISEL parses `ipmi-sel --comma-separated-output` output
+// Format: ID,DATE,TIME,NAME,TYPE,EVENT
+func parseFreeIPMISEL(output string) []IPMIEvent {
+	events := []IPMIEvent{}
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.Split(line, ",")
+		if len(parts) < 6 {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+		if err != nil {
+			continue
+		}
+		events = append(events, IPMIEvent{
+			RecordID:  id,
+			Timestamp: strings.TrimSpace(parts[1]) + " " + strings.TrimSpace(parts[2]),
+			Sensor:    strings.TrimSpace(parts[3]),
+			Event:     strings.TrimSpace(strings.Join(parts[5:], ",")),
+		})
+	}
+	return events
+}
+
+// parseSensorValue returns nil for readings the BMC reports as unavailable
+func parseSensorValue(raw string) *float64 {
+	raw = strings.TrimSpace(raw)
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return nil
+	}
+	return &value
+}
+
+// sensorKind classifies a sensor as power, temperature, fan, voltage or other
+func sensorKind(name, unit string) string {
+	lowerName := strings.ToLower(name)
+	lowerUnit := strings.ToLower(unit)
+	switch {
+	case strings.Contains(lowerUnit, "degrees") || lowerUnit == "c" || strings.Contains(lowerName, "temp"):
+		return "temperature"
+	case strings.Contains(lowerUnit, "watts") || lowerUnit == "w" || strings.Contains(lowerName, "power"):
+		return "power"
+	case strings.Contains(lowerUnit, "rpm") || strings.Contains(lowerName, "fan"):
+		return "fan"
+	case strings.Contains(lowerUnit, "volts") || lowerUnit == "v":
+		return "voltage"
+	default:
+		return "other"
+	}
+}
+
+// getEventCursorPath returns the path to the SEL cursor file
+func (s *IPMIMonitorService) getEventCursorPath() string {
+	return filepath.Join("data", "ipmi_sel.cursor")
+}
+
+// loadEventCursor loads the last reported SEL record ID from disk
+func (s *IPMIMonitorService) loadEventCursor() (int64, error) {
+	data, err := os.ReadFile(s.getEventCursorPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read SEL cursor file: %w", err)
+	}
+
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// saveEventCursor saves the last reported SEL record ID to disk
+func (s *IPMIMonitorService) saveEventCursor(id int64) error {
+	cursorPath := s.getEventCursorPath()
+	if err := os.MkdirAll(filepath.Dir(cursorPath), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	if err := os.WriteFile(cursorPath, []byte(strconv.FormatInt(id, 10)), 0644); err != nil {
+		return fmt.Errorf("failed to write SEL cursor file: %w", err)
+	}
+	return nil
+}
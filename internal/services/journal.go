@@ -0,0 +1,81 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"sprinter-agent/internal/execwrap"
+)
+
+// journalTimeout bounds one journalctl run
+const journalTimeout = 30 * time.Second
+
+// journalEntry is one entry of journalctl's JSON output
+type journalEntry map[string]json.RawMessage
+
+// Field returns a field's value. journalctl prints values that are not valid UTF-8 as
+// arrays of bytes, and fields set more than once as arrays; the first value is returned.
+func (e journalEntry) Field(name string) string {
+	raw, ok := e[name]
+	if !ok {
+		return ""
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+	var values []string
+	if err := json.Unmarshal(raw, &values); err == nil {
+		if len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	var data []byte
+	var bytesValue []int
+	if err := json.Unmarshal(raw, &bytesValue); err == nil {
+		for _, b := range bytesValue {
+			data = append(data, byte(b))
+		}
+	}
+	return string(data)
+}
+
+// Time returns when the entry was written
+func (e journalEntry) Time() time.Time {
+	usec, _ := strconv.ParseInt(e.Field("__REALTIME_TIMESTAMP"), 10, 64)
+	return time.UnixMicro(usec)
+}
+
+// readJournal returns up to limit entries matching the journalctl arguments, starting
+// after the cursor, or at the start of the current boot without one
+func readJournal(cursor string, limit int, args ...string) ([]journalEntry, error) {
+	args = append([]string{"-o", "json", "--no-pager", "-n", strconv.Itoa(limit)}, args...)
+	if cursor != "" {
+		args = append(args, "--after-cursor", cursor)
+	} else {
+		args = append(args, "-b")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), journalTimeout)
+	defer cancel()
+	output, err := execwrap.Output(ctx, execwrap.Options{}, "journalctl", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []journalEntry
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Field("__CURSOR") == "" {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,131 @@
+//go:build linux && !minimal && !no_kernel_log
+
+package services
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// kmsgPath is the kernel ring buffer's record interface
+const kmsgPath = "/dev/kmsg"
+
+// kmsgReader reads records from /dev/kmsg without blocking
+type kmsgReader struct {
+	fd       int
+	bootID   string
+	bootTime time.Time
+	// last is the sequence number of the last record returned, valid when seen is set
+	last uint64
+	seen bool
+	buf  []byte
+}
+
+// openKmsg opens the ring buffer at its oldest record. Records up to the cursor are
+// skipped when it is from the current boot; after a reboot the whole buffer is new.
+func openKmsg(cursor kernelLogCursor) (kernelLogReader, error) {
+	fd, err := syscall.Open(kmsgPath, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: kmsgPath, Err: err}
+	}
+	r := &kmsgReader{
+		fd:       fd,
+		bootID:   readTrimmedFile("/proc/sys/kernel/random/boot_id"),
+		bootTime: monotonicBootTime(),
+		buf:      make([]byte, 8192),
+	}
+	if r.bootID != "" && cursor.BootID == r.bootID {
+		r.last, r.seen = cursor.Seq, true
+	}
+	return r, nil
+}
+
+// ReadRecords reads the records written since the previous call
+func (r *kmsgReader) ReadRecords() ([]kernelRecord, error) {
+	var records []kernelRecord
+	for {
+		n, err := syscall.Read(r.fd, r.buf)
+		switch err {
+		case nil:
+		case syscall.EAGAIN:
+			return records, nil
+		case syscall.EINTR, syscall.EPIPE:
+			// EPIPE: records were overwritten before they were read; the next read
+			// continues with the oldest one left
+			continue
+		default:
+			return records, &os.PathError{Op: "read", Path: kmsgPath, Err: err}
+		}
+		if n == 0 {
+			return records, nil
+		}
+
+		seq, record, ok := parseKmsgRecord(string(r.buf[:n]), r.bootTime)
+		if !ok || (r.seen && seq <= r.last) {
+			continue
+		}
+		r.last, r.seen = seq, true
+		record.ID = r.bootID + ":" + strconv.FormatUint(seq, 10)
+		if record.Message != "" {
+			records = append(records, record)
+		}
+	}
+}
+
+// Cursor returns the boot and sequence number of the last record read
+func (r *kmsgReader) Cursor() kernelLogCursor {
+	if !r.seen {
+		return kernelLogCursor{}
+	}
+	return kernelLogCursor{BootID: r.bootID, Seq: r.last}
+}
+
+// Close closes /dev/kmsg
+func (r *kmsgReader) Close() error {
+	return syscall.Close(r.fd)
+}
+
+// parseKmsgRecord parses a "priority,sequence,microseconds,flags;message" record,
+// followed by optional " KEY=value" lines. Messages that user space wrote to /dev/kmsg
+// are returned without text, so they cannot pass for kernel messages.
+func parseKmsgRecord(data string, bootTime time.Time) (uint64, kernelRecord, bool) {
+	header, message, ok := strings.Cut(data, ";")
+	if !ok {
+		return 0, kernelRecord{}, false
+	}
+	fields := strings.Split(header, ",")
+	if len(fields) < 3 {
+		return 0, kernelRecord{}, false
+	}
+	priority, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, kernelRecord{}, false
+	}
+	seq, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, kernelRecord{}, false
+	}
+	usec, _ := strconv.ParseInt(fields[2], 10, 64)
+
+	record := kernelRecord{Time: bootTime.Add(time.Duration(usec) * time.Microsecond)}
+	if priority>>3 == 0 {
+		message, _, _ = strings.Cut(message, "\n")
+		record.Message = message
+	}
+	return seq, record, true
+}
+
+// monotonicBootTime returns the wall clock time at which the monotonic clock, which
+// kernel log timestamps count, was zero
+func monotonicBootTime() time.Time {
+	var ts syscall.Timespec
+	const clockMonotonic = 1
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ts)), 0); errno != 0 {
+		return time.Now()
+	}
+	return time.Now().Add(-time.Duration(ts.Nano()))
+}
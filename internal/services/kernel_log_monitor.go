@@ -0,0 +1,448 @@
+//go:build !minimal && !no_kernel_log
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// kernelLogCursorPath keeps the position of the last kernel message reported, so a
+// restarted agent neither reports the boot's errors again nor misses those written while
+// it was down
+const kernelLogCursorPath = "data/kernel_log_cursor.json"
+
+// maxJournalKernelRecords bounds the journal messages read per interval
+const maxJournalKernelRecords = 5000
+
+// Kernel event categories
+const (
+	kernelCategoryOOM      = "oom_kill"
+	kernelCategoryIO       = "io_error"
+	kernelCategoryMCE      = "machine_check"
+	kernelCategorySegfault = "segfault"
+)
+
+// severityCritical marks uncorrected hardware errors
+const severityCritical = "critical"
+
+// KernelEvent is a kernel message reporting a hardware error, an OOM kill or a crashed
+// process
+type KernelEvent struct {
+	EventID   string `json:"event_id"`
+	Category  string `json:"category"`
+	Severity  string `json:"severity"`
+	Timestamp string `json:"timestamp"`
+	Message   string `json:"message"`
+	Process   string `json:"process,omitempty"`
+	PID       int    `json:"pid,omitempty"`
+	Device    string `json:"device,omitempty"`
+	// Details holds what else the message says, such as an OOM victim's memory use
+	Details     map[string]string `json:"details,omitempty"`
+	Maintenance string            `json:"maintenance,omitempty"`
+	EventOccurrences
+}
+
+// KernelEventsReport is the payload sent to the kernel events endpoint
+type KernelEventsReport struct {
+	Source  string        `json:"source"`
+	Events  []KernelEvent `json:"events"`
+	Dropped int           `json:"dropped"`
+}
+
+// kernelRecord is one kernel log message
+type kernelRecord struct {
+	// ID identifies the message across boots
+	ID      string
+	Time    time.Time
+	Message string
+}
+
+// kernelLogCursor is the position after the last message read
+type kernelLogCursor struct {
+	BootID string `json:"boot_id,omitempty"`
+	// Seq is the ring buffer sequence number of the last message, within BootID
+	Seq uint64 `json:"seq,omitempty"`
+	// Journal is the journal cursor of the last message
+	Journal string `json:"journal,omitempty"`
+}
+
+// kernelLogReader reads new kernel log messages
+type kernelLogReader interface {
+	// ReadRecords returns the messages written since the previous call
+	ReadRecords() ([]kernelRecord, error)
+	// Cursor returns the position after the last message returned
+	Cursor() kernelLogCursor
+	Close() error
+}
+
+// KernelLogMonitorService forwards hardware errors, OOM kills and segfaults from the kernel
+// log to the API
+type KernelLogMonitorService struct {
+	config  *config.Config
+	hostRid string
+	reader  kernelLogReader
+	source  string
+	limiter *tokenBucket
+	dedup   *eventDeduper[KernelEvent]
+	dropped int
+	// pending events failed to send and are resent with the next batch
+	pending []KernelEvent
+	// saved is the cursor last written to disk
+	saved kernelLogCursor
+	// oomCgroups maps OOM victims' PIDs to their memory cgroup, from the oom-kill line the
+	// kernel logs just before the kill itself
+	oomCgroups map[int]string
+	stopChan   chan bool
+}
+
+// NewKernelLogMonitorService creates a new kernel log monitor service
+func NewKernelLogMonitorService(cfg *config.Config, hostRid string) *KernelLogMonitorService {
+	return &KernelLogMonitorService{
+		config:     cfg,
+		hostRid:    hostRid,
+		dedup:      newEventDeduper[KernelEvent](dedupWindow(cfg)),
+		oomCgroups: make(map[int]string),
+		stopChan:   make(chan bool),
+	}
+}
+
+// init registers the collector, unless built with no_kernel_log
+func init() {
+	registerCollector("kernel_log", func(m *CollectorManager, c *config.Config) Collector {
+		return NewKernelLogMonitorService(c, m.hostRid)
+	})
+}
+
+// Start opens the kernel log and begins forwarding events
+func (s *KernelLogMonitorService) Start() error {
+	if !s.config.KernelLog.Enabled {
+		log.Println("Kernel log monitoring not enabled - skipping")
+		setCollectorStatus("kernel_log", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping kernel log monitoring")
+		return nil
+	}
+
+	cursor, err := loadKernelLogCursor()
+	if err != nil {
+		log.Printf("Warning: failed to load kernel log cursor: %v", err)
+	}
+	s.saved = cursor
+	reader, source, err := openKernelLog(s.config.KernelLog.Source, cursor)
+	if err != nil {
+		if isPermissionError(err) {
+			setPermissionProblem("kernel_log", CollectorSkipped, fmt.Sprintf("no read access to the kernel log: %v", err))
+		} else {
+			setCollectorStatus("kernel_log", CollectorSkipped, err.Error())
+		}
+		log.Printf("Kernel log monitoring skipped: %v", err)
+		return nil
+	}
+	s.reader, s.source = reader, source
+	s.limiter = newTokenBucket(s.config.KernelLog.RateLimit)
+
+	go s.monitorLoop()
+
+	setCollectorStatus("kernel_log", CollectorRunning, "")
+	log.Printf("Kernel log monitoring started from %s", source)
+	return nil
+}
+
+// Stop stops the monitoring process
+func (s *KernelLogMonitorService) Stop() {
+	if s.reader != nil {
+		close(s.stopChan)
+		log.Println("Kernel log monitoring stopped")
+	}
+}
+
+// openKernelLog opens the configured source. With "auto" the ring buffer is preferred,
+// since it needs no journald; the journal is the fallback when it cannot be read.
+func openKernelLog(source string, cursor kernelLogCursor) (kernelLogReader, string, error) {
+	var kmsgErr error
+	if source != "journald" {
+		reader, err := openKmsg(cursor)
+		if err == nil || source == "kmsg" {
+			return reader, "kmsg", err
+		}
+		kmsgErr = err
+	}
+	if _, err := exec.LookPath("journalctl"); err != nil {
+		if kmsgErr != nil {
+			return nil, "", kmsgErr
+		}
+		return nil, "", errors.New("journalctl is not installed")
+	}
+	return &journalKernelReader{cursor: cursor}, "journald", nil
+}
+
+// monitorLoop polls the kernel log for new messages
+func (s *KernelLogMonitorService) monitorLoop() {
+	defer recoverPanic("kernel_log")
+	ticker := newCollectorTicker("kernel_log", s.config.KernelLog.Interval)
+	defer ticker.Stop()
+	defer s.reader.Close()
+
+	markProgress("kernel_log", s.config.KernelLog.Interval)
+	for {
+		select {
+		case <-ticker.C:
+			s.forwardEvents()
+			markProgress("kernel_log", s.config.KernelLog.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// forwardEvents reads new kernel messages and forwards those reporting problems
+func (s *KernelLogMonitorService) forwardEvents() {
+	records, err := s.reader.ReadRecords()
+	if err != nil {
+		if isPermissionError(err) {
+			if setPermissionProblem("kernel_log", CollectorSkipped, fmt.Sprintf("no read access to the kernel log: %v", err)) {
+				log.Printf("Kernel log monitoring skipped due to permissions: %v", err)
+			}
+			return
+		}
+		log.Printf("Failed to read kernel log: %v", err)
+	} else {
+		setCollectorStatus("kernel_log", CollectorRunning, "")
+	}
+
+	now := time.Now()
+	events := s.pending
+	for _, record := range records {
+		event, ok := s.classify(record)
+		if !ok {
+			continue
+		}
+		// Repeats are counted before rate limiting so they do not use up the budget
+		if !s.dedup.Observe(kernelEventKey(event), event, now) {
+			continue
+		}
+		if !s.limiter.Allow() {
+			s.dropped++
+			continue
+		}
+		events = append(events, event)
+	}
+	for _, summary := range s.dedup.Flush(now) {
+		event := summary.Event
+		event.EventOccurrences = summary.occurrences()
+		events = append(events, event)
+	}
+
+	if len(events) > 0 || s.dropped > 0 {
+		reqBody := KernelEventsReport{
+			Source:  s.source,
+			Events:  events,
+			Dropped: s.dropped,
+		}
+		if err := submitReport(context.Background(), s.config, http.MethodPost, hostPath(s.hostRid, "/kernel-events"), reqBody); err != nil {
+			log.Printf("Failed to forward kernel events (%d queued): %v", len(events), err)
+			recordCollectorError("kernel_log", err)
+			s.pending = retainEvents("kernel_log", events)
+			return
+		}
+		log.Printf("Forwarded %d kernel events successfully", len(events))
+		s.pending = nil
+		s.dropped = 0
+	}
+
+	// The cursor only moves past messages whose events the server accepted
+	if cursor := s.reader.Cursor(); cursor != s.saved {
+		if err := saveKernelLogCursor(cursor); err != nil {
+			log.Printf("Warning: failed to save kernel log cursor: %v", err)
+			return
+		}
+		s.saved = cursor
+	}
+}
+
+// Patterns of the kernel messages worth an event
+var (
+	kernelSegfault    = regexp.MustCompile(`^(\S+)\[(\d+)\]: segfault at`)
+	kernelTrap        = regexp.MustCompile(`^traps: (\S+)\[(\d+)\] (general protection fault|trap (?:divide error|invalid opcode|stack segment))`)
+	kernelMachineChk  = regexp.MustCompile(`\[Hardware Error\]|Machine check events logged|^mce: |^EDAC `)
+	kernelEDACCounted = regexp.MustCompile(`^EDAC (\S+): \d+ (CE|UE)\b`)
+	kernelIOErrors    = []*regexp.Regexp{
+		regexp.MustCompile(`(?:I/O|critical medium|critical target|critical nexus|critical space allocation) error, dev ([\w-]+), sector (\d+)`),
+		regexp.MustCompile(`Buffer I/O error on dev(?:ice)? ([\w-]+)`),
+		regexp.MustCompile(`^EXT[234]-fs error \(device ([\w-]+)\)`),
+		regexp.MustCompile(`^XFS \(([\w-]+)\): .*(?:I/O error|metadata I/O error|Corruption)`),
+		regexp.MustCompile(`^BTRFS (?:error|critical) \(device ([\w-]+)\)`),
+		regexp.MustCompile(`^(ata\d+(?:\.\d+)?): failed command`),
+		regexp.MustCompile(`^nvme (nvme\d+): .*(?:I/O \d+ .*timeout|controller is down|Device not ready)`),
+	}
+)
+
+// classify turns a kernel message into an event when it reports a problem
+func (s *KernelLogMonitorService) classify(record kernelRecord) (KernelEvent, bool) {
+	message := record.Message
+	// The oom-kill line names the victim's cgroup; the kill follows in the next message
+	if oom, ok := parseOOMContext(message); ok {
+		if len(s.oomCgroups) >= 100 {
+			s.oomCgroups = make(map[int]string)
+		}
+		s.oomCgroups[oom.PID] = oom.Cgroup
+		return KernelEvent{}, false
+	}
+
+	event, ok := classifyKernelMessage(message)
+	if !ok {
+		return KernelEvent{}, false
+	}
+	if event.Category == kernelCategoryOOM {
+		if cgroup, ok := s.oomCgroups[event.PID]; ok {
+			event.Details["cgroup"] = cgroup
+			delete(s.oomCgroups, event.PID)
+		}
+	}
+	event.Timestamp = record.Time.UTC().Format(time.RFC3339Nano)
+	event.Maintenance = maintenanceTag(record.Time)
+	event.EventID = eventID("kernel_log", record.ID)
+	return event, true
+}
+
+// classifyKernelMessage matches a message against the known problem patterns
+func classifyKernelMessage(message string) (KernelEvent, bool) {
+	event := KernelEvent{Message: message}
+
+	if kill, ok := parseOOMKill(message); ok {
+		event.Category, event.Severity = kernelCategoryOOM, severityError
+		event.PID, event.Process = kill.PID, kill.Process
+		event.Details = make(map[string]string)
+		for name, kb := range kill.Memory {
+			event.Details[name+"_kb"] = strconv.FormatInt(kb, 10)
+		}
+		return event, true
+	}
+	for _, pattern := range []*regexp.Regexp{kernelSegfault, kernelTrap} {
+		if match := pattern.FindStringSubmatch(message); match != nil {
+			event.Category, event.Severity = kernelCategorySegfault, severityWarning
+			event.Process = match[1]
+			event.PID, _ = strconv.Atoi(match[2])
+			return event, true
+		}
+	}
+	for _, pattern := range kernelIOErrors {
+		if match := pattern.FindStringSubmatch(message); match != nil {
+			event.Category, event.Severity = kernelCategoryIO, severityError
+			event.Device = match[1]
+			if len(match) > 2 {
+				event.Details = map[string]string{"sector": match[2]}
+			}
+			return event, true
+		}
+	}
+	if kernelMachineChk.MatchString(message) {
+		event.Category, event.Severity = kernelCategoryMCE, machineCheckSeverity(message)
+		if match := kernelEDACCounted.FindStringSubmatch(message); match != nil {
+			event.Device = match[1]
+		}
+		return event, true
+	}
+	return KernelEvent{}, false
+}
+
+// machineCheckSeverity tells corrected hardware errors, which the hardware recovered
+// from, from uncorrected ones
+func machineCheckSeverity(message string) string {
+	lower := strings.ToLower(message)
+	switch {
+	case strings.Contains(message, " UE ") || strings.Contains(lower, "uncorrect") || strings.Contains(lower, "fatal"):
+		return severityCritical
+	case strings.Contains(message, " CE ") || strings.Contains(lower, "corrected"):
+		return severityWarning
+	default:
+		return severityError
+	}
+}
+
+// kernelEventKey identifies identical events, ignoring when they happened. I/O errors
+// are keyed by device, so a failing disk's errors on every sector count as one event.
+func kernelEventKey(event KernelEvent) string {
+	return strings.Join([]string{event.Category, event.Severity, event.Process, event.Device}, "\x00")
+}
+
+// journalKernelReader reads kernel messages from the journal with journalctl
+type journalKernelReader struct {
+	cursor kernelLogCursor
+}
+
+// ReadRecords returns the kernel messages after the cursor, or those of the current boot
+// when there is none
+func (r *journalKernelReader) ReadRecords() ([]kernelRecord, error) {
+	entries, err := readJournal(r.cursor.Journal, maxJournalKernelRecords, "-k")
+	if err != nil {
+		return nil, err
+	}
+	records := make([]kernelRecord, 0, len(entries))
+	for _, entry := range entries {
+		r.cursor.Journal, r.cursor.BootID = entry.Field("__CURSOR"), entry.Field("_BOOT_ID")
+		records = append(records, kernelRecord{
+			ID:      r.cursor.Journal,
+			Time:    entry.Time(),
+			Message: entry.Field("MESSAGE"),
+		})
+	}
+	return records, nil
+}
+
+// Cursor returns the journal cursor of the last message read
+func (r *journalKernelReader) Cursor() kernelLogCursor {
+	return r.cursor
+}
+
+// Close does nothing; journalctl runs once per read
+func (r *journalKernelReader) Close() error {
+	return nil
+}
+
+// loadKernelLogCursor loads the position of the last kernel message reported
+func loadKernelLogCursor() (kernelLogCursor, error) {
+	var cursor kernelLogCursor
+	data, err := os.ReadFile(kernelLogCursorPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cursor, nil
+		}
+		return cursor, fmt.Errorf("failed to read kernel log cursor file: %w", err)
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return kernelLogCursor{}, fmt.Errorf("failed to parse kernel log cursor file: %w", err)
+	}
+	return cursor, nil
+}
+
+// saveKernelLogCursor saves the position of the last kernel message reported
+func saveKernelLogCursor(cursor kernelLogCursor) error {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(kernelLogCursorPath), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	if err := os.WriteFile(kernelLogCursorPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write kernel log cursor file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !minimal && !no_kernel_log
+
+package services
+
+import "errors"
+
+// openKmsg fails; only Linux has /dev/kmsg
+func openKmsg(cursor kernelLogCursor) (kernelLogReader, error) {
+	return nil, errors.New("the kernel ring buffer can only be read on Linux")
+}
@@ -0,0 +1,206 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"sprinter-agent/internal/config"
+)
+
+// KernelModule is a loaded kernel module
+type KernelModule struct {
+	Name string `json:"name"`
+	Size string `json:"size"`
+}
+
+// KernelSnapshot is the payload sent to the kernel endpoint
+type KernelSnapshot struct {
+	Release string            `json:"release"`
+	Version string            `json:"version"`
+	Modules []KernelModule    `json:"modules"`
+	Sysctls map[string]string `json:"sysctls"`
+	// Missing lists configured sysctl keys that do not exist on this kernel
+	Missing []string `json:"missing"`
+	Hash    string   `json:"hash"`
+}
+
+// KernelMonitorService reports the kernel configuration at startup and whenever it changes
+type KernelMonitorService struct {
+	config   *config.Config
+	hostRid  string
+	lastHash string
+	started  bool
+	stopChan chan bool
+}
+
+// NewKernelMonitorService creates a new kernel monitor service
+func NewKernelMonitorService(cfg *config.Config, hostRid string) *KernelMonitorService {
+	return &KernelMonitorService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+	}
+}
+
+// Start reports the current snapshot and begins checking for changes
+func (s *KernelMonitorService) Start() error {
+	if !s.config.Kernel.Enabled {
+		log.Println("Kernel snapshots not enabled - skipping")
+		setCollectorStatus("kernel", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping kernel snapshots")
+		return nil
+	}
+
+	s.started = true
+	go s.monitorLoop()
+
+	setCollectorStatus("kernel", CollectorRunning, "")
+	log.Printf("Kernel snapshot service started for host RID: %s", s.hostRid)
+	return nil
+}
+
+// Stop stops the monitoring process
+func (s *KernelMonitorService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("Kernel snapshot service stopped")
+	}
+}
+
+// monitorLoop runs the periodic change check
+func (s *KernelMonitorService) monitorLoop() {
+	defer recoverPanic("kernel")
+	ticker := newCollectorTicker("kernel", s.config.Kernel.Interval)
+	defer ticker.Stop()
+
+	markProgress("kernel", s.config.Kernel.Interval)
+	// Run immediately on start
+	s.reportSnapshot()
+	if finishedOnce("kernel") {
+		return
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reportSnapshot()
+			markProgress("kernel", s.config.Kernel.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// reportSnapshot reports the kernel snapshot if it differs from the last one sent
+func (s *KernelMonitorService) reportSnapshot() {
+	snapshot := collectKernelSnapshot(s.config.Kernel.Sysctls)
+	if snapshot.Hash == s.lastHash {
+		return
+	}
+
+	ctx := context.Background()
+	if err := submitReport(ctx, s.config, http.MethodPut, hostPath(s.hostRid, "/kernel"), snapshot); err != nil {
+		log.Printf("Failed to report kernel snapshot: %v", err)
+		recordCollectorError("kernel", err)
+		return
+	}
+
+	if s.lastHash != "" {
+		log.Printf("Kernel configuration changed, reported new snapshot")
+	} else {
+		log.Printf("Reported kernel snapshot (%s, %d modules) successfully", snapshot.Release, len(snapshot.Modules))
+	}
+	s.lastHash = snapshot.Hash
+}
+
+// collectKernelSnapshot reads the kernel release, loaded modules and the given sysctls
+func collectKernelSnapshot(sysctls []string) *KernelSnapshot {
+	snapshot := &KernelSnapshot{
+		Release: readTrimmedFile(hostFile("/proc/sys/kernel/osrelease")),
+		Version: readTrimmedFile(hostFile("/proc/sys/kernel/version")),
+		Modules: readKernelModules(),
+		Sysctls: make(map[string]string, len(sysctls)),
+		Missing: []string{},
+	}
+
+	for _, key := range sysctls {
+		value, err := readSysctl(key)
+		if err != nil {
+			snapshot.Missing = append(snapshot.Missing, key)
+			continue
+		}
+		snapshot.Sysctls[key] = value
+	}
+
+	// Module sizes are excluded so that only loads and unloads count as changes
+	names := make([]string, len(snapshot.Modules))
+	for i, module := range snapshot.Modules {
+		names[i] = module.Name
+	}
+	data, _ := json.Marshal(struct {
+		Release string
+		Version string
+		Modules []string
+		Sysctls map[string]string
+	}{snapshot.Release, snapshot.Version, names, snapshot.Sysctls})
+	sum := sha256.Sum256(data)
+	snapshot.Hash = hex.EncodeToString(sum[:])
+
+	return snapshot
+}
+
+// readSysctl reads a sysctl given in dotted form
+func readSysctl(key string) (string, error) {
+	data, err := os.ReadFile(hostFile(filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/"))))
+	if err != nil {
+		return "", err
+	}
+	// Multi-value sysctls are tab separated
+	return strings.Join(strings.Fields(string(data)), " "), nil
+}
+
+// readKernelModules lists loaded modules from /proc/modules, sorted by name
+func readKernelModules() []KernelModule {
+	modules := []KernelModule{}
+
+	file, err := os.Open(hostFile("/proc/modules"))
+	if err != nil {
+		return modules
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		modules = append(modules, KernelModule{Name: fields[0], Size: fields[1]})
+	}
+
+	sort.Slice(modules, func(i, j int) bool {
+		return modules[i].Name < modules[j].Name
+	})
+	return modules
+}
+
+// readTrimmedFile returns the trimmed contents of a file, or an empty string on error
+func readTrimmedFile(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
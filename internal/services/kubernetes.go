@@ -0,0 +1,80 @@
+package services
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"sprinter-agent/internal/config"
+)
+
+// kubernetesRidNamespace scopes RIDs derived from node names
+var kubernetesRidNamespace = uuid.MustParse("5f0b7c1e-3a8d-4c52-9d3e-6b1f2a7e8c40")
+
+// kubernetesIdentity is the node a DaemonSet pod runs on. The node, not the pod, is
+// registered as the host, so a restarted or rescheduled pod reports as the same host.
+type kubernetesIdentity struct {
+	Cluster   string            `json:"cluster,omitempty"`
+	Node      string            `json:"node"`
+	Namespace string            `json:"namespace,omitempty"`
+	Pod       string            `json:"pod,omitempty"`
+	HostIP    string            `json:"-"`
+	Labels    map[string]string `json:"-"`
+}
+
+// detectKubernetes reads the node identity exposed through the downward API, returning
+// nil when the agent does not run as a Kubernetes DaemonSet
+func detectKubernetes(cfg *config.Config) *kubernetesIdentity {
+	k8s := cfg.Kubernetes
+	if !k8s.Enabled {
+		return nil
+	}
+	// The downward API sets the node name with fieldRef spec.nodeName
+	node := os.Getenv(k8s.NodeNameEnv)
+	if node == "" || os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+		return nil
+	}
+
+	identity := &kubernetesIdentity{
+		Cluster:   k8s.Cluster,
+		Node:      node,
+		Namespace: os.Getenv("POD_NAMESPACE"),
+		Pod:       os.Getenv("POD_NAME"),
+		HostIP:    os.Getenv("HOST_IP"),
+	}
+	if k8s.LabelsFile != "" {
+		data, err := os.ReadFile(k8s.LabelsFile)
+		if err == nil {
+			identity.Labels = parseDownwardLabels(string(data))
+		} else if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read labels from %s: %v", k8s.LabelsFile, err)
+		}
+	}
+	return identity
+}
+
+// hostRid derives the node's RID from the cluster and node name, so a pod that lost its
+// state registers the same host again instead of a duplicate
+func (k *kubernetesIdentity) hostRid() string {
+	return uuid.NewSHA1(kubernetesRidNamespace, []byte(k.Cluster+"/"+k.Node)).String()
+}
+
+// parseDownwardLabels parses a downward API labels file made of key="value" lines
+func parseDownwardLabels(data string) map[string]string {
+	labels := make(map[string]string)
+	for _, line := range strings.Split(data, "\n") {
+		key, quoted, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || key == "" {
+			continue
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			value = quoted
+		}
+		labels[key] = value
+	}
+	return labels
+}
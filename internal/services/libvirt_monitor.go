@@ -0,0 +1,270 @@
+//go:build !minimal && !no_libvirt
+
+package services
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// domainStates names the values of a domain's state.state statistic
+var domainStates = map[string]string{
+	"0": "no state",
+	"1": "running",
+	"2": "blocked",
+	"3": "paused",
+	"4": "shutting down",
+	"5": "shut off",
+	"6": "crashed",
+	"7": "suspended",
+}
+
+// VirtualMachine is a libvirt domain defined on the host, reported as a child of it
+type VirtualMachine struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	// VCPUs and MemoryBytes are what the guest has now, Max* what it may be given
+	VCPUs          uint64 `json:"vcpus"`
+	MaxVCPUs       uint64 `json:"max_vcpus"`
+	MemoryBytes    uint64 `json:"memory_bytes"`
+	MaxMemoryBytes uint64 `json:"max_memory_bytes"`
+	// The counters below are only reported while the guest runs
+	CPUTimeNs   uint64   `json:"cpu_time_ns,omitempty"`
+	CPUPercent  *float64 `json:"cpu_percent,omitempty"`
+	DiskRead    uint64   `json:"disk_read_bytes,omitempty"`
+	DiskWritten uint64   `json:"disk_written_bytes,omitempty"`
+	NetReceived uint64   `json:"net_received_bytes,omitempty"`
+	NetSent     uint64   `json:"net_sent_bytes,omitempty"`
+	Disks       []string `json:"disks,omitempty"`
+	Interfaces  []string `json:"interfaces,omitempty"`
+}
+
+// VirtualMachinesReport is the payload sent to the virtual machines endpoint. It replaces
+// the previous one, so an undefined domain disappears.
+type VirtualMachinesReport struct {
+	Hypervisor string           `json:"hypervisor"`
+	Machines   []VirtualMachine `json:"machines"`
+}
+
+// LibvirtMonitorService reports the virtual machines libvirt manages on the host, so a
+// hypervisor exposes its guests
+type LibvirtMonitorService struct {
+	config   *config.Config
+	hostRid  string
+	stopChan chan bool
+	started  bool
+	// lastCPU holds the previous CPU time of each domain for the CPU percentage
+	lastCPU map[string]cpuSample
+}
+
+// NewLibvirtMonitorService creates a new libvirt monitor service
+func NewLibvirtMonitorService(cfg *config.Config, hostRid string) *LibvirtMonitorService {
+	return &LibvirtMonitorService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+		lastCPU:  make(map[string]cpuSample),
+	}
+}
+
+// init registers the collector, unless built with no_libvirt
+func init() {
+	registerCollector("libvirt", func(m *CollectorManager, c *config.Config) Collector {
+		return NewLibvirtMonitorService(c, m.hostRid)
+	})
+}
+
+// Start begins reporting virtual machines periodically
+func (s *LibvirtMonitorService) Start() error {
+	if !s.config.Libvirt.Enabled {
+		log.Println("Libvirt collector not enabled - skipping")
+		setCollectorStatus("libvirt", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping libvirt collector")
+		return nil
+	}
+	if _, err := exec.LookPath("virsh"); err != nil {
+		log.Println("virsh not found - skipping libvirt collector")
+		setCollectorStatus("libvirt", CollectorSkipped, "virsh not found")
+		return nil
+	}
+
+	s.started = true
+	go s.monitorLoop()
+
+	setCollectorStatus("libvirt", CollectorRunning, "")
+	log.Printf("Libvirt collector started for %s", s.config.Libvirt.URI)
+	return nil
+}
+
+// Stop stops the collector
+func (s *LibvirtMonitorService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("Libvirt collector stopped")
+	}
+}
+
+// monitorLoop reports the virtual machines at the configured interval
+func (s *LibvirtMonitorService) monitorLoop() {
+	defer recoverPanic("libvirt")
+	ticker := newCollectorTicker("libvirt", s.config.Libvirt.Interval)
+	defer ticker.Stop()
+
+	markProgress("libvirt", s.config.Libvirt.Interval)
+	s.reportMachines()
+	if finishedOnce("libvirt") {
+		return
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reportMachines()
+			markProgress("libvirt", s.config.Libvirt.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// reportMachines reads every domain's statistics and reports them
+func (s *LibvirtMonitorService) reportMachines() {
+	output, err := s.virsh("domstats", "--raw")
+	if err != nil {
+		if isPermissionError(err) {
+			if setPermissionProblem("libvirt", CollectorSkipped, "permission denied connecting to "+s.config.Libvirt.URI) {
+				log.Printf("Libvirt collector skipped due to permissions: %v", err)
+			}
+			return
+		}
+		log.Printf("Failed to read libvirt domain statistics: %v", err)
+		setCollectorStatus("libvirt", CollectorError, err.Error())
+		recordCollectorError("libvirt", err)
+		return
+	}
+	setCollectorStatus("libvirt", CollectorRunning, "")
+
+	machines := []VirtualMachine{}
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, machine := range parseDomainStats(output) {
+		if s.excluded(machine.Name) {
+			continue
+		}
+		if machine.CPUTimeNs > 0 {
+			usec := machine.CPUTimeNs / 1000
+			if prev, ok := s.lastCPU[machine.Name]; ok && usec >= prev.usageUsec {
+				if elapsed := now.Sub(prev.takenAt).Microseconds(); elapsed > 0 {
+					percent := float64(usec-prev.usageUsec) / float64(elapsed) * 100
+					machine.CPUPercent = &percent
+				}
+			}
+			s.lastCPU[machine.Name] = cpuSample{usageUsec: usec, takenAt: now}
+			seen[machine.Name] = true
+		}
+		machines = append(machines, machine)
+	}
+	for name := range s.lastCPU {
+		if !seen[name] {
+			delete(s.lastCPU, name)
+		}
+	}
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].Name < machines[j].Name
+	})
+
+	report := VirtualMachinesReport{Hypervisor: s.config.Libvirt.URI, Machines: machines}
+	if err := submitReport(context.Background(), s.config, http.MethodPut, hostPath(s.hostRid, "/virtual-machines"), report); err != nil {
+		log.Printf("Failed to report virtual machines: %v", err)
+		recordCollectorError("libvirt", err)
+	}
+}
+
+// excluded reports whether a domain name matches libvirt.exclude
+func (s *LibvirtMonitorService) excluded(name string) bool {
+	for _, pattern := range s.config.Libvirt.Exclude {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// virsh runs a read-only virsh command against the configured connection, including its
+// error output in any error
+func (s *LibvirtMonitorService) virsh(args ...string) (string, error) {
+	args = append([]string{"--readonly", "--connect", s.config.Libvirt.URI}, args...)
+	return runCollectorCommand("libvirt", nil, "virsh", args...)
+}
+
+// parseDomainStats parses virsh domstats --raw, a "Domain: 'name'" line per domain followed
+// by indented key=value statistics
+func parseDomainStats(output string) []VirtualMachine {
+	var machines []VirtualMachine
+	var current *VirtualMachine
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if name, ok := strings.CutPrefix(line, "Domain:"); ok {
+			machines = append(machines, VirtualMachine{Name: strings.Trim(strings.TrimSpace(name), "'"), State: "unknown"})
+			current = &machines[len(machines)-1]
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || current == nil {
+			continue
+		}
+		if key == "state.state" {
+			if state, ok := domainStates[value]; ok {
+				current.State = state
+			}
+			continue
+		}
+		// Device names are kept in the order libvirt lists them
+		if strings.HasSuffix(key, ".name") {
+			switch {
+			case strings.HasPrefix(key, "block."):
+				current.Disks = append(current.Disks, value)
+			case strings.HasPrefix(key, "net."):
+				current.Interfaces = append(current.Interfaces, value)
+			}
+			continue
+		}
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		switch {
+		case key == "vcpu.current":
+			current.VCPUs = n
+		case key == "vcpu.maximum":
+			current.MaxVCPUs = n
+		case key == "balloon.current":
+			current.MemoryBytes = n * 1024
+		case key == "balloon.maximum":
+			current.MaxMemoryBytes = n * 1024
+		case key == "cpu.time":
+			current.CPUTimeNs = n
+		case strings.HasPrefix(key, "block.") && strings.HasSuffix(key, ".rd.bytes"):
+			current.DiskRead += n
+		case strings.HasPrefix(key, "block.") && strings.HasSuffix(key, ".wr.bytes"):
+			current.DiskWritten += n
+		case strings.HasPrefix(key, "net.") && strings.HasSuffix(key, ".rx.bytes"):
+			current.NetReceived += n
+		case strings.HasPrefix(key, "net.") && strings.HasSuffix(key, ".tx.bytes"):
+			current.NetSent += n
+		}
+	}
+	return machines
+}
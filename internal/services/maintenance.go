@@ -0,0 +1,93 @@
+package services
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// MaintenanceWindow is a maintenance window in progress
+type MaintenanceWindow struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Reboot is set when the host is expected to reboot during the window
+	Reboot bool `json:"reboot,omitempty"`
+}
+
+// maintenanceWindow is a configured window with its parsed schedule, nil for a one-off
+// window
+type maintenanceWindow struct {
+	config.MaintenanceWindow
+	schedule *cronSchedule
+}
+
+// maintenance holds the windows of the current configuration
+var maintenance = struct {
+	sync.Mutex
+	windows []maintenanceWindow
+}{}
+
+// ConfigureMaintenance applies the maintenance windows of the configuration. A window
+// whose schedule does not parse is left out.
+func ConfigureMaintenance(cfg *config.Config) {
+	windows := make([]maintenanceWindow, 0, len(cfg.Maintenance.Windows))
+	for _, window := range cfg.Maintenance.Windows {
+		parsed := maintenanceWindow{MaintenanceWindow: window}
+		if window.Schedule != "" {
+			schedule, err := parseCronSchedule(window.Schedule)
+			if err != nil {
+				log.Printf("Warning: ignoring maintenance window %s: invalid schedule: %v", window.Name, err)
+				continue
+			}
+			parsed.schedule = schedule
+		}
+		windows = append(windows, parsed)
+	}
+
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	maintenance.windows = windows
+}
+
+// maintenanceAt returns the window in progress at t, preferring one that allows reboots
+func maintenanceAt(t time.Time) (MaintenanceWindow, bool) {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+
+	// Cron schedules are in local time
+	t = t.Local()
+	var found MaintenanceWindow
+	ok := false
+	for _, window := range maintenance.windows {
+		start, end := window.Start, window.End
+		if window.schedule != nil {
+			opened, fired := window.schedule.previous(t, window.Duration)
+			if !fired {
+				continue
+			}
+			start, end = opened, opened.Add(window.Duration)
+		}
+		if t.Before(start) || !t.Before(end) {
+			continue
+		}
+		if !ok || (window.Reboot && !found.Reboot) {
+			found = MaintenanceWindow{Name: window.Name, Start: start, End: end, Reboot: window.Reboot}
+			ok = true
+		}
+	}
+	return found, ok
+}
+
+// maintenanceTag returns the name of the window in progress at t, to tag events with
+func maintenanceTag(t time.Time) string {
+	window, _ := maintenanceAt(t)
+	return window.Name
+}
+
+// CurrentMaintenance returns the maintenance window in progress
+func CurrentMaintenance() (MaintenanceWindow, bool) {
+	return maintenanceAt(time.Now())
+}
@@ -0,0 +1,379 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// getfsstat flags and mount flags from <sys/mount.h>
+const (
+	mntNoWait     = 2
+	mntLocal      = 0x00001000
+	mntDontBrowse = 0x00100000
+)
+
+// darwinSampler reads host metrics on macOS. Memory, swap and the load average come from
+// sysctl and filesystems from getfsstat, without running anything. CPU ticks, the IOKit
+// registry and per-process usage are only reachable through Mach calls and frameworks,
+// which need cgo, so CPU usage, disks, the battery and processes still come from iostat,
+// ioreg and ps.
+type darwinSampler struct {
+	at    time.Time
+	disks map[string]ioKitDiskCounters
+}
+
+// ioKitDiskCounters are the cumulative statistics of an IOBlockStorageDriver
+type ioKitDiskCounters struct {
+	bytesRead, bytesWritten uint64
+	reads, writes           uint64
+	// readNanos and writeNanos are the total time spent on reads and on writes
+	readNanos, writeNanos uint64
+}
+
+// newMetricsSampler returns the macOS backend
+func newMetricsSampler() (metricsSampler, error) {
+	for _, tool := range []string{"iostat", "ioreg", "ps"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return nil, fmt.Errorf("%s not found in PATH: %w", tool, err)
+		}
+	}
+	return &darwinSampler{}, nil
+}
+
+// sample reads the host and computes disk rates against the previous sample
+func (d *darwinSampler) sample() (*HostMetrics, error) {
+	now := time.Now()
+	elapsed := now.Sub(d.at).Seconds()
+	first := d.at.IsZero()
+	d.at = now
+
+	metrics := &HostMetrics{
+		CollectedAt: now.UTC(),
+		Backend:     "darwin",
+		Disks:       []DiskMetrics{},
+	}
+
+	// iostat reports CPU usage over its one second interval, so no baseline is kept
+	usage, err := readDarwinCPU()
+	if err != nil {
+		return nil, err
+	}
+	metrics.CPU = CPUMetrics{UsagePercent: usage, Cores: runtime.NumCPU(), LoadAverage: readDarwinLoadAverage()}
+
+	memory, err := readDarwinMemory()
+	if err != nil {
+		return nil, err
+	}
+	metrics.Memory = memory
+
+	disks, err := readIOKitDisks()
+	if err != nil {
+		return nil, err
+	}
+	for name, current := range disks {
+		previous, ok := d.disks[name]
+		if first || !ok || current.bytesRead < previous.bytesRead || current.bytesWritten < previous.bytesWritten ||
+			current.reads < previous.reads || current.writes < previous.writes ||
+			current.readNanos < previous.readNanos || current.writeNanos < previous.writeNanos {
+			continue
+		}
+		readNanos := current.readNanos - previous.readNanos
+		writeNanos := current.writeNanos - previous.writeNanos
+		reads := current.reads - previous.reads
+		writes := current.writes - previous.writes
+		// Summed request time over elapsed time is the average number of requests in flight
+		queue := float64(readNanos+writeNanos) / 1e9 / elapsed
+		metrics.Disks = append(metrics.Disks, DiskMetrics{
+			Device:           name,
+			ReadBytesPerSec:  float64(current.bytesRead-previous.bytesRead) / elapsed,
+			WriteBytesPerSec: float64(current.bytesWritten-previous.bytesWritten) / elapsed,
+			ReadsPerSec:      float64(reads) / elapsed,
+			WritesPerSec:     float64(writes) / elapsed,
+			ReadAwaitMs:      averageOf(float64(readNanos)/1e6, reads),
+			WriteAwaitMs:     averageOf(float64(writeNanos)/1e6, writes),
+			QueueLength:      queue,
+			// IOKit has no idle time; a disk with a request in flight on average is busy
+			BusyPercent: min(queue, 1) * 100,
+		})
+	}
+	d.disks = disks
+
+	metrics.Filesystems = readDarwinFilesystems()
+	metrics.Power = readBattery()
+
+	processes, err := readDarwinProcesses()
+	if err != nil {
+		return nil, err
+	}
+	metrics.Processes = processes
+
+	return metrics, nil
+}
+
+// close releases nothing; every sample runs its own commands
+func (d *darwinSampler) close() {}
+
+// runDarwinCommand runs a system tool and returns its stdout
+func runDarwinCommand(name string, args ...string) (string, error) {
+	return runCollectorCommand("metrics", nil, name, args...)
+}
+
+// readDarwinCPU samples CPU usage with iostat. Its first line averages since boot, so the
+// second line, covering one second, is used.
+func readDarwinCPU() (float64, error) {
+	output, err := runDarwinCommand("iostat", "-n", "0", "-C", "-c", "2", "-w", "1")
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	// Columns: us sy id 1m 5m 15m
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 3 {
+		return 0, fmt.Errorf("unexpected iostat output: %q", lines[len(lines)-1])
+	}
+	idle, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected iostat output: %w", err)
+	}
+	return 100 - idle, nil
+}
+
+// readDarwinLoadAverage reads vm.loadavg, a struct loadavg of three fixed-point loads and
+// their scale, or returns nil when it cannot be read
+func readDarwinLoadAverage() []float64 {
+	raw, err := unix.SysctlRaw("vm.loadavg")
+	if err != nil || len(raw) < 24 {
+		return nil
+	}
+	// The long scale follows the three 32-bit loads after 4 bytes of padding
+	scale := float64(binary.LittleEndian.Uint64(raw[16:24]))
+	if scale == 0 {
+		return nil
+	}
+	loads := make([]float64, 3)
+	for i := range loads {
+		loads[i] = float64(binary.LittleEndian.Uint32(raw[i*4:])) / scale
+	}
+	return loads
+}
+
+// readDarwinMemory reads the totals and the page counts behind host_statistics64 from
+// sysctl
+func readDarwinMemory() (MemoryMetrics, error) {
+	total, err := sysctlNumber("hw.memsize")
+	if err != nil {
+		return MemoryMetrics{}, fmt.Errorf("failed to read hw.memsize: %w", err)
+	}
+	pageSize, err := sysctlNumber("hw.pagesize")
+	if err != nil {
+		return MemoryMetrics{}, fmt.Errorf("failed to read hw.pagesize: %w", err)
+	}
+	memory := MemoryMetrics{TotalBytes: total}
+
+	// Free pages, file-backed pages and purgeable pages are reclaimed without swapping,
+	// the memory Activity Monitor does not count as used
+	var available uint64
+	for _, name := range []string{"vm.page_free_count", "vm.page_pageable_external_count", "vm.page_purgeable_count"} {
+		pages, err := sysctlNumber(name)
+		if err != nil {
+			return MemoryMetrics{}, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		available += pages
+	}
+	memory.AvailableBytes = min(available*pageSize, total)
+	memory.UsedBytes = total - memory.AvailableBytes
+
+	// vm.swapusage is a struct xsw_usage: total, available and used bytes, then the page size
+	if raw, err := unix.SysctlRaw("vm.swapusage"); err == nil && len(raw) >= 24 {
+		memory.SwapTotalBytes = binary.LittleEndian.Uint64(raw[0:8])
+		memory.SwapUsedBytes = binary.LittleEndian.Uint64(raw[16:24])
+	}
+	return memory, nil
+}
+
+// sysctlNumber reads a numeric sysctl, which the kernel declares as a 32 or 64-bit integer
+func sysctlNumber(name string) (uint64, error) {
+	raw, err := unix.SysctlRaw(name)
+	if err != nil {
+		return 0, err
+	}
+	switch len(raw) {
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(raw)), nil
+	case 8:
+		return binary.LittleEndian.Uint64(raw), nil
+	}
+	return 0, fmt.Errorf("unexpected size %d", len(raw))
+}
+
+// ioregStatistic matches one counter in an IOBlockStorageDriver's Statistics dictionary
+var ioregStatistic = regexp.MustCompile(`"(Bytes|Operations|Total Time) \((Read|Write)\)"=(\d+)`)
+
+// ioregBSDName matches the BSD name of a storage device, such as disk0
+var ioregBSDName = regexp.MustCompile(`"BSD Name" = "(disk\d+)"`)
+
+// readIOKitDisks reads the cumulative statistics of every whole disk from the IOKit
+// registry. Each driver's Statistics are followed by its media, whose first BSD name is
+// the whole disk.
+func readIOKitDisks() (map[string]ioKitDiskCounters, error) {
+	output, err := runDarwinCommand("ioreg", "-r", "-c", "IOBlockStorageDriver", "-w", "0")
+	if err != nil {
+		return nil, err
+	}
+	disks := make(map[string]ioKitDiskCounters)
+	var pending *ioKitDiskCounters
+	for _, line := range strings.Split(output, "\n") {
+		if strings.Contains(line, `"Statistics" =`) {
+			counters := ioKitDiskCounters{}
+			for _, match := range ioregStatistic.FindAllStringSubmatch(line, -1) {
+				value, _ := strconv.ParseUint(match[3], 10, 64)
+				switch match[1] + " " + match[2] {
+				case "Bytes Read":
+					counters.bytesRead = value
+				case "Bytes Write":
+					counters.bytesWritten = value
+				case "Operations Read":
+					counters.reads = value
+				case "Operations Write":
+					counters.writes = value
+				case "Total Time Read":
+					counters.readNanos = value
+				case "Total Time Write":
+					counters.writeNanos = value
+				}
+			}
+			pending = &counters
+			continue
+		}
+		if match := ioregBSDName.FindStringSubmatch(line); match != nil && pending != nil {
+			disks[match[1]] = *pending
+			pending = nil
+		}
+	}
+	return disks, nil
+}
+
+// readDarwinFilesystems reads the space of local, visible filesystems with getfsstat
+func readDarwinFilesystems() []FilesystemMetrics {
+	count, err := syscall.Getfsstat(nil, mntNoWait)
+	if err != nil || count == 0 {
+		return nil
+	}
+	stats := make([]syscall.Statfs_t, count)
+	count, err = syscall.Getfsstat(stats, mntNoWait)
+	if err != nil {
+		return nil
+	}
+
+	filesystems := []FilesystemMetrics{}
+	for _, stat := range stats[:count] {
+		// System volumes such as /System/Volumes/VM are hidden from browsing
+		if stat.Flags&mntLocal == 0 || stat.Flags&mntDontBrowse != 0 || stat.Blocks == 0 {
+			continue
+		}
+		blockSize := uint64(stat.Bsize)
+		filesystems = append(filesystems, FilesystemMetrics{
+			MountPoint:     int8String(stat.Mntonname[:]),
+			Device:         int8String(stat.Mntfromname[:]),
+			Type:           int8String(stat.Fstypename[:]),
+			TotalBytes:     stat.Blocks * blockSize,
+			UsedBytes:      (stat.Blocks - stat.Bfree) * blockSize,
+			AvailableBytes: stat.Bavail * blockSize,
+		})
+	}
+	return filesystems
+}
+
+// int8String converts a NUL-terminated C char array
+func int8String(chars []int8) string {
+	buf := make([]byte, 0, len(chars))
+	for _, c := range chars {
+		if c == 0 {
+			break
+		}
+		buf = append(buf, byte(c))
+	}
+	return string(buf)
+}
+
+// ioregValue matches a numeric or boolean property of the battery
+var ioregValue = regexp.MustCompile(`^\s*"(\w+)" = (Yes|No|\d+)\s*$`)
+
+// readBattery reads the AppleSmartBattery IOKit service, or nil on machines without one
+func readBattery() *PowerMetrics {
+	output, err := runDarwinCommand("ioreg", "-r", "-n", "AppleSmartBattery", "-w", "0")
+	if err != nil || strings.TrimSpace(output) == "" {
+		return nil
+	}
+	values := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		if match := ioregValue.FindStringSubmatch(line); match != nil {
+			values[match[1]] = match[2]
+		}
+	}
+	number := func(key string) float64 {
+		value, _ := strconv.ParseFloat(values[key], 64)
+		return value
+	}
+	if _, ok := values["CurrentCapacity"]; !ok {
+		return nil
+	}
+
+	power := &PowerMetrics{
+		OnBattery: values["ExternalConnected"] == "No",
+		Charging:  values["IsCharging"] == "Yes",
+		// Apple silicon reports the charge as a percentage with MaxCapacity 100
+		BatteryPercent: percentOf(number("CurrentCapacity"), number("MaxCapacity")),
+		CycleCount:     int(number("CycleCount")),
+	}
+	fullCharge := number("AppleRawMaxCapacity")
+	if fullCharge == 0 && number("MaxCapacity") > 100 {
+		fullCharge = number("MaxCapacity")
+	}
+	power.HealthPercent = percentOf(fullCharge, number("DesignCapacity"))
+	// 65535 means the estimate is still being calculated
+	if remaining := int(number("TimeRemaining")); remaining > 0 && remaining < 65535 {
+		power.MinutesRemaining = &remaining
+	}
+	return power
+}
+
+// readDarwinProcesses lists processes with ps, whose CPU usage is a percentage of one core
+// averaged over the last minute
+func readDarwinProcesses() ([]ProcessMetrics, error) {
+	output, err := runDarwinCommand("ps", "-axo", "pid=,pcpu=,rss=,comm=")
+	if err != nil {
+		return nil, err
+	}
+	processes := []ProcessMetrics{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		pid, err1 := strconv.Atoi(fields[0])
+		cpu, err2 := strconv.ParseFloat(fields[1], 64)
+		rssKB, err3 := strconv.ParseUint(fields[2], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		processes = append(processes, ProcessMetrics{
+			PID: pid,
+			// comm is the executable path, which may contain spaces
+			Name:        filepath.Base(strings.Join(fields[3:], " ")),
+			CPUPercent:  cpu,
+			MemoryBytes: rssKB * 1024,
+		})
+	}
+	return processes, nil
+}
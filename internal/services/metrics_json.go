@@ -0,0 +1,271 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// appendJSON appends the metrics encoded as encoding/json would encode them. Metrics are
+// reported every few seconds with hundreds of processes, which reflection makes the most
+// expensive part of a report; this encoder writes the fields directly and must follow
+// the struct tags when fields change.
+func (m *HostMetrics) appendJSON(b []byte) ([]byte, error) {
+	w := jsonWriter{buf: b}
+	w.raw(`{"collected_at":`)
+	w.time(m.CollectedAt)
+	w.raw(`,"backend":`)
+	w.string(m.Backend)
+
+	w.raw(`,"cpu":{"usage_percent":`)
+	w.float(m.CPU.UsagePercent)
+	w.raw(`,"cores":`)
+	w.int(int64(m.CPU.Cores))
+	if len(m.CPU.LoadAverage) > 0 {
+		w.raw(`,"load_average":[`)
+		for i, load := range m.CPU.LoadAverage {
+			if i > 0 {
+				w.raw(",")
+			}
+			w.float(load)
+		}
+		w.raw("]")
+	}
+
+	w.raw(`},"memory":{"total_bytes":`)
+	w.uint(m.Memory.TotalBytes)
+	w.raw(`,"available_bytes":`)
+	w.uint(m.Memory.AvailableBytes)
+	w.raw(`,"used_bytes":`)
+	w.uint(m.Memory.UsedBytes)
+	w.raw(`,"swap_total_bytes":`)
+	w.uint(m.Memory.SwapTotalBytes)
+	w.raw(`,"swap_used_bytes":`)
+	w.uint(m.Memory.SwapUsedBytes)
+
+	w.raw(`},"disks":`)
+	if m.Disks == nil {
+		w.raw("null")
+	} else {
+		w.raw("[")
+		for i := range m.Disks {
+			disk := &m.Disks[i]
+			if i > 0 {
+				w.raw(",")
+			}
+			w.raw(`{"device":`)
+			w.string(disk.Device)
+			if disk.Name != "" {
+				w.raw(`,"name":`)
+				w.string(disk.Name)
+			}
+			w.raw(`,"read_bytes_per_sec":`)
+			w.float(disk.ReadBytesPerSec)
+			w.raw(`,"write_bytes_per_sec":`)
+			w.float(disk.WriteBytesPerSec)
+			w.raw(`,"reads_per_sec":`)
+			w.float(disk.ReadsPerSec)
+			w.raw(`,"writes_per_sec":`)
+			w.float(disk.WritesPerSec)
+			w.raw(`,"read_await_ms":`)
+			w.float(disk.ReadAwaitMs)
+			w.raw(`,"write_await_ms":`)
+			w.float(disk.WriteAwaitMs)
+			w.raw(`,"queue_length":`)
+			w.float(disk.QueueLength)
+			w.raw(`,"busy_percent":`)
+			w.float(disk.BusyPercent)
+			w.raw("}")
+		}
+		w.raw("]")
+	}
+
+	if len(m.Filesystems) > 0 {
+		w.raw(`,"filesystems":[`)
+		for i := range m.Filesystems {
+			filesystem := &m.Filesystems[i]
+			if i > 0 {
+				w.raw(",")
+			}
+			w.raw(`{"mount_point":`)
+			w.string(filesystem.MountPoint)
+			w.raw(`,"device":`)
+			w.string(filesystem.Device)
+			w.raw(`,"type":`)
+			w.string(filesystem.Type)
+			w.raw(`,"total_bytes":`)
+			w.uint(filesystem.TotalBytes)
+			w.raw(`,"used_bytes":`)
+			w.uint(filesystem.UsedBytes)
+			w.raw(`,"available_bytes":`)
+			w.uint(filesystem.AvailableBytes)
+			w.raw("}")
+		}
+		w.raw("]")
+	}
+
+	if power := m.Power; power != nil {
+		w.raw(`,"power":{"on_battery":`)
+		w.bool(power.OnBattery)
+		w.raw(`,"charging":`)
+		w.bool(power.Charging)
+		w.raw(`,"battery_percent":`)
+		w.float(power.BatteryPercent)
+		if power.HealthPercent != 0 {
+			w.raw(`,"health_percent":`)
+			w.float(power.HealthPercent)
+		}
+		if power.CycleCount != 0 {
+			w.raw(`,"cycle_count":`)
+			w.int(int64(power.CycleCount))
+		}
+		if power.MinutesRemaining != nil {
+			w.raw(`,"minutes_remaining":`)
+			w.int(int64(*power.MinutesRemaining))
+		}
+		w.raw("}")
+	}
+
+	w.raw(`,"processes":`)
+	if m.Processes == nil {
+		w.raw("null")
+	} else {
+		w.raw("[")
+		for i := range m.Processes {
+			process := &m.Processes[i]
+			if i > 0 {
+				w.raw(",")
+			}
+			w.raw(`{"pid":`)
+			w.int(int64(process.PID))
+			w.raw(`,"name":`)
+			w.string(process.Name)
+			w.raw(`,"cpu_percent":`)
+			w.float(process.CPUPercent)
+			w.raw(`,"memory_bytes":`)
+			w.uint(process.MemoryBytes)
+			w.raw("}")
+		}
+		w.raw("]")
+	}
+	w.raw("}")
+	return w.buf, w.err
+}
+
+// jsonWriter appends JSON values to buf. The first value that cannot be encoded sets err,
+// like it fails json.Marshal.
+type jsonWriter struct {
+	buf []byte
+	err error
+}
+
+const hexDigits = "0123456789abcdef"
+
+// raw appends JSON text as it is
+func (w *jsonWriter) raw(s string) {
+	w.buf = append(w.buf, s...)
+}
+
+func (w *jsonWriter) bool(v bool) {
+	w.buf = strconv.AppendBool(w.buf, v)
+}
+
+func (w *jsonWriter) int(v int64) {
+	w.buf = strconv.AppendInt(w.buf, v, 10)
+}
+
+func (w *jsonWriter) uint(v uint64) {
+	w.buf = strconv.AppendUint(w.buf, v, 10)
+}
+
+// float appends a number formatted like encoding/json does, in exponent notation only
+// for very small and very large values
+func (w *jsonWriter) float(v float64) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		if w.err == nil {
+			w.err = fmt.Errorf("json: unsupported value: %s", strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		w.buf = append(w.buf, '0')
+		return
+	}
+	format := byte('f')
+	if abs := math.Abs(v); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	w.buf = strconv.AppendFloat(w.buf, v, format, -1, 64)
+	if format == 'e' {
+		// 1e-07 is written 1e-7
+		if n := len(w.buf); n >= 4 && w.buf[n-4] == 'e' && w.buf[n-3] == '-' && w.buf[n-2] == '0' {
+			w.buf[n-2] = w.buf[n-1]
+			w.buf = w.buf[:n-1]
+		}
+	}
+}
+
+// time appends a timestamp in RFC 3339 with nanoseconds, as time.Time encodes itself
+func (w *jsonWriter) time(t time.Time) {
+	if year := t.Year(); year < 0 || year >= 10000 {
+		if w.err == nil {
+			w.err = fmt.Errorf("json: year %d outside of range [0,9999]", year)
+		}
+	}
+	w.buf = append(w.buf, '"')
+	w.buf = t.AppendFormat(w.buf, time.RFC3339Nano)
+	w.buf = append(w.buf, '"')
+}
+
+// string appends a quoted string, escaped like encoding/json escapes it: HTML characters,
+// control characters and the JavaScript line separators are escaped, and invalid UTF-8
+// is replaced
+func (w *jsonWriter) string(s string) {
+	w.buf = append(w.buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			w.buf = append(w.buf, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				w.buf = append(w.buf, '\\', c)
+			case '\b':
+				w.buf = append(w.buf, '\\', 'b')
+			case '\f':
+				w.buf = append(w.buf, '\\', 'f')
+			case '\n':
+				w.buf = append(w.buf, '\\', 'n')
+			case '\r':
+				w.buf = append(w.buf, '\\', 'r')
+			case '\t':
+				w.buf = append(w.buf, '\\', 't')
+			default:
+				w.buf = append(w.buf, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			w.buf = append(w.buf, s[start:i]...)
+			w.buf = append(w.buf, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			w.buf = append(w.buf, s[start:i]...)
+			w.buf = append(w.buf, '\\', 'u', '2', '0', '2', hexDigits[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	w.buf = append(w.buf, s[start:]...)
+	w.buf = append(w.buf, '"')
+}
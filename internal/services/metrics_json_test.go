@@ -0,0 +1,126 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// populatedMetrics returns metrics with every field set and processes processes
+func populatedMetrics(processes int) *HostMetrics {
+	minutes := 95
+	m := &HostMetrics{
+		CollectedAt: time.Date(2024, 3, 9, 14, 5, 7, 123456789, time.FixedZone("CET", 3600)),
+		Backend:     "procfs",
+		CPU:         CPUMetrics{UsagePercent: 12.5, Cores: 8, LoadAverage: []float64{0.52, 0.61, 1.0}},
+		Memory: MemoryMetrics{
+			TotalBytes:     16 << 30,
+			AvailableBytes: 9 << 30,
+			UsedBytes:      7 << 30,
+			SwapTotalBytes: 2 << 30,
+			SwapUsedBytes:  math.MaxUint64,
+		},
+		Disks: []DiskMetrics{{
+			Device: "dm-0", Name: "vg0-data",
+			ReadBytesPerSec: 1048576, WriteBytesPerSec: 0.001,
+			ReadsPerSec: 10, WritesPerSec: 3.3333333333333335,
+			ReadAwaitMs: 0.25, WriteAwaitMs: 1e-7,
+			QueueLength: 0, BusyPercent: 100,
+		}},
+		Filesystems: []FilesystemMetrics{{MountPoint: "/", Device: "/dev/sda1", Type: "ext4", TotalBytes: 1 << 40, UsedBytes: 1 << 39, AvailableBytes: 1 << 38}},
+		Power:       &PowerMetrics{OnBattery: true, BatteryPercent: 87.5, HealthPercent: 91, CycleCount: 312, MinutesRemaining: &minutes},
+	}
+	for i := 0; i < processes; i++ {
+		m.Processes = append(m.Processes, ProcessMetrics{PID: 1000 + i, Name: fmt.Sprintf("worker-%d", i), CPUPercent: float64(i) / 3, MemoryBytes: uint64(i) << 20})
+	}
+	return m
+}
+
+func TestAppendJSONMatchesMarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics *HostMetrics
+	}{
+		{"populated", populatedMetrics(3)},
+		{"empty", &HostMetrics{}},
+		{"nil slices", &HostMetrics{Backend: "iostat", Disks: nil, Processes: nil, CPU: CPUMetrics{LoadAverage: nil}}},
+		{"empty slices", &HostMetrics{Disks: []DiskMetrics{}, Filesystems: []FilesystemMetrics{}, Processes: []ProcessMetrics{}, CPU: CPUMetrics{LoadAverage: []float64{}}}},
+		{"power without estimate", &HostMetrics{Power: &PowerMetrics{Charging: true}}},
+		{"special floats", &HostMetrics{
+			CPU: CPUMetrics{UsagePercent: math.Copysign(0, -1), LoadAverage: []float64{
+				1e-6, 9.99e-7, 1e20, 1e21, 123456789012345678901234.0, math.MaxFloat64, math.SmallestNonzeroFloat64, -1e-300, 0.1 + 0.2,
+			}},
+			Processes: []ProcessMetrics{{CPUPercent: -5e-324}},
+		}},
+		{"strings", &HostMetrics{
+			Backend: "quote\" backslash\\ <tag> & line\u2028para\u2029 tab\t nul\x00 \x7f é 日本",
+			Disks:   []DiskMetrics{{Device: "bad \xff\xfe utf-8", Name: "cut \xe6\x97"}},
+			Filesystems: []FilesystemMetrics{{
+				MountPoint: "/mnt/\xc3\x28", Device: "\xed\xa0\x80 surrogate", Type: "\x01\x1f control",
+			}},
+			Processes: []ProcessMetrics{{Name: "\xf0\x9f\x98\x80 emoji \xf0\x9f"}},
+		}},
+		{"times", &HostMetrics{CollectedAt: time.Date(1999, 12, 31, 23, 59, 59, 0, time.UTC)}},
+		{"time with offset", &HostMetrics{CollectedAt: time.Date(2024, 1, 2, 3, 4, 5, 6000, time.FixedZone("", -(9*3600+30*60)))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := json.Marshal(tt.metrics)
+			if err != nil {
+				t.Fatalf("json.Marshal: %v", err)
+			}
+			got, err := tt.metrics.appendJSON([]byte("prefix"))
+			if err != nil {
+				t.Fatalf("appendJSON: %v", err)
+			}
+			if !bytes.Equal(got, append([]byte("prefix"), want...)) {
+				t.Errorf("appendJSON =\n%s\nwant\nprefix%s", got, want)
+			}
+		})
+	}
+}
+
+func TestAppendJSONRejectsWhatMarshalRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics *HostMetrics
+	}{
+		{"NaN", &HostMetrics{CPU: CPUMetrics{UsagePercent: math.NaN()}}},
+		{"infinity", &HostMetrics{Disks: []DiskMetrics{{BusyPercent: math.Inf(1)}}}},
+		{"negative infinity", &HostMetrics{CPU: CPUMetrics{LoadAverage: []float64{math.Inf(-1)}}}},
+		{"year 10000", &HostMetrics{CollectedAt: time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := json.Marshal(tt.metrics); err == nil {
+				t.Fatal("json.Marshal accepted the metrics")
+			}
+			if _, err := tt.metrics.appendJSON(nil); err == nil {
+				t.Fatal("appendJSON accepted metrics json.Marshal rejects")
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeHostMetrics(b *testing.B) {
+	m := populatedMetrics(200)
+	b.Run("appendJSON", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := encodeBody(m); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("json.Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := json.Marshal(m); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
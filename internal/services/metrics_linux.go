@@ -0,0 +1,632 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// deviceRefreshInterval is how often the sampler forgets what it learned about disks and
+// mounts, so a renamed device mapper volume or a remounted filesystem is picked up
+const deviceRefreshInterval = time.Minute
+
+// atFDCWD makes openat resolve paths like open does
+var atFDCWD = -100
+
+// procfsSampler reads host metrics from /proc, through the host mounts in a container.
+// Sampling every second on a host with thousands of processes must stay cheap, so the
+// sampler keeps its read buffers, counter maps and the metrics it returns between samples:
+// once processes, disks and mounts are steady, a sample allocates next to nothing. The
+// metrics it returns are only valid until the next sample.
+type procfsSampler struct {
+	at  time.Time
+	cpu cpuTimes
+	// disks and procs hold the previous sample's counters; the next maps are filled by the
+	// current sample and swapped in once it is done
+	disks, nextDisks map[string]diskCounters
+	procs, nextProcs map[int]procCounters
+	// devices and mounts remember what was learned about diskstats entries and mount table
+	// lines until the next refresh
+	devices   map[string]diskDevice
+	mounts    map[string]mountEntry
+	refreshed time.Time
+	// statted are the devices whose filesystem this sample already counted
+	statted map[string]bool
+
+	reader  procReader
+	paths   procPaths
+	metrics HostMetrics
+}
+
+// procPaths are the NUL-terminated paths of the files read every sample
+type procPaths struct {
+	stat, loadavg, meminfo, diskstats, mounts []byte
+}
+
+// cpuTimes are the cumulative jiffies from the aggregate cpu line of /proc/stat
+type cpuTimes struct {
+	idle, total uint64
+}
+
+// diskCounters are the cumulative counters of a disk in /proc/diskstats
+type diskCounters struct {
+	reads, writes               uint64
+	sectorsRead, sectorsWritten uint64
+	readMillis, writeMillis     uint64
+	ioMillis, weightedMillis    uint64
+}
+
+// procCounters are what a sample keeps of a process for the next one
+type procCounters struct {
+	ticks uint64
+	name  string
+}
+
+// diskDevice is what the sampler learned about a /proc/diskstats entry
+type diskDevice struct {
+	name string
+	// whole is false for partitions, loop devices and RAM disks, which are skipped
+	whole bool
+	// mapperName is the device mapper name, such as vg0-data
+	mapperName string
+}
+
+// mountEntry is a parsed line of the mount table; skip is set for filesystems that are not
+// on a block device
+type mountEntry struct {
+	skip                       bool
+	mountPoint, device, fsType string
+	path                       string
+}
+
+// newMetricsSampler returns the procfs backend
+func newMetricsSampler() (metricsSampler, error) {
+	if _, err := os.Stat(hostFile("/proc/stat")); err != nil {
+		return nil, fmt.Errorf("/proc is not available: %w", err)
+	}
+	return &procfsSampler{
+		disks:     make(map[string]diskCounters),
+		nextDisks: make(map[string]diskCounters),
+		procs:     make(map[int]procCounters),
+		nextProcs: make(map[int]procCounters),
+		devices:   make(map[string]diskDevice),
+		mounts:    make(map[string]mountEntry),
+		statted:   make(map[string]bool),
+		reader:    procReader{root: hostFile("/proc")},
+		paths: procPaths{
+			stat:      cPath(hostFile("/proc/stat")),
+			loadavg:   cPath(hostFile("/proc/loadavg")),
+			meminfo:   cPath(hostFile("/proc/meminfo")),
+			diskstats: cPath(hostFile("/proc/diskstats")),
+			mounts:    cPath(hostProcSelf("mounts")),
+		},
+		metrics: HostMetrics{Backend: "procfs", Disks: []DiskMetrics{}},
+	}, nil
+}
+
+// sample reads /proc and computes rates against the previous sample
+func (p *procfsSampler) sample() (*HostMetrics, error) {
+	now := time.Now()
+	elapsed := now.Sub(p.at).Seconds()
+	first := p.at.IsZero()
+	p.at = now
+	if now.Sub(p.refreshed) > deviceRefreshInterval {
+		clear(p.devices)
+		clear(p.mounts)
+		p.refreshed = now
+	}
+
+	metrics := &p.metrics
+	metrics.CollectedAt = now.UTC()
+	metrics.CPU = CPUMetrics{LoadAverage: metrics.CPU.LoadAverage[:0]}
+	metrics.Disks = metrics.Disks[:0]
+	metrics.Filesystems = metrics.Filesystems[:0]
+	metrics.Processes = metrics.Processes[:0]
+
+	data, err := p.reader.read(p.paths.stat)
+	if err != nil {
+		return nil, err
+	}
+	cpu, err := parseCPUTimes(data)
+	if err != nil {
+		return nil, err
+	}
+	if !first && cpu.total > p.cpu.total {
+		busy := float64(cpu.total-p.cpu.total) - float64(cpu.idle-p.cpu.idle)
+		metrics.CPU.UsagePercent = percentOf(busy, float64(cpu.total-p.cpu.total))
+	}
+	p.cpu = cpu
+	metrics.CPU.Cores = runtime.NumCPU()
+	if data, err := p.reader.read(p.paths.loadavg); err == nil {
+		metrics.CPU.LoadAverage = appendLoadAverage(metrics.CPU.LoadAverage, data)
+	} else {
+		metrics.CPU.LoadAverage = nil
+	}
+
+	data, err = p.reader.read(p.paths.meminfo)
+	if err != nil {
+		return nil, err
+	}
+	metrics.Memory = parseMemInfo(data)
+
+	data, err = p.reader.read(p.paths.diskstats)
+	if err != nil {
+		return nil, err
+	}
+	p.sampleDisks(data, elapsed, first)
+
+	if data, err := p.reader.read(p.paths.mounts); err == nil {
+		p.sampleFilesystems(data)
+	}
+
+	if err := p.sampleProcesses(elapsed, first); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// sampleDisks computes the activity of whole disks from /proc/diskstats
+func (p *procfsSampler) sampleDisks(data []byte, elapsed float64, first bool) {
+	clear(p.nextDisks)
+	for len(data) > 0 {
+		var line []byte
+		line, data, _ = bytes.Cut(data, []byte{'\n'})
+		var fields [14][]byte
+		count := 0
+		for rest := line; count < len(fields); count++ {
+			if fields[count], rest = nextField(rest); fields[count] == nil {
+				break
+			}
+		}
+		if count < len(fields) {
+			continue
+		}
+		device := p.diskDevice(fields[2])
+		if !device.whole {
+			continue
+		}
+		var values [8]uint64
+		for i, index := range [...]int{3, 7, 5, 9, 6, 10, 12, 13} {
+			values[i], _ = parseDecimal(fields[index])
+		}
+		current := diskCounters{
+			reads:          values[0],
+			writes:         values[1],
+			sectorsRead:    values[2],
+			sectorsWritten: values[3],
+			readMillis:     values[4],
+			writeMillis:    values[5],
+			ioMillis:       values[6],
+			weightedMillis: values[7],
+		}
+		p.nextDisks[device.name] = current
+
+		previous, ok := p.disks[device.name]
+		// The counters are 32 bits wide on 32-bit kernels and wrap on busy disks
+		if first || !ok || current.reads < previous.reads || current.writes < previous.writes ||
+			current.readMillis < previous.readMillis || current.writeMillis < previous.writeMillis {
+			continue
+		}
+		elapsedMillis := elapsed * 1000
+		reads := current.reads - previous.reads
+		writes := current.writes - previous.writes
+		p.metrics.Disks = append(p.metrics.Disks, DiskMetrics{
+			Device:           device.name,
+			Name:             device.mapperName,
+			ReadBytesPerSec:  float64(current.sectorsRead-previous.sectorsRead) * 512 / elapsed,
+			WriteBytesPerSec: float64(current.sectorsWritten-previous.sectorsWritten) * 512 / elapsed,
+			ReadsPerSec:      float64(reads) / elapsed,
+			WritesPerSec:     float64(writes) / elapsed,
+			ReadAwaitMs:      averageOf(float64(current.readMillis-previous.readMillis), reads),
+			WriteAwaitMs:     averageOf(float64(current.writeMillis-previous.writeMillis), writes),
+			QueueLength:      float64(current.weightedMillis-previous.weightedMillis) / elapsedMillis,
+			BusyPercent:      percentOf(float64(current.ioMillis-previous.ioMillis), elapsedMillis),
+		})
+	}
+	p.disks, p.nextDisks = p.nextDisks, p.disks
+}
+
+// diskDevice returns what is known about a diskstats entry, learning it on first sight.
+// Partitions, loop devices and RAM disks are not whole disks; only whole disks have an
+// entry in /sys/block.
+func (p *procfsSampler) diskDevice(name []byte) diskDevice {
+	if device, ok := p.devices[string(name)]; ok {
+		return device
+	}
+	device := diskDevice{name: string(name)}
+	if !strings.HasPrefix(device.name, "loop") && !strings.HasPrefix(device.name, "ram") && !strings.HasPrefix(device.name, "zram") {
+		if _, err := os.Stat(hostFile("/sys/block/" + device.name)); err == nil {
+			device.whole = true
+			device.mapperName = deviceMapperName(device.name)
+		}
+	}
+	p.devices[device.name] = device
+	return device
+}
+
+// sampleFilesystems reads the space of filesystems on block devices, once per device so
+// bind mounts are not counted twice
+func (p *procfsSampler) sampleFilesystems(data []byte) {
+	clear(p.statted)
+	for len(data) > 0 {
+		var line []byte
+		line, data, _ = bytes.Cut(data, []byte{'\n'})
+		entry, ok := p.mounts[string(line)]
+		if !ok {
+			entry = parseMountEntry(line)
+			p.mounts[string(line)] = entry
+		}
+		if entry.skip || p.statted[entry.device] {
+			continue
+		}
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(entry.path, &stat); err != nil || stat.Blocks == 0 {
+			continue
+		}
+		p.statted[entry.device] = true
+		blockSize := uint64(stat.Bsize)
+		p.metrics.Filesystems = append(p.metrics.Filesystems, FilesystemMetrics{
+			MountPoint:     entry.mountPoint,
+			Device:         entry.device,
+			Type:           entry.fsType,
+			TotalBytes:     stat.Blocks * blockSize,
+			UsedBytes:      (stat.Blocks - stat.Bfree) * blockSize,
+			AvailableBytes: stat.Bavail * blockSize,
+		})
+	}
+}
+
+// parseMountEntry parses a line of the mount table
+func parseMountEntry(line []byte) mountEntry {
+	device, rest := nextField(line)
+	mountPoint, rest := nextField(rest)
+	fsType, _ := nextField(rest)
+	if fsType == nil || !bytes.HasPrefix(device, []byte("/dev/")) {
+		return mountEntry{skip: true}
+	}
+	// Spaces in mount points are escaped as \040
+	entry := mountEntry{
+		mountPoint: strings.ReplaceAll(string(mountPoint), "\\040", " "),
+		device:     string(device),
+		fsType:     string(fsType),
+	}
+	entry.path = hostFile(entry.mountPoint)
+	return entry
+}
+
+// sampleProcesses reads the CPU time and memory of every process
+func (p *procfsSampler) sampleProcesses(elapsed float64, first bool) error {
+	clear(p.nextProcs)
+	pageSize := uint64(os.Getpagesize())
+	err := p.reader.eachPID(func(pid int) {
+		data, err := p.reader.readPID(pid, "stat")
+		if err != nil {
+			// The process exited while /proc was read
+			return
+		}
+		name, ticks, rssPages, ok := parseProcStat(data)
+		if !ok {
+			return
+		}
+		previous, seen := p.procs[pid]
+		// A process keeps its name string from sample to sample until it renames itself
+		if !seen || previous.name != string(name) {
+			previous.name = string(name)
+		}
+		p.nextProcs[pid] = procCounters{ticks: ticks, name: previous.name}
+
+		process := ProcessMetrics{PID: pid, Name: previous.name, MemoryBytes: rssPages * pageSize}
+		if seen && !first && ticks >= previous.ticks {
+			process.CPUPercent = float64(ticks-previous.ticks) / clockTicks / elapsed * 100
+		}
+		p.metrics.Processes = append(p.metrics.Processes, process)
+	})
+	if err != nil {
+		return err
+	}
+	p.procs, p.nextProcs = p.nextProcs, p.procs
+	return nil
+}
+
+// close releases nothing; procfs keeps no handles open
+func (p *procfsSampler) close() {}
+
+// procReader reads /proc files into one reused buffer. Paths are NUL-terminated byte
+// slices opened with a raw openat, since syscall.Open copies every path it is given.
+type procReader struct {
+	root    string
+	path    []byte
+	buf     []byte
+	dirents []byte
+}
+
+// cPath returns a path as a NUL-terminated byte slice
+func cPath(path string) []byte {
+	return append([]byte(path), 0)
+}
+
+// open opens a NUL-terminated path
+func (r *procReader) open(path []byte, flags int) (int, error) {
+	fd, _, errno := syscall.Syscall6(syscall.SYS_OPENAT, uintptr(atFDCWD), uintptr(unsafe.Pointer(&path[0])), uintptr(flags|syscall.O_RDONLY|syscall.O_CLOEXEC), 0, 0, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// read returns the content of a file, valid until the next read
+func (r *procReader) read(path []byte) ([]byte, error) {
+	fd, err := r.open(path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	if r.buf == nil {
+		r.buf = make([]byte, 64<<10)
+	}
+	n := 0
+	for {
+		if n == len(r.buf) {
+			r.buf = append(r.buf, make([]byte, len(r.buf))...)
+		}
+		m, err := syscall.Read(fd, r.buf[n:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if m == 0 {
+			return r.buf[:n], nil
+		}
+		n += m
+	}
+}
+
+// readPID returns the content of a file of a process, valid until the next read
+func (r *procReader) readPID(pid int, name string) ([]byte, error) {
+	r.path = append(r.path[:0], r.root...)
+	r.path = append(r.path, '/')
+	r.path = strconv.AppendInt(r.path, int64(pid), 10)
+	r.path = append(r.path, '/')
+	r.path = append(r.path, name...)
+	r.path = append(r.path, 0)
+	return r.read(r.path)
+}
+
+// eachPID calls fn with the ID of every process in /proc, reading the directory entries
+// itself since os.ReadDir allocates an entry per process
+func (r *procReader) eachPID(fn func(pid int)) error {
+	r.path = append(append(r.path[:0], r.root...), 0)
+	fd, err := r.open(r.path, syscall.O_DIRECTORY)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if r.dirents == nil {
+		r.dirents = make([]byte, 32<<10)
+	}
+	for {
+		n, err := syscall.ReadDirent(fd, r.dirents)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		// Each entry is a linux_dirent64: inode, offset, record length, type, then the
+		// NUL-terminated name
+		for entries := r.dirents[:n]; len(entries) >= 19; {
+			length := int(*(*uint16)(unsafe.Pointer(&entries[16])))
+			if length < 19 || length > len(entries) {
+				break
+			}
+			name, _, _ := bytes.Cut(entries[19:length], []byte{0})
+			if pid, ok := parseDecimal(name); ok {
+				fn(int(pid))
+			}
+			entries = entries[length:]
+		}
+	}
+}
+
+// nextField returns the first space-separated field of b and what follows it, or nil
+// when there is none
+func nextField(b []byte) (field, rest []byte) {
+	start := 0
+	for start < len(b) && (b[start] == ' ' || b[start] == '\t') {
+		start++
+	}
+	if start == len(b) {
+		return nil, nil
+	}
+	end := start
+	for end < len(b) && b[end] != ' ' && b[end] != '\t' {
+		end++
+	}
+	return b[start:end], b[end:]
+}
+
+// parseDecimal parses an unsigned decimal number; ok is false for anything else
+func parseDecimal(b []byte) (value uint64, ok bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		value = value*10 + uint64(c-'0')
+	}
+	return value, true
+}
+
+// parseCPUTimes parses the aggregate cpu line of /proc/stat
+func parseCPUTimes(data []byte) (cpuTimes, error) {
+	line, _, _ := bytes.Cut(data, []byte{'\n'})
+	label, rest := nextField(line)
+	if string(label) != "cpu" {
+		return cpuTimes{}, fmt.Errorf("unexpected /proc/stat format")
+	}
+	var times cpuTimes
+	// user nice system idle iowait irq softirq steal; guest time is already in user
+	count := 0
+	for ; count < 8; count++ {
+		var field []byte
+		if field, rest = nextField(rest); field == nil {
+			break
+		}
+		value, ok := parseDecimal(field)
+		if !ok {
+			return cpuTimes{}, fmt.Errorf("unexpected /proc/stat format: %q", field)
+		}
+		times.total += value
+		if count == 3 || count == 4 {
+			times.idle += value
+		}
+	}
+	if count < 4 {
+		return cpuTimes{}, fmt.Errorf("unexpected /proc/stat format")
+	}
+	return times, nil
+}
+
+// appendLoadAverage appends the 1, 5 and 15 minute load of /proc/loadavg to loads, or
+// returns nil when it cannot be parsed
+func appendLoadAverage(loads []float64, data []byte) []float64 {
+	for i := 0; i < 3; i++ {
+		var field []byte
+		if field, data = nextField(data); field == nil {
+			return nil
+		}
+		load, err := strconv.ParseFloat(string(field), 64)
+		if err != nil {
+			return nil
+		}
+		loads = append(loads, load)
+	}
+	return loads
+}
+
+// readMemInfo reads physical memory and swap from /proc/meminfo
+func readMemInfo() (MemoryMetrics, error) {
+	data, err := os.ReadFile(hostFile("/proc/meminfo"))
+	if err != nil {
+		return MemoryMetrics{}, err
+	}
+	return parseMemInfo(data), nil
+}
+
+// parseMemInfo parses physical memory and swap from /proc/meminfo
+func parseMemInfo(data []byte) MemoryMetrics {
+	var memory MemoryMetrics
+	var free, buffers, cached, swapFree uint64
+	hasAvailable := false
+	for len(data) > 0 {
+		var line []byte
+		line, data, _ = bytes.Cut(data, []byte{'\n'})
+		key, value, ok := bytes.Cut(line, []byte{':'})
+		if !ok {
+			continue
+		}
+		field, _ := nextField(value)
+		kb, ok := parseDecimal(field)
+		if !ok {
+			continue
+		}
+		switch string(key) {
+		case "MemTotal":
+			memory.TotalBytes = kb * 1024
+		case "MemAvailable":
+			memory.AvailableBytes, hasAvailable = kb*1024, true
+		case "MemFree":
+			free = kb * 1024
+		case "Buffers":
+			buffers = kb * 1024
+		case "Cached":
+			cached = kb * 1024
+		case "SwapTotal":
+			memory.SwapTotalBytes = kb * 1024
+		case "SwapFree":
+			swapFree = kb * 1024
+		}
+	}
+	// Kernels before 3.14 have no MemAvailable
+	if !hasAvailable {
+		memory.AvailableBytes = free + buffers + cached
+	}
+	if memory.TotalBytes > memory.AvailableBytes {
+		memory.UsedBytes = memory.TotalBytes - memory.AvailableBytes
+	}
+	if memory.SwapTotalBytes > swapFree {
+		memory.SwapUsedBytes = memory.SwapTotalBytes - swapFree
+	}
+	return memory
+}
+
+// deviceMapperName returns the name of a device mapper disk such as dm-0, or "" for
+// other disks
+func deviceMapperName(device string) string {
+	if !strings.HasPrefix(device, "dm-") {
+		return ""
+	}
+	data, err := os.ReadFile(hostFile("/sys/block/" + device + "/dm/name"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readProcStat returns a process's name, its CPU time in clock ticks and its resident
+// set size in pages
+func readProcStat(pid int) (string, uint64, uint64, error) {
+	data, err := os.ReadFile(hostFile(fmt.Sprintf("/proc/%d/stat", pid)))
+	if err != nil {
+		return "", 0, 0, err
+	}
+	name, ticks, rss, ok := parseProcStat(data)
+	if !ok {
+		return "", 0, 0, fmt.Errorf("unexpected /proc/%d/stat format", pid)
+	}
+	return string(name), ticks, rss, nil
+}
+
+// parseProcStat parses /proc/<pid>/stat into the process name, its CPU time in clock
+// ticks and its resident set size in pages
+func parseProcStat(data []byte) (name []byte, ticks, rss uint64, ok bool) {
+	// The command name may contain spaces and parens, so fields are counted after the
+	// last closing paren
+	open := bytes.IndexByte(data, '(')
+	end := bytes.LastIndex(data, []byte(") "))
+	if open < 0 || end < open {
+		return nil, 0, 0, false
+	}
+	name = data[open+1 : end]
+	// utime, stime and rss are fields 14, 15 and 24, the 12th, 13th and 22nd after the name
+	rest := data[end+2:]
+	var utime, stime uint64
+	for i := 0; i < 22; i++ {
+		var field []byte
+		if field, rest = nextField(rest); field == nil {
+			return nil, 0, 0, false
+		}
+		switch i {
+		case 11:
+			utime, _ = parseDecimal(field)
+		case 12:
+			stime, _ = parseDecimal(field)
+		case 21:
+			rss, _ = parseDecimal(field)
+		}
+	}
+	return name, utime + stime, rss, true
+}
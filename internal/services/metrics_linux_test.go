@@ -0,0 +1,27 @@
+package services
+
+import "testing"
+
+func BenchmarkProcfsSample(b *testing.B) {
+	sampler, err := newMetricsSampler()
+	if err != nil {
+		b.Skipf("procfs sampler unavailable: %v", err)
+	}
+	defer sampler.close()
+	// The first sample sets the baseline the rates are computed against
+	if _, err := sampler.sample(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		metrics, err := sampler.sample()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := encodeBody(metrics); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
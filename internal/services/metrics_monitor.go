@@ -0,0 +1,237 @@
+package services
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// HostMetrics is a snapshot of the host's resource usage. Every platform backend maps its
+// native counters onto this schema, so hosts are compared the same way across platforms.
+type HostMetrics struct {
+	CollectedAt time.Time     `json:"collected_at"`
+	Backend     string        `json:"backend"`
+	CPU         CPUMetrics    `json:"cpu"`
+	Memory      MemoryMetrics `json:"memory"`
+	Disks       []DiskMetrics `json:"disks"`
+	// Filesystems is the space on local filesystems where the backend reads it
+	Filesystems []FilesystemMetrics `json:"filesystems,omitempty"`
+	// Power is the battery state of portable machines
+	Power     *PowerMetrics    `json:"power,omitempty"`
+	Processes []ProcessMetrics `json:"processes"`
+}
+
+// CPUMetrics is the CPU usage over the interval since the previous sample
+type CPUMetrics struct {
+	UsagePercent float64 `json:"usage_percent"`
+	Cores        int     `json:"cores"`
+	// LoadAverage is the 1, 5 and 15 minute load where the platform has one
+	LoadAverage []float64 `json:"load_average,omitempty"`
+}
+
+// MemoryMetrics is the physical memory and swap in use
+type MemoryMetrics struct {
+	TotalBytes     uint64 `json:"total_bytes"`
+	AvailableBytes uint64 `json:"available_bytes"`
+	UsedBytes      uint64 `json:"used_bytes"`
+	SwapTotalBytes uint64 `json:"swap_total_bytes"`
+	SwapUsedBytes  uint64 `json:"swap_used_bytes"`
+}
+
+// DiskMetrics is the activity of a physical disk over the interval
+type DiskMetrics struct {
+	Device string `json:"device"`
+	// Name is the device mapper name of an LVM volume or encrypted disk, such as vg0-data
+	Name             string  `json:"name,omitempty"`
+	ReadBytesPerSec  float64 `json:"read_bytes_per_sec"`
+	WriteBytesPerSec float64 `json:"write_bytes_per_sec"`
+	// ReadsPerSec and WritesPerSec are the requests completed, the disk's IOPS
+	ReadsPerSec  float64 `json:"reads_per_sec"`
+	WritesPerSec float64 `json:"writes_per_sec"`
+	// ReadAwaitMs and WriteAwaitMs are the average time a request took, queueing included;
+	// 0 when none completed
+	ReadAwaitMs  float64 `json:"read_await_ms"`
+	WriteAwaitMs float64 `json:"write_await_ms"`
+	// QueueLength is the average number of requests waiting or in flight
+	QueueLength float64 `json:"queue_length"`
+	BusyPercent float64 `json:"busy_percent"`
+}
+
+// FilesystemMetrics is the space used on a mounted filesystem
+type FilesystemMetrics struct {
+	MountPoint     string `json:"mount_point"`
+	Device         string `json:"device"`
+	Type           string `json:"type"`
+	TotalBytes     uint64 `json:"total_bytes"`
+	UsedBytes      uint64 `json:"used_bytes"`
+	AvailableBytes uint64 `json:"available_bytes"`
+}
+
+// PowerMetrics is the state of the battery and power source
+type PowerMetrics struct {
+	OnBattery      bool    `json:"on_battery"`
+	Charging       bool    `json:"charging"`
+	BatteryPercent float64 `json:"battery_percent"`
+	// HealthPercent is the full charge capacity as a percentage of the design capacity
+	HealthPercent    float64 `json:"health_percent,omitempty"`
+	CycleCount       int     `json:"cycle_count,omitempty"`
+	MinutesRemaining *int    `json:"minutes_remaining,omitempty"`
+}
+
+// ProcessMetrics is the usage of one of the busiest processes. CPU usage is a percentage
+// of one core, so a process using two cores fully reports 200.
+type ProcessMetrics struct {
+	PID         int     `json:"pid"`
+	Name        string  `json:"name"`
+	CPUPercent  float64 `json:"cpu_percent"`
+	MemoryBytes uint64  `json:"memory_bytes"`
+}
+
+// metricsSampler reads host metrics from a platform backend. Rates are computed against
+// the previous sample, so the first sample only sets the baseline. A backend may reuse
+// the metrics it returned for the next sample.
+type metricsSampler interface {
+	sample() (*HostMetrics, error)
+	close()
+}
+
+// MetricsMonitorService reports host CPU, memory, disk and process metrics
+type MetricsMonitorService struct {
+	config   *config.Config
+	hostRid  string
+	sampler  metricsSampler
+	stopChan chan bool
+}
+
+// NewMetricsMonitorService creates a new metrics monitor service
+func NewMetricsMonitorService(cfg *config.Config, hostRid string) *MetricsMonitorService {
+	return &MetricsMonitorService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+	}
+}
+
+// Start begins sampling and reporting host metrics
+func (s *MetricsMonitorService) Start() error {
+	if !s.config.Metrics.Enabled {
+		log.Println("Host metrics not enabled - skipping")
+		setCollectorStatus("metrics", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping host metrics")
+		return nil
+	}
+
+	sampler, err := newMetricsSampler()
+	if err != nil {
+		setCollectorStatus("metrics", CollectorSkipped, err.Error())
+		log.Printf("Host metrics skipped: %v", err)
+		return nil
+	}
+	// The first sample is the baseline the first report's rates are computed against
+	if _, err := sampler.sample(); err != nil {
+		sampler.close()
+		return err
+	}
+	s.sampler = sampler
+
+	go s.monitorLoop()
+
+	setCollectorStatus("metrics", CollectorRunning, "")
+	log.Println("Host metrics service started")
+	return nil
+}
+
+// Stop stops the monitoring process
+func (s *MetricsMonitorService) Stop() {
+	if s.sampler != nil {
+		close(s.stopChan)
+		log.Println("Host metrics service stopped")
+	}
+}
+
+// monitorLoop runs the periodic collection loop
+func (s *MetricsMonitorService) monitorLoop() {
+	defer recoverPanic("metrics")
+	defer s.sampler.close()
+	ticker := newCollectorTicker("metrics", s.config.Metrics.Interval)
+	defer ticker.Stop()
+
+	markProgress("metrics", s.config.Metrics.Interval)
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reportMetrics()
+			markProgress("metrics", s.config.Metrics.Interval)
+			if finishedOnce("metrics") {
+				return
+			}
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// reportMetrics samples the host and reports the metrics to the API
+func (s *MetricsMonitorService) reportMetrics() {
+	metrics, err := s.sampler.sample()
+	if err != nil {
+		log.Printf("Failed to sample host metrics: %v", err)
+		return
+	}
+	metrics.Processes = topProcesses(metrics.Processes, s.config.Metrics.TopProcesses)
+	slices.SortFunc(metrics.Disks, func(a, b DiskMetrics) int { return strings.Compare(a.Device, b.Device) })
+	slices.SortFunc(metrics.Filesystems, func(a, b FilesystemMetrics) int {
+		return strings.Compare(a.MountPoint, b.MountPoint)
+	})
+
+	ctx := context.Background()
+	if err := submitReport(ctx, s.config, http.MethodPut, hostPath(s.hostRid, "/metrics"), metrics); err != nil {
+		log.Printf("Failed to report host metrics: %v", err)
+		recordCollectorError("metrics", err)
+		return
+	}
+	log.Printf("Reported host metrics successfully")
+}
+
+// topProcesses keeps the n processes using the most CPU, then memory
+func topProcesses(processes []ProcessMetrics, n int) []ProcessMetrics {
+	slices.SortFunc(processes, func(a, b ProcessMetrics) int {
+		if a.CPUPercent != b.CPUPercent {
+			return cmp.Compare(b.CPUPercent, a.CPUPercent)
+		}
+		return cmp.Compare(b.MemoryBytes, a.MemoryBytes)
+	})
+	if len(processes) > n {
+		processes = processes[:n]
+	}
+	if processes == nil {
+		processes = []ProcessMetrics{}
+	}
+	return processes
+}
+
+// percentOf returns part as a percentage of whole, or 0 when whole is 0
+func percentOf(part, whole float64) float64 {
+	if whole <= 0 {
+		return 0
+	}
+	return part / whole * 100
+}
+
+// averageOf returns the total spread over count, or 0 when count is 0
+func averageOf(total float64, count uint64) float64 {
+	if count == 0 {
+		return 0
+	}
+	return total / float64(count)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows && !darwin
+
+package services
+
+import "fmt"
+
+// newMetricsSampler is only implemented on Linux, Windows and macOS
+func newMetricsSampler() (metricsSampler, error) {
+	return nil, fmt.Errorf("host metrics not supported on this platform")
+}
@@ -0,0 +1,292 @@
+package services
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	pdh                             = syscall.NewLazyDLL("pdh.dll")
+	procPdhOpenQuery                = pdh.NewProc("PdhOpenQueryW")
+	procPdhAddEnglishCounter        = pdh.NewProc("PdhAddEnglishCounterW")
+	procPdhCollectQueryData         = pdh.NewProc("PdhCollectQueryData")
+	procPdhGetFormattedCounterValue = pdh.NewProc("PdhGetFormattedCounterValue")
+	procPdhGetFormattedCounterArray = pdh.NewProc("PdhGetFormattedCounterArrayW")
+	procPdhCloseQuery               = pdh.NewProc("PdhCloseQuery")
+
+	kernel32                 = syscall.NewLazyDLL("kernel32.dll")
+	procGlobalMemoryStatusEx = kernel32.NewProc("GlobalMemoryStatusEx")
+)
+
+// PDH constants
+const (
+	pdhFmtDouble   = 0x00000200
+	pdhFmtNoCap100 = 0x00008000
+	pdhMoreData    = 0x800007D2
+	// pdhCstatusValid is the highest status of a valid value (PDH_CSTATUS_NEW_DATA)
+	pdhCstatusValid = 1
+)
+
+// pdhCounterValue is PDH_FMT_COUNTERVALUE with the double member of its union
+type pdhCounterValue struct {
+	CStatus uint32
+	_       uint32
+	Value   float64
+}
+
+// pdhCounterItem layout: PDH_FMT_COUNTERVALUE_ITEM_W is a name pointer followed by a
+// PDH_FMT_COUNTERVALUE aligned to 8 bytes, on 32 and 64-bit Windows alike
+const (
+	pdhItemSize         = 24
+	pdhItemStatusOffset = 8
+	pdhItemValueOffset  = 16
+)
+
+// memoryStatusEx is MEMORYSTATUSEX
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+// pdhCounters are the counters read per sample, by English path so they work on
+// localized Windows
+var pdhCounters = []string{
+	`\Processor(_Total)\% Processor Time`,
+	`\PhysicalDisk(*)\Disk Read Bytes/sec`,
+	`\PhysicalDisk(*)\Disk Write Bytes/sec`,
+	`\PhysicalDisk(*)\Disk Reads/sec`,
+	`\PhysicalDisk(*)\Disk Writes/sec`,
+	`\PhysicalDisk(*)\Avg. Disk sec/Read`,
+	`\PhysicalDisk(*)\Avg. Disk sec/Write`,
+	`\PhysicalDisk(*)\Avg. Disk Queue Length`,
+	`\PhysicalDisk(*)\% Idle Time`,
+	`\Process(*)\ID Process`,
+	`\Process(*)\% Processor Time`,
+	`\Process(*)\Working Set`,
+}
+
+// pdhSampler reads host metrics from Windows performance counters
+type pdhSampler struct {
+	query    uintptr
+	counters map[string]uintptr
+	primed   bool
+}
+
+// newMetricsSampler opens a PDH query with the counters mapped onto the metrics schema
+func newMetricsSampler() (metricsSampler, error) {
+	if err := pdh.Load(); err != nil {
+		return nil, fmt.Errorf("performance counters are not available: %w", err)
+	}
+
+	s := &pdhSampler{counters: make(map[string]uintptr)}
+	if status, _, _ := procPdhOpenQuery.Call(0, 0, uintptr(unsafe.Pointer(&s.query))); status != 0 {
+		return nil, fmt.Errorf("PdhOpenQuery failed with status 0x%x", status)
+	}
+	for _, path := range pdhCounters {
+		pathPtr, err := syscall.UTF16PtrFromString(path)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		var counter uintptr
+		status, _, _ := procPdhAddEnglishCounter.Call(s.query, uintptr(unsafe.Pointer(pathPtr)), 0, uintptr(unsafe.Pointer(&counter)))
+		if status != 0 {
+			s.close()
+			return nil, fmt.Errorf("failed to add counter %s: status 0x%x", path, status)
+		}
+		s.counters[path] = counter
+	}
+	return s, nil
+}
+
+// sample collects the counters; rate counters compare against the previous collection
+func (s *pdhSampler) sample() (*HostMetrics, error) {
+	if status, _, _ := procPdhCollectQueryData.Call(s.query); status != 0 {
+		return nil, fmt.Errorf("PdhCollectQueryData failed with status 0x%x", status)
+	}
+
+	metrics := &HostMetrics{
+		CollectedAt: time.Now().UTC(),
+		Backend:     "pdh",
+		Disks:       []DiskMetrics{},
+	}
+
+	// Rate counters have no valid value after the first collection
+	if !s.primed {
+		s.primed = true
+		return metrics, nil
+	}
+	cpu, err := s.value(`\Processor(_Total)\% Processor Time`)
+	if err != nil {
+		return nil, err
+	}
+	metrics.CPU.UsagePercent = cpu
+	metrics.CPU.Cores = runtime.NumCPU()
+
+	memory, err := readMemoryStatus()
+	if err != nil {
+		return nil, err
+	}
+	metrics.Memory = memory
+
+	reads := s.array(`\PhysicalDisk(*)\Disk Read Bytes/sec`)
+	writes := s.array(`\PhysicalDisk(*)\Disk Write Bytes/sec`)
+	readOps := s.array(`\PhysicalDisk(*)\Disk Reads/sec`)
+	writeOps := s.array(`\PhysicalDisk(*)\Disk Writes/sec`)
+	readAwaits := s.array(`\PhysicalDisk(*)\Avg. Disk sec/Read`)
+	writeAwaits := s.array(`\PhysicalDisk(*)\Avg. Disk sec/Write`)
+	queues := s.array(`\PhysicalDisk(*)\Avg. Disk Queue Length`)
+	idle := s.array(`\PhysicalDisk(*)\% Idle Time`)
+	for i, item := range reads {
+		if item.name == "_Total" || i >= len(writes) || i >= len(queues) || i >= len(idle) ||
+			i >= len(readOps) || i >= len(writeOps) || i >= len(readAwaits) || i >= len(writeAwaits) {
+			continue
+		}
+		busy := 100 - idle[i].value
+		if busy < 0 {
+			busy = 0
+		}
+		metrics.Disks = append(metrics.Disks, DiskMetrics{
+			// Instances are named like "0 C:"
+			Device:           item.name,
+			ReadBytesPerSec:  item.value,
+			WriteBytesPerSec: writes[i].value,
+			ReadsPerSec:      readOps[i].value,
+			WritesPerSec:     writeOps[i].value,
+			ReadAwaitMs:      readAwaits[i].value * 1000,
+			WriteAwaitMs:     writeAwaits[i].value * 1000,
+			QueueLength:      queues[i].value,
+			BusyPercent:      busy,
+		})
+	}
+
+	// Instances of one object keep the same order across its counters in a collection
+	pids := s.array(`\Process(*)\ID Process`)
+	cpus := s.array(`\Process(*)\% Processor Time`)
+	workingSets := s.array(`\Process(*)\Working Set`)
+	for i, item := range pids {
+		if item.name == "_Total" || item.name == "Idle" || i >= len(cpus) || i >= len(workingSets) {
+			continue
+		}
+		metrics.Processes = append(metrics.Processes, ProcessMetrics{
+			PID: int(item.value),
+			// Same-named processes are listed as "name#1", "name#2" in some views
+			Name:        strings.SplitN(item.name, "#", 2)[0],
+			CPUPercent:  cpus[i].value,
+			MemoryBytes: uint64(workingSets[i].value),
+		})
+	}
+
+	return metrics, nil
+}
+
+// close closes the PDH query
+func (s *pdhSampler) close() {
+	if s.query != 0 {
+		procPdhCloseQuery.Call(s.query)
+		s.query = 0
+	}
+}
+
+// value returns the formatted value of a single-instance counter
+func (s *pdhSampler) value(path string) (float64, error) {
+	var value pdhCounterValue
+	status, _, _ := procPdhGetFormattedCounterValue.Call(s.counters[path], pdhFmtDouble|pdhFmtNoCap100, 0, uintptr(unsafe.Pointer(&value)))
+	if status != 0 {
+		return 0, fmt.Errorf("failed to read counter %s: status 0x%x", path, status)
+	}
+	if value.CStatus > pdhCstatusValid {
+		return 0, fmt.Errorf("counter %s has no valid data: status 0x%x", path, value.CStatus)
+	}
+	return value.Value, nil
+}
+
+// pdhItem is one instance of a wildcard counter
+type pdhItem struct {
+	name  string
+	value float64
+}
+
+// array returns every instance of a wildcard counter. Instances without valid data are
+// kept with a zero value, so the instances of counters on one object stay aligned.
+func (s *pdhSampler) array(path string) []pdhItem {
+	counter := s.counters[path]
+	format := uintptr(pdhFmtDouble | pdhFmtNoCap100)
+	var size, count uint32
+	status, _, _ := procPdhGetFormattedCounterArray.Call(counter, format, uintptr(unsafe.Pointer(&size)), uintptr(unsafe.Pointer(&count)), 0)
+	if status != pdhMoreData || size == 0 {
+		return nil
+	}
+
+	// The buffer holds the items followed by the instance names they point to
+	buf := make([]byte, size)
+	status, _, _ = procPdhGetFormattedCounterArray.Call(counter, format, uintptr(unsafe.Pointer(&size)), uintptr(unsafe.Pointer(&count)), uintptr(unsafe.Pointer(&buf[0])))
+	if status != 0 {
+		return nil
+	}
+
+	items := make([]pdhItem, 0, count)
+	for i := 0; i < int(count); i++ {
+		offset := i * pdhItemSize
+		if offset+pdhItemSize > len(buf) {
+			break
+		}
+		item := pdhItem{name: utf16PtrToString(*(**uint16)(unsafe.Pointer(&buf[offset])))}
+		if *(*uint32)(unsafe.Pointer(&buf[offset+pdhItemStatusOffset])) <= pdhCstatusValid {
+			item.value = *(*float64)(unsafe.Pointer(&buf[offset+pdhItemValueOffset]))
+		}
+		items = append(items, item)
+	}
+	runtime.KeepAlive(buf)
+	return items
+}
+
+// utf16PtrToString converts a NUL-terminated UTF-16 string
+func utf16PtrToString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	var chars []uint16
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; ptr = unsafe.Add(ptr, 2) {
+		chars = append(chars, *(*uint16)(ptr))
+	}
+	return syscall.UTF16ToString(chars)
+}
+
+// readMemoryStatus maps GlobalMemoryStatusEx onto memory and swap. Windows has no swap
+// total; the page file is the commit limit beyond physical memory.
+func readMemoryStatus() (MemoryMetrics, error) {
+	status := memoryStatusEx{}
+	status.Length = uint32(unsafe.Sizeof(status))
+	if ok, _, err := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status))); ok == 0 {
+		return MemoryMetrics{}, fmt.Errorf("GlobalMemoryStatusEx failed: %w", err)
+	}
+
+	memory := MemoryMetrics{
+		TotalBytes:     status.TotalPhys,
+		AvailableBytes: status.AvailPhys,
+		UsedBytes:      status.TotalPhys - status.AvailPhys,
+	}
+	if status.TotalPageFile > status.TotalPhys {
+		memory.SwapTotalBytes = status.TotalPageFile - status.TotalPhys
+		committed := status.TotalPageFile - status.AvailPageFile
+		if committed > memory.UsedBytes {
+			memory.SwapUsedBytes = committed - memory.UsedBytes
+		}
+		if memory.SwapUsedBytes > memory.SwapTotalBytes {
+			memory.SwapUsedBytes = memory.SwapTotalBytes
+		}
+	}
+	return memory, nil
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/mqtt"
+)
+
+// mqttMessage wraps a report published over MQTT with the request it replaces, so a
+// bridge on the broker side can replay it against the API
+type mqttMessage struct {
+	HostRid string          `json:"host_rid"`
+	Method  string          `json:"method"`
+	Path    string          `json:"path"`
+	SentAt  time.Time       `json:"sent_at"`
+	Body    json.RawMessage `json:"body,omitempty"`
+	// IdempotencyKey lets the bridge drop messages the broker delivered twice
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// Signature signs the method, path, time and body with the agent's key when payload
+	// signing is enabled, as the signature header of an HTTPS request does
+	Signature string `json:"signature,omitempty"`
+}
+
+// mqttPublisher sends heartbeats and reports to a broker instead of the Somana server,
+// connecting lazily and reconnecting after the connection broke
+type mqttPublisher struct {
+	config  *config.Config
+	hostRid string
+
+	mu     sync.Mutex
+	client *mqtt.Client
+}
+
+// activeMQTT is the publisher used while MQTT transport is enabled, if any
+var activeMQTT struct {
+	sync.Mutex
+	publisher *mqttPublisher
+}
+
+// StartMQTT routes heartbeats and collector reports through the configured MQTT broker
+func StartMQTT(cfg *config.Config, hostRid string) {
+	if !cfg.MQTT.Enabled {
+		return
+	}
+	activeMQTT.Lock()
+	activeMQTT.publisher = &mqttPublisher{config: cfg, hostRid: hostRid}
+	activeMQTT.Unlock()
+	log.Printf("Publishing heartbeats and reports to MQTT broker %s", cfg.MQTT.BrokerURL)
+}
+
+// StopMQTT disconnects from the broker and returns to HTTPS
+func StopMQTT() {
+	activeMQTT.Lock()
+	publisher := activeMQTT.publisher
+	activeMQTT.publisher = nil
+	activeMQTT.Unlock()
+
+	if publisher != nil {
+		publisher.close()
+	}
+}
+
+// currentMQTT returns the active MQTT publisher, or nil when reports go over HTTPS
+func currentMQTT() *mqttPublisher {
+	activeMQTT.Lock()
+	defer activeMQTT.Unlock()
+	return activeMQTT.publisher
+}
+
+// publish sends a request to the topic for its kind, reconnecting once when the
+// connection broke since the last message
+func (p *mqttPublisher) publish(kind, method, path string, body interface{}) error {
+	message := mqttMessage{
+		HostRid: p.hostRid,
+		Method:  method,
+		Path:    path,
+		SentAt:  time.Now().UTC(),
+	}
+	if body != nil {
+		data, err := encodeBody(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request body: %w", err)
+		}
+		message.Body = data
+		message.IdempotencyKey = idempotencyKey(method, path, data)
+	}
+	if key := payloadKey.Load(); key != nil {
+		message.Signature = payloadSignature(*key, method, path, message.SentAt.Unix(), message.Body)
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to encode MQTT message: %w", err)
+	}
+
+	topic := p.topic(kind)
+	for attempt := 0; ; attempt++ {
+		client, err := p.connection()
+		if err != nil {
+			return err
+		}
+		err = client.Publish(topic, payload, p.config.MQTT.QoS)
+		if err == nil {
+			return nil
+		}
+		if client.Err() == nil || attempt > 0 {
+			return fmt.Errorf("failed to publish to %s: %w", topic, err)
+		}
+		log.Printf("MQTT connection lost, reconnecting: %v", client.Err())
+	}
+}
+
+// topic expands the topic template for a kind of message
+func (p *mqttPublisher) topic(kind string) string {
+	return strings.NewReplacer("{host_rid}", p.hostRid, "{kind}", kind).Replace(p.config.MQTT.TopicTemplate)
+}
+
+// connection returns a live broker connection, dialing a new one when needed
+func (p *mqttPublisher) connection() (*mqtt.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client != nil && p.client.Err() == nil {
+		return p.client, nil
+	}
+
+	clientID := p.config.MQTT.ClientID
+	if clientID == "" {
+		clientID = "sprinter-" + p.hostRid
+	}
+	client, err := mqtt.Dial(p.config.MQTT.BrokerURL, mqtt.Options{
+		ClientID:  clientID,
+		Username:  p.config.MQTT.Username,
+		Password:  p.config.MQTT.Password,
+		KeepAlive: p.config.MQTT.KeepAlive,
+		TLSConfig: restrictTLS(&tls.Config{MinVersion: tls.VersionTLS12}),
+		// The broker is resolved like the server, so dns settings apply to it too
+		DialContext: DialServer,
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.client = client
+	return client, nil
+}
+
+// close disconnects from the broker
+func (p *mqttPublisher) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client != nil {
+		p.client.Close()
+		p.client = nil
+	}
+}
+
+// mqttKind names the topic of an API path: the part after the host RID, such as
+// "fim-events" for /api/v1/hosts/{rid}/fim-events
+func mqttKind(hostRid, path string) string {
+	kind := strings.TrimPrefix(path, hostPath(hostRid, ""))
+	kind = strings.Trim(kind, "/")
+	if kind == "" {
+		return "host"
+	}
+	return kind
+}
@@ -0,0 +1,181 @@
+//go:build !minimal && !no_netflow && !no_ebpf
+
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+// btfPath exposes the running kernel's BTF, required for CO-RE relocations
+const btfPath = "/sys/kernel/btf/vmlinux"
+
+// bpfFlowCounters mirrors struct flow_counters in bpf/netflow.bpf.c; the counters are
+// cumulative per process
+type bpfFlowCounters struct {
+	BytesSent        uint64
+	BytesReceived    uint64
+	Retransmits      uint64
+	Connects         uint64
+	ConnectLatencyNs uint64
+	Comm             [16]byte
+}
+
+// bpfSocketOwner mirrors struct socket_owner in bpf/netflow.bpf.c
+type bpfSocketOwner struct {
+	PID            uint32
+	Pad            uint32
+	ConnectStartNs uint64
+}
+
+// ebpfFlowSource reads the per-process counters the netflow object keeps in kernel maps
+type ebpfFlowSource struct {
+	collection *ebpf.Collection
+	links      []link.Link
+	previous   map[uint32]bpfFlowCounters
+}
+
+// newEBPFFlowSource loads the CO-RE object at objectPath, which relocates it against the
+// running kernel's BTF, and attaches its probes
+func newEBPFFlowSource(objectPath string) (flowSource, error) {
+	if _, err := os.Stat(btfPath); err != nil {
+		return nil, fmt.Errorf("kernel BTF not available at %s: %w", btfPath, err)
+	}
+	if objectPath == "" {
+		return nil, fmt.Errorf("no eBPF object path configured")
+	}
+	// The object runs in the kernel, so one others could replace would run their code there
+	if err := checkTrustedFile(objectPath); err != nil {
+		return nil, fmt.Errorf("refusing eBPF object: %w", err)
+	}
+	spec, err := ebpf.LoadCollectionSpec(objectPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read eBPF object: %w", err)
+	}
+	for _, name := range []string{"flows", "sockets"} {
+		if spec.Maps[name] == nil {
+			return nil, fmt.Errorf("eBPF object %s has no %s map", objectPath, name)
+		}
+	}
+
+	// Kernels before 5.11 charge BPF maps against the locked memory limit
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return nil, fmt.Errorf("failed to lift the locked memory limit: %w", err)
+	}
+	collection, err := ebpf.NewCollection(spec)
+	if err != nil {
+		var verifierErr *ebpf.VerifierError
+		if errors.As(err, &verifierErr) {
+			return nil, fmt.Errorf("eBPF object rejected by the verifier: %w", err)
+		}
+		return nil, fmt.Errorf("failed to load eBPF object: %w", err)
+	}
+
+	source := &ebpfFlowSource{collection: collection, previous: make(map[uint32]bpfFlowCounters)}
+	names := make([]string, 0, len(spec.Programs))
+	for name := range spec.Programs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		probe, err := attachFlowProbe(spec.Programs[name], collection.Programs[name])
+		if err != nil {
+			source.Close()
+			return nil, fmt.Errorf("failed to attach %s: %w", name, err)
+		}
+		source.links = append(source.links, probe)
+	}
+	return source, nil
+}
+
+// attachFlowProbe attaches a kprobe or a BTF tracepoint program to its kernel hook
+func attachFlowProbe(spec *ebpf.ProgramSpec, program *ebpf.Program) (link.Link, error) {
+	switch spec.Type {
+	case ebpf.Kprobe:
+		return link.Kprobe(spec.AttachTo, program, nil)
+	case ebpf.Tracing:
+		return link.AttachTracing(link.TracingOptions{Program: program})
+	default:
+		return nil, fmt.Errorf("unsupported program type %s", spec.Type)
+	}
+}
+
+// Name returns the source name reported to the server
+func (f *ebpfFlowSource) Name() string {
+	return "ebpf"
+}
+
+// Close detaches the probes and frees the maps
+func (f *ebpfFlowSource) Close() error {
+	var errs []error
+	for _, probe := range f.links {
+		if err := probe.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	f.collection.Close()
+	return errors.Join(errs...)
+}
+
+// Collect reads the counters and open sockets per process from the kernel maps
+func (f *ebpfFlowSource) Collect() ([]ProcessFlowStats, error) {
+	connections := make(map[uint32]int)
+	var socket uint64
+	var owner bpfSocketOwner
+	sockets := f.collection.Maps["sockets"].Iterate()
+	for sockets.Next(&socket, &owner) {
+		connections[owner.PID]++
+	}
+	if err := sockets.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read sockets map: %w", err)
+	}
+
+	current := make(map[uint32]bpfFlowCounters)
+	var pid uint32
+	var counters bpfFlowCounters
+	flows := f.collection.Maps["flows"].Iterate()
+	for flows.Next(&pid, &counters) {
+		current[pid] = counters
+	}
+	if err := flows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read flows map: %w", err)
+	}
+
+	processes := flowDeltas(current, f.previous, connections)
+	f.previous = current
+	return processes, nil
+}
+
+// flowDeltas turns cumulative per-process counters into the increase since the previous
+// read; processes with neither traffic nor open sockets in the interval are left out
+func flowDeltas(current, previous map[uint32]bpfFlowCounters, connections map[uint32]int) []ProcessFlowStats {
+	processes := make([]ProcessFlowStats, 0, len(current))
+	for pid, counters := range current {
+		prev := previous[pid]
+		entry := ProcessFlowStats{
+			PID:           int(pid),
+			Process:       string(bytes.TrimRight(counters.Comm[:], "\x00")),
+			Connections:   connections[pid],
+			Retransmits:   counterDelta(counters.Retransmits, prev.Retransmits),
+			BytesSent:     counterDelta(counters.BytesSent, prev.BytesSent),
+			BytesReceived: counterDelta(counters.BytesReceived, prev.BytesReceived),
+		}
+		if connects := counterDelta(counters.Connects, prev.Connects); connects > 0 {
+			avg := float64(counterDelta(counters.ConnectLatencyNs, prev.ConnectLatencyNs)) / float64(connects) / 1000
+			entry.ConnectLatencyAvgUs = &avg
+		}
+		if entry.Connections == 0 && entry.Retransmits == 0 && entry.BytesSent == 0 && entry.BytesReceived == 0 && entry.ConnectLatencyAvgUs == nil {
+			continue
+		}
+		entry.Unit = readProcUnit(entry.PID)
+		processes = append(processes, entry)
+	}
+	return processes
+}
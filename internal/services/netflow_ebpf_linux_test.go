@@ -0,0 +1,69 @@
+//go:build !minimal && !no_netflow && !no_ebpf
+
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFlowDeltas(t *testing.T) {
+	comm := func(name string) (c [16]byte) {
+		copy(c[:], name)
+		return c
+	}
+	previous := map[uint32]bpfFlowCounters{
+		100: {BytesSent: 1000, BytesReceived: 500, Retransmits: 2, Connects: 1, ConnectLatencyNs: 4000, Comm: comm("curl")},
+		200: {BytesSent: 10, Comm: comm("idle")},
+	}
+	current := map[uint32]bpfFlowCounters{
+		100: {BytesSent: 1500, BytesReceived: 800, Retransmits: 3, Connects: 3, ConnectLatencyNs: 10000, Comm: comm("curl")},
+		200: {BytesSent: 10, Comm: comm("idle")},
+		// Recreated after the LRU map evicted it, so its counters start over
+		300: {BytesSent: 50, Comm: comm("nginx")},
+	}
+
+	processes := flowDeltas(current, previous, map[uint32]int{100: 2, 300: 1})
+	byPID := make(map[int]ProcessFlowStats)
+	for _, p := range processes {
+		byPID[p.PID] = p
+	}
+	if len(processes) != 2 {
+		t.Fatalf("flowDeltas returned %d processes, want curl and nginx: %+v", len(processes), processes)
+	}
+
+	curl := byPID[100]
+	if curl.Process != "curl" || curl.Connections != 2 || curl.BytesSent != 500 || curl.BytesReceived != 300 || curl.Retransmits != 1 {
+		t.Errorf("curl = %+v, want 2 connections, 500 sent, 300 received, 1 retransmit", curl)
+	}
+	// Two connects took 6µs in total
+	if curl.ConnectLatencyAvgUs == nil || *curl.ConnectLatencyAvgUs != 3 {
+		t.Errorf("curl connect latency = %v, want 3µs", curl.ConnectLatencyAvgUs)
+	}
+
+	nginx := byPID[300]
+	if nginx.Process != "nginx" || nginx.BytesSent != 50 || nginx.ConnectLatencyAvgUs != nil {
+		t.Errorf("nginx = %+v, want 50 sent and no connect latency", nginx)
+	}
+}
+
+func TestNewEBPFFlowSourceRefusesWritableObject(t *testing.T) {
+	if _, err := os.Stat(btfPath); err != nil {
+		t.Skipf("kernel BTF unavailable: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "netflow.bpf.o")
+	if err := os.WriteFile(path, []byte("not an object"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// WriteFile is subject to the umask
+	if err := os.Chmod(path, 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := newEBPFFlowSource(path)
+	if err == nil || !strings.Contains(err.Error(), "writable by group or others") {
+		t.Fatalf("newEBPFFlowSource error = %v, want the object refused", err)
+	}
+}
@@ -0,0 +1,299 @@
+//go:build !minimal && !no_netflow
+
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/execwrap"
+)
+
+// ProcessFlowStats is TCP telemetry aggregated per process over one interval
+type ProcessFlowStats struct {
+	PID                 int      `json:"pid"`
+	Process             string   `json:"process"`
+	Unit                string   `json:"unit,omitempty"`
+	Connections         int      `json:"connections"`
+	Retransmits         uint64   `json:"retransmits"`
+	BytesSent           uint64   `json:"bytes_sent"`
+	BytesReceived       uint64   `json:"bytes_received"`
+	ConnectLatencyAvgUs *float64 `json:"connect_latency_avg_us,omitempty"`
+	SmoothedRTTAvgUs    *float64 `json:"srtt_avg_us,omitempty"`
+}
+
+// NetFlowReport is the payload sent to the network flows endpoint
+type NetFlowReport struct {
+	Source    string             `json:"source"`
+	SampledAt time.Time          `json:"sampled_at"`
+	Processes []ProcessFlowStats `json:"processes"`
+}
+
+// flowSource produces per-process flow statistics
+type flowSource interface {
+	Name() string
+	Collect() ([]ProcessFlowStats, error)
+	Close() error
+}
+
+// NetFlowMonitorService reports per-process TCP retransmits, latency and bytes
+type NetFlowMonitorService struct {
+	config   *config.Config
+	hostRid  string
+	source   flowSource
+	stopChan chan bool
+}
+
+// NewNetFlowMonitorService creates a new network flow monitor service
+func NewNetFlowMonitorService(cfg *config.Config, hostRid string) *NetFlowMonitorService {
+	return &NetFlowMonitorService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+	}
+}
+
+// init registers the collector; no_netflow leaves it out and no_ebpf only the eBPF probes
+func init() {
+	registerCollector("netflow", func(m *CollectorManager, c *config.Config) Collector {
+		return NewNetFlowMonitorService(c, m.hostRid)
+	})
+}
+
+// Start selects a flow source and begins reporting periodically
+func (s *NetFlowMonitorService) Start() error {
+	if !s.config.NetFlow.Enabled {
+		log.Println("Network flow telemetry not enabled - skipping")
+		setCollectorStatus("netflow", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping network flow telemetry")
+		return nil
+	}
+
+	if s.config.NetFlow.EBPF {
+		source, err := newEBPFFlowSource(s.config.NetFlow.ObjectPath)
+		if err != nil {
+			log.Printf("eBPF flow telemetry unavailable, falling back to polling: %v", err)
+		} else {
+			s.source = source
+		}
+	}
+	if s.source == nil {
+		if _, err := exec.LookPath("ss"); err != nil {
+			return fmt.Errorf("ss not found in PATH: %w", err)
+		}
+		s.source = &ssFlowSource{previous: make(map[string]ssSocketCounters)}
+	}
+
+	go s.monitorLoop()
+
+	if isPrivileged() {
+		setCollectorStatus("netflow", CollectorRunning, "")
+	} else {
+		setPermissionProblem("netflow", CollectorDegraded, "not running as root: sockets of other users' processes are not attributed")
+	}
+	log.Printf("Network flow telemetry started using %s", s.source.Name())
+	return nil
+}
+
+// Stop stops the monitoring process and releases the flow source
+func (s *NetFlowMonitorService) Stop() {
+	if s.source != nil {
+		close(s.stopChan)
+		log.Println("Network flow telemetry stopped")
+	}
+}
+
+// monitorLoop runs the periodic collection loop
+func (s *NetFlowMonitorService) monitorLoop() {
+	defer recoverPanic("netflow")
+	ticker := newCollectorTicker("netflow", s.config.NetFlow.Interval)
+	defer ticker.Stop()
+	defer func() {
+		if err := s.source.Close(); err != nil {
+			log.Printf("Warning: failed to close %s flow source: %v", s.source.Name(), err)
+		}
+	}()
+
+	markProgress("netflow", s.config.NetFlow.Interval)
+	for {
+		select {
+		case <-ticker.C:
+			s.reportFlows()
+			markProgress("netflow", s.config.NetFlow.Interval)
+			if finishedOnce("netflow") {
+				return
+			}
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// reportFlows collects per-process flow statistics and reports them to the API
+func (s *NetFlowMonitorService) reportFlows() {
+	processes, err := s.source.Collect()
+	if err != nil {
+		log.Printf("Failed to collect network flows: %v", err)
+		return
+	}
+
+	sort.Slice(processes, func(i, j int) bool {
+		return processes[i].BytesSent+processes[i].BytesReceived > processes[j].BytesSent+processes[j].BytesReceived
+	})
+
+	reqBody := NetFlowReport{
+		Source:    s.source.Name(),
+		SampledAt: time.Now().UTC(),
+		Processes: processes,
+	}
+
+	ctx := context.Background()
+	if err := submitReport(ctx, s.config, http.MethodPut, hostPath(s.hostRid, "/network/flows"), reqBody); err != nil {
+		log.Printf("Failed to report network flows: %v", err)
+		recordCollectorError("netflow", err)
+		return
+	}
+
+	log.Printf("Reported network flows for %d processes successfully", len(processes))
+}
+
+// ssSocketCounters holds the cumulative counters of one socket from the previous poll
+type ssSocketCounters struct {
+	bytesSent     uint64
+	bytesReceived uint64
+	retransmits   uint64
+}
+
+// ssFlowSource polls `ss -tinp` and turns cumulative socket counters into per-interval deltas
+type ssFlowSource struct {
+	previous map[string]ssSocketCounters
+}
+
+var (
+	ssPIDPattern   = regexp.MustCompile(`\("([^"]*)",pid=(\d+)`)
+	ssValuePattern = regexp.MustCompile(`(bytes_sent|bytes_acked|bytes_received|retrans|rtt):([0-9./]+)`)
+)
+
+// Name returns the source name reported to the server
+func (f *ssFlowSource) Name() string {
+	return "ss"
+}
+
+// Close releases nothing; the poller holds no kernel resources
+func (f *ssFlowSource) Close() error {
+	return nil
+}
+
+// Collect runs ss and aggregates socket deltas per process
+func (f *ssFlowSource) Collect() ([]ProcessFlowStats, error) {
+	output, err := execwrap.Output(context.Background(), execwrap.Options{}, "ss", "-tinpH", "state", "established")
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[int]*ProcessFlowStats)
+	rttSums := make(map[int]float64)
+	current := make(map[string]ssSocketCounters)
+
+	var socketKey string
+	var pid int
+	var comm string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		// Socket lines start in column 0, their TCP info follows on an indented line
+		if line[0] != ' ' && line[0] != '\t' {
+			fields := strings.Fields(line)
+			socketKey, pid, comm = "", 0, ""
+			if len(fields) >= 4 {
+				socketKey = fields[2] + "-" + fields[3]
+			}
+			if match := ssPIDPattern.FindStringSubmatch(line); match != nil {
+				comm = match[1]
+				pid, _ = strconv.Atoi(match[2])
+			}
+			continue
+		}
+
+		if socketKey == "" || pid == 0 {
+			continue
+		}
+
+		counters := ssSocketCounters{}
+		var rttMs float64
+		for _, match := range ssValuePattern.FindAllStringSubmatch(line, -1) {
+			switch match[1] {
+			case "bytes_sent", "bytes_acked":
+				// Older kernels only report bytes_acked
+				if value, err := strconv.ParseUint(match[2], 10, 64); err == nil && value > counters.bytesSent {
+					counters.bytesSent = value
+				}
+			case "bytes_received":
+				counters.bytesReceived, _ = strconv.ParseUint(match[2], 10, 64)
+			case "retrans":
+				// retrans:<outstanding>/<total>
+				if _, total, ok := strings.Cut(match[2], "/"); ok {
+					counters.retransmits, _ = strconv.ParseUint(total, 10, 64)
+				}
+			case "rtt":
+				// rtt:<srtt>/<rttvar> in milliseconds
+				srtt, _, _ := strings.Cut(match[2], "/")
+				rttMs, _ = strconv.ParseFloat(srtt, 64)
+			}
+		}
+
+		key := fmt.Sprintf("%d/%s", pid, socketKey)
+		current[key] = counters
+		prev := f.previous[key]
+
+		entry, ok := stats[pid]
+		if !ok {
+			entry = &ProcessFlowStats{PID: pid, Process: comm, Unit: readProcUnit(pid)}
+			stats[pid] = entry
+		}
+		entry.Connections++
+		entry.BytesSent += counterDelta(counters.bytesSent, prev.bytesSent)
+		entry.BytesReceived += counterDelta(counters.bytesReceived, prev.bytesReceived)
+		entry.Retransmits += counterDelta(counters.retransmits, prev.retransmits)
+		rttSums[pid] += rttMs * 1000
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	f.previous = current
+
+	processes := make([]ProcessFlowStats, 0, len(stats))
+	for pid, entry := range stats {
+		avg := rttSums[pid] / float64(entry.Connections)
+		entry.SmoothedRTTAvgUs = &avg
+		processes = append(processes, *entry)
+	}
+	return processes, nil
+}
+
+// counterDelta returns the increase of a cumulative counter, treating resets as a fresh start
+func counterDelta(current, previous uint64) uint64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
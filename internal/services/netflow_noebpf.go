@@ -0,0 +1,10 @@
+//go:build !minimal && !no_netflow && (!linux || no_ebpf)
+
+package services
+
+import "fmt"
+
+// newEBPFFlowSource is left out of builds with the no_ebpf tag and outside Linux
+func newEBPFFlowSource(objectPath string) (flowSource, error) {
+	return nil, fmt.Errorf("eBPF support not included in this build")
+}
@@ -0,0 +1,67 @@
+//go:build linux && !minimal && !no_network_mounts
+
+package services
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// readNetworkMounts lists the host's mounts of the given filesystem types from its mount
+// table, which is read without touching the filesystems themselves
+func readNetworkMounts(types []string) ([]NetworkMount, error) {
+	data, err := os.ReadFile(hostProcSelf("mounts"))
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool, len(types))
+	for _, fsType := range types {
+		wanted[fsType] = true
+	}
+	mounts := []NetworkMount{}
+	// index finds a mount point already listed; a later mount over it hides the earlier one
+	index := make(map[string]int)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || !wanted[fields[2]] {
+			continue
+		}
+		mount := NetworkMount{
+			// Spaces in sources and mount points are escaped as \040
+			Source:     strings.ReplaceAll(fields[0], "\\040", " "),
+			MountPoint: strings.ReplaceAll(fields[1], "\\040", " "),
+			Type:       fields[2],
+			Options:    fields[3],
+		}
+		if i, ok := index[mount.MountPoint]; ok {
+			mounts[i] = mount
+			continue
+		}
+		index[mount.MountPoint] = len(mounts)
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// statfsMount asks the filesystem mounted at a mount point for its space. On a network
+// mount this is a call to the server, which blocks for as long as the server is away.
+func statfsMount(mountPoint string) (mountSpace, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(hostFile(mountPoint), &stat); err != nil {
+		return mountSpace{}, err
+	}
+	blockSize := uint64(stat.Bsize)
+	return mountSpace{
+		total:     stat.Blocks * blockSize,
+		used:      (stat.Blocks - stat.Bfree) * blockSize,
+		available: stat.Bavail * blockSize,
+	}, nil
+}
+
+// isStaleHandle reports whether a probe failed because the server no longer knows the
+// mounted export, as after it was re-exported or its filesystem replaced
+func isStaleHandle(err error) bool {
+	return errors.Is(err, syscall.ESTALE)
+}
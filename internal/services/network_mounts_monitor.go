@@ -0,0 +1,346 @@
+//go:build !minimal && !no_network_mounts
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// NetworkMount is an NFS, CIFS or other network mount and the outcome of probing it
+type NetworkMount struct {
+	Source     string `json:"source"`
+	MountPoint string `json:"mount_point"`
+	Type       string `json:"type"`
+	Options    string `json:"options"`
+	// State is "ok", "hung" when the server did not answer within the timeout, "stale" when
+	// it no longer knows the export, or "error"
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+	// LatencyMs is how long the server took to answer
+	LatencyMs *float64 `json:"latency_ms,omitempty"`
+	// HungSeconds is how long the oldest unanswered probe has been waiting
+	HungSeconds    *float64 `json:"hung_seconds,omitempty"`
+	TotalBytes     uint64   `json:"total_bytes,omitempty"`
+	UsedBytes      uint64   `json:"used_bytes,omitempty"`
+	AvailableBytes uint64   `json:"available_bytes,omitempty"`
+}
+
+// NetworkMountsReport is the payload sent to the network mounts endpoint. It replaces the
+// previous one, so an unmounted share disappears.
+type NetworkMountsReport struct {
+	Mounts []NetworkMount `json:"mounts"`
+}
+
+// NetworkMountEvent is a mount changing state between two probes, such as a share going
+// hung when its server stops answering
+type NetworkMountEvent struct {
+	EventID    string `json:"event_id"`
+	MountPoint string `json:"mount_point"`
+	Source     string `json:"source"`
+	Type       string `json:"type"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Severity   string `json:"severity"`
+	// Message says what happened in one line
+	Message     string `json:"message"`
+	Timestamp   string `json:"timestamp"`
+	Maintenance string `json:"maintenance,omitempty"`
+	EventOccurrences
+}
+
+// NetworkMountEventsReport is the payload sent to the network mount events endpoint
+type NetworkMountEventsReport struct {
+	Events []NetworkMountEvent `json:"events"`
+}
+
+// mountSpace is the space statfs reports for a mount
+type mountSpace struct {
+	total     uint64
+	used      uint64
+	available uint64
+}
+
+// mountProbe is a statfs running in its own goroutine. A hung mount blocks the goroutine
+// in the kernel until the server returns, so a probe is only replaced once it finishes.
+type mountProbe struct {
+	started time.Time
+	done    chan mountProbeResult
+}
+
+// mountProbeResult is the outcome of a finished probe
+type mountProbeResult struct {
+	space    mountSpace
+	err      error
+	finished time.Time
+}
+
+// wait returns the probe's result, waiting for it until the deadline
+func (p *mountProbe) wait(deadline time.Time) (mountProbeResult, bool) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case result := <-p.done:
+		return result, true
+	case <-timer.C:
+	}
+	// A probe finishing just as the deadline passed still counts
+	select {
+	case result := <-p.done:
+		return result, true
+	default:
+		return mountProbeResult{}, false
+	}
+}
+
+// NetworkMountsMonitorService probes network mounts with statfs, each in its own goroutine
+// bounded by a timeout, and reports those whose server is hung or has gone stale. Other
+// collectors skip network filesystems, as a single call to a dead server never returns.
+type NetworkMountsMonitorService struct {
+	config   *config.Config
+	hostRid  string
+	stopChan chan bool
+	started  bool
+	// probes holds the probe of each mount point that has not finished yet
+	probes map[string]*mountProbe
+	// last holds the state of each mount point at the previous poll
+	last          map[string]string
+	dedup         *eventDeduper[NetworkMountEvent]
+	pendingEvents []NetworkMountEvent
+}
+
+// NewNetworkMountsMonitorService creates a new network mounts monitor service
+func NewNetworkMountsMonitorService(cfg *config.Config, hostRid string) *NetworkMountsMonitorService {
+	return &NetworkMountsMonitorService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+		probes:   make(map[string]*mountProbe),
+		dedup:    newEventDeduper[NetworkMountEvent](dedupWindow(cfg)),
+	}
+}
+
+// init registers the collector, unless built with no_network_mounts
+func init() {
+	registerCollector("network_mounts", func(m *CollectorManager, c *config.Config) Collector {
+		return NewNetworkMountsMonitorService(c, m.hostRid)
+	})
+}
+
+// Start begins probing network mounts periodically
+func (s *NetworkMountsMonitorService) Start() error {
+	if !s.config.NetworkMounts.Enabled {
+		log.Println("Network mounts collector not enabled - skipping")
+		setCollectorStatus("network_mounts", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping network mounts collector")
+		return nil
+	}
+	if _, err := readNetworkMounts(s.config.NetworkMounts.Types); err != nil {
+		log.Printf("Cannot read the mount table - skipping network mounts collector: %v", err)
+		setCollectorStatus("network_mounts", CollectorSkipped, err.Error())
+		return nil
+	}
+
+	s.started = true
+	go s.monitorLoop()
+
+	setCollectorStatus("network_mounts", CollectorRunning, "")
+	log.Println("Network mounts collector started")
+	return nil
+}
+
+// Stop stops the collector. Probes still blocked on a hung server end when it returns.
+func (s *NetworkMountsMonitorService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("Network mounts collector stopped")
+	}
+}
+
+// monitorLoop probes the mounts at the configured interval
+func (s *NetworkMountsMonitorService) monitorLoop() {
+	defer recoverPanic("network_mounts")
+	ticker := newCollectorTicker("network_mounts", s.config.NetworkMounts.Interval)
+	defer ticker.Stop()
+
+	markProgress("network_mounts", s.config.NetworkMounts.Interval)
+	s.poll()
+	if finishedOnce("network_mounts") {
+		return
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			s.poll()
+			markProgress("network_mounts", s.config.NetworkMounts.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// poll probes every network mount, reports them and raises events for those that changed
+func (s *NetworkMountsMonitorService) poll() {
+	mounts, err := readNetworkMounts(s.config.NetworkMounts.Types)
+	if err != nil {
+		log.Printf("Failed to read the mount table: %v", err)
+		setCollectorStatus("network_mounts", CollectorError, err.Error())
+		recordCollectorError("network_mounts", err)
+		return
+	}
+	setCollectorStatus("network_mounts", CollectorRunning, "")
+
+	probed := []NetworkMount{}
+	for _, mount := range mounts {
+		if !s.excluded(mount.MountPoint) {
+			probed = append(probed, mount)
+		}
+	}
+	s.probe(probed)
+	sort.Slice(probed, func(i, j int) bool {
+		return probed[i].MountPoint < probed[j].MountPoint
+	})
+
+	if err := submitReport(context.Background(), s.config, http.MethodPut, hostPath(s.hostRid, "/network-mounts"), NetworkMountsReport{Mounts: probed}); err != nil {
+		log.Printf("Failed to report network mounts: %v", err)
+		recordCollectorError("network_mounts", err)
+	}
+	s.reportChanges(probed)
+}
+
+// probe fills in the state of each mount. All probes run at once and share one timeout,
+// so a hung server delays the poll by the timeout at most, however many mounts it holds.
+func (s *NetworkMountsMonitorService) probe(mounts []NetworkMount) {
+	now := time.Now()
+	current := make(map[string]bool, len(mounts))
+	for _, mount := range mounts {
+		current[mount.MountPoint] = true
+		if _, running := s.probes[mount.MountPoint]; running {
+			continue
+		}
+		probe := &mountProbe{started: now, done: make(chan mountProbeResult, 1)}
+		go func(mountPoint string) {
+			space, err := statfsMount(mountPoint)
+			probe.done <- mountProbeResult{space: space, err: err, finished: time.Now()}
+		}(mount.MountPoint)
+		s.probes[mount.MountPoint] = probe
+	}
+	// A probe of an unmounted share is forgotten; its goroutine ends when statfs returns
+	for mountPoint := range s.probes {
+		if !current[mountPoint] {
+			delete(s.probes, mountPoint)
+		}
+	}
+
+	deadline := now.Add(s.config.NetworkMounts.Timeout)
+	for i := range mounts {
+		probe := s.probes[mounts[i].MountPoint]
+		result, finished := probe.wait(deadline)
+		if !finished {
+			hung := time.Since(probe.started).Seconds()
+			mounts[i].State = "hung"
+			mounts[i].HungSeconds = &hung
+			mounts[i].Error = fmt.Sprintf("no answer from the server for %.0fs", hung)
+			continue
+		}
+		delete(s.probes, mounts[i].MountPoint)
+		latency := float64(result.finished.Sub(probe.started).Microseconds()) / 1000
+		mounts[i].LatencyMs = &latency
+		switch {
+		case result.err == nil:
+			mounts[i].State = "ok"
+			mounts[i].TotalBytes = result.space.total
+			mounts[i].UsedBytes = result.space.used
+			mounts[i].AvailableBytes = result.space.available
+		case isStaleHandle(result.err):
+			mounts[i].State = "stale"
+			mounts[i].Error = result.err.Error()
+		default:
+			mounts[i].State = "error"
+			mounts[i].Error = result.err.Error()
+		}
+	}
+}
+
+// excluded reports whether a mount point matches network_mounts.exclude
+func (s *NetworkMountsMonitorService) excluded(mountPoint string) bool {
+	for _, pattern := range s.config.NetworkMounts.Exclude {
+		if ok, _ := filepath.Match(pattern, mountPoint); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// reportChanges sends an event for every mount whose state changed since the previous
+// poll. Mounts that appear or disappear raise none; they show in the report.
+func (s *NetworkMountsMonitorService) reportChanges(mounts []NetworkMount) {
+	previous := s.last
+	s.last = make(map[string]string, len(mounts))
+	for _, mount := range mounts {
+		s.last[mount.MountPoint] = mount.State
+	}
+	if previous == nil {
+		return
+	}
+
+	now := time.Now()
+	events := []NetworkMountEvent{}
+	for _, mount := range mounts {
+		before, ok := previous[mount.MountPoint]
+		if !ok || before == mount.State {
+			continue
+		}
+		event := NetworkMountEvent{
+			MountPoint:  mount.MountPoint,
+			Source:      mount.Source,
+			Type:        mount.Type,
+			From:        before,
+			To:          mount.State,
+			Severity:    severityError,
+			Timestamp:   now.UTC().Format(time.RFC3339),
+			Maintenance: maintenanceTag(now),
+		}
+		if mount.State == "ok" {
+			event.Severity = severityInfo
+			event.Message = fmt.Sprintf("%s on %s answers again", mount.Source, mount.MountPoint)
+		} else {
+			event.Message = fmt.Sprintf("%s on %s is %s: %s", mount.Source, mount.MountPoint, mount.State, mount.Error)
+		}
+		event.EventID = eventID("network_mount", mount.MountPoint, before, mount.State, now.UTC().Format(time.RFC3339Nano))
+		if s.dedup.Observe(mount.MountPoint+"\x00"+before+"\x00"+mount.State, event, now) {
+			events = append(events, event)
+		}
+	}
+	for _, summary := range s.dedup.Flush(now) {
+		event := summary.Event
+		event.EventOccurrences = summary.occurrences()
+		events = append(events, event)
+	}
+
+	events = append(s.pendingEvents, events...)
+	if len(events) == 0 {
+		return
+	}
+
+	reqBody := NetworkMountEventsReport{Events: events}
+	if err := submitReport(context.Background(), s.config, http.MethodPost, hostPath(s.hostRid, "/network-mount-events"), reqBody); err != nil {
+		log.Printf("Failed to report network mount events (%d queued): %v", len(events), err)
+		recordCollectorError("network_mounts", err)
+		s.pendingEvents = retainEvents("network_mounts", events)
+		return
+	}
+	s.pendingEvents = nil
+	log.Printf("Reported %d network mount events successfully", len(events))
+}
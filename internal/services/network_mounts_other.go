@@ -0,0 +1,20 @@
+//go:build !linux && !minimal && !no_network_mounts
+
+package services
+
+import "errors"
+
+// readNetworkMounts fails; the mount table is only read on Linux
+func readNetworkMounts(types []string) ([]NetworkMount, error) {
+	return nil, errors.New("network mounts can only be probed on Linux")
+}
+
+// statfsMount is never called, as no mounts are found
+func statfsMount(mountPoint string) (mountSpace, error) {
+	return mountSpace{}, errors.New("network mounts can only be probed on Linux")
+}
+
+// isStaleHandle reports no stale handles
+func isStaleHandle(err error) bool {
+	return false
+}
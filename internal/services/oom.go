@@ -0,0 +1,73 @@
+package services
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Patterns of the kernel's OOM killer messages
+var (
+	oomKilledPattern  = regexp.MustCompile(`Killed process (\d+) \(([^)]*)\)`)
+	oomContextPattern = regexp.MustCompile(`^oom-kill:(?:constraint=([^,]*),)?.*\btask_memcg=([^,]*),task=[^,]*,pid=(\d+)`)
+	oomMemoryPattern  = regexp.MustCompile(`\b(total-vm|anon-rss|file-rss|shmem-rss):(\d+)kB`)
+)
+
+// oomKill is a process the OOM killer killed
+type oomKill struct {
+	PID     int
+	Process string
+	// Memory is the victim's memory use in kB, keyed total_vm, anon_rss, file_rss and
+	// shmem_rss
+	Memory map[string]int64
+}
+
+// oomContext is the oom-kill line the kernel logs just before a kill. It names the
+// victim's memory cgroup, which the kill message does not.
+type oomContext struct {
+	PID    int
+	Cgroup string
+	// Constraint is CONSTRAINT_MEMCG when a cgroup hit its limit and CONSTRAINT_NONE when
+	// the whole system ran out of memory
+	Constraint string
+}
+
+// parseOOMKill parses a "Killed process" message
+func parseOOMKill(message string) (oomKill, bool) {
+	match := oomKilledPattern.FindStringSubmatch(message)
+	if match == nil {
+		return oomKill{}, false
+	}
+	kill := oomKill{Process: match[2], Memory: make(map[string]int64)}
+	kill.PID, _ = strconv.Atoi(match[1])
+	for _, memory := range oomMemoryPattern.FindAllStringSubmatch(message, -1) {
+		kb, _ := strconv.ParseInt(memory[2], 10, 64)
+		kill.Memory[strings.ReplaceAll(memory[1], "-", "_")] = kb
+	}
+	return kill, true
+}
+
+// parseOOMContext parses an oom-kill line
+func parseOOMContext(message string) (oomContext, bool) {
+	match := oomContextPattern.FindStringSubmatch(message)
+	if match == nil {
+		return oomContext{}, false
+	}
+	pid, err := strconv.Atoi(match[3])
+	if err != nil {
+		return oomContext{}, false
+	}
+	return oomContext{PID: pid, Cgroup: match[2], Constraint: match[1]}, true
+}
+
+// unitFromCgroup returns the systemd unit a cgroup path belongs to: the innermost service
+// or scope, so a user service is named rather than the user manager running it
+func unitFromCgroup(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if strings.HasSuffix(parts[i], ".service") || strings.HasSuffix(parts[i], ".scope") {
+			return parts[i]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,411 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/execwrap"
+)
+
+// pathDiagnosticTimeout bounds a single path diagnostic, including slow hops
+const pathDiagnosticTimeout = 2 * time.Minute
+
+// PathHop is one router on the path to the target, with its loss and latency
+type PathHop struct {
+	Hop         int     `json:"hop"`
+	Address     string  `json:"address,omitempty"`
+	Sent        int     `json:"sent"`
+	LossPercent float64 `json:"loss_percent"`
+	LastMillis  float64 `json:"last_ms"`
+	AvgMillis   float64 `json:"avg_ms"`
+	BestMillis  float64 `json:"best_ms"`
+	WorstMillis float64 `json:"worst_ms"`
+}
+
+// PathDiagnostic is the result of tracing the network path to a target, uploaded as a
+// diagnostic artifact
+type PathDiagnostic struct {
+	// RequestID is the server request the diagnostic answers, empty when run from the CLI
+	RequestID string        `json:"request_id,omitempty"`
+	Target    string        `json:"target"`
+	Tool      string        `json:"tool"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration_ns"`
+	Hops      []PathHop     `json:"hops"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// diagnosticRequest is a diagnostic the server asks the agent to run
+type diagnosticRequest struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Target string `json:"target"`
+	// RequestedBy is the user or automation that asked for the diagnostic
+	RequestedBy string `json:"requested_by,omitempty"`
+}
+
+// NetworkDiagnosticsService runs path and throughput diagnostics requested by the server or
+// the CLI and uploads their results
+type NetworkDiagnosticsService struct {
+	config   *config.Config
+	hostRid  string
+	stopChan chan bool
+	started  bool
+	// running serializes diagnostics; concurrent probes would skew each other's results
+	running chan struct{}
+	// requests remembers the diagnostic requests between polls
+	requests commandInbox
+}
+
+// NewNetworkDiagnosticsService creates a new network diagnostics service
+func NewNetworkDiagnosticsService(cfg *config.Config, hostRid string) *NetworkDiagnosticsService {
+	return &NetworkDiagnosticsService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+		running:  make(chan struct{}, 1),
+	}
+}
+
+// Start begins polling the server for diagnostic requests
+func (s *NetworkDiagnosticsService) Start() error {
+	if !s.config.PathDiagnostics.Enabled && !s.config.SpeedTest.Enabled {
+		log.Println("Network diagnostics not enabled - skipping")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping network diagnostics")
+		return nil
+	}
+
+	s.started = true
+	go s.pollLoop()
+
+	log.Printf("Network diagnostics started for host RID: %s", s.hostRid)
+	return nil
+}
+
+// Stop stops polling
+func (s *NetworkDiagnosticsService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("Network diagnostics stopped")
+	}
+}
+
+// pollLoop checks for diagnostic requests at the configured interval
+func (s *NetworkDiagnosticsService) pollLoop() {
+	defer recoverPanic("network_diagnostics")
+	ticker := newReportTicker(s.config.PathDiagnostics.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.poll()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// poll runs the diagnostics the server requested
+func (s *NetworkDiagnosticsService) poll() {
+	ctx, cancel := context.WithTimeout(context.Background(), apiRequestTimeout)
+	var items []json.RawMessage
+	err := sendJSON(ctx, s.config, http.MethodGet, hostPath(s.hostRid, "/diagnostics/requests"), nil, &items)
+	cancel()
+
+	var statusErr *apiStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		// Servers without on-demand diagnostics
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to fetch diagnostic requests: %v", err)
+		return
+	}
+
+	verifier, err := newCommandVerifier(s.config, s.hostRid)
+	if err != nil {
+		log.Printf("Cannot verify diagnostic requests: %v", err)
+		return
+	}
+	receiveCommands(&s.requests, verifier, items, diagnosticRequest.id, s.reject, func(request diagnosticRequest) bool {
+		var action *RemoteAction
+		var err error
+		switch {
+		case request.Type == "path" && s.config.PathDiagnostics.Enabled:
+			log.Printf("Running path diagnostic %s requested by the server", request.ID)
+			action = startRemoteAction(s.config, ActionPathDiagnostic)
+			action.Args = map[string]string{"target": request.Target}
+			_, err = s.runTrace(request.ID, request.Target)
+		case request.Type == "throughput" && s.config.SpeedTest.Enabled:
+			log.Printf("Running throughput test %s requested by the server", request.ID)
+			action = startRemoteAction(s.config, ActionThroughputTest)
+			_, err = s.runSpeedTest(request.ID)
+		default:
+			return true
+		}
+		if err != nil {
+			log.Printf("Diagnostic %s failed: %v", request.ID, err)
+		}
+		action.RequestID, action.Requester = request.ID, request.RequestedBy
+		action.finish(err)
+		return true
+	})
+}
+
+// id returns the request ID
+func (r diagnosticRequest) id() string { return r.ID }
+
+// reject reports a diagnostic request that is malformed or fails signature checks. It is
+// described by what it claims to be, which cannot be trusted.
+func (s *NetworkDiagnosticsService) reject(item json.RawMessage, err error) {
+	var claimed diagnosticRequest
+	json.Unmarshal(unverifiedPayload(item), &claimed)
+	log.Printf("Rejected diagnostic request %q: %v", claimed.ID, err)
+
+	command := "diagnostic"
+	switch claimed.Type {
+	case "path":
+		command = ActionPathDiagnostic
+	case "throughput":
+		command = ActionThroughputTest
+	}
+	action := startRemoteAction(s.config, command)
+	action.RequestID, action.Requester = claimed.ID, claimed.RequestedBy
+	action.reject(err)
+	raiseHealthEvent(healthCommandRejected, severityError, "network_diagnostics", err.Error(), map[string]interface{}{
+		"request_id": claimed.ID,
+	})
+}
+
+// acquire reserves the network for one diagnostic at a time
+func (s *NetworkDiagnosticsService) acquire() (release func(), err error) {
+	select {
+	case s.running <- struct{}{}:
+		return func() { <-s.running }, nil
+	default:
+		return nil, errors.New("a network diagnostic is already running")
+	}
+}
+
+// Traceroute traces the path to target, or to the Somana server when target is empty, and
+// uploads the result
+func (s *NetworkDiagnosticsService) Traceroute(target string) (*PathDiagnostic, error) {
+	if !s.config.PathDiagnostics.Enabled {
+		return nil, errors.New("path diagnostics are disabled, set path_diagnostics.enabled: true")
+	}
+	return s.runTrace("", target)
+}
+
+// runTrace traces and uploads a path diagnostic answering the request ID
+func (s *NetworkDiagnosticsService) runTrace(requestID, target string) (*PathDiagnostic, error) {
+	if target == "" {
+		target = serverHost(s.config)
+	}
+	if target == "" {
+		return nil, errors.New("no target given and the server address is unknown")
+	}
+
+	release, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), pathDiagnosticTimeout)
+	defer cancel()
+
+	diagnostic := tracePath(ctx, target, s.config.PathDiagnostics.Probes, s.config.PathDiagnostics.MaxHops)
+	diagnostic.RequestID = requestID
+
+	// Failed traces are uploaded too; the error is what the server asked about
+	if err := sendJSON(ctx, s.config, http.MethodPost, hostPath(s.hostRid, "/diagnostics/path"), diagnostic, nil); err != nil {
+		log.Printf("Failed to upload path diagnostic: %v", err)
+	}
+	if diagnostic.Error != "" {
+		return diagnostic, errors.New(diagnostic.Error)
+	}
+	return diagnostic, nil
+}
+
+// serverHost returns the host name of the Somana server
+func serverHost(cfg *config.Config) string {
+	u, err := url.Parse(cfg.HostRegistration.SprinterURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// tracePath traces the path to target with mtr, or traceroute when mtr is not installed
+func tracePath(ctx context.Context, target string, probes, maxHops int) *PathDiagnostic {
+	diagnostic := &PathDiagnostic{Target: target, StartedAt: time.Now(), Hops: []PathHop{}}
+	defer func() { diagnostic.Duration = time.Since(diagnostic.StartedAt) }()
+
+	err := errors.New("neither mtr nor traceroute is installed")
+	if _, lookErr := exec.LookPath("mtr"); lookErr == nil {
+		diagnostic.Tool = "mtr"
+		if diagnostic.Hops, err = runMTR(ctx, target, probes, maxHops); err == nil {
+			return diagnostic
+		}
+		// mtr needs raw sockets, which a hardened unit may not grant; traceroute's UDP
+		// probes do not
+		log.Printf("Warning: %v, trying traceroute", err)
+	}
+	if _, lookErr := exec.LookPath("traceroute"); lookErr == nil {
+		diagnostic.Tool = "traceroute"
+		diagnostic.Hops, err = runTraceroute(ctx, target, probes, maxHops)
+	}
+	if err != nil {
+		diagnostic.Error = err.Error()
+	}
+	if diagnostic.Hops == nil {
+		diagnostic.Hops = []PathHop{}
+	}
+	return diagnostic
+}
+
+// runPathCommand runs a path tracing tool and returns its stdout
+func runPathCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	output, err := execwrap.Output(ctx, execwrap.Options{}, name, args...)
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// runMTR traces the path with mtr's JSON report
+func runMTR(ctx context.Context, target string, probes, maxHops int) ([]PathHop, error) {
+	output, err := runPathCommand(ctx, "mtr", "--json", "--no-dns",
+		"--report-cycles", strconv.Itoa(probes), "--max-ttl", strconv.Itoa(maxHops), target)
+	if err != nil {
+		return nil, err
+	}
+	return parseMTRReport(output)
+}
+
+// parseMTRReport parses the output of mtr --json
+func parseMTRReport(output []byte) ([]PathHop, error) {
+	var report struct {
+		Report struct {
+			Hubs []struct {
+				// Older mtr releases report the hop number as a string
+				Count json.RawMessage `json:"count"`
+				Host  string          `json:"host"`
+				Loss  float64         `json:"Loss%"`
+				Sent  int             `json:"Snt"`
+				Last  float64         `json:"Last"`
+				Avg   float64         `json:"Avg"`
+				Best  float64         `json:"Best"`
+				Worst float64         `json:"Wrst"`
+			} `json:"hubs"`
+		} `json:"report"`
+	}
+	if err := json.Unmarshal(output, &report); err != nil {
+		return nil, fmt.Errorf("failed to parse mtr report: %w", err)
+	}
+
+	hops := make([]PathHop, 0, len(report.Report.Hubs))
+	for i, hub := range report.Report.Hubs {
+		hop, err := strconv.Atoi(strings.Trim(string(hub.Count), `"`))
+		if err != nil {
+			hop = i + 1
+		}
+		address := hub.Host
+		if address == "???" {
+			address = ""
+		}
+		hops = append(hops, PathHop{
+			Hop:         hop,
+			Address:     address,
+			Sent:        hub.Sent,
+			LossPercent: hub.Loss,
+			LastMillis:  hub.Last,
+			AvgMillis:   hub.Avg,
+			BestMillis:  hub.Best,
+			WorstMillis: hub.Worst,
+		})
+	}
+	return hops, nil
+}
+
+// runTraceroute traces the path with traceroute, sending probes queries per hop
+func runTraceroute(ctx context.Context, target string, probes, maxHops int) ([]PathHop, error) {
+	output, err := runPathCommand(ctx, "traceroute", "-n", "-q", strconv.Itoa(probes),
+		"-w", "2", "-m", strconv.Itoa(maxHops), target)
+	if err != nil {
+		return nil, err
+	}
+	return parseTraceroute(string(output)), nil
+}
+
+// parseTraceroute parses traceroute -n output such as
+// " 3  192.0.2.1  5.123 ms  5.310 ms *"
+func parseTraceroute(output string) []PathHop {
+	hops := []PathHop{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		number, err := strconv.Atoi(fields[0])
+		if err != nil {
+			// The "traceroute to ..." header
+			continue
+		}
+
+		hop := PathHop{Hop: number}
+		var rtts []float64
+		lost := 0
+		for i, field := range fields[1:] {
+			switch {
+			case field == "*":
+				lost++
+			case net.ParseIP(field) != nil:
+				if hop.Address == "" {
+					hop.Address = field
+				}
+			case i+2 < len(fields) && fields[i+2] == "ms":
+				if rtt, err := strconv.ParseFloat(field, 64); err == nil {
+					rtts = append(rtts, rtt)
+				}
+			}
+		}
+
+		hop.Sent = lost + len(rtts)
+		if hop.Sent > 0 {
+			hop.LossPercent = float64(lost) * 100 / float64(hop.Sent)
+		}
+		if len(rtts) > 0 {
+			hop.BestMillis, hop.WorstMillis = rtts[0], rtts[0]
+			sum := 0.0
+			for _, rtt := range rtts {
+				sum += rtt
+				if rtt < hop.BestMillis {
+					hop.BestMillis = rtt
+				}
+				if rtt > hop.WorstMillis {
+					hop.WorstMillis = rtt
+				}
+			}
+			hop.AvgMillis = sum / float64(len(rtts))
+			hop.LastMillis = rtts[len(rtts)-1]
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
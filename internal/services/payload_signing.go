@@ -0,0 +1,104 @@
+package services
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// Headers of a signed request
+const (
+	signatureHeader     = "X-Somana-Signature"
+	signatureTimeHeader = "X-Somana-Signature-Time"
+)
+
+// payloadKey is the key requests and MQTT messages are signed with, nil when payload
+// signing is off. It is the key UDP heartbeats are signed with, so the server pins one
+// key per agent.
+var payloadKey atomic.Pointer[ed25519.PrivateKey]
+
+// ConfigurePayloadSigning loads the agent's key when payload signing is enabled. It fails
+// rather than send unsigned payloads the server would reject.
+func ConfigurePayloadSigning(cfg *config.Config) error {
+	if !cfg.PayloadSigning.Enabled {
+		return nil
+	}
+	key, err := heartbeatKey()
+	if err != nil {
+		return err
+	}
+	payloadKey.Store(&key)
+	log.Printf("Signing requests and MQTT messages with the key in %s", heartbeatKeyPath)
+	return nil
+}
+
+// signingPublicKey returns the public key to send with HTTPS heartbeats when payloads are
+// signed, or an empty string
+func signingPublicKey() string {
+	key := payloadKey.Load()
+	if key == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// payloadSignature signs a request: its method, path, Unix time and the hex SHA-256 of its
+// body, separated by newlines. The time lets the server reject replays.
+func payloadSignature(key ed25519.PrivateKey, method, path string, unix int64, body []byte) string {
+	digest := sha256.Sum256(body)
+	message := fmt.Sprintf("%s\n%s\n%d\n%s", method, path, unix, hex.EncodeToString(digest[:]))
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(message)))
+}
+
+// signingTransport signs every request to the server as sent, after encoding and
+// compression, so a gateway relaying it cannot alter it unnoticed
+type signingTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := payloadKey.Load()
+	if key == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		// Reading GetBody's copy leaves the request's own body for the transport
+		reader := req.Body
+		if req.GetBody != nil {
+			var err error
+			if reader, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body to sign: %w", err)
+		}
+		body = data
+	}
+
+	// A RoundTripper must not modify the request it was given
+	signed := req.Clone(req.Context())
+	if body != nil && req.GetBody == nil {
+		signed.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	now := time.Now().Unix()
+	signed.Header.Set(signatureTimeHeader, strconv.FormatInt(now, 10))
+	signed.Header.Set(signatureHeader, payloadSignature(*key, req.Method, req.URL.Path, now, body))
+	return t.base.RoundTrip(signed)
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dataClass is the kind of data a request carries, in order of priority. When reporting is
+// constrained, by a bandwidth budget or by server backpressure, higher classes go first
+// and lower ones are shed first.
+type dataClass int
+
+const (
+	classInventory dataClass = iota
+	classLogs
+	classMetrics
+	classEvents
+	classHeartbeat
+)
+
+// String returns the name of the class
+func (c dataClass) String() string {
+	switch c {
+	case classInventory:
+		return "inventory"
+	case classLogs:
+		return "logs"
+	case classMetrics:
+		return "metrics"
+	case classEvents:
+		return "events"
+	case classHeartbeat:
+		return "heartbeat"
+	}
+	return fmt.Sprintf("class %d", int(c))
+}
+
+// parseDataClass returns the class with the given name
+func parseDataClass(name string) (dataClass, bool) {
+	for class := classInventory; class <= classHeartbeat; class++ {
+		if class.String() == name {
+			return class, true
+		}
+	}
+	return 0, false
+}
+
+// reportRoute names the collector and class of the reports sent to a path
+type reportRoute struct {
+	collector string
+	class     dataClass
+}
+
+// reportRoutes maps report paths, below the host, to the collector and class of their reports
+var reportRoutes = map[string]reportRoute{
+	"/heartbeat":            {"heartbeat", classHeartbeat},
+	"/agent-health":         {"agent", classEvents},
+	"/security-events":      {"audit", classEvents},
+	"/crash-events":         {"crashes", classEvents},
+	"/fim-events":           {"fim", classEvents},
+	"/kernel-events":        {"kernel_log", classEvents},
+	"/reboot-events":        {"reboots", classEvents},
+	"/remediation-events":   {"remediation", classEvents},
+	"/service-events":       {"systemd", classEvents},
+	"/storage-events":       {"storage", classEvents},
+	"/network-mount-events": {"network_mounts", classEvents},
+	"/saturation-events":    {"saturation", classEvents},
+	"/systemd-services":     {"systemd", classMetrics},
+	"/service-availability": {"systemd", classMetrics},
+	"/metrics":              {"metrics", classMetrics},
+	"/connections":          {"connections", classMetrics},
+	"/network/flows":        {"netflow", classMetrics},
+	"/hardware/ipmi":        {"ipmi", classMetrics},
+	"/custom-metrics":       {"custom_metrics", classMetrics},
+	"/textfile-metrics":     {"textfile", classMetrics},
+	"/containers":           {"containers", classMetrics},
+	"/virtual-machines":     {"libvirt", classMetrics},
+	"/storage":              {"storage", classMetrics},
+	"/network-mounts":       {"network_mounts", classMetrics},
+	"/saturation":           {"saturation", classMetrics},
+	"/logs":                 {"eventlog", classLogs},
+	"/inventory":            {"inventory", classInventory},
+	"/compliance":           {"compliance", classInventory},
+	"/firewall":             {"firewall", classInventory},
+	"/kernel":               {"kernel", classInventory},
+	"/scheduled-jobs":       {"scheduled_jobs", classInventory},
+}
+
+// routeOf returns the route of a report path; reports to other paths count as metrics of a
+// collector named after the path
+func routeOf(path string) reportRoute {
+	suffix := path
+	if rest, ok := strings.CutPrefix(path, "/api/v1/hosts/"); ok {
+		if i := strings.Index(rest, "/"); i >= 0 {
+			suffix = rest[i:]
+		}
+	}
+	if route, ok := reportRoutes[suffix]; ok {
+		return route
+	}
+	return reportRoute{collector: strings.TrimPrefix(suffix, "/"), class: classMetrics}
+}
@@ -0,0 +1,44 @@
+package services
+
+import (
+	"log"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/helper"
+)
+
+// privilegedHelper returns a client for the privileged helper, or nil when it is
+// disabled or not reachable
+func privilegedHelper(cfg *config.Config) *helper.Client {
+	if !cfg.Helper.Enabled {
+		return nil
+	}
+	client := helper.NewClient(cfg.Helper.SocketPath)
+	if !client.Available() {
+		log.Printf("Privileged helper not reachable at %s", cfg.Helper.SocketPath)
+		return nil
+	}
+	return client
+}
+
+// helperTailer reads the audit log through the privileged helper
+type helperTailer struct {
+	client *helper.Client
+	inode  uint64
+	offset int64
+}
+
+// ReadLines returns all complete lines appended since the previous call
+func (t *helperTailer) ReadLines() ([]string, error) {
+	lines, inode, offset, err := t.client.ReadAuditLog(t.inode, t.offset)
+	if err != nil {
+		return nil, err
+	}
+	t.inode, t.offset = inode, offset
+	return lines, nil
+}
+
+// Close is a no-op since the helper keeps no state for the agent
+func (t *helperTailer) Close() error {
+	return nil
+}
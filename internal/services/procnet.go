@@ -0,0 +1,202 @@
+package services
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// TCP socket states as reported in /proc/net/tcp
+const (
+	tcpStateEstablished = "01"
+	tcpStateListen      = "0A"
+)
+
+// tcpSocket is a single entry from /proc/net/tcp or /proc/net/tcp6
+type tcpSocket struct {
+	LocalIP    net.IP
+	LocalPort  int
+	RemoteIP   net.IP
+	RemotePort int
+	State      string
+	Inode      uint64
+}
+
+// readTCPSockets reads IPv4 and IPv6 TCP sockets from procfs
+func readTCPSockets() ([]tcpSocket, error) {
+	sockets, err := parseProcNetTCP(hostProcSelf("net/tcp"))
+	if err != nil {
+		return nil, err
+	}
+
+	// IPv6 may be disabled, so a missing tcp6 table is not an error
+	sockets6, err := parseProcNetTCP(hostProcSelf("net/tcp6"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return append(sockets, sockets6...), nil
+}
+
+// parseProcNetTCP parses a /proc/net/tcp style table
+func parseProcNetTCP(path string) ([]tcpSocket, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sockets := []tcpSocket{}
+	scanner := bufio.NewScanner(file)
+	// Skip header line
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		localIP, localPort, err := parseProcNetAddr(fields[1])
+		if err != nil {
+			continue
+		}
+		remoteIP, remotePort, err := parseProcNetAddr(fields[2])
+		if err != nil {
+			continue
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		sockets = append(sockets, tcpSocket{
+			LocalIP:    localIP,
+			LocalPort:  localPort,
+			RemoteIP:   remoteIP,
+			RemotePort: remotePort,
+			State:      fields[3],
+			Inode:      inode,
+		})
+	}
+	return sockets, scanner.Err()
+}
+
+// parseProcNetAddr decodes an "ADDR:PORT" pair where ADDR is hex in host byte order per 32-bit word
+func parseProcNetAddr(raw string) (net.IP, int, error) {
+	addrHex, portHex, ok := strings.Cut(raw, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid address: %s", raw)
+	}
+
+	addr, err := hex.DecodeString(addrHex)
+	if err != nil || (len(addr) != net.IPv4len && len(addr) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address: %s", raw)
+	}
+	// Each 32-bit word is stored little-endian
+	for i := 0; i < len(addr); i += 4 {
+		addr[i], addr[i+1], addr[i+2], addr[i+3] = addr[i+3], addr[i+2], addr[i+1], addr[i]
+	}
+
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port: %s", raw)
+	}
+
+	return net.IP(addr), int(port), nil
+}
+
+// processInfo identifies a process owning one or more sockets
+type processInfo struct {
+	PID  int
+	Comm string
+	Unit string
+}
+
+// mapSocketInodes walks /proc/<pid>/fd and maps socket inodes to their owning process
+func mapSocketInodes() map[uint64]processInfo {
+	owners := make(map[uint64]processInfo)
+
+	procDir := hostFile("/proc")
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return owners
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		fdDir := filepath.Join(procDir, entry.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			// Processes owned by other users are unreadable without privileges
+			continue
+		}
+
+		var info *processInfo
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(target, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]"), 10, 64)
+			if err != nil {
+				continue
+			}
+			if info == nil {
+				info = &processInfo{
+					PID:  pid,
+					Comm: readProcComm(pid),
+					Unit: readProcUnit(pid),
+				}
+			}
+			owners[inode] = *info
+		}
+	}
+
+	return owners
+}
+
+// readProcComm returns the command name of a process
+func readProcComm(pid int) string {
+	data, err := os.ReadFile(hostFile(filepath.Join("/proc", strconv.Itoa(pid), "comm")))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readProcCgroup returns the cgroup v2 path of a process
+func readProcCgroup(pid int) string {
+	data, err := os.ReadFile(hostFile(filepath.Join("/proc", strconv.Itoa(pid), "cgroup")))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// cgroup v2 entries have the form "0::/system.slice/foo.service"
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::")
+		}
+	}
+	return ""
+}
+
+// readProcUnit returns the systemd unit a process belongs to, if any
+func readProcUnit(pid int) string {
+	cgroup := readProcCgroup(pid)
+	parts := strings.Split(cgroup, "/")
+	// Walk from the leaf so nested cgroups resolve to the innermost unit
+	for i := len(parts) - 1; i >= 0; i-- {
+		if strings.HasSuffix(parts[i], ".service") || strings.HasSuffix(parts[i], ".scope") {
+			return parts[i]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"log"
+	"math/rand"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/schedule"
+)
+
+const (
+	// sharedClockResolution is how often the shared clock checks which tickers are due
+	sharedClockResolution = time.Second
+	// maxSharedResumeJitter bounds the delay before a shared ticker fires after a resume
+	maxSharedResumeJitter = 5 * time.Second
+	// minimalGCPercent makes the garbage collector run sooner in the minimal profile
+	minimalGCPercent = 50
+)
+
+// ConfigureProfile applies the runtime side of the configured profile; it must run before
+// any collector starts so every report ticker uses the shared clock
+func ConfigureProfile(cfg *config.Config) {
+	if cfg.Profile != config.ProfileMinimal {
+		return
+	}
+
+	activeClock.Lock()
+	if activeClock.clock == nil {
+		activeClock.clock = &sharedClock{ticks: make(map[*sharedTick]bool)}
+		go activeClock.clock.run()
+	}
+	activeClock.Unlock()
+
+	// An explicit GOGC in the environment takes precedence
+	if os.Getenv("GOGC") == "" {
+		debug.SetGCPercent(minimalGCPercent)
+	}
+	log.Println("Minimal profile: collectors share one ticker and buffers are reduced")
+}
+
+// activeClock is the shared clock of the minimal profile, if any
+var activeClock struct {
+	sync.Mutex
+	clock *sharedClock
+}
+
+// currentSharedClock returns the shared clock, or nil when tickers run on their own
+func currentSharedClock() *sharedClock {
+	activeClock.Lock()
+	defer activeClock.Unlock()
+	return activeClock.clock
+}
+
+// sharedClock drives every report ticker from a single schedule.Ticker, instead of one
+// timer goroutine and clock jump subscription per collector
+type sharedClock struct {
+	mu    sync.Mutex
+	ticks map[*sharedTick]bool
+}
+
+// sharedTick is one report ticker driven by the shared clock; like schedule.Ticker it
+// drops ticks rather than queueing them for slow receivers
+type sharedTick struct {
+	C <-chan time.Time
+
+	c        chan time.Time
+	clock    *sharedClock
+	interval time.Duration
+	next     time.Time
+}
+
+// run fires due tickers on every tick of the underlying ticker
+func (s *sharedClock) run() {
+	ticker := schedule.NewTicker(sharedClockResolution)
+	defer ticker.Stop()
+	// Go timers stop during suspend, so due times are pulled in after a resume
+	cancel := schedule.OnClockJump(func(drift time.Duration) {
+		if drift > 0 {
+			s.expedite()
+		}
+	})
+	defer cancel()
+
+	for now := range ticker.C {
+		s.fire(now)
+	}
+}
+
+// subscribe adds a ticker firing every interval, which must be positive
+func (s *sharedClock) subscribe(interval time.Duration) *sharedTick {
+	if interval <= 0 {
+		panic("services: non-positive interval for shared ticker")
+	}
+	c := make(chan time.Time, 1)
+	tick := &sharedTick{C: c, c: c, clock: s, interval: interval, next: time.Now().Add(interval)}
+
+	s.mu.Lock()
+	s.ticks[tick] = true
+	s.mu.Unlock()
+	return tick
+}
+
+// fire delivers a tick to every ticker due by now
+func (s *sharedClock) fire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Half a resolution of slack keeps an interval that is a multiple of the resolution
+	// from slipping by a whole tick
+	due := now.Add(sharedClockResolution / 2)
+	for tick := range s.ticks {
+		if due.Before(tick.next) {
+			continue
+		}
+		select {
+		case tick.c <- now:
+		default:
+		}
+		tick.next = now.Add(tick.interval)
+	}
+}
+
+// expedite makes every ticker fire shortly, spread out so a fleet resuming together does
+// not report at once
+func (s *sharedClock) expedite() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for tick := range s.ticks {
+		limit := min(tick.interval/10, maxSharedResumeJitter)
+		at := now
+		if limit > 0 {
+			at = at.Add(time.Duration(rand.Int63n(int64(limit))))
+		}
+		if at.Before(tick.next) {
+			tick.next = at
+		}
+	}
+}
+
+// Reset changes the interval; the next tick comes one new interval from now
+func (t *sharedTick) Reset(interval time.Duration) {
+	if interval <= 0 {
+		panic("services: non-positive interval for shared ticker")
+	}
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.interval = interval
+	t.next = time.Now().Add(interval)
+}
+
+// Stop removes the ticker from the shared clock; no more ticks are sent after it returns
+func (t *sharedTick) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	delete(t.clock.ticks, t)
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// QueryCacheStats count how cached system queries were answered, reported in self-metrics
+type QueryCacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	// Invalidations are results dropped before their TTL because what they describe changed
+	Invalidations uint64 `json:"invalidations"`
+}
+
+var queryCacheStats struct {
+	hits, misses, invalidations atomic.Uint64
+}
+
+// currentQueryCacheStats returns the cache counters, or nil before any cached query ran
+func currentQueryCacheStats() *QueryCacheStats {
+	if queryCacheStats.hits.Load() == 0 && queryCacheStats.misses.Load() == 0 {
+		return nil
+	}
+	return &QueryCacheStats{
+		Hits:          queryCacheStats.hits.Load(),
+		Misses:        queryCacheStats.misses.Load(),
+		Invalidations: queryCacheStats.invalidations.Load(),
+	}
+}
+
+// queryCache holds the cache configuration and how to drop each cached query, by name
+var queryCache = struct {
+	sync.Mutex
+	config      config.QueryCacheConfig
+	invalidates map[string]func()
+}{
+	config:      config.QueryCacheConfig{Enabled: true, PackagesTTL: 24 * time.Hour, HardwareTTL: 24 * time.Hour},
+	invalidates: make(map[string]func()),
+}
+
+// configureQueryCache applies the cache configuration. A changed configuration drops every
+// cached result, so new TTLs apply right away.
+func configureQueryCache(cfg *config.Config) {
+	queryCache.Lock()
+	changed := !reflect.DeepEqual(queryCache.config, cfg.QueryCache)
+	queryCache.config = cfg.QueryCache
+	queryCache.Unlock()
+	if changed {
+		invalidateQueries()
+	}
+}
+
+// invalidateQueries drops the cached results of the named queries, or of all of them
+// without names, so their next use queries the system again
+func invalidateQueries(names ...string) {
+	queryCache.Lock()
+	var invalidates []func()
+	if len(names) == 0 {
+		for _, invalidate := range queryCache.invalidates {
+			invalidates = append(invalidates, invalidate)
+		}
+	}
+	for _, name := range names {
+		if invalidate, ok := queryCache.invalidates[name]; ok {
+			invalidates = append(invalidates, invalidate)
+		}
+	}
+	queryCache.Unlock()
+	for _, invalidate := range invalidates {
+		invalidate()
+	}
+}
+
+// cachedQuery is a slow query of slow-changing data whose result collectors share until
+// its TTL passes or it is invalidated. Callers get the same value and must not modify it.
+type cachedQuery[T any] struct {
+	ttl   func(*config.QueryCacheConfig) time.Duration
+	fetch func() (T, error)
+	// stamp identifies the state of the source cheaply, such as the modification time of a
+	// database; a different stamp refreshes the result before its TTL
+	stamp func() string
+
+	// mu is held while querying, so concurrent callers wait for one query
+	mu      sync.Mutex
+	valid   bool
+	value   T
+	fetched time.Time
+	stamped string
+}
+
+// newCachedQuery registers a cached query under name, for invalidateQueries. stamp may
+// be nil.
+func newCachedQuery[T any](name string, ttl func(*config.QueryCacheConfig) time.Duration, stamp func() string, fetch func() (T, error)) *cachedQuery[T] {
+	q := &cachedQuery[T]{ttl: ttl, fetch: fetch, stamp: stamp}
+	queryCache.Lock()
+	queryCache.invalidates[name] = q.invalidate
+	queryCache.Unlock()
+	return q
+}
+
+// get returns the cached result, querying the source when there is none still fresh.
+// Failed queries are not cached.
+func (q *cachedQuery[T]) get() (T, error) {
+	queryCache.Lock()
+	cfg := queryCache.config
+	queryCache.Unlock()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stamp := ""
+	if q.stamp != nil {
+		stamp = q.stamp()
+	}
+	if cfg.Enabled && q.valid && time.Since(q.fetched) < q.ttl(&cfg) {
+		if stamp == q.stamped {
+			queryCacheStats.hits.Add(1)
+			return q.value, nil
+		}
+		queryCacheStats.invalidations.Add(1)
+	}
+
+	queryCacheStats.misses.Add(1)
+	value, err := q.fetch()
+	q.valid = err == nil && cfg.Enabled
+	if q.valid {
+		q.value, q.fetched, q.stamped = value, time.Now(), stamp
+	} else {
+		var zero T
+		q.value = zero
+	}
+	return value, err
+}
+
+// invalidate drops the cached result
+func (q *cachedQuery[T]) invalidate() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.valid {
+		queryCacheStats.invalidations.Add(1)
+	}
+	var zero T
+	q.valid, q.value = false, zero
+}
@@ -0,0 +1,546 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/execwrap"
+)
+
+// bootStatePath keeps what the agent knows about the current boot, to be compared with the
+// next one
+const bootStatePath = "data/boot_state.json"
+
+// bootTimeTolerance is how far two readings of the boot time may differ for the same boot.
+// Systems without a boot ID derive the boot time from the uptime, which drifts slightly.
+const bootTimeTolerance = 10 * time.Second
+
+// How the agent last stopped in a boot
+const (
+	// shutdownSystem: the agent stopped because the system was shutting down
+	shutdownSystem = "system"
+	// shutdownAgent: only the agent stopped; the system may have been rebooted later
+	shutdownAgent = "agent"
+)
+
+// ActionReboot is the remote action of rebooting the host
+const ActionReboot = "reboot"
+
+// rebootCommandTimeout bounds the reboot command, which only has to start the shutdown
+const rebootCommandTimeout = 30 * time.Second
+
+// maxHandledReboots bounds the reboot request IDs kept in the boot state
+const maxHandledReboots = 50
+
+// Reboot kinds
+const (
+	rebootPlanned    = "planned"
+	rebootUnexpected = "unexpected"
+	rebootUnknown    = "unknown"
+)
+
+// bootInfo identifies the running boot
+type bootInfo struct {
+	// ID is the kernel's boot ID, empty where the system has none
+	ID   string
+	Time time.Time
+}
+
+// bootState is the agent's record of a boot
+type bootState struct {
+	BootID   string    `json:"boot_id,omitempty"`
+	BootTime time.Time `json:"boot_time"`
+	// LastSeen is the last time the agent saw the host up during the boot
+	LastSeen time.Time `json:"last_seen"`
+	// Shutdown is how the agent stopped, empty while it runs; a boot that ended with it
+	// empty ended without the agent being stopped
+	Shutdown string `json:"shutdown,omitempty"`
+	// RebootRequest is the server request the agent rebooted the host for
+	RebootRequest string `json:"reboot_request,omitempty"`
+	// HandledRequests are the reboot requests the agent acted on, oldest first. The server
+	// offers a request until it sees the reboot event, so these are kept across restarts
+	// and the reboot itself.
+	HandledRequests []string `json:"handled_requests,omitempty"`
+	// Pending are reboot events the server has not accepted yet
+	Pending []RebootEvent `json:"pending,omitempty"`
+}
+
+// RebootEvent reports that the host booted again since the agent last ran
+type RebootEvent struct {
+	EventID string `json:"event_id"`
+	// Kind is "planned" when the agent saw the system shut down, "unexpected" when the
+	// boot ended while the agent was running, as after a kernel panic, power loss or
+	// hard reset, and "unknown" when the agent had been stopped before
+	Kind             string    `json:"kind"`
+	BootID           string    `json:"boot_id,omitempty"`
+	BootTime         time.Time `json:"boot_time"`
+	PreviousBootID   string    `json:"previous_boot_id,omitempty"`
+	PreviousBootTime time.Time `json:"previous_boot_time"`
+	// LastSeen is the last time the agent saw the host up in the previous boot
+	LastSeen time.Time `json:"last_seen"`
+	// PreviousBootDuration is how long the previous boot ran, until LastSeen
+	PreviousBootDuration time.Duration `json:"previous_boot_duration_ns"`
+	// Downtime is the time from LastSeen to the new boot
+	Downtime time.Duration `json:"downtime_ns"`
+	// RequestID is the server request the agent rebooted for, confirming it completed
+	RequestID   string `json:"request_id,omitempty"`
+	Maintenance string `json:"maintenance,omitempty"`
+}
+
+// rebootRequest is a reboot the server asks for
+type rebootRequest struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+	// RequestedBy is the user or automation that asked for the reboot
+	RequestedBy string `json:"requested_by,omitempty"`
+}
+
+// RebootResult tells the server what became of a reboot request before the host went
+// down; the reboot event of the next boot confirms that it came back
+type RebootResult struct {
+	RequestID string `json:"request_id"`
+	// Status is "rebooting" right before the reboot command runs, then "failed" if it
+	// cannot; a request that is not acted on is "refused"
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	Maintenance string `json:"maintenance,omitempty"`
+}
+
+// RebootEventsReport is the payload sent to the reboot events endpoint
+type RebootEventsReport struct {
+	Events []RebootEvent `json:"events"`
+}
+
+// RebootService detects that the host rebooted while the agent was not running and
+// reports whether it was planned
+type RebootService struct {
+	config   *config.Config
+	hostRid  string
+	stopChan chan bool
+	started  bool
+
+	mu    sync.Mutex
+	state bootState
+
+	// requests remembers the reboot requests between polls
+	requests commandInbox
+}
+
+// NewRebootService creates a new reboot detection service
+func NewRebootService(cfg *config.Config, hostRid string) *RebootService {
+	return &RebootService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+	}
+}
+
+// Start compares the running boot with the one the agent last saw, then records that
+// the host is up at the configured interval
+func (s *RebootService) Start() error {
+	if !s.config.Reboots.Enabled {
+		log.Println("Reboot detection not enabled - skipping")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping reboot detection")
+		return nil
+	}
+	boot, err := currentBoot()
+	if err != nil {
+		log.Printf("Reboot detection skipped: %v", err)
+		return nil
+	}
+
+	previous, err := loadBootState()
+	if err != nil {
+		log.Printf("Warning: failed to load boot state: %v", err)
+	}
+	var event *RebootEvent
+	s.state, event = nextBootState(previous, boot, time.Now())
+	if event != nil {
+		log.Printf("Host rebooted (%s) after %s up, down for %s", event.Kind, event.PreviousBootDuration.Round(time.Second), event.Downtime.Round(time.Second))
+	}
+	if err := saveBootState(s.state); err != nil {
+		log.Printf("Warning: failed to save boot state: %v", err)
+	}
+
+	s.started = true
+	go s.loop()
+
+	if s.config.Reboots.Remote.Enabled {
+		log.Println("Reboot detection started, accepting reboot requests from the server")
+		return nil
+	}
+	log.Println("Reboot detection started")
+	return nil
+}
+
+// Stop records whether the system is shutting down, so the next boot knows whether it
+// was planned
+func (s *RebootService) Stop() {
+	if !s.started {
+		return
+	}
+	close(s.stopChan)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.LastSeen = time.Now()
+	s.state.Shutdown = shutdownAgent
+	// A reboot the agent started is a system shutdown even where it cannot be detected
+	if systemShuttingDown() || s.state.RebootRequest != "" {
+		s.state.Shutdown = shutdownSystem
+	}
+	if err := saveBootState(s.state); err != nil {
+		log.Printf("Warning: failed to save boot state: %v", err)
+	}
+	log.Printf("Reboot detection stopped (%s shutdown)", s.state.Shutdown)
+}
+
+// loop sends a pending reboot event, refreshes LastSeen and polls for reboot requests
+func (s *RebootService) loop() {
+	defer recoverPanic("reboots")
+	ticker := newReportTicker(s.config.Reboots.Interval)
+	defer ticker.Stop()
+	var requests <-chan time.Time
+	if s.config.Reboots.Remote.Enabled {
+		requestTicker := newReportTicker(s.config.Reboots.Remote.PollInterval)
+		defer requestTicker.Stop()
+		requests = requestTicker.C
+	}
+
+	// The event goes out right away; the ticker only retries it
+	s.sendPending()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			s.state.LastSeen = time.Now()
+			if err := saveBootState(s.state); err != nil {
+				log.Printf("Warning: failed to save boot state: %v", err)
+			}
+			s.mu.Unlock()
+			s.sendPending()
+		case <-requests:
+			s.poll()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// sendPending sends the reboot events until the server accepts them
+func (s *RebootService) sendPending() {
+	s.mu.Lock()
+	events := s.state.Pending
+	s.mu.Unlock()
+	if len(events) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiRequestTimeout)
+	defer cancel()
+	reqBody := RebootEventsReport{Events: events}
+	if err := submitReport(ctx, s.config, http.MethodPost, hostPath(s.hostRid, "/reboot-events"), reqBody); err != nil {
+		log.Printf("Failed to report reboots (%d queued): %v", len(events), err)
+		return
+	}
+	log.Printf("Reported %d reboots successfully", len(events))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Events are only added at start, so those sent are still the first ones
+	s.state.Pending = s.state.Pending[len(events):]
+	if err := saveBootState(s.state); err != nil {
+		log.Printf("Warning: failed to save boot state: %v", err)
+	}
+}
+
+// nextBootState returns the state for the running boot. When the previous state belongs to
+// an earlier boot, it also returns a reboot event describing how that boot ended, which
+// is queued behind the events that were never sent.
+func nextBootState(previous *bootState, boot bootInfo, now time.Time) (bootState, *RebootEvent) {
+	state := bootState{BootID: boot.ID, BootTime: boot.Time, LastSeen: now}
+	if previous == nil {
+		return state, nil
+	}
+	state.Pending = previous.Pending
+	state.HandledRequests = previous.HandledRequests
+	state.handled(previous.RebootRequest)
+	if previous.sameBoot(boot) {
+		return state, nil
+	}
+
+	kind := rebootUnexpected
+	switch previous.Shutdown {
+	case shutdownSystem:
+		kind = rebootPlanned
+	case shutdownAgent:
+		kind = rebootUnknown
+	}
+	// The host went down between LastSeen and the new boot
+	window, inWindow := maintenanceAt(previous.LastSeen)
+	if !inWindow {
+		window, inWindow = maintenanceAt(boot.Time)
+	}
+	if kind == rebootUnknown && inWindow && window.Reboot {
+		kind = rebootPlanned
+	}
+	event := &RebootEvent{
+		Kind:                 kind,
+		BootID:               boot.ID,
+		BootTime:             boot.Time,
+		PreviousBootID:       previous.BootID,
+		PreviousBootTime:     previous.BootTime,
+		LastSeen:             previous.LastSeen,
+		PreviousBootDuration: previous.LastSeen.Sub(previous.BootTime),
+		RequestID:            previous.RebootRequest,
+		Maintenance:          window.Name,
+	}
+	if downtime := boot.Time.Sub(previous.LastSeen); downtime > 0 {
+		event.Downtime = downtime
+	}
+	event.EventID = eventID("reboot", boot.ID, strconv.FormatInt(boot.Time.Unix(), 10))
+	state.Pending = retainEvents("reboot", append(state.Pending, *event))
+	return state, event
+}
+
+// poll acts on the reboot requests of the server
+func (s *RebootService) poll() {
+	ctx, cancel := context.WithTimeout(context.Background(), apiRequestTimeout)
+	var items []json.RawMessage
+	err := sendJSON(ctx, s.config, http.MethodGet, hostPath(s.hostRid, "/reboots/requests"), nil, &items)
+	cancel()
+
+	var statusErr *apiStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		// Servers without coordinated reboots
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to fetch reboot requests: %v", err)
+		return
+	}
+
+	verifier, err := newCommandVerifier(s.config, s.hostRid)
+	if err != nil {
+		log.Printf("Cannot verify reboot requests: %v", err)
+		return
+	}
+	// Requests acted on before a restart or the reboot may still be offered; they are
+	// skipped before their nonce is used
+	s.mu.Lock()
+	if s.requests.handled == nil {
+		s.requests.handled = make(map[string]bool)
+	}
+	for _, id := range s.state.HandledRequests {
+		s.requests.handled[id] = true
+	}
+	s.mu.Unlock()
+	receiveCommands(&s.requests, verifier, items, rebootRequest.id, s.rejectUnverified, func(request rebootRequest) bool {
+		// The host is going down; later requests are left for after the reboot
+		return !s.reboot(request)
+	})
+}
+
+// id returns the request ID
+func (r rebootRequest) id() string { return r.ID }
+
+// rejectUnverified reports a reboot request that is malformed or fails signature checks.
+// It is described by what it claims to be, which cannot be trusted.
+func (s *RebootService) rejectUnverified(item json.RawMessage, err error) {
+	var claimed rebootRequest
+	json.Unmarshal(unverifiedPayload(item), &claimed)
+	log.Printf("Rejected reboot request %q: %v", claimed.ID, err)
+
+	action := startRemoteAction(s.config, ActionReboot)
+	action.RequestID, action.Requester = claimed.ID, claimed.RequestedBy
+	action.Args = map[string]string{"reason": claimed.Reason}
+	action.reject(err)
+	raiseHealthEvent(healthCommandRejected, severityError, "reboots", err.Error(), map[string]interface{}{
+		"request_id": claimed.ID,
+	})
+}
+
+// reboot records the request so the next boot confirms it, uploads the result and flushes
+// queued reports while the network is still up, and runs the reboot command. It reports
+// whether the host is going down.
+func (s *RebootService) reboot(request rebootRequest) bool {
+	action := startRemoteAction(s.config, ActionReboot)
+	action.RequestID, action.Requester = request.ID, request.RequestedBy
+	action.Args = map[string]string{"reason": request.Reason}
+	result := RebootResult{RequestID: request.ID}
+
+	window, inWindow := CurrentMaintenance()
+	result.Maintenance = window.Name
+	if s.config.Reboots.Remote.OnlyInWindow && !(inWindow && window.Reboot) {
+		err := errors.New("no maintenance window that allows reboots is in progress")
+		log.Printf("Refused reboot request %s: %v", request.ID, err)
+		result.Status, result.Error = "refused", err.Error()
+		action.reject(err)
+		s.mu.Lock()
+		s.state.handled(request.ID)
+		if err := saveBootState(s.state); err != nil {
+			log.Printf("Warning: failed to save boot state: %v", err)
+		}
+		s.mu.Unlock()
+		s.upload(result)
+		return false
+	}
+
+	log.Printf("Rebooting for request %s: %s", request.ID, request.Reason)
+	s.mu.Lock()
+	s.state.RebootRequest = request.ID
+	s.state.handled(request.ID)
+	s.state.LastSeen = time.Now()
+	saveErr := saveBootState(s.state)
+	if saveErr != nil {
+		s.state.RebootRequest = ""
+	}
+	s.mu.Unlock()
+	if saveErr != nil {
+		// Without the record the next boot could not confirm the reboot
+		s.fail(action, result, fmt.Errorf("failed to record the reboot: %w", saveErr))
+		return false
+	}
+
+	// Once the command runs the network may go down at any moment
+	result.Status = "rebooting"
+	s.upload(result)
+	s.flush()
+
+	command := rebootCommand(s.config.Reboots.Remote.Command)
+	ctx, cancel := context.WithTimeout(context.Background(), rebootCommandTimeout)
+	defer cancel()
+	if _, err := execwrap.Output(ctx, execwrap.Options{Writable: true}, command[0], command[1:]...); err != nil {
+		s.mu.Lock()
+		s.state.RebootRequest = ""
+		if err := saveBootState(s.state); err != nil {
+			log.Printf("Warning: failed to save boot state: %v", err)
+		}
+		s.mu.Unlock()
+		s.fail(action, result, err)
+		return false
+	}
+	action.finish(nil)
+	return true
+}
+
+// fail records and uploads a reboot that did not happen; a "failed" result supersedes
+// the "rebooting" one sent before the command ran
+func (s *RebootService) fail(action *RemoteAction, result RebootResult, err error) {
+	log.Printf("Reboot for request %s failed: %v", result.RequestID, err)
+	result.Status, result.Error = "failed", err.Error()
+	action.finish(err)
+	s.upload(result)
+}
+
+// flush sends the reports queued for the bulk reporter before the host goes down, waiting
+// at most flush_timeout. The agent's own shutdown flushes again what is left.
+func (s *RebootService) flush() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		flushReports()
+	}()
+	select {
+	case <-done:
+	case <-time.After(s.config.Reboots.Remote.FlushTimeout):
+		log.Printf("Queued reports not flushed within %s, rebooting anyway", s.config.Reboots.Remote.FlushTimeout)
+	}
+}
+
+// upload sends a reboot result to the server; a lost result is logged, the action log
+// still has the outcome
+func (s *RebootService) upload(result RebootResult) {
+	ctx, cancel := context.WithTimeout(context.Background(), apiRequestTimeout)
+	defer cancel()
+	if err := sendJSON(ctx, s.config, http.MethodPost, hostPath(s.hostRid, "/reboots/results"), result, nil); err != nil {
+		log.Printf("Failed to upload reboot result %s: %v", result.RequestID, err)
+	}
+}
+
+// rebootCommand returns the configured reboot command, or the platform's
+func rebootCommand(configured []string) []string {
+	if len(configured) > 0 {
+		return configured
+	}
+	if runtime.GOOS == "windows" {
+		return []string{"shutdown", "/r", "/t", "0"}
+	}
+	if _, err := exec.LookPath("systemctl"); err == nil {
+		return []string{"systemctl", "reboot"}
+	}
+	return []string{"shutdown", "-r", "now"}
+}
+
+// sameBoot reports whether the state was recorded during the given boot
+func (b *bootState) sameBoot(boot bootInfo) bool {
+	if b.BootID != "" && boot.ID != "" {
+		return b.BootID == boot.ID
+	}
+	diff := b.BootTime.Sub(boot.Time)
+	return diff < bootTimeTolerance && diff > -bootTimeTolerance
+}
+
+// handled adds a reboot request to those acted on, dropping the oldest beyond
+// maxHandledReboots
+func (b *bootState) handled(id string) {
+	if id == "" || slices.Contains(b.HandledRequests, id) {
+		return
+	}
+	b.HandledRequests = append(b.HandledRequests, id)
+	if n := len(b.HandledRequests) - maxHandledReboots; n > 0 {
+		b.HandledRequests = b.HandledRequests[n:]
+	}
+}
+
+// loadBootState loads the state of the boot the agent last ran in, nil when there is none
+func loadBootState() (*bootState, error) {
+	data, err := os.ReadFile(bootStatePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read boot state file: %w", err)
+	}
+	var state bootState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse boot state file: %w", err)
+	}
+	return &state, nil
+}
+
+// saveBootState writes the boot state atomically, since a crash mid-write is what it is
+// there to survive
+func saveBootState(state bootState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(bootStatePath), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	tmp := bootStatePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write boot state file: %w", err)
+	}
+	if err := os.Rename(tmp, bootStatePath); err != nil {
+		return fmt.Errorf("failed to write boot state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNextBootStateKeepsHandledRequests(t *testing.T) {
+	now := time.Now()
+	previous := &bootState{
+		BootID:          "boot-1",
+		BootTime:        now.Add(-time.Hour),
+		LastSeen:        now.Add(-time.Minute),
+		Shutdown:        shutdownSystem,
+		RebootRequest:   "reboot-2",
+		HandledRequests: []string{"reboot-1"},
+	}
+
+	state, event := nextBootState(previous, bootInfo{ID: "boot-2", Time: now}, now)
+	if event == nil || event.RequestID != "reboot-2" || event.Kind != rebootPlanned {
+		t.Fatalf("event = %+v, want a planned reboot for reboot-2", event)
+	}
+	if want := []string{"reboot-1", "reboot-2"}; !slices.Equal(state.HandledRequests, want) {
+		t.Errorf("handled requests = %v, want %v", state.HandledRequests, want)
+	}
+	if state.RebootRequest != "" {
+		t.Errorf("reboot request = %q, want it cleared in the new boot", state.RebootRequest)
+	}
+}
+
+func TestBootStateHandledIsBounded(t *testing.T) {
+	var state bootState
+	for i := 0; i < maxHandledReboots+5; i++ {
+		state.handled(fmt.Sprintf("reboot-%d", i))
+	}
+	state.handled(state.HandledRequests[0])
+	if len(state.HandledRequests) != maxHandledReboots {
+		t.Fatalf("kept %d handled requests, want %d", len(state.HandledRequests), maxHandledReboots)
+	}
+	if state.HandledRequests[0] != "reboot-5" {
+		t.Errorf("oldest kept = %q, want reboot-5", state.HandledRequests[0])
+	}
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// missedHeartbeatLimit is how many heartbeat intervals may pass without a successful
+	// heartbeat before the agent counts as unhealthy
+	missedHeartbeatLimit = 3
+	// minHeartbeatStaleness keeps short heartbeat intervals from flagging a single slow request
+	minHeartbeatStaleness = time.Minute
+)
+
+// RegistrationHealth is the registration and heartbeat state of a running agent, as
+// reported by the health command
+type RegistrationHealth struct {
+	Healthy bool `json:"healthy"`
+	// Reason explains why the agent is unhealthy
+	Reason  string `json:"reason,omitempty"`
+	HostRid string `json:"host_rid,omitempty"`
+	// RegisteredAt is when this run of the agent registered
+	RegisteredAt time.Time `json:"registered_at"`
+	// LastHeartbeat is the last heartbeat the server accepted
+	LastHeartbeat       time.Time     `json:"last_heartbeat"`
+	LastHeartbeatError  string        `json:"last_heartbeat_error,omitempty"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	HeartbeatInterval   time.Duration `json:"heartbeat_interval"`
+}
+
+// heartbeatHealth tracks heartbeat results for the health command
+type heartbeatHealth struct {
+	registeredAt  time.Time
+	lastSuccess   time.Time
+	lastError     error
+	failuresInRow int
+}
+
+// markRegistered records a successful registration
+func (s *HostRegistrationService) markRegistered() {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	s.health.registeredAt = time.Now()
+}
+
+// recordHeartbeat records the result of a heartbeat
+func (s *HostRegistrationService) recordHeartbeat(err error) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	if err != nil {
+		s.health.lastError = err
+		s.health.failuresInRow++
+		return
+	}
+	s.health.lastSuccess = time.Now()
+	s.health.lastError = nil
+	s.health.failuresInRow = 0
+}
+
+// heartbeatError returns the error of the last heartbeat, nil when it succeeded
+func (s *HostRegistrationService) heartbeatError() error {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	return s.health.lastError
+}
+
+// Health reports whether the host is registered and its heartbeats are getting through;
+// the registration itself counts as the first heartbeat, so a freshly started agent is healthy
+func (s *HostRegistrationService) Health() RegistrationHealth {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+
+	interval := s.heartbeatInterval()
+	health := RegistrationHealth{
+		HostRid:             s.GetHostRid(),
+		RegisteredAt:        s.health.registeredAt,
+		LastHeartbeat:       s.health.lastSuccess,
+		ConsecutiveFailures: s.health.failuresInRow,
+		HeartbeatInterval:   interval,
+	}
+	if s.health.lastError != nil {
+		health.LastHeartbeatError = s.health.lastError.Error()
+	}
+
+	if s.health.registeredAt.IsZero() {
+		health.Reason = "host is not registered"
+		return health
+	}
+	staleAfter := max(missedHeartbeatLimit*interval, minHeartbeatStaleness)
+	last := s.health.lastSuccess
+	if last.IsZero() {
+		last = s.health.registeredAt
+	}
+	if since := time.Since(last); since > staleAfter {
+		health.Reason = fmt.Sprintf("no successful heartbeat for %s", since.Round(time.Second))
+		if health.LastHeartbeatError != "" {
+			health.Reason += ": " + health.LastHeartbeatError
+		}
+		return health
+	}
+	health.Healthy = true
+	return health
+}
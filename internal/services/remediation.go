@@ -0,0 +1,265 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/execwrap"
+	"sprinter-agent/internal/generated"
+)
+
+// ActionRestartUnit is the action of restarting a failed unit under a remediation rule. It
+// is recorded in the remote action log with server "local".
+const ActionRestartUnit = "restart_unit"
+
+// remediationRequester stands in for the requester in the action log of restarts the
+// remediation rules made
+const remediationRequester = "remediation"
+
+// Remediation event kinds
+const (
+	remediationRestart   = "restart"
+	remediationEscalated = "escalated"
+)
+
+// RemediationEvent reports a restart of a failed unit, or that the unit is still failed
+// after every restart its rule allows
+type RemediationEvent struct {
+	EventID string `json:"event_id"`
+	// Kind is "restart" for an attempt and "escalated" once the attempts are used up
+	Kind string `json:"kind"`
+	Unit string `json:"unit"`
+	// Rule is the unit pattern of the rule that matched
+	Rule        string `json:"rule"`
+	Attempt     int    `json:"attempt"`
+	MaxRestarts int    `json:"max_restarts"`
+	// Result is systemd's reason for the failure a restart was for, such as exit-code
+	Result string `json:"result,omitempty"`
+	// Error is why the restart command failed
+	Error       string `json:"error,omitempty"`
+	Timestamp   string `json:"timestamp"`
+	Maintenance string `json:"maintenance,omitempty"`
+}
+
+// RemediationEventsReport is the payload sent to the remediation events endpoint
+type RemediationEventsReport struct {
+	Events []RemediationEvent `json:"events"`
+}
+
+// remediationState tracks the restarts of a unit since it last recovered
+type remediationState struct {
+	attempts int
+	// next is when the next restart, or the escalation, is due
+	next       time.Time
+	restarting bool
+	escalated  bool
+	// recoveredAt is when the unit left the failed state, zero while it is failed
+	recoveredAt time.Time
+}
+
+// remediation holds the restarts of failed units. It outlives the systemd collector, so a
+// restart of the collector does not give a unit a fresh set of restarts.
+var remediation = struct {
+	sync.Mutex
+	units map[string]*remediationState
+	// pending are events the server has not accepted yet
+	pending []RemediationEvent
+}{units: make(map[string]*remediationState)}
+
+// remediationRule is a rule with the section's settings filled in
+type remediationRule struct {
+	pattern     string
+	maxRestarts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+}
+
+// matchRemediationRule returns the first rule matching unit
+func matchRemediationRule(cfg *config.RemediationConfig, unit string) (remediationRule, bool) {
+	for _, rule := range cfg.Rules {
+		if ok, _ := filepath.Match(rule.Unit, unit); !ok {
+			continue
+		}
+		matched := remediationRule{
+			pattern:     rule.Unit,
+			maxRestarts: cfg.MaxRestarts,
+			backoff:     cfg.Backoff,
+			maxBackoff:  cfg.MaxBackoff,
+		}
+		if rule.MaxRestarts > 0 {
+			matched.maxRestarts = rule.MaxRestarts
+		}
+		if rule.Backoff > 0 {
+			matched.backoff = rule.Backoff
+		}
+		if rule.MaxBackoff > 0 {
+			matched.maxBackoff = rule.MaxBackoff
+		}
+		return matched, true
+	}
+	return remediationRule{}, false
+}
+
+// delay returns the wait before the given attempt, counting from 1: the backoff, doubled
+// for each attempt before, up to the maximum
+func (r remediationRule) delay(attempt int) time.Duration {
+	delay := r.backoff
+	for i := 1; i < attempt && delay < r.maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, r.maxBackoff)
+}
+
+// remediate restarts the failed units that match a remediation rule once their backoff
+// passed, and escalates those still failed after their last restart
+func (s *SystemdMonitorService) remediate(services []generated.SystemdUnit, now time.Time) {
+	cfg := &s.config.Remediation
+	// The collect command only reports
+	if !cfg.Enabled || oneShotMode() {
+		return
+	}
+	failed := make(map[string]bool)
+	for _, service := range services {
+		if service.Active == "failed" {
+			failed[service.Unit] = true
+		}
+	}
+
+	remediation.Lock()
+	defer remediation.Unlock()
+
+	for unit, state := range remediation.units {
+		if failed[unit] || state.restarting {
+			continue
+		}
+		if state.recoveredAt.IsZero() {
+			state.recoveredAt = now
+		}
+		if now.Sub(state.recoveredAt) >= cfg.ResetAfter {
+			delete(remediation.units, unit)
+		}
+	}
+
+	for unit := range failed {
+		rule, ok := matchRemediationRule(cfg, unit)
+		if !ok {
+			continue
+		}
+		state := remediation.units[unit]
+		switch {
+		case state == nil:
+			state = &remediationState{next: now.Add(rule.delay(1))}
+			remediation.units[unit] = state
+		case !state.recoveredAt.IsZero():
+			// Failed again before reset_after passed; the backoff carries on
+			state.recoveredAt = time.Time{}
+			state.next = now.Add(rule.delay(state.attempts + 1))
+		}
+		if state.restarting || state.escalated || now.Before(state.next) {
+			continue
+		}
+
+		if state.attempts >= rule.maxRestarts {
+			state.escalated = true
+			log.Printf("Unit %s is still failed after %d restarts, escalating", unit, state.attempts)
+			event := newRemediationEvent(remediationEscalated, unit, rule, state.attempts, now)
+			remediation.pending = append(remediation.pending, event)
+			continue
+		}
+		state.attempts++
+		state.restarting = true
+		go s.restartUnit(unit, rule, state.attempts)
+	}
+}
+
+// restartUnit runs one restart of a failed unit, records it in the action log and queues
+// its event
+func (s *SystemdMonitorService) restartUnit(unit string, rule remediationRule, attempt int) {
+	defer recoverPanic("remediation")
+	action := startRemoteAction(s.config, ActionRestartUnit)
+	action.Server, action.Requester = localRequester, remediationRequester
+	action.Args = map[string]string{"unit": unit, "rule": rule.pattern, "attempt": strconv.Itoa(attempt)}
+
+	// The restart replaces the reason for the failure, so it is read first
+	result := ""
+	if props, err := systemctlShow([]string{unit}, []string{"Id", "Result"}); err == nil {
+		result = props[unit]["Result"]
+	}
+	log.Printf("Restarting failed unit %s (attempt %d of %d)", unit, attempt, rule.maxRestarts)
+	err := restartSystemdUnit(unit, s.config.Remediation.RestartTimeout)
+	action.finish(err)
+
+	now := time.Now()
+	event := newRemediationEvent(remediationRestart, unit, rule, attempt, now)
+	event.Result = result
+	if err != nil {
+		log.Printf("Failed to restart unit %s: %v", unit, err)
+		event.Error = err.Error()
+	}
+
+	remediation.Lock()
+	defer remediation.Unlock()
+	if state := remediation.units[unit]; state != nil {
+		state.restarting = false
+		state.next = now.Add(rule.delay(attempt + 1))
+	}
+	remediation.pending = append(remediation.pending, event)
+}
+
+// restartSystemdUnit clears the failed state of a unit, including a start limit it hit,
+// and restarts it. The remediation rule bounds the restarts instead.
+func restartSystemdUnit(unit string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, args := range [][]string{{"reset-failed", "--", unit}, {"restart", "--", unit}} {
+		if _, err := execwrap.Output(ctx, execwrap.Options{Writable: true}, "systemctl", args...); err != nil {
+			return fmt.Errorf("failed to %s %s: %w", args[0], unit, err)
+		}
+	}
+	return nil
+}
+
+// newRemediationEvent returns an event about a unit under a rule
+func newRemediationEvent(kind, unit string, rule remediationRule, attempt int, at time.Time) RemediationEvent {
+	timestamp := at.UTC().Format(time.RFC3339)
+	return RemediationEvent{
+		EventID:     eventID("remediation", kind, unit, strconv.Itoa(attempt), at.UTC().Format(time.RFC3339Nano)),
+		Kind:        kind,
+		Unit:        unit,
+		Rule:        rule.pattern,
+		Attempt:     attempt,
+		MaxRestarts: rule.maxRestarts,
+		Timestamp:   timestamp,
+		Maintenance: maintenanceTag(at),
+	}
+}
+
+// reportRemediation sends the queued remediation events
+func (s *SystemdMonitorService) reportRemediation() {
+	remediation.Lock()
+	events := remediation.pending
+	remediation.pending = nil
+	remediation.Unlock()
+	if len(events) == 0 {
+		return
+	}
+
+	reqBody := RemediationEventsReport{Events: events}
+	if err := submitReport(context.Background(), s.config, http.MethodPost, hostPath(s.hostRid, "/remediation-events"), reqBody); err != nil {
+		log.Printf("Failed to report remediation events (%d queued): %v", len(events), err)
+		recordCollectorError("systemd", err)
+		remediation.Lock()
+		// Events queued while sending go after the ones that failed
+		remediation.pending = retainEvents("remediation", append(events, remediation.pending...))
+		remediation.Unlock()
+		return
+	}
+	log.Printf("Reported %d remediation events successfully", len(events))
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// remoteActionLogPath is the append-only record of actions taken at the server's request,
+// one JSON object per line. The agent never rewrites or truncates it.
+const remoteActionLogPath = "data/remote_actions.jsonl"
+
+// Remote actions the agent performs at the server's request
+const (
+	ActionApplyConfig    = "apply_config"
+	ActionPathDiagnostic = "path_diagnostic"
+	ActionThroughputTest = "throughput_test"
+)
+
+// Outcomes of a remote action
+const (
+	ActionSucceeded = "succeeded"
+	ActionFailed    = "failed"
+	// ActionRejected means the agent refused the request without acting on it
+	ActionRejected = "rejected"
+)
+
+// RemoteAction is one entry of the remote action log
+type RemoteAction struct {
+	Time time.Time `json:"time"`
+	// Server is the host of the server that issued the request
+	Server string `json:"server"`
+	// Requester is the user or automation the server attributes the request to, when it
+	// says
+	Requester string            `json:"requester,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Command   string            `json:"command"`
+	Args      map[string]string `json:"args,omitempty"`
+	Result    string            `json:"result"`
+	Error     string            `json:"error,omitempty"`
+	Duration  time.Duration     `json:"duration_ns"`
+}
+
+// remoteActionLog serializes appends so entries are never interleaved
+var remoteActionLog sync.Mutex
+
+// startRemoteAction begins an entry for a command issued by the configured server
+func startRemoteAction(cfg *config.Config, command string) *RemoteAction {
+	server := cfg.HostRegistration.SprinterURL
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		server = u.Host
+	}
+	return &RemoteAction{Time: time.Now().UTC(), Server: server, Command: command}
+}
+
+// finish completes the action with the outcome of running it and appends it to the log
+func (a *RemoteAction) finish(err error) {
+	a.Result = ActionSucceeded
+	if err != nil {
+		a.Result, a.Error = ActionFailed, err.Error()
+	}
+	a.record()
+}
+
+// reject records that the agent refused the action
+func (a *RemoteAction) reject(err error) {
+	a.Result, a.Error = ActionRejected, err.Error()
+	a.record()
+}
+
+// record appends the action to the log. Losing an entry is logged, but does not undo or
+// block the action it describes.
+func (a *RemoteAction) record() {
+	a.Duration = time.Since(a.Time)
+	log.Printf("Remote action %s requested by %s: %s", a.Command, a.requestedBy(), a.Result)
+	if err := appendRemoteAction(remoteActionLogPath, a); err != nil {
+		log.Printf("Warning: Failed to record remote action %s: %v", a.Command, err)
+	}
+}
+
+// requestedBy names who asked for the action, for log lines
+func (a *RemoteAction) requestedBy() string {
+	if a.Requester != "" {
+		return a.Requester + " via " + a.Server
+	}
+	return a.Server
+}
+
+// appendRemoteAction appends an entry to the log at path and syncs it to disk
+func appendRemoteAction(path string, a *RemoteAction) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("failed to encode remote action: %w", err)
+	}
+
+	remoteActionLog.Lock()
+	defer remoteActionLog.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create remote action log directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open remote action log: %w", err)
+	}
+	// A line cut short by a crash is ended first, so it does not swallow this entry
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			data = append([]byte{'\n'}, data...)
+		}
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write remote action log: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync remote action log: %w", err)
+	}
+	return file.Close()
+}
+
+// RemoteActions returns up to n of the most recent remote actions, oldest first, or all of
+// them when n is zero. Lines that cannot be decoded, such as one cut short by a crash,
+// are skipped.
+func RemoteActions(n int) ([]RemoteAction, error) {
+	remoteActionLog.Lock()
+	defer remoteActionLog.Unlock()
+
+	file, err := os.Open(remoteActionLogPath)
+	if os.IsNotExist(err) {
+		return []RemoteAction{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open remote action log: %w", err)
+	}
+	defer file.Close()
+
+	actions := []RemoteAction{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxRemoteDocumentSize)
+	for scanner.Scan() {
+		var action RemoteAction
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+			continue
+		}
+		actions = append(actions, action)
+		if n > 0 && len(actions) > n {
+			actions = actions[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read remote action log: %w", err)
+	}
+	return actions, nil
+}
+
+// extractRequester removes the "requested_by" key of a document and returns it
+func extractRequester(document map[string]interface{}) string {
+	requester, _ := document["requested_by"].(string)
+	delete(document, "requested_by")
+	return requester
+}
+
+// documentKeys lists the top-level keys of a document, for the action log
+func documentKeys(document map[string]interface{}) string {
+	keys := make([]string, 0, len(document))
+	for key := range document {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sprinter-agent/internal/config"
+)
+
+// maxRemoteDocumentSize bounds documents fetched from the server
+const maxRemoteDocumentSize = 4 << 20
+
+// remoteDocument is a document pulled from the server (configuration, directives, check
+// definitions) and cached on disk with its validators, so polls for an unchanged document
+// are answered with 304 Not Modified and survive agent restarts
+type remoteDocument struct {
+	apiPath   string
+	cachePath string
+
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"last_modified,omitempty"`
+	Body         json.RawMessage `json:"body,omitempty"`
+}
+
+// newRemoteDocument creates a document for an API path, loading any cached copy
+func newRemoteDocument(apiPath, name string) *remoteDocument {
+	d := &remoteDocument{
+		apiPath:   apiPath,
+		cachePath: filepath.Join("data", "cache", name+".json"),
+	}
+	if data, err := os.ReadFile(d.cachePath); err == nil {
+		// A corrupt cache is ignored and replaced by the next full fetch
+		if err := json.Unmarshal(data, d); err != nil {
+			d.ETag, d.LastModified, d.Body = "", "", nil
+		}
+	}
+	return d
+}
+
+// Fetch polls the server with conditional headers and reports whether the document changed
+func (d *remoteDocument) Fetch(ctx context.Context, cfg *config.Config) (bool, error) {
+	url := strings.TrimRight(cfg.HostRegistration.SprinterURL, "/") + d.apiPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	// Validators are only sent when there is a cached body to fall back on
+	if d.Body != nil {
+		if d.ETag != "" {
+			req.Header.Set("If-None-Match", d.ETag)
+		}
+		if d.LastModified != "" {
+			req.Header.Set("If-Modified-Since", d.LastModified)
+		}
+	}
+
+	resp, err := reportHTTPClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("request to %s failed: %w", d.apiPath, err)
+	}
+	defer func() {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, &apiStatusError{Path: d.apiPath, StatusCode: resp.StatusCode}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteDocumentSize+1))
+	if err != nil {
+		return false, fmt.Errorf("failed to read response from %s: %w", d.apiPath, err)
+	}
+	if len(body) > maxRemoteDocumentSize {
+		return false, fmt.Errorf("document at %s exceeds %d bytes", d.apiPath, maxRemoteDocumentSize)
+	}
+	if !json.Valid(body) {
+		return false, fmt.Errorf("document at %s is not valid JSON", d.apiPath)
+	}
+
+	changed := string(body) != string(d.Body)
+	d.Body = body
+	d.ETag = resp.Header.Get("ETag")
+	d.LastModified = resp.Header.Get("Last-Modified")
+	if err := d.save(); err != nil {
+		return changed, err
+	}
+	return changed, nil
+}
+
+// Decode unmarshals the cached document; it returns false when nothing was fetched yet
+func (d *remoteDocument) Decode(out interface{}) (bool, error) {
+	if d.Body == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(d.Body, out); err != nil {
+		return false, fmt.Errorf("failed to decode %s: %w", d.apiPath, err)
+	}
+	return true, nil
+}
+
+// save writes the document and its validators to the cache atomically
+func (d *remoteDocument) save() error {
+	if err := os.MkdirAll(filepath.Dir(d.cachePath), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("failed to encode cached document: %w", err)
+	}
+	tmp := d.cachePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write cached document: %w", err)
+	}
+	if err := os.Rename(tmp, d.cachePath); err != nil {
+		return fmt.Errorf("failed to replace cached document: %w", err)
+	}
+	return nil
+}
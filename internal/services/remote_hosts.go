@@ -0,0 +1,399 @@
+//go:build !minimal && !no_remote_hosts
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/execwrap"
+	"sprinter-agent/internal/generated"
+)
+
+// remoteHostRidNamespace scopes RIDs derived from remote host addresses
+var remoteHostRidNamespace = uuid.MustParse("9c3e51a2-7b4d-4f08-a6e1-2d8f0b5c9e73")
+
+// remoteScript runs on the remote host; each section starts with a marker line so a
+// missing command only empties its own section. It sticks to POSIX sh for appliances.
+const remoteScript = `echo @@uname; uname -sr 2>/dev/null
+echo @@uptime; uptime 2>/dev/null
+echo @@proc_uptime; cat /proc/uptime 2>/dev/null
+echo @@df; df -P -k 2>/dev/null
+echo @@systemctl; command -v systemctl >/dev/null 2>&1 && systemctl list-units --type=service --no-pager --no-legend --plain 2>/dev/null
+exit 0`
+
+// RemoteDisk is the usage of a filesystem mounted on a remote host
+type RemoteDisk struct {
+	Filesystem     string `json:"filesystem"`
+	MountPoint     string `json:"mount_point"`
+	TotalBytes     uint64 `json:"total_bytes"`
+	UsedBytes      uint64 `json:"used_bytes"`
+	AvailableBytes uint64 `json:"available_bytes"`
+}
+
+// RemoteHostReport is what agentless collection gathered from a remote host
+type RemoteHostReport struct {
+	CollectedBy   string       `json:"collected_by"`
+	CollectedAt   time.Time    `json:"collected_at"`
+	Kernel        string       `json:"kernel,omitempty"`
+	UptimeSeconds float64      `json:"uptime_seconds,omitempty"`
+	LoadAverage   []float64    `json:"load_average,omitempty"`
+	Disks         []RemoteDisk `json:"disks"`
+	// services is reported separately through the systemd services endpoint
+	services []generated.SystemdUnit
+	// systemd reports whether the host runs systemd
+	systemd bool
+}
+
+// RemoteHostsService monitors devices where the agent cannot be installed by running
+// commands over SSH. Each device is registered and reported as a host of its own,
+// marked agentless and attributed to this agent's host.
+type RemoteHostsService struct {
+	config   *config.Config
+	hostRid  string
+	api      *hostAPI
+	stopChan chan bool
+	started  bool
+	// registered maps the RID of each target already registered in this run
+	registered map[string]bool
+}
+
+// NewRemoteHostsService creates a new agentless collection service
+func NewRemoteHostsService(cfg *config.Config, apiClient *generated.ClientWithResponses, hostRid string) *RemoteHostsService {
+	return &RemoteHostsService{
+		config:     cfg,
+		hostRid:    hostRid,
+		api:        &hostAPI{client: apiClient},
+		stopChan:   make(chan bool),
+		registered: make(map[string]bool),
+	}
+}
+
+// init registers the collector, which needs the API client to register devices
+func init() {
+	registerCollector("remote_hosts", func(m *CollectorManager, c *config.Config) Collector {
+		if m.client == nil {
+			return nil
+		}
+		return NewRemoteHostsService(c, m.client, m.hostRid)
+	})
+}
+
+// Start begins polling the configured remote hosts
+func (s *RemoteHostsService) Start() error {
+	if !s.config.RemoteHosts.Enabled {
+		log.Println("Agentless remote host collection not enabled - skipping")
+		setCollectorStatus("remote_hosts", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping agentless remote host collection")
+		return nil
+	}
+	if len(s.config.RemoteHosts.Targets) == 0 {
+		log.Println("No remote hosts configured - skipping agentless remote host collection")
+		setCollectorStatus("remote_hosts", CollectorSkipped, "no targets configured")
+		return nil
+	}
+	if _, err := exec.LookPath("ssh"); err != nil {
+		return fmt.Errorf("ssh not found in PATH: %w", err)
+	}
+	for _, target := range s.config.RemoteHosts.Targets {
+		if target.Address == "" {
+			return fmt.Errorf("remote host %q has no address", target.Name)
+		}
+	}
+
+	go s.monitorLoop()
+	s.started = true
+
+	setCollectorStatus("remote_hosts", CollectorRunning, "")
+	log.Printf("Agentless remote host collection started for %d hosts", len(s.config.RemoteHosts.Targets))
+	return nil
+}
+
+// Stop stops polling
+func (s *RemoteHostsService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		s.started = false
+		log.Println("Agentless remote host collection stopped")
+	}
+}
+
+// monitorLoop polls every remote host per interval
+func (s *RemoteHostsService) monitorLoop() {
+	defer recoverPanic("remote_hosts")
+	ticker := newCollectorTicker("remote_hosts", s.config.RemoteHosts.Interval)
+	defer ticker.Stop()
+
+	markProgress("remote_hosts", s.config.RemoteHosts.Interval)
+	s.pollAll()
+	if finishedOnce("remote_hosts") {
+		return
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			s.pollAll()
+			markProgress("remote_hosts", s.config.RemoteHosts.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// pollAll collects from and reports every target; one failing host does not hold up the others
+func (s *RemoteHostsService) pollAll() {
+	for _, target := range s.config.RemoteHosts.Targets {
+		select {
+		case <-s.stopChan:
+			return
+		default:
+		}
+		if err := s.poll(target); err != nil {
+			log.Printf("Failed to collect from remote host %s: %v", remoteHostName(target), err)
+			recordCollectorError("remote_hosts", fmt.Errorf("%s: %w", remoteHostName(target), err))
+		}
+	}
+}
+
+// poll collects from one target and reports it as its own host. An unreachable host gets
+// no heartbeat, so the server marks it offline like any host that stopped reporting.
+func (s *RemoteHostsService) poll(target config.RemoteHostTarget) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.RemoteHosts.Timeout+30*time.Second)
+	defer cancel()
+
+	output, err := s.runSSH(ctx, target)
+	if err != nil {
+		return err
+	}
+	report := parseRemoteOutput(output)
+	report.CollectedBy = s.hostRid
+	report.CollectedAt = time.Now().UTC()
+
+	rid := remoteHostRid(target)
+	// The collect command prints the reports without registering the host
+	if sink := currentReportSink(); sink != nil {
+		if err := sink(http.MethodPut, hostPath(rid, "/remote-metrics"), report); err != nil {
+			return err
+		}
+		if report.systemd {
+			return sink(http.MethodPut, hostPath(rid, "/systemd-services"), generated.SystemdServicesRequest{Services: report.services})
+		}
+		return nil
+	}
+
+	if !s.registered[rid] {
+		if err := s.register(ctx, rid, target, report); err != nil {
+			return err
+		}
+		s.registered[rid] = true
+	}
+
+	if err := s.api.heartbeat(ctx, rid, generated.HostHeartbeatRequest{}, s.metadata(target)); err != nil {
+		return err
+	}
+	if err := sendJSON(ctx, s.config, http.MethodPut, hostPath(rid, "/remote-metrics"), report, nil); err != nil {
+		return fmt.Errorf("failed to report metrics: %w", err)
+	}
+	if report.systemd {
+		body := generated.SystemdServicesRequest{Services: report.services}
+		if err := sendJSON(ctx, s.config, http.MethodPut, hostPath(rid, "/systemd-services"), body, nil); err != nil {
+			return fmt.Errorf("failed to report systemd services: %w", err)
+		}
+	}
+	return nil
+}
+
+// register creates the pseudo-host for a target unless the server already knows it
+func (s *RemoteHostsService) register(ctx context.Context, rid string, target config.RemoteHostTarget, report *RemoteHostReport) error {
+	exists, err := s.api.exists(ctx, rid)
+	if err != nil {
+		return fmt.Errorf("failed to check host existence: %w", err)
+	}
+	if exists {
+		return nil
+	}
+
+	osName, osVersion, _ := strings.Cut(report.Kernel, " ")
+	body := generated.HostCreateRequest{
+		HostRid:   generated.HostRid(rid),
+		Hostname:  remoteHostName(target),
+		IpAddress: target.Address,
+		OsName:    osName,
+		OsVersion: osVersion,
+	}
+	serverRid, err := s.api.create(ctx, body, s.metadata(target), enrollmentToken(s.config))
+	if err != nil {
+		return fmt.Errorf("failed to register remote host: %w", err)
+	}
+	if serverRid != rid {
+		// The RID must stay derived from the address, so the host is found again after a restart
+		return fmt.Errorf("server assigned RID %s instead of %s", serverRid, rid)
+	}
+	log.Printf("Registered remote host %s with RID: %s", remoteHostName(target), rid)
+	return nil
+}
+
+// metadata marks the host as agentless and attributes it to this agent
+func (s *RemoteHostsService) metadata(target config.RemoteHostTarget) generated.RequestEditorFn {
+	fields := map[string]interface{}{
+		"agentless":    true,
+		"collected_by": s.hostRid,
+	}
+	if len(target.Labels) > 0 {
+		fields["labels"] = target.Labels
+	}
+	if s.config.Environment != "" {
+		fields["environment"] = s.config.Environment
+	}
+	if s.config.Team != "" {
+		fields["team"] = s.config.Team
+	}
+	return mergeJSONBody(fields)
+}
+
+// runSSH runs the collection script on the target with the system ssh client. Batch mode
+// fails instead of prompting, and host keys must already be known.
+func (s *RemoteHostsService) runSSH(ctx context.Context, target config.RemoteHostTarget) (string, error) {
+	cfg := s.config.RemoteHosts
+	args := []string{
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "ConnectTimeout=" + strconv.Itoa(int(cfg.Timeout/time.Second)),
+	}
+	if cfg.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+cfg.KnownHostsFile)
+	}
+	identityFile := target.IdentityFile
+	if identityFile == "" {
+		identityFile = cfg.IdentityFile
+	}
+	if identityFile != "" {
+		args = append(args, "-i", identityFile, "-o", "IdentitiesOnly=yes")
+	}
+	if target.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(target.Port))
+	}
+	destination := target.Address
+	if user := target.User; user != "" {
+		destination = user + "@" + destination
+	} else if cfg.User != "" {
+		destination = cfg.User + "@" + destination
+	}
+	args = append(args, "--", destination, remoteScript)
+
+	output, err := execwrap.Output(ctx, execwrap.Options{}, "ssh", args...)
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
+// remoteHostRid derives a target's RID from its address, so it keeps reporting as the
+// same host when the agent's state is lost or another agent takes over collection
+func remoteHostRid(target config.RemoteHostTarget) string {
+	return uuid.NewSHA1(remoteHostRidNamespace, []byte(target.Address)).String()
+}
+
+// remoteHostName is the hostname a target is registered with
+func remoteHostName(target config.RemoteHostTarget) string {
+	if target.Name != "" {
+		return target.Name
+	}
+	return target.Address
+}
+
+// parseRemoteOutput splits the collection script's output into its sections
+func parseRemoteOutput(output string) *RemoteHostReport {
+	sections := make(map[string][]string)
+	section := ""
+	for _, line := range strings.Split(output, "\n") {
+		if name, ok := strings.CutPrefix(line, "@@"); ok {
+			section = strings.TrimSpace(name)
+			sections[section] = []string{}
+			continue
+		}
+		if section != "" && strings.TrimSpace(line) != "" {
+			sections[section] = append(sections[section], line)
+		}
+	}
+
+	report := &RemoteHostReport{Disks: []RemoteDisk{}}
+	if lines := sections["uname"]; len(lines) > 0 {
+		report.Kernel = strings.TrimSpace(lines[0])
+	}
+	if lines := sections["uptime"]; len(lines) > 0 {
+		report.LoadAverage = parseUptimeLoad(lines[0])
+	}
+	if lines := sections["proc_uptime"]; len(lines) > 0 {
+		if fields := strings.Fields(lines[0]); len(fields) > 0 {
+			report.UptimeSeconds, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+	report.Disks = parseDF(sections["df"])
+	if lines, ok := sections["systemctl"]; ok && len(lines) > 0 {
+		report.systemd = true
+		report.services = parseSystemctlUnits(strings.Join(lines, "\n"))
+	}
+	return report
+}
+
+// parseUptimeLoad reads the load averages from uptime output, such as
+// "load average: 0.08, 0.03, 0.01" on Linux or "load averages: 1.20 1.31 1.42" on BSD
+func parseUptimeLoad(line string) []float64 {
+	idx := strings.Index(line, "load average")
+	if idx < 0 {
+		return nil
+	}
+	_, values, ok := strings.Cut(line[idx:], ":")
+	if !ok {
+		return nil
+	}
+	var loads []float64
+	for _, field := range strings.Fields(strings.ReplaceAll(values, ",", " ")) {
+		load, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil
+		}
+		loads = append(loads, load)
+	}
+	return loads
+}
+
+// parseDF parses POSIX df -P -k output, skipping the header
+func parseDF(lines []string) []RemoteDisk {
+	disks := []RemoteDisk{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[0] == "Filesystem" {
+			continue
+		}
+		total, err1 := strconv.ParseUint(fields[1], 10, 64)
+		used, err2 := strconv.ParseUint(fields[2], 10, 64)
+		available, err3 := strconv.ParseUint(fields[3], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		disks = append(disks, RemoteDisk{
+			Filesystem: fields[0],
+			// Mount points may contain spaces
+			MountPoint:     strings.Join(fields[5:], " "),
+			TotalBytes:     total * 1024,
+			UsedBytes:      used * 1024,
+			AvailableBytes: available * 1024,
+		})
+	}
+	return disks
+}
@@ -0,0 +1,423 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// bulkItem is one collector request carried inside a bulk report
+type bulkItem struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	// IdempotencyKey is the key the request would carry when sent on its own
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	class    dataClass
+	queuedAt time.Time
+	result   chan error
+	// abandoned is set when the collector stopped waiting, so the request is not sent
+	abandoned atomic.Bool
+}
+
+// BulkReport combines the collector requests of one flush interval
+type BulkReport struct {
+	Items []*bulkItem `json:"items"`
+}
+
+// BulkResult is the server's outcome for a single item, in request order
+type BulkResult struct {
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BulkResponse is the server's reply to a bulk report
+type BulkResponse struct {
+	Results []BulkResult `json:"results"`
+}
+
+// activeReporter is the running bulk reporter collectors hand their requests to, if any
+var activeReporter struct {
+	sync.Mutex
+	reporter *BulkReporter
+}
+
+// ReportSink receives collector reports in place of the server
+type ReportSink func(method, path string, body interface{}) error
+
+// activeSink is the sink set with SetReportSink, if any
+var activeSink struct {
+	sync.Mutex
+	sink ReportSink
+}
+
+// SetReportSink hands every collector report to sink instead of sending it, so the collect
+// command can print them; nil sends them again
+func SetReportSink(sink ReportSink) {
+	activeSink.Lock()
+	defer activeSink.Unlock()
+	activeSink.sink = sink
+}
+
+// currentReportSink returns the sink set with SetReportSink, or nil
+func currentReportSink() ReportSink {
+	activeSink.Lock()
+	defer activeSink.Unlock()
+	return activeSink.sink
+}
+
+// submitReport sends a collector request, through the bulk reporter when one is running; it
+// blocks until the request was delivered so collectors only advance cursors on success
+func submitReport(ctx context.Context, cfg *config.Config, method, path string, body interface{}) error {
+	if sink := currentReportSink(); sink != nil {
+		return sink(method, path, body)
+	}
+	// Encoded once, for the bandwidth budget and then for sending
+	if body != nil {
+		data, err := encodeBody(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request body: %w", err)
+		}
+		// A shed report counts as delivered; what was shed is reported in self-metrics
+		if !reportBandwidth().admit(&cfg.Bandwidth, path, int64(len(data)), time.Now()) {
+			return nil
+		}
+		body = json.RawMessage(data)
+	}
+	var err error
+	// The broker acknowledges each message, so batching gains nothing
+	publisher := currentMQTT()
+	if publisher != nil {
+		err = publisher.publish(mqttKind(publisher.hostRid, path), method, path, body)
+	} else {
+		activeReporter.Lock()
+		reporter := activeReporter.reporter
+		activeReporter.Unlock()
+
+		if reporter == nil {
+			err = sendJSON(ctx, cfg, method, path, body, nil)
+		} else {
+			err = reporter.enqueue(ctx, method, path, body)
+		}
+	}
+	recordSample(method, path, body, err)
+	// Buffered reports are replayed over HTTPS, so only reports sent that way are buffered
+	if buffer := currentBuffer(); buffer != nil && publisher == nil {
+		return buffer.settle(method, path, body, err)
+	}
+	return err
+}
+
+// jsonAppender is a report that encodes itself without reflection, such as host metrics
+type jsonAppender interface {
+	appendJSON(b []byte) ([]byte, error)
+}
+
+// reportBuffers are the buffers reports are encoded into, so frequent reports do not grow
+// a new buffer each time
+var reportBuffers = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// maxPooledBuffer bounds the buffers kept in reportBuffers, so one huge report does not
+// hold its memory for good
+const maxPooledBuffer = 1 << 20
+
+// encodeBody encodes a request body as JSON. A body encoded already is returned as it is,
+// since encoding it again would only copy it.
+func encodeBody(body interface{}) ([]byte, error) {
+	switch body := body.(type) {
+	case json.RawMessage:
+		return body, nil
+	case jsonAppender:
+		buf := reportBuffers.Get().(*[]byte)
+		encoded, err := body.appendJSON((*buf)[:0])
+		// The encoded body outlives the call, so it is copied out of the pooled buffer
+		var data []byte
+		if err == nil {
+			data = make([]byte, len(encoded))
+			copy(data, encoded)
+		}
+		if cap(encoded) <= maxPooledBuffer {
+			*buf = encoded
+			reportBuffers.Put(buf)
+		}
+		return data, err
+	}
+	return json.Marshal(body)
+}
+
+// flushReports sends everything the bulk reporter has queued without waiting for its
+// interval, unless the server asks agents to back off
+func flushReports() {
+	activeReporter.Lock()
+	reporter := activeReporter.reporter
+	activeReporter.Unlock()
+
+	if reporter == nil {
+		return
+	}
+	for reporter.flush() {
+	}
+}
+
+// bulkReportingActive reports whether collector requests currently go through a bulk reporter
+func bulkReportingActive() bool {
+	activeReporter.Lock()
+	defer activeReporter.Unlock()
+	return activeReporter.reporter != nil
+}
+
+// QueuedReports returns how many collector reports wait for the next bulk flush
+func QueuedReports() int {
+	activeReporter.Lock()
+	reporter := activeReporter.reporter
+	activeReporter.Unlock()
+
+	if reporter == nil {
+		return 0
+	}
+	reporter.mu.Lock()
+	defer reporter.mu.Unlock()
+	return len(reporter.pending)
+}
+
+// maxHeldWait bounds how long a request waits in the queue while the server asks agents to
+// back off; it then fails and its collector retries at its next interval, well before the
+// supervisor would take the waiting collector for stalled
+const maxHeldWait = 2 * time.Minute
+
+// BulkReporter flushes all queued collector requests as one request per interval instead
+// of each collector making its own calls
+type BulkReporter struct {
+	config   *config.Config
+	hostRid  string
+	mu       sync.Mutex
+	pending  []*bulkItem
+	closed   bool
+	stopChan chan bool
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewBulkReporter creates a new bulk reporter
+func NewBulkReporter(cfg *config.Config, hostRid string) *BulkReporter {
+	return &BulkReporter{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start begins the flush loop and routes collector requests through it
+func (r *BulkReporter) Start() error {
+	if !r.config.Reporting.Bulk {
+		log.Println("Bulk reporting not enabled - collectors report individually")
+		close(r.done)
+		return nil
+	}
+	if r.hostRid == "" {
+		log.Println("Host RID not set - skipping bulk reporting")
+		close(r.done)
+		return nil
+	}
+
+	activeReporter.Lock()
+	activeReporter.reporter = r
+	activeReporter.Unlock()
+
+	go r.flushLoop()
+
+	log.Printf("Bulk reporting started, flushing every %s", r.config.Reporting.FlushInterval)
+	return nil
+}
+
+// Stop flushes what is queued and returns collectors to individual requests
+func (r *BulkReporter) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stopChan)
+		<-r.done
+	})
+}
+
+// enqueue queues a request for the next flush and waits for its outcome
+func (r *BulkReporter) enqueue(ctx context.Context, method, path string, body interface{}) error {
+	item := &bulkItem{Method: method, Path: path, class: routeOf(path).class, queuedAt: time.Now(), result: make(chan error, 1)}
+	if body != nil {
+		data, err := encodeBody(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request body: %w", err)
+		}
+		item.Body = data
+	}
+	item.IdempotencyKey = idempotencyKey(method, path, item.Body)
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return sendJSON(ctx, r.config, method, path, body, nil)
+	}
+	r.pending = append(r.pending, item)
+	r.mu.Unlock()
+
+	select {
+	case err := <-item.result:
+		return err
+	case <-ctx.Done():
+		item.abandoned.Store(true)
+		return ctx.Err()
+	}
+}
+
+// flushLoop sends the queued requests every flush interval
+func (r *BulkReporter) flushLoop() {
+	defer recoverPanic("reporter")
+	defer close(r.done)
+
+	ticker := newReportTicker(r.config.Reporting.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.flush()
+		case <-r.stopChan:
+			r.disable()
+			r.mu.Lock()
+			r.closed = true
+			r.mu.Unlock()
+			r.flush()
+			log.Println("Bulk reporting stopped")
+			return
+		}
+	}
+}
+
+// flush sends the queued requests as one bulk report, highest priority first and up to
+// max_flush_kb, and reports whether requests are left for the next flush. While the server
+// asks agents to back off, requests stay queued for up to maxHeldWait rather than fail, so
+// once it takes reports again events go before metrics, logs and inventory.
+func (r *BulkReporter) flush() bool {
+	r.mu.Lock()
+	if wait := serverBackpressure.remaining(); wait > 0 && !r.closed {
+		expired := r.expire(time.Now().Add(-maxHeldWait))
+		r.mu.Unlock()
+		for _, item := range expired {
+			item.result <- fmt.Errorf("%w, next attempt in %s", errBackpressure, wait.Round(time.Second))
+		}
+		return false
+	}
+	limit := r.config.Reporting.MaxFlushKB * 1024 / serverBackpressure.currentFactor()
+	if r.closed {
+		limit = 0
+	}
+	items := r.take(limit)
+	more := len(r.pending) > 0
+	r.mu.Unlock()
+
+	if len(items) == 0 {
+		return more
+	}
+
+	var resp BulkResponse
+	ctx := context.Background()
+	err := sendJSON(ctx, r.config, http.MethodPost, hostPath(r.hostRid, "/bulk"), BulkReport{Items: items}, &resp)
+	if err != nil {
+		var statusErr *apiStatusError
+		if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusNotImplemented) {
+			log.Println("Server does not support bulk reports - collectors report individually")
+			r.disable()
+			r.sendIndividually(items)
+			return more
+		}
+		for _, item := range items {
+			item.result <- err
+		}
+		return more
+	}
+
+	for i, item := range items {
+		if i >= len(resp.Results) {
+			item.result <- nil
+			continue
+		}
+		result := resp.Results[i]
+		if result.Status != 0 && (result.Status < 200 || result.Status >= 300) {
+			item.result <- &apiStatusError{Path: item.Path, StatusCode: result.Status}
+			continue
+		}
+		item.result <- nil
+	}
+	return more
+}
+
+// expire removes the requests queued before cutoff from the queue
+func (r *BulkReporter) expire(cutoff time.Time) []*bulkItem {
+	var expired []*bulkItem
+	pending := r.pending[:0]
+	for _, item := range r.pending {
+		if item.queuedAt.Before(cutoff) {
+			expired = append(expired, item)
+		} else {
+			pending = append(pending, item)
+		}
+	}
+	r.pending = pending
+	return expired
+}
+
+// take removes the requests of the next flush from the queue: the highest-priority ones,
+// oldest first within a class, up to limit bytes of bodies and at least one. A limit of 0
+// takes every request.
+func (r *BulkReporter) take(limit int) []*bulkItem {
+	pending := r.pending[:0]
+	for _, item := range r.pending {
+		if !item.abandoned.Load() {
+			pending = append(pending, item)
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].class > pending[j].class })
+
+	n, size := len(pending), 0
+	if limit > 0 {
+		for n = 0; n < len(pending); n++ {
+			size += len(pending[n].Body)
+			if n > 0 && size > limit {
+				break
+			}
+		}
+	}
+	items := pending[:n:n]
+	r.pending = append([]*bulkItem(nil), pending[n:]...)
+	return items
+}
+
+// disable stops routing new requests through this reporter
+func (r *BulkReporter) disable() {
+	activeReporter.Lock()
+	if activeReporter.reporter == r {
+		activeReporter.reporter = nil
+	}
+	activeReporter.Unlock()
+}
+
+// sendIndividually delivers queued requests one by one
+func (r *BulkReporter) sendIndividually(items []*bulkItem) {
+	ctx := context.Background()
+	for _, item := range items {
+		var body interface{}
+		if item.Body != nil {
+			body = item.Body
+		}
+		item.result <- sendJSON(ctx, r.config, item.Method, item.Path, body, nil)
+	}
+}
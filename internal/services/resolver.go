@@ -0,0 +1,321 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// dohContentType is the media type of DNS messages sent over HTTPS (RFC 8484)
+const dohContentType = "application/dns-message"
+
+// maxDNSMessage is the largest DNS message, bounded by its two-byte length prefix
+const maxDNSMessage = 65535
+
+// DNSStats are counters of lookups through the configured resolvers, reported in self-metrics
+type DNSStats struct {
+	Lookups uint64 `json:"lookups"`
+	Errors  uint64 `json:"errors"`
+	// Fallbacks counts lookups the system resolver answered after the configured ones failed
+	Fallbacks uint64 `json:"fallbacks"`
+}
+
+var dnsStats struct {
+	lookups, errors, fallbacks atomic.Uint64
+}
+
+// currentDNSStats returns the lookup counters, or nil when the system resolver is used
+func currentDNSStats() *DNSStats {
+	if agentResolver == nil {
+		return nil
+	}
+	return &DNSStats{
+		Lookups:   dnsStats.lookups.Load(),
+		Errors:    dnsStats.errors.Load(),
+		Fallbacks: dnsStats.fallbacks.Load(),
+	}
+}
+
+// customResolver resolves names with the configured servers or DoH endpoint
+type customResolver struct {
+	resolver *net.Resolver
+	timeout  time.Duration
+	fallback bool
+	// description names the resolvers for logs and the doctor command
+	description string
+}
+
+// agentResolver is set by ConfigureResolver before any connection is made; nil means the
+// system resolver
+var agentResolver *customResolver
+
+// ConfigureResolver makes the agent's connections to the server and broker resolve names
+// with the configured DNS servers or DoH endpoint
+func ConfigureResolver(cfg *config.Config) {
+	dns := cfg.DNS
+	if len(dns.Servers) == 0 && dns.DoHURL == "" {
+		agentResolver = nil
+		return
+	}
+
+	var servers *net.Resolver
+	if len(dns.Servers) > 0 {
+		servers = serverResolver(dns.Servers)
+	}
+	r := &customResolver{resolver: servers, timeout: dns.Timeout, fallback: dns.Fallback}
+	if dns.DoHURL != "" {
+		r.resolver = dohResolver(dns.DoHURL, servers)
+		r.description = "DNS over HTTPS at " + dns.DoHURL
+	} else {
+		r.description = "DNS servers " + strings.Join(dns.Servers, ", ")
+	}
+	agentResolver = r
+	log.Printf("Resolving server names with %s", r.description)
+}
+
+// ResolverDescription names the resolvers the agent uses, for the doctor command
+func ResolverDescription() string {
+	if agentResolver == nil {
+		return "the system resolver"
+	}
+	return agentResolver.description
+}
+
+// LookupHost resolves host with the configured resolvers, falling back to the system
+// resolver when that is allowed
+func LookupHost(ctx context.Context, host string) ([]string, error) {
+	r := agentResolver
+	if r == nil {
+		return net.DefaultResolver.LookupHost(ctx, host)
+	}
+
+	dnsStats.lookups.Add(1)
+	lookupCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	addrs, err := r.resolver.LookupHost(lookupCtx, host)
+	cancel()
+	if err == nil {
+		return addrs, nil
+	}
+	dnsStats.errors.Add(1)
+	if r.fallback {
+		if fallback, fallbackErr := net.DefaultResolver.LookupHost(ctx, host); fallbackErr == nil {
+			dnsStats.fallbacks.Add(1)
+			log.Printf("Warning: %s failed to resolve %s, used the system resolver: %v", r.description, host, err)
+			return fallback, nil
+		}
+	}
+	return nil, err
+}
+
+// dialResolved dials address, resolving its host with LookupHost and trying each of its
+// addresses in turn
+func dialResolved(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || agentResolver == nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	addrs, err := LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// DialServer dials the server, the proxy in front of it or the broker, resolving names
+// with the configured resolvers
+func DialServer(ctx context.Context, network, address string) (net.Conn, error) {
+	return dialResolved(ctx, apiDialer, network, address)
+}
+
+// serverResolver returns a resolver that sends its queries to servers, in turn, instead of
+// the nameservers in /etc/resolv.conf
+func serverResolver(servers []string) *net.Resolver {
+	addrs := make([]string, len(servers))
+	for i, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		addrs[i] = server
+	}
+	var next atomic.Uint32
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			server := addrs[int(next.Add(1)-1)%len(addrs)]
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// dohResolver returns a resolver that sends its queries to a DoH endpoint. The endpoint's
+// own host name is resolved with bootstrap, or the system resolver when it is nil.
+func dohResolver(endpoint string, bootstrap *net.Resolver) *net.Resolver {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second, Resolver: bootstrap}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     apiIdleConnTimeout,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     restrictTLS(&tls.Config{MinVersion: tls.VersionTLS12}),
+		},
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return &dohConn{ctx: ctx, client: client, endpoint: endpoint}, nil
+		},
+	}
+}
+
+// dohConn carries the Go resolver's queries over HTTPS. It is a stream connection, so the
+// resolver frames each message with a two-byte length, as over TCP; every query written
+// is posted to the endpoint when its answer is read.
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	endpoint string
+	deadline time.Time
+	queries  bytes.Buffer
+	answers  bytes.Buffer
+}
+
+// Read returns answers, posting the queries written so far when none are waiting
+func (c *dohConn) Read(b []byte) (int, error) {
+	for c.answers.Len() == 0 {
+		query, ok := c.nextQuery()
+		if !ok {
+			return 0, io.EOF
+		}
+		answer, err := c.exchange(query)
+		if err != nil {
+			return 0, err
+		}
+		c.answers.Write(binary.BigEndian.AppendUint16(nil, uint16(len(answer))))
+		c.answers.Write(answer)
+	}
+	return c.answers.Read(b)
+}
+
+// nextQuery takes the next complete query from what was written
+func (c *dohConn) nextQuery() ([]byte, bool) {
+	data := c.queries.Bytes()
+	if len(data) < 2 {
+		return nil, false
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+n {
+		return nil, false
+	}
+	query := append([]byte(nil), data[2:2+n]...)
+	c.queries.Next(2 + n)
+	return query, true
+}
+
+// exchange posts a query to the endpoint and returns its answer
+func (c *dohConn) exchange(query []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS query failed with status: %d", resp.StatusCode)
+	}
+	if mediaType := resp.Header.Get("Content-Type"); !strings.HasPrefix(mediaType, dohContentType) {
+		return nil, fmt.Errorf("DNS over HTTPS endpoint answered with %q instead of %s", mediaType, dohContentType)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessage+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) > maxDNSMessage {
+		return nil, errors.New("DNS over HTTPS answer is larger than a DNS message")
+	}
+	return answer, nil
+}
+
+// Write buffers queries until their answers are read
+func (c *dohConn) Write(b []byte) (int, error) {
+	return c.queries.Write(b)
+}
+
+// Close implements net.Conn; queries are posted on shared connections, so there is
+// nothing to close
+func (c *dohConn) Close() error {
+	return nil
+}
+
+// LocalAddr implements net.Conn
+func (c *dohConn) LocalAddr() net.Addr {
+	return dohAddr(c.endpoint)
+}
+
+// RemoteAddr implements net.Conn
+func (c *dohConn) RemoteAddr() net.Addr {
+	return dohAddr(c.endpoint)
+}
+
+// SetDeadline bounds the queries posted after it
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+// SetReadDeadline bounds the queries posted after it
+func (c *dohConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn; writes only buffer
+func (c *dohConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// dohAddr is the address of a DoH endpoint
+type dohAddr string
+
+// Network implements net.Addr
+func (a dohAddr) Network() string { return "https" }
+
+// String implements net.Addr
+func (a dohAddr) String() string { return string(a) }
@@ -0,0 +1,56 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Rollout stages a fleet-wide change: a host applies it only when its bucket falls within
+// Percentage, or once After has passed, so a bad change reaches a canary group first
+type Rollout struct {
+	// ID names the change; buckets are derived from it so each rollout picks different canaries
+	ID string `json:"id"`
+	// Percentage of hosts (0-100) that apply the change right away; nil means all hosts
+	Percentage *float64 `json:"percentage,omitempty"`
+	// After is when every host applies the change regardless of its bucket
+	After *time.Time `json:"after,omitempty"`
+}
+
+// Eligible reports whether the change applies to the host at the given time
+func (r *Rollout) Eligible(hostRid string, now time.Time) bool {
+	if r.After != nil && !now.Before(*r.After) {
+		return true
+	}
+	if r.Percentage == nil {
+		return r.After == nil
+	}
+	return rolloutBucket(r.ID, hostRid) < *r.Percentage
+}
+
+// rolloutBucket maps a host to a stable position in [0, 100) for a rollout
+func rolloutBucket(rolloutID, hostRid string) float64 {
+	sum := sha256.Sum256([]byte(rolloutID + "/" + hostRid))
+	return float64(binary.BigEndian.Uint64(sum[:8])%10000) / 100
+}
+
+// extractRollout removes and decodes the "rollout" key of a document, if present
+func extractRollout(document map[string]interface{}) (*Rollout, error) {
+	raw, ok := document["rollout"]
+	if !ok {
+		return nil, nil
+	}
+	delete(document, "rollout")
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rollout: %w", err)
+	}
+	var rollout Rollout
+	if err := json.Unmarshal(data, &rollout); err != nil {
+		return nil, fmt.Errorf("invalid rollout: %w", err)
+	}
+	return &rollout, nil
+}
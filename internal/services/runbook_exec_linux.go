@@ -0,0 +1,78 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+
+	"sprinter-agent/internal/config"
+)
+
+// runbookGate holds a script with resource limits until the agent has applied them, then
+// runs it in place of the shell; the limits are in force before any of its own code runs.
+// Without the go-ahead on fd 3 the script never runs.
+const runbookGate = `read -r _ <&3 || exit 126; exec 3<&-; exec "$0" "$@"`
+
+// startRunbook starts the script in its own process group, so a timeout kills everything
+// it started and not just the script, with its memory and CPU limits applied
+func startRunbook(cmd *exec.Cmd, script config.RunbookScript) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	if script.MaxMemoryMB == 0 && script.MaxCPUSeconds == 0 {
+		return cmd.Start()
+	}
+
+	gate, release, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create pipe: %w", err)
+	}
+	defer release.Close()
+	cmd.Path = "/bin/sh"
+	cmd.Args = append([]string{"/bin/sh", "-c", runbookGate, script.Path}, script.Args...)
+	cmd.ExtraFiles = []*os.File{gate}
+	err = cmd.Start()
+	gate.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := limitRunbook(cmd.Process.Pid, script); err != nil {
+		return fmt.Errorf("failed to apply resource limits: %w", err)
+	}
+	if _, err := release.Write([]byte("\n")); err != nil {
+		return fmt.Errorf("failed to release runbook: %w", err)
+	}
+	return nil
+}
+
+// limitRunbook applies a script's memory and CPU limits to its process; children it
+// starts inherit them
+func limitRunbook(pid int, script config.RunbookScript) error {
+	if script.MaxMemoryMB > 0 {
+		bytes := uint64(script.MaxMemoryMB) << 20
+		if err := prlimit(pid, syscall.RLIMIT_AS, syscall.Rlimit{Cur: bytes, Max: bytes}); err != nil {
+			return err
+		}
+	}
+	if script.MaxCPUSeconds > 0 {
+		// SIGXCPU at the soft limit lets the script clean up before SIGKILL at the hard one
+		seconds := uint64(script.MaxCPUSeconds)
+		if err := prlimit(pid, syscall.RLIMIT_CPU, syscall.Rlimit{Cur: seconds, Max: seconds + 5}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prlimit sets a resource limit of another process
+func prlimit(pid, resource int, limit syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
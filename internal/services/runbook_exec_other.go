@@ -0,0 +1,19 @@
+//go:build !linux
+
+package services
+
+import (
+	"errors"
+	"os/exec"
+
+	"sprinter-agent/internal/config"
+)
+
+// startRunbook starts the script; outside Linux a timeout kills the script itself, and
+// scripts with resource limits are refused since the limits cannot be enforced
+func startRunbook(cmd *exec.Cmd, script config.RunbookScript) error {
+	if script.MaxMemoryMB > 0 || script.MaxCPUSeconds > 0 {
+		return errors.New("runbook resource limits are only supported on Linux")
+	}
+	return cmd.Start()
+}
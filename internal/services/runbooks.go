@@ -0,0 +1,331 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/execwrap"
+)
+
+// runbookWaitDelay bounds how long a killed runbook's children may hold its output open
+const runbookWaitDelay = 5 * time.Second
+
+// ActionRunbook is the remote action of running a runbook
+const ActionRunbook = "runbook"
+
+// runbookRequest is a runbook run the server asks for. It only names a registered
+// runbook; what runs and with which arguments is fixed by the local configuration.
+type runbookRequest struct {
+	ID      string `json:"id"`
+	Runbook string `json:"runbook"`
+	// RequestedBy is the user or automation that asked for the run
+	RequestedBy string `json:"requested_by,omitempty"`
+}
+
+// RunbookResult is the outcome of a runbook run, uploaded to the server
+type RunbookResult struct {
+	RequestID string        `json:"request_id"`
+	Runbook   string        `json:"runbook"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration_ns"`
+	// ExitCode is -1 when the script did not run or was killed
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	// Truncated is set when output beyond max_output_kb was dropped
+	Truncated bool   `json:"truncated,omitempty"`
+	TimedOut  bool   `json:"timed_out,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// RunbookService runs locally registered scripts at the server's request and uploads
+// their output
+type RunbookService struct {
+	config   *config.Config
+	hostRid  string
+	stopChan chan bool
+	started  bool
+
+	mu sync.Mutex
+	// running holds the runbooks being run; a runbook never runs twice at once
+	running map[string]bool
+	runs    sync.WaitGroup
+
+	// requests remembers the runbook requests between polls
+	requests commandInbox
+}
+
+// NewRunbookService creates a new runbook service
+func NewRunbookService(cfg *config.Config, hostRid string) *RunbookService {
+	return &RunbookService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+		running:  make(map[string]bool),
+	}
+}
+
+// Start begins polling the server for runbook requests
+func (s *RunbookService) Start() error {
+	if !s.config.Runbooks.Enabled {
+		log.Println("Runbooks not enabled - skipping")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping runbooks")
+		return nil
+	}
+
+	s.started = true
+	go s.pollLoop()
+
+	log.Printf("Runbooks started for host RID: %s (%d registered)", s.hostRid, len(s.config.Runbooks.Scripts))
+	return nil
+}
+
+// Stop stops polling and waits for running runbooks, which are bounded by their timeouts
+func (s *RunbookService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		s.runs.Wait()
+		log.Println("Runbooks stopped")
+	}
+}
+
+// pollLoop checks for runbook requests at the configured interval
+func (s *RunbookService) pollLoop() {
+	defer recoverPanic("runbooks")
+	ticker := newReportTicker(s.config.Runbooks.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.poll()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// poll starts the runbooks the server requested
+func (s *RunbookService) poll() {
+	ctx, cancel := context.WithTimeout(context.Background(), apiRequestTimeout)
+	var items []json.RawMessage
+	err := sendJSON(ctx, s.config, http.MethodGet, hostPath(s.hostRid, "/runbooks/requests"), nil, &items)
+	cancel()
+
+	var statusErr *apiStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		// Servers without runbooks
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to fetch runbook requests: %v", err)
+		return
+	}
+
+	verifier, err := newCommandVerifier(s.config, s.hostRid)
+	if err != nil {
+		log.Printf("Cannot verify runbook requests: %v", err)
+		return
+	}
+	receiveCommands(&s.requests, verifier, items, runbookRequest.id, s.rejectUnverified, func(request runbookRequest) bool {
+		s.start(request)
+		return true
+	})
+}
+
+// id returns the request ID
+func (r runbookRequest) id() string { return r.ID }
+
+// rejectUnverified reports a runbook request that is malformed or fails signature checks.
+// It is described by what it claims to be, which cannot be trusted.
+func (s *RunbookService) rejectUnverified(item json.RawMessage, err error) {
+	var claimed runbookRequest
+	json.Unmarshal(unverifiedPayload(item), &claimed)
+	log.Printf("Rejected runbook request %q: %v", claimed.ID, err)
+
+	action := startRemoteAction(s.config, ActionRunbook)
+	action.RequestID, action.Requester = claimed.ID, claimed.RequestedBy
+	action.Args = map[string]string{"runbook": claimed.Runbook}
+	action.reject(err)
+	raiseHealthEvent(healthCommandRejected, severityError, "runbooks", err.Error(), map[string]interface{}{
+		"request_id": claimed.ID,
+	})
+}
+
+// start runs a verified request in the background, or refuses it when the runbook is
+// unknown or unsafe, already running, or no slot is free. A refused request gets a result too, so
+// the server can tell the user.
+func (s *RunbookService) start(request runbookRequest) {
+	action := startRemoteAction(s.config, ActionRunbook)
+	action.RequestID, action.Requester = request.ID, request.RequestedBy
+	action.Args = map[string]string{"runbook": request.Runbook}
+	result := &RunbookResult{RequestID: request.ID, Runbook: request.Runbook, StartedAt: time.Now(), ExitCode: -1}
+
+	script, ok := s.config.Runbooks.Scripts[request.Runbook]
+	if !ok {
+		s.refuse(action, result, fmt.Errorf("no runbook named %q is registered", request.Runbook))
+		return
+	}
+	if err := checkTrustedFile(script.Path); err != nil {
+		s.refuse(action, result, err)
+		return
+	}
+	s.mu.Lock()
+	busy := len(s.running) >= s.config.Runbooks.MaxConcurrent
+	already := s.running[request.Runbook]
+	if !busy && !already {
+		s.running[request.Runbook] = true
+	}
+	s.mu.Unlock()
+	if already {
+		s.refuse(action, result, fmt.Errorf("runbook %s is already running", request.Runbook))
+		return
+	}
+	if busy {
+		s.refuse(action, result, fmt.Errorf("%d runbooks are already running", s.config.Runbooks.MaxConcurrent))
+		return
+	}
+
+	log.Printf("Running runbook %s for request %s", request.Runbook, request.ID)
+	s.runs.Add(1)
+	go func() {
+		defer s.runs.Done()
+		defer recoverPanic("runbooks")
+		defer func() {
+			s.mu.Lock()
+			delete(s.running, request.Runbook)
+			s.mu.Unlock()
+		}()
+
+		err := s.run(script, request, result)
+		// A runbook may have installed packages or changed anything else queries cache
+		invalidateQueries()
+		if err != nil {
+			result.Error = err.Error()
+			log.Printf("Runbook %s failed: %v", request.Runbook, err)
+		}
+		action.finish(err)
+		s.upload(result)
+	}()
+}
+
+// refuse records and uploads a request the agent will not run
+func (s *RunbookService) refuse(action *RemoteAction, result *RunbookResult, err error) {
+	log.Printf("Refused runbook request %s: %v", result.RequestID, err)
+	result.Error = err.Error()
+	action.reject(err)
+	s.upload(result)
+}
+
+// run runs a script with its timeout and resource limits, capturing its output into the
+// result
+func (s *RunbookService) run(script config.RunbookScript, request runbookRequest, result *RunbookResult) error {
+	timeout := script.Timeout
+	if timeout == 0 {
+		timeout = s.config.Runbooks.Timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	limit := s.config.Runbooks.MaxOutputKB << 10
+	stdout, stderr := &cappedBuffer{limit: limit}, &cappedBuffer{limit: limit}
+	env := []string{"RUNBOOK_NAME=" + request.Runbook, "RUNBOOK_REQUEST_ID=" + request.ID}
+	cmd, cancelCmd := execwrap.Command(ctx, execwrap.Options{Env: env, Writable: true}, script.Path, script.Args...)
+	defer cancelCmd()
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	cmd.WaitDelay = runbookWaitDelay
+
+	if err := startRunbook(cmd, script); err != nil {
+		// A script that cannot be limited does not get to run unlimited
+		if cmd.Process != nil {
+			cmd.Cancel()
+			cmd.Wait()
+		}
+		return fmt.Errorf("failed to start %s: %w", script.Path, err)
+	}
+	err := cmd.Wait()
+
+	result.Duration = time.Since(result.StartedAt)
+	result.Stdout, result.Stderr = stdout.String(), stderr.String()
+	result.Truncated = stdout.truncated || stderr.truncated
+	if ctx.Err() == context.DeadlineExceeded {
+		result.TimedOut = true
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+		return fmt.Errorf("exited with %s", exitErr.ProcessState)
+	}
+	if err != nil {
+		return err
+	}
+	result.ExitCode = 0
+	return nil
+}
+
+// checkTrustedFile refuses a script or program others could change, since the agent would
+// then run anything they wrote into it
+func checkTrustedFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s is writable by group or others (mode %s)", path, info.Mode().Perm())
+	}
+	return nil
+}
+
+// upload sends a run's result to the server; a lost result is logged, the action log
+// still has the outcome
+func (s *RunbookService) upload(result *RunbookResult) {
+	ctx, cancel := context.WithTimeout(context.Background(), apiRequestTimeout)
+	defer cancel()
+	if err := sendJSON(ctx, s.config, http.MethodPost, hostPath(s.hostRid, "/runbooks/results"), result, nil); err != nil {
+		log.Printf("Failed to upload runbook result %s: %v", result.RequestID, err)
+	}
+}
+
+// cappedBuffer keeps the first limit bytes written to it and notes whether more came
+type cappedBuffer struct {
+	buf       []byte
+	limit     int
+	truncated bool
+}
+
+// Write keeps what fits and reports everything as written, so the script never sees a
+// broken pipe
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	room := b.limit - len(b.buf)
+	if room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf = append(b.buf, p[:room]...)
+		}
+		return len(p), nil
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+// String returns the kept output
+func (b *cappedBuffer) String() string {
+	return string(b.buf)
+}
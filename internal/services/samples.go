@@ -0,0 +1,61 @@
+package services
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSampleBytes bounds each kept payload, so large reports such as the inventory do not
+// hold much memory
+const maxSampleBytes = 16 * 1024
+
+// PayloadSample is the most recent report sent to one path, kept for diagnostic bundles
+type PayloadSample struct {
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	SentAt time.Time `json:"sent_at"`
+	// Body is the JSON payload, cut off at maxSampleBytes when Truncated is set
+	Body      string `json:"body"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// payloadSamples keeps the latest report per path
+var payloadSamples = struct {
+	sync.Mutex
+	m map[string]PayloadSample
+}{m: make(map[string]PayloadSample)}
+
+// recordSample keeps a report and the outcome of sending it as the sample for its path
+func recordSample(method, path string, body interface{}, err error) {
+	data, encodeErr := encodeBody(body)
+	if encodeErr != nil {
+		return
+	}
+	sample := PayloadSample{Method: method, Path: path, SentAt: time.Now().UTC()}
+	if len(data) > maxSampleBytes {
+		data, sample.Truncated = data[:maxSampleBytes], true
+	}
+	sample.Body = string(data)
+	if err != nil {
+		sample.Error = err.Error()
+	}
+
+	payloadSamples.Lock()
+	defer payloadSamples.Unlock()
+	payloadSamples.m[path] = sample
+}
+
+// PayloadSamples returns the latest report sent to each path, sorted by path
+func PayloadSamples() []PayloadSample {
+	payloadSamples.Lock()
+	defer payloadSamples.Unlock()
+
+	samples := make([]PayloadSample, 0, len(payloadSamples.m))
+	for _, sample := range payloadSamples.m {
+		samples = append(samples, sample)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Path < samples[j].Path })
+	return samples
+}
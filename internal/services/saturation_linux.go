@@ -0,0 +1,133 @@
+//go:build linux && !minimal && !no_saturation
+
+package services
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readSaturation reads how much of the kernel's file, connection tracking and PID tables
+// is in use, and the entropy estimate. Tables the kernel does not have, such as
+// conntrack without its module loaded, are left out.
+func readSaturation() (*SaturationReport, error) {
+	report := &SaturationReport{}
+
+	// file-nr is "allocated unused max"; kernels since 2.6 always report 0 unused
+	fileNr, err := readUintFields(hostFile("/proc/sys/fs/file-nr"))
+	if err != nil {
+		return nil, err
+	}
+	if len(fileNr) == 3 {
+		report.FileDescriptors = newLimitUsage(fileNr[0]-min(fileNr[1], fileNr[0]), fileNr[2])
+	}
+
+	if count, err := readUintFile(hostFile("/proc/sys/net/netfilter/nf_conntrack_count")); err == nil {
+		if limit, err := readUintFile(hostFile("/proc/sys/net/netfilter/nf_conntrack_max")); err == nil {
+			report.Conntrack = newLimitUsage(count, limit)
+		}
+	}
+
+	// The fourth field of loadavg is "running/total" scheduling entities, every thread
+	// of which holds a PID
+	if data, err := os.ReadFile(hostFile("/proc/loadavg")); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) >= 4 {
+			_, total, _ := strings.Cut(fields[3], "/")
+			tasks, terr := strconv.ParseUint(total, 10, 64)
+			pidMax, perr := readUintFile(hostFile("/proc/sys/kernel/pid_max"))
+			if terr == nil && perr == nil {
+				report.PIDs = newLimitUsage(tasks, pidMax)
+			}
+		}
+	}
+
+	if entropy, err := readUintFile(hostFile("/proc/sys/kernel/random/entropy_avail")); err == nil {
+		available := int(entropy)
+		report.EntropyAvailable = &available
+	}
+	return report, nil
+}
+
+// readProcessFiles counts the open files of every process against its soft limit.
+// Processes of other users can only be read as root; denied counts those skipped.
+func readProcessFiles() (processes []ProcessFiles, denied int, err error) {
+	entries, err := os.ReadDir(hostFile("/proc"))
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		limit, err := openFileLimit(pid)
+		if err != nil || limit == 0 {
+			// The process exited, or has no limit
+			continue
+		}
+		dir, err := os.Open(hostFile(fmt.Sprintf("/proc/%d/fd", pid)))
+		if err != nil {
+			if os.IsPermission(err) {
+				denied++
+			}
+			continue
+		}
+		names, err := dir.Readdirnames(-1)
+		dir.Close()
+		if err != nil {
+			continue
+		}
+		name, _, _, err := readProcStat(pid)
+		if err != nil {
+			continue
+		}
+		processes = append(processes, ProcessFiles{
+			PID:     pid,
+			Name:    name,
+			Open:    uint64(len(names)),
+			Limit:   limit,
+			Percent: percentOf(float64(len(names)), float64(limit)),
+		})
+	}
+	return processes, denied, nil
+}
+
+// openFileLimit reads the soft "Max open files" limit of a process, 0 when unlimited
+func openFileLimit(pid int) (uint64, error) {
+	data, err := os.ReadFile(hostFile(fmt.Sprintf("/proc/%d/limits", pid)))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		rest, ok := strings.CutPrefix(line, "Max open files")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 || fields[0] == "unlimited" {
+			return 0, nil
+		}
+		return strconv.ParseUint(fields[0], 10, 64)
+	}
+	return 0, nil
+}
+
+// readUintFields reads a file holding unsigned integers separated by whitespace
+func readUintFields(path string) ([]uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values []uint64
+	for _, field := range strings.Fields(string(data)) {
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected content in %s: %w", path, err)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
@@ -0,0 +1,320 @@
+//go:build !minimal && !no_saturation
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// SaturationReport is the payload sent to the saturation endpoint: how close the host is
+// to kernel limits that fail without warning once reached
+type SaturationReport struct {
+	FileDescriptors *LimitUsage `json:"file_descriptors,omitempty"`
+	// Conntrack is absent when the nf_conntrack module is not loaded
+	Conntrack *LimitUsage `json:"conntrack,omitempty"`
+	PIDs      *LimitUsage `json:"pids,omitempty"`
+	// EntropyAvailable is the kernel's entropy estimate in bits
+	EntropyAvailable *int `json:"entropy_available,omitempty"`
+	// Processes are those using the largest share of their open file limit
+	Processes []ProcessFiles `json:"processes"`
+}
+
+// LimitUsage is how much of a kernel table is in use
+type LimitUsage struct {
+	Used    uint64  `json:"used"`
+	Limit   uint64  `json:"limit"`
+	Percent float64 `json:"percent"`
+}
+
+// ProcessFiles is the number of files a process has open against its soft limit
+type ProcessFiles struct {
+	PID     int     `json:"pid"`
+	Name    string  `json:"name"`
+	Open    uint64  `json:"open"`
+	Limit   uint64  `json:"limit"`
+	Percent float64 `json:"percent"`
+}
+
+// SaturationEvent is a limit being approached or reached, or usage falling back below the
+// warning threshold
+type SaturationEvent struct {
+	EventID string `json:"event_id"`
+	// Resource is "file_descriptors", "conntrack", "pids", "entropy" or "open_files" of a
+	// process, which PID and Process name
+	Resource string `json:"resource"`
+	PID      int    `json:"pid,omitempty"`
+	Process  string `json:"process,omitempty"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Severity string `json:"severity"`
+	Used     uint64 `json:"used"`
+	Limit    uint64 `json:"limit,omitempty"`
+	// Message says what happened in one line
+	Message     string `json:"message"`
+	Timestamp   string `json:"timestamp"`
+	Maintenance string `json:"maintenance,omitempty"`
+	EventOccurrences
+}
+
+// SaturationEventsReport is the payload sent to the saturation events endpoint
+type SaturationEventsReport struct {
+	Events []SaturationEvent `json:"events"`
+}
+
+// saturationCondition is the state of one limit; a change raises an event
+type saturationCondition struct {
+	event SaturationEvent
+	state string
+}
+
+// newLimitUsage returns the usage of a table of the given size
+func newLimitUsage(used, limit uint64) *LimitUsage {
+	return &LimitUsage{Used: used, Limit: limit, Percent: percentOf(float64(used), float64(limit))}
+}
+
+// SaturationMonitorService reports how close the host is to its file descriptor,
+// conntrack and PID limits and how much entropy the kernel has, and raises events as a
+// limit is approached. Reaching any of them fails new files, connections or processes
+// with errors that rarely point at the cause.
+type SaturationMonitorService struct {
+	config   *config.Config
+	hostRid  string
+	stopChan chan bool
+	started  bool
+	// last holds the conditions of the previous poll, keyed by resource and PID
+	last          map[string]saturationCondition
+	dedup         *eventDeduper[SaturationEvent]
+	pendingEvents []SaturationEvent
+}
+
+// NewSaturationMonitorService creates a new saturation monitor service
+func NewSaturationMonitorService(cfg *config.Config, hostRid string) *SaturationMonitorService {
+	return &SaturationMonitorService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+		dedup:    newEventDeduper[SaturationEvent](dedupWindow(cfg)),
+	}
+}
+
+// init registers the collector, unless built with no_saturation
+func init() {
+	registerCollector("saturation", func(m *CollectorManager, c *config.Config) Collector {
+		return NewSaturationMonitorService(c, m.hostRid)
+	})
+}
+
+// Start begins checking the kernel limits periodically
+func (s *SaturationMonitorService) Start() error {
+	if !s.config.Saturation.Enabled {
+		log.Println("Saturation collector not enabled - skipping")
+		setCollectorStatus("saturation", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping saturation collector")
+		return nil
+	}
+	if _, err := readSaturation(); err != nil {
+		log.Printf("Cannot read kernel limits - skipping saturation collector: %v", err)
+		setCollectorStatus("saturation", CollectorSkipped, err.Error())
+		return nil
+	}
+
+	s.started = true
+	go s.monitorLoop()
+
+	setCollectorStatus("saturation", CollectorRunning, "")
+	log.Println("Saturation collector started")
+	return nil
+}
+
+// Stop stops the collector
+func (s *SaturationMonitorService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("Saturation collector stopped")
+	}
+}
+
+// monitorLoop checks the limits at the configured interval
+func (s *SaturationMonitorService) monitorLoop() {
+	defer recoverPanic("saturation")
+	ticker := newCollectorTicker("saturation", s.config.Saturation.Interval)
+	defer ticker.Stop()
+
+	markProgress("saturation", s.config.Saturation.Interval)
+	s.poll()
+	if finishedOnce("saturation") {
+		return
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			s.poll()
+			markProgress("saturation", s.config.Saturation.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// poll reads the limits, reports them and raises events for those that changed state
+func (s *SaturationMonitorService) poll() {
+	report, err := readSaturation()
+	if err != nil {
+		log.Printf("Failed to read kernel limits: %v", err)
+		setCollectorStatus("saturation", CollectorError, err.Error())
+		recordCollectorError("saturation", err)
+		return
+	}
+	processes, denied, err := readProcessFiles()
+	switch {
+	case err != nil:
+		log.Printf("Failed to count open files of processes: %v", err)
+		setCollectorStatus("saturation", CollectorError, err.Error())
+		recordCollectorError("saturation", err)
+	case denied > 0:
+		reason := fmt.Sprintf("cannot count the open files of %d processes of other users", denied)
+		if setPermissionProblem("saturation", CollectorDegraded, reason) {
+			log.Printf("Saturation collector degraded due to permissions: %s", reason)
+		}
+	default:
+		setCollectorStatus("saturation", CollectorRunning, "")
+	}
+
+	// Every process counts for events; the report only lists the top ones
+	conditions := saturationConditions(&s.config.Saturation, report, processes)
+	sort.Slice(processes, func(i, j int) bool {
+		if processes[i].Percent != processes[j].Percent {
+			return processes[i].Percent > processes[j].Percent
+		}
+		return processes[i].PID < processes[j].PID
+	})
+	report.Processes = processes[:min(len(processes), s.config.Saturation.TopProcesses)]
+	if report.Processes == nil {
+		report.Processes = []ProcessFiles{}
+	}
+
+	if err := submitReport(context.Background(), s.config, http.MethodPut, hostPath(s.hostRid, "/saturation"), report); err != nil {
+		log.Printf("Failed to report saturation: %v", err)
+		recordCollectorError("saturation", err)
+	}
+	s.reportChanges(conditions)
+}
+
+// saturationConditions derives the state of every limit from a report and the open files
+// of every process
+func saturationConditions(cfg *config.SaturationConfig, report *SaturationReport, processes []ProcessFiles) map[string]saturationCondition {
+	conditions := make(map[string]saturationCondition)
+	// limit is "full" once the table is, "high" above the warning threshold and "ok" below it
+	limit := func(event SaturationEvent, what string, percent float64) {
+		state := "ok"
+		event.Severity = severityInfo
+		event.Message = fmt.Sprintf("%s is below %d%% of its limit", what, cfg.Warning)
+		switch {
+		case event.Limit > 0 && event.Used >= event.Limit:
+			state = "full"
+			event.Severity = severityError
+			event.Message = fmt.Sprintf("%s has reached its limit of %d", what, event.Limit)
+		case percent >= float64(cfg.Warning):
+			state = "high"
+			event.Severity = severityWarning
+			event.Message = fmt.Sprintf("%s is at %.0f%% of its limit, %d of %d", what, percent, event.Used, event.Limit)
+		}
+		conditions[fmt.Sprintf("%s\x00%d", event.Resource, event.PID)] = saturationCondition{event: event, state: state}
+	}
+
+	for _, table := range []struct {
+		resource, what string
+		usage          *LimitUsage
+	}{
+		{"file_descriptors", "the system-wide open file table", report.FileDescriptors},
+		{"conntrack", "the connection tracking table", report.Conntrack},
+		{"pids", "the number of processes and threads", report.PIDs},
+	} {
+		if table.usage != nil {
+			limit(SaturationEvent{Resource: table.resource, Used: table.usage.Used, Limit: table.usage.Limit}, table.what, table.usage.Percent)
+		}
+	}
+	for _, process := range processes {
+		event := SaturationEvent{Resource: "open_files", PID: process.PID, Process: process.Name, Used: process.Open, Limit: process.Limit}
+		limit(event, fmt.Sprintf("the open file count of %s (%d)", process.Name, process.PID), process.Percent)
+	}
+
+	if report.EntropyAvailable != nil && cfg.EntropyWarning > 0 {
+		event := SaturationEvent{Resource: "entropy", Used: uint64(*report.EntropyAvailable), Severity: severityInfo}
+		state := "ok"
+		event.Message = fmt.Sprintf("the kernel has %d bits of entropy", *report.EntropyAvailable)
+		if *report.EntropyAvailable < cfg.EntropyWarning {
+			state = "low"
+			event.Severity = severityWarning
+			event.Message = fmt.Sprintf("the kernel has only %d bits of entropy, below %d", *report.EntropyAvailable, cfg.EntropyWarning)
+		}
+		conditions["entropy\x000"] = saturationCondition{event: event, state: state}
+	}
+	return conditions
+}
+
+// reportChanges sends an event for every limit whose state changed since the previous
+// poll. Limits already high when the agent starts, and processes that start or exit,
+// raise none; they show in the report.
+func (s *SaturationMonitorService) reportChanges(current map[string]saturationCondition) {
+	previous := s.last
+	s.last = current
+	if previous == nil {
+		return
+	}
+
+	now := time.Now()
+	events := []SaturationEvent{}
+	for key, condition := range current {
+		before, ok := previous[key]
+		if !ok || before.state == condition.state {
+			continue
+		}
+		event := condition.event
+		event.From = before.state
+		event.To = condition.state
+		event.Timestamp = now.UTC().Format(time.RFC3339)
+		event.Maintenance = maintenanceTag(now)
+		event.EventID = eventID("saturation", key, before.state, condition.state, now.UTC().Format(time.RFC3339Nano))
+		if s.dedup.Observe(key+"\x00"+before.state+"\x00"+condition.state, event, now) {
+			events = append(events, event)
+		}
+	}
+	for _, summary := range s.dedup.Flush(now) {
+		event := summary.Event
+		event.EventOccurrences = summary.occurrences()
+		events = append(events, event)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Resource != events[j].Resource {
+			return events[i].Resource < events[j].Resource
+		}
+		return events[i].PID < events[j].PID
+	})
+	events = append(s.pendingEvents, events...)
+	if len(events) == 0 {
+		return
+	}
+
+	reqBody := SaturationEventsReport{Events: events}
+	if err := submitReport(context.Background(), s.config, http.MethodPost, hostPath(s.hostRid, "/saturation-events"), reqBody); err != nil {
+		log.Printf("Failed to report saturation events (%d queued): %v", len(events), err)
+		recordCollectorError("saturation", err)
+		s.pendingEvents = retainEvents("saturation", events)
+		return
+	}
+	s.pendingEvents = nil
+	log.Printf("Reported %d saturation events successfully", len(events))
+}
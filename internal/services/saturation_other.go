@@ -0,0 +1,15 @@
+//go:build !linux && !minimal && !no_saturation
+
+package services
+
+import "errors"
+
+// readSaturation fails; the kernel limits are only read on Linux
+func readSaturation() (*SaturationReport, error) {
+	return nil, errors.New("kernel limits can only be read on Linux")
+}
+
+// readProcessFiles finds no processes
+func readProcessFiles() ([]ProcessFiles, int, error) {
+	return nil, 0, errors.New("kernel limits can only be read on Linux")
+}
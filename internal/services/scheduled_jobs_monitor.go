@@ -0,0 +1,444 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/execwrap"
+)
+
+// CronJob is a single crontab entry
+type CronJob struct {
+	Source   string     `json:"source"`
+	User     string     `json:"user"`
+	Schedule string     `json:"schedule"`
+	Command  string     `json:"command"`
+	LastRun  *time.Time `json:"last_run,omitempty"`
+}
+
+// TimerJob is a systemd timer and the service it triggers
+type TimerJob struct {
+	Unit        string     `json:"unit"`
+	Service     string     `json:"service"`
+	LastTrigger *time.Time `json:"last_trigger,omitempty"`
+	NextElapse  *time.Time `json:"next_elapse,omitempty"`
+	Result      string     `json:"result"`
+	ExitStatus  string     `json:"exit_status,omitempty"`
+}
+
+// JobAnomaly flags a scheduled job that failed or did not run when expected
+type JobAnomaly struct {
+	Kind     string     `json:"kind"`
+	Job      string     `json:"job"`
+	Reason   string     `json:"reason"`
+	Expected *time.Time `json:"expected,omitempty"`
+}
+
+// ScheduledJobsReport is the payload sent to the scheduled jobs endpoint
+type ScheduledJobsReport struct {
+	CronJobs  []CronJob    `json:"cron_jobs"`
+	Timers    []TimerJob   `json:"timers"`
+	Anomalies []JobAnomaly `json:"anomalies"`
+}
+
+// Job anomaly kinds
+const (
+	jobAnomalyFailed = "failed"
+	jobAnomalyMissed = "missed"
+)
+
+// System crontabs carry a user column, per-user spool crontabs do not
+var (
+	systemCrontabs  = []string{"/etc/crontab"}
+	systemCronDirs  = []string{"/etc/cron.d"}
+	userCrontabDirs = []string{"/var/spool/cron/crontabs", "/var/spool/cron"}
+)
+
+// cronLogPattern matches "(user) CMD (command)" lines logged by cron daemons
+var cronLogPattern = regexp.MustCompile(`\((\S+)\) CMD \((.*)\)\s*$`)
+
+// ScheduledJobsMonitorService tracks cron jobs and systemd timers
+type ScheduledJobsMonitorService struct {
+	config    *config.Config
+	hostRid   string
+	startedAt time.Time
+	stopChan  chan bool
+}
+
+// NewScheduledJobsMonitorService creates a new scheduled jobs monitor service
+func NewScheduledJobsMonitorService(cfg *config.Config, hostRid string) *ScheduledJobsMonitorService {
+	return &ScheduledJobsMonitorService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+	}
+}
+
+// Start begins collecting scheduled jobs periodically
+func (s *ScheduledJobsMonitorService) Start() error {
+	if !s.config.ScheduledJobs.Enabled {
+		log.Println("Scheduled job tracking not enabled - skipping")
+		setCollectorStatus("scheduled_jobs", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping scheduled job tracking")
+		return nil
+	}
+
+	s.startedAt = time.Now()
+	go s.monitorLoop()
+
+	setCollectorStatus("scheduled_jobs", CollectorRunning, "")
+	log.Printf("Scheduled job tracking started for host RID: %s", s.hostRid)
+	return nil
+}
+
+// Stop stops the monitoring process
+func (s *ScheduledJobsMonitorService) Stop() {
+	if !s.startedAt.IsZero() {
+		close(s.stopChan)
+		log.Println("Scheduled job tracking stopped")
+	}
+}
+
+// monitorLoop runs the periodic collection loop
+func (s *ScheduledJobsMonitorService) monitorLoop() {
+	defer recoverPanic("scheduled_jobs")
+	ticker := newCollectorTicker("scheduled_jobs", s.config.ScheduledJobs.Interval)
+	defer ticker.Stop()
+
+	markProgress("scheduled_jobs", s.config.ScheduledJobs.Interval)
+	// Run immediately on start
+	s.reportJobs()
+	if finishedOnce("scheduled_jobs") {
+		return
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reportJobs()
+			markProgress("scheduled_jobs", s.config.ScheduledJobs.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// reportJobs collects the job inventory, detects anomalies and reports them
+func (s *ScheduledJobsMonitorService) reportJobs() {
+	now := time.Now()
+	anomalies := []JobAnomaly{}
+
+	cronJobs := collectCronJobs()
+	lastRuns, logCoverage, err := readCronExecutions(s.config.ScheduledJobs.Lookback)
+	if err != nil {
+		log.Printf("Cron execution history unavailable: %v", err)
+	}
+	for i := range cronJobs {
+		job := &cronJobs[i]
+		if last, ok := lastRuns[job.User+"\x00"+job.Command]; ok {
+			last := last
+			job.LastRun = &last
+		}
+		if logCoverage.IsZero() {
+			continue
+		}
+		if anomaly, ok := s.checkCronMissed(*job, now, logCoverage); ok {
+			anomalies = append(anomalies, anomaly)
+		}
+	}
+
+	timers, err := collectTimers()
+	if err != nil {
+		log.Printf("Failed to collect systemd timers: %v", err)
+		timers = []TimerJob{}
+	}
+	for _, timer := range timers {
+		if timer.Result != "" && timer.Result != "success" {
+			anomalies = append(anomalies, JobAnomaly{
+				Kind:   jobAnomalyFailed,
+				Job:    timer.Unit,
+				Reason: "last run of " + timer.Service + " finished with result " + timer.Result,
+			})
+		} else if timer.ExitStatus != "" && timer.ExitStatus != "0" {
+			anomalies = append(anomalies, JobAnomaly{
+				Kind:   jobAnomalyFailed,
+				Job:    timer.Unit,
+				Reason: "last run of " + timer.Service + " exited with status " + timer.ExitStatus,
+			})
+		}
+		if timer.NextElapse != nil && now.Sub(*timer.NextElapse) > s.config.ScheduledJobs.MissedGrace {
+			anomalies = append(anomalies, JobAnomaly{
+				Kind:     jobAnomalyMissed,
+				Job:      timer.Unit,
+				Reason:   "timer did not fire at its scheduled time",
+				Expected: timer.NextElapse,
+			})
+		}
+	}
+
+	reqBody := ScheduledJobsReport{
+		CronJobs:  cronJobs,
+		Timers:    timers,
+		Anomalies: anomalies,
+	}
+
+	ctx := context.Background()
+	if err := submitReport(ctx, s.config, http.MethodPut, hostPath(s.hostRid, "/scheduled-jobs"), reqBody); err != nil {
+		log.Printf("Failed to report scheduled jobs: %v", err)
+		recordCollectorError("scheduled_jobs", err)
+		return
+	}
+
+	log.Printf("Reported %d cron jobs, %d timers and %d anomalies successfully", len(cronJobs), len(timers), len(anomalies))
+}
+
+// checkCronMissed reports a cron job whose latest expected run has no matching execution
+func (s *ScheduledJobsMonitorService) checkCronMissed(job CronJob, now, logCoverage time.Time) (JobAnomaly, bool) {
+	schedule, err := parseCronSchedule(job.Schedule)
+	if err != nil {
+		return JobAnomaly{}, false
+	}
+
+	expected, ok := schedule.previous(now.Add(-s.config.ScheduledJobs.MissedGrace), s.config.ScheduledJobs.Lookback)
+	// Only judge runs the logs are able to confirm
+	if !ok || expected.Before(logCoverage) {
+		return JobAnomaly{}, false
+	}
+	if job.LastRun != nil && !job.LastRun.Before(expected) {
+		return JobAnomaly{}, false
+	}
+
+	return JobAnomaly{
+		Kind:     jobAnomalyMissed,
+		Job:      job.Source + ": " + job.Command,
+		Reason:   "no cron execution logged for scheduled run",
+		Expected: &expected,
+	}, true
+}
+
+// collectCronJobs reads system and per-user crontabs
+func collectCronJobs() []CronJob {
+	jobs := []CronJob{}
+
+	for _, path := range systemCrontabs {
+		jobs = append(jobs, parseCrontab(path, "")...)
+	}
+	for _, dir := range systemCronDirs {
+		entries, err := os.ReadDir(hostFile(dir))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			// cron ignores files with dots in their names, as do we
+			if entry.IsDir() || strings.Contains(entry.Name(), ".") {
+				continue
+			}
+			jobs = append(jobs, parseCrontab(filepath.Join(dir, entry.Name()), "")...)
+		}
+	}
+	for _, dir := range userCrontabDirs {
+		entries, err := os.ReadDir(hostFile(dir))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			jobs = append(jobs, parseCrontab(filepath.Join(dir, entry.Name()), entry.Name())...)
+		}
+	}
+
+	return jobs
+}
+
+// parseCrontab parses a crontab; user is empty for system crontabs with a user column
+func parseCrontab(path, user string) []CronJob {
+	file, err := os.Open(hostFile(path))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	jobs := []CronJob{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		// Environment assignments such as SHELL=/bin/sh
+		if strings.Contains(fields[0], "=") {
+			continue
+		}
+
+		var schedule string
+		var rest []string
+		if strings.HasPrefix(fields[0], "@") {
+			schedule, rest = fields[0], fields[1:]
+		} else if len(fields) >= 6 {
+			schedule, rest = strings.Join(fields[:5], " "), fields[5:]
+		} else {
+			continue
+		}
+
+		jobUser := user
+		if jobUser == "" {
+			if len(rest) < 2 {
+				continue
+			}
+			jobUser, rest = rest[0], rest[1:]
+		}
+		if len(rest) == 0 {
+			continue
+		}
+
+		jobs = append(jobs, CronJob{
+			Source:   path,
+			User:     jobUser,
+			Schedule: schedule,
+			Command:  strings.Join(rest, " "),
+		})
+	}
+	return jobs
+}
+
+// readCronExecutions returns the latest logged run per user and command, and the
+// earliest time the logs cover; a zero coverage means no history was found
+func readCronExecutions(lookback time.Duration) (map[string]time.Time, time.Time, error) {
+	if _, err := exec.LookPath("journalctl"); err != nil {
+		return map[string]time.Time{}, time.Time{}, err
+	}
+
+	since := time.Now().Add(-lookback)
+	output, err := execwrap.Output(context.Background(), execwrap.Options{}, "journalctl", "--no-pager", "-o", "short-iso", "-t", "CRON", "-t", "crond", "-t", "cron",
+		"--since", since.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return map[string]time.Time{}, time.Time{}, err
+	}
+
+	runs, coverage := parseCronLog(string(output))
+	return runs, coverage, nil
+}
+
+// parseCronLog reads cron's journal lines. The coverage is the time of the first entry:
+// the journal may have been rotated or vacuumed after the start of the lookback, and
+// jobs due before that cannot be told apart from missing logs.
+func parseCronLog(output string) (map[string]time.Time, time.Time) {
+	runs := make(map[string]time.Time)
+	var coverage time.Time
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		stamp, _, _ := strings.Cut(line, " ")
+		when, err := time.Parse("2006-01-02T15:04:05-0700", stamp)
+		if err != nil {
+			continue
+		}
+		if coverage.IsZero() || when.Before(coverage) {
+			coverage = when
+		}
+		match := cronLogPattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		key := match[1] + "\x00" + match[2]
+		if when.After(runs[key]) {
+			runs[key] = when
+		}
+	}
+	return runs, coverage
+}
+
+// collectTimers reads all systemd timers and the result of the service each one triggers
+func collectTimers() ([]TimerJob, error) {
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return []TimerJob{}, nil
+	}
+
+	output, err := execwrap.Output(context.Background(), execwrap.Options{}, "systemctl", "list-units", "--type=timer", "--all", "--no-pager", "--no-legend", "--plain")
+	if err != nil {
+		return nil, err
+	}
+
+	units := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			units = append(units, fields[0])
+		}
+	}
+
+	timerProps, err := systemctlShow(units, []string{"Id", "Unit", "LastTriggerUSec", "NextElapseUSecRealtime"}, "--timestamp=unix")
+	if err != nil {
+		// Older systemd versions lack --timestamp
+		if timerProps, err = systemctlShow(units, []string{"Id", "Unit", "LastTriggerUSec", "NextElapseUSecRealtime"}); err != nil {
+			return nil, err
+		}
+	}
+
+	services := make([]string, 0, len(timerProps))
+	for _, props := range timerProps {
+		if props["Unit"] != "" {
+			services = append(services, props["Unit"])
+		}
+	}
+	serviceProps, err := systemctlShow(services, []string{"Id", "Result", "ExecMainStatus"})
+	if err != nil {
+		log.Printf("Failed to read timer service results: %v", err)
+		serviceProps = map[string]map[string]string{}
+	}
+
+	timers := make([]TimerJob, 0, len(timerProps))
+	for _, unit := range units {
+		props, ok := timerProps[unit]
+		if !ok {
+			continue
+		}
+		service := serviceProps[props["Unit"]]
+		timers = append(timers, TimerJob{
+			Unit:        unit,
+			Service:     props["Unit"],
+			LastTrigger: parseSystemdTimestamp(props["LastTriggerUSec"]),
+			NextElapse:  parseSystemdTimestamp(props["NextElapseUSecRealtime"]),
+			Result:      service["Result"],
+			ExitStatus:  service["ExecMainStatus"],
+		})
+	}
+	return timers, nil
+}
+
+// parseSystemdTimestamp parses "@<unix seconds>" or "Mon 2006-01-02 15:04:05 MST" timestamps
+func parseSystemdTimestamp(value string) *time.Time {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "n/a" || value == "0" {
+		return nil
+	}
+	if strings.HasPrefix(value, "@") {
+		seconds, err := strconv.ParseInt(strings.TrimPrefix(value, "@"), 10, 64)
+		if err != nil || seconds == 0 {
+			return nil
+		}
+		t := time.Unix(seconds, 0).UTC()
+		return &t
+	}
+	t, err := time.Parse("Mon 2006-01-02 15:04:05 MST", value)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,33 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronLogCoverageStartsAtFirstEntry(t *testing.T) {
+	output := `2024-03-10T04:17:01+0000 web1 CRON[812]: pam_unix(cron:session): session opened for user root(uid=0) by (uid=0)
+2024-03-10T04:17:01+0000 web1 CRON[813]: (root) CMD (cd / && run-parts --report /etc/cron.hourly)
+2024-03-10T05:00:01+0000 web1 CRON[901]: (backup) CMD (/usr/local/bin/backup.sh)
+2024-03-10T05:17:01+0000 web1 CRON[944]: (root) CMD (cd / && run-parts --report /etc/cron.hourly)
+`
+	runs, coverage := parseCronLog(output)
+
+	if want := time.Date(2024, 3, 10, 4, 17, 1, 0, time.UTC); !coverage.Equal(want) {
+		t.Errorf("coverage = %v, want the first entry at %v", coverage, want)
+	}
+	hourly := runs["root\x00cd / && run-parts --report /etc/cron.hourly"]
+	if want := time.Date(2024, 3, 10, 5, 17, 1, 0, time.UTC); !hourly.Equal(want) {
+		t.Errorf("hourly run = %v, want the latest at %v", hourly, want)
+	}
+	if len(runs) != 2 {
+		t.Errorf("parseCronLog found %d jobs, want 2: %v", len(runs), runs)
+	}
+}
+
+func TestParseCronLogWithoutEntries(t *testing.T) {
+	runs, coverage := parseCronLog("-- No entries --\n")
+	if !coverage.IsZero() || len(runs) != 0 {
+		t.Errorf("parseCronLog = %v, %v, want no runs and zero coverage", runs, coverage)
+	}
+}
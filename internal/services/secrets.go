@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/execwrap"
+)
+
+// bufferKeySecret is the buffer key fetched by ResolveSecrets. buffer.key keeps its
+// reference, since validation of a later remote configuration still requires one there.
+var bufferKeySecret struct {
+	sync.Mutex
+	ref    string
+	secret string
+}
+
+// ResolveSecrets replaces every credential written as a secret reference with the secret
+// fetched from its provider, so the rest of the agent only sees plain values. It fails on
+// the first secret that cannot be fetched, naming the setting it was for. The buffer key
+// is fetched too, while the sandbox still lets the agent reach every provider.
+func ResolveSecrets(cfg *config.Config) error {
+	for _, field := range cfg.SecretFields() {
+		ref, ok := config.ParseSecretRef(*field.Value)
+		if !ok {
+			continue
+		}
+		secret, err := fetchSecretWithTimeout(cfg, ref)
+		if err != nil {
+			return fmt.Errorf("%s: failed to fetch %s: %w", field.Path, ref, err)
+		}
+		*field.Value = secret
+	}
+
+	if ref, ok := config.ParseSecretRef(cfg.Buffer.Key); ok && cfg.Buffer.Enabled && cfg.Buffer.Encrypt {
+		secret, err := fetchSecretWithTimeout(cfg, ref)
+		if err != nil {
+			return fmt.Errorf("buffer.key: failed to fetch %s: %w", ref, err)
+		}
+		bufferKeySecret.Lock()
+		bufferKeySecret.ref, bufferKeySecret.secret = ref.String(), secret
+		bufferKeySecret.Unlock()
+	}
+	return nil
+}
+
+// fetchSecretWithTimeout reads one secret within secrets.timeout
+func fetchSecretWithTimeout(cfg *config.Config, ref config.SecretRef) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Secrets.Timeout)
+	defer cancel()
+	return fetchSecret(ctx, &cfg.Secrets, ref)
+}
+
+// fetchSecret reads one secret from its provider
+func fetchSecret(ctx context.Context, cfg *config.SecretsConfig, ref config.SecretRef) (string, error) {
+	switch ref.Provider {
+	case "vault":
+		return vaultSecret(ctx, &cfg.Vault, ref)
+	case "aws-sm":
+		return awsSecret(ctx, cfg.AWSRegion, ref)
+	case "exec":
+		args := append(append([]string{}, cfg.Command[1:]...), ref.Path)
+		return runSecretCommand(ctx, execwrap.Options{}, cfg.Command[0], args...)
+	}
+	return "", fmt.Errorf("unknown secrets provider %q", ref.Provider)
+}
+
+// vaultSecret reads a field of a secret from Vault's KV engine, version 1 or 2
+func vaultSecret(ctx context.Context, cfg *config.VaultConfig, ref config.SecretRef) (string, error) {
+	token := cfg.Token
+	if cfg.TokenFile != "" {
+		data, err := os.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read Vault token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	endpoint := strings.TrimRight(cfg.Address, "/") + "/v1/" + strings.TrimLeft(ref.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", cfg.Namespace)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: restrictTLS(&tls.Config{MinVersion: tls.VersionTLS12}),
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Vault answered %s", resp.Status)
+	}
+
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("failed to decode Vault response: %w", err)
+	}
+	// KV version 2 nests the fields under data.data, next to data.metadata
+	fields := secret.Data
+	if nested, ok := fields["data"]; ok {
+		if _, versioned := fields["metadata"]; versioned {
+			fields = nil
+			if err := json.Unmarshal(nested, &fields); err != nil {
+				return "", fmt.Errorf("failed to decode Vault secret: %w", err)
+			}
+		}
+	}
+	return secretField(fields, ref.Key)
+}
+
+// awsSecret reads a secret from AWS Secrets Manager with the aws CLI, which finds the
+// instance role or other credentials the way every AWS tool does. With a key, the secret
+// is a JSON object and the key names one of its fields.
+func awsSecret(ctx context.Context, region string, ref config.SecretRef) (string, error) {
+	args := []string{"secretsmanager", "get-secret-value", "--secret-id", ref.Path, "--query", "SecretString", "--output", "text"}
+	if region != "" {
+		args = append(args, "--region", region)
+	}
+	// The CLI finds its credentials and proxy in the environment
+	opts := execwrap.Options{Env: []string{"AWS_PAGER="}, KeepEnv: []string{"AWS_*", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"}}
+	secret, err := runSecretCommand(ctx, opts, "aws", args...)
+	if err != nil || ref.Key == "" {
+		return secret, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object, so it has no key %q", ref.Key)
+	}
+	return secretField(fields, ref.Key)
+}
+
+// secretField returns a string field of a secret
+func secretField(fields map[string]json.RawMessage, key string) (string, error) {
+	raw, ok := fields[key]
+	if !ok {
+		return "", fmt.Errorf("secret has no key %q", key)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", fmt.Errorf("key %q of the secret is not a string", key)
+	}
+	return value, nil
+}
+
+// runSecretCommand runs a command printing a secret and returns its output without the
+// trailing newline. The secret is never part of an error; its error output is.
+func runSecretCommand(ctx context.Context, opts execwrap.Options, name string, args ...string) (string, error) {
+	output, err := execwrap.Output(ctx, opts, name, args...)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimRight(string(output), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("%s printed no secret", name)
+	}
+	return secret, nil
+}
@@ -0,0 +1,268 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+const (
+	// cgroupBudgetShare is the part of the agent's cgroup limit used as its budget, leaving
+	// headroom before the kernel OOM-kills or throttles it
+	cgroupBudgetShare = 0.9
+	// shedAfterChecks is how many consecutive checks over budget start load shedding
+	shedAfterChecks = 2
+	// restoreAfterChecks is how many consecutive checks well under budget end load shedding
+	restoreAfterChecks = 5
+	// restoreShare is the part of the budget usage must stay under before restoring
+	restoreShare = 0.7
+	// clockTicks is the kernel USER_HZ used in /proc/self/stat
+	clockTicks = 100
+)
+
+// SelfBudget is the memory and CPU the agent allows itself; zero means unlimited
+type SelfBudget struct {
+	MemoryBytes uint64  `json:"memory_bytes,omitempty"`
+	CPUPercent  float64 `json:"cpu_percent,omitempty"`
+}
+
+// SelfUsage is the agent's own resource usage against its budget
+type SelfUsage struct {
+	RSSBytes   uint64     `json:"rss_bytes"`
+	CPUPercent float64    `json:"cpu_percent"`
+	Budget     SelfBudget `json:"budget"`
+	Shedding   bool       `json:"shedding"`
+}
+
+var selfUsage = struct {
+	sync.Mutex
+	usage *SelfUsage
+}{}
+
+// currentSelfUsage returns the latest self usage sample, or nil before the first
+func currentSelfUsage() *SelfUsage {
+	selfUsage.Lock()
+	defer selfUsage.Unlock()
+	if selfUsage.usage == nil {
+		return nil
+	}
+	usage := *selfUsage.usage
+	return &usage
+}
+
+// resolveSelfBudget returns the configured budget, deriving unset parts from the agent's
+// own cgroup limits when it runs in a container or a limited systemd unit
+func resolveSelfBudget(cfg *config.Config) SelfBudget {
+	budget := SelfBudget{
+		MemoryBytes: uint64(cfg.SelfLimits.MemoryMB) * 1024 * 1024,
+		CPUPercent:  cfg.SelfLimits.CPUPercent,
+	}
+	if budget.MemoryBytes > 0 && budget.CPUPercent > 0 {
+		return budget
+	}
+
+	limits, err := ownCgroupLimits()
+	if err != nil {
+		return budget
+	}
+	if budget.MemoryBytes == 0 && limits.MemoryMax > 0 {
+		budget.MemoryBytes = uint64(float64(limits.MemoryMax) * cgroupBudgetShare)
+	}
+	if budget.CPUPercent == 0 && limits.CPUCores > 0 {
+		budget.CPUPercent = limits.CPUCores * 100 * cgroupBudgetShare
+	}
+	return budget
+}
+
+// ApplyMemoryLimit sets the Go runtime's soft memory limit to the memory budget, so the
+// garbage collector works harder before the agent has to shed load. An explicit
+// GOMEMLIMIT in the environment takes precedence.
+func ApplyMemoryLimit(cfg *config.Config) {
+	if !cfg.SelfLimits.Enabled || os.Getenv("GOMEMLIMIT") != "" {
+		return
+	}
+	budget := resolveSelfBudget(cfg)
+	if budget.MemoryBytes == 0 {
+		return
+	}
+	debug.SetMemoryLimit(int64(budget.MemoryBytes))
+	log.Printf("Memory limit set to %d MiB", budget.MemoryBytes/(1024*1024))
+}
+
+// SelfLimitService watches the agent's own memory and CPU use and sheds load, keeping
+// only essential collectors, while the agent is over its budget
+type SelfLimitService struct {
+	config   *config.Config
+	manager  *CollectorManager
+	stopChan chan bool
+	started  bool
+
+	budget   SelfBudget
+	lastCPU  float64
+	lastAt   time.Time
+	over     int
+	under    int
+	shedding bool
+}
+
+// NewSelfLimitService creates a new self limit service
+func NewSelfLimitService(cfg *config.Config, manager *CollectorManager) *SelfLimitService {
+	return &SelfLimitService{
+		config:   cfg,
+		manager:  manager,
+		stopChan: make(chan bool),
+	}
+}
+
+// Start begins checking the agent's resource usage
+func (s *SelfLimitService) Start() error {
+	if !s.config.SelfLimits.Enabled {
+		log.Println("Self limits not enabled - skipping")
+		return nil
+	}
+
+	s.budget = resolveSelfBudget(s.config)
+	if s.budget.MemoryBytes == 0 && s.budget.CPUPercent == 0 {
+		log.Println("No memory or CPU budget configured or found in the agent's cgroup - skipping self limits")
+		return nil
+	}
+
+	s.started = true
+	go s.monitorLoop()
+
+	log.Printf("Self limits started (memory %d MiB, CPU %.0f%%)", s.budget.MemoryBytes/(1024*1024), s.budget.CPUPercent)
+	return nil
+}
+
+// Stop stops checking resource usage
+func (s *SelfLimitService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("Self limits stopped")
+	}
+}
+
+// monitorLoop checks usage periodically
+func (s *SelfLimitService) monitorLoop() {
+	defer recoverPanic("self_limits")
+
+	ticker := time.NewTicker(s.config.SelfLimits.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.check()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// check samples usage and starts or ends load shedding with hysteresis
+func (s *SelfLimitService) check() {
+	usage := SelfUsage{Budget: s.budget, RSSBytes: readSelfRSS()}
+	now := time.Now()
+	if cpuSeconds, err := readSelfCPUSeconds(); err == nil {
+		if !s.lastAt.IsZero() {
+			usage.CPUPercent = (cpuSeconds - s.lastCPU) / now.Sub(s.lastAt).Seconds() * 100
+		}
+		s.lastCPU, s.lastAt = cpuSeconds, now
+	}
+
+	var reasons []string
+	memOver := s.budget.MemoryBytes > 0 && usage.RSSBytes > s.budget.MemoryBytes
+	cpuOver := s.budget.CPUPercent > 0 && usage.CPUPercent > s.budget.CPUPercent
+	if memOver {
+		reasons = append(reasons, fmt.Sprintf("memory %d MiB over %d MiB budget", usage.RSSBytes/(1024*1024), s.budget.MemoryBytes/(1024*1024)))
+	}
+	if cpuOver {
+		reasons = append(reasons, fmt.Sprintf("CPU %.0f%% over %.0f%% budget", usage.CPUPercent, s.budget.CPUPercent))
+	}
+	memLow := s.budget.MemoryBytes == 0 || float64(usage.RSSBytes) < float64(s.budget.MemoryBytes)*restoreShare
+	cpuLow := s.budget.CPUPercent == 0 || usage.CPUPercent < s.budget.CPUPercent*restoreShare
+
+	switch {
+	case len(reasons) > 0:
+		s.over++
+		s.under = 0
+	case memLow && cpuLow:
+		s.under++
+		s.over = 0
+	default:
+		s.over, s.under = 0, 0
+	}
+
+	if !s.shedding && s.over >= shedAfterChecks {
+		reason := strings.Join(reasons, ", ")
+		shed := s.manager.Shed(s.config.SelfLimits.Essential, reason)
+		log.Printf("Warning: Agent over its resource budget (%s), shedding %s", reason, strings.Join(shed, ", "))
+		debug.FreeOSMemory()
+		s.shedding = true
+	} else if s.shedding && s.under >= restoreAfterChecks {
+		s.manager.Restore()
+		log.Println("Agent back under its resource budget, restoring shed collectors")
+		s.shedding = false
+	}
+
+	usage.Shedding = s.shedding
+	selfUsage.Lock()
+	selfUsage.usage = &usage
+	selfUsage.Unlock()
+}
+
+// readSelfRSS returns the agent's resident set size, falling back to the memory the Go
+// runtime obtained from the OS where /proc is unavailable
+func readSelfRSS() uint64 {
+	if data, err := os.ReadFile("/proc/self/status"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if value, ok := strings.CutPrefix(line, "VmRSS:"); ok {
+				fields := strings.Fields(value)
+				if len(fields) == 0 {
+					break
+				}
+				if kb, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+					return kb * 1024
+				}
+			}
+		}
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return mem.Sys
+}
+
+// readSelfCPUSeconds returns the CPU time the agent used in user and system mode
+func readSelfCPUSeconds() (float64, error) {
+	data, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces, so fields are counted after its closing paren
+	_, rest, ok := strings.Cut(string(data), ") ")
+	if !ok {
+		return 0, fmt.Errorf("unexpected /proc/self/stat format")
+	}
+	fields := strings.Fields(rest)
+	// utime and stime are fields 14 and 15, the 12th and 13th after the command name
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("unexpected /proc/self/stat format")
+	}
+	utime, err := strconv.ParseFloat(fields[11], 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseFloat(fields[12], 64)
+	if err != nil {
+		return 0, err
+	}
+	return (utime + stime) / clockTicks, nil
+}
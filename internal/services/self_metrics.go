@@ -0,0 +1,54 @@
+package services
+
+import (
+	"expvar"
+	"sync"
+)
+
+var publishOnce sync.Once
+
+// AgentMetrics is the agent's own telemetry, sent with every heartbeat
+type AgentMetrics struct {
+	Transport TransportStats `json:"transport"`
+	Resources *SelfUsage     `json:"resources,omitempty"`
+	// Heartbeat is the round-trip timing of the previous heartbeat
+	Heartbeat *HeartbeatTiming `json:"heartbeat,omitempty"`
+	// Gateway counts requests relayed for other agents when running as a gateway
+	Gateway *GatewayStats `json:"gateway,omitempty"`
+	// CustomMetrics counts what applications pushed when the custom metrics API is running
+	CustomMetrics *CustomMetricsStats `json:"custom_metrics,omitempty"`
+	// DNS counts lookups when the agent resolves names with its own resolvers
+	DNS *DNSStats `json:"dns,omitempty"`
+	// Bandwidth is what reports used of the bandwidth budgets, per collector
+	Bandwidth *BandwidthStats `json:"bandwidth,omitempty"`
+	// Buffer is the usage of the disk buffer when it is enabled
+	Buffer *BufferStats `json:"buffer,omitempty"`
+	// Commands counts the external commands collectors ran
+	Commands *CommandStats `json:"commands,omitempty"`
+	// QueryCache counts the answers of cached system queries
+	QueryCache *QueryCacheStats `json:"query_cache,omitempty"`
+}
+
+// PublishExpvars exposes collector states and self-metrics on the expvar endpoint
+func PublishExpvars() {
+	publishOnce.Do(func() {
+		expvar.Publish("collectors", expvar.Func(func() interface{} { return CollectorStatuses() }))
+		expvar.Publish("agent_metrics", expvar.Func(func() interface{} { return currentAgentMetrics() }))
+	})
+}
+
+// currentAgentMetrics collects the agent's self-metrics
+func currentAgentMetrics() AgentMetrics {
+	return AgentMetrics{
+		Transport:     currentTransportStats(),
+		Resources:     currentSelfUsage(),
+		Heartbeat:     currentHeartbeatTiming(),
+		Gateway:       currentGatewayStats(),
+		CustomMetrics: currentCustomMetricsStats(),
+		DNS:           currentDNSStats(),
+		Bandwidth:     currentBandwidthStats(),
+		Buffer:        currentBufferStats(),
+		Commands:      currentCommandStats(),
+		QueryCache:    currentQueryCacheStats(),
+	}
+}
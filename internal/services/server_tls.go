@@ -0,0 +1,101 @@
+package services
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+
+	"sprinter-agent/internal/config"
+)
+
+// PinMismatchError is a server whose verified certificate chain holds none of the pinned
+// keys, as when a TLS-inspecting proxy re-signs the connection with its own CA
+type PinMismatchError struct {
+	ServerName string
+	// Presented is the pin of the server's own certificate, to compare with the
+	// configuration when the server's key was legitimately changed
+	Presented string
+}
+
+func (e *PinMismatchError) Error() string {
+	server := "the server"
+	// Servers reached by IP address get no server name
+	if e.ServerName != "" {
+		server = e.ServerName
+	}
+	return fmt.Sprintf("certificate of %s matches none of tls.pinned_keys (it presented sha256//%s); the connection may be intercepted", server, e.Presented)
+}
+
+// ServerTLSConfig returns the TLS configuration for connections to the Somana server:
+// the authorities in tls.ca_file, or the system's, and the tls.pinned_keys check
+func ServerTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tlsConfig := restrictTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	if cfg.TLS.CAFile != "" {
+		data, err := os.ReadFile(cfg.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", cfg.TLS.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	pins, err := cfg.TLS.ParsePinnedKeys()
+	if err != nil {
+		return nil, err
+	}
+	if len(pins) == 0 {
+		return tlsConfig, nil
+	}
+	pinned := make(map[[sha256.Size]byte]bool, len(pins))
+	for _, pin := range pins {
+		pinned[pin] = true
+	}
+	// Verification has already succeeded here, so any certificate of a verified chain, the
+	// server's own or an authority's, may carry the pin
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		for _, chain := range state.VerifiedChains {
+			for _, cert := range chain {
+				if pinned[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+					return nil
+				}
+			}
+		}
+		err := &PinMismatchError{ServerName: state.ServerName}
+		if len(state.PeerCertificates) > 0 {
+			err.Presented = SPKIPin(state.PeerCertificates[0])
+		}
+		return err
+	}
+	return tlsConfig, nil
+}
+
+// SPKIPin returns the base64 SHA-256 hash of a certificate's public key, as written in
+// tls.pinned_keys
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ConfigureTLS applies the CA bundle and pinned keys to every connection to the server. It
+// fails rather than fall back to unpinned connections when they cannot be loaded.
+func ConfigureTLS(cfg *config.Config) error {
+	tlsConfig, err := ServerTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	apiTransport.TLSClientConfig = tlsConfig
+	if cfg.TLS.CAFile != "" {
+		log.Printf("Trusting the authorities in %s for the server", cfg.TLS.CAFile)
+	}
+	if len(cfg.TLS.PinnedKeys) > 0 {
+		log.Printf("Pinning the server to %d public keys", len(cfg.TLS.PinnedKeys))
+	}
+	return nil
+}
@@ -0,0 +1,468 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/diagnostics"
+	"sprinter-agent/internal/execwrap"
+)
+
+// ActionSnapshot is the remote action of capturing a system snapshot
+const ActionSnapshot = "snapshot"
+
+// snapshotRequest is a snapshot the server asks for
+type snapshotRequest struct {
+	ID string `json:"id"`
+	// RequestedBy is the user or automation that asked for the snapshot
+	RequestedBy string `json:"requested_by,omitempty"`
+}
+
+// Snapshot is a point-in-time capture of the host's processes, open files, sockets, kernel
+// log and disk usage, uploaded to the server as a gzipped tarball
+type Snapshot struct {
+	// RequestID is the server request the snapshot answers, empty when taken from the CLI
+	RequestID string         `json:"request_id,omitempty"`
+	TakenAt   time.Time      `json:"taken_at"`
+	Duration  time.Duration  `json:"duration_ns"`
+	Files     []SnapshotFile `json:"files"`
+	// Bundle is the tarball that was uploaded
+	Bundle []byte `json:"bundle,omitempty"`
+}
+
+// SnapshotFile describes one file of a snapshot bundle
+type SnapshotFile struct {
+	Name string `json:"name"`
+	// Source is the command or file the content came from
+	Source string `json:"source,omitempty"`
+	Size   int    `json:"size"`
+	// Truncated is set when output beyond max_file_kb was dropped
+	Truncated bool `json:"truncated,omitempty"`
+	// Error explains why the content is missing or incomplete
+	Error string `json:"error,omitempty"`
+}
+
+// snapshotSource is one file of a snapshot and the commands that can produce it, tried in
+// order until one succeeds
+type snapshotSource struct {
+	name     string
+	commands [][]string
+	// tail keeps only the last lines of the output, zero for all of it
+	tail int
+	// fallback produces the content in Go when none of the commands is available
+	fallback func() ([]byte, error)
+}
+
+// SnapshotService captures system snapshots requested by the server or the CLI and uploads
+// them as bundles
+type SnapshotService struct {
+	config   *config.Config
+	hostRid  string
+	stopChan chan bool
+	started  bool
+	// running allows one snapshot at a time
+	running chan struct{}
+
+	// requests remembers the snapshot requests between polls
+	requests commandInbox
+}
+
+// NewSnapshotService creates a new snapshot service
+func NewSnapshotService(cfg *config.Config, hostRid string) *SnapshotService {
+	return &SnapshotService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+		running:  make(chan struct{}, 1),
+	}
+}
+
+// Start begins polling the server for snapshot requests
+func (s *SnapshotService) Start() error {
+	if !s.config.Snapshot.Enabled {
+		log.Println("Snapshots not enabled - skipping")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping snapshots")
+		return nil
+	}
+
+	s.started = true
+	go s.pollLoop()
+
+	log.Printf("Snapshots started for host RID: %s", s.hostRid)
+	return nil
+}
+
+// Stop stops polling for snapshot requests
+func (s *SnapshotService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("Snapshots stopped")
+	}
+}
+
+// pollLoop checks for snapshot requests at the configured interval
+func (s *SnapshotService) pollLoop() {
+	defer recoverPanic("snapshot")
+	ticker := newReportTicker(s.config.Snapshot.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.poll()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// poll captures the snapshots the server requested
+func (s *SnapshotService) poll() {
+	ctx, cancel := context.WithTimeout(context.Background(), apiRequestTimeout)
+	var items []json.RawMessage
+	err := sendJSON(ctx, s.config, http.MethodGet, hostPath(s.hostRid, "/snapshots/requests"), nil, &items)
+	cancel()
+
+	var statusErr *apiStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		// Servers without snapshots
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to fetch snapshot requests: %v", err)
+		return
+	}
+
+	verifier, err := newCommandVerifier(s.config, s.hostRid)
+	if err != nil {
+		log.Printf("Cannot verify snapshot requests: %v", err)
+		return
+	}
+	receiveCommands(&s.requests, verifier, items, snapshotRequest.id, s.rejectUnverified, func(request snapshotRequest) bool {
+		log.Printf("Capturing snapshot %s requested by the server", request.ID)
+		action := startRemoteAction(s.config, ActionSnapshot)
+		action.RequestID, action.Requester = request.ID, request.RequestedBy
+		if _, err := s.capture(action, request.ID); err != nil {
+			log.Printf("Snapshot %s failed: %v", request.ID, err)
+		}
+		return true
+	})
+}
+
+// id returns the request ID
+func (r snapshotRequest) id() string { return r.ID }
+
+// rejectUnverified reports a snapshot request that is malformed or fails signature checks.
+// It is described by what it claims to be, which cannot be trusted.
+func (s *SnapshotService) rejectUnverified(item json.RawMessage, err error) {
+	var claimed snapshotRequest
+	json.Unmarshal(unverifiedPayload(item), &claimed)
+	log.Printf("Rejected snapshot request %q: %v", claimed.ID, err)
+
+	action := startRemoteAction(s.config, ActionSnapshot)
+	action.RequestID, action.Requester = claimed.ID, claimed.RequestedBy
+	action.reject(err)
+	raiseHealthEvent(healthCommandRejected, severityError, "snapshot", err.Error(), map[string]interface{}{
+		"request_id": claimed.ID,
+	})
+}
+
+// Capture takes and uploads a snapshot for the CLI, recorded in the action log as a local
+// request
+func (s *SnapshotService) Capture() (*Snapshot, error) {
+	if !s.config.Snapshot.Enabled {
+		return nil, errors.New("snapshots are disabled, set snapshot.enabled: true")
+	}
+	action := startRemoteAction(s.config, ActionSnapshot)
+	action.Server = localRequester
+	return s.capture(action, "")
+}
+
+// capture takes a snapshot, uploads it and records the outcome. A snapshot with missing
+// parts is still uploaded; only a failed upload fails the action.
+func (s *SnapshotService) capture(action *RemoteAction, requestID string) (*Snapshot, error) {
+	select {
+	case s.running <- struct{}{}:
+		defer func() { <-s.running }()
+	default:
+		err := errors.New("a snapshot is already being captured")
+		action.reject(err)
+		return nil, err
+	}
+
+	snapshot := s.take(requestID)
+	action.Args = map[string]string{"files": strconv.Itoa(len(snapshot.Files)), "bytes": strconv.Itoa(len(snapshot.Bundle))}
+
+	path := hostPath(s.hostRid, "/diagnostics/snapshots")
+	if requestID != "" {
+		path += "?request_id=" + url.QueryEscape(requestID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiRequestTimeout)
+	defer cancel()
+	err := sendBody(ctx, s.config, http.MethodPost, path, snapshot.Bundle, "application/gzip", idempotencyKey(http.MethodPost, path, snapshot.Bundle), nil)
+	if err != nil {
+		err = fmt.Errorf("failed to upload snapshot: %w", err)
+	}
+	action.finish(err)
+	return snapshot, err
+}
+
+// take runs the snapshot's commands and packs their output, with a manifest, into a
+// gzipped tarball
+func (s *SnapshotService) take(requestID string) *Snapshot {
+	snapshot := &Snapshot{RequestID: requestID, TakenAt: time.Now().UTC()}
+	limit := s.config.Snapshot.MaxFileKB << 10
+
+	var contents [][]byte
+	for _, source := range snapshotSources(s.config.Snapshot.DmesgLines) {
+		file, data := s.collect(source, limit)
+		snapshot.Files = append(snapshot.Files, file)
+		contents = append(contents, data)
+	}
+
+	var goroutines bytes.Buffer
+	file := SnapshotFile{Name: "agent-goroutines.txt", Source: "sprinter"}
+	if err := diagnostics.WriteGoroutines(&goroutines); err != nil {
+		file.Error = err.Error()
+	}
+	file.Size = goroutines.Len()
+	snapshot.Files = append(snapshot.Files, file)
+	contents = append(contents, goroutines.Bytes())
+	snapshot.Duration = time.Since(snapshot.TakenAt)
+
+	bundle, err := packSnapshot(snapshot, contents)
+	if err != nil {
+		// Only the manifest encoding can fail, and the files are still worth sending
+		log.Printf("Failed to pack snapshot: %v", err)
+	}
+	snapshot.Bundle = bundle
+	return snapshot
+}
+
+// collect produces one file of a snapshot, trying its commands in order and falling back
+// to Go when none of them is available
+func (s *SnapshotService) collect(source snapshotSource, limit int) (SnapshotFile, []byte) {
+	file := SnapshotFile{Name: source.name}
+	var failures []string
+	for _, command := range source.commands {
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.Snapshot.Timeout)
+		stdout, stderr := &cappedBuffer{limit: limit}, &cappedBuffer{limit: 4096}
+		end := &tailBuffer{limit: limit}
+		cmd, cancelCmd := execwrap.Command(ctx, execwrap.Options{}, command[0], command[1:]...)
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		if source.tail > 0 {
+			cmd.Stdout = end
+		}
+		cmd.WaitDelay = runbookWaitDelay
+		err := cmd.Run()
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", s.config.Snapshot.Timeout)
+		}
+		cancelCmd()
+		cancel()
+
+		data, truncated := stdout.buf, stdout.truncated
+		if source.tail > 0 {
+			// Dropped output only matters when it held some of the wanted lines
+			kept := end.bytes()
+			data = tailLines(kept, source.tail)
+			truncated = end.truncated && len(data) == len(kept)
+		}
+		if err != nil && len(data) == 0 {
+			if message := strings.TrimSpace(stderr.String()); message != "" {
+				err = fmt.Errorf("%v: %s", err, message)
+			}
+			failures = append(failures, fmt.Sprintf("%s: %v", command[0], err))
+			continue
+		}
+		file.Source, file.Size, file.Truncated = strings.Join(command, " "), len(data), truncated
+		if err != nil {
+			// Some tools, such as lsof, exit non-zero after printing most of their output,
+			// which is kept
+			file.Error = err.Error()
+		}
+		return file, data
+	}
+
+	if source.fallback != nil {
+		data, err := source.fallback()
+		if err == nil || len(data) > 0 {
+			if len(data) > limit {
+				data, file.Truncated = data[:limit], true
+			}
+			file.Source, file.Size = "sprinter", len(data)
+			if err != nil {
+				file.Error = err.Error()
+			}
+			return file, data
+		}
+		failures = append(failures, err.Error())
+	}
+	if len(failures) == 0 {
+		failures = append(failures, "not available on "+runtime.GOOS)
+	}
+	file.Error = strings.Join(failures, "; ")
+	return file, nil
+}
+
+// tailBuffer keeps the last limit bytes written to it and notes whether earlier ones were
+// dropped
+type tailBuffer struct {
+	buf       []byte
+	limit     int
+	truncated bool
+}
+
+// Write appends p, dropping the oldest bytes once twice the limit is held
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > 2*b.limit {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.limit:]...)
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+// bytes returns the last limit bytes written
+func (b *tailBuffer) bytes() []byte {
+	if len(b.buf) > b.limit {
+		b.truncated = true
+		return b.buf[len(b.buf)-b.limit:]
+	}
+	return b.buf
+}
+
+// tailLines returns the last n lines of data
+func tailLines(data []byte, n int) []byte {
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	start := end
+	for lines := 0; start > 0; start-- {
+		if data[start-1] == '\n' {
+			if lines++; lines == n {
+				break
+			}
+		}
+	}
+	return data[start:]
+}
+
+// packSnapshot writes the files and a manifest.json describing them into a gzipped
+// tarball. Files without content are only listed in the manifest.
+func packSnapshot(snapshot *Snapshot, contents [][]byte) ([]byte, error) {
+	hostname, _ := os.Hostname()
+	prefix := fmt.Sprintf("sprinter-snapshot-%s-%s", hostname, snapshot.TakenAt.Format("20060102T150405Z"))
+	manifest, manifestErr := json.MarshalIndent(snapshot, "", "  ")
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	write := func(name string, data []byte) error {
+		header := &tar.Header{
+			Name:    filepath.ToSlash(filepath.Join(prefix, name)),
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: snapshot.TakenAt,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	if manifestErr == nil {
+		if err := write("manifest.json", append(manifest, '\n')); err != nil {
+			return nil, err
+		}
+	}
+	for i, file := range snapshot.Files {
+		if contents[i] == nil {
+			continue
+		}
+		if err := write(file.Name, contents[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), manifestErr
+}
+
+// snapshotSources lists what a snapshot holds on this platform
+func snapshotSources(dmesgLines int) []snapshotSource {
+	if runtime.GOOS == "windows" {
+		return []snapshotSource{
+			{name: "processes.txt", commands: [][]string{{"tasklist", "/v"}}},
+			{name: "sockets.txt", commands: [][]string{{"netstat", "-ano"}}},
+			{name: "disks.txt", commands: [][]string{{"powershell", "-NoProfile", "-Command", "Get-PSDrive -PSProvider FileSystem | Format-Table -AutoSize"}}},
+		}
+	}
+	return []snapshotSource{
+		{name: "processes.txt", commands: [][]string{{"ps", "auxww"}}},
+		{name: "open-files.txt", commands: [][]string{{"lsof", "-n", "-P"}}, fallback: procOpenFiles},
+		{name: "sockets.txt", commands: [][]string{{"ss", "-tanup"}, {"netstat", "-an"}}},
+		{name: "dmesg.txt", tail: dmesgLines, commands: [][]string{
+			{"dmesg", "-T"},
+			{"journalctl", "-k", "-b", "--no-pager", "-n", strconv.Itoa(dmesgLines)},
+			{"dmesg"},
+		}},
+		{name: "df.txt", commands: [][]string{{"df", "-h"}}},
+		{name: "df-inodes.txt", commands: [][]string{{"df", "-i"}}},
+	}
+}
+
+// procOpenFiles lists the open files of every process from /proc, for hosts without lsof.
+// Processes the agent may not inspect are skipped.
+func procOpenFiles() ([]byte, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	fmt.Fprintln(&out, "PID\tCOMMAND\tFD\tTARGET")
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join("/proc", entry.Name())
+		comm, _ := os.ReadFile(filepath.Join(dir, "comm"))
+		fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(&out, "%d\t%s\t%s\t%s\n", pid, strings.TrimSpace(string(comm)), fd.Name(), target)
+		}
+	}
+	return out.Bytes(), nil
+}
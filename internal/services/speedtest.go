@@ -0,0 +1,159 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// speedTestTimeout bounds each direction of a throughput test on slow links
+const speedTestTimeout = time.Minute
+
+// ThroughputResult is the outcome of a throughput test between the agent and the server,
+// uploaded as a diagnostic artifact
+type ThroughputResult struct {
+	// RequestID is the server request the test answers, empty when run from the CLI
+	RequestID        string        `json:"request_id,omitempty"`
+	StartedAt        time.Time     `json:"started_at"`
+	Bytes            int64         `json:"bytes"`
+	DownloadBytes    int64         `json:"download_bytes"`
+	DownloadDuration time.Duration `json:"download_duration_ns"`
+	DownloadMbps     float64       `json:"download_mbps"`
+	UploadBytes      int64         `json:"upload_bytes"`
+	UploadDuration   time.Duration `json:"upload_duration_ns"`
+	UploadMbps       float64       `json:"upload_mbps"`
+	Error            string        `json:"error,omitempty"`
+}
+
+// SpeedTest measures download and upload throughput against the server's throughput
+// endpoint and uploads the result
+func (s *NetworkDiagnosticsService) SpeedTest() (*ThroughputResult, error) {
+	if !s.config.SpeedTest.Enabled {
+		return nil, errors.New("speed tests are disabled, set speed_test.enabled: true")
+	}
+	return s.runSpeedTest("")
+}
+
+// runSpeedTest runs and uploads a throughput test answering the request ID
+func (s *NetworkDiagnosticsService) runSpeedTest(requestID string) (*ThroughputResult, error) {
+	release, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	size := int64(s.config.SpeedTest.SizeMB) * 1024 * 1024
+	if size <= 0 {
+		size = 4 * 1024 * 1024
+	}
+	result := &ThroughputResult{RequestID: requestID, StartedAt: time.Now(), Bytes: size}
+
+	// Upload runs even when download fails; slow shipping is about the upload direction
+	var errs []string
+	if err := s.measureDownload(result); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := s.measureUpload(result); err != nil {
+		errs = append(errs, err.Error())
+	}
+	result.Error = strings.Join(errs, "; ")
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiRequestTimeout)
+	defer cancel()
+	if err := sendJSON(ctx, s.config, http.MethodPost, hostPath(s.hostRid, "/diagnostics/throughput/results"), result, nil); err != nil {
+		log.Printf("Failed to upload throughput result: %v", err)
+	}
+
+	if result.Error != "" {
+		return result, errors.New(result.Error)
+	}
+	log.Printf("Throughput test: %.1f Mbit/s down, %.1f Mbit/s up", result.DownloadMbps, result.UploadMbps)
+	return result, nil
+}
+
+// measureDownload fetches result.Bytes from the throughput endpoint
+func (s *NetworkDiagnosticsService) measureDownload(result *ThroughputResult) error {
+	ctx, cancel := context.WithTimeout(context.Background(), speedTestTimeout)
+	defer cancel()
+
+	url := s.throughputURL() + "?bytes=" + strconv.FormatInt(result.Bytes, 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create download request: %w", err)
+	}
+
+	start := time.Now()
+	resp, err := speedTestClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed with status: %d", resp.StatusCode)
+	}
+
+	result.DownloadBytes, err = io.Copy(io.Discard, io.LimitReader(resp.Body, result.Bytes))
+	result.DownloadDuration = time.Since(start)
+	result.DownloadMbps = mbps(result.DownloadBytes, result.DownloadDuration)
+	if err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+	return nil
+}
+
+// measureUpload sends result.Bytes of random data to the throughput endpoint. Random data
+// keeps compressing proxies from inflating the result.
+func (s *NetworkDiagnosticsService) measureUpload(result *ThroughputResult) error {
+	ctx, cancel := context.WithTimeout(context.Background(), speedTestTimeout)
+	defer cancel()
+
+	payload := make([]byte, result.Bytes)
+	if _, err := rand.Read(payload); err != nil {
+		return fmt.Errorf("failed to generate upload payload: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.throughputURL(), bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create upload request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	start := time.Now()
+	resp, err := speedTestClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload failed: %w", err)
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("upload failed with status: %d", resp.StatusCode)
+	}
+
+	result.UploadBytes = result.Bytes
+	result.UploadDuration = time.Since(start)
+	result.UploadMbps = mbps(result.UploadBytes, result.UploadDuration)
+	return nil
+}
+
+// throughputURL returns the server's throughput test endpoint for this host
+func (s *NetworkDiagnosticsService) throughputURL() string {
+	return strings.TrimRight(s.config.HostRegistration.SprinterURL, "/") + hostPath(s.hostRid, "/diagnostics/throughput")
+}
+
+// speedTestClient shares the API connection pool but not its short request timeout
+var speedTestClient = &http.Client{Transport: newAPIClient().Transport}
+
+// mbps converts bytes transferred in d to megabits per second
+func mbps(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) * 8 / d.Seconds() / 1e6
+}
@@ -0,0 +1,175 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Collector states reported in heartbeats and agent status
+const (
+	CollectorRunning  = "running"
+	CollectorDisabled = "disabled"
+	// CollectorSkipped means the collector cannot run at all with the agent's privileges or build
+	CollectorSkipped = "skipped"
+	// CollectorDegraded means the collector runs but some data is unavailable
+	CollectorDegraded = "degraded"
+	CollectorError    = "error"
+	// CollectorPaused means an operator paused the collector at runtime
+	CollectorPaused = "paused"
+)
+
+// CollectorStatus describes the state of a single collector
+type CollectorStatus struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Reason    string    `json:"reason,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// LastRun is when the collector last started or completed an iteration
+	LastRun *time.Time `json:"last_run,omitempty"`
+	// LastError is the collector's most recent collection or reporting failure, kept
+	// after later iterations succeed
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	// BackedOff is set while the collector is over its error budget and retries slowly
+	BackedOff bool `json:"backed_off,omitempty"`
+}
+
+var collectorStatuses = struct {
+	sync.Mutex
+	m map[string]CollectorStatus
+}{m: make(map[string]CollectorStatus)}
+
+// collectorActivity records when each collector last ran and last failed
+var collectorActivity = struct {
+	sync.Mutex
+	m map[string]collectorRun
+}{m: make(map[string]collectorRun)}
+
+// collectorRun is a collector's last iteration and last failure
+type collectorRun struct {
+	last      time.Time
+	lastError string
+	errorAt   time.Time
+}
+
+// recordCollectorRun records a completed collector iteration
+func recordCollectorRun(name string) {
+	collectorActivity.Lock()
+	defer collectorActivity.Unlock()
+	run := collectorActivity.m[name]
+	run.last = time.Now().UTC()
+	collectorActivity.m[name] = run
+}
+
+// recordCollectorError records a failure to collect or report, shown by the status command
+// and counted against the collector's error budget
+func recordCollectorError(name string, err error) {
+	collectorActivity.Lock()
+	run := collectorActivity.m[name]
+	run.lastError = err.Error()
+	run.errorAt = time.Now().UTC()
+	collectorActivity.m[name] = run
+	collectorActivity.Unlock()
+
+	chargeErrorBudget(name, err)
+}
+
+// setCollectorStatus records a collector's state and reports whether it changed; a
+// collector entering the error state raises an agent health event
+func setCollectorStatus(name, state, reason string) bool {
+	collectorStatuses.Lock()
+	prev, ok := collectorStatuses.m[name]
+	if ok && prev.State == state && prev.Reason == reason {
+		collectorStatuses.Unlock()
+		return false
+	}
+	collectorStatuses.m[name] = CollectorStatus{
+		Name:      name,
+		State:     state,
+		Reason:    reason,
+		UpdatedAt: time.Now().UTC(),
+	}
+	collectorStatuses.Unlock()
+
+	if state == CollectorError && prev.State != CollectorError {
+		raiseHealthEvent(healthCollectorFailed, severityError, name, reason, nil)
+	}
+	return true
+}
+
+// setPermissionProblem records that a collector is skipped or degraded for lack of
+// privileges and reports whether its state changed; a change raises an agent health event
+func setPermissionProblem(name, state, reason string) bool {
+	if !setCollectorStatus(name, state, reason) {
+		return false
+	}
+	raiseHealthEvent(healthPermissionDenied, severityWarning, name, reason, map[string]interface{}{"state": state})
+	return true
+}
+
+// collectorState returns the current state of a collector, empty if it never reported one
+func collectorState(name string) string {
+	collectorStatuses.Lock()
+	defer collectorStatuses.Unlock()
+	return collectorStatuses.m[name].State
+}
+
+// CollectorStatuses returns the state of every collector, sorted by name
+func CollectorStatuses() []CollectorStatus {
+	collectorStatuses.Lock()
+	defer collectorStatuses.Unlock()
+
+	collectorActivity.Lock()
+	defer collectorActivity.Unlock()
+
+	statuses := make([]CollectorStatus, 0, len(collectorStatuses.m))
+	for _, status := range collectorStatuses.m {
+		if run, ok := collectorActivity.m[status.Name]; ok {
+			if !run.last.IsZero() {
+				last := run.last
+				status.LastRun = &last
+			}
+			if run.lastError != "" {
+				errorAt := run.errorAt
+				status.LastError, status.LastErrorAt = run.lastError, &errorAt
+			}
+		}
+		_, status.BackedOff = collectorBackoff(status.Name)
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// isPermissionError reports whether err stems from insufficient privileges
+func isPermissionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, os.ErrPermission) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "permission denied") || strings.Contains(msg, "operation not permitted") ||
+		strings.Contains(msg, "access denied") || strings.Contains(msg, "must be root") {
+		return true
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		stderr := strings.ToLower(string(exitErr.Stderr))
+		return strings.Contains(stderr, "permission denied") || strings.Contains(stderr, "operation not permitted")
+	}
+	return false
+}
+
+// isPrivileged reports whether the agent runs as root
+func isPrivileged() bool {
+	return os.Geteuid() == 0
+}
@@ -0,0 +1,273 @@
+//go:build !minimal && !no_storage
+
+package services
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ZFSPool is the health, capacity and device tree of a zpool
+type ZFSPool struct {
+	Name            string `json:"name"`
+	Health          string `json:"health"`
+	SizeBytes       uint64 `json:"size_bytes"`
+	AllocatedBytes  uint64 `json:"allocated_bytes"`
+	FreeBytes       uint64 `json:"free_bytes"`
+	CapacityPercent int    `json:"capacity_percent"`
+	// FragmentationPercent is absent for pools that do not track it
+	FragmentationPercent *int `json:"fragmentation_percent,omitempty"`
+	// Scan is zpool status's line on the last or running scrub or resilver
+	Scan string `json:"scan,omitempty"`
+	// ScrubErrors is how many errors the last completed scrub found
+	ScrubErrors *int `json:"scrub_errors,omitempty"`
+	// Errors is zpool status's summary of data errors, "No known data errors" when healthy
+	Errors string    `json:"errors,omitempty"`
+	Vdevs  []ZFSVdev `json:"vdevs"`
+}
+
+// ZFSVdev is a device, or a group of devices such as a mirror, in a pool
+type ZFSVdev struct {
+	Name string `json:"name"`
+	// Parent is the group the device belongs to, such as mirror-0 or cache; empty at the top
+	Parent      string `json:"parent,omitempty"`
+	State       string `json:"state"`
+	ReadErrors  uint64 `json:"read_errors"`
+	WriteErrors uint64 `json:"write_errors"`
+	CksumErrors uint64 `json:"checksum_errors"`
+	// Note is what zpool status says about the device, such as "cannot open"
+	Note string `json:"note,omitempty"`
+}
+
+// VolumeGroup is the usage of an LVM volume group and its logical volumes
+type VolumeGroup struct {
+	Name      string `json:"name"`
+	SizeBytes uint64 `json:"size_bytes"`
+	FreeBytes uint64 `json:"free_bytes"`
+	// Partial is set when physical volumes of the group are missing
+	Partial bool            `json:"partial,omitempty"`
+	Volumes []LogicalVolume `json:"volumes"`
+}
+
+// LogicalVolume is an LVM logical volume. Thin pools carry their usage and how far the
+// thin volumes in them are overcommitted.
+type LogicalVolume struct {
+	Name      string `json:"name"`
+	Attr      string `json:"attr"`
+	SizeBytes uint64 `json:"size_bytes"`
+	Type      string `json:"type"`
+	// Pool is the thin pool a thin volume allocates from
+	Pool string `json:"pool,omitempty"`
+	// Health is lvs's health flag spelt out, such as "partial" or "mismatches exist"; empty
+	// when healthy
+	Health          string   `json:"health,omitempty"`
+	DataPercent     *float64 `json:"data_percent,omitempty"`
+	MetadataPercent *float64 `json:"metadata_percent,omitempty"`
+	// VirtualBytes is the total size of the thin volumes in a thin pool, and Overcommit
+	// its ratio to the pool size
+	VirtualBytes uint64   `json:"virtual_bytes,omitempty"`
+	Overcommit   *float64 `json:"overcommit,omitempty"`
+}
+
+// lvHealthFlags spells out the ninth character of lv_attr
+var lvHealthFlags = map[byte]string{
+	'p': "partial",
+	'r': "refresh needed",
+	'm': "mismatches exist",
+	'w': "writemostly",
+	'X': "unknown",
+	'D': "dead",
+	'E': "metadata errors",
+	'F': "failed",
+	'M': "out of metadata space",
+}
+
+// zfsHealthyStates are the vdev states that need no attention
+var zfsHealthyStates = map[string]bool{"ONLINE": true, "AVAIL": true, "INUSE": true}
+
+// scrubErrorsPattern finds the error count of a completed scrub
+var scrubErrorsPattern = regexp.MustCompile(`^scrub repaired .* with (\d+) errors`)
+
+// parseZpoolList parses zpool list -Hp -o name,size,alloc,free,frag,cap,health
+func parseZpoolList(output string) []ZFSPool {
+	var pools []ZFSPool
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 7 {
+			continue
+		}
+		pool := ZFSPool{Name: fields[0], Health: fields[6], Vdevs: []ZFSVdev{}}
+		pool.SizeBytes, _ = strconv.ParseUint(fields[1], 10, 64)
+		pool.AllocatedBytes, _ = strconv.ParseUint(fields[2], 10, 64)
+		pool.FreeBytes, _ = strconv.ParseUint(fields[3], 10, 64)
+		if frag, err := strconv.Atoi(strings.TrimSuffix(fields[4], "%")); err == nil {
+			pool.FragmentationPercent = &frag
+		}
+		pool.CapacityPercent, _ = strconv.Atoi(strings.TrimSuffix(fields[5], "%"))
+		pools = append(pools, pool)
+	}
+	return pools
+}
+
+// zpoolStatus is what zpool status says about one pool
+type zpoolStatus struct {
+	scan   string
+	errors string
+	vdevs  []ZFSVdev
+}
+
+// parseZpoolStatus parses zpool status -p for every pool, keyed by pool name
+func parseZpoolStatus(output string) map[string]zpoolStatus {
+	result := make(map[string]zpoolStatus)
+	var pool string
+	var status zpoolStatus
+	inConfig := false
+	// parents holds the group at each indentation depth of the device tree
+	var parents []string
+	flush := func() {
+		if pool != "" {
+			result[pool] = status
+		}
+		status = zpoolStatus{}
+		inConfig = false
+		parents = nil
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if name, ok := strings.CutPrefix(trimmed, "pool:"); ok {
+			flush()
+			pool = strings.TrimSpace(name)
+			continue
+		}
+		if scan, ok := strings.CutPrefix(trimmed, "scan:"); ok {
+			status.scan = strings.TrimSpace(scan)
+			continue
+		}
+		if errs, ok := strings.CutPrefix(trimmed, "errors:"); ok {
+			status.errors = strings.TrimSpace(errs)
+			inConfig = false
+			continue
+		}
+		if trimmed == "config:" {
+			inConfig = true
+			continue
+		}
+		if !inConfig || trimmed == "" {
+			continue
+		}
+
+		fields := strings.Fields(trimmed)
+		if fields[0] == "NAME" {
+			continue
+		}
+		// The tree is indented by two spaces per level below a tab. The pool and the
+		// logs, cache and spares headings are at the top.
+		indented := strings.TrimLeft(line, "\t")
+		depth := (len(indented) - len(strings.TrimLeft(indented, " "))) / 2
+		for len(parents) < depth {
+			parents = append(parents, "")
+		}
+		parents = append(parents[:depth], fields[0])
+		if depth == 0 || len(fields) < 2 {
+			continue
+		}
+		vdev := ZFSVdev{Name: fields[0], Parent: parents[depth-1]}
+		if vdev.Parent == pool {
+			vdev.Parent = ""
+		}
+		vdev.State = fields[1]
+		if len(fields) >= 5 {
+			vdev.ReadErrors, _ = strconv.ParseUint(fields[2], 10, 64)
+			vdev.WriteErrors, _ = strconv.ParseUint(fields[3], 10, 64)
+			vdev.CksumErrors, _ = strconv.ParseUint(fields[4], 10, 64)
+			vdev.Note = strings.Join(fields[5:], " ")
+		}
+		status.vdevs = append(status.vdevs, vdev)
+	}
+	flush()
+	return result
+}
+
+// scrubErrors returns the errors found by the completed scrub a scan line describes
+func scrubErrors(scan string) *int {
+	match := scrubErrorsPattern.FindStringSubmatch(scan)
+	if match == nil {
+		return nil
+	}
+	errors, err := strconv.Atoi(match[1])
+	if err != nil {
+		return nil
+	}
+	return &errors
+}
+
+// parseVGs parses vgs --noheadings --units b --nosuffix --separator '|' -o
+// vg_name,vg_size,vg_free,vg_attr
+func parseVGs(output string) []VolumeGroup {
+	var groups []VolumeGroup
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) < 4 {
+			continue
+		}
+		group := VolumeGroup{Name: fields[0], Volumes: []LogicalVolume{}}
+		group.SizeBytes, _ = strconv.ParseUint(fields[1], 10, 64)
+		group.FreeBytes, _ = strconv.ParseUint(fields[2], 10, 64)
+		// The fourth attribute character is p for a partial group
+		group.Partial = len(fields[3]) > 3 && fields[3][3] == 'p'
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// parseLVs parses lvs --noheadings --units b --nosuffix --separator '|' -o
+// vg_name,lv_name,lv_attr,lv_size,segtype,pool_lv,data_percent,metadata_percent and adds
+// the volumes to their groups, working out the overcommit of each thin pool
+func parseLVs(output string, groups []VolumeGroup) {
+	index := make(map[string]int, len(groups))
+	for i, group := range groups {
+		index[group.Name] = i
+	}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) < 8 {
+			continue
+		}
+		i, ok := index[fields[0]]
+		if !ok {
+			continue
+		}
+		volume := LogicalVolume{Name: fields[1], Attr: fields[2], Type: fields[4], Pool: fields[5]}
+		volume.SizeBytes, _ = strconv.ParseUint(fields[3], 10, 64)
+		if len(volume.Attr) > 8 {
+			volume.Health = lvHealthFlags[volume.Attr[8]]
+		}
+		if percent, err := strconv.ParseFloat(fields[6], 64); err == nil {
+			volume.DataPercent = &percent
+		}
+		if percent, err := strconv.ParseFloat(fields[7], 64); err == nil {
+			volume.MetadataPercent = &percent
+		}
+		groups[i].Volumes = append(groups[i].Volumes, volume)
+	}
+
+	for g := range groups {
+		volumes := groups[g].Volumes
+		virtual := make(map[string]uint64)
+		for _, volume := range volumes {
+			if volume.Pool != "" && volume.Type == "thin" {
+				virtual[volume.Pool] += volume.SizeBytes
+			}
+		}
+		for v := range volumes {
+			if volumes[v].Type != "thin-pool" || volumes[v].SizeBytes == 0 {
+				continue
+			}
+			volumes[v].VirtualBytes = virtual[volumes[v].Name]
+			ratio := float64(volumes[v].VirtualBytes) / float64(volumes[v].SizeBytes)
+			volumes[v].Overcommit = &ratio
+		}
+	}
+}
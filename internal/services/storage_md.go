@@ -0,0 +1,154 @@
+//go:build !minimal && !no_storage
+
+package services
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// mdstatPath lists the software RAID arrays the kernel runs
+const mdstatPath = "/proc/mdstat"
+
+// MDArray is the health of a Linux software RAID array
+type MDArray struct {
+	Name  string `json:"name"`
+	Level string `json:"level"`
+	// State is mdadm's state, such as "clean, degraded, recovering", or "active" or
+	// "inactive" from /proc/mdstat when mdadm cannot be run
+	State string `json:"state"`
+	// Devices is how many members the array needs and ActiveDevices how many it has
+	Devices       int  `json:"devices"`
+	ActiveDevices int  `json:"active_devices"`
+	Degraded      bool `json:"degraded"`
+	// SyncAction is the resync, recovery, reshape or check in progress, with its progress
+	SyncAction    string     `json:"sync_action,omitempty"`
+	SyncPercent   *float64   `json:"sync_percent,omitempty"`
+	SyncFinish    string     `json:"sync_finish,omitempty"`
+	SyncSpeedKBps int        `json:"sync_speed_kbps,omitempty"`
+	Members       []MDMember `json:"members"`
+}
+
+// MDMember is a device of an array
+type MDMember struct {
+	Device string `json:"device"`
+	// State is "active", "spare", "faulty" or mdadm's state, such as "spare rebuilding"
+	State string `json:"state"`
+}
+
+var (
+	// mdstatArrayLine starts an array's entry, e.g. "md0 : active raid1 sdc1[2] sdb1[0](F)"
+	mdstatArrayLine = regexp.MustCompile(`^(md\S+) : (\S+)(?: \((?:auto-)?read-only\))? (.*)$`)
+	// mdstatCounts is the needed and active member counts, e.g. "[2/1] [U_]"
+	mdstatCounts = regexp.MustCompile(`\[(\d+)/(\d+)\]`)
+	// mdstatProgress is a running resync or recovery, e.g.
+	// "recovery = 24.3% (254848/1046528) finish=0.2min speed=50962K/sec"
+	mdstatProgress = regexp.MustCompile(`(resync|recovery|reshape|check|repair)\s*=\s*([\d.]+)%.*?finish=(\S+)\s+speed=(\d+)K/sec`)
+	// mdstatMember is a member device with its role number and flags
+	mdstatMember = regexp.MustCompile(`^(\S+)\[\d+\](\([A-Z]\))*$`)
+)
+
+// parseMDStat parses /proc/mdstat
+func parseMDStat(content string) []MDArray {
+	var arrays []MDArray
+	var current *MDArray
+	for _, line := range strings.Split(content, "\n") {
+		if match := mdstatArrayLine.FindStringSubmatch(line); match != nil {
+			arrays = append(arrays, MDArray{Name: match[1], State: match[2], Members: []MDMember{}})
+			current = &arrays[len(arrays)-1]
+			for i, field := range strings.Fields(match[3]) {
+				member := mdstatMember.FindStringSubmatch(field)
+				if member == nil {
+					// The level comes before the members, and is absent from an inactive array
+					if i == 0 {
+						current.Level = field
+					}
+					continue
+				}
+				state := "active"
+				switch {
+				case strings.Contains(field, "(F)"):
+					state = "faulty"
+				case strings.Contains(field, "(S)"):
+					state = "spare"
+				}
+				current.Members = append(current.Members, MDMember{Device: member[1], State: state})
+			}
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		if match := mdstatCounts.FindStringSubmatch(line); match != nil {
+			current.Devices, _ = strconv.Atoi(match[1])
+			current.ActiveDevices, _ = strconv.Atoi(match[2])
+			current.Degraded = current.ActiveDevices < current.Devices
+		}
+		if match := mdstatProgress.FindStringSubmatch(line); match != nil {
+			current.SyncAction = match[1]
+			if percent, err := strconv.ParseFloat(match[2], 64); err == nil {
+				current.SyncPercent = &percent
+			}
+			current.SyncFinish = match[3]
+			current.SyncSpeedKBps, _ = strconv.Atoi(match[4])
+		}
+		if strings.TrimSpace(line) == "" {
+			current = nil
+		}
+	}
+	return arrays
+}
+
+// mdstatFingerprint is /proc/mdstat without the progress of running resyncs, so it only
+// changes when an array or member does
+func mdstatFingerprint(content string) string {
+	var kept []string
+	for _, line := range strings.Split(content, "\n") {
+		if !mdstatProgress.MatchString(line) {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// applyMDDetail refines an array with mdadm --detail, which names the state of each
+// member, such as "spare rebuilding", and the array's state, such as "clean, degraded"
+func applyMDDetail(array *MDArray, output string) {
+	inDevices := false
+	var members []MDMember
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if inDevices {
+			fields := strings.Fields(trimmed)
+			// Number Major Minor RaidDevice State... Device; removed slots have no device
+			if len(fields) < 6 || !strings.HasPrefix(fields[len(fields)-1], "/dev/") {
+				continue
+			}
+			members = append(members, MDMember{
+				Device: strings.TrimPrefix(fields[len(fields)-1], "/dev/"),
+				State:  strings.Join(fields[4:len(fields)-1], " "),
+			})
+			continue
+		}
+		if strings.HasPrefix(trimmed, "Number") && strings.Contains(trimmed, "RaidDevice") {
+			inDevices = true
+			continue
+		}
+		key, value, ok := strings.Cut(trimmed, " : ")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "State":
+			array.State = value
+			array.Degraded = strings.Contains(value, "degraded")
+		case "Raid Level":
+			array.Level = value
+		}
+	}
+	if len(members) > 0 {
+		array.Members = members
+	}
+}
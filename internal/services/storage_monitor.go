@@ -0,0 +1,457 @@
+//go:build !minimal && !no_storage
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/schedule"
+)
+
+// StorageReport is the payload sent to the storage endpoint
+type StorageReport struct {
+	Pools        []ZFSPool     `json:"zfs_pools,omitempty"`
+	VolumeGroups []VolumeGroup `json:"volume_groups,omitempty"`
+	MDArrays     []MDArray     `json:"md_arrays,omitempty"`
+}
+
+// StorageEvent is a change in the condition of a pool, device or volume between two polls,
+// such as a vdev going FAULTED or a thin pool filling up
+type StorageEvent struct {
+	EventID string `json:"event_id"`
+	// Subject is what changed, such as "zpool tank", "vdev tank/sdb", "lv vg0/pool" or
+	// "md md0/sdb1"
+	Subject  string `json:"subject"`
+	Check    string `json:"check"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Severity string `json:"severity"`
+	// Message says what happened in one line
+	Message     string `json:"message"`
+	Timestamp   string `json:"timestamp"`
+	Maintenance string `json:"maintenance,omitempty"`
+	EventOccurrences
+}
+
+// StorageEventsReport is the payload sent to the storage events endpoint
+type StorageEventsReport struct {
+	Events []StorageEvent `json:"events"`
+}
+
+// storageCondition is the state of one check of one subject; a change raises an event
+type storageCondition struct {
+	subject  string
+	check    string
+	state    string
+	severity string
+	message  string
+}
+
+// StorageMonitorService reports ZFS pool, LVM volume and software RAID health and usage,
+// raising events when a pool or array degrades, a scrub finds errors or a pool or thin
+// pool fills up
+type StorageMonitorService struct {
+	config   *config.Config
+	hostRid  string
+	stopChan chan bool
+	started  bool
+	// last holds the conditions of the previous poll, keyed by subject and check
+	last          map[string]storageCondition
+	dedup         *eventDeduper[StorageEvent]
+	pendingEvents []StorageEvent
+	// mdstat is the fingerprint of /proc/mdstat at the last poll
+	mdstat string
+}
+
+// NewStorageMonitorService creates a new storage monitor service
+func NewStorageMonitorService(cfg *config.Config, hostRid string) *StorageMonitorService {
+	return &StorageMonitorService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+		dedup:    newEventDeduper[StorageEvent](dedupWindow(cfg)),
+	}
+}
+
+// init registers the collector, unless built with no_storage
+func init() {
+	registerCollector("storage", func(m *CollectorManager, c *config.Config) Collector {
+		return NewStorageMonitorService(c, m.hostRid)
+	})
+}
+
+// Start begins polling storage health periodically
+func (s *StorageMonitorService) Start() error {
+	if !s.config.Storage.Enabled {
+		log.Println("Storage collector not enabled - skipping")
+		setCollectorStatus("storage", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping storage collector")
+		return nil
+	}
+	_, zfsErr := exec.LookPath("zpool")
+	_, lvmErr := exec.LookPath("lvs")
+	_, mdErr := os.Stat(hostFile(mdstatPath))
+	if zfsErr != nil && lvmErr != nil && mdErr != nil {
+		log.Println("No zpool, lvs or /proc/mdstat found - skipping storage collector")
+		setCollectorStatus("storage", CollectorSkipped, "no zpool, lvs or /proc/mdstat found")
+		return nil
+	}
+
+	s.started = true
+	go s.monitorLoop()
+
+	setCollectorStatus("storage", CollectorRunning, "")
+	log.Println("Storage collector started")
+	return nil
+}
+
+// Stop stops the collector
+func (s *StorageMonitorService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("Storage collector stopped")
+	}
+}
+
+// monitorLoop polls at the configured interval, and as soon as /proc/mdstat shows a
+// changed array so a failed RAID member is reported without waiting for the next poll
+func (s *StorageMonitorService) monitorLoop() {
+	defer recoverPanic("storage")
+	ticker := newCollectorTicker("storage", s.config.Storage.Interval)
+	defer ticker.Stop()
+	mdTicker := schedule.NewTicker(s.config.Storage.MDStatInterval)
+	defer mdTicker.Stop()
+
+	markProgress("storage", s.config.Storage.Interval)
+	s.poll()
+	if finishedOnce("storage") {
+		return
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			s.poll()
+			markProgress("storage", s.config.Storage.Interval)
+		case <-mdTicker.C:
+			if data, err := os.ReadFile(hostFile(mdstatPath)); err == nil && mdstatFingerprint(string(data)) != s.mdstat {
+				s.poll()
+			}
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// poll collects ZFS and LVM state, reports it and raises events for what changed
+func (s *StorageMonitorService) poll() {
+	var report StorageReport
+	var problems []string
+	permission := false
+	if _, err := exec.LookPath("zpool"); err == nil {
+		pools, err := collectZFS()
+		if err != nil {
+			problems = append(problems, err.Error())
+			permission = permission || isPermissionError(err)
+		}
+		report.Pools = pools
+	}
+	if _, err := exec.LookPath("lvs"); err == nil {
+		groups, err := collectLVM()
+		if err != nil {
+			problems = append(problems, err.Error())
+			permission = permission || isPermissionError(err)
+		}
+		report.VolumeGroups = groups
+	}
+	if data, err := os.ReadFile(hostFile(mdstatPath)); err == nil {
+		s.mdstat = mdstatFingerprint(string(data))
+		arrays, err := collectMD(string(data))
+		if err != nil {
+			problems = append(problems, err.Error())
+			permission = permission || isPermissionError(err)
+		}
+		report.MDArrays = arrays
+	}
+
+	switch {
+	case len(problems) == 0:
+		setCollectorStatus("storage", CollectorRunning, "")
+	case permission:
+		if setPermissionProblem("storage", CollectorDegraded, strings.Join(problems, "; ")) {
+			log.Printf("Storage collector degraded due to permissions: %s", strings.Join(problems, "; "))
+		}
+	default:
+		err := fmt.Errorf("%s", strings.Join(problems, "; "))
+		log.Printf("Failed to collect storage health: %v", err)
+		setCollectorStatus("storage", CollectorError, err.Error())
+		recordCollectorError("storage", err)
+	}
+	// With nothing collected the conditions are unknown, not healthy
+	if len(problems) > 0 && len(report.Pools) == 0 && len(report.VolumeGroups) == 0 && len(report.MDArrays) == 0 {
+		return
+	}
+
+	if err := submitReport(context.Background(), s.config, http.MethodPut, hostPath(s.hostRid, "/storage"), report); err != nil {
+		log.Printf("Failed to report storage health: %v", err)
+		recordCollectorError("storage", err)
+	}
+	s.reportChanges(storageConditions(&s.config.Storage, report))
+}
+
+// collectZFS reads the capacity and health of every pool and its device tree
+func collectZFS() ([]ZFSPool, error) {
+	output, err := runStorageCommand("zpool", "list", "-Hp", "-o", "name,size,alloc,free,frag,cap,health")
+	if err != nil {
+		return nil, err
+	}
+	pools := parseZpoolList(output)
+	if len(pools) == 0 {
+		return nil, nil
+	}
+	output, err = runStorageCommand("zpool", "status", "-p")
+	if err != nil {
+		return pools, err
+	}
+	statuses := parseZpoolStatus(output)
+	for i := range pools {
+		status := statuses[pools[i].Name]
+		pools[i].Scan = status.scan
+		pools[i].ScrubErrors = scrubErrors(status.scan)
+		pools[i].Errors = status.errors
+		if status.vdevs != nil {
+			pools[i].Vdevs = status.vdevs
+		}
+	}
+	return pools, nil
+}
+
+// collectLVM reads the volume groups and their logical volumes
+func collectLVM() ([]VolumeGroup, error) {
+	args := []string{"--noheadings", "--units", "b", "--nosuffix", "--separator", "|"}
+	output, err := runStorageCommand("vgs", append(args, "-o", "vg_name,vg_size,vg_free,vg_attr")...)
+	if err != nil {
+		return nil, err
+	}
+	groups := parseVGs(output)
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	output, err = runStorageCommand("lvs", append(args, "-o", "vg_name,lv_name,lv_attr,lv_size,segtype,pool_lv,data_percent,metadata_percent")...)
+	if err != nil {
+		return groups, err
+	}
+	parseLVs(output, groups)
+	return groups, nil
+}
+
+// collectMD reads the arrays in /proc/mdstat, refined by mdadm --detail where mdadm is
+// installed. mdadm needs root; without it the arrays are still reported from mdstat.
+func collectMD(mdstat string) ([]MDArray, error) {
+	arrays := parseMDStat(mdstat)
+	if len(arrays) == 0 {
+		return nil, nil
+	}
+	if _, err := exec.LookPath("mdadm"); err != nil {
+		return arrays, nil
+	}
+	for i := range arrays {
+		if arrays[i].State == "inactive" {
+			continue
+		}
+		output, err := runStorageCommand("mdadm", "--detail", "/dev/"+arrays[i].Name)
+		if err != nil {
+			return arrays, err
+		}
+		applyMDDetail(&arrays[i], output)
+	}
+	return arrays, nil
+}
+
+// storageConditions derives the condition of every check from a report
+func storageConditions(cfg *config.StorageConfig, report StorageReport) map[string]storageCondition {
+	conditions := make(map[string]storageCondition)
+	add := func(subject, check, state, severity, message string) {
+		conditions[subject+"\x00"+check] = storageCondition{subject, check, state, severity, message}
+	}
+	// usage is "high" above the warning threshold and "ok" below it
+	usage := func(subject, check, what string, percent float64) {
+		if cfg.CapacityWarning > 0 && percent >= float64(cfg.CapacityWarning) {
+			add(subject, check, "high", severityWarning, fmt.Sprintf("%s %s is %.0f%% full", subject, what, percent))
+		} else {
+			add(subject, check, "ok", severityInfo, fmt.Sprintf("%s %s is below %d%%", subject, what, cfg.CapacityWarning))
+		}
+	}
+
+	for _, pool := range report.Pools {
+		subject := "zpool " + pool.Name
+		severity := severityError
+		switch pool.Health {
+		case "ONLINE":
+			severity = severityInfo
+		case "DEGRADED":
+			severity = severityWarning
+		}
+		add(subject, "health", pool.Health, severity, fmt.Sprintf("%s is %s", subject, pool.Health))
+		usage(subject, "capacity", "capacity", float64(pool.CapacityPercent))
+		if pool.ScrubErrors != nil {
+			if *pool.ScrubErrors > 0 {
+				add(subject, "scrub", "errors", severityError, fmt.Sprintf("scrub of %s found %d errors", subject, *pool.ScrubErrors))
+			} else {
+				add(subject, "scrub", "ok", severityInfo, fmt.Sprintf("scrub of %s found no errors", subject))
+			}
+		}
+		for _, vdev := range pool.Vdevs {
+			name := "vdev " + pool.Name + "/" + vdev.Name
+			severity := severityInfo
+			switch {
+			case vdev.State == "DEGRADED":
+				severity = severityWarning
+			case !zfsHealthyStates[vdev.State]:
+				severity = severityError
+			}
+			message := fmt.Sprintf("%s is %s", name, vdev.State)
+			if vdev.Note != "" {
+				message += ": " + vdev.Note
+			}
+			add(name, "state", vdev.State, severity, message)
+		}
+	}
+
+	for _, group := range report.VolumeGroups {
+		subject := "vg " + group.Name
+		if group.Partial {
+			add(subject, "health", "partial", severityError, subject+" is missing physical volumes")
+		} else {
+			add(subject, "health", "ok", severityInfo, subject+" has all its physical volumes")
+		}
+		for _, volume := range group.Volumes {
+			name := "lv " + group.Name + "/" + volume.Name
+			if volume.Health != "" {
+				add(name, "health", volume.Health, severityError, fmt.Sprintf("%s is %s", name, volume.Health))
+			} else {
+				add(name, "health", "ok", severityInfo, name+" is healthy")
+			}
+			if volume.Type != "thin-pool" {
+				continue
+			}
+			if volume.DataPercent != nil {
+				usage(name, "data", "data", *volume.DataPercent)
+			}
+			if volume.MetadataPercent != nil {
+				usage(name, "metadata", "metadata", *volume.MetadataPercent)
+			}
+			if volume.Overcommit != nil && cfg.ThinOvercommit > 0 {
+				if *volume.Overcommit > cfg.ThinOvercommit {
+					add(name, "overcommit", "high", severityWarning, fmt.Sprintf("thin volumes in %s may grow to %.1f times its size", name, *volume.Overcommit))
+				} else {
+					add(name, "overcommit", "ok", severityInfo, fmt.Sprintf("thin volumes in %s are within %.1f times its size", name, cfg.ThinOvercommit))
+				}
+			}
+		}
+	}
+
+	for _, array := range report.MDArrays {
+		subject := "md " + array.Name
+		switch {
+		case array.State == "inactive":
+			add(subject, "health", "inactive", severityError, subject+" is inactive")
+		case array.Degraded:
+			add(subject, "health", "degraded", severityError, fmt.Sprintf("%s is degraded, %d of %d devices active", subject, array.ActiveDevices, array.Devices))
+		default:
+			add(subject, "health", "ok", severityInfo, subject+" has all its devices")
+		}
+		if array.SyncAction != "" {
+			add(subject, "sync", array.SyncAction, severityInfo, fmt.Sprintf("%s started a %s", subject, array.SyncAction))
+		} else {
+			add(subject, "sync", "idle", severityInfo, subject+" is in sync")
+		}
+		for _, member := range array.Members {
+			name := subject + "/" + member.Device
+			severity := severityInfo
+			if strings.Contains(member.State, "faulty") {
+				severity = severityError
+			}
+			add(name, "state", member.State, severity, fmt.Sprintf("%s is %s", name, member.State))
+		}
+	}
+	return conditions
+}
+
+// reportChanges sends an event for every condition that changed since the previous poll.
+// Subjects that appear or disappear, such as an imported or destroyed pool, raise none;
+// they show in the storage report.
+func (s *StorageMonitorService) reportChanges(current map[string]storageCondition) {
+	previous := s.last
+	s.last = current
+	if previous == nil {
+		return
+	}
+
+	now := time.Now()
+	events := []StorageEvent{}
+	for key, condition := range current {
+		before, ok := previous[key]
+		if !ok || before.state == condition.state {
+			continue
+		}
+		event := StorageEvent{
+			Subject:     condition.subject,
+			Check:       condition.check,
+			From:        before.state,
+			To:          condition.state,
+			Severity:    condition.severity,
+			Message:     condition.message,
+			Timestamp:   now.UTC().Format(time.RFC3339),
+			Maintenance: maintenanceTag(now),
+		}
+		event.EventID = eventID("storage", condition.subject, condition.check, before.state, condition.state, now.UTC().Format(time.RFC3339Nano))
+		if s.dedup.Observe(key+"\x00"+before.state+"\x00"+condition.state, event, now) {
+			events = append(events, event)
+		}
+	}
+	for _, summary := range s.dedup.Flush(now) {
+		event := summary.Event
+		event.EventOccurrences = summary.occurrences()
+		events = append(events, event)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Subject != events[j].Subject {
+			return events[i].Subject < events[j].Subject
+		}
+		return events[i].Check < events[j].Check
+	})
+	events = append(s.pendingEvents, events...)
+	if len(events) == 0 {
+		return
+	}
+
+	reqBody := StorageEventsReport{Events: events}
+	if err := submitReport(context.Background(), s.config, http.MethodPost, hostPath(s.hostRid, "/storage-events"), reqBody); err != nil {
+		log.Printf("Failed to report storage events (%d queued): %v", len(events), err)
+		recordCollectorError("storage", err)
+		s.pendingEvents = retainEvents("storage", events)
+		return
+	}
+	s.pendingEvents = nil
+	log.Printf("Reported %d storage events successfully", len(events))
+}
+
+// runStorageCommand runs a zpool, LVM or mdadm command in the C locale, so its output
+// parses the same everywhere
+func runStorageCommand(name string, args ...string) (string, error) {
+	return runCollectorCommand("storage", []string{"LC_ALL=C"}, name, args...)
+}
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// supervisePeriod is how often the supervisor checks collector progress
+	supervisePeriod = 30 * time.Second
+	// stallGrace is added to the expected interval so slow but healthy iterations are not
+	// mistaken for a stall
+	stallGrace = 10 * time.Minute
+	// stallIntervals is how many missed iterations count as a stall
+	stallIntervals = 3
+)
+
+// loopProgress records when each collector loop last completed an iteration
+var loopProgress = struct {
+	sync.Mutex
+	m map[string]loopLiveness
+}{m: make(map[string]loopLiveness)}
+
+// loopLiveness is a collector loop's last iteration and its expected interval
+type loopLiveness struct {
+	last     time.Time
+	interval time.Duration
+}
+
+// markProgress records that a collector loop completed an iteration; loops expected to
+// iterate every interval call it on start and after every iteration
+func markProgress(name string, interval time.Duration) {
+	loopProgress.Lock()
+	loopProgress.m[name] = loopLiveness{last: time.Now(), interval: interval}
+	loopProgress.Unlock()
+	recordCollectorRun(name)
+	settleErrorBudget(name)
+}
+
+// forgetProgress stops tracking a collector loop
+func forgetProgress(name string) {
+	loopProgress.Lock()
+	defer loopProgress.Unlock()
+	delete(loopProgress.m, name)
+}
+
+// stalledFor reports how long a collector loop has gone without progress, if that is
+// longer than its expected interval allows
+func stalledFor(name string, now time.Time) (time.Duration, bool) {
+	loopProgress.Lock()
+	entry, ok := loopProgress.m[name]
+	loopProgress.Unlock()
+	if !ok {
+		return 0, false
+	}
+
+	// Intervals are stretched while the server asks agents to back off, and while the
+	// collector is over its error budget
+	interval := entry.interval * time.Duration(serverBackpressure.currentFactor())
+	if backoff, ok := collectorBackoff(name); ok {
+		interval = max(interval, backoff)
+	}
+	limit := stallIntervals*interval + stallGrace
+	idle := now.Sub(entry.last)
+	return idle, idle > limit
+}
+
+// supervise restarts collectors whose loops stopped making progress until stop is closed
+func (m *CollectorManager) supervise(stop chan bool) {
+	defer recoverPanic("supervisor")
+	ticker := time.NewTicker(supervisePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.restartStalled()
+			m.reportHealthEvents(takeHealthEvents())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// restartStalled restarts every stalled collector. A wedged goroutine cannot be killed,
+// so it is abandoned and a fresh instance takes over; it exits once it gets unstuck.
+func (m *CollectorManager) restartStalled() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopped {
+		return
+	}
+
+	now := time.Now()
+	for _, spec := range collectorSpecs {
+		if _, ok := m.running[spec.name]; !ok {
+			continue
+		}
+		idle, stalled := stalledFor(spec.name, now)
+		if !stalled {
+			continue
+		}
+
+		log.Printf("Warning: %s made no progress for %s, restarting it", spec.name, idle.Round(time.Second))
+		m.stopLocked(spec.name)
+		m.startLocked(spec, m.config)
+		raiseHealthEvent(healthCollectorRestarted, severityWarning, spec.name, "no progress for "+idle.Round(time.Second).String(), nil)
+	}
+}
@@ -1,36 +1,93 @@
 package services
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"sprinter-agent/internal/config"
+	"sprinter-agent/internal/dbus"
+	"sprinter-agent/internal/execwrap"
 	"sprinter-agent/internal/generated"
 )
 
+// systemdInterval is how often systemd services are reported
+const systemdInterval = 5 * time.Second
+
 // SystemdMonitorService handles monitoring and reporting systemd services
 type SystemdMonitorService struct {
 	config   *config.Config
 	client   *generated.ClientWithResponses
 	hostRid  string
 	stopChan chan bool
+
+	// lastUsage holds the previous cgroup sample per unit for computing CPU percent and rates
+	lastUsage map[string]cgroupSample
+
+	// lastActive holds each unit's active state from the previous poll, nil before the first
+	lastActive map[string]string
+	dedup      *eventDeduper[ServiceStateEvent]
+	// pendingEvents failed to send and are resent with the next state changes
+	pendingEvents []ServiceStateEvent
+
+	lastAvailabilityReport time.Time
+}
+
+// cpuSample is a cumulative cgroup CPU reading taken at a point in time
+type cpuSample struct {
+	usageUsec uint64
+	takenAt   time.Time
+}
+
+// SystemdServiceEntry is a systemd unit with its cgroup resource usage
+type SystemdServiceEntry struct {
+	generated.SystemdUnit
+	Resources *CgroupUsage `json:"resources,omitempty"`
+}
+
+// SystemdServicesReport is the services report including resource usage
+type SystemdServicesReport struct {
+	Services []SystemdServiceEntry `json:"services"`
+}
+
+// ServiceStateEvent is a change of a unit's active state between two polls
+type ServiceStateEvent struct {
+	EventID   string `json:"event_id"`
+	Unit      string `json:"unit"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Timestamp string `json:"timestamp"`
+	// Result is systemd's reason for a failure, such as oom-kill, core-dump or exit-code
+	Result      string `json:"result,omitempty"`
+	Maintenance string `json:"maintenance,omitempty"`
+	EventOccurrences
+}
+
+// ServiceEventsReport is the payload sent to the service events endpoint
+type ServiceEventsReport struct {
+	Events []ServiceStateEvent `json:"events"`
 }
 
 // NewSystemdMonitorService creates a new systemd monitor service
 func NewSystemdMonitorService(cfg *config.Config, apiClient *generated.ClientWithResponses, hostRid string) *SystemdMonitorService {
 	return &SystemdMonitorService{
-		config:   cfg,
-		client:   apiClient,
-		hostRid:  hostRid,
-		stopChan: make(chan bool),
+		config:    cfg,
+		client:    apiClient,
+		hostRid:   hostRid,
+		stopChan:  make(chan bool),
+		lastUsage: make(map[string]cgroupSample),
+		dedup:     newEventDeduper[ServiceStateEvent](dedupWindow(cfg)),
+
+		lastAvailabilityReport: time.Now(),
 	}
 }
 
@@ -58,17 +115,28 @@ func (s *SystemdMonitorService) Stop() {
 
 // monitorLoop runs the periodic monitoring loop
 func (s *SystemdMonitorService) monitorLoop() {
-	ticker := time.NewTicker(5 * time.Second)
+	defer recoverPanic("systemd")
+	ticker := newCollectorTicker("systemd", systemdInterval)
 	defer ticker.Stop()
 
+	markProgress("systemd", systemdInterval)
 	// Run immediately on start
 	s.reportSystemdServices()
+	if finishedOnce("systemd") {
+		return
+	}
 
 	for {
 		select {
 		case <-ticker.C:
 			s.reportSystemdServices()
+			markProgress("systemd", systemdInterval)
 		case <-s.stopChan:
+			if s.config.Systemd.Availability.Enabled {
+				if err := unitAvailability().save(); err != nil {
+					log.Printf("Warning: failed to save unit availability: %v", err)
+				}
+			}
 			return
 		}
 	}
@@ -78,48 +146,183 @@ func (s *SystemdMonitorService) monitorLoop() {
 func (s *SystemdMonitorService) reportSystemdServices() {
 	services, err := s.getSystemdServices()
 	if err != nil {
-		log.Printf("ERROR: Failed to get systemd services: %v", err)
-		// Check if it's a permission error
-		var exitError *exec.ExitError
-		if errors.As(err, &exitError) {
-			if exitError.ExitCode() == 1 {
-				log.Printf("ERROR: systemctl command failed with exit code 1 - this may indicate permission issues")
-				log.Printf("ERROR: Current user: %s, UID: %d, GID: %d", os.Getenv("USER"), os.Getuid(), os.Getgid())
-				if stderr := string(exitError.Stderr); stderr != "" {
-					log.Printf("ERROR: systemctl stderr: %s", stderr)
-				}
-				log.Printf("ERROR: Suggestion: Ensure the service is running with appropriate permissions (may need to run as root or add user to systemd-journal group)")
+		if isPermissionError(err) {
+			if setPermissionProblem("systemd", CollectorSkipped, "permission denied listing systemd units") {
+				log.Printf("Systemd monitoring skipped due to permissions: %v", err)
 			}
-		}
-		// Check for permission denied errors
-		if errors.Is(err, os.ErrPermission) || strings.Contains(err.Error(), "permission denied") {
-			log.Printf("ERROR: Permission denied accessing systemd - ensure the process has appropriate permissions")
+		} else {
+			setCollectorStatus("systemd", CollectorError, err.Error())
+			log.Printf("Failed to get systemd services: %v", err)
+			recordCollectorError("systemd", err)
 		}
 		// Send empty list if systemd doesn't exist or fails
 		services = []generated.SystemdUnit{}
+	} else {
+		setCollectorStatus("systemd", CollectorRunning, "")
+		s.reportStateChanges(services)
+		s.remediate(services, time.Now())
+		s.reportRemediation()
+		// The collect command sees a single poll, which observes no time
+		if s.config.Systemd.Availability.Enabled && !oneShotMode() {
+			now := time.Now()
+			unitAvailability().observe(&s.config.Systemd.Availability, services, now)
+			s.reportAvailability(now)
+		}
+	}
+
+	ctx := context.Background()
+
+	if s.config.Systemd.ResourceUsage && cgroupV2Available() && len(services) > 0 {
+		report := SystemdServicesReport{
+			Services: s.attachResourceUsage(services),
+		}
+		if err := submitReport(ctx, s.config, http.MethodPut, hostPath(s.hostRid, "/systemd-services"), report); err != nil {
+			log.Printf("Failed to report systemd services: %v", err)
+			recordCollectorError("systemd", err)
+			return
+		}
+		log.Printf("Reported %d systemd services with resource usage successfully", len(services))
+		return
 	}
 
 	reqBody := generated.SystemdServicesRequest{
 		Services: services,
 	}
 
-	ctx := context.Background()
-	resp, err := s.client.PutApiV1HostsHostRidSystemdServicesWithResponse(ctx, generated.HostRid(s.hostRid), reqBody)
+	// Folded into the bulk report when one is running, published to the MQTT broker, or
+	// handed to the collect command's sink
+	if bulkReportingActive() || currentMQTT() != nil || currentReportSink() != nil {
+		err = submitReport(ctx, s.config, http.MethodPut, hostPath(s.hostRid, "/systemd-services"), reqBody)
+	} else {
+		err = s.putSystemdServices(ctx, reqBody)
+	}
 	if err != nil {
 		log.Printf("Failed to report systemd services: %v", err)
+		recordCollectorError("systemd", err)
 		return
 	}
 
-	if resp.StatusCode() != http.StatusOK {
-		log.Printf("Failed to report systemd services: status %d", resp.StatusCode())
+	log.Printf("Reported %d systemd services successfully", len(services))
+}
+
+// reportStateChanges sends an event for every unit whose active state changed since the
+// previous poll, coalescing a flapping unit into one event per deduplication window
+func (s *SystemdMonitorService) reportStateChanges(services []generated.SystemdUnit) {
+	current := make(map[string]string, len(services))
+	for _, service := range services {
+		current[service.Unit] = service.Active
+	}
+	previous := s.lastActive
+	s.lastActive = current
+	if previous == nil {
 		return
 	}
 
-	log.Printf("Reported %d systemd services successfully", len(services))
+	now := time.Now()
+	events := []ServiceStateEvent{}
+	results := failureResults(current, previous)
+	observe := func(unit, from, to string) {
+		event := ServiceStateEvent{
+			Unit:      unit,
+			From:      from,
+			To:        to,
+			Timestamp: now.UTC().Format(time.RFC3339),
+		}
+		if to == "failed" {
+			event.Result = results[unit]
+		}
+		event.Maintenance = maintenanceTag(now)
+		event.EventID = eventID("service_state", unit, from, to, now.UTC().Format(time.RFC3339Nano))
+		if s.dedup.Observe(unit+"\x00"+from+"\x00"+to, event, now) {
+			events = append(events, event)
+		}
+	}
+	// Inactive units are not listed, so a unit that disappeared has stopped
+	for unit, state := range current {
+		from, ok := previous[unit]
+		if !ok {
+			from = "inactive"
+		}
+		if from != state {
+			observe(unit, from, state)
+		}
+	}
+	for unit, state := range previous {
+		if _, ok := current[unit]; !ok {
+			observe(unit, state, "inactive")
+		}
+	}
+	for _, summary := range s.dedup.Flush(now) {
+		event := summary.Event
+		event.EventOccurrences = summary.occurrences()
+		events = append(events, event)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Unit < events[j].Unit
+	})
+	// Earlier changes that failed to send go first, keeping each unit's changes in order
+	events = append(s.pendingEvents, events...)
+	if len(events) == 0 {
+		return
+	}
+
+	reqBody := ServiceEventsReport{Events: events}
+	if err := submitReport(context.Background(), s.config, http.MethodPost, hostPath(s.hostRid, "/service-events"), reqBody); err != nil {
+		log.Printf("Failed to report service state changes (%d queued): %v", len(events), err)
+		recordCollectorError("systemd", err)
+		s.pendingEvents = retainEvents("service state", events)
+		return
+	}
+	s.pendingEvents = nil
+	log.Printf("Reported %d service state changes successfully", len(events))
+}
+
+// failureResults returns why each newly failed unit failed, so an OOM kill or a crash
+// can be told from a clean error exit
+func failureResults(current, previous map[string]string) map[string]string {
+	var failed []string
+	for unit, state := range current {
+		if state == "failed" && previous[unit] != "failed" {
+			failed = append(failed, unit)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	props, err := systemctlShow(failed, []string{"Id", "Result"})
+	if err != nil {
+		return nil
+	}
+	results := make(map[string]string, len(props))
+	for unit, values := range props {
+		results[unit] = values["Result"]
+	}
+	return results
+}
+
+// putSystemdServices reports services with the generated client
+func (s *SystemdMonitorService) putSystemdServices(ctx context.Context, reqBody generated.SystemdServicesRequest) error {
+	resp, err := s.client.PutApiV1HostsHostRidSystemdServicesWithResponse(ctx, generated.HostRid(s.hostRid), reqBody)
+	if isDecodeError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !isSuccess(resp.StatusCode()) {
+		return fmt.Errorf("status %d", resp.StatusCode())
+	}
+	return nil
 }
 
-// getSystemdServices reads systemd services from the system
+// getSystemdServices reads systemd services from the system, preferring D-Bus
+// since it works without root
 func (s *SystemdMonitorService) getSystemdServices() ([]generated.SystemdUnit, error) {
+	if services, err := listServicesDBus(); err == nil {
+		return services, nil
+	}
+
 	// Check if systemctl exists
 	if _, err := exec.LookPath("systemctl"); err != nil {
 		log.Println("systemctl not found - returning empty list")
@@ -127,50 +330,29 @@ func (s *SystemdMonitorService) getSystemdServices() ([]generated.SystemdUnit, e
 	}
 
 	// Run systemctl list-units command
-	cmd := exec.Command("systemctl", "list-units", "--type=service", "--no-pager", "--no-legend")
-	
-	// Capture both stdout and stderr for better error reporting
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	
-	output, err := cmd.Output()
+	output, err := execwrap.Output(context.Background(), execwrap.Options{}, "systemctl", "list-units", "--type=service", "--no-pager", "--no-legend")
 	if err != nil {
-		// Get stderr output if available
-		stderrStr := strings.TrimSpace(stderr.String())
-		
-		// Check for specific error types
+		// Check for permission-related exit codes
 		var exitError *exec.ExitError
-		if errors.As(err, &exitError) {
-			exitCode := exitError.ExitCode()
-			errMsg := fmt.Sprintf("systemctl command failed with exit code %d", exitCode)
-			if stderrStr != "" {
-				errMsg += fmt.Sprintf(": %s", stderrStr)
-			}
-			
-			// Check for permission-related exit codes
-			if exitCode == 1 {
-				errMsg += " (likely permission issue - systemctl may require elevated privileges)"
-			}
-			
-			return nil, fmt.Errorf("failed to run systemctl: %s: %w", errMsg, err)
+		if errors.As(err, &exitError) && exitError.ExitCode() == 1 {
+			return nil, fmt.Errorf("%w (likely permission issue - systemctl may require elevated privileges)", err)
 		}
-		
+
 		// Check for permission denied
 		if errors.Is(err, os.ErrPermission) || strings.Contains(err.Error(), "permission denied") {
 			return nil, fmt.Errorf("permission denied running systemctl (current user: %s, UID: %d): %w", os.Getenv("USER"), os.Getuid(), err)
 		}
-		
-		// Generic error
-		if stderrStr != "" {
-			return nil, fmt.Errorf("failed to run systemctl (stderr: %s): %w", stderrStr, err)
-		}
-		return nil, fmt.Errorf("failed to run systemctl: %w", err)
+		return nil, err
 	}
 
-	// Parse the output
+	return parseSystemctlUnits(string(output)), nil
+}
+
+// parseSystemctlUnits parses the output of systemctl list-units --no-legend
+func parseSystemctlUnits(output string) []generated.SystemdUnit {
 	// systemctl output format: UNIT LOAD ACTIVE SUB DESCRIPTION
 	// Fields are separated by multiple spaces
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	lines := strings.Split(strings.TrimSpace(output), "\n")
 	services := make([]generated.SystemdUnit, 0, len(lines))
 
 	for _, line := range lines {
@@ -212,6 +394,155 @@ func (s *SystemdMonitorService) getSystemdServices() ([]generated.SystemdUnit, e
 		})
 	}
 
-	return services, nil
+	return services
 }
 
+
+
+// attachResourceUsage reads the cgroup of every active unit and pairs it with the unit
+func (s *SystemdMonitorService) attachResourceUsage(services []generated.SystemdUnit) []SystemdServiceEntry {
+	entries := make([]SystemdServiceEntry, len(services))
+	active := make([]string, 0, len(services))
+	for i, service := range services {
+		entries[i] = SystemdServiceEntry{SystemdUnit: service}
+		if service.Active == "active" {
+			active = append(active, service.Unit)
+		}
+	}
+
+	props, err := systemctlShow(active, []string{"Id", "ControlGroup", "IPIngressBytes", "IPEgressBytes"})
+	if err != nil {
+		log.Printf("Failed to look up unit cgroups: %v", err)
+		return entries
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool, len(props))
+	for i := range entries {
+		unit := entries[i].Unit
+		values, ok := props[unit]
+		if !ok || values["ControlGroup"] == "" {
+			continue
+		}
+
+		usage, err := readCgroupUsage(values["ControlGroup"])
+		if err != nil {
+			continue
+		}
+		usage.NetReceivedBytes = ipAccountingBytes(values["IPIngressBytes"])
+		usage.NetSentBytes = ipAccountingBytes(values["IPEgressBytes"])
+
+		if prev, ok := s.lastUsage[unit]; ok {
+			usage.applyRates(prev, now)
+		}
+		s.lastUsage[unit] = cgroupSample{usage: *usage, takenAt: now}
+		seen[unit] = true
+
+		entries[i].Resources = usage
+	}
+
+	// Forget units that have gone away so the map does not grow forever
+	for unit := range s.lastUsage {
+		if !seen[unit] {
+			delete(s.lastUsage, unit)
+		}
+	}
+
+	return entries
+}
+
+// ipAccountingBytes parses an IPIngressBytes or IPEgressBytes property, which is
+// "[no data]", or the largest uint64 on older systemd, when IPAccounting= is off
+func ipAccountingBytes(value string) *uint64 {
+	count, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || count == math.MaxUint64 {
+		return nil
+	}
+	return &count
+}
+
+// getUnitCgroups returns the control group path of each unit, relative to the cgroup root
+func getUnitCgroups(units []string) (map[string]string, error) {
+	props, err := systemctlShow(units, []string{"Id", "ControlGroup"})
+	if err != nil {
+		return nil, err
+	}
+
+	cgroups := make(map[string]string, len(props))
+	for id, values := range props {
+		cgroups[id] = values["ControlGroup"]
+	}
+	return cgroups, nil
+}
+
+// systemctlShow returns the requested properties of each unit, keyed by unit Id
+func systemctlShow(units []string, properties []string, extraArgs ...string) (map[string]map[string]string, error) {
+	result := make(map[string]map[string]string, len(units))
+	if len(units) == 0 {
+		return result, nil
+	}
+
+	args := []string{"show", "--property=" + strings.Join(properties, ",")}
+	args = append(args, extraArgs...)
+	args = append(args, "--")
+	args = append(args, units...)
+	output, err := execwrap.Output(context.Background(), execwrap.Options{}, "systemctl", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run systemctl show: %w", err)
+	}
+
+	// Output is one block of KEY=VALUE lines per unit, separated by blank lines
+	block := make(map[string]string)
+	flush := func() {
+		if id := block["Id"]; id != "" {
+			result[id] = block
+		}
+		block = make(map[string]string)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			flush()
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			block[key] = value
+		}
+	}
+	flush()
+
+	return result, nil
+}
+
+// listServicesDBus lists the non-inactive service units over the system bus,
+// matching the default output of systemctl list-units --type=service
+func listServicesDBus() ([]generated.SystemdUnit, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	units, err := conn.ListUnits()
+	if err != nil {
+		return nil, err
+	}
+
+	services := make([]generated.SystemdUnit, 0, len(units))
+	for _, unit := range units {
+		if !strings.HasSuffix(unit.Name, ".service") || unit.ActiveState == "inactive" {
+			continue
+		}
+		services = append(services, generated.SystemdUnit{
+			Unit:        unit.Name,
+			Load:        unit.LoadState,
+			Active:      unit.ActiveState,
+			Sub:         unit.SubState,
+			Description: unit.Description,
+		})
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Unit < services[j].Unit
+	})
+	return services, nil
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// lineReader returns lines appended to a log since the previous call
+type lineReader interface {
+	ReadLines() ([]string, error)
+	Close() error
+}
+
+// fileTailer reads lines appended to a file, following it across rotation
+type fileTailer struct {
+	path    string
+	file    *os.File
+	reader  *bufio.Reader
+	inode   uint64
+	offset  int64
+	partial string
+}
+
+// newFileTailer creates a tailer positioned at the current end of the file
+func newFileTailer(path string) *fileTailer {
+	t := &fileTailer{path: path}
+	if err := t.open(true); err != nil {
+		// The file may not exist yet; ReadLines retries on every call
+		t.file = nil
+	}
+	return t
+}
+
+// open (re)opens the file, optionally seeking to its end
+func (t *fileTailer) open(seekEnd bool) error {
+	file, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	t.offset = 0
+	if seekEnd {
+		if t.offset, err = file.Seek(0, io.SeekEnd); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	t.file = file
+	t.reader = bufio.NewReader(file)
+	t.inode = fileInode(info)
+	t.partial = ""
+	return nil
+}
+
+// ReadLines returns all complete lines appended since the previous call
+func (t *fileTailer) ReadLines() ([]string, error) {
+	if t.file == nil {
+		// A file that appears after startup is read from the beginning
+		if err := t.open(false); err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+	} else if t.rotated() {
+		t.file.Close()
+		if err := t.open(false); err != nil {
+			t.file = nil
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+
+	lines := []string{}
+	for {
+		chunk, err := t.reader.ReadString('\n')
+		t.offset += int64(len(chunk))
+		if err != nil {
+			// Keep incomplete trailing data until the writer finishes the line
+			t.partial += chunk
+			if err == io.EOF {
+				return lines, nil
+			}
+			return lines, err
+		}
+		lines = append(lines, t.partial+chunk[:len(chunk)-1])
+		t.partial = ""
+	}
+}
+
+// rotated reports whether the path now refers to a different or truncated file
+func (t *fileTailer) rotated() bool {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return false
+	}
+	return fileInode(info) != t.inode || info.Size() < t.offset
+}
+
+// Close closes the underlying file
+func (t *fileTailer) Close() error {
+	if t.file == nil {
+		return nil
+	}
+	return t.file.Close()
+}
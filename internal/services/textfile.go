@@ -0,0 +1,200 @@
+//go:build !minimal && !no_textfile
+
+package services
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// promSample is a sample of a file in the Prometheus text format
+type promSample struct {
+	Name string
+	// Type is "counter" or "gauge", from the TYPE line of the sample's family
+	Type   string
+	Labels map[string]string
+	Value  float64
+	// Timestamp is zero when the sample has none
+	Timestamp time.Time
+}
+
+// promTypes are the metric types a TYPE line may declare
+var promTypes = map[string]bool{"counter": true, "gauge": true, "histogram": true, "summary": true, "untyped": true}
+
+// parsePromText parses the Prometheus text format. HELP lines and other comments are
+// skipped. Any malformed line fails the whole file, as it does for node_exporter, so a
+// half-written file is never forwarded in part.
+func parsePromText(data string) ([]promSample, error) {
+	types := make(map[string]string)
+	var samples []promSample
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line[1:])
+			if len(fields) == 0 || fields[0] != "TYPE" {
+				continue
+			}
+			if len(fields) != 3 || !promTypes[fields[2]] {
+				return nil, fmt.Errorf("line %d: expected # TYPE <name> counter|gauge|histogram|summary|untyped", i+1)
+			}
+			if _, ok := types[fields[1]]; ok {
+				return nil, fmt.Errorf("line %d: second TYPE line for %s", i+1, fields[1])
+			}
+			types[fields[1]] = fields[2]
+			continue
+		}
+
+		sample, err := parsePromSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		sample.Type = promSampleType(types, sample.Name)
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// promSampleType maps the declared type of a sample's family to counter or gauge. The
+// buckets, sums and counts of histograms and summaries only grow, so they are counters;
+// quantiles are gauges. A counter family may name its samples with a _total suffix.
+func promSampleType(types map[string]string, name string) string {
+	switch types[name] {
+	case "counter":
+		return "counter"
+	case "gauge", "untyped", "summary":
+		return "gauge"
+	}
+	if family, ok := strings.CutSuffix(name, "_total"); ok && types[family] == "counter" {
+		return "counter"
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		family, ok := strings.CutSuffix(name, suffix)
+		if !ok {
+			continue
+		}
+		if t := types[family]; t == "histogram" || t == "summary" {
+			return "counter"
+		}
+	}
+	return "gauge"
+}
+
+// parsePromSample parses a line of the form name{label="value",...} value [timestamp]
+func parsePromSample(line string) (promSample, error) {
+	var sample promSample
+	end := promNameEnd(line, true)
+	if end == 0 {
+		return sample, fmt.Errorf("invalid metric name in %q", line)
+	}
+	sample.Name, line = line[:end], line[end:]
+
+	if strings.HasPrefix(line, "{") {
+		labels, rest, err := parsePromLabels(line[1:])
+		if err != nil {
+			return sample, fmt.Errorf("%s: %w", sample.Name, err)
+		}
+		sample.Labels, line = labels, rest
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 || len(fields) > 2 {
+		return sample, fmt.Errorf("%s: expected a value and an optional timestamp", sample.Name)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return sample, fmt.Errorf("%s: invalid value %q", sample.Name, fields[0])
+	}
+	sample.Value = value
+	if len(fields) == 2 {
+		ms, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return sample, fmt.Errorf("%s: invalid timestamp %q", sample.Name, fields[1])
+		}
+		sample.Timestamp = time.UnixMilli(ms).UTC()
+	}
+	return sample, nil
+}
+
+// parsePromLabels parses the labels after the opening brace, returning what follows the
+// closing one
+func parsePromLabels(line string) (map[string]string, string, error) {
+	labels := make(map[string]string)
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if strings.HasPrefix(line, "}") {
+			return labels, line[1:], nil
+		}
+		end := promNameEnd(line, false)
+		if end == 0 {
+			return nil, "", fmt.Errorf("invalid label name in %q", line)
+		}
+		name := line[:end]
+		if _, ok := labels[name]; ok {
+			return nil, "", fmt.Errorf("duplicate label %s", name)
+		}
+		line = strings.TrimLeft(line[end:], " \t")
+		if !strings.HasPrefix(line, "=") {
+			return nil, "", fmt.Errorf("expected = after label %s", name)
+		}
+		line = strings.TrimLeft(line[1:], " \t")
+		if !strings.HasPrefix(line, `"`) {
+			return nil, "", fmt.Errorf("expected a quoted value for label %s", name)
+		}
+
+		var value strings.Builder
+		closed := false
+		i := 1
+		for ; i < len(line); i++ {
+			c := line[i]
+			if c == '"' {
+				closed = true
+				break
+			}
+			if c == '\\' && i+1 < len(line) {
+				i++
+				switch line[i] {
+				case 'n':
+					value.WriteByte('\n')
+				case '\\', '"':
+					value.WriteByte(line[i])
+				default:
+					return nil, "", fmt.Errorf("invalid escape \\%c in label %s", line[i], name)
+				}
+				continue
+			}
+			value.WriteByte(c)
+		}
+		if !closed {
+			return nil, "", fmt.Errorf("unterminated value for label %s", name)
+		}
+		labels[name] = value.String()
+
+		line = strings.TrimLeft(line[i+1:], " \t")
+		if strings.HasPrefix(line, ",") {
+			line = line[1:]
+		} else if !strings.HasPrefix(line, "}") {
+			return nil, "", fmt.Errorf("expected , or } after label %s", name)
+		}
+	}
+}
+
+// promNameEnd returns the length of the metric or label name line starts with, 0 when it
+// does not start with one. Only metric names may contain colons.
+func promNameEnd(line string, metric bool) int {
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c == ':' && metric:
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return i
+		}
+	}
+	return len(line)
+}
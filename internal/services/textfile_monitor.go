@@ -0,0 +1,224 @@
+//go:build !minimal && !no_textfile
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// TextfileStatus is what became of one .prom file
+type TextfileStatus struct {
+	File       string    `json:"file"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Samples    int       `json:"samples"`
+	// Skipped counts samples with NaN or infinite values, which cannot be sent as JSON
+	Skipped int `json:"skipped,omitempty"`
+	// Error is why the file was left out, such as a syntax error
+	Error string `json:"error,omitempty"`
+}
+
+// TextfileReport is the payload sent to the textfile metrics endpoint. It replaces the
+// previous one, so samples of a file that was removed disappear.
+type TextfileReport struct {
+	Files   []TextfileStatus `json:"files"`
+	Metrics []CustomMetric   `json:"metrics"`
+}
+
+// TextfileMonitorService forwards the metrics that scripts and cron jobs write to .prom
+// files in the textfile directory
+type TextfileMonitorService struct {
+	config   *config.Config
+	hostRid  string
+	stopChan chan bool
+	started  bool
+	// problems holds the error of each file at the last scrape, so a broken file is
+	// logged once rather than every interval
+	problems map[string]string
+}
+
+// NewTextfileMonitorService creates a new textfile monitor service
+func NewTextfileMonitorService(cfg *config.Config, hostRid string) *TextfileMonitorService {
+	return &TextfileMonitorService{
+		config:   cfg,
+		hostRid:  hostRid,
+		stopChan: make(chan bool),
+		problems: make(map[string]string),
+	}
+}
+
+// init registers the collector, unless built with no_textfile
+func init() {
+	registerCollector("textfile", func(m *CollectorManager, c *config.Config) Collector {
+		return NewTextfileMonitorService(c, m.hostRid)
+	})
+}
+
+// Start begins reading the textfile directory periodically
+func (s *TextfileMonitorService) Start() error {
+	if !s.config.Textfile.Enabled {
+		log.Println("Textfile collector not enabled - skipping")
+		setCollectorStatus("textfile", CollectorDisabled, "")
+		return nil
+	}
+	if s.hostRid == "" {
+		log.Println("Host RID not set - skipping textfile collector")
+		return nil
+	}
+
+	s.started = true
+	go s.monitorLoop()
+
+	setCollectorStatus("textfile", CollectorRunning, "")
+	log.Printf("Textfile collector started, reading %s", s.config.Textfile.Directory)
+	return nil
+}
+
+// Stop stops the collector
+func (s *TextfileMonitorService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("Textfile collector stopped")
+	}
+}
+
+// monitorLoop reads the directory at the configured interval
+func (s *TextfileMonitorService) monitorLoop() {
+	defer recoverPanic("textfile")
+	ticker := newCollectorTicker("textfile", s.config.Textfile.Interval)
+	defer ticker.Stop()
+
+	markProgress("textfile", s.config.Textfile.Interval)
+	// Run immediately on start
+	s.reportTextfiles()
+	if finishedOnce("textfile") {
+		return
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reportTextfiles()
+			markProgress("textfile", s.config.Textfile.Interval)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// reportTextfiles reads every .prom file and reports their samples
+func (s *TextfileMonitorService) reportTextfiles() {
+	dir := s.config.Textfile.Directory
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			// Scripts may create it later; it is read again every interval
+			setCollectorStatus("textfile", CollectorSkipped, fmt.Sprintf("directory %s does not exist", dir))
+		case isPermissionError(err):
+			if setPermissionProblem("textfile", CollectorSkipped, "permission denied reading "+dir) {
+				log.Printf("Textfile collector skipped due to permissions: %v", err)
+			}
+		default:
+			setCollectorStatus("textfile", CollectorError, err.Error())
+			log.Printf("Failed to read textfile directory: %v", err)
+			recordCollectorError("textfile", err)
+		}
+		return
+	}
+	setCollectorStatus("textfile", CollectorRunning, "")
+
+	report := TextfileReport{Files: []TextfileStatus{}, Metrics: []CustomMetric{}}
+	problems := make(map[string]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		// Scripts write to a hidden or differently named file and rename it into place
+		if !strings.HasSuffix(name, ".prom") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		status, metrics := s.readTextfile(filepath.Join(dir, name), len(report.Metrics))
+		if status.Error != "" {
+			problems[name] = status.Error
+			if s.problems[name] != status.Error {
+				log.Printf("Leaving out textfile %s: %s", name, status.Error)
+			}
+		}
+		report.Files = append(report.Files, status)
+		report.Metrics = append(report.Metrics, metrics...)
+	}
+	s.problems = problems
+
+	if err := submitReport(context.Background(), s.config, http.MethodPut, hostPath(s.hostRid, "/textfile-metrics"), report); err != nil {
+		log.Printf("Failed to report textfile metrics: %v", err)
+		recordCollectorError("textfile", err)
+		return
+	}
+	log.Printf("Reported %d textfile metrics from %d files successfully", len(report.Metrics), len(report.Files))
+}
+
+// readTextfile parses one file into metrics, given how many samples earlier files used
+// of max_samples. A file that fails to parse or does not fit is left out whole.
+func (s *TextfileMonitorService) readTextfile(path string, used int) (TextfileStatus, []CustomMetric) {
+	status := TextfileStatus{File: filepath.Base(path)}
+	info, err := os.Stat(path)
+	if err != nil {
+		status.Error = err.Error()
+		return status, nil
+	}
+	status.ModifiedAt = info.ModTime().UTC()
+	if !info.Mode().IsRegular() {
+		status.Error = "not a regular file"
+		return status, nil
+	}
+	if limit := int64(s.config.Textfile.MaxFileKB) * 1024; info.Size() > limit {
+		status.Error = fmt.Sprintf("larger than max_file_kb (%d KB)", s.config.Textfile.MaxFileKB)
+		return status, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		status.Error = err.Error()
+		return status, nil
+	}
+	samples, err := parsePromText(string(data))
+	if err != nil {
+		status.Error = err.Error()
+		return status, nil
+	}
+	if used+len(samples) > s.config.Textfile.MaxSamples {
+		status.Error = fmt.Sprintf("%d samples would exceed max_samples (%d)", len(samples), s.config.Textfile.MaxSamples)
+		return status, nil
+	}
+
+	metrics := make([]CustomMetric, 0, len(samples))
+	for _, sample := range samples {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			status.Skipped++
+			continue
+		}
+		// Samples without a timestamp are as old as the file
+		timestamp := sample.Timestamp
+		if timestamp.IsZero() {
+			timestamp = status.ModifiedAt
+		}
+		metrics = append(metrics, CustomMetric{
+			Name:      sample.Name,
+			Type:      sample.Type,
+			Value:     sample.Value,
+			Labels:    sample.Labels,
+			Timestamp: timestamp,
+			Source:    status.File,
+		})
+	}
+	status.Samples = len(metrics)
+	return status, metrics
+}
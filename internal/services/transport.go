@@ -0,0 +1,108 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// apiIdleConnTimeout keeps idle connections open across heartbeats and collector intervals
+	apiIdleConnTimeout = 5 * time.Minute
+	// apiMaxConnsPerHost bounds concurrent connections; HTTP/2 multiplexes over one
+	apiMaxConnsPerHost = 4
+	apiRequestTimeout  = 10 * time.Second
+)
+
+// apiDialer opens connections to the Somana server, or to the proxy in front of it
+var apiDialer = &net.Dialer{
+	Timeout:   10 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// apiTransport is the connection pool shared by every request to the Somana server, so
+// long-lived agents keep one persistent connection instead of reconnecting per call
+var apiTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           countingDialer(DialServer),
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          apiMaxConnsPerHost,
+	MaxIdleConnsPerHost:   apiMaxConnsPerHost,
+	MaxConnsPerHost:       apiMaxConnsPerHost,
+	IdleConnTimeout:       apiIdleConnTimeout,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: time.Second,
+	TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
+}
+
+// newAPIClient returns a client for the Somana API sharing apiTransport
+func newAPIClient() *http.Client {
+	return &http.Client{
+		Timeout:   apiRequestTimeout,
+		Transport: &backpressureTransport{base: &statsTransport{base: &signingTransport{base: apiTransport}}},
+	}
+}
+
+// TransportStats are counters of the shared API transport, reported in agent self-metrics
+type TransportStats struct {
+	Requests       uint64 `json:"requests"`
+	Errors         uint64 `json:"errors"`
+	Dials          uint64 `json:"dials"`
+	ReusedConns    uint64 `json:"reused_conns"`
+	HTTP2Responses uint64 `json:"http2_responses"`
+}
+
+var transportStats struct {
+	requests, errors, dials, reused, http2 atomic.Uint64
+}
+
+// currentTransportStats returns a snapshot of the transport counters
+func currentTransportStats() TransportStats {
+	return TransportStats{
+		Requests:       transportStats.requests.Load(),
+		Errors:         transportStats.errors.Load(),
+		Dials:          transportStats.dials.Load(),
+		ReusedConns:    transportStats.reused.Load(),
+		HTTP2Responses: transportStats.http2.Load(),
+	}
+}
+
+// countingDialer counts new connections opened by the transport
+func countingDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		transportStats.dials.Add(1)
+		return dial(ctx, network, addr)
+	}
+}
+
+// statsTransport records request, connection reuse and protocol counters
+type statsTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *statsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transportStats.requests.Add(1)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				transportStats.reused.Add(1)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		transportStats.errors.Add(1)
+		return nil, err
+	}
+	if resp.ProtoMajor == 2 {
+		transportStats.http2.Add(1)
+	}
+	return resp, nil
+}
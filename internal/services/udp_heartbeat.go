@@ -0,0 +1,322 @@
+package services
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"sprinter-agent/internal/config"
+)
+
+// heartbeatKeyPath holds the seed of the key UDP heartbeats are signed with
+const heartbeatKeyPath = "data/heartbeat.key"
+
+// udpHeartbeatMagic starts every datagram; the digit is the layout version
+const udpHeartbeatMagic = "SMH1"
+
+// Flags of a UDP heartbeat
+const (
+	// udpFlagHTTPSFailing is set while the last HTTPS heartbeat failed
+	udpFlagHTTPSFailing = 1 << iota
+	// udpFlagMaintenance is set during a maintenance window
+	udpFlagMaintenance
+)
+
+// Classes of the error that failed the last HTTPS heartbeat, so the server can tell
+// which part of the path is broken
+const (
+	httpsErrorNone byte = iota
+	httpsErrorDNS
+	httpsErrorConnect
+	httpsErrorProxy
+	httpsErrorTLS
+	httpsErrorTimeout
+	// httpsErrorHTTP means the server, or something posing as it, answered with an error status
+	httpsErrorHTTP
+	httpsErrorOther byte = 255
+)
+
+// noHTTPSSuccess is sent as the time since the last successful HTTPS heartbeat when this
+// run of the agent has had none
+const noHTTPSSuccess = math.MaxUint32
+
+// heartbeatKey is the agent's UDP heartbeat key, created on first use. Its public half is
+// sent with every HTTPS heartbeat so the server can pin it before it is ever needed.
+var heartbeatKey = sync.OnceValues(loadHeartbeatKey)
+
+// loadHeartbeatKey reads the saved key, or generates and saves one
+func loadHeartbeatKey() (ed25519.PrivateKey, error) {
+	seed, err := os.ReadFile(heartbeatKeyPath)
+	if err == nil {
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s is %d bytes, expected a %d-byte Ed25519 seed", heartbeatKeyPath, len(seed), ed25519.SeedSize)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read heartbeat key: %w", err)
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate heartbeat key: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(heartbeatKeyPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	tmp := heartbeatKeyPath + ".tmp"
+	if err := os.WriteFile(tmp, key.Seed(), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write heartbeat key: %w", err)
+	}
+	if err := os.Rename(tmp, heartbeatKeyPath); err != nil {
+		return nil, fmt.Errorf("failed to write heartbeat key: %w", err)
+	}
+	log.Printf("Generated UDP heartbeat key in %s", heartbeatKeyPath)
+	return key, nil
+}
+
+// udpHeartbeatPublicKey returns the public key to send with HTTPS heartbeats, or an empty
+// string when UDP heartbeats are disabled or the key is unavailable
+func udpHeartbeatPublicKey(cfg *config.Config) string {
+	if !cfg.UDPHeartbeat.Enabled {
+		return ""
+	}
+	key, err := heartbeatKey()
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// UDPHeartbeatService sends a small signed datagram to the server at every interval. It
+// needs neither TLS nor a proxy, so the server still sees the host while HTTPS is broken,
+// and the datagram says why the HTTPS heartbeat is failing.
+type UDPHeartbeatService struct {
+	config       *config.Config
+	registration *HostRegistrationService
+	key          ed25519.PrivateKey
+	stopChan     chan bool
+	started      bool
+	sequence     uint32
+	// lastAddr is the server's last resolved address, used while name resolution fails
+	lastAddr *net.UDPAddr
+	// lastError is the last send error, so a lasting failure is logged once
+	lastError string
+}
+
+// NewUDPHeartbeatService creates a new UDP heartbeat service
+func NewUDPHeartbeatService(cfg *config.Config, registration *HostRegistrationService) *UDPHeartbeatService {
+	return &UDPHeartbeatService{
+		config:       cfg,
+		registration: registration,
+		stopChan:     make(chan bool),
+	}
+}
+
+// Start begins sending datagrams
+func (s *UDPHeartbeatService) Start() error {
+	if !s.config.UDPHeartbeat.Enabled {
+		log.Println("UDP heartbeat not enabled - skipping")
+		return nil
+	}
+	key, err := heartbeatKey()
+	if err != nil {
+		return err
+	}
+	s.key = key
+
+	s.started = true
+	go s.sendLoop()
+
+	log.Printf("UDP heartbeat started, sending to %s every %v", s.config.UDPHeartbeat.Address, s.config.UDPHeartbeat.Interval)
+	return nil
+}
+
+// Stop stops sending datagrams
+func (s *UDPHeartbeatService) Stop() {
+	if s.started {
+		close(s.stopChan)
+		log.Println("UDP heartbeat stopped")
+	}
+}
+
+// sendLoop sends a datagram at the configured interval. The interval is not stretched
+// when the server asks for backoff, since datagrams bypass the HTTP path being throttled.
+func (s *UDPHeartbeatService) sendLoop() {
+	defer recoverPanic("udp heartbeat")
+	ticker := time.NewTicker(s.config.UDPHeartbeat.Interval)
+	defer ticker.Stop()
+
+	s.send()
+	for {
+		select {
+		case <-ticker.C:
+			s.send()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// send sends one datagram, unless only_on_failure is set and HTTPS heartbeats succeed
+func (s *UDPHeartbeatService) send() {
+	health := s.registration.Health()
+	if s.config.UDPHeartbeat.OnlyOnFailure && health.ConsecutiveFailures == 0 {
+		return
+	}
+
+	s.sequence++
+	datagram, err := s.datagram(health, time.Now())
+	if err == nil {
+		err = s.write(datagram)
+	}
+	if err != nil {
+		if err.Error() != s.lastError {
+			log.Printf("Failed to send UDP heartbeat: %v", err)
+		}
+		s.lastError = err.Error()
+		return
+	}
+	if s.lastError != "" {
+		log.Printf("UDP heartbeat sent successfully again")
+	}
+	s.lastError = ""
+}
+
+// datagram encodes and signs a heartbeat. The layout, with integers big-endian, is:
+//
+//	magic "SMH1" (4) | flags (1) | HTTPS error class (1) | Unix time (8) | sequence (4) |
+//	seconds since the last successful HTTPS heartbeat (4) | consecutive HTTPS failures (2) |
+//	RID length (1) | RID | Ed25519 signature of everything before it (64)
+func (s *UDPHeartbeatService) datagram(health RegistrationHealth, now time.Time) ([]byte, error) {
+	rid := health.HostRid
+	if rid == "" {
+		return nil, fmt.Errorf("host RID not set")
+	}
+	if len(rid) > math.MaxUint8 {
+		return nil, fmt.Errorf("host RID is %d bytes, longer than a datagram can carry", len(rid))
+	}
+
+	var flags byte
+	if health.ConsecutiveFailures > 0 {
+		flags |= udpFlagHTTPSFailing
+	}
+	if _, ok := CurrentMaintenance(); ok {
+		flags |= udpFlagMaintenance
+	}
+	since := uint32(noHTTPSSuccess)
+	if !health.LastHeartbeat.IsZero() {
+		since = uint32(min(now.Sub(health.LastHeartbeat).Seconds(), noHTTPSSuccess-1))
+	}
+
+	data := make([]byte, 0, 25+len(rid)+ed25519.SignatureSize)
+	data = append(data, udpHeartbeatMagic...)
+	data = append(data, flags, httpsErrorClass(s.registration.heartbeatError()))
+	data = binary.BigEndian.AppendUint64(data, uint64(now.Unix()))
+	data = binary.BigEndian.AppendUint32(data, s.sequence)
+	data = binary.BigEndian.AppendUint32(data, since)
+	data = binary.BigEndian.AppendUint16(data, uint16(min(health.ConsecutiveFailures, math.MaxUint16)))
+	data = append(data, byte(len(rid)))
+	data = append(data, rid...)
+	return append(data, ed25519.Sign(s.key, data)...), nil
+}
+
+// write sends a datagram to the server
+func (s *UDPHeartbeatService) write(datagram []byte) error {
+	addr, err := s.resolve()
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(datagram)
+	return err
+}
+
+// resolve returns the address datagrams go to. Broken name resolution is one of the
+// failures the datagrams report, so the last resolved address is kept for it.
+func (s *UDPHeartbeatService) resolve() (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(s.config.UDPHeartbeat.Address)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		u, err := url.Parse(s.config.HostRegistration.SprinterURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sprinter_url: %w", err)
+		}
+		host = u.Hostname()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.UDPHeartbeat.Interval)
+	defer cancel()
+	addrs, err := LookupHost(ctx, host)
+	if err == nil {
+		var addr *net.UDPAddr
+		if addr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(addrs[0], port)); err == nil {
+			s.lastAddr = addr
+			return addr, nil
+		}
+	}
+	if s.lastAddr != nil {
+		return s.lastAddr, nil
+	}
+	return nil, err
+}
+
+// httpsErrorClass classifies the error of a failed HTTPS heartbeat
+func httpsErrorClass(err error) byte {
+	if err == nil {
+		return httpsErrorNone
+	}
+	var statusErr *apiStatusError
+	if errors.As(err, &statusErr) || errors.Is(err, errIdentityConflict) {
+		return httpsErrorHTTP
+	}
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return httpsErrorOther
+	}
+
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var verification *tls.CertificateVerificationError
+	var recordHeader tls.RecordHeaderError
+	var alert tls.AlertError
+	var pinMismatch *PinMismatchError
+	switch {
+	case errors.As(err, &dnsErr):
+		return httpsErrorDNS
+	case errors.As(err, &opErr) && opErr.Op == "proxyconnect":
+		return httpsErrorProxy
+	case errors.As(err, &unknownAuthority), errors.As(err, &hostname), errors.As(err, &invalid),
+		errors.As(err, &verification), errors.As(err, &recordHeader), errors.As(err, &alert),
+		errors.As(err, &pinMismatch):
+		return httpsErrorTLS
+	case urlErr.Timeout():
+		return httpsErrorTimeout
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return httpsErrorConnect
+	}
+	return httpsErrorOther
+}